@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminKeyHeader is the request header administrative callers use to present
+// the shared admin key.
+const adminKeyHeader = "X-Admin-Key"
+
+// isAdmin returns whether the request was made by an administrative caller.
+// The admin key may also be sent as the password for basic auth, which is what
+// browsers using the admin web page do. Administrative access is disabled
+// entirely when no admin key is configured.
+func (u *UserPreferencesApp) isAdmin(r *http.Request) bool {
+	if u.adminKey == "" {
+		return false
+	}
+	provided := r.Header.Get(adminKeyHeader)
+	if provided == "" {
+		_, provided, _ = r.BasicAuth()
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(u.adminKey)) == 1
+}
+
+// adminOnly wraps a handler so that it responds with a 403 unless the request
+// was made by an administrative caller.
+func (u *UserPreferencesApp) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if !u.isAdmin(r) {
+			forbidden(writer, "This endpoint requires administrative access")
+			return
+		}
+		h(writer, r)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAdmin(t *testing.T) {
+	n := New(NewMockDB())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(adminKeyHeader, "")
+	if n.isAdmin(req) {
+		t.Error("an empty key was accepted when no admin key was configured")
+	}
+
+	n.adminKey = "secret"
+	if n.isAdmin(req) {
+		t.Error("an empty key was accepted")
+	}
+
+	req.Header.Set(adminKeyHeader, "wrong")
+	if n.isAdmin(req) {
+		t.Error("the wrong key was accepted")
+	}
+
+	req.Header.Set(adminKeyHeader, "secret")
+	if !n.isAdmin(req) {
+		t.Error("the correct key was rejected")
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+
+	called := false
+	handler := n.adminOnly(func(writer http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if called {
+		t.Error("the handler was called for a non-admin request")
+	}
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusForbidden)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(adminKeyHeader, "secret")
+	recorder = httptest.NewRecorder()
+	handler(recorder, req)
+	if !called {
+		t.Error("the handler was not called for an admin request")
+	}
+}
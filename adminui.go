@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// requestedWithHeader is the header the administrative web page sends with the
+// requests that change anything. Browsers don't let other sites set it without
+// the service's permission, so it shows that the request came from the page.
+const requestedWithHeader = "X-Requested-With"
+
+// adminUI wraps a handler for the administrative web page and its API so that
+// unauthenticated browsers are asked for credentials. The admin key is used as
+// the basic auth password; the username is ignored. Since browsers send the
+// basic auth credentials along with any request to the service, even one made
+// by another site, requests other than GET and HEAD are rejected unless they
+// have the X-Requested-With or X-Admin-Key header.
+func (u *UserPreferencesApp) adminUI(h http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if !u.isAdmin(r) {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="user-preferences admin"`)
+			http.Error(writer, "This page requires administrative access", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			r.Header.Get(requestedWithHeader) == "" && r.Header.Get(adminKeyHeader) == "" {
+			forbidden(writer, fmt.Sprintf("Requests that change preferences need the %s header", requestedWithHeader))
+			return
+		}
+		h(writer, r)
+	}
+}
+
+// AdminUIRedirect sends browsers to the page's canonical URL, which ends in a
+// slash so that the relative API URLs resolve. The Location is relative, and
+// set directly rather than with http.Redirect, so that tenant path prefixes
+// are kept.
+func (u *UserPreferencesApp) AdminUIRedirect(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Location", "ui/")
+	writer.WriteHeader(http.StatusMovedPermanently)
+}
+
+// AdminUIRequest serves the administrative web page.
+func (u *UserPreferencesApp) AdminUIRequest(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	writer.Header().Set("X-Frame-Options", "DENY")
+	writer.Write([]byte(adminUIPage))
+}
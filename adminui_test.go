@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdminUI(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"theme":"dark"}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	handler := n.router
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/ui/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("an unauthenticated request returned %d with %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/ui/", nil)
+	req.SetBasicAuth("ops", "wrong")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("a request with the wrong password returned %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/ui/", nil)
+	req.SetBasicAuth("ops", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<title>user-preferences admin</title>") {
+		t.Errorf("the page returned %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("the page's content type was %s", rec.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/ui", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "ui/" {
+		t.Errorf("the redirect returned %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestAdminUIAPI(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"theme":"dark"}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	base := server.URL + "/admin/ui/api/users/test-user"
+
+	status, _ := doRequest(t, http.MethodGet, base, nil, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("an unauthenticated API request returned %d", status)
+	}
+
+	auth := map[string]string{"Authorization": "Basic b3BzOnNlY3JldA=="}
+	status, body := doRequest(t, http.MethodGet, base, nil, auth)
+	if status != http.StatusOK || string(body) != `{"theme":"dark"}` {
+		t.Errorf("getting the preferences returned %d %s", status, body)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, base, []byte(`{"theme":"light"}`), auth)
+	if status != http.StatusForbidden {
+		t.Errorf("saving the preferences without the %s header returned %d", requestedWithHeader, status)
+	}
+
+	page := map[string]string{"Authorization": auth["Authorization"], requestedWithHeader: "XMLHttpRequest"}
+	status, _ = doRequest(t, http.MethodPut, base, []byte(`{"theme":"light"}`), page)
+	if status != http.StatusOK {
+		t.Errorf("saving the preferences returned %d", status)
+	}
+
+	status, body = doRequest(t, http.MethodGet, base+"/history", nil, auth)
+	if status != http.StatusOK {
+		t.Fatalf("getting the history returned %d", status)
+	}
+
+	var history struct {
+		History []historyEntry `json:"history"`
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.History) != 1 || !reflect.DeepEqual(history.History[0].Preferences, map[string]interface{}{"theme": "dark"}) {
+		t.Fatalf("the history was %#v", history)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, base+"/history/1/restore", nil, auth)
+	if status != http.StatusForbidden {
+		t.Errorf("restoring a version without the %s header returned %d", requestedWithHeader, status)
+	}
+	if stored := mock.storage["test-user"]["user-prefs"]; stored != `{"theme":"light"}` {
+		t.Errorf("a rejected restore stored %s", stored)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, base+"/history/1/restore", nil, page)
+	if status != http.StatusOK {
+		t.Errorf("restoring a version returned %d", status)
+	}
+	if stored := mock.storage["test-user"]["user-prefs"]; stored != `{"theme":"dark"}` {
+		t.Errorf("the restored preferences were %s", stored)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Anonymizer replaces usernames with pseudonyms and removes sensitive keys
+// from the documents in exports. Pseudonyms are the HMAC-SHA256 of the
+// username with the deployment's key, so a user gets the same pseudonym in
+// every export without the username being recoverable from it.
+type Anonymizer struct {
+	key   []byte
+	strip []string
+}
+
+// NewAnonymizer returns a newly created *Anonymizer that pseudonymizes
+// usernames with the key and removes the dotted key paths in strip from the
+// documents.
+func NewAnonymizer(key string, strip []string) (*Anonymizer, error) {
+	if key == "" {
+		return nil, fmt.Errorf("user-preferences.anonymize.key must be set to anonymize exports")
+	}
+	return &Anonymizer{key: []byte(key), strip: strip}, nil
+}
+
+// anonymizerConfig returns the anonymizer described by the configuration.
+func anonymizerConfig(cfg *viper.Viper) (*Anonymizer, error) {
+	return NewAnonymizer(
+		cfg.GetString("user-preferences.anonymize.key"),
+		cfg.GetStringSlice("user-preferences.anonymize.strip-keys"),
+	)
+}
+
+// pseudonym returns the pseudonym for the username.
+func (a *Anonymizer) pseudonym(username string) string {
+	return hex.EncodeToString(hmacSHA256(a.key, username))
+}
+
+// document removes the configured keys from the preferences.
+func (a *Anonymizer) document(prefs map[string]interface{}) {
+	for _, path := range a.strip {
+		deletePath(prefs, path)
+	}
+}
+
+// exportedDocument is a line of an export.
+type exportedDocument struct {
+	User        string                 `json:"user"`
+	Version     int64                  `json:"version"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ModifiedAt  time.Time              `json:"modified_at"`
+	Preferences map[string]interface{} `json:"preferences"`
+}
+
+// exportDocuments writes every user's preferences to w as JSON lines, ordered
+// by username, and returns the number written. If anon isn't nil, the
+// usernames are replaced by pseudonyms and the sensitive keys are removed.
+func (p *PrefsDB) exportDocuments(w io.Writer, anon *Anonymizer) (int64, error) {
+	query := `SELECT u.username, p.preferences, p.encoding, p.compressed, p.created_at, p.modified_at, p.version
+                FROM ` + p.tables.Preferences + ` p,
+                     ` + p.tables.usersSource() + ` u
+               WHERE p.user_id = u.id
+            ORDER BY u.username`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out      = bufio.NewWriter(w)
+		encoder  = json.NewEncoder(out)
+		exported int64
+	)
+	for rows.Next() {
+		var (
+			doc        exportedDocument
+			prefs      sql.NullString
+			encoding   string
+			compressed []byte
+		)
+		if err = rows.Scan(&doc.User, &prefs, &encoding, &compressed, &doc.CreatedAt, &doc.ModifiedAt, &doc.Version); err != nil {
+			return exported, err
+		}
+
+		decoded, err := p.decode(prefs, encoding, compressed)
+		if err != nil {
+			return exported, fmt.Errorf("Error decoding the preferences for user %s: %s", doc.User, err)
+		}
+		var values map[string]interface{}
+		if err = json.Unmarshal([]byte(decoded), &values); err != nil {
+			return exported, fmt.Errorf("Error parsing the preferences for user %s: %s", doc.User, err)
+		}
+		doc.Preferences = unwrappedDocument(values)
+
+		if anon != nil {
+			doc.User = anon.pseudonym(doc.User)
+			anon.document(doc.Preferences)
+		}
+		if err = encoder.Encode(&doc); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	if err = rows.Err(); err != nil {
+		return exported, err
+	}
+	return exported, out.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNewAnonymizerRequiresKey(t *testing.T) {
+	if _, err := NewAnonymizer("", nil); err == nil {
+		t.Error("an anonymizer was created without a key")
+	}
+}
+
+func TestPseudonym(t *testing.T) {
+	anon, err := NewAnonymizer("deployment-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAnonymizer("other-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := anon.pseudonym("alice")
+	if alice != anon.pseudonym("alice") {
+		t.Error("the pseudonym for alice changed between calls")
+	}
+	if len(alice) != 64 || strings.Contains(alice, "alice") {
+		t.Errorf("the pseudonym for alice was %s", alice)
+	}
+	if alice == anon.pseudonym("bob") {
+		t.Error("alice and bob got the same pseudonym")
+	}
+	if alice == other.pseudonym("alice") {
+		t.Error("the pseudonym didn't depend on the key")
+	}
+}
+
+func TestExportDocuments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	created := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	rows := func() sqlmock.Rows {
+		return sqlmock.NewRows([]string{"username", "preferences", "encoding", "compressed", "created_at", "modified_at", "version"}).
+			AddRow("alice", `{"preferences":{"theme":"dark","profile":{"email":"alice@example.org","lang":"en"}}}`, encodingIdentity, nil, created, created, 3).
+			AddRow("bob", `{"theme":"light"}`, encodingIdentity, nil, created, created, 1)
+	}
+	query := regexp.QuoteMeta("SELECT u.username, p.preferences, p.encoding, p.compressed, p.created_at, p.modified_at, p.version")
+	mock.ExpectQuery(query).WillReturnRows(rows())
+	mock.ExpectQuery(query).WillReturnRows(rows())
+
+	p := NewPrefsDB(db)
+	var plain bytes.Buffer
+	exported, err := p.exportDocuments(&plain, nil)
+	if err != nil {
+		t.Fatalf("error from exportDocuments(): %s", err)
+	}
+	if exported != 2 || !strings.Contains(plain.String(), `"user":"alice"`) || !strings.Contains(plain.String(), "alice@example.org") {
+		t.Errorf("the export of %d documents was %s", exported, plain.String())
+	}
+
+	anon, err := NewAnonymizer("deployment-key", []string{"profile.email", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anonymized bytes.Buffer
+	if _, err = p.exportDocuments(&anonymized, anon); err != nil {
+		t.Fatalf("error from exportDocuments(): %s", err)
+	}
+	if strings.Contains(anonymized.String(), "alice") || strings.Contains(anonymized.String(), "bob") {
+		t.Errorf("the anonymized export contained a username: %s", anonymized.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(anonymized.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("the anonymized export had %d lines", len(lines))
+	}
+	var doc exportedDocument
+	if err = json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.User != anon.pseudonym("alice") || doc.Version != 3 {
+		t.Errorf("the first document was %+v", doc)
+	}
+	profile, _ := doc.Preferences["profile"].(map[string]interface{})
+	if _, ok := profile["email"]; ok || profile["lang"] != "en" || doc.Preferences["theme"] != "dark" {
+		t.Errorf("the first document's preferences were %v", doc.Preferences)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// archiveRestores counts the archived documents that were moved back when
+// their users returned. It's published at /debug/vars.
+var archiveRestores = expvar.NewInt("archive_restores")
+
+// archivingSetting is set in the transactions that move documents into or out
+// of the archive, so that the triggers don't record the move as a change.
+const archivingSetting = `SET LOCAL user_preferences.archiving = 'on'`
+
+// archivePreferences moves up to limit documents of users who haven't used
+// them since before into the archive, and returns the number moved. A user's
+// last access comes from the usage counts if they're tracked, and from the
+// document's modification time otherwise.
+func (p *PrefsDB) archivePreferences(before time.Time, limit int) (int64, error) {
+	query := `WITH stale AS (
+                  SELECT p.user_id
+                    FROM ` + p.onlyPreferences() + ` p
+               LEFT JOIN user_preferences_usage s ON s.user_id = p.user_id
+                   WHERE p.modified_at < $1
+                     AND (s.last_access IS NULL OR s.last_access < $1)
+                   LIMIT $2
+                     FOR UPDATE OF p SKIP LOCKED
+              ), moved AS (
+                  DELETE FROM ` + p.onlyPreferences() + ` p
+                        USING stale
+                        WHERE p.user_id = stale.user_id
+                    RETURNING p.user_id, p.preferences, p.encoding, p.compressed, p.checksum, p.created_at, p.modified_at, p.version
+              )
+              INSERT INTO user_preferences_archive (user_id, preferences, encoding, compressed, checksum, created_at, modified_at, version)
+                   SELECT user_id, preferences, encoding, compressed, checksum, created_at, modified_at, version FROM moved
+              ON CONFLICT (user_id) DO UPDATE
+                      SET preferences = EXCLUDED.preferences,
+                          encoding = EXCLUDED.encoding,
+                          compressed = EXCLUDED.compressed,
+                          checksum = EXCLUDED.checksum,
+                          created_at = EXCLUDED.created_at,
+                          modified_at = EXCLUDED.modified_at,
+                          version = EXCLUDED.version,
+                          archived_at = now()`
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec(archivingSetting); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	result, err := tx.Exec(query, before, limit)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	archived, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return archived, tx.Commit()
+}
+
+// restorePreferences moves the user's archived document back, and returns
+// whether there was one.
+func (p *PrefsDB) restorePreferences(username string) (bool, error) {
+	checkQuery := `SELECT EXISTS (
+                       SELECT 1
+                         FROM user_preferences_archive a,
+                              ` + p.tables.usersSource() + ` u
+                        WHERE a.user_id = u.id
+                          AND u.username = $1
+                   )`
+
+	var archived bool
+	if err := p.db.QueryRow(checkQuery, username).Scan(&archived); err != nil || !archived {
+		return false, err
+	}
+
+	query := `WITH restored AS (
+                  DELETE FROM user_preferences_archive a
+                        USING ` + p.tables.usersSource() + ` u
+                        WHERE a.user_id = u.id
+                          AND u.username = $1
+                    RETURNING a.user_id, a.preferences, a.encoding, a.compressed, a.checksum, a.created_at, a.modified_at, a.version
+              )
+              INSERT INTO ` + p.tables.Preferences + ` (user_id, preferences, encoding, compressed, checksum, created_at, modified_at, version)
+                   SELECT user_id, preferences, encoding, compressed, checksum, created_at, modified_at, version FROM restored`
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = tx.Exec(archivingSetting); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	result, err := tx.Exec(query, username)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	restored, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return restored > 0, tx.Commit()
+}
+
+// archiveStale moves the documents of users who haven't used them in the
+// configured time into the archive.
+func (u *UserPreferencesApp) archiveStale(now time.Time) (int, error) {
+	archived, err := u.prefs.archivePreferences(now.Add(-u.archiveAfter), u.archiveBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("Error archiving stale preferences: %s", err)
+	}
+	return int(archived), nil
+}
+
+// restoreArchived moves the user's archived document back if there is one, so
+// that requests for returning users see their preferences.
+func (u *UserPreferencesApp) restoreArchived(username string) error {
+	restored, err := u.prefs.restorePreferences(username)
+	if err != nil {
+		return fmt.Errorf("Error restoring the archived preferences for user %s: %s", username, err)
+	}
+	if restored {
+		archiveRestores.Add(1)
+		log.WithFields(Fields{"user": username}).Info("Restored archived preferences")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestArchivePreferences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	before := time.Now().Add(-180 * 24 * time.Hour)
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL user_preferences.archiving = 'on'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("WITH stale AS (.+) DELETE FROM ONLY user_preferences p (.+) INSERT INTO user_preferences_archive").
+		WithArgs(before, 50).
+		WillReturnResult(sqlmock.NewResult(0, 12))
+	mock.ExpectCommit()
+
+	archived, err := NewPrefsDB(db).archivePreferences(before, 50)
+	if err != nil || archived != 12 {
+		t.Errorf("archivePreferences() returned %d, %v", archived, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestorePreferences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT EXISTS (.+) FROM user_preferences_archive").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	if restored, err := p.restorePreferences("bob"); err != nil || restored {
+		t.Errorf("restorePreferences(bob) returned %t, %v", restored, err)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS (.+) FROM user_preferences_archive").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL user_preferences.archiving = 'on'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("WITH restored AS (.+) INSERT INTO user_preferences").
+		WithArgs("alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if restored, err := p.restorePreferences("alice"); err != nil || !restored {
+		t.Errorf("restorePreferences(alice) returned %t, %v", restored, err)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS (.+) FROM user_preferences_archive").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL user_preferences.archiving = 'on'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("WITH restored AS").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	if _, err := p.restorePreferences("alice"); err == nil {
+		t.Error("restorePreferences() didn't return the error")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArchiveAndRestore(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+	mock.insertPreferences("bob", `{"theme":"light"}`)
+
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, "user-preferences:\n  archive:\n    enabled: true\n    after: 720h\n")); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	mock.storage["alice"]["modified-at"] = time.Now().Add(-1000 * time.Hour)
+	if archived, err := n.archiveStale(time.Now()); err != nil || archived != 1 {
+		t.Fatalf("archiveStale() returned %d, %v", archived, err)
+	}
+	if _, ok := mock.archived["alice"]; !ok {
+		t.Fatal("alice's preferences weren't archived")
+	}
+	if _, ok := mock.storage["bob"]; !ok {
+		t.Fatal("bob's preferences were archived")
+	}
+
+	before := archiveRestores.Value()
+	status, body := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil)
+	if status != http.StatusOK || string(body) != `{"theme":"dark"}` {
+		t.Errorf("the returning user's preferences were %d: %s", status, body)
+	}
+	if _, ok := mock.archived["alice"]; ok || archiveRestores.Value() != before+1 {
+		t.Error("alice's preferences weren't restored")
+	}
+}
+
+func TestArchivingDisabled(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.archived["alice"] = map[string]interface{}{"user-prefs": `{"theme":"dark"}`}
+
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, "")); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	for _, status := range n.jobs.Status() {
+		if status.Name == "archive-stale-preferences" {
+			t.Error("the archiving job was added without being enabled")
+		}
+	}
+
+	server := httptest.NewServer(n)
+	defer server.Close()
+	doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil)
+	if _, ok := mock.archived["alice"]; !ok {
+		t.Error("an archived document was restored without archiving enabled")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// The runtime assets are embedded in the binary so that it doesn't depend on
+// any files besides its configuration, and can run from a distroless image.
+
+// embeddedMigrations contains the SQL files in migrations/.
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// embeddedOpenAPI is the OpenAPI description of the service.
+//
+//go:embed openapi.json
+var embeddedOpenAPI []byte
+
+// adminUIPage is the administrative web page served at /admin/ui/. It uses the
+// routes under /admin/ui/api, relative to the page so that tenant path prefixes
+// are kept. Browsers send the page's basic auth credentials to them
+// automatically.
+//
+//go:embed ui/admin.html
+var adminUIPage string
+
+// migrationsFS returns the migrations in dir, or the embedded migrations if
+// dir is empty.
+func migrationsFS(dir string) fs.FS {
+	if dir == "" {
+		migrations, _ := fs.Sub(embeddedMigrations, "migrations")
+		return migrations
+	}
+	return os.DirFS(dir)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultAuditLimit is the number of entries returned by the audit log
+// endpoint when the client doesn't ask for a specific number.
+const defaultAuditLimit = 50
+
+// recordAudit adds an entry to the audit log. The details are stored as a JSON
+// document.
+func (p *PrefsDB) recordAudit(action, details string) error {
+	query := `INSERT INTO user_preferences_audit (action, details) VALUES ($1, $2)`
+	_, err := p.db.Exec(query, action, details)
+	return err
+}
+
+// audit records an administrative action and its details in the audit log.
+func (u *UserPreferencesApp) audit(action string, details map[string]string) error {
+	jsoned, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("Error generating audit JSON for %s: %s", action, err)
+	}
+
+	log.Infof("Audit: %s %s", action, jsoned)
+	if err = u.prefs.recordAudit(action, string(jsoned)); err != nil {
+		return fmt.Errorf("Error recording %s in the audit log: %s", action, err)
+	}
+
+	return nil
+}
+
+// AuditFilter selects the entries returned by listAudits. Action and User
+// limit the listing to the entries for the action and naming the user, if
+// they're set.
+type AuditFilter struct {
+	Action string
+	User   string
+	PageFilter
+}
+
+// listAudits returns the page of audit log entries selected by the filter,
+// newest first.
+func (p *PrefsDB) listAudits(filter AuditFilter) ([]AuditRecord, error) {
+	conditions, args := filter.conditions("id", "created_at", nil)
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		conditions = append(conditions, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if filter.User != "" {
+		args = append(args, filter.User)
+		conditions = append(conditions, fmt.Sprintf("details::jsonb ->> 'user' = $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT id, action, details, created_at
+              FROM user_preferences_audit
+              %s
+          ORDER BY id DESC
+             LIMIT $%d`, where, len(args))
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audits := []AuditRecord{}
+	for rows.Next() {
+		var record AuditRecord
+		if err := rows.Scan(&record.ID, &record.Action, &record.Details, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		audits = append(audits, record)
+	}
+
+	return audits, rows.Err()
+}
+
+// auditEntry is a single entry in the audit log endpoint's response.
+type auditEntry struct {
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// auditResponse is the JSON body returned by the audit log endpoint.
+type auditResponse struct {
+	Audit []auditEntry `json:"audit"`
+	pageResponse
+}
+
+// AuditRequest handles listing the audit log, newest first, a page at a time.
+// The listing can be limited to an action, a user, and a time range.
+func (u *UserPreferencesApp) AuditRequest(writer http.ResponseWriter, r *http.Request) {
+	page, err := parsePageFilter(r, defaultAuditLimit, u.maxPageSize)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+	filter := AuditFilter{
+		Action:     r.URL.Query().Get("action"),
+		User:       r.URL.Query().Get("user"),
+		PageFilter: page.peek(),
+	}
+
+	records, err := u.prefs.listAudits(filter)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing the audit log: %s", err))
+		return
+	}
+	count, paging := page.paginate(len(records), func(i int) int64 { return records[i].ID })
+
+	response := auditResponse{Audit: make([]auditEntry, count), pageResponse: paging}
+	for i, record := range records[:count] {
+		response.Audit[i] = auditEntry{
+			ID:        record.ID,
+			Action:    record.Action,
+			Details:   json.RawMessage(record.Details),
+			CreatedAt: record.CreatedAt,
+		}
+	}
+
+	jsoned, err := json.Marshal(&response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the audit log JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
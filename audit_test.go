@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRecordAudit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec("INSERT INTO user_preferences_audit \\(action, details\\) VALUES \\(\\$1, \\$2\\)").
+		WithArgs("rename-key", `{"from":"a"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = p.recordAudit("rename-key", `{"from":"a"}`); err != nil {
+		t.Errorf("error from recordAudit(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestListAudits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT id, action, details, created_at FROM user_preferences_audit WHERE id < \\$1 AND action = \\$2 AND details::jsonb ->> 'user' = \\$3 ORDER BY id DESC LIMIT \\$4").
+		WithArgs(int64(9), "gdpr-export", "alice", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "action", "details", "created_at"}).
+			AddRow(4, "gdpr-export", `{"user":"alice"}`, now))
+
+	records, err := p.listAudits(AuditFilter{Action: "gdpr-export", User: "alice", PageFilter: PageFilter{Before: 9, Limit: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != 4 {
+		t.Errorf("the records were %#v", records)
+	}
+
+	mock.ExpectQuery("SELECT id, action, details, created_at FROM user_preferences_audit ORDER BY id DESC LIMIT \\$1").
+		WithArgs(50).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "action", "details", "created_at"}))
+
+	if _, err = p.listAudits(AuditFilter{PageFilter: PageFilter{Limit: 50}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+	for _, user := range []string{"alice", "bob", "alice"} {
+		n.audit("gdpr-export", map[string]string{"user": user})
+	}
+	n.audit("rename-key", map[string]string{"from": "a", "to": "b"})
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	var response auditResponse
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/audit?action=gdpr-export&user=alice&limit=1", nil, admin)
+	json.Unmarshal(body, &response)
+	if status != http.StatusOK || len(response.Audit) != 1 || response.Audit[0].ID != 3 || response.NextCursor == "" {
+		t.Fatalf("the first page of the audit log returned %d: %s", status, body)
+	}
+	if string(response.Audit[0].Details) != `{"user":"alice"}` {
+		t.Errorf("the details were %s", response.Audit[0].Details)
+	}
+
+	url := server.URL + "/admin/audit?action=gdpr-export&user=alice&limit=1&cursor=" + response.NextCursor
+	response = auditResponse{}
+	status, body = doRequest(t, http.MethodGet, url, nil, admin)
+	json.Unmarshal(body, &response)
+	if status != http.StatusOK || len(response.Audit) != 1 || response.Audit[0].ID != 1 || response.NextCursor != "" {
+		t.Errorf("the second page of the audit log returned %d: %s", status, body)
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/audit?limit=1000", nil, admin); status != http.StatusBadRequest {
+		t.Errorf("a limit over the maximum page size returned %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/audit", nil, nil); status != http.StatusForbidden {
+		t.Errorf("a request without the admin key returned %d", status)
+	}
+}
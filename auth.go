@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// casTicketParam is the query parameter that carries a CAS proxy ticket, as it
+// does for the other DE services.
+const casTicketParam = "proxyToken"
+
+var (
+	// ErrNoCredentials is returned when a request doesn't include any
+	// credentials.
+	ErrNoCredentials = errors.New("The request doesn't include any credentials")
+
+	// ErrInvalidCredentials is returned when a request's credentials are
+	// rejected by the identity provider.
+	ErrInvalidCredentials = errors.New("The credentials are invalid or have expired")
+)
+
+// Authenticator resolves the user that made a request. ErrNoCredentials or
+// ErrInvalidCredentials is returned if the user can't be identified; any other
+// error means the identity provider couldn't be reached.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// casServiceResponse is the XML document returned by the CAS proxyValidate
+// endpoint.
+type casServiceResponse struct {
+	XMLName xml.Name `xml:"serviceResponse"`
+	Success *struct {
+		User string `xml:"user"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
+// CASAuthenticator authenticates requests with CAS proxy tickets, passed in
+// the proxyToken query parameter and validated against the CAS server.
+type CASAuthenticator struct {
+	base    string
+	service string
+	client  *http.Client
+}
+
+// NewCASAuthenticator returns a newly created *CASAuthenticator that validates
+// tickets issued for the service with the CAS server at base.
+func NewCASAuthenticator(base, service string, timeout time.Duration) *CASAuthenticator {
+	return &CASAuthenticator{
+		base:    strings.TrimSuffix(base, "/"),
+		service: service,
+		client:  outbound.client("cas", timeout),
+	}
+}
+
+// Authenticate returns the user that the request's proxy ticket was issued to.
+func (c *CASAuthenticator) Authenticate(r *http.Request) (string, error) {
+	ticket := r.URL.Query().Get(casTicketParam)
+	if ticket == "" {
+		return "", ErrNoCredentials
+	}
+
+	params := url.Values{}
+	params.Set("service", c.service)
+	params.Set("ticket", ticket)
+
+	resp, err := c.client.Get(c.base + "/proxyValidate?" + params.Encode())
+	if err != nil {
+		return "", fmt.Errorf("Error validating the CAS ticket: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("CAS returned %d while validating the ticket", resp.StatusCode)
+	}
+
+	var parsed casServiceResponse
+	if err = xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("Error parsing the CAS validation response: %s", err)
+	}
+	if parsed.Success == nil || parsed.Success.User == "" {
+		return "", ErrInvalidCredentials
+	}
+	return strings.TrimSpace(parsed.Success.User), nil
+}
+
+// oidcIdentity is a user resolved from a bearer token, cached until expires.
+type oidcIdentity struct {
+	username string
+	expires  time.Time
+}
+
+// OIDCAuthenticator authenticates requests with OIDC bearer tokens, such as
+// those issued by Keycloak. Tokens are checked by calling the provider's
+// userinfo endpoint, and the user is read from the configured claim. Resolved
+// tokens are cached briefly so that the provider isn't called on every
+// request.
+type OIDCAuthenticator struct {
+	userinfo string
+	claim    string
+	ttl      time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]oidcIdentity
+}
+
+// NewOIDCAuthenticator returns a newly created *OIDCAuthenticator. Resolved
+// tokens are cached for ttl; they aren't cached at all if ttl is zero.
+func NewOIDCAuthenticator(userinfo, claim string, ttl, timeout time.Duration) *OIDCAuthenticator {
+	return &OIDCAuthenticator{
+		userinfo: userinfo,
+		claim:    claim,
+		ttl:      ttl,
+		client:   outbound.client("oidc", timeout),
+		cache:    make(map[string]oidcIdentity),
+	}
+}
+
+// bearerToken returns the token in the request's Authorization header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// cached returns the user the token was resolved to, if it's still cached.
+func (o *OIDCAuthenticator) cached(key string, now time.Time) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	identity, ok := o.cache[key]
+	if !ok {
+		return "", false
+	}
+	if !now.Before(identity.expires) {
+		delete(o.cache, key)
+		return "", false
+	}
+	return identity.username, true
+}
+
+// remember caches the user the token was resolved to, dropping any expired
+// entries along the way.
+func (o *OIDCAuthenticator) remember(key, username string, now time.Time) {
+	if o.ttl <= 0 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for k, identity := range o.cache {
+		if !now.Before(identity.expires) {
+			delete(o.cache, k)
+		}
+	}
+	o.cache[key] = oidcIdentity{username: username, expires: now.Add(o.ttl)}
+}
+
+// Authenticate returns the user that the request's bearer token belongs to.
+func (o *OIDCAuthenticator) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", ErrNoCredentials
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+	if username, ok := o.cached(key, now); ok {
+		return username, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, o.userinfo, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error calling the OIDC userinfo endpoint: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", ErrInvalidCredentials
+	case resp.StatusCode != http.StatusOK:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("The OIDC userinfo endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var claims map[string]interface{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+		return "", fmt.Errorf("Error parsing the OIDC userinfo response: %s", err)
+	}
+	username, _ := claims[o.claim].(string)
+	if username == "" {
+		return "", fmt.Errorf("The OIDC userinfo response doesn't include the %s claim", o.claim)
+	}
+
+	o.remember(key, username, now)
+	return username, nil
+}
+
+// authorize checks that the request was made by the user it names, writing an
+// error response and returning false if it wasn't. Every request is allowed
+// when no authenticator is configured, and administrative callers may act for
+// any user. Requests made on behalf of a user by an administrator are checked
+// by impersonate instead.
+func (u *UserPreferencesApp) authorize(writer http.ResponseWriter, r *http.Request, username string) bool {
+	if r.Header.Get(impersonateUserHeader) != "" {
+		return u.impersonate(writer, r, username)
+	}
+	if u.auth == nil || u.isAdmin(r) {
+		return true
+	}
+
+	authenticated, err := u.auth.Authenticate(r)
+	switch {
+	case err == ErrNoCredentials || err == ErrInvalidCredentials:
+		unauthorized(writer, err.Error())
+		return false
+	case err != nil:
+		unavailable(writer, fmt.Sprintf("Error authenticating the request for user %s: %s", username, err))
+		return false
+	case !u.sameUser(authenticated, username):
+		forbidden(writer, fmt.Sprintf("User %s may not access the preferences of user %s", authenticated, username))
+		return false
+	}
+	return true
+}
+
+// sameUser reports whether the authenticated username names the user from the
+// request's URL. The authenticated username is normalized by the same policy as
+// the path username, so a principal such as alice@iplantcollaborative.org
+// matches /alice when the suffix is stripped. It's checked before the path
+// username is replaced by its spelling in the users table, so it ignores case
+// if usernames aren't case-sensitive.
+func (u *UserPreferencesApp) sameUser(authenticated, username string) bool {
+	if u.usernames != nil {
+		normalized, err := u.usernames.normalize(authenticated)
+		if err != nil {
+			return false
+		}
+		authenticated = normalized
+	}
+	if u.foldUsernames {
+		return strings.EqualFold(authenticated, username)
+	}
+	return authenticated == username
+}
+
+// unauthorized writes out a 401 response for a request whose credentials were
+// missing or rejected.
+func unauthorized(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusUnauthorized)
+	log.Error(msg)
+}
+
+// newAuthenticator returns the authenticator for the named provider, or nil if
+// the provider is "none".
+func newAuthenticator(provider string, settings authSettings) (Authenticator, error) {
+	switch provider {
+	case "", "none":
+		return nil, nil
+	case "cas":
+		if settings.casBase == "" || settings.casService == "" {
+			return nil, errors.New("The CAS base URL and service must both be set to use CAS authentication")
+		}
+		return NewCASAuthenticator(settings.casBase, settings.casService, settings.timeout), nil
+	case "oidc":
+		if settings.userinfo == "" {
+			return nil, errors.New("The OIDC userinfo URL must be set to use OIDC authentication")
+		}
+		return NewOIDCAuthenticator(settings.userinfo, settings.claim, settings.cacheTTL, settings.timeout), nil
+	default:
+		return nil, fmt.Errorf("Unknown authentication provider %s", provider)
+	}
+}
+
+// authSettings are the configured settings for the authentication providers.
+type authSettings struct {
+	casBase    string
+	casService string
+	userinfo   string
+	claim      string
+	cacheTTL   time.Duration
+	timeout    time.Duration
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCASAuthenticator(t *testing.T) {
+	cas := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cas/proxyValidate" || r.URL.Query().Get("service") != "https://de.example.org" {
+			t.Errorf("unexpected validation request %s", r.URL)
+		}
+		if r.URL.Query().Get("ticket") == "PT-alice" {
+			fmt.Fprint(writer, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess><cas:user>alice</cas:user></cas:authenticationSuccess>
+</cas:serviceResponse>`)
+			return
+		}
+		fmt.Fprint(writer, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationFailure code="INVALID_TICKET">Ticket not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`)
+	}))
+	defer cas.Close()
+
+	auth := NewCASAuthenticator(cas.URL+"/cas/", "https://de.example.org", time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/alice?proxyToken=PT-alice", nil)
+	if username, err := auth.Authenticate(req); err != nil || username != "alice" {
+		t.Errorf("a valid ticket resolved to %q: %v", username, err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/alice?proxyToken=PT-bogus", nil)
+	if _, err := auth.Authenticate(req); err != ErrInvalidCredentials {
+		t.Errorf("an invalid ticket returned %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/alice", nil)
+	if _, err := auth.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("a request without a ticket returned %v", err)
+	}
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	calls := 0
+	userinfo := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(writer, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(writer, `{"sub":"1234","preferred_username":"alice"}`)
+	}))
+	defer userinfo.Close()
+
+	auth := NewOIDCAuthenticator(userinfo.URL, "preferred_username", time.Minute, time.Second)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/alice", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		if username, err := auth.Authenticate(req); err != nil || username != "alice" {
+			t.Errorf("a valid token resolved to %q: %v", username, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("the userinfo endpoint was called %d times for a cached token", calls)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/alice", nil)
+	req.Header.Set("Authorization", "Bearer bad")
+	if _, err := auth.Authenticate(req); err != ErrInvalidCredentials {
+		t.Errorf("an invalid token returned %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/alice", nil)
+	req.SetBasicAuth("alice", "secret")
+	if _, err := auth.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("a request without a bearer token returned %v", err)
+	}
+
+	auth = NewOIDCAuthenticator(userinfo.URL, "email", time.Minute, time.Second)
+	req = httptest.NewRequest(http.MethodGet, "/alice", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	if _, err := auth.Authenticate(req); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("a response without the claim returned %v", err)
+	}
+}
+
+// fixedAuthenticator authenticates every request as the same user, or fails
+// with the error.
+type fixedAuthenticator struct {
+	username string
+	err      error
+}
+
+func (f fixedAuthenticator) Authenticate(r *http.Request) (string, error) {
+	return f.username, f.err
+}
+
+func TestAuthorize(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.auth = fixedAuthenticator{username: "alice"}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, body := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusOK {
+		t.Errorf("a request for the authenticated user returned %d: %s", status, body)
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/bob", nil, nil); status != http.StatusForbidden {
+		t.Errorf("a request for another user returned %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/bob", nil, map[string]string{adminKeyHeader: "secret"}); status != http.StatusOK {
+		t.Errorf("an administrative request for another user returned %d", status)
+	}
+
+	n.auth = fixedAuthenticator{err: ErrNoCredentials}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("a request without credentials returned %d", status)
+	}
+
+	n.auth = fixedAuthenticator{err: fmt.Errorf("connection refused")}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("a request while the provider was down returned %d", status)
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/", nil, nil); status != http.StatusOK {
+		t.Errorf("the greeting returned %d", status)
+	}
+}
+
+func TestAuthorizeNormalizedPrincipal(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	policy, err := NewUsernamePolicy("", 0, true, "@iplantcollaborative.org", suffixStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.usernames = policy
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	for _, principal := range []string{"Alice", "alice@iplantcollaborative.org", "ALICE@IPLANTCOLLABORATIVE.ORG"} {
+		n.auth = fixedAuthenticator{username: principal}
+		if status, body := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusOK {
+			t.Errorf("a request authenticated as %s returned %d: %s", principal, status, body)
+		}
+	}
+
+	n.auth = fixedAuthenticator{username: "bob@iplantcollaborative.org"}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusForbidden {
+		t.Errorf("a request authenticated as another user returned %d", status)
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	if auth, err := newAuthenticator("none", authSettings{}); auth != nil || err != nil {
+		t.Errorf("the none provider returned %v, %v", auth, err)
+	}
+	if _, err := newAuthenticator("cas", authSettings{}); err == nil {
+		t.Error("the CAS provider didn't require its settings")
+	}
+	if _, err := newAuthenticator("oidc", authSettings{}); err == nil {
+		t.Error("the OIDC provider didn't require its settings")
+	}
+	if _, err := newAuthenticator("ldap", authSettings{}); err == nil {
+		t.Error("an unknown provider was accepted")
+	}
+
+	auth, err := newAuthenticator("oidc", authSettings{userinfo: "https://keycloak.example.org/userinfo", claim: "preferred_username"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := auth.(*OIDCAuthenticator); !ok {
+		t.Errorf("the OIDC provider returned a %T", auth)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/dbutil"
+	"github.com/spf13/viper"
+)
+
+// backupFormat is the version of the backup archive layout. Archives in other
+// formats are refused by restores.
+const backupFormat = 1
+
+// backupManifestName is the name of the archive entry that describes the rest
+// of the archive. It's written last, once the checksums are known.
+const backupManifestName = "manifest.json"
+
+// backupChunkRows is the number of rows in each archive entry, which is also the
+// number of rows inserted by each statement during a restore.
+const backupChunkRows = 1000
+
+// backupTables are the tables saved in a backup, in the order they're
+// restored. The idempotency cache and admin UI sessions are short-lived, so
+// they're left out.
+var backupTables = []string{
+	"user_preferences",
+	"user_preferences_history",
+	"user_preferences_expirations",
+	"user_preferences_presets",
+	"user_preferences_registry",
+	"user_preferences_groups",
+	"user_preferences_sessions",
+	"user_preferences_searches",
+	"user_preferences_bags",
+	"user_preferences_experiments",
+	"user_preferences_audit",
+	"user_preferences_undo",
+	"user_preferences_scheduled_changes",
+	"user_preferences_rollouts",
+	"user_preferences_rollout_members",
+}
+
+// backupSource returns the table that a backed up table is read from and
+// restored into. Archives name the preferences table by its default name,
+// whatever it's been renamed to.
+func backupSource(table string) string {
+	if table == defaultTableNames.Preferences {
+		return tables.Preferences
+	}
+	return table
+}
+
+// serialTables are the backed up tables with bigserial IDs, whose sequences
+// have to be moved past the restored IDs.
+var serialTables = []string{
+	"user_preferences_history",
+	"user_preferences_audit",
+	"user_preferences_scheduled_changes",
+}
+
+// backupTable describes the rows of a table in a backup. SHA256 is the hex
+// checksum of the table's rows, each followed by a newline, across all of its
+// archive entries.
+type backupTable struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupManifest describes a backup archive. SchemaVersion is the latest
+// migration that had been applied to the database, which the database being
+// restored into has to match.
+type backupManifest struct {
+	Format        int           `json:"format"`
+	CreatedAt     time.Time     `json:"created_at"`
+	SchemaVersion int           `json:"schema_version"`
+	Tables        []backupTable `json:"tables"`
+}
+
+// schemaVersion returns the latest migration that's been applied.
+func schemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM user_preferences_migrations`).Scan(&version)
+	return version, err
+}
+
+// backupEntry returns the name of the archive entry holding a chunk of the
+// table's rows.
+func backupEntry(table string, chunk int) string {
+	return fmt.Sprintf("%s/%05d.jsonl", table, chunk)
+}
+
+// writeBackupEntry adds a file to the archive.
+func writeBackupEntry(tw *tar.Writer, name string, contents []byte, now time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: now,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// backupRows writes the table's rows to the archive as JSON lines, split into
+// entries of up to backupChunkRows rows each.
+func backupRows(tx *sql.Tx, tw *tar.Writer, table string, now time.Time) (*backupTable, error) {
+	rows, err := tx.Query(`SELECT row_to_json(t)::text FROM ` + backupSource(table) + ` t`)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", table, err)
+	}
+	defer rows.Close()
+
+	var (
+		buf    bytes.Buffer
+		chunk  int
+		result = &backupTable{Name: table}
+		sum    = sha256.New()
+	)
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		chunk++
+		err := writeBackupEntry(tw, backupEntry(table, chunk), buf.Bytes(), now)
+		buf.Reset()
+		return err
+	}
+
+	for rows.Next() {
+		var row string
+		if err = rows.Scan(&row); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", table, err)
+		}
+		line := row + "\n"
+		buf.WriteString(line)
+		sum.Write([]byte(line))
+		result.Rows++
+
+		if result.Rows%backupChunkRows == 0 {
+			if err = flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", table, err)
+	}
+	if err = flush(); err != nil {
+		return nil, err
+	}
+
+	result.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	return result, nil
+}
+
+// backup writes a gzipped tar archive of the service's tables to w and returns
+// its manifest. The tables are read in a single repeatable read transaction so
+// that the backup is consistent.
+func backup(db *sql.DB, w io.Writer, now time.Time) (*backupManifest, error) {
+	manifest := &backupManifest{Format: backupFormat, CreatedAt: now.UTC()}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`); err != nil {
+		return nil, err
+	}
+	if manifest.SchemaVersion, err = schemaVersion(tx); err != nil {
+		return nil, fmt.Errorf("Error checking the schema version: %s", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, table := range backupTables {
+		saved, err := backupRows(tx, tw, table, now)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append(manifest.Tables, *saved)
+	}
+
+	jsoned, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeBackupEntry(tw, backupManifestName, jsoned, now); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// restoreRows inserts a chunk of JSON lines into the table.
+func restoreRows(tx *sql.Tx, table string, lines []string) error {
+	source := backupSource(table)
+	query := `INSERT INTO ` + source + `
+                   SELECT * FROM json_populate_recordset(NULL::` + source + `, $1::json)`
+	_, err := tx.Exec(query, "["+strings.Join(lines, ",")+"]")
+	return err
+}
+
+// restoreBackup replaces the contents of the service's tables with the backup
+// read from r. Everything happens in one transaction, which is rolled back if
+// the archive doesn't match its manifest, so a damaged archive leaves the
+// database untouched.
+func restoreBackup(db *sql.DB, r io.Reader) (*backupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the backup: %s", err)
+	}
+	defer gz.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := restoreTables(tx, tar.NewReader(gz))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return manifest, tx.Commit()
+}
+
+// restoreTables empties the tables and loads the archive into them within the
+// transaction.
+func restoreTables(tx *sql.Tx, tr *tar.Reader) (*backupManifest, error) {
+	// Deleting the preferences copies them into the history, so they're
+	// deleted before the history is.
+	for _, table := range append(backupTables[:1:1], reversed(backupTables[1:])...) {
+		if _, err := tx.Exec(`DELETE FROM ` + backupSource(table)); err != nil {
+			return nil, fmt.Errorf("Error emptying %s: %s", table, err)
+		}
+	}
+
+	known := make(map[string]bool, len(backupTables))
+	for _, table := range backupTables {
+		known[table] = true
+	}
+
+	var (
+		manifest *backupManifest
+		restored = make(map[string]*backupTable)
+		sums     = make(map[string]hash.Hash)
+	)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the backup: %s", err)
+		}
+
+		if header.Name == backupManifestName {
+			manifest = &backupManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("Error reading the backup manifest: %s", err)
+			}
+			continue
+		}
+
+		table := path.Dir(header.Name)
+		if !known[table] {
+			return nil, fmt.Errorf("The backup contains an unknown entry %s", header.Name)
+		}
+		if restored[table] == nil {
+			restored[table] = &backupTable{Name: table}
+			sums[table] = sha256.New()
+		}
+
+		var lines []string
+		scanner := bufio.NewScanner(tr)
+		scanner.Buffer(make([]byte, 64*1024), 1<<30)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			sums[table].Write(append(scanner.Bytes(), '\n'))
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("Error reading %s from the backup: %s", header.Name, err)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		if err = restoreRows(tx, table, lines); err != nil {
+			return nil, fmt.Errorf("Error restoring %s: %s", header.Name, err)
+		}
+		restored[table].Rows += int64(len(lines))
+	}
+
+	if err := verifyRestore(tx, manifest, restored, sums); err != nil {
+		return nil, err
+	}
+
+	for _, table := range serialTables {
+		query := `SELECT setval(pg_get_serial_sequence('` + table + `', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM ` + table
+		if _, err := tx.Exec(query); err != nil {
+			return nil, fmt.Errorf("Error resetting the IDs of %s: %s", table, err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// verifyRestore checks that the restored rows match the manifest and that the
+// backup was taken from a database with the same schema.
+func verifyRestore(tx *sql.Tx, manifest *backupManifest, restored map[string]*backupTable, sums map[string]hash.Hash) error {
+	if manifest == nil {
+		return fmt.Errorf("The backup doesn't have a manifest")
+	}
+	if manifest.Format != backupFormat {
+		return fmt.Errorf("The backup is in format %d, but only format %d can be restored", manifest.Format, backupFormat)
+	}
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return fmt.Errorf("Error checking the schema version: %s", err)
+	}
+	if version != manifest.SchemaVersion {
+		return fmt.Errorf("The backup was taken at schema version %d, but the database is at version %d", manifest.SchemaVersion, version)
+	}
+
+	listed := make(map[string]bool, len(manifest.Tables))
+	for _, expected := range manifest.Tables {
+		listed[expected.Name] = true
+
+		actual := backupTable{Name: expected.Name, SHA256: hex.EncodeToString(sha256.New().Sum(nil))}
+		if restored[expected.Name] != nil {
+			actual.Rows = restored[expected.Name].Rows
+			actual.SHA256 = hex.EncodeToString(sums[expected.Name].Sum(nil))
+		}
+		if actual != expected {
+			return fmt.Errorf("The backup of %s is damaged: the manifest lists %d rows with checksum %s, but it has %d rows with checksum %s",
+				expected.Name, expected.Rows, expected.SHA256, actual.Rows, actual.SHA256)
+		}
+	}
+	for table := range restored {
+		if !listed[table] {
+			return fmt.Errorf("The backup contains rows for %s, which its manifest doesn't list", table)
+		}
+	}
+	return nil
+}
+
+// reversed returns a reversed copy of the strings.
+func reversed(values []string) []string {
+	retval := make([]string, len(values))
+	for i, value := range values {
+		retval[len(values)-1-i] = value
+	}
+	return retval
+}
+
+// commandUsage describes the subcommands of the service.
+const commandUsage = "Usage: user-preferences [flags] backup|restore|export <file>"
+
+// runCommand runs the backup, restore, or export subcommand against the
+// database. The file is - for stdout or stdin. When tenants are configured, the
+// tenant chooses the schema. If anonymize is true, the export pseudonymizes
+// the usernames and removes the configured sensitive keys.
+func runCommand(cfg *viper.Viper, connector *dbutil.Connector, dburi, tenant string, anonymize bool, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(commandUsage)
+	}
+
+	command, file := args[0], args[1]
+	var anon *Anonymizer
+	if anonymize {
+		if command != "export" {
+			return fmt.Errorf("--anonymize only applies to export, since backups have to be restorable")
+		}
+		var err error
+		if anon, err = anonymizerConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	var schema string
+	if schemas := cfg.GetStringMapString("user-preferences.tenants.schemas"); len(schemas) > 0 {
+		var ok bool
+		if schema, ok = schemas[tenant]; !ok {
+			return fmt.Errorf("--tenant must name one of the configured tenants")
+		}
+	}
+	dburi, err := withSchemas(cfg, dburi, schema)
+	if err != nil {
+		return err
+	}
+
+	db, err := connector.Connect("postgres", dburi)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch command {
+	case "backup":
+		out := os.Stdout
+		if file != "-" {
+			if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+				return err
+			}
+		}
+		manifest, err := backup(db, out, time.Now())
+		if err == nil && out != os.Stdout {
+			err = out.Close()
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("Backed up %d tables at schema version %d to %s", len(manifest.Tables), manifest.SchemaVersion, file)
+	case "restore":
+		in := os.Stdin
+		if file != "-" {
+			if in, err = os.Open(file); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		manifest, err := restoreBackup(db, in)
+		if err != nil {
+			return err
+		}
+		log.Infof("Restored %d tables from the backup taken at %s", len(manifest.Tables), manifest.CreatedAt.Format(time.RFC3339))
+	case "export":
+		prefsDB := NewPrefsDB(db)
+		if prefsDB.objects, err = objectStoreConfig(cfg); err != nil {
+			return err
+		}
+		out := os.Stdout
+		if file != "-" {
+			if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+				return err
+			}
+		}
+		exported, err := prefsDB.exportDocuments(out, anon)
+		if err == nil && out != os.Stdout {
+			err = out.Close()
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("Exported %d documents to %s", exported, file)
+	default:
+		return fmt.Errorf("Unknown command %s. %s", command, commandUsage)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+var backupRowsByTable = map[string][]string{
+	"user_preferences": {
+		`{"id":"1","user_id":"u1","preferences":"{}","encoding":"identity","compressed":null}`,
+		`{"id":"2","user_id":"u2","preferences":null,"encoding":"gzip","compressed":"\\x1f8b"}`,
+	},
+	"user_preferences_audit": {
+		`{"id":7,"action":"delete-key","details":"{}"}`,
+	},
+}
+
+// testBackup returns an archive of backupRowsByTable taken at schema version 19.
+func testBackup(t *testing.T) []byte {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM user_preferences_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(19))
+	for _, table := range backupTables {
+		rows := sqlmock.NewRows([]string{"row_to_json"})
+		for _, row := range backupRowsByTable[table] {
+			rows.AddRow(row)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT row_to_json(t)::text FROM " + table + " t")).WillReturnRows(rows)
+	}
+	mock.ExpectRollback()
+
+	var buf bytes.Buffer
+	manifest, err := backup(db, &buf, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("error from backup(): %s", err)
+	}
+	if manifest.SchemaVersion != 19 || len(manifest.Tables) != len(backupTables) {
+		t.Fatalf("the manifest was %+v", manifest)
+	}
+	if manifest.Tables[0].Rows != 2 || manifest.Tables[0].SHA256 == manifest.Tables[1].SHA256 {
+		t.Errorf("the manifest's first tables were %+v", manifest.Tables[:2])
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// expectRestore sets up the statements a restore runs before it verifies the
+// archive against the database's schema version.
+func expectRestore(mock sqlmock.Sqlmock, version int) {
+	mock.ExpectBegin()
+	for _, table := range append([]string{backupTables[0]}, reversed(backupTables[1:])...) {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM " + table)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_preferences SELECT * FROM json_populate_recordset(NULL::user_preferences, $1::json)")).
+		WithArgs("[" + strings.Join(backupRowsByTable["user_preferences"], ",") + "]").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_preferences_audit SELECT")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM user_preferences_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	archive := testBackup(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	expectRestore(mock, 19)
+	for _, table := range serialTables {
+		mock.ExpectExec(regexp.QuoteMeta("SELECT setval(pg_get_serial_sequence('" + table + "', 'id')")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	manifest, err := restoreBackup(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("error from restoreBackup(): %s", err)
+	}
+	if !manifest.CreatedAt.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("the restored backup was taken at %s", manifest.CreatedAt)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRestoreSchemaMismatch(t *testing.T) {
+	archive := testBackup(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	expectRestore(mock, 20)
+	mock.ExpectRollback()
+
+	if _, err = restoreBackup(db, bytes.NewReader(archive)); err == nil || !strings.Contains(err.Error(), "schema version 19") {
+		t.Errorf("restoring into a newer schema returned %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// rewriteBackup returns the archive with the contents of each entry replaced
+// by edit.
+func rewriteBackup(t *testing.T, archive []byte, edit func(name string, contents []byte) []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = edit(header.Name, contents)
+		header.Size = int64(len(contents))
+		if err = tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(contents)
+	}
+	tw.Close()
+	gzw.Close()
+	return buf.Bytes()
+}
+
+func TestRestoreDamagedBackup(t *testing.T) {
+	archive := rewriteBackup(t, testBackup(t), func(name string, contents []byte) []byte {
+		if name == backupEntry("user_preferences_audit", 1) {
+			return bytes.Replace(contents, []byte("delete-key"), []byte("rename-key"), 1)
+		}
+		return contents
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	expectRestore(mock, 19)
+	mock.ExpectRollback()
+
+	if _, err = restoreBackup(db, bytes.NewReader(archive)); err == nil || !strings.Contains(err.Error(), "user_preferences_audit is damaged") {
+		t.Errorf("restoring a damaged backup returned %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRestoreWithoutManifest(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.Close()
+	gz.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	for range backupTables {
+		mock.ExpectExec("DELETE FROM").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectRollback()
+
+	if _, err = restoreBackup(db, &buf); err == nil || !strings.Contains(err.Error(), "manifest") {
+		t.Errorf("restoring an archive without a manifest returned %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
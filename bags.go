@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BagRecord is a named collection of items that a user has assembled in the
+// DE. Contents is the JSON encoding of the items.
+type BagRecord struct {
+	Name       string
+	Contents   string
+	Default    bool
+	ModifiedAt time.Time
+}
+
+// bagColumns are the columns scanned by scanBag.
+const bagColumns = `b.name,
+                   b.contents,
+                   b.is_default,
+                   b.modified_at`
+
+// scanBag scans a row containing the bagColumns.
+func scanBag(row interface {
+	Scan(dest ...interface{}) error
+}) (*BagRecord, error) {
+	var bag BagRecord
+	if err := row.Scan(&bag.Name, &bag.Contents, &bag.Default, &bag.ModifiedAt); err != nil {
+		return nil, err
+	}
+	return &bag, nil
+}
+
+// listBags returns the user's bags, sorted by name.
+func (p *PrefsDB) listBags(username string) ([]BagRecord, error) {
+	query := `SELECT ` + bagColumns + `
+              FROM user_preferences_bags b,
+                   ` + p.tables.usersSource() + ` u
+             WHERE b.user_id = u.id
+               AND u.username = $1
+          ORDER BY b.name`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bags := []BagRecord{}
+	for rows.Next() {
+		bag, err := scanBag(rows)
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, *bag)
+	}
+
+	return bags, rows.Err()
+}
+
+// getBag returns the user's named bag. sql.ErrNoRows is returned if it doesn't
+// exist.
+func (p *PrefsDB) getBag(username, name string) (*BagRecord, error) {
+	query := `SELECT ` + bagColumns + `
+              FROM user_preferences_bags b,
+                   ` + p.tables.usersSource() + ` u
+             WHERE b.user_id = u.id
+               AND u.username = $1
+               AND b.name = $2`
+
+	return scanBag(p.db.QueryRow(query, username, name))
+}
+
+// getDefaultBag returns the user's default bag. sql.ErrNoRows is returned if
+// they haven't chosen one.
+func (p *PrefsDB) getDefaultBag(username string) (*BagRecord, error) {
+	query := `SELECT ` + bagColumns + `
+              FROM user_preferences_bags b,
+                   ` + p.tables.usersSource() + ` u
+             WHERE b.user_id = u.id
+               AND u.username = $1
+               AND b.is_default`
+
+	return scanBag(p.db.QueryRow(query, username))
+}
+
+// putBag creates or replaces the contents of the user's named bag and returns
+// whether it was created.
+func (p *PrefsDB) putBag(username, name, contents string) (bool, error) {
+	query := `INSERT INTO user_preferences_bags (user_id, name, contents)
+                   SELECT u.id, $2, $3 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $1
+              ON CONFLICT (user_id, name) DO UPDATE
+                      SET contents = EXCLUDED.contents,
+                          modified_at = now()
+                RETURNING (xmax = 0)`
+
+	var created bool
+	if err := p.db.QueryRow(query, username, name, contents).Scan(&created); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// deleteBag removes the user's named bag and returns whether it existed.
+func (p *PrefsDB) deleteBag(username, name string) (bool, error) {
+	query := `DELETE FROM user_preferences_bags b
+                    USING ` + p.tables.usersSource() + ` u
+                    WHERE b.user_id = u.id
+                      AND u.username = $1
+                      AND b.name = $2`
+
+	result, err := p.db.Exec(query, username, name)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// setDefaultBag makes the named bag the user's default, and none of their
+// others. It returns false without changing anything if the bag doesn't
+// exist.
+func (p *PrefsDB) setDefaultBag(username, name string) (bool, error) {
+	query := `UPDATE user_preferences_bags b
+                 SET is_default = (b.name = $2)
+                FROM ` + p.tables.usersSource() + ` u
+               WHERE b.user_id = u.id
+                 AND u.username = $1
+                 AND EXISTS (SELECT 1
+                               FROM user_preferences_bags d
+                              WHERE d.user_id = u.id
+                                AND d.name = $2)`
+
+	result, err := p.db.Exec(query, username, name)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// bagSummary describes one of a user's bags in the listing.
+type bagSummary struct {
+	Name       string    `json:"name"`
+	Default    bool      `json:"default"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// bagResponse is the JSON body returned for a single bag.
+type bagResponse struct {
+	Name       string          `json:"name"`
+	Default    bool            `json:"default"`
+	ModifiedAt time.Time       `json:"modified_at"`
+	Contents   json.RawMessage `json:"contents"`
+}
+
+// newBagResponse returns the response for the bag.
+func newBagResponse(bag *BagRecord) bagResponse {
+	return bagResponse{
+		Name:       bag.Name,
+		Default:    bag.Default,
+		ModifiedAt: bag.ModifiedAt,
+		Contents:   json.RawMessage(bag.Contents),
+	}
+}
+
+// writeBag writes the bag as a response with the status.
+func writeBag(writer http.ResponseWriter, status int, bag *BagRecord) {
+	jsoned, err := json.Marshal(newBagResponse(bag))
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for bag %s: %s", bag.Name, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsoned)
+}
+
+// ListBagsRequest handles listing a user's bags.
+func (u *UserPreferencesApp) ListBagsRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	bags, err := u.prefs.listBags(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing bags for user %s: %s", username, err))
+		return
+	}
+
+	summaries := make([]bagSummary, len(bags))
+	for i, bag := range bags {
+		summaries[i] = bagSummary{Name: bag.Name, Default: bag.Default, ModifiedAt: bag.ModifiedAt}
+	}
+
+	jsoned, err := json.Marshal(map[string][]bagSummary{"bags": summaries})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating bags JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// GetBagRequest handles getting one of a user's bags.
+func (u *UserPreferencesApp) GetBagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	bag, err := u.prefs.getBag(username, name)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Bag %s does not exist for user %s", name, username))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting bag %s for user %s: %s", name, username, err))
+		return
+	}
+
+	writeBag(writer, http.StatusOK, bag)
+}
+
+// PutBagRequest handles creating or replacing the contents of one of a user's
+// bags. The body is the contents, which may be any JSON value. A 201 is
+// returned if the bag was created.
+func (u *UserPreferencesApp) PutBagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	var contents interface{}
+	if err := decodeBody(r.Body, &contents); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+	if contents == nil {
+		contents = []interface{}{}
+	}
+
+	jsoned, err := json.Marshal(contents)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for bag %s: %s", name, err))
+		return
+	}
+
+	created, err := u.prefs.putBag(username, name, string(jsoned))
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error saving bag %s for user %s: %s", name, username, err))
+		return
+	}
+
+	bag, err := u.prefs.getBag(username, name)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting bag %s for user %s: %s", name, username, err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeBag(writer, status, bag)
+}
+
+// DeleteBagRequest handles deleting one of a user's bags.
+func (u *UserPreferencesApp) DeleteBagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	deleted, err := u.prefs.deleteBag(username, name)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error deleting bag %s for user %s: %s", name, username, err))
+		return
+	}
+	if !deleted {
+		notFound(writer, fmt.Sprintf("Bag %s does not exist for user %s", name, username))
+	}
+}
+
+// GetDefaultBagRequest handles getting a user's default bag.
+func (u *UserPreferencesApp) GetDefaultBagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	bag, err := u.prefs.getDefaultBag(username)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("User %s does not have a default bag", username))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting the default bag for user %s: %s", username, err))
+		return
+	}
+
+	writeBag(writer, http.StatusOK, bag)
+}
+
+// defaultBagBody is the body accepted when choosing a user's default bag.
+type defaultBagBody struct {
+	Name string `json:"name"`
+}
+
+// PutDefaultBagRequest handles choosing which of a user's bags is their
+// default.
+func (u *UserPreferencesApp) PutDefaultBagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var body defaultBagBody
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+	if body.Name == "" {
+		badRequest(writer, "The name of the default bag must be given")
+		return
+	}
+
+	found, err := u.prefs.setDefaultBag(username, body.Name)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error setting the default bag for user %s: %s", username, err))
+		return
+	}
+	if !found {
+		notFound(writer, fmt.Sprintf("Bag %s does not exist for user %s", body.Name, username))
+		return
+	}
+
+	u.GetDefaultBagRequest(writer, r)
+}
+
+// bagsExport returns all of the user's bags for a data export.
+func (u *UserPreferencesApp) bagsExport(username string) ([]bagResponse, error) {
+	bags, err := u.prefs.listBags(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing bags for user %s: %s", username, err)
+	}
+
+	exported := make([]bagResponse, len(bags))
+	for i := range bags {
+		exported[i] = newBagResponse(&bags[i])
+	}
+	return exported, nil
+}
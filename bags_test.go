@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBagRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/bags"
+
+	status, body := doRequest(t, http.MethodPut, url+"/reads", []byte(`["/iplant/home/alice/a.fq"]`), nil)
+	var bag bagResponse
+	if err := json.Unmarshal(body, &bag); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusCreated || bag.Name != "reads" || string(bag.Contents) != `["/iplant/home/alice/a.fq"]` {
+		t.Errorf("creating a bag returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodPut, url+"/reads", []byte(`["/iplant/home/alice/b.fq"]`), nil); status != http.StatusOK {
+		t.Errorf("replacing a bag returned %d", status)
+	}
+	doRequest(t, http.MethodPut, url+"/apps", []byte(`{"apps":["wc"]}`), nil)
+
+	status, body = doRequest(t, http.MethodGet, url, nil, nil)
+	var listing map[string][]bagSummary
+	if err := json.Unmarshal(body, &listing); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(listing["bags"]) != 2 || listing["bags"][0].Name != "apps" {
+		t.Errorf("listing the bags returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url+"/reads", nil, nil)
+	bag = bagResponse{}
+	json.Unmarshal(body, &bag)
+	if status != http.StatusOK || string(bag.Contents) != `["/iplant/home/alice/b.fq"]` {
+		t.Errorf("getting a bag returned %d: %s", status, body)
+	}
+	if status, _ = doRequest(t, http.MethodGet, url+"/missing", nil, nil); status != http.StatusNotFound {
+		t.Errorf("getting a missing bag returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url+"/apps", nil, nil); status != http.StatusOK {
+		t.Errorf("deleting a bag returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodDelete, url+"/apps", nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleting a missing bag returned %d", status)
+	}
+}
+
+func TestDefaultBagRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.putBag("alice", "reads", `[]`)
+	mock.putBag("alice", "apps", `[]`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/default-bag"
+
+	if status, _ := doRequest(t, http.MethodGet, url, nil, nil); status != http.StatusNotFound {
+		t.Errorf("getting an unset default bag returned %d", status)
+	}
+
+	for _, name := range []string{"reads", "apps"} {
+		status, body := doRequest(t, http.MethodPut, url, []byte(`{"name":"`+name+`"}`), nil)
+		var bag bagResponse
+		json.Unmarshal(body, &bag)
+		if status != http.StatusOK || bag.Name != name || !bag.Default {
+			t.Errorf("choosing %s as the default returned %d: %s", name, status, body)
+		}
+	}
+	if mock.bags["alice"]["reads"].Default {
+		t.Error("the previous default bag is still the default")
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"name":"missing"}`), nil); status != http.StatusNotFound {
+		t.Errorf("choosing a missing bag returned %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{}`), nil); status != http.StatusBadRequest {
+		t.Errorf("choosing no bag returned %d", status)
+	}
+
+	status, body := doRequest(t, http.MethodGet, url, nil, nil)
+	var bag bagResponse
+	json.Unmarshal(body, &bag)
+	if status != http.StatusOK || bag.Name != "apps" {
+		t.Errorf("getting the default bag returned %d: %s", status, body)
+	}
+}
+
+func TestSetDefaultBag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec("UPDATE user_preferences_bags b SET is_default = \\(b.name = \\$2\\)").
+		WithArgs("test-user", "reads").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE user_preferences_bags b SET is_default = \\(b.name = \\$2\\)").
+		WithArgs("test-user", "missing").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if found, err := p.setDefaultBag("test-user", "reads"); err != nil || !found {
+		t.Errorf("setDefaultBag returned %v, %v", found, err)
+	}
+	if found, err := p.setDefaultBag("test-user", "missing"); err != nil || found {
+		t.Errorf("setDefaultBag for a missing bag returned %v, %v", found, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
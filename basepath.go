@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// pathPrefixKey is the context key for the path prefix that was stripped from
+// a request's URL before it was routed.
+type pathPrefixKey struct{}
+
+// pathPrefix returns the path prefix that was stripped from the request's URL,
+// or "" if there wasn't one.
+func pathPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(pathPrefixKey{}).(string)
+	return prefix
+}
+
+// withPathPrefix returns the request with the prefix added to the end of its
+// stripped path prefix.
+func withPathPrefix(r *http.Request, prefix string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, pathPrefix(r)+prefix))
+}
+
+// externalPath returns the path as clients see it, with any prefixes that
+// were stripped from the request's URL put back. It's used for links that are
+// returned in responses.
+func externalPath(r *http.Request, path string) string {
+	return pathPrefix(r) + path
+}
+
+// normalizeBasePath returns the base path with a leading slash and without a
+// trailing one. The root path is returned as "".
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(strings.TrimSpace(basePath), "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// BasePath serves the routes of a handler under a path prefix, for ingresses
+// that can't strip the prefix themselves. Requests outside the prefix are
+// rejected.
+type BasePath struct {
+	prefix  string
+	handler http.Handler
+}
+
+// NewBasePath returns the handler mounted under the prefix. The handler is
+// returned unchanged if the prefix is empty or the root path.
+func NewBasePath(prefix string, handler http.Handler) http.Handler {
+	prefix = normalizeBasePath(prefix)
+	if prefix == "" {
+		return handler
+	}
+	return &BasePath{prefix: prefix, handler: handler}
+}
+
+// stripPrefix returns the path with the prefix removed, and whether the path
+// was within the prefix.
+func (b *BasePath) stripPrefix(path string) (string, bool) {
+	switch {
+	case path == b.prefix:
+		return "/", true
+	case strings.HasPrefix(path, b.prefix+"/"):
+		return strings.TrimPrefix(path, b.prefix), true
+	default:
+		return "", false
+	}
+}
+
+// ServeHTTP strips the prefix from the request's URL and passes the request on
+// to the handler.
+func (b *BasePath) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	path, ok := b.stripPrefix(r.URL.Path)
+	if !ok {
+		http.NotFound(writer, r)
+		return
+	}
+
+	stripped := withPathPrefix(r, b.prefix)
+	u := *r.URL
+	u.Path = path
+	if u.RawPath != "" {
+		if u.RawPath, ok = b.stripPrefix(u.RawPath); !ok {
+			u.RawPath = ""
+		}
+	}
+	stripped.URL = &u
+
+	b.handler.ServeHTTP(writer, stripped)
+}
+
+// withServerURL returns the OpenAPI description with its servers list set to
+// the base path, so that clients generated from it use the prefixed routes.
+// The description is returned unchanged if it can't be parsed.
+func withServerURL(spec []byte, basePath string) []byte {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(spec, &parsed); err != nil {
+		return spec
+	}
+
+	parsed["servers"] = []map[string]string{{"url": basePath}}
+	jsoned, err := json.Marshal(parsed)
+	if err != nil {
+		return spec
+	}
+	return jsoned
+}
+
+// prefixedLinks returns the links with the request's stripped path prefix
+// added to each of them.
+func prefixedLinks(r *http.Request, links map[string]string) map[string]string {
+	prefixed := make(map[string]string, len(links))
+	for name, link := range links {
+		prefixed[name] = externalPath(r, link)
+	}
+	return prefixed
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"/":                      "",
+		"user-preferences":       "/user-preferences",
+		"/user-preferences/v1/":  "/user-preferences/v1",
+		" /user-preferences/v1 ": "/user-preferences/v1",
+	}
+	for basePath, expected := range tests {
+		if actual := normalizeBasePath(basePath); actual != expected {
+			t.Errorf("normalizeBasePath(%q) returned %q instead of %q", basePath, actual, expected)
+		}
+	}
+}
+
+func TestBasePathRouting(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	if handler := NewBasePath("/", n); handler != n {
+		t.Error("the root base path wrapped the handler")
+	}
+
+	server := httptest.NewServer(NewBasePath("/user-preferences/v1/", n))
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/user-preferences/v1/test-user", nil, nil)
+	if status != http.StatusOK || string(body) != `{"theme":"dark"}` {
+		t.Errorf("GET under the base path returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/user-preferences/v1", nil, map[string]string{"Accept": "text/plain"})
+	if status != http.StatusOK || string(body) != "Hello from user-preferences." {
+		t.Errorf("GET of the base path returned %d '%s'", status, body)
+	}
+
+	for _, path := range []string{"/test-user", "/user-preferences/v1test-user", "/user-preferences"} {
+		if status, _ = doRequest(t, http.MethodGet, server.URL+path, nil, nil); status != http.StatusNotFound {
+			t.Errorf("GET %s outside the base path returned %d instead of %d", path, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestBasePathLinks(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	handler := NewBasePath("/user-preferences/v1", New(mock))
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/user-preferences/v1/test-user", bytes.NewBufferString(`{"theme":"dark"}`))
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("PUT under the base path returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if location := recorder.Header().Get("Location"); location != "/user-preferences/v1/test-user" {
+		t.Errorf("the Location header was %s", location)
+	}
+
+	recorder = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/user-preferences/v1/", nil)
+	r.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(recorder, r)
+
+	var descriptor serviceDescriptor
+	if err := json.Unmarshal(recorder.Body.Bytes(), &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.Links["health"] != "/user-preferences/v1/healthz" || descriptor.Links["openapi"] != "/user-preferences/v1/openapi.json" {
+		t.Errorf("the descriptor's links were %v", descriptor.Links)
+	}
+	if serviceLinks["health"] != "/healthz" {
+		t.Errorf("prefixing the descriptor's links changed the defaults to %v", serviceLinks)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/user-preferences/v1/openapi.json", nil))
+
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/user-preferences/v1" {
+		t.Errorf("the OpenAPI servers were %+v", spec.Servers)
+	}
+	if _, ok := spec.Paths["/{username}"]; !ok {
+		t.Error("the OpenAPI description lost its paths")
+	}
+}
+
+func TestBasePathTenants(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	tenants := NewTenantRouter("")
+	tenants.Add("iplant", New(mock))
+	handler := NewBasePath("/user-preferences/v1", tenants)
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/user-preferences/v1/tenants/iplant/test-user", bytes.NewBufferString(`{"theme":"dark"}`))
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("PUT under the base path returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if location := recorder.Header().Get("Location"); location != "/user-preferences/v1/tenants/iplant/test-user" {
+		t.Errorf("the Location header was %s", location)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// benchmarkSizes are the numbers of entries in the documents used by the
+// benchmarks, covering a typical user and one with a lot of history.
+var benchmarkSizes = []int{10, 1000}
+
+// benchmarkRecord returns a stored record for a representative document with
+// the number of entries, wrapped in a preferences object if wrapped is true.
+func benchmarkRecord(b *testing.B, entries int, wrapped bool) *UserPreferencesRecord {
+	var doc interface{} = representativeDocument(entries)
+	if wrapped {
+		doc = map[string]interface{}{"preferences": doc}
+	}
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &UserPreferencesRecord{Preferences: string(encoded)}
+}
+
+func BenchmarkConvert(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		for _, stored := range []bool{false, true} {
+			record := benchmarkRecord(b, entries, stored)
+			for _, wrap := range []bool{false, true} {
+				b.Run(fmt.Sprintf("%d/stored-wrapped=%t/wrap=%t", entries, stored, wrap), func(b *testing.B) {
+					b.SetBytes(int64(len(record.Preferences)))
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if _, err := convert(record, wrap); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkWrapUnwrap covers reading a stored document and writing it back,
+// which unwraps the stored document and wraps the result again.
+func BenchmarkWrapUnwrap(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		record := benchmarkRecord(b, entries, true)
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				doc, err := convert(record, true)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = documentJSON.Marshal(map[string]interface{}{"preferences": unwrappedDocument(doc)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkRequests sends a representative document to the user's document
+// with the method, b.N times, through the service's router and a mocked
+// database. Saved searches are left out because they're stored separately.
+func benchmarkRequests(b *testing.B, method string, entries int) {
+	doc := representativeDocument(entries)
+	delete(doc, "savedSearches")
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err = mock.insertPreferences("test-user", string(body)); err != nil {
+		b.Fatal(err)
+	}
+	n := New(mock)
+
+	defer log.SetLevel(log.Level())
+	log.SetLevel(ErrorLevel)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(method, "/test-user", bytes.NewReader(body))
+		recorder := httptest.NewRecorder()
+		n.router.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("%s returned %d: %s", method, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func BenchmarkPutRequest(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			benchmarkRequests(b, http.MethodPut, entries)
+		})
+	}
+}
+
+func BenchmarkPostRequest(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			benchmarkRequests(b, http.MethodPost, entries)
+		})
+	}
+}
+
+func BenchmarkGetRequest(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			benchmarkRequests(b, http.MethodGet, entries)
+		})
+	}
+}
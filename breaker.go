@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// databaseMetrics contains the per-database retry and circuit breaker counters
+// published at /debug/vars.
+var databaseMetrics = expvar.NewMap("database")
+
+// ErrCircuitOpen is returned for database calls that are rejected because the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("The database is unavailable")
+
+// The states a circuit breaker can be in.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// isTransient returns true if the database call that returned err may succeed
+// if it's tried again.
+func isTransient(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53":
+			return true
+		}
+		return pqErr.Code == "57P01"
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isRetryableWrite returns true if the write that returned err certainly wasn't
+// applied, so that trying it again can't apply it twice. A lost connection or
+// any other failure that isTransient accepts may have come after the write was
+// committed, so writes are only retried if the driver never used the
+// connection, or the transaction was rolled back by a serialization failure or
+// a deadlock.
+func isRetryableWrite(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// isDatabaseFailure returns true if err indicates that the database is
+// unhealthy, as opposed to an error caused by the request itself. Queries that
+// were canceled by the statement timeout aren't retried, but they do count as
+// failures. On CockroachDB, serialization failures are retried but don't count,
+// since they're caused by contention rather than an unhealthy database.
+func isDatabaseFailure(err error) bool {
+	if cockroachMode && isSerializationFailure(err) {
+		return false
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "57014" {
+		return true
+	}
+	return isTransient(err)
+}
+
+// CircuitBreaker stops database calls from being made after a run of
+// consecutive failures. Once the cooldown has passed calls are allowed again;
+// the first success closes the breaker and the first failure re-opens it.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+// NewCircuitBreaker returns a newly created *CircuitBreaker. The name is used
+// to identify the breaker's metrics. A threshold of zero disables the breaker.
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		now:       time.Now,
+	}
+	b.publish()
+	return b
+}
+
+// publish records the breaker's current state in the metrics. The caller must
+// hold the lock, if it's needed.
+func (b *CircuitBreaker) publish() {
+	state := new(expvar.String)
+	state.Set(b.state)
+	databaseMetrics.Set(b.name+".breaker_state", state)
+}
+
+// rejecting returns true if calls are currently being rejected. The caller must
+// hold the lock.
+func (b *CircuitBreaker) rejecting() bool {
+	return b.state == breakerOpen && b.now().Sub(b.openedAt) < b.cooldown
+}
+
+// Rejecting returns true if calls are currently being rejected.
+func (b *CircuitBreaker) Rejecting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rejecting()
+}
+
+// State returns the breaker's current state.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow returns ErrCircuitOpen if a call shouldn't be made.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.state != breakerOpen {
+		return nil
+	}
+
+	if b.rejecting() {
+		databaseMetrics.Add(b.name+".rejected", 1)
+		return ErrCircuitOpen
+	}
+
+	b.state = breakerHalfOpen
+	b.publish()
+	return nil
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	if !isDatabaseFailure(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			log.Infof("Closing the %s database circuit breaker", b.name)
+			b.state = breakerClosed
+			b.publish()
+		}
+		return
+	}
+
+	b.failures++
+	databaseMetrics.Add(b.name+".failures", 1)
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Errorf("Opening the %s database circuit breaker after %d failures: %s", b.name, b.failures, err)
+		b.state = breakerOpen
+		b.openedAt = b.now()
+		databaseMetrics.Add(b.name+".trips", 1)
+		b.publish()
+	}
+}
+
+// readyResponse is the JSON body returned by the readiness endpoint.
+type readyResponse struct {
+	Ready          bool   `json:"ready"`
+	CircuitBreaker string `json:"circuit_breaker"`
+}
+
+// ReadyRequest handles reporting whether the service is ready to handle
+// requests. The service isn't ready while the database circuit breaker is
+// rejecting calls.
+func (u *UserPreferencesApp) ReadyRequest(writer http.ResponseWriter, r *http.Request) {
+	response := &readyResponse{Ready: true, CircuitBreaker: "disabled"}
+	if u.breaker != nil {
+		response.CircuitBreaker = u.breaker.State()
+		response.Ready = !u.breaker.Rejecting()
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating readiness JSON: %s", err))
+		return
+	}
+
+	if !response.Ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writer.Write(jsoned)
+}
+
+// unavailable writes out a 503 response for a request that was rejected
+// because the database is unavailable.
+func unavailable(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusServiceUnavailable)
+	log.Error(msg)
+}
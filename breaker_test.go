@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{driver.ErrBadConn, true},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "57014"}, false},
+		{&pq.Error{Code: "23505"}, false},
+		{sql.ErrNoRows, false},
+		{errors.New("bad input"), false},
+	}
+
+	for _, test := range tests {
+		if actual := isTransient(test.err); actual != test.expected {
+			t.Errorf("isTransient(%#v) returned %t", test.err, actual)
+		}
+	}
+
+	if !isDatabaseFailure(&pq.Error{Code: "57014"}) {
+		t.Error("a canceled statement is not a database failure")
+	}
+}
+
+func TestIsRetryableWrite(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{driver.ErrBadConn, true},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "40003"}, false},
+		{&pq.Error{Code: "08006"}, false},
+		{&pq.Error{Code: "57P01"}, false},
+		{io.EOF, false},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, false},
+		{sql.ErrNoRows, false},
+	}
+
+	for _, test := range tests {
+		if actual := isRetryableWrite(test.err); actual != test.expected {
+			t.Errorf("isRetryableWrite(%#v) returned %t", test.err, actual)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker("test-breaker", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.record(driver.ErrBadConn)
+	if b.State() != breakerClosed {
+		t.Errorf("the breaker was %s after one failure", b.State())
+	}
+
+	b.record(sql.ErrNoRows)
+	b.record(driver.ErrBadConn)
+	if b.State() != breakerClosed {
+		t.Errorf("the breaker was %s after a success reset the failures", b.State())
+	}
+
+	b.record(driver.ErrBadConn)
+	if b.State() != breakerOpen {
+		t.Errorf("the breaker was %s after two consecutive failures", b.State())
+	}
+
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Errorf("allow() returned %v while the breaker was open", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Errorf("allow() returned %s after the cooldown", err)
+	}
+	if b.State() != breakerHalfOpen {
+		t.Errorf("the breaker was %s after the cooldown", b.State())
+	}
+
+	b.record(driver.ErrBadConn)
+	if b.State() != breakerOpen {
+		t.Errorf("the breaker was %s after a half-open failure", b.State())
+	}
+
+	now = now.Add(time.Minute)
+	b.allow()
+	b.record(nil)
+	if b.State() != breakerClosed {
+		t.Errorf("the breaker was %s after a half-open success", b.State())
+	}
+
+	if databaseMetrics.Get("test-breaker.trips").String() != "2" {
+		t.Errorf("trips metric was %s", databaseMetrics.Get("test-breaker.trips"))
+	}
+}
+
+// flakyDB fails the isUser and insertPreferences calls with the error until
+// failures reaches zero.
+type flakyDB struct {
+	*MockDB
+	err      error
+	failures int
+	calls    int
+	inserts  int
+}
+
+func (f *flakyDB) isUser(username string) (bool, error) {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return false, f.err
+	}
+	return f.MockDB.isUser(username)
+}
+
+func (f *flakyDB) insertPreferences(username, prefs string) error {
+	f.inserts++
+	if f.failures > 0 {
+		f.failures--
+		return f.err
+	}
+	return f.MockDB.insertPreferences(username, prefs)
+}
+
+func TestResilientDB(t *testing.T) {
+	flaky := &flakyDB{MockDB: NewMockDB(), err: driver.ErrBadConn, failures: 2}
+	flaky.users["test-user"] = true
+
+	var waits []time.Duration
+	r := NewResilientDB(flaky, NewCircuitBreaker("test-resilient", 5, time.Minute), 3, 10*time.Millisecond)
+	r.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	exists, err := r.isUser("test-user")
+	if err != nil {
+		t.Fatalf("isUser returned %s after transient failures", err)
+	}
+	if !exists || flaky.calls != 3 {
+		t.Errorf("isUser returned %t after %d calls", exists, flaky.calls)
+	}
+	if len(waits) != 2 || waits[0] != 10*time.Millisecond || waits[1] != 20*time.Millisecond {
+		t.Errorf("the waits were %v", waits)
+	}
+
+	flaky.calls = 0
+	flaky.err = &pq.Error{Code: "23505"}
+	flaky.failures = 1
+	if _, err = r.isUser("test-user"); err == nil {
+		t.Error("a permanent error was not returned")
+	}
+	if flaky.calls != 1 {
+		t.Errorf("a permanent error was tried %d times", flaky.calls)
+	}
+
+	flaky.err = io.EOF
+	flaky.failures = 1
+	if err = r.insertPreferences("test-user", `{}`); err != io.EOF {
+		t.Errorf("a write that may have been applied returned %v", err)
+	}
+	if flaky.inserts != 1 {
+		t.Errorf("a write that may have been applied was tried %d times", flaky.inserts)
+	}
+
+	flaky.err = &pq.Error{Code: "40001"}
+	flaky.failures = 1
+	flaky.inserts = 0
+	if err = r.insertPreferences("test-user", `{}`); err != nil {
+		t.Errorf("a write that failed to serialize returned %s", err)
+	}
+	if flaky.inserts != 2 {
+		t.Errorf("a write that failed to serialize was tried %d times", flaky.inserts)
+	}
+}
+
+func TestReadyRequest(t *testing.T) {
+	n := New(NewMockDB())
+	n.breaker = NewCircuitBreaker("test-ready", 1, time.Minute)
+
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/readyz", nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("readyz returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed readyResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Ready || parsed.CircuitBreaker != breakerClosed {
+		t.Errorf("readyz returned %#v", parsed)
+	}
+
+	n.breaker.record(driver.ErrBadConn)
+
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/readyz", nil, nil)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("readyz returned %d instead of %d with an open breaker", status, http.StatusServiceUnavailable)
+	}
+
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("a request returned %d instead of %d with an open breaker", status, http.StatusServiceUnavailable)
+	}
+}
+
+// blockingDB blocks reads of preferences until it's released.
+type blockingDB struct {
+	*MockDB
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+	if atomic.AddInt32(&b.calls, 1) == 1 {
+		close(b.started)
+	}
+	<-b.release
+	return b.MockDB.getPreferences(username)
+}
+
+func TestResilientDBSharedReads(t *testing.T) {
+	blocking := &blockingDB{MockDB: NewMockDB(), started: make(chan struct{}), release: make(chan struct{})}
+	blocking.insertPreferences("test-user", `{"theme":"dark"}`)
+	r := NewResilientDB(blocking, NewCircuitBreaker("test-shared", 5, time.Minute), 0, 0)
+
+	const readers = 5
+	var wg sync.WaitGroup
+	results := make([][]UserPreferencesRecord, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				<-blocking.started
+			}
+			var err error
+			if results[i], err = r.getPreferences("test-user"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	// Give the other readers time to join the first one's query.
+	<-blocking.started
+	time.Sleep(50 * time.Millisecond)
+	close(blocking.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&blocking.calls); calls != 1 {
+		t.Errorf("%d concurrent reads made %d queries", readers, calls)
+	}
+	for i, records := range results {
+		if len(records) != 1 || records[0].Preferences != `{"theme":"dark"}` {
+			t.Errorf("reader %d got %#v", i, records)
+		}
+	}
+
+	results[0][0].Preferences = "{}"
+	if results[1][0].Preferences != `{"theme":"dark"}` {
+		t.Error("the readers share the same records")
+	}
+
+	if _, err := r.getPreferences("test-user"); err != nil || atomic.LoadInt32(&blocking.calls) != 2 {
+		t.Errorf("a later read returned %v after %d queries", err, blocking.calls)
+	}
+}
+
+func TestResilientDBWritesEndSharedReads(t *testing.T) {
+	blocking := &blockingDB{MockDB: NewMockDB(), started: make(chan struct{}), release: make(chan struct{})}
+	blocking.insertPreferences("test-user", `{"theme":"dark"}`)
+	r := NewResilientDB(blocking, NewCircuitBreaker("test-shared-writes", 5, time.Minute), 0, 0)
+
+	var wg sync.WaitGroup
+	read := func() {
+		defer wg.Done()
+		if _, err := r.getPreferences("test-user"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Add(1)
+	go read()
+	<-blocking.started
+
+	if err := r.updatePreferences("test-user", `{"theme":"light"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read that starts after the write mustn't join the query that started
+	// before it.
+	wg.Add(1)
+	go read()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&blocking.calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(blocking.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&blocking.calls); calls != 2 {
+		t.Errorf("the reads before and after the write made %d queries", calls)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// upsertPreferences replaces the preferences of each user in the map, or
+// inserts them for users who don't have any, in a single transaction. It
+// returns whether each user's preferences were inserted.
+func (p *PrefsDB) upsertPreferences(prefs map[string]string) (map[string]bool, error) {
+	update := `UPDATE ` + p.onlyPreferences() + `
+                     SET preferences = $2,
+                         encoding = $3,
+                         compressed = $4,
+                         checksum = $5,
+                         version = version + 1
+                   WHERE user_id = $1`
+	insert := `INSERT INTO ` + p.tables.Preferences + ` (user_id, preferences, encoding, compressed, checksum)
+                  VALUES ($1, $2, $3, $4, $5)`
+
+	usernames := make([]string, 0, len(prefs))
+	for username := range prefs {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	userIDs := make(map[string]string, len(prefs))
+	for _, username := range usernames {
+		userID, err := p.userID(username)
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up user %s: %s", username, err)
+		}
+		userIDs[username] = userID
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	created := make(map[string]bool, len(prefs))
+	for _, username := range usernames {
+		stored, encoding, compressed, err := p.encodePreferences(prefs[username])
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		checksum := preferencesChecksum(prefs[username])
+
+		result, err := tx.Exec(update, userIDs[username], stored, encoding, compressed, checksum)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if updated > 0 {
+			continue
+		}
+
+		if _, err = tx.Exec(insert, userIDs[username], stored, encoding, compressed, checksum); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		created[username] = true
+	}
+
+	return created, tx.Commit()
+}
+
+// bulkWriteResponse is the JSON body returned after writing the preferences of
+// several users.
+type bulkWriteResponse struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+}
+
+// BulkWriteRequest handles replacing the preferences of several users at once.
+// The body maps usernames to their new preferences, which are all written in
+// one transaction; if any of them can't be written, none are. Every user must
+// already exist, and at most the admin batch size may be written at a time.
+func (u *UserPreferencesApp) BulkWriteRequest(writer http.ResponseWriter, r *http.Request) {
+	var body map[string]map[string]interface{}
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if len(body) == 0 {
+		badRequest(writer, "At least one user's preferences must be given")
+		return
+	}
+	if limit := u.operations.batchSize; limit > 0 && len(body) > limit {
+		badRequest(writer, fmt.Sprintf("At most %d users' preferences may be written at once", limit))
+		return
+	}
+
+	var unknown []string
+	for username := range body {
+		exists, err := u.prefs.isUser(username)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+			return
+		}
+		if !exists {
+			unknown = append(unknown, username)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		badRequest(writer, fmt.Sprintf("Unknown users: %s", strings.Join(unknown, ", ")))
+		return
+	}
+
+	prefs := make(map[string]string, len(body))
+	for username, values := range body {
+		if values == nil {
+			values = make(map[string]interface{})
+		}
+		u.stripComputed(values)
+
+		jsoned, err := documentJSON.Marshal(values)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error generating preferences JSON for user %s: %s", username, err))
+			return
+		}
+		if err = u.checkQuota(username, len(jsoned)); err != nil {
+			storeFailed(writer, err)
+			return
+		}
+		prefs[username] = string(jsoned)
+	}
+
+	created, err := u.prefs.upsertPreferences(prefs)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error writing preferences for %d users: %s", len(prefs), err))
+		return
+	}
+
+	response := bulkWriteResponse{Created: []string{}, Updated: []string{}}
+	for username := range prefs {
+		if created[username] {
+			response.Created = append(response.Created, username)
+		} else {
+			response.Updated = append(response.Updated, username)
+		}
+	}
+	sort.Strings(response.Created)
+	sort.Strings(response.Updated)
+
+	users := append(append([]string{}, response.Created...), response.Updated...)
+	sort.Strings(users)
+	if err = u.audit("bulk-write", map[string]string{"users": strings.Join(users, ",")}); err != nil {
+		log.Error(err)
+	}
+
+	jsoned, err := json.Marshal(&response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating bulk write JSON: %s", err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBulkWriteRequest(t *testing.T) {
+	mock := NewMockDB()
+	for _, username := range []string{"alice", "bob", "carol"} {
+		mock.users[username] = true
+	}
+	mock.insertPreferences("alice", `{"theme":"dark","old":true}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/admin/preferences"
+	admin := map[string]string{adminKeyHeader: "secret"}
+	body := []byte(`{"alice":{"theme":"light"},"bob":{"workshop":"genomics"}}`)
+
+	if status, _ := doRequest(t, http.MethodPut, url, body, nil); status != http.StatusForbidden {
+		t.Errorf("a bulk write without the admin key returned %d", status)
+	}
+
+	status, resBody := doRequest(t, http.MethodPut, url, []byte(`{"alice":{},"zed":{},"yan":{}}`), admin)
+	if status != http.StatusBadRequest || !strings.Contains(string(resBody), "Unknown users: yan, zed") {
+		t.Errorf("a bulk write for unknown users returned %d: %s", status, resBody)
+	}
+	if prefs, _ := mock.getPreferences("alice"); prefs[0].Preferences != `{"theme":"dark","old":true}` {
+		t.Error("a rejected bulk write was partly applied")
+	}
+
+	status, resBody = doRequest(t, http.MethodPut, url, body, admin)
+	if status != http.StatusOK {
+		t.Fatalf("the bulk write returned %d: %s", status, resBody)
+	}
+
+	var response bulkWriteResponse
+	if err := json.Unmarshal(resBody, &response); err != nil {
+		t.Fatal(err)
+	}
+	expected := bulkWriteResponse{Created: []string{"bob"}, Updated: []string{"alice"}}
+	if !reflect.DeepEqual(response, expected) {
+		t.Errorf("the bulk write returned %#v", response)
+	}
+
+	for username, doc := range map[string]string{"alice": `{"theme":"light"}`, "bob": `{"workshop":"genomics"}`} {
+		if prefs, _ := mock.getPreferences(username); len(prefs) != 1 || prefs[0].Preferences != doc {
+			t.Errorf("the preferences stored for %s were %#v", username, prefs)
+		}
+	}
+	if has, _ := mock.hasPreferences("carol"); has {
+		t.Error("preferences were stored for a user who wasn't in the request")
+	}
+
+	if len(mock.audits) != 1 || mock.audits[0] != `bulk-write {"users":"alice,bob"}` {
+		t.Errorf("the audit log was %#v", mock.audits)
+	}
+}
+
+func TestBulkWriteLimits(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+
+	n := New(mock)
+	n.operations = NewOperationTracker(1)
+	n.quota = 10
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/admin/preferences"
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{}`), admin); status != http.StatusBadRequest {
+		t.Errorf("an empty bulk write returned %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"alice":{},"bob":{}}`), admin); status != http.StatusBadRequest {
+		t.Errorf("a bulk write over the batch size returned %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"alice":{"theme":"solarized"}}`), admin); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a bulk write over the quota returned %d", status)
+	}
+}
+
+func TestUpsertPreferences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("2"))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE ONLY user_preferences SET (.+) WHERE user_id = \\$1").
+		WithArgs("1", `{"a":1}`, "identity", []byte(nil), preferencesChecksum(`{"a":1}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE ONLY user_preferences SET (.+) WHERE user_id = \\$1").
+		WithArgs("2", `{"b":2}`, "identity", []byte(nil), preferencesChecksum(`{"b":2}`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_preferences \\(user_id, preferences, encoding, compressed, checksum\\)").
+		WithArgs("2", `{"b":2}`, "identity", []byte(nil), preferencesChecksum(`{"b":2}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	created, err := p.upsertPreferences(map[string]string{"alice": `{"a":1}`, "bob": `{"b":2}`})
+	if err != nil {
+		t.Fatalf("error upserting preferences: %s", err)
+	}
+	if !reflect.DeepEqual(created, map[string]bool{"bob": true}) {
+		t.Errorf("upsertPreferences returned %#v", created)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CacheRule is the caching policy for the GET responses of a route.
+type CacheRule struct {
+	// Route is the route's path template, such as /{username}.
+	Route string
+
+	// MaxAge is how long caches may reuse a response.
+	MaxAge time.Duration
+
+	// Public allows shared caches, such as a CDN, to store responses to
+	// authenticated requests. Otherwise only the client may store them.
+	Public bool
+
+	// Vary lists the request headers that select between responses, in
+	// addition to any the handler adds.
+	Vary []string
+}
+
+// cacheControl returns the Cache-Control header value for the rule.
+func (c *CacheRule) cacheControl() string {
+	scope := "private"
+	if c.Public {
+		scope = "public"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(c.MaxAge/time.Second))
+}
+
+// CachePolicy decides the caching headers of each response. GET and HEAD
+// responses from routes with a rule can be cached for the rule's max age and
+// carry an ETag computed from their bodies; responses to every other method
+// are marked uncacheable. Headers set by the handlers are left alone.
+type CachePolicy struct {
+	rules map[string]*CacheRule
+}
+
+// NewCachePolicy returns a newly created *CachePolicy from the caching.routes
+// configuration setting, a map from route path templates to their rules. Each
+// template must be one of the router's.
+func NewCachePolicy(config map[string]interface{}, router *mux.Router) (*CachePolicy, error) {
+	templates := make(map[string]bool)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if template, err := route.GetPathTemplate(); err == nil {
+			templates[template] = true
+		}
+		return nil
+	})
+
+	var routes []string
+	for route := range config {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	c := &CachePolicy{rules: make(map[string]*CacheRule)}
+	for _, route := range routes {
+		if !templates[route] {
+			return nil, fmt.Errorf("The caching rule for %s doesn't match a route", route)
+		}
+
+		settings, ok := config[route].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The caching rule for %s must be a map", route)
+		}
+
+		rule := &CacheRule{Route: route}
+		maxAge, _ := settings["max-age"].(string)
+		if rule.MaxAge, ok = parseMaxAge(maxAge); !ok {
+			return nil, fmt.Errorf("The max-age of the caching rule for %s must be a positive duration", route)
+		}
+		if value, present := settings["public"]; present {
+			if rule.Public, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("The public setting of the caching rule for %s must be true or false", route)
+			}
+		}
+		if value, present := settings["vary"]; present {
+			headers, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("The vary setting of the caching rule for %s must be a list of header names", route)
+			}
+			for _, header := range headers {
+				name, ok := header.(string)
+				if !ok || name == "" {
+					return nil, fmt.Errorf("The vary setting of the caching rule for %s must be a list of header names", route)
+				}
+				rule.Vary = append(rule.Vary, http.CanonicalHeaderKey(name))
+			}
+		}
+
+		c.rules[route] = rule
+	}
+
+	return c, nil
+}
+
+// parseMaxAge parses a rule's max age, which must be at least a second.
+func parseMaxAge(value string) (time.Duration, bool) {
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge < time.Second {
+		return 0, false
+	}
+	return maxAge, true
+}
+
+// rule returns the rule for the route the request is routed to, or nil if
+// there isn't one.
+func (c *CachePolicy) rule(router *mux.Router, r *http.Request) *CacheRule {
+	if len(c.rules) == 0 {
+		return nil
+	}
+
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return nil
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	return c.rules[template]
+}
+
+// wrap returns the writer that applies the caching headers for the request,
+// and a function that must be called once the handler has finished.
+func (c *CachePolicy) wrap(writer http.ResponseWriter, r *http.Request, router *mux.Router) (http.ResponseWriter, func()) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Handlers that choose their own Cache-Control header replace this.
+		writer.Header().Set("Cache-Control", "no-store")
+		return writer, func() {}
+	}
+
+	rule := c.rule(router, r)
+	if rule == nil {
+		return writer, func() {}
+	}
+
+	cw := &cachingWriter{ResponseWriter: writer, rule: rule, request: r}
+	return cw, cw.finish
+}
+
+// cachingWriter holds a cacheable response until the handler finishes, so that
+// its ETag can be computed from the body and compared with the request's
+// If-None-Match header.
+type cachingWriter struct {
+	http.ResponseWriter
+	rule    *CacheRule
+	request *http.Request
+	status  int
+	body    bytes.Buffer
+}
+
+func (w *cachingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *cachingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// finish adds the caching headers and writes out the held response. Only
+// successful responses are cacheable; errors are marked no-store so that a
+// cache doesn't keep serving them.
+func (w *cachingWriter) finish() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	header := w.Header()
+
+	for _, name := range w.rule.Vary {
+		if !headerListContains(header["Vary"], name) {
+			header.Add("Vary", name)
+		}
+	}
+
+	if w.status != http.StatusOK {
+		if header.Get("Cache-Control") == "" {
+			header.Set("Cache-Control", "no-store")
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", w.rule.cacheControl())
+	}
+	if header.Get("ETag") == "" && w.request.Method == http.MethodGet {
+		sum := sha256.Sum256(w.body.Bytes())
+		header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+
+	if etag := header.Get("ETag"); etag != "" && etagMatches(w.request.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+// headerListContains returns whether the comma-separated header values
+// include the name, ignoring case.
+func headerListContains(values []string, name string) bool {
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// etagMatches returns whether the If-None-Match header value matches the ETag,
+// using the weak comparison the header calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
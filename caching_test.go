@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const cachingConfig = `user-preferences:
+  admin:
+    key: secret
+  caching:
+    routes:
+      "/{username}":
+        max-age: 30s
+        public: true
+        vary: [authorization]
+      /admin/jobs:
+        max-age: 1m
+`
+
+func TestCachingHeaders(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, cachingConfig)); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("the GET returned %d with the ETag %q", resp.StatusCode, etag)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=30" {
+		t.Errorf("the Cache-Control header was %q", cc)
+	}
+	if !headerListContains(resp.Header["Vary"], "Authorization") {
+		t.Errorf("the Vary header was %v", resp.Header["Vary"])
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/alice", nil)
+	req.Header.Set("If-None-Match", `"stale", `+etag)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || resp.ContentLength > 0 {
+		t.Errorf("a GET with a matching ETag returned %d", resp.StatusCode)
+	}
+
+	status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"light"}`), nil)
+	if status != http.StatusOK {
+		t.Fatalf("the PUT returned %d", status)
+	}
+
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("a GET with a stale ETag returned %d with the ETag %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestCachingUncacheable(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, cachingConfig)); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		expected     string
+	}{
+		{http.MethodPut, "/alice", "no-store"},
+		{http.MethodDelete, "/alice", "no-store"},
+		{http.MethodGet, "/admin/jobs", "no-store"},
+		{http.MethodGet, "/alice/history", ""},
+	} {
+		var body *strings.Reader
+		if tc.method == http.MethodPut {
+			body = strings.NewReader(`{}`)
+		} else {
+			body = strings.NewReader("")
+		}
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.path, body))
+		if cc := recorder.Header().Get("Cache-Control"); cc != tc.expected {
+			t.Errorf("%s %s returned %d with the Cache-Control header %q", tc.method, tc.path, recorder.Code, cc)
+		}
+		if recorder.Header().Get("ETag") != "" {
+			t.Errorf("%s %s returned an ETag", tc.method, tc.path)
+		}
+	}
+}
+
+func TestNewCachePolicy(t *testing.T) {
+	router := New(NewMockDB()).router
+	for _, config := range []map[string]interface{}{
+		{"/nowhere": map[string]interface{}{"max-age": "30s"}},
+		{"/{username}": "30s"},
+		{"/{username}": map[string]interface{}{"max-age": "soon"}},
+		{"/{username}": map[string]interface{}{"max-age": "100ms"}},
+		{"/{username}": map[string]interface{}{"max-age": "30s", "public": "yes"}},
+		{"/{username}": map[string]interface{}{"max-age": "30s", "vary": "Accept"}},
+	} {
+		if _, err := NewCachePolicy(config, router); err == nil {
+			t.Errorf("NewCachePolicy(%v) did not return an error", config)
+		}
+	}
+
+	policy, err := NewCachePolicy(map[string]interface{}{
+		"/{username}": map[string]interface{}{"max-age": "2m", "vary": []interface{}{"accept"}},
+	}, router)
+	if err != nil {
+		t.Fatalf("error from NewCachePolicy(): %s", err)
+	}
+	rule := policy.rules["/{username}"]
+	if rule.cacheControl() != "private, max-age=120" || len(rule.Vary) != 1 || rule.Vary[0] != "Accept" {
+		t.Errorf("the rule was %+v", rule)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header, etag string
+		expected     bool
+	}{
+		{"", `"a"`, false},
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{"*", `"a"`, true},
+		{`"b"`, `"a"`, false},
+	} {
+		if actual := etagMatches(tc.header, tc.etag); actual != tc.expected {
+			t.Errorf("etagMatches(%q, %q) returned %t", tc.header, tc.etag, actual)
+		}
+	}
+}
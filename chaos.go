@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosPath is the path of the endpoint that manages fault injection. Faults
+// are never injected into it, so they can always be cleared.
+const chaosPath = "/admin/chaos"
+
+// ChaosRule describes the faults to inject into requests whose paths start
+// with Route. An empty Methods list matches every method. Latency is added
+// before anything else. A fraction of the requests given by ErrorRate then get
+// ErrorStatus, and if DatabaseUnavailable is set the rest get the same
+// response as when the database circuit breaker is open.
+type ChaosRule struct {
+	Route               string   `json:"route"`
+	Methods             []string `json:"methods,omitempty"`
+	Latency             string   `json:"latency,omitempty"`
+	ErrorRate           float64  `json:"error_rate,omitempty"`
+	ErrorStatus         int      `json:"error_status,omitempty"`
+	DatabaseUnavailable bool     `json:"database_unavailable,omitempty"`
+
+	latency time.Duration
+}
+
+// validate checks the rule and fills in its defaults.
+func (c *ChaosRule) validate() error {
+	if !strings.HasPrefix(c.Route, "/") {
+		return fmt.Errorf("The route %q must start with /", c.Route)
+	}
+
+	if c.Latency != "" {
+		latency, err := time.ParseDuration(c.Latency)
+		if err != nil || latency < 0 {
+			return fmt.Errorf("Invalid latency %q for route %s", c.Latency, c.Route)
+		}
+		c.latency = latency
+	}
+
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("The error rate for route %s must be between 0 and 1", c.Route)
+	}
+	if c.ErrorStatus == 0 {
+		c.ErrorStatus = http.StatusInternalServerError
+	}
+	if c.ErrorStatus < 400 || c.ErrorStatus > 599 {
+		return fmt.Errorf("The error status for route %s must be between 400 and 599", c.Route)
+	}
+
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// matches returns true if the rule applies to the request.
+func (c *ChaosRule) matches(r *http.Request) bool {
+	prefix := strings.TrimSuffix(c.Route, "/")
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		return false
+	}
+	if len(c.Methods) == 0 {
+		return true
+	}
+	for _, method := range c.Methods {
+		if method == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// Chaos injects faults into requests so that the resilience of the service's
+// clients can be tested. When more than one rule matches a request, the rule
+// with the longest route wins.
+type Chaos struct {
+	mu     sync.Mutex
+	rules  []ChaosRule
+	random func() float64
+	sleep  func(time.Duration)
+}
+
+// NewChaos returns a newly created *Chaos without any rules.
+func NewChaos() *Chaos {
+	return &Chaos{
+		random: rand.Float64,
+		sleep:  time.Sleep,
+	}
+}
+
+// Rules returns the current rules.
+func (c *Chaos) Rules() []ChaosRule {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ChaosRule{}, c.rules...)
+}
+
+// SetRules validates and replaces the current rules.
+func (c *Chaos) SetRules(rules []ChaosRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Route) > len(rules[j].Route)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+	return nil
+}
+
+// inject applies the faults of the rule matching the request, if there is one.
+// It returns true if it wrote a response, in which case the request must not
+// be handled.
+func (c *Chaos) inject(writer http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path == chaosPath {
+		return false
+	}
+
+	c.mu.Lock()
+	var rule *ChaosRule
+	for i := range c.rules {
+		if c.rules[i].matches(r) {
+			matched := c.rules[i]
+			rule = &matched
+			break
+		}
+	}
+	fail := rule != nil && rule.ErrorRate > 0 && c.random() < rule.ErrorRate
+	c.mu.Unlock()
+
+	if rule == nil {
+		return false
+	}
+
+	if rule.latency > 0 {
+		c.sleep(rule.latency)
+	}
+
+	switch {
+	case fail:
+		http.Error(writer, fmt.Sprintf("Fault injected for %s", rule.Route), rule.ErrorStatus)
+		return true
+	case rule.DatabaseUnavailable:
+		unavailable(writer, ErrCircuitOpen.Error())
+		return true
+	}
+	return false
+}
+
+// chaosRules is the JSON body accepted and returned by the chaos endpoint.
+type chaosRules struct {
+	Rules []ChaosRule `json:"rules"`
+}
+
+// writeChaosRules writes out the current fault injection rules.
+func (u *UserPreferencesApp) writeChaosRules(writer http.ResponseWriter) {
+	jsoned, err := json.Marshal(chaosRules{Rules: u.chaos.Rules()})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating chaos rules JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// GetChaosRequest handles writing out the current fault injection rules.
+func (u *UserPreferencesApp) GetChaosRequest(writer http.ResponseWriter, r *http.Request) {
+	u.writeChaosRules(writer)
+}
+
+// PutChaosRequest handles replacing the fault injection rules.
+func (u *UserPreferencesApp) PutChaosRequest(writer http.ResponseWriter, r *http.Request) {
+	var body chaosRules
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if err := u.chaos.SetRules(body.Rules); err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	log.Warnf("Injecting faults into %d routes", len(body.Rules))
+	u.writeChaosRules(writer)
+}
+
+// DeleteChaosRequest handles removing all of the fault injection rules.
+func (u *UserPreferencesApp) DeleteChaosRequest(writer http.ResponseWriter, r *http.Request) {
+	u.chaos.SetRules(nil)
+	log.Info("Stopped injecting faults")
+	u.writeChaosRules(writer)
+}
+
+// enableChaos turns on fault injection and registers the endpoint that
+// manages it.
+func (u *UserPreferencesApp) enableChaos() {
+	log.Warnf("Fault injection is enabled; manage it at %s", chaosPath)
+	u.chaos = NewChaos()
+	u.router.HandleFunc(chaosPath, u.adminOnly(u.GetChaosRequest)).Methods("GET")
+	u.router.HandleFunc(chaosPath, u.adminOnly(u.PutChaosRequest)).Methods("PUT")
+	u.router.HandleFunc(chaosPath, u.adminOnly(u.DeleteChaosRequest)).Methods("DELETE")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosRuleValidate(t *testing.T) {
+	rule := ChaosRule{Route: "/alice", Methods: []string{"get"}, Latency: "250ms"}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.latency != 250*time.Millisecond || rule.ErrorStatus != http.StatusInternalServerError || rule.Methods[0] != "GET" {
+		t.Errorf("the validated rule was %#v", rule)
+	}
+
+	invalid := []ChaosRule{
+		{Route: "alice"},
+		{Route: "/alice", Latency: "soon"},
+		{Route: "/alice", ErrorRate: 1.5},
+		{Route: "/alice", ErrorStatus: 200},
+	}
+	for _, rule := range invalid {
+		if err := rule.validate(); err == nil {
+			t.Errorf("%#v was accepted", rule)
+		}
+	}
+}
+
+func TestChaosInject(t *testing.T) {
+	var slept time.Duration
+	chaos := NewChaos()
+	chaos.random = func() float64 { return 0.5 }
+	chaos.sleep = func(d time.Duration) { slept += d }
+
+	err := chaos.SetRules([]ChaosRule{
+		{Route: "/", Latency: "1s"},
+		{Route: "/alice", ErrorRate: 0.6, ErrorStatus: http.StatusBadGateway},
+		{Route: "/bob", ErrorRate: 0.4, DatabaseUnavailable: true},
+		{Route: "/carol", Methods: []string{"PUT"}, DatabaseUnavailable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method   string
+		path     string
+		injected bool
+		status   int
+		slept    time.Duration
+	}{
+		{http.MethodGet, "/alice/history", true, http.StatusBadGateway, 0},
+		{http.MethodGet, "/bob", true, http.StatusServiceUnavailable, 0},
+		{http.MethodGet, "/carol", false, http.StatusOK, time.Second},
+		{http.MethodPut, "/carol", true, http.StatusServiceUnavailable, 0},
+		{http.MethodGet, "/alicia", false, http.StatusOK, time.Second},
+		{http.MethodPut, chaosPath, false, http.StatusOK, 0},
+	}
+	for _, c := range cases {
+		slept = 0
+		recorder := httptest.NewRecorder()
+		injected := chaos.inject(recorder, httptest.NewRequest(c.method, c.path, nil))
+		if injected != c.injected || recorder.Code != c.status || slept != c.slept {
+			t.Errorf("%s %s: injected %t with status %d after %s", c.method, c.path, injected, recorder.Code, slept)
+		}
+	}
+}
+
+func TestChaosRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.enableChaos()
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	headers := map[string]string{adminKeyHeader: "secret"}
+
+	body := []byte(`{"rules":[{"route":"/alice","methods":["GET"],"error_rate":1,"error_status":502}]}`)
+	if status, _ := doRequest(t, http.MethodPut, server.URL+chaosPath, body, nil); status != http.StatusForbidden {
+		t.Errorf("setting the rules without the admin key returned %d", status)
+	}
+
+	status, body := doRequest(t, http.MethodPut, server.URL+chaosPath, body, headers)
+	if status != http.StatusOK {
+		t.Fatalf("setting the rules returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusBadGateway {
+		t.Errorf("a request with an injected error returned %d", status)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+chaosPath, nil, headers)
+	var rules chaosRules
+	if err := json.Unmarshal(body, &rules); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(rules.Rules) != 1 || rules.Rules[0].ErrorStatus != http.StatusBadGateway {
+		t.Errorf("listing the rules returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodPut, server.URL+chaosPath, []byte(`{"rules":[{"route":"/","latency":"forever"}]}`), headers); status != http.StatusBadRequest {
+		t.Errorf("an invalid rule returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, server.URL+chaosPath, nil, headers); status != http.StatusOK {
+		t.Errorf("clearing the rules returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusOK {
+		t.Errorf("a request after clearing the rules returned %d", status)
+	}
+}
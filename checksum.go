@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// checksumFailures counts the documents that failed checksum verification when
+// they were read. It's published at /debug/vars.
+var checksumFailures = expvar.NewInt("checksum_failures")
+
+// corruptHeader is set on the error response for a document that failed
+// checksum verification, so that clients can tell it apart from other errors.
+const corruptHeader = "X-Preferences-Corrupt"
+
+// preferencesChecksum returns the hex SHA-256 checksum of the uncompressed
+// preferences document.
+func preferencesChecksum(prefs string) string {
+	sum := sha256.Sum256([]byte(prefs))
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumSQL returns the SQL expression for the checksum of the document
+// produced by the text expression, for statements that rewrite documents in
+// the database.
+func checksumSQL(expr string) string {
+	return `encode(sha256(convert_to(` + expr + `, 'UTF8')), 'hex')`
+}
+
+// ChecksumError is returned when a stored document doesn't match the checksum
+// it was stored with.
+type ChecksumError struct {
+	Username string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("The preferences for user %s are corrupt: their checksum is %s instead of %s", e.Username, e.Actual, e.Expected)
+}
+
+// verifyChecksum returns a ChecksumError if the decoded document doesn't match
+// the stored checksum. Documents without a checksum aren't verified.
+func verifyChecksum(username, prefs string, stored sql.NullString) error {
+	if !stored.Valid {
+		return nil
+	}
+	if actual := preferencesChecksum(prefs); actual != stored.String {
+		checksumFailures.Add(1)
+		return &ChecksumError{Username: username, Expected: stored.String, Actual: actual}
+	}
+	return nil
+}
+
+// readFailed writes out the response for a failed read of a user's preferences.
+// Corrupt documents get a 500 marked with the corrupt header.
+func readFailed(writer http.ResponseWriter, err error) {
+	if _, ok := err.(*ChecksumError); ok {
+		writer.Header().Set(corruptHeader, "true")
+	}
+	errored(writer, err.Error())
+}
+
+// CorruptDocument describes a stored document that failed checksum
+// verification, or that couldn't be decoded at all.
+type CorruptDocument struct {
+	Username   string    `json:"username"`
+	Version    int64     `json:"version"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Expected   string    `json:"expected"`
+	Actual     string    `json:"actual,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ChecksumReport is the result of verifying every stored document. Unverified
+// counts the documents that were written before checksums were stored.
+type ChecksumReport struct {
+	Checked    int64             `json:"checked"`
+	Unverified int64             `json:"unverified"`
+	Corrupt    []CorruptDocument `json:"corrupt"`
+}
+
+// verifyChecksums verifies the checksum of every stored document. Documents
+// found this way aren't counted as failed reads.
+func (p *PrefsDB) verifyChecksums() (*ChecksumReport, error) {
+	query := `SELECT u.username,
+                     p.preferences,
+                     p.encoding,
+                     p.compressed,
+                     p.checksum,
+                     p.version,
+                     p.modified_at
+                FROM ` + p.tables.Preferences + ` p,
+                     ` + p.tables.usersSource() + ` u
+               WHERE p.user_id = u.id
+            ORDER BY u.username`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &ChecksumReport{Corrupt: []CorruptDocument{}}
+	for rows.Next() {
+		var (
+			doc        CorruptDocument
+			stored     sql.NullString
+			encoding   string
+			compressed []byte
+			checksum   sql.NullString
+		)
+		if err = rows.Scan(&doc.Username, &stored, &encoding, &compressed, &checksum, &doc.Version, &doc.ModifiedAt); err != nil {
+			return nil, err
+		}
+
+		report.Checked++
+		if !checksum.Valid {
+			report.Unverified++
+			continue
+		}
+		doc.Expected = checksum.String
+
+		prefs, err := p.decode(stored, encoding, compressed)
+		if err != nil {
+			doc.Error = err.Error()
+			report.Corrupt = append(report.Corrupt, doc)
+			continue
+		}
+		if doc.Actual = preferencesChecksum(prefs); doc.Actual != doc.Expected {
+			report.Corrupt = append(report.Corrupt, doc)
+		}
+	}
+
+	return report, rows.Err()
+}
+
+// ChecksumsRequest handles verifying the checksums of all of the stored
+// documents and writing out the ones that are corrupt.
+func (u *UserPreferencesApp) ChecksumsRequest(writer http.ResponseWriter, r *http.Request) {
+	report, err := u.prefs.verifyChecksums()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error verifying checksums: %s", err))
+		return
+	}
+
+	jsoned, err := json.Marshal(report)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating checksum report JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPreferencesChecksum(t *testing.T) {
+	expected := "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	if actual := preferencesChecksum("{}"); actual != expected {
+		t.Errorf("the checksum of {} was %s", actual)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	before := checksumFailures.Value()
+
+	if err := verifyChecksum("test-user", "{}", sql.NullString{}); err != nil {
+		t.Errorf("a document without a checksum failed verification: %s", err)
+	}
+	if err := verifyChecksum("test-user", "{}", sql.NullString{String: preferencesChecksum("{}"), Valid: true}); err != nil {
+		t.Errorf("a matching document failed verification: %s", err)
+	}
+	if checksumFailures.Value() != before {
+		t.Error("passing verifications were counted as failures")
+	}
+
+	err := verifyChecksum("test-user", `{"a":`, sql.NullString{String: preferencesChecksum(`{"a":1}`), Valid: true})
+	checksumErr, ok := err.(*ChecksumError)
+	if !ok || checksumErr.Username != "test-user" || checksumErr.Expected != preferencesChecksum(`{"a":1}`) {
+		t.Fatalf("verifying a truncated document returned %#v", err)
+	}
+	if checksumFailures.Value() != before+1 {
+		t.Errorf("the failure counter went from %d to %d", before, checksumFailures.Value())
+	}
+}
+
+func TestGetPreferencesChecksumMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT p.id AS id, (.+) FROM user_preferences p, users u").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences", "encoding", "compressed", "checksum", "created_at", "modified_at", "version"}).
+			AddRow("1", "2", `{"a":`, "identity", nil, preferencesChecksum(`{"a":1}`), now, now, 3))
+
+	if _, err = NewPrefsDB(db).getPreferences("test-user"); err == nil {
+		t.Fatal("getPreferences() returned a corrupt document")
+	}
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("getPreferences() returned %#v", err)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT u.username, (.+) FROM user_preferences p, users u WHERE p.user_id = u.id ORDER BY u.username").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "preferences", "encoding", "compressed", "checksum", "version", "modified_at"}).
+			AddRow("alice", "{}", encodingIdentity, nil, preferencesChecksum("{}"), 1, now).
+			AddRow("bob", "{}", encodingIdentity, nil, nil, 1, now).
+			AddRow("carol", `{"a":`, encodingIdentity, nil, preferencesChecksum(`{"a":1}`), 2, now).
+			AddRow("dave", nil, encodingGzip, []byte("garbage"), preferencesChecksum("{}"), 4, now))
+
+	report, err := NewPrefsDB(db).verifyChecksums()
+	if err != nil {
+		t.Fatalf("error from verifyChecksums(): %s", err)
+	}
+	if report.Checked != 4 || report.Unverified != 1 || len(report.Corrupt) != 2 {
+		t.Fatalf("the report was %+v", report)
+	}
+	if carol := report.Corrupt[0]; carol.Username != "carol" || carol.Version != 2 || carol.Actual != preferencesChecksum(`{"a":`) {
+		t.Errorf("the first corrupt document was %+v", carol)
+	}
+	if dave := report.Corrupt[1]; dave.Username != "dave" || dave.Error == "" {
+		t.Errorf("the second corrupt document was %+v", dave)
+	}
+}
+
+func TestCorruptPreferencesRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+	mock.insertPreferences("bob", `{"theme":"light"}`)
+	mock.storage["bob"]["user-prefs"] = `{"theme":"li`
+
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	if status, body := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusOK {
+		t.Errorf("GET of intact preferences returned %d: %s", status, body)
+	}
+
+	res, err := http.Get(server.URL + "/bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError || res.Header.Get(corruptHeader) != "true" {
+		t.Errorf("GET of corrupt preferences returned %d with %s %q", res.StatusCode, corruptHeader, res.Header.Get(corruptHeader))
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/checksums", nil, nil); status != http.StatusForbidden {
+		t.Errorf("the checksum report returned %d without the admin key", status)
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/checksums", nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Fatalf("the checksum report returned %d: %s", status, body)
+	}
+
+	var report ChecksumReport
+	if err = json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || len(report.Corrupt) != 1 || report.Corrupt[0].Username != "bob" {
+		t.Errorf("the checksum report was %s", body)
+	}
+
+	mock.insertPreferences("bob", `{"theme":"light"}`)
+	if status, body = doRequest(t, http.MethodGet, server.URL+"/bob", nil, nil); status != http.StatusOK {
+		t.Errorf("GET of rewritten preferences returned %d: %s", status, body)
+	}
+}
@@ -0,0 +1,182 @@
+// Package client is a Go client for the user-preferences service.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+// Headers understood by the service.
+const (
+	AdminKeyHeader = "X-Admin-Key"
+	TenantHeader   = "X-Tenant-ID"
+)
+
+// Merge strategies accepted by Merge.
+const (
+	ServerWins = "server-wins"
+	ClientWins = "client-wins"
+	NewestWins = "newest-wins"
+)
+
+// Error is returned when the service responds with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("user-preferences returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to a user-preferences service.
+type Client struct {
+	// BaseURL is the URL the service's routes are relative to.
+	BaseURL string
+
+	// AdminKey is sent with every request if it's set.
+	AdminKey string
+
+	// Tenant selects the tenant for every request if it's set.
+	Tenant string
+
+	// HTTPClient is used to send requests. http.DefaultClient is used if
+	// it's nil.
+	HTTPClient *http.Client
+}
+
+// New returns a *Client for the service at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// do sends a request with the JSON encoding of body, if it isn't nil, and
+// decodes the JSON response into out, if it isn't nil.
+func (c *Client) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.AdminKey != "" {
+		req.Header.Set(AdminKeyHeader, c.AdminKey)
+	}
+	if c.Tenant != "" {
+		req.Header.Set(TenantHeader, c.Tenant)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// userPath returns the path for the user's preferences plus any suffix.
+func userPath(username, suffix string) string {
+	return "/" + url.PathEscape(username) + suffix
+}
+
+// storedResponse is the body returned by the service after a write.
+type storedResponse struct {
+	Preferences map[string]interface{} `json:"preferences"`
+}
+
+// Get returns the user's preferences. An empty document is returned if the
+// user hasn't stored any.
+func (c *Client) Get(username string) (map[string]interface{}, error) {
+	prefs := make(map[string]interface{})
+	if err := c.do(http.MethodGet, userPath(username, ""), nil, &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// GetTyped returns the user's well-known preferences decoded into the types
+// defined by the model package. The service returns an error if the stored
+// preferences don't match the model.
+func (c *Client) GetTyped(username string) (*model.Preferences, error) {
+	prefs := &model.Preferences{}
+	if err := c.do(http.MethodGet, userPath(username, "/typed"), nil, prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// Put replaces the user's preferences and returns the stored document.
+func (c *Client) Put(username string, prefs map[string]interface{}) (map[string]interface{}, error) {
+	var stored storedResponse
+	if err := c.do(http.MethodPut, userPath(username, ""), prefs, &stored); err != nil {
+		return nil, err
+	}
+	return stored.Preferences, nil
+}
+
+// Update deep-merges the document into the user's stored preferences and
+// returns the stored result. Keys the document doesn't contain are left alone.
+func (c *Client) Update(username string, prefs map[string]interface{}) (map[string]interface{}, error) {
+	var stored storedResponse
+	if err := c.do(http.MethodPost, userPath(username, ""), prefs, &stored); err != nil {
+		return nil, err
+	}
+	return stored.Preferences, nil
+}
+
+// Merge combines the document with the user's stored preferences on the
+// server using the strategy and returns the stored result.
+func (c *Client) Merge(username string, prefs map[string]interface{}, strategy string) (map[string]interface{}, error) {
+	body := map[string]interface{}{
+		"preferences": prefs,
+		"strategy":    strategy,
+	}
+
+	var stored storedResponse
+	if err := c.do(http.MethodPost, userPath(username, "/merge"), body, &stored); err != nil {
+		return nil, err
+	}
+	return stored.Preferences, nil
+}
+
+// Delete removes all of the user's preferences.
+func (c *Client) Delete(username string) error {
+	return c.do(http.MethodDelete, userPath(username, ""), nil, nil)
+}
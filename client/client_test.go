@@ -0,0 +1,75 @@
+package client
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/user-preferences/testutil"
+)
+
+func TestClient(t *testing.T) {
+	server := testutil.NewServer()
+	defer server.Close()
+
+	c := New(server.URL + "/")
+	c.AdminKey = "secret"
+	c.Tenant = "tenant"
+
+	prefs, err := c.Get("test user")
+	if err != nil || len(prefs) != 0 {
+		t.Errorf("Get() returned %#v, %v", prefs, err)
+	}
+
+	prefs, err = c.Put("test user", map[string]interface{}{"theme": "dark"})
+	if err != nil || !reflect.DeepEqual(prefs, map[string]interface{}{"theme": "dark"}) {
+		t.Errorf("Put() returned %#v, %v", prefs, err)
+	}
+
+	prefs, err = c.Update("test user", map[string]interface{}{"columns": 3.0})
+	if err != nil || !reflect.DeepEqual(prefs, map[string]interface{}{"theme": "dark", "columns": 3.0}) {
+		t.Errorf("Update() returned %#v, %v", prefs, err)
+	}
+
+	prefs, err = c.Merge("test user", map[string]interface{}{"tools": true}, ClientWins)
+	if err != nil || !reflect.DeepEqual(prefs, map[string]interface{}{"theme": "dark", "columns": 3.0, "tools": true}) {
+		t.Errorf("Merge() returned %#v, %v", prefs, err)
+	}
+
+	_, err = c.Merge("test user", map[string]interface{}{}, "loudest-wins")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest || e.Message != "Unknown merge strategy: loudest-wins" {
+		t.Errorf("a failed Merge() returned %#v", err)
+	}
+
+	typed, err := c.GetTyped("test user")
+	if err != nil || typed.SaveSession != nil {
+		t.Errorf("GetTyped() returned %#v, %v", typed, err)
+	}
+
+	_, err = c.Update("test user", map[string]interface{}{"saveSession": "yes"})
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("an invalid Update() returned %#v", err)
+	}
+
+	if err = c.Delete("test user"); err != nil {
+		t.Errorf("Delete() returned %v", err)
+	}
+
+	expected := []string{
+		"GET /test%20user secret tenant",
+		"PUT /test%20user secret tenant",
+		"POST /test%20user secret tenant",
+		"POST /test%20user/merge secret tenant",
+		"POST /test%20user/merge secret tenant",
+		"GET /test%20user/typed secret tenant",
+		"POST /test%20user secret tenant",
+		"DELETE /test%20user secret tenant",
+	}
+	var requests []string
+	for _, r := range server.Requests() {
+		requests = append(requests, r.Method+" "+r.Path+" "+r.Header.Get(AdminKeyHeader)+" "+r.Header.Get(TenantHeader))
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("the requests were %#v", requests)
+	}
+}
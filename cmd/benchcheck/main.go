@@ -0,0 +1,199 @@
+// Command benchcheck compares the output of "go test -bench" against a stored
+// baseline and exits with a non-zero status if any benchmark got slower, or
+// allocates more, by more than the thresholds.
+//
+//	benchcheck [-time-threshold 15] [-alloc-threshold 5] baseline.txt current.txt
+//
+// Allocation counts barely vary between runs or machines, so their threshold
+// can be much tighter than the one for time.
+//
+// Benchmarks that were run several times with -count are compared by their
+// median. Benchmarks missing from either file are reported but don't fail the
+// check, so that the storage benchmarks can be left out when there's no
+// database.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// procsSuffix matches the GOMAXPROCS suffix that go test appends to benchmark
+// names.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// result is the measurements of a single run of a benchmark.
+type result struct {
+	nsPerOp     float64
+	allocsPerOp float64
+}
+
+// parse reads benchmark output, returning the runs of each benchmark by name.
+func parse(r io.Reader) (map[string][]result, error) {
+	results := make(map[string][]result)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		var (
+			res result
+			ok  bool
+		)
+		for i := 2; i+1 < len(fields); i++ {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				res.nsPerOp, ok = value, true
+			case "allocs/op":
+				res.allocsPerOp = value
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		results[name] = append(results[name], res)
+	}
+	return results, scanner.Err()
+}
+
+// median returns the median of the measurement selected by value.
+func median(runs []result, value func(result) float64) float64 {
+	values := make([]float64, len(runs))
+	for i, run := range runs {
+		values[i] = value(run)
+	}
+	sort.Float64s(values)
+
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// change returns the percentage change from before to after.
+func change(before, after float64) float64 {
+	if before == 0 {
+		if after == 0 {
+			return 0
+		}
+		return 100
+	}
+	return (after - before) / before * 100
+}
+
+// thresholds are the percentage increases treated as regressions.
+type thresholds struct {
+	time   float64
+	allocs float64
+}
+
+// compare writes a table comparing the current results with the baseline and
+// returns the number of benchmarks that regressed by more than the thresholds.
+func compare(baseline, current map[string][]result, limits thresholds, out io.Writer) int {
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nsPerOp := func(r result) float64 { return r.nsPerOp }
+	allocsPerOp := func(r result) float64 { return r.allocsPerOp }
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "benchmark\tbaseline ns/op\tcurrent ns/op\tdelta\tbaseline allocs\tcurrent allocs\tdelta\t")
+
+	regressions := 0
+	for _, name := range names {
+		before, ok := baseline[name]
+		if !ok {
+			fmt.Fprintf(w, "%s\t-\t%.0f\t(new)\t\t\t\t\n", name, median(current[name], nsPerOp))
+			continue
+		}
+
+		timeBefore, timeAfter := median(before, nsPerOp), median(current[name], nsPerOp)
+		allocsBefore, allocsAfter := median(before, allocsPerOp), median(current[name], allocsPerOp)
+		timeChange, allocsChange := change(timeBefore, timeAfter), change(allocsBefore, allocsAfter)
+
+		status := ""
+		if timeChange > limits.time || allocsChange > limits.allocs {
+			status = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%+.1f%%\t%.0f\t%.0f\t%+.1f%%\t%s\n",
+			name, timeBefore, timeAfter, timeChange, allocsBefore, allocsAfter, allocsChange, status)
+	}
+
+	var missing []string
+	for name := range baseline {
+		if _, ok := current[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Fprintf(w, "%s\t%.0f\t-\t(not run)\t\t\t\t\n", name, median(baseline[name], nsPerOp))
+	}
+
+	w.Flush()
+	return regressions
+}
+
+// parseFile reads the benchmark output in the file.
+func parseFile(path string) (map[string][]result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+func main() {
+	var limits thresholds
+	flag.Float64Var(&limits.time, "time-threshold", 15, "The percentage increase in ns/op treated as a regression")
+	flag.Float64Var(&limits.allocs, "alloc-threshold", 5, "The percentage increase in allocs/op treated as a regression")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: benchcheck [flags] <baseline> <current>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	baseline, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the baseline: %s\n", err)
+		os.Exit(2)
+	}
+	current, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the current results: %s\n", err)
+		os.Exit(2)
+	}
+
+	if regressions := compare(baseline, current, limits, os.Stdout); regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d benchmarks regressed by more than the thresholds\n", regressions)
+		os.Exit(1)
+	}
+}
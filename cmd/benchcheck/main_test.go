@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const baselineOutput = `goos: linux
+goarch: amd64
+pkg: github.com/cyverse-de/user-preferences
+BenchmarkConvert/10-8     	   20000	     50000 ns/op	   23033 B/op	     428 allocs/op
+BenchmarkConvert/10-8     	   20000	     52000 ns/op	   23033 B/op	     428 allocs/op
+BenchmarkConvert/10-8     	   20000	     90000 ns/op	   23033 B/op	     428 allocs/op
+BenchmarkPutRequest/10-8  	    2000	    130000 ns/op	  9.31 MB/s	   37972 B/op	     499 allocs/op
+BenchmarkStorageGetPreferences/10-8	1000	400000 ns/op	1000 B/op	20 allocs/op
+PASS
+`
+
+func TestParse(t *testing.T) {
+	results, err := parse(strings.NewReader(baselineOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("parsed %d benchmarks: %v", len(results), results)
+	}
+	if runs := results["BenchmarkConvert/10"]; len(runs) != 3 || runs[0].nsPerOp != 50000 || runs[0].allocsPerOp != 428 {
+		t.Errorf("parsed the convert runs as %v", runs)
+	}
+	if runs := results["BenchmarkPutRequest/10"]; len(runs) != 1 || runs[0].nsPerOp != 130000 || runs[0].allocsPerOp != 499 {
+		t.Errorf("parsed the put runs as %v", runs)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline, err := parse(strings.NewReader(baselineOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := parse(strings.NewReader(`
+BenchmarkConvert/10-4     	   20000	     53000 ns/op	   23033 B/op	     428 allocs/op
+BenchmarkPutRequest/10-4  	    2000	    130000 ns/op	   37972 B/op	     600 allocs/op
+BenchmarkGetRequest/10-4  	    2000	     60000 ns/op	   21664 B/op	     263 allocs/op
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if regressions := compare(baseline, current, thresholds{time: 10, allocs: 5}, &out); regressions != 1 {
+		t.Errorf("found %d regressions:\n%s", regressions, out.String())
+	}
+
+	report := out.String()
+	for _, expected := range []string{"(new)", "(not run)", "REGRESSION"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("the report doesn't mention %s:\n%s", expected, report)
+		}
+	}
+	for _, line := range strings.Split(report, "\n") {
+		if strings.HasPrefix(line, "BenchmarkConvert/10") && strings.Contains(line, "REGRESSION") {
+			t.Errorf("a change within the threshold of the median was reported: %s", line)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	nsPerOp := func(r result) float64 { return r.nsPerOp }
+	if m := median([]result{{nsPerOp: 3}, {nsPerOp: 1}, {nsPerOp: 2}}, nsPerOp); m != 2 {
+		t.Errorf("the median of an odd number of runs was %g", m)
+	}
+	if m := median([]result{{nsPerOp: 4}, {nsPerOp: 1}, {nsPerOp: 2}, {nsPerOp: 3}}, nsPerOp); m != 2.5 {
+		t.Errorf("the median of an even number of runs was %g", m)
+	}
+}
@@ -0,0 +1,293 @@
+// Command prefs reads and modifies preferences stored in the user-preferences
+// service. Run it without arguments for usage information.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cyverse-de/user-preferences/client"
+	"github.com/cyverse-de/user-preferences/diff"
+)
+
+const usage = `Usage: prefs [flags] <command> <username> [arguments]
+
+Commands:
+  get <username> [path]           Print the preferences, or the value at the path.
+  set <username> <path> <json>    Set the value at the path.
+  patch <username> <json>         Merge the JSON document into the preferences.
+  delete <username> [path]        Delete the value at the path, or all preferences.
+  export <username> [file]        Write the preferences to the file, or stdout.
+  import <username> [file]        Replace the preferences with the file, or stdin.
+  diff <username> [file]          Compare the stored preferences with the file, or stdin.
+
+Paths are jq-like expressions such as .tools.favorites[0] or .["key with spaces"].
+
+Flags:
+`
+
+// command runs a subcommand against the client, writing its output to out.
+type command func(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error
+
+var commands = map[string]command{
+	"get":    getCommand,
+	"set":    setCommand,
+	"patch":  patchCommand,
+	"delete": deleteCommand,
+	"export": exportCommand,
+	"import": importCommand,
+	"diff":   diffCommand,
+}
+
+func main() {
+	var (
+		serviceURL = flag.String("url", envDefault("USER_PREFERENCES_URL", "http://localhost:60000"), "The base URL of the user-preferences service")
+		adminKey   = flag.String("admin-key", os.Getenv("USER_PREFERENCES_ADMIN_KEY"), "The admin key to send with requests")
+		tenant     = flag.String("tenant", os.Getenv("USER_PREFERENCES_TENANT"), "The tenant to send requests for")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*serviceURL)
+	c.AdminKey = *adminKey
+	c.Tenant = *tenant
+
+	if err := run(c, args[1], args[2:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// envDefault returns the value of the environment variable, or def if it's
+// not set.
+func envDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// writeJSON writes the value to out as indented JSON.
+func writeJSON(out io.Writer, value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", encoded)
+	return err
+}
+
+// readDocument reads a preferences document from the named file, or from in
+// if the name is empty or "-".
+func readDocument(args []string, in io.Reader) (map[string]interface{}, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if len(args) == 0 || args[0] == "-" {
+		data, err = ioutil.ReadAll(in)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing the preferences: %s", err)
+	}
+	return doc, nil
+}
+
+// document converts the result of setValue or deleteValue back into a
+// preferences document.
+func document(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return make(map[string]interface{}), nil
+	}
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The preferences must be an object, not a %T", value)
+	}
+	return doc, nil
+}
+
+func getCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	prefs, err := c.Get(username)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return writeJSON(out, prefs)
+	}
+
+	steps, err := parsePath(args[0])
+	if err != nil {
+		return err
+	}
+
+	value, ok := getValue(prefs, steps)
+	if !ok {
+		return fmt.Errorf("%s is not set", args[0])
+	}
+	return writeJSON(out, value)
+}
+
+func setCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("set needs a path and a JSON value")
+	}
+
+	steps, err := parsePath(args[0])
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	if err = json.Unmarshal([]byte(args[1]), &value); err != nil {
+		return fmt.Errorf("Error parsing the value: %s", err)
+	}
+
+	prefs, err := c.Get(username)
+	if err != nil {
+		return err
+	}
+
+	updated, err := setValue(prefs, steps, value)
+	if err != nil {
+		return err
+	}
+
+	doc, err := document(updated)
+	if err != nil {
+		return err
+	}
+
+	stored, err := c.Put(username, doc)
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, stored)
+}
+
+func patchCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("patch needs a JSON document")
+	}
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal([]byte(args[0]), &patch); err != nil {
+		return fmt.Errorf("Error parsing the patch: %s", err)
+	}
+
+	stored, err := c.Merge(username, patch, client.ClientWins)
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, stored)
+}
+
+func deleteCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return c.Delete(username)
+	}
+
+	steps, err := parsePath(args[0])
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return c.Delete(username)
+	}
+
+	prefs, err := c.Get(username)
+	if err != nil {
+		return err
+	}
+
+	updated, removed := deleteValue(prefs, steps)
+	if !removed {
+		return fmt.Errorf("%s is not set", args[0])
+	}
+
+	doc, err := document(updated)
+	if err != nil {
+		return err
+	}
+
+	stored, err := c.Put(username, doc)
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, stored)
+}
+
+func exportCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	prefs, err := c.Get(username)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return writeJSON(out, prefs)
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err = writeJSON(f, prefs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	doc, err := readDocument(args, in)
+	if err != nil {
+		return err
+	}
+
+	stored, err := c.Put(username, doc)
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, stored)
+}
+
+func diffCommand(c *client.Client, username string, args []string, in io.Reader, out io.Writer) error {
+	doc, err := readDocument(args, in)
+	if err != nil {
+		return err
+	}
+
+	prefs, err := c.Get(username)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(out, diff.Compute(prefs, doc))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/user-preferences/client"
+	"github.com/cyverse-de/user-preferences/testutil"
+)
+
+// fakeService stores a single user's preferences in a fake service.
+func fakeService(t *testing.T, stored map[string]interface{}) (*client.Client, func() map[string]interface{}) {
+	server := testutil.NewServer(testutil.WithPreferences("user", stored))
+	t.Cleanup(server.Close)
+	return client.New(server.URL), func() map[string]interface{} { return server.Preferences("user") }
+}
+
+func TestCommands(t *testing.T) {
+	c, stored := fakeService(t, map[string]interface{}{
+		"tools": map[string]interface{}{"favorites": []interface{}{"a", "b"}},
+	})
+
+	var out bytes.Buffer
+	if err := getCommand(c, "user", []string{".tools.favorites[1]"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "\"b\"\n" {
+		t.Errorf("get printed %q", out.String())
+	}
+
+	if err := getCommand(c, "user", []string{".missing"}, nil, &out); err == nil {
+		t.Error("get didn't fail for a missing path")
+	}
+
+	if err := setCommand(c, "user", []string{".theme", `"dark"`}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := patchCommand(c, "user", []string{`{"columns":3}`}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteCommand(c, "user", []string{".tools.favorites[0]"}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"tools":   map[string]interface{}{"favorites": []interface{}{"b"}},
+		"theme":   "dark",
+		"columns": 3.0,
+	}
+	if !reflect.DeepEqual(stored(), expected) {
+		t.Errorf("the preferences were %#v instead of %#v", stored(), expected)
+	}
+
+	out.Reset()
+	if err := diffCommand(c, "user", nil, strings.NewReader(`{"theme":"light","columns":3}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	var d map[string]interface{}
+	json.Unmarshal(out.Bytes(), &d)
+	if !reflect.DeepEqual(d["removed"], []interface{}{"tools"}) {
+		t.Errorf("diff printed %s", out.String())
+	}
+
+	if err := importCommand(c, "user", []string{"-"}, strings.NewReader(`{"imported":true}`), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := exportCommand(c, "user", nil, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "{\n  \"imported\": true\n}\n" {
+		t.Errorf("export printed %q", out.String())
+	}
+
+	if err := deleteCommand(c, "user", nil, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored()) != 0 {
+		t.Errorf("the preferences weren't deleted: %#v", stored())
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePath parses a jq-like path expression such as .tools.favorites[0] or
+// .["key with spaces"].value into its steps. Object keys are returned as
+// strings and array indexes as ints. Both "." and "" select the whole
+// document.
+func parsePath(expr string) ([]interface{}, error) {
+	var steps []interface{}
+
+	rest := strings.TrimSpace(expr)
+	if rest == "" || rest == "." {
+		return steps, nil
+	}
+	if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".["):
+			rest = rest[1:]
+
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated [ in path %s", expr)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+
+			if strings.HasPrefix(inner, `"`) {
+				key, err := strconv.Unquote(inner)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid key %s in path %s", inner, expr)
+				}
+				steps = append(steps, key)
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("Invalid index %s in path %s", inner, expr)
+			}
+			steps = append(steps, index)
+
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[]")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("Empty key in path %s", expr)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+
+		default:
+			return nil, fmt.Errorf("Unexpected %q in path %s", rest[:1], expr)
+		}
+	}
+
+	return steps, nil
+}
+
+// getValue returns the value at the path within the document.
+func getValue(doc interface{}, steps []interface{}) (interface{}, bool) {
+	current := doc
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = m[s]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := current.([]interface{})
+			if !ok || s >= len(a) {
+				return nil, false
+			}
+			current = a[s]
+		}
+	}
+	return current, true
+}
+
+// setValue returns the document with the value at the path replaced. Missing
+// objects along the path are created; array indexes must already exist.
+func setValue(doc interface{}, steps []interface{}, value interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		return value, nil
+	}
+
+	switch s := steps[0].(type) {
+	case string:
+		m, ok := doc.(map[string]interface{})
+		if doc == nil {
+			m, ok = make(map[string]interface{}), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("Cannot set key %s on a %T", s, doc)
+		}
+		child, err := setValue(m[s], steps[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		m[s] = child
+		return m, nil
+
+	case int:
+		a, ok := doc.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Cannot set index %d on a %T", s, doc)
+		}
+		if s >= len(a) {
+			return nil, fmt.Errorf("Index %d is out of range", s)
+		}
+		child, err := setValue(a[s], steps[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		a[s] = child
+		return a, nil
+	}
+
+	return nil, fmt.Errorf("Invalid path step %v", steps[0])
+}
+
+// deleteValue removes the value at the path from the document and returns
+// the document and whether anything was removed. Array elements are removed
+// and the elements after them shifted down.
+func deleteValue(doc interface{}, steps []interface{}) (interface{}, bool) {
+	if len(steps) == 0 {
+		return nil, doc != nil
+	}
+
+	switch s := steps[0].(type) {
+	case string:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return doc, false
+		}
+		child, ok := m[s]
+		if !ok {
+			return doc, false
+		}
+		if len(steps) == 1 {
+			delete(m, s)
+			return m, true
+		}
+		child, removed := deleteValue(child, steps[1:])
+		m[s] = child
+		return m, removed
+
+	case int:
+		a, ok := doc.([]interface{})
+		if !ok || s >= len(a) {
+			return doc, false
+		}
+		if len(steps) == 1 {
+			return append(a[:s], a[s+1:]...), true
+		}
+		child, removed := deleteValue(a[s], steps[1:])
+		a[s] = child
+		return a, removed
+	}
+
+	return doc, false
+}
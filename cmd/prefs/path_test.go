@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	cases := map[string][]interface{}{
+		".":                      nil,
+		"":                       nil,
+		".tools":                 {"tools"},
+		"tools.favorites":        {"tools", "favorites"},
+		".tools.favorites[0]":    {"tools", "favorites", 0},
+		`.["key with spaces"].a`: {"key with spaces", "a"},
+		`["a.b"][2][3]`:          {"a.b", 2, 3},
+		`.tools.["quoted"]`:      {"tools", "quoted"},
+	}
+	for expr, expected := range cases {
+		actual, err := parsePath(expr)
+		if err != nil {
+			t.Errorf("error parsing %s: %s", expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s was parsed as %#v instead of %#v", expr, actual, expected)
+		}
+	}
+
+	for _, expr := range []string{".a..b", ".a[", ".a[-1]", ".a[x]", `.["unterminated]`, ".a]"} {
+		if _, err := parsePath(expr); err == nil {
+			t.Errorf("no error was returned for %s", expr)
+		}
+	}
+}
+
+func TestPathValues(t *testing.T) {
+	doc := map[string]interface{}{
+		"tools": map[string]interface{}{"favorites": []interface{}{"a", "b", "c"}},
+	}
+
+	value, ok := getValue(doc, []interface{}{"tools", "favorites", 1})
+	if !ok || value != "b" {
+		t.Errorf("getValue() returned %#v, %t", value, ok)
+	}
+	if _, ok = getValue(doc, []interface{}{"tools", "favorites", 5}); ok {
+		t.Error("getValue() found an index that's out of range")
+	}
+	if _, ok = getValue(doc, []interface{}{"tools", 0}); ok {
+		t.Error("getValue() indexed into an object")
+	}
+
+	updated, err := setValue(doc, []interface{}{"tools", "favorites", 0}, "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = setValue(updated, []interface{}{"new", "nested"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = setValue(updated, []interface{}{"tools", "favorites", 9}, 1); err == nil {
+		t.Error("setValue() set an index that's out of range")
+	}
+
+	updated, removed := deleteValue(updated, []interface{}{"tools", "favorites", 1})
+	if !removed {
+		t.Error("deleteValue() didn't remove the array element")
+	}
+	if _, removed = deleteValue(updated, []interface{}{"missing"}); removed {
+		t.Error("deleteValue() removed a missing key")
+	}
+
+	expected := map[string]interface{}{
+		"tools": map[string]interface{}{"favorites": []interface{}{"z", "c"}},
+		"new":   map[string]interface{}{"nested": true},
+	}
+	if !reflect.DeepEqual(updated, expected) {
+		t.Errorf("the document was %#v instead of %#v", updated, expected)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+)
+
+// cockroachMode is true if the database is CockroachDB rather than Postgres.
+// It's set from the configuration at startup.
+var cockroachMode bool
+
+// onlyPreferences returns the preferences table for the statements that name
+// it with ONLY. CockroachDB doesn't have table inheritance, so it doesn't
+// accept ONLY.
+func (p *PrefsDB) onlyPreferences() string {
+	if p.cockroach {
+		return p.tables.Preferences
+	}
+	return "ONLY " + p.tables.Preferences
+}
+
+// cockroachMigrations replaces the migrations that CockroachDB can't run. An
+// empty replacement skips the migration, although it's still recorded as
+// applied.
+var cockroachMigrations = map[string]string{
+	// Transaction IDs aren't available, so every event gets the same one and
+	// replays go by event ID alone. An event whose transaction commits after
+	// a later event has been replayed can be skipped.
+	"0021_outbox_transactions.sql": `
+ALTER TABLE user_preferences_outbox
+    ADD COLUMN IF NOT EXISTS transaction_id bigint NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS user_preferences_outbox_transaction_index
+    ON user_preferences_outbox (transaction_id, id);
+`,
+}
+
+// cockroachTriggerMigrations are the migrations that create triggers, which
+// CockroachDB only accepts with EXECUTE FUNCTION. Postgres has accepted that
+// since version 11, but the migrations keep EXECUTE PROCEDURE for older
+// versions.
+var cockroachTriggerMigrations = map[string]bool{
+	"0006_modified_at_trigger.sql": true,
+	"0012_history.sql":             true,
+	"0019_checksums.sql":           true,
+	"0020_outbox.sql":              true,
+}
+
+// migrationSQL returns the SQL to apply for the migration.
+func migrationSQL(m migration) string {
+	if !cockroachMode {
+		return m.sql
+	}
+	if replacement, ok := cockroachMigrations[m.name]; ok {
+		return replacement
+	}
+	if cockroachTriggerMigrations[m.name] {
+		return strings.Replace(m.sql, "EXECUTE PROCEDURE", "EXECUTE FUNCTION", -1)
+	}
+	return m.sql
+}
+
+// isSerializationFailure returns true if err is a transaction that has to be
+// retried because it conflicted with another one. CockroachDB returns these
+// whenever transactions contend, rather than only under heavy load.
+func isSerializationFailure(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
+
+// cockroachConfig sets cockroachMode from the configuration.
+func cockroachConfig(cfg *viper.Viper) {
+	cockroachMode = cfg.GetBool("user-preferences.database.cockroach")
+}
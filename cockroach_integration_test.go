@@ -0,0 +1,119 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cockroachDBEnv names the environment variable containing the URI of the
+// CockroachDB database used by the CockroachDB integration tests, such as
+// postgresql://root@localhost:26257/defaultdb?sslmode=disable for a single
+// node started with cockroach start-single-node --insecure.
+const cockroachDBEnv = "USER_PREFERENCES_TEST_COCKROACH"
+
+// newCockroachCluster is newIntegrationCluster for CockroachDB. The instances
+// retry serialization failures the way the service does when it's configured
+// for CockroachDB.
+func newCockroachCluster(t testing.TB, size int) *integrationCluster {
+	dburi := os.Getenv(cockroachDBEnv)
+	if dburi == "" {
+		t.Skipf("%s is not set", cockroachDBEnv)
+	}
+
+	saved := cockroachMode
+	cockroachMode = true
+	t.Cleanup(func() { cockroachMode = saved })
+
+	return startIntegrationCluster(t, dburi, size, func(db DB) DB {
+		return NewResilientDB(db, NewCircuitBreaker("cockroach", 5, time.Second), 10, 10*time.Millisecond)
+	})
+}
+
+func TestCockroachRoundTrip(t *testing.T) {
+	c := newCockroachCluster(t, 1)
+	defer c.Close()
+
+	username := "cockroach-user"
+	c.addUser(t, username)
+
+	if status, body := doRequest(t, http.MethodPut, c.url(0, "/"+username), []byte(`{"theme":"dark"}`), nil); status != http.StatusCreated {
+		t.Fatalf("creating the preferences returned %d: %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodPut, c.url(0, "/"+username), []byte(`{"theme":"light"}`), nil); status != http.StatusOK {
+		t.Fatalf("replacing the preferences returned %d: %s", status, body)
+	}
+	if values := getIntegrationPreferences(t, c.url(0, "/"+username)); values["theme"] != "light" {
+		t.Errorf("the preferences were read back as %v", values)
+	}
+
+	status, body := doRequest(t, http.MethodGet, c.url(0, "/"+username+"/history"), nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("the history returned %d: %s", status, body)
+	}
+	var history struct {
+		History []historyEntry `json:"history"`
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.History) != 1 || history.History[0].Preferences["theme"] != "dark" {
+		t.Errorf("the history trigger recorded %+v", history.History)
+	}
+
+	if status, body = doRequest(t, http.MethodDelete, c.url(0, "/"+username), nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Errorf("deleting the preferences returned %d: %s", status, body)
+	}
+
+	events, err := NewPrefsDB(c.dbs[0]).replayEvents(EventFilter{User: username, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := make([]string, len(events))
+	for i, event := range events {
+		operations[i] = event.Operation
+	}
+	if fmt.Sprint(operations) != "[insert update delete]" {
+		t.Errorf("the change events were %v", operations)
+	}
+}
+
+// TestCockroachContention toggles a different flag from each writer, so that
+// the writes' transactions conflict, and checks that the serialization
+// failures and version conflicts were retried without losing any of them.
+func TestCockroachContention(t *testing.T) {
+	c := newCockroachCluster(t, 2)
+	defer c.Close()
+
+	username := "cockroach-contention"
+	c.addUser(t, username)
+
+	if status, _ := doRequest(t, http.MethodPut, c.url(0, "/"+username), []byte(`{}`), nil); status != http.StatusCreated {
+		t.Fatalf("creating the preferences returned %d", status)
+	}
+
+	writers := 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			toggleIntegrationFlag(t, c.url(i, fmt.Sprintf("/%s/flags/flag-%d/toggle", username, i)))
+		}(i)
+	}
+	wg.Wait()
+
+	values := getIntegrationPreferences(t, c.url(0, "/"+username))
+	for i := 0; i < writers; i++ {
+		if values[fmt.Sprintf("flag-%d", i)] != true {
+			t.Errorf("the update to flag-%d was lost", i)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestCockroachStatements(t *testing.T) {
+	userID := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	}
+	failed := errors.New("stop here")
+	_, _, compressed, _ := (&PrefsDB{compressAbove: 1}).encodePreferences(`{"theme":"` + strings.Repeat("dark", 100) + `"}`)
+
+	// Each statement that names the preferences table with ONLY is expected
+	// without it. Statements in transactions fail once they've been checked,
+	// so the rest of the transaction doesn't need to be mocked.
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		call   func(p *PrefsDB)
+	}{
+		{
+			"updatePreferences",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectExec("^UPDATE user_preferences SET (.+) WHERE user_id = \\$1$").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			func(p *PrefsDB) { p.updatePreferences("alice", "{}") },
+		},
+		{
+			"updatePreferencesIfVersion",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectExec("^UPDATE user_preferences SET (.+) AND version = \\$6$").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			func(p *PrefsDB) { p.updatePreferencesIfVersion("alice", "{}", 2) },
+		},
+		{
+			"deletePreferences",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectExec("^DELETE FROM user_preferences WHERE user_id = \\$1$").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			func(p *PrefsDB) { p.deletePreferences("alice") },
+		},
+		{
+			"upsertPreferences",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("^UPDATE user_preferences SET (.+) WHERE user_id = \\$1$").WillReturnError(failed)
+				mock.ExpectRollback()
+			},
+			func(p *PrefsDB) { p.upsertPreferences(map[string]string{"alice": "{}"}) },
+		},
+		{
+			"replacePreferences",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectExec("^UPDATE user_preferences SET (.+) AND version <= \\$6$").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			func(p *PrefsDB) { p.replacePreferences("alice", "{}", 2) },
+		},
+		{
+			"archivePreferences",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SET LOCAL user_preferences.archiving").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("^WITH stale AS \\( SELECT p.user_id FROM user_preferences p LEFT JOIN (.+) DELETE FROM user_preferences p USING stale").
+					WillReturnError(failed)
+				mock.ExpectRollback()
+			},
+			func(p *PrefsDB) { p.archivePreferences(time.Now(), 10) },
+		},
+		{
+			"rewriteCompressed",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, version, encoding, compressed FROM user_preferences").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "version", "encoding", "compressed"}).
+						AddRow("1", 2, encodingGzip, compressed))
+				mock.ExpectExec("^UPDATE user_preferences SET (.+) WHERE id = \\$1 AND version = \\$2$").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			func(p *PrefsDB) {
+				p.rewriteCompressed(10, func(values map[string]interface{}) bool {
+					delete(values, "theme")
+					return true
+				})
+			},
+		},
+		{
+			"eraseUser",
+			func(mock sqlmock.Sqlmock) {
+				userID(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("^DELETE FROM user_preferences WHERE user_id = \\$1$").WillReturnError(failed)
+				mock.ExpectRollback()
+			},
+			func(p *PrefsDB) { p.eraseUser("alice") },
+		},
+	}
+
+	saved := cockroachMode
+	defer func() { cockroachMode = saved }()
+	cockroachMode = true
+
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("error creating the mock db: %s", err)
+		}
+
+		test.expect(mock)
+		test.call(NewPrefsDB(db))
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		db.Close()
+	}
+}
+
+func TestMigrationSQL(t *testing.T) {
+	saved := cockroachMode
+	defer func() { cockroachMode = saved }()
+
+	transactions := migration{version: 21, name: "0021_outbox_transactions.sql", sql: "SELECT txid_current()"}
+	presets := migration{version: 1, name: "0001_presets.sql", sql: "CREATE TABLE presets ()"}
+
+	cockroachMode = false
+	if statements := migrationSQL(transactions); statements != transactions.sql {
+		t.Errorf("the Postgres migration was replaced with %q", statements)
+	}
+
+	cockroachMode = true
+	if statements := migrationSQL(transactions); statements != cockroachMigrations[transactions.name] {
+		t.Errorf("the outbox transactions migration wasn't replaced: %q", statements)
+	}
+	if statements := migrationSQL(presets); statements != presets.sql {
+		t.Errorf("a compatible migration was replaced with %q", statements)
+	}
+
+	embedded, err := loadMigrations(migrationsFS(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range embedded {
+		statements := migrationSQL(m)
+		if strings.Contains(statements, "EXECUTE PROCEDURE") {
+			t.Errorf("%s creates a trigger with EXECUTE PROCEDURE on CockroachDB", m.name)
+		}
+		if cockroachTriggerMigrations[m.name] && !strings.Contains(statements, "EXECUTE FUNCTION") {
+			t.Errorf("%s doesn't create a trigger", m.name)
+		}
+	}
+}
+
+func TestCockroachSerializationFailures(t *testing.T) {
+	saved := cockroachMode
+	defer func() { cockroachMode = saved }()
+
+	conflict := &pq.Error{Code: "40001", Message: "restart transaction"}
+	if !isSerializationFailure(conflict) || isSerializationFailure(errors.New("40001")) {
+		t.Error("serialization failures weren't recognized")
+	}
+
+	cockroachMode = false
+	if !isTransient(conflict) || !isDatabaseFailure(conflict) {
+		t.Error("a serialization failure on Postgres wasn't a retried failure")
+	}
+
+	cockroachMode = true
+	if !isTransient(conflict) {
+		t.Error("a serialization failure on CockroachDB wasn't retried")
+	}
+	if isDatabaseFailure(conflict) {
+		t.Error("a serialization failure on CockroachDB counted against the circuit breaker")
+	}
+}
+
+func TestCockroachConfig(t *testing.T) {
+	saved := cockroachMode
+	defer func() { cockroachMode = saved }()
+
+	if cockroachConfig(testConfig(t, "")); cockroachMode {
+		t.Error("the default configuration enabled CockroachDB mode")
+	}
+	if cockroachConfig(testConfig(t, "user-preferences:\n  database:\n    cockroach: true\n")); !cockroachMode {
+		t.Error("CockroachDB mode wasn't enabled")
+	}
+}
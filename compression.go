@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Encodings for stored preferences documents. Identity documents are stored as
+// text in the preferences column; compressed documents are stored in the
+// compressed column and leave the preferences column NULL. Documents in object
+// storage use encodingObject.
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+)
+
+// encodePreferences returns the values to store in the preferences, encoding,
+// and compressed columns for the document. Documents larger than the object
+// storage threshold are offloaded to object storage, and documents larger than
+// the compression threshold are gzipped, as long as that makes them smaller.
+func (p *PrefsDB) encodePreferences(prefs string) (sql.NullString, string, []byte, error) {
+	if p.objects != nil && len(prefs) > p.objects.threshold {
+		key, err := p.objects.put([]byte(prefs))
+		if err != nil {
+			return sql.NullString{}, "", nil, err
+		}
+		return sql.NullString{}, encodingObject, []byte(key), nil
+	}
+
+	if p.compressAbove <= 0 || len(prefs) <= p.compressAbove {
+		return sql.NullString{String: prefs, Valid: true}, encodingIdentity, nil, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(prefs)); err != nil {
+		return sql.NullString{}, "", nil, err
+	}
+	if err := w.Close(); err != nil {
+		return sql.NullString{}, "", nil, err
+	}
+
+	if buf.Len() >= len(prefs) {
+		return sql.NullString{String: prefs, Valid: true}, encodingIdentity, nil, nil
+	}
+
+	return sql.NullString{}, encodingGzip, buf.Bytes(), nil
+}
+
+// decodePreferences returns the document stored in the preferences, encoding,
+// and compressed columns.
+func decodePreferences(prefs sql.NullString, encoding string, compressed []byte) (string, error) {
+	switch encoding {
+	case encodingIdentity, "":
+		return prefs.String, nil
+	case encodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		return string(decompressed), nil
+	default:
+		return "", fmt.Errorf("Unknown preferences encoding %s", encoding)
+	}
+}
+
+// countCompressed returns the number of compressed documents that match. The
+// documents can't be searched by the database, so each one is decompressed.
+func (p *PrefsDB) countCompressed(match func(values map[string]interface{}) bool) (int64, error) {
+	var count int64
+	err := p.eachCompressed(func(id string, version int64, doc map[string]interface{}) error {
+		if match(unwrappedDocument(doc)) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// rewriteCompressed applies the rewrite to up to limit compressed documents
+// and returns the number of documents that were changed. The rewrite returns
+// whether it changed anything. A document that's modified by another request
+// while it's being rewritten is skipped.
+func (p *PrefsDB) rewriteCompressed(limit int64, rewrite func(values map[string]interface{}) bool) (int64, error) {
+	query := `UPDATE ` + p.onlyPreferences() + `
+                 SET preferences = $3,
+                     encoding = $4,
+                     compressed = $5,
+                     checksum = $6,
+                     version = version + 1
+               WHERE id = $1
+                 AND version = $2`
+
+	var updated int64
+	err := p.eachCompressed(func(id string, version int64, doc map[string]interface{}) error {
+		if updated >= limit || !rewrite(unwrappedDocument(doc)) {
+			return nil
+		}
+
+		jsoned, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		prefs, encoding, compressed, err := p.encodePreferences(string(jsoned))
+		if err != nil {
+			return err
+		}
+
+		result, err := p.db.Exec(query, id, version, prefs, encoding, compressed, preferencesChecksum(string(jsoned)))
+		if err != nil {
+			return err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		updated += affected
+		return nil
+	})
+	return updated, err
+}
+
+// eachCompressed calls fn with each compressed document.
+func (p *PrefsDB) eachCompressed(fn func(id string, version int64, doc map[string]interface{}) error) error {
+	query := `SELECT id, version, encoding, compressed
+                FROM ` + p.tables.Preferences + `
+               WHERE encoding <> 'identity'`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id         string
+			version    int64
+			encoding   string
+			compressed []byte
+		)
+		if err = rows.Scan(&id, &version, &encoding, &compressed); err != nil {
+			return err
+		}
+
+		prefs, err := p.decode(sql.NullString{}, encoding, compressed)
+		if err != nil {
+			return fmt.Errorf("Error decoding preferences %s: %s", id, err)
+		}
+
+		var doc map[string]interface{}
+		if err = json.Unmarshal([]byte(prefs), &doc); err != nil {
+			return fmt.Errorf("Error parsing preferences %s: %s", id, err)
+		}
+
+		if err = fn(id, version, doc); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEncodePreferences(t *testing.T) {
+	p := &PrefsDB{}
+	stored, encoding, compressed, err := p.encodePreferences(`{"one":"two"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != encodingIdentity || stored.String != `{"one":"two"}` || compressed != nil {
+		t.Errorf("compression was used while disabled: %#v %s %#v", stored, encoding, compressed)
+	}
+
+	p.compressAbove = 100
+	large := `{"tools":"` + strings.Repeat("abc", 200) + `"}`
+	stored, encoding, compressed, err = p.encodePreferences(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != encodingGzip || stored.Valid || len(compressed) >= len(large) {
+		t.Errorf("the large document wasn't compressed: %#v %s %d", stored, encoding, len(compressed))
+	}
+
+	decoded, err := decodePreferences(stored, encoding, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != large {
+		t.Errorf("the decoded document was %s", decoded)
+	}
+
+	stored, encoding, _, _ = p.encodePreferences(`{"small":true}`)
+	if encoding != encodingIdentity || stored.String != `{"small":true}` {
+		t.Errorf("a document under the threshold was compressed")
+	}
+}
+
+func TestDecodePreferencesUnknownEncoding(t *testing.T) {
+	if _, err := decodePreferences(sql.NullString{}, "brotli", nil); err == nil {
+		t.Error("no error was returned for an unknown encoding")
+	}
+}
+
+func TestDeleteKeyBatchCompressed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	p.compressAbove = 10
+
+	padding := strings.Repeat("abc", 100)
+	_, _, matching, _ := p.encodePreferences(`{"preferences":{"retired":1,"theme":"` + padding + `"}}`)
+	_, _, other, _ := p.encodePreferences(`{"theme":"` + padding + `"}`)
+	_, _, expected, _ := p.encodePreferences(`{"preferences":{"theme":"` + padding + `"}}`)
+
+	mock.ExpectExec("UPDATE user_preferences SET preferences =").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT id, version, encoding, compressed FROM user_preferences WHERE encoding <> 'identity'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "encoding", "compressed"}).
+			AddRow("1", 4, encodingGzip, matching).
+			AddRow("2", 2, encodingGzip, other))
+	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences = (.+) WHERE id = \\$1 AND version = \\$2").
+		WithArgs("1", 4, nil, encodingGzip, expected, preferencesChecksum(`{"preferences":{"theme":"`+padding+`"}}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	updated, err := p.deleteKeyBatch("retired", 10)
+	if err != nil {
+		t.Fatalf("error from deleteKeyBatch(): %s", err)
+	}
+	if updated != 2 {
+		t.Errorf("deleteKeyBatch() returned %d instead of 2", updated)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestGetPreferencesCompressed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	p.compressAbove = 10
+	document := `{"theme":"` + strings.Repeat("abc", 100) + `"}`
+	_, _, compressed, _ := p.encodePreferences(document)
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT p.id AS id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences", "encoding", "compressed", "checksum", "created_at", "modified_at", "version"}).
+			AddRow("1", "2", nil, encodingGzip, compressed, nil, now, now, 1))
+
+	records, err := p.getPreferences("test-user")
+	if err != nil {
+		t.Fatalf("error from getPreferences(): %s", err)
+	}
+	if len(records) != 1 || records[0].Preferences != document {
+		t.Errorf("the records were %#v", records)
+	}
+}
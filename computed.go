@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// ComputeFunc returns the value of a computed preference for the user, given
+// the user's stored preferences. Returning a nil value leaves the key out of
+// the response.
+type ComputeFunc func(username string, values map[string]interface{}) (interface{}, error)
+
+// ComputedKey is a virtual preference. Its value is computed whenever the
+// user's preferences are read and is never stored.
+type ComputedKey struct {
+	Path    string
+	Compute ComputeFunc
+}
+
+// computers contains the constructors for the supported kinds of computed
+// preferences, keyed by the type used in the configuration.
+var computers = map[string]func(settings map[string]interface{}) (ComputeFunc, error){
+	"cohort":   newCohortComputer,
+	"constant": newConstantComputer,
+	"copy":     newCopyComputer,
+}
+
+// newConstantComputer returns a ComputeFunc that always returns the value
+// setting.
+func newConstantComputer(settings map[string]interface{}) (ComputeFunc, error) {
+	value, ok := settings["value"]
+	if !ok {
+		return nil, fmt.Errorf("A constant computed preference needs a value")
+	}
+	return func(string, map[string]interface{}) (interface{}, error) {
+		return deepCopy(value), nil
+	}, nil
+}
+
+// newCopyComputer returns a ComputeFunc that returns the value stored at the
+// from key path, falling back to the default setting when it isn't stored.
+func newCopyComputer(settings map[string]interface{}) (ComputeFunc, error) {
+	from, _ := settings["from"].(string)
+	if from == "" {
+		return nil, fmt.Errorf("A copy computed preference needs a from key")
+	}
+	def := settings["default"]
+	return func(_ string, values map[string]interface{}) (interface{}, error) {
+		if value, ok := getPath(values, from); ok {
+			return deepCopy(value), nil
+		}
+		return deepCopy(def), nil
+	}, nil
+}
+
+// newCohortComputer returns a ComputeFunc that assigns each user to one of the
+// buckets setting. The assignment is a hash of the salt setting and the
+// username, so it's stable across requests and instances.
+func newCohortComputer(settings map[string]interface{}) (ComputeFunc, error) {
+	buckets, _ := settings["buckets"].([]interface{})
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("A cohort computed preference needs at least one bucket")
+	}
+	salt := fmt.Sprintf("%v", settings["salt"])
+	return func(username string, _ map[string]interface{}) (interface{}, error) {
+		h := fnv.New32a()
+		h.Write([]byte(salt + ":" + username))
+		return buckets[h.Sum32()%uint32(len(buckets))], nil
+	}, nil
+}
+
+// NewComputedKeys returns the computed preferences described by the config
+// document, which maps key paths to settings. Each settings map needs a type
+// naming one of the computers, along with that computer's settings.
+func NewComputedKeys(config map[string]interface{}) ([]ComputedKey, error) {
+	var paths []string
+	for path := range config {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var keys []ComputedKey
+	for _, path := range paths {
+		settings, ok := config[path].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The settings for computed preference %s must be a map", path)
+		}
+
+		kind, _ := settings["type"].(string)
+		constructor, ok := computers[kind]
+		if !ok {
+			return nil, fmt.Errorf("Unknown type %q for computed preference %s", kind, path)
+		}
+
+		compute, err := constructor(settings)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring computed preference %s: %s", path, err)
+		}
+
+		keys = append(keys, ComputedKey{Path: path, Compute: compute})
+	}
+
+	return keys, nil
+}
+
+// applyComputed adds the computed preferences to the response for the user,
+// overriding any stored values at the same paths. The response is returned,
+// since a new one is created if it's nil.
+func (u *UserPreferencesApp) applyComputed(username string, response map[string]interface{}, wrap bool) (map[string]interface{}, error) {
+	if len(u.computed) == 0 {
+		return response, nil
+	}
+
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+
+	values := response
+	if wrap {
+		var ok bool
+		if values, ok = response["preferences"].(map[string]interface{}); !ok {
+			values = make(map[string]interface{})
+			response["preferences"] = values
+		}
+	}
+
+	// Every key is computed from the stored values only, so the result doesn't
+	// depend on the order the keys are applied in.
+	stored := deepCopy(values).(map[string]interface{})
+	for _, key := range u.computed {
+		value, err := key.Compute(username, stored)
+		if err != nil {
+			return nil, fmt.Errorf("Error computing preference %s for user %s: %s", key.Path, username, err)
+		}
+		if value != nil {
+			setPath(values, key.Path, value)
+		}
+	}
+
+	return response, nil
+}
+
+// stripComputed removes the computed preferences from a document that's about
+// to be stored, so that values echoed back by clients aren't persisted.
+func (u *UserPreferencesApp) stripComputed(values map[string]interface{}) {
+	for _, key := range u.computed {
+		deletePath(values, key.Path)
+	}
+}
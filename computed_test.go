@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewComputedKeys(t *testing.T) {
+	cfg := testConfig(t, `
+user-preferences:
+  computed:
+    limits.storage:
+      type: copy
+      from: overrides.storage
+      default: 100
+    cohort:
+      type: cohort
+      salt: experiment-1
+      buckets: [control, treatment]
+`)
+
+	config, err := configDocument(cfg, "user-preferences.computed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewComputedKeys(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, key := range keys {
+		paths = append(paths, key.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"cohort", "limits.storage"}) {
+		t.Errorf("the computed paths were %#v", paths)
+	}
+
+	value, err := keys[1].Compute("alice", map[string]interface{}{})
+	if err != nil || value != 100 {
+		t.Errorf("the default storage limit was %#v (%v)", value, err)
+	}
+
+	value, err = keys[1].Compute("alice", map[string]interface{}{"overrides": map[string]interface{}{"storage": 500.0}})
+	if err != nil || value != 500.0 {
+		t.Errorf("the overridden storage limit was %#v (%v)", value, err)
+	}
+}
+
+func TestNewComputedKeysInvalid(t *testing.T) {
+	configs := []map[string]interface{}{
+		{"a": "not a map"},
+		{"a": map[string]interface{}{"type": "unknown"}},
+		{"a": map[string]interface{}{"type": "constant"}},
+		{"a": map[string]interface{}{"type": "copy"}},
+		{"a": map[string]interface{}{"type": "cohort"}},
+	}
+	for _, config := range configs {
+		if _, err := NewComputedKeys(config); err == nil {
+			t.Errorf("no error was returned for %#v", config)
+		}
+	}
+}
+
+func TestCohortComputer(t *testing.T) {
+	compute, err := newCohortComputer(map[string]interface{}{
+		"salt":    "experiment-1",
+		"buckets": []interface{}{"control", "treatment"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[interface{}]bool)
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		first, _ := compute(username, nil)
+		second, _ := compute(username, nil)
+		if first != second {
+			t.Errorf("%s was assigned to %v and then %v", username, first, second)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("the users were assigned to %#v", seen)
+	}
+}
+
+func TestComputedPreferences(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"theme":"dark","tier":"gold"}`)
+
+	n := New(mock)
+	n.computed = []ComputedKey{
+		{Path: "limits.tier", Compute: func(_ string, values map[string]interface{}) (interface{}, error) {
+			return values["tier"], nil
+		}},
+		{Path: "greeting", Compute: func(username string, _ map[string]interface{}) (interface{}, error) {
+			return "hello " + username, nil
+		}},
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting the preferences returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var actual map[string]interface{}
+	if err := json.Unmarshal(body, &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"theme":    "dark",
+		"tier":     "gold",
+		"limits":   map[string]interface{}{"tier": "gold"},
+		"greeting": "hello test-user",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("the preferences were %#v instead of %#v", actual, expected)
+	}
+
+	// Echoing the computed values back doesn't store them.
+	status, _ = doRequest(t, http.MethodPost, server.URL+"/test-user", body, nil)
+	if status != http.StatusOK {
+		t.Fatalf("storing the preferences returned %d instead of %d", status, http.StatusOK)
+	}
+
+	records, _ := mock.getPreferences("test-user")
+	var stored map[string]interface{}
+	json.Unmarshal([]byte(records[0].Preferences), &stored)
+	if !reflect.DeepEqual(stored, map[string]interface{}{"theme": "dark", "tier": "gold", "limits": map[string]interface{}{}}) {
+		t.Errorf("the stored preferences were %#v", stored)
+	}
+}
+
+func TestComputedPreferencesWithoutStoredPreferences(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	n := New(mock)
+	n.computed = []ComputedKey{
+		{Path: "cohort", Compute: func(string, map[string]interface{}) (interface{}, error) {
+			return "control", nil
+		}},
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	_, body := doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if string(body) != `{"cohort":"control"}` {
+		t.Errorf("the preferences were %s", body)
+	}
+}
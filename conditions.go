@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Headers used for conditional writes. GET responses include the hash of the
+// stored document in valueHashHeader and its version in versionHeader, and
+// writes that send either back in valueMatchHeader or ifVersionHeader are only
+// applied if the document hasn't changed since.
+const (
+	valueHashHeader  = "Value-Hash"
+	valueMatchHeader = "If-Value-Matches"
+	versionHeader    = "Preferences-Version"
+	ifVersionHeader  = "If-Version"
+)
+
+// versionKey is the key of a wrapped request body that may contain the
+// version the client read, instead of the If-Version header.
+const versionKey = "version"
+
+// valueHash returns the hex-encoded SHA-256 hash of the document's canonical
+// JSON encoding, which has its keys sorted and no insignificant whitespace.
+// A missing document hashes the same as an empty one.
+func valueHash(doc map[string]interface{}) (string, error) {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	jsoned, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(jsoned)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeCondition is the condition a conditional write places on the stored
+// document: its version, its hash, or the document itself. Every part that's
+// set must match. Version 0 is the version of a user without preferences.
+type writeCondition struct {
+	version   *int64
+	hash      string
+	expect    map[string]interface{}
+	hasExpect bool
+}
+
+// matches returns whether the stored document, which has the version,
+// satisfies the condition.
+func (c *writeCondition) matches(current map[string]interface{}, version int64) (bool, error) {
+	if c.version != nil && *c.version != version {
+		return false, nil
+	}
+	if c.hash != "" {
+		hash, err := valueHash(current)
+		if err != nil {
+			return false, err
+		}
+		if hash != c.hash {
+			return false, nil
+		}
+	}
+	if c.hasExpect && (len(current) != 0 || len(c.expect) != 0) {
+		return reflect.DeepEqual(current, c.expect), nil
+	}
+	return true, nil
+}
+
+// parseVersion parses a version sent by the client.
+func parseVersion(value interface{}) (*int64, error) {
+	var version int64
+	switch v := value.(type) {
+	case string:
+		parsed, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(v), `"`), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version %q", v)
+		}
+		version = parsed
+	case float64:
+		if v != float64(int64(v)) {
+			return nil, fmt.Errorf("Invalid version %v", v)
+		}
+		version = int64(v)
+	default:
+		return nil, fmt.Errorf("The version must be a number")
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("Invalid version %d", version)
+	}
+	return &version, nil
+}
+
+// parseWriteCondition returns the condition placed on a write, if there is
+// one, along with the document to write. The condition is made up of the
+// If-Version header or the version key of a wrapped body, the
+// If-Value-Matches header, and a body of the form {"expect": {...}, "set":
+// {...}}, in which case the document to write is the set document. A body is
+// only treated as an expect/set body if those are its only two keys. The
+// version key is removed from the body so that it doesn't get stored.
+func parseWriteCondition(r *http.Request, body map[string]interface{}) (*writeCondition, map[string]interface{}, error) {
+	var (
+		cond = &writeCondition{}
+		err  error
+	)
+
+	if header := r.Header.Get(ifVersionHeader); header != "" {
+		if cond.version, err = parseVersion(header); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if _, wrapped := body["preferences"]; wrapped {
+		if value, ok := body[versionKey]; ok {
+			delete(body, versionKey)
+			version, err := parseVersion(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cond.version != nil && *cond.version != *version {
+				return nil, nil, fmt.Errorf("The %s header and the %s field don't match", ifVersionHeader, versionKey)
+			}
+			cond.version = version
+		}
+	}
+
+	if hash := strings.TrimSpace(r.Header.Get(valueMatchHeader)); hash != "" {
+		cond.hash = strings.ToLower(strings.Trim(hash, `"`))
+	}
+
+	expect, hasExpect := body["expect"]
+	set, hasSet := body["set"]
+	if len(body) == 2 && hasExpect && hasSet {
+		setDoc, ok := set.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("The set document must be a map")
+		}
+		expectDoc, ok := expect.(map[string]interface{})
+		if expect != nil && !ok {
+			return nil, nil, fmt.Errorf("The expect document must be a map or null")
+		}
+		cond.expect, cond.hasExpect = expectDoc, true
+		body = setDoc
+	}
+
+	if cond.version == nil && cond.hash == "" && !cond.hasExpect {
+		return nil, body, nil
+	}
+	return cond, body, nil
+}
+
+// preconditionRequired writes out a 428 response for a write that needed a
+// condition but didn't have one.
+func preconditionRequired(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusPreconditionRequired)
+	log.Error(msg)
+}
+
+// conflictResponse is the body of a 409 response to a conditional write whose
+// condition wasn't met.
+type conflictResponse struct {
+	Preferences map[string]interface{} `json:"preferences"`
+	Version     int64                  `json:"version"`
+	ValueHash   string                 `json:"value_hash"`
+}
+
+// writeConflict writes a 409 response containing the stored document, its
+// version, and its hash, so that the client can reconcile its changes and try
+// again.
+func writeConflict(writer http.ResponseWriter, r *http.Request, username string, current map[string]interface{}, version int64) {
+	hash, err := valueHash(current)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error hashing preferences for user %s: %s", username, err))
+		return
+	}
+	if current == nil {
+		current = map[string]interface{}{}
+	}
+
+	doc, err := normalizeDocument(conflictResponse{Preferences: current, Version: version, ValueHash: hash})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating conflict response for user %s: %s", username, err))
+		return
+	}
+
+	log.Infof("Rejecting a conditional write for user %s; the preferences have changed", username)
+	writer.Header().Set(valueHashHeader, hash)
+	writer.Header().Set(versionHeader, strconv.FormatInt(version, 10))
+	if err = writeDocument(writer, r, http.StatusConflict, doc.(map[string]interface{})); err != nil {
+		log.Errorf("Error writing conflict response for user %s: %s", username, err)
+	}
+}
+
+// storeIfMatches stores the preferences only if the stored document meets the
+// condition, writing a 409 response and returning false if it doesn't. An
+// existing document is replaced only if its version hasn't changed since it
+// was checked, so a concurrent write can't slip in between the check and the
+// update.
+func (u *UserPreferencesApp) storeIfMatches(writer http.ResponseWriter, r *http.Request, username, prefs string, cond *writeCondition) bool {
+	current, record, err := u.preferencesResponse(username, false)
+	if err != nil {
+		errored(writer, err.Error())
+		return false
+	}
+
+	matched, err := cond.matches(current, record.Version)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
+		return false
+	}
+	if !matched {
+		writeConflict(writer, r, username, current, record.Version)
+		return false
+	}
+
+	if record.ID == "" {
+		if err = u.prefs.insertPreferences(username, prefs); err != nil {
+			errored(writer, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
+			return false
+		}
+		return true
+	}
+
+	updated, err := u.prefs.updatePreferencesIfVersion(username, prefs, record.Version)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+		return false
+	}
+	if !updated {
+		if current, record, err = u.preferencesResponse(username, false); err != nil {
+			errored(writer, err.Error())
+			return false
+		}
+		writeConflict(writer, r, username, current, record.Version)
+		return false
+	}
+	return true
+}
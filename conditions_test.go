@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValueHash(t *testing.T) {
+	empty, err := valueHash(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty != "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a" {
+		t.Errorf("the hash of a missing document was %s", empty)
+	}
+	if hash, _ := valueHash(map[string]interface{}{}); hash != empty {
+		t.Errorf("the hash of an empty document was %s", hash)
+	}
+
+	a, _ := valueHash(map[string]interface{}{"b": 1.0, "a": map[string]interface{}{"d": true, "c": "x"}})
+	b, _ := valueHash(map[string]interface{}{"a": map[string]interface{}{"c": "x", "d": true}, "b": 1.0})
+	if a != b {
+		t.Error("the hash depends on the order of the keys")
+	}
+}
+
+func TestParseWriteCondition(t *testing.T) {
+	body := map[string]interface{}{"theme": "dark"}
+
+	r := httptest.NewRequest(http.MethodPut, "/alice", nil)
+	cond, doc, err := parseWriteCondition(r, body)
+	if err != nil || cond != nil || !reflect.DeepEqual(doc, body) {
+		t.Errorf("a plain write returned %#v, %#v, %v", cond, doc, err)
+	}
+
+	r.Header.Set(valueMatchHeader, `"ABC123"`)
+	cond, doc, err = parseWriteCondition(r, body)
+	if err != nil || cond == nil || cond.hash != "abc123" || !reflect.DeepEqual(doc, body) {
+		t.Errorf("a write with %s returned %#v, %#v, %v", valueMatchHeader, cond, doc, err)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/alice", nil)
+	cond, doc, err = parseWriteCondition(r, map[string]interface{}{"expect": nil, "set": body})
+	if err != nil || cond == nil || cond.expect != nil || !reflect.DeepEqual(doc, body) {
+		t.Errorf("an expect/set body returned %#v, %#v, %v", cond, doc, err)
+	}
+
+	doc = map[string]interface{}{"expect": "x", "set": body, "other": 1.0}
+	if cond, _, err = parseWriteCondition(r, doc); err != nil || cond != nil {
+		t.Errorf("a document with other keys returned %#v, %v", cond, err)
+	}
+
+	if _, _, err = parseWriteCondition(r, map[string]interface{}{"expect": "x", "set": body}); err == nil {
+		t.Error("an expect document that isn't a map was accepted")
+	}
+	if _, _, err = parseWriteCondition(r, map[string]interface{}{"expect": body, "set": 1.0}); err == nil {
+		t.Error("a set document that isn't a map was accepted")
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	hash := res.Header.Get(valueHashHeader)
+	if expected, _ := valueHash(map[string]interface{}{"theme": "dark"}); hash != expected {
+		t.Fatalf("GET returned a %s of %s instead of %s", valueHashHeader, hash, expected)
+	}
+
+	body := []byte(`{"theme":"light"}`)
+	status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", body, map[string]string{valueMatchHeader: hash})
+	if status != http.StatusOK {
+		t.Errorf("a write with the current hash returned %d", status)
+	}
+
+	status, resBody := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"blue"}`), map[string]string{valueMatchHeader: hash})
+	var conflict conflictResponse
+	if err = json.Unmarshal(resBody, &conflict); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusConflict || !reflect.DeepEqual(conflict.Preferences, map[string]interface{}{"theme": "light"}) {
+		t.Errorf("a write with a stale hash returned %d: %s", status, resBody)
+	}
+	if expected, _ := valueHash(conflict.Preferences); conflict.ValueHash != expected {
+		t.Errorf("the conflict response had a hash of %s instead of %s", conflict.ValueHash, expected)
+	}
+
+	body = []byte(`{"expect":{"theme":"light"},"set":{"theme":"green"}}`)
+	if status, resBody = doRequest(t, http.MethodPut, server.URL+"/alice", body, nil); status != http.StatusOK {
+		t.Errorf("a write expecting the current document returned %d: %s", status, resBody)
+	}
+
+	body = []byte(`{"expect":{"theme":"light"},"set":{"theme":"red"}}`)
+	if status, _ = doRequest(t, http.MethodPut, server.URL+"/alice", body, nil); status != http.StatusConflict {
+		t.Errorf("a write expecting an old document returned %d", status)
+	}
+
+	prefs, _ := mock.getPreferences("alice")
+	if prefs[0].Preferences != `{"theme":"green"}` {
+		t.Errorf("the stored preferences were %s", prefs[0].Preferences)
+	}
+}
+
+// racingDB simulates another request updating the preferences between a
+// conditional write's check and its update.
+type racingDB struct {
+	*MockDB
+}
+
+func (r *racingDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	r.MockDB.insertPreferences(username, `{"theme":"sneaky"}`)
+	return r.MockDB.updatePreferencesIfVersion(username, prefs, version)
+}
+
+func TestConditionalWriteRace(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+
+	n := New(&racingDB{mock})
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"expect":{"theme":"dark"},"set":{"theme":"light"}}`)
+	status, resBody := doRequest(t, http.MethodPut, server.URL+"/alice", body, nil)
+	if status != http.StatusConflict {
+		t.Errorf("a write that lost a race returned %d: %s", status, resBody)
+	}
+
+	prefs, _ := mock.getPreferences("alice")
+	if prefs[0].Preferences != `{"theme":"sneaky"}` {
+		t.Errorf("the stored preferences were %s", prefs[0].Preferences)
+	}
+}
+
+func TestUpdatePreferencesIfVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	for _, affected := range []int64{1, 0} {
+		mock.ExpectQuery("SELECT id FROM users WHERE username =").
+			WithArgs("test-user").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+		mock.ExpectExec("UPDATE ONLY user_preferences SET (.+) WHERE user_id = \\$1 AND version = \\$6").
+			WithArgs("1", "{}", "identity", []byte(nil), preferencesChecksum("{}"), 3).
+			WillReturnResult(sqlmock.NewResult(0, affected))
+
+		updated, err := p.updatePreferencesIfVersion("test-user", "{}", 3)
+		if err != nil {
+			t.Errorf("error updating preferences: %s", err)
+		}
+		if updated != (affected == 1) {
+			t.Errorf("updatePreferencesIfVersion returned %t when %d rows were affected", updated, affected)
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestParseWriteConditionVersion(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/alice", nil)
+	r.Header.Set(ifVersionHeader, "3")
+	cond, _, err := parseWriteCondition(r, map[string]interface{}{"theme": "dark"})
+	if err != nil || cond == nil || cond.version == nil || *cond.version != 3 {
+		t.Errorf("a write with %s returned %#v, %v", ifVersionHeader, cond, err)
+	}
+
+	body := map[string]interface{}{"preferences": map[string]interface{}{}, "version": 3.0}
+	cond, doc, err := parseWriteCondition(r, body)
+	if err != nil || cond == nil || *cond.version != 3 {
+		t.Errorf("a write with a matching header and field returned %#v, %v", cond, err)
+	}
+	if _, ok := doc[versionKey]; ok {
+		t.Error("the version field wasn't removed from the body")
+	}
+
+	body = map[string]interface{}{"preferences": map[string]interface{}{}, "version": 4.0}
+	if _, _, err = parseWriteCondition(r, body); err == nil {
+		t.Error("a header and field that don't match were accepted")
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/alice", nil)
+	cond, doc, err = parseWriteCondition(r, map[string]interface{}{"version": 4.0})
+	if err != nil || cond != nil || doc[versionKey] != 4.0 {
+		t.Errorf("an unwrapped body with a version key returned %#v, %#v, %v", cond, doc, err)
+	}
+
+	for _, invalid := range []interface{}{"x", -1.0, 1.5, true} {
+		body = map[string]interface{}{"preferences": map[string]interface{}{}, "version": invalid}
+		if _, _, err = parseWriteCondition(r, body); err == nil {
+			t.Errorf("the version %#v was accepted", invalid)
+		}
+	}
+}
+
+func TestVersionedWrites(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.requireVersion = true
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"dark"}`), nil); status != http.StatusPreconditionRequired {
+		t.Errorf("a write without a version returned %d", status)
+	}
+
+	res, err := http.Get(server.URL + "/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if version := res.Header.Get(versionHeader); version != "0" {
+		t.Fatalf("GET for a user without preferences returned version %s", version)
+	}
+
+	status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"dark"}`), map[string]string{ifVersionHeader: "0"})
+	if status != http.StatusCreated {
+		t.Errorf("creating the preferences returned %d", status)
+	}
+
+	body := []byte(`{"preferences":{"theme":"light"},"version":1}`)
+	if status, _ = doRequest(t, http.MethodPost, server.URL+"/alice", body, nil); status != http.StatusOK {
+		t.Errorf("a write with the current version returned %d", status)
+	}
+
+	status, resBody := doRequest(t, http.MethodPut, server.URL+"/alice", body, nil)
+	var conflict conflictResponse
+	if err = json.Unmarshal(resBody, &conflict); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusConflict || conflict.Version != 2 || conflict.Preferences["theme"] != "light" {
+		t.Errorf("a write with a stale version returned %d: %s", status, resBody)
+	}
+
+	prefs, _ := mock.getPreferences("alice")
+	if prefs[0].Preferences != `{"preferences":{"theme":"light"}}` {
+		t.Errorf("the stored preferences were %s", prefs[0].Preferences)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// defaultConfig contains the default values for the settings specific to this
+// service. It's appended to the shared job services defaults.
+const defaultConfig = `
+user-preferences:
+  admin:
+    batch-size: 500
+  anonymize:
+    key: ""
+    strip-keys: []
+  archive:
+    enabled: false
+    after: 4380h
+    batch-size: 1000
+  auth:
+    provider: none
+    timeout: 10s
+    cas:
+      base-url: ""
+      service: ""
+    oidc:
+      userinfo-url: ""
+      username-claim: preferred_username
+      cache-ttl: 1m
+  caching:
+    routes: {}
+  chaos:
+    enabled: false
+  compression:
+    threshold: 0
+  content-metrics:
+    keys: []
+  database:
+    retries: 3
+    backoff: 100ms
+    breaker:
+      failures: 5
+      cooldown: 30s
+    slow-query: 500ms
+    create-indexes: false
+    cockroach: false
+    schema: ""
+    tables:
+      preferences: user_preferences
+      users: users
+      users-id: id
+      users-username: username
+    users-schema: ""
+  debug:
+    addr: ""
+    pprof: false
+  dual-write:
+    uri: ""
+  empty:
+    not-found: false
+  history:
+    retention: 2160h
+  http-client:
+    ca-file: ""
+    dial-timeout: 10s
+    idle-conn-timeout: 90s
+    insecure-skip-verify: false
+    max-idle-conns: 100
+    max-idle-conns-per-host: 10
+    proxy: ""
+    retries: 2
+    retry-backoff: 200ms
+    tls-handshake-timeout: 10s
+  idempotency:
+    window: 24h
+  immutable:
+    keys: []
+  impersonation:
+    enabled: true
+  json:
+    engine: std
+    strict: false
+  jobs:
+    purge-expired-keys:
+      interval: 1h
+    purge-idempotency-keys:
+      interval: 1h
+    purge-expired-sessions:
+      interval: 1h
+    purge-expired-ui-sessions:
+      interval: 1h
+    purge-history:
+      interval: 24h
+    apply-scheduled-changes:
+      interval: 1m
+    archive-stale-preferences:
+      interval: 24h
+    dispatch-outbox:
+      interval: 5s
+    purge-outbox:
+      interval: 1h
+    sample-content-metrics:
+      interval: 1h
+    flush-usage:
+      interval: 1m
+  key-filter:
+    allow: []
+    deny: []
+    policy: reject
+  lambda:
+    conn-max-idle-time: 30s
+    conn-max-lifetime: 5m
+    max-idle-conns: 1
+    max-open-conns: 2
+  locales:
+    defaults: {}
+    fallback: ""
+  log:
+    level: info
+  merge:
+    depth: 0
+    arrays: replace
+    keys: []
+  object-storage:
+    endpoint: ""
+    bucket: ""
+    region: us-east-1
+    access-key: ""
+    secret-key: ""
+    prefix: user-preferences/
+    threshold: 1048576
+    timeout: 30s
+  outbox:
+    targets: []
+    subject: user-preferences.changed
+    timeout: 10s
+    batch-size: 100
+    retention: 168h
+  pagination:
+    max-page-size: 100
+  pii:
+    enabled: false
+    detectors: []
+    policy: reject
+    allow-keys: []
+  quota:
+    bytes: 1048576
+  registry:
+    warn-deprecated: false
+    warn-unregistered: false
+  reserved:
+    prefix: _system
+  response-compression:
+    enabled: false
+    encodings: []
+    min-size: 1024
+  service:
+    name: user-preferences
+    description: ""
+    openapi: ""
+  sessions:
+    ttl: 720h
+  share:
+    secret: ""
+    max-ttl: 24h
+  shutdown:
+    drain-delay: 10s
+    timeout: 30s
+  templates:
+    url: ""
+  terrain:
+    enabled: false
+    prefix: /secured
+  timeouts:
+    read: 30s
+    write: 90s
+    idle: 2m
+    handler: 60s
+    statement: 60s
+  ui-sessions:
+    max-bytes: 262144
+    ttl: 0s
+  undo:
+    depth: 10
+  usage:
+    enabled: false
+  usernames:
+    case-sensitive: true
+    lowercase: false
+    max-length: 0
+    pattern: ""
+    suffix: ""
+    suffix-mode: none
+  validation:
+    mode: enforce
+    quota-warning: 0.9
+  versions:
+    required: false
+  webhooks:
+    allowed-hosts: []
+    allowed-topics: []
+    timeout: 10s
+`
+
+// stringKeyed converts the map[interface{}]interface{} values produced by the
+// YAML parser into map[string]interface{} values, recursively, so that they can
+// be merged with and serialized like preferences documents.
+func stringKeyed(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range v {
+			converted[fmt.Sprintf("%v", key)] = stringKeyed(item)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range v {
+			converted[key] = stringKeyed(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = stringKeyed(item)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// configDocument returns the configuration setting at key as a preferences
+// document. An empty document is returned if the setting is missing, and an
+// error is returned if it isn't a map.
+func configDocument(cfg *viper.Viper, key string) (map[string]interface{}, error) {
+	value := cfg.Get(key)
+	if value == nil {
+		return make(map[string]interface{}), nil
+	}
+
+	doc, ok := stringKeyed(value).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The %s configuration setting must be a map", key)
+	}
+
+	return doc, nil
+}
+
+// configureApp applies the service's configuration settings to the app and
+// registers its background jobs.
+func configureApp(app *UserPreferencesApp, cfg *viper.Viper) error {
+	var err error
+
+	app.flagDefault = cfg.GetBool("user-preferences.flags.default")
+	app.adminKey = cfg.GetString("user-preferences.admin.key")
+	app.operations = NewOperationTracker(cfg.GetInt("user-preferences.admin.batch-size"))
+
+	app.identity.name = cfg.GetString("user-preferences.service.name")
+	if description := cfg.GetString("user-preferences.service.description"); description != "" {
+		app.identity.description = description
+	}
+	if path := cfg.GetString("user-preferences.service.openapi"); path != "" {
+		app.loadOpenAPI(path)
+	}
+
+	app.usernames, err = NewUsernamePolicy(
+		cfg.GetString("user-preferences.usernames.pattern"),
+		cfg.GetInt("user-preferences.usernames.max-length"),
+		cfg.GetBool("user-preferences.usernames.lowercase"),
+		cfg.GetString("user-preferences.usernames.suffix"),
+		cfg.GetString("user-preferences.usernames.suffix-mode"),
+	)
+	if err != nil {
+		return err
+	}
+
+	app.auth, err = newAuthenticator(cfg.GetString("user-preferences.auth.provider"), authSettings{
+		casBase:    cfg.GetString("user-preferences.auth.cas.base-url"),
+		casService: cfg.GetString("user-preferences.auth.cas.service"),
+		userinfo:   cfg.GetString("user-preferences.auth.oidc.userinfo-url"),
+		claim:      cfg.GetString("user-preferences.auth.oidc.username-claim"),
+		cacheTTL:   cfg.GetDuration("user-preferences.auth.oidc.cache-ttl"),
+		timeout:    cfg.GetDuration("user-preferences.auth.timeout"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if app.defaults, err = configDocument(cfg, "user-preferences.defaults"); err != nil {
+		return err
+	}
+
+	localeDefaults, err := configDocument(cfg, "user-preferences.locales.defaults")
+	if err != nil {
+		return err
+	}
+	if app.locales, err = NewLocaleDefaults(localeDefaults, cfg.GetString("user-preferences.locales.fallback")); err != nil {
+		return err
+	}
+
+	computed, err := configDocument(cfg, "user-preferences.computed")
+	if err != nil {
+		return err
+	}
+	if app.computed, err = NewComputedKeys(computed); err != nil {
+		return err
+	}
+
+	experiments, err := configDocument(cfg, "user-preferences.experiments")
+	if err != nil {
+		return err
+	}
+	if app.experiments, err = NewExperiments(experiments); err != nil {
+		return err
+	}
+
+	variables, err := configDocument(cfg, "user-preferences.templates.variables")
+	if err != nil {
+		return err
+	}
+	patterns := make(map[string]string, len(variables))
+	for name, pattern := range variables {
+		str, ok := pattern.(string)
+		if !ok {
+			return fmt.Errorf("The template variable %s must be a string", name)
+		}
+		patterns[name] = str
+	}
+	var source VariableSource
+	if templatesURL := cfg.GetString("user-preferences.templates.url"); templatesURL != "" {
+		source = NewHTTPVariableSource(templatesURL)
+	}
+	app.templates = NewTemplates(patterns, source)
+
+	app.locks, err = NewKeyLocks(
+		cfg.GetStringSlice("user-preferences.locks.keys"),
+		cfg.GetString("user-preferences.locks.policy"),
+	)
+	if err != nil {
+		return err
+	}
+
+	app.immutable = NewImmutableKeys(cfg.GetStringSlice("user-preferences.immutable.keys"))
+	app.reserved = NewReservedKeys(cfg.GetString("user-preferences.reserved.prefix"))
+
+	app.keyFilter, err = NewKeyFilter(
+		cfg.GetStringSlice("user-preferences.key-filter.allow"),
+		cfg.GetStringSlice("user-preferences.key-filter.deny"),
+		cfg.GetString("user-preferences.key-filter.policy"),
+	)
+	if err != nil {
+		return err
+	}
+
+	app.webhooks = NewWebhookPolicy(
+		cfg.GetStringSlice("user-preferences.webhooks.allowed-hosts"),
+		cfg.GetStringSlice("user-preferences.webhooks.allowed-topics"),
+		cfg.GetDuration("user-preferences.webhooks.timeout"),
+	)
+
+	if cfg.GetBool("user-preferences.pii.enabled") {
+		app.pii, err = NewPIIScanner(
+			cfg.GetStringSlice("user-preferences.pii.detectors"),
+			cfg.GetString("user-preferences.pii.policy"),
+			cfg.GetStringSlice("user-preferences.pii.allow-keys"),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if groupsBase := cfg.GetString("iplant_groups.base"); groupsBase != "" {
+		app.groups = NewIplantGroupsClient(groupsBase, cfg.GetString("iplant_groups.user"))
+	}
+
+	app.idempotencyWindow = cfg.GetDuration("user-preferences.idempotency.window")
+	app.sessionTTL = cfg.GetDuration("user-preferences.sessions.ttl")
+	app.uiSessionTTL = cfg.GetDuration("user-preferences.ui-sessions.ttl")
+	app.uiSessionLimit = cfg.GetInt("user-preferences.ui-sessions.max-bytes")
+	app.maxPageSize = cfg.GetInt("user-preferences.pagination.max-page-size")
+	app.quota = cfg.GetInt("user-preferences.quota.bytes")
+	app.historyRetention = cfg.GetDuration("user-preferences.history.retention")
+	app.requireVersion = cfg.GetBool("user-preferences.versions.required")
+	app.impersonation = cfg.GetBool("user-preferences.impersonation.enabled")
+	app.emptyNotFound = cfg.GetBool("user-preferences.empty.not-found")
+	app.undoDepth = cfg.GetInt("user-preferences.undo.depth")
+	app.warnUnregisteredKeys = cfg.GetBool("user-preferences.registry.warn-unregistered")
+	app.warnDeprecatedKeys = cfg.GetBool("user-preferences.registry.warn-deprecated")
+	app.foldUsernames = !cfg.GetBool("user-preferences.usernames.case-sensitive")
+	app.quotaWarningAt = cfg.GetFloat64("user-preferences.validation.quota-warning")
+	if app.warnOnly, err = parseValidationMode(cfg.GetString("user-preferences.validation.mode")); err != nil {
+		return err
+	}
+
+	app.merge, err = newMergeOptions(
+		cfg.GetInt("user-preferences.merge.depth"),
+		cfg.GetString("user-preferences.merge.arrays"),
+		cfg.GetStringSlice("user-preferences.merge.keys"),
+	)
+	if err != nil {
+		return err
+	}
+
+	if secret := cfg.GetString("user-preferences.share.secret"); secret != "" {
+		app.share = NewShareSigner(secret, cfg.GetDuration("user-preferences.share.max-ttl"))
+	}
+
+	if cfg.GetBool("user-preferences.terrain.enabled") {
+		app.enableTerrainRoutes(cfg.GetString("user-preferences.terrain.prefix"))
+	}
+
+	if cfg.GetBool("user-preferences.chaos.enabled") {
+		app.enableChaos()
+	}
+
+	if cfg.GetBool("user-preferences.debug.pprof") {
+		app.enablePprof()
+	}
+
+	if cfg.GetBool("user-preferences.response-compression.enabled") {
+		app.compression, err = NewResponseCompression(
+			cfg.GetStringSlice("user-preferences.response-compression.encodings"),
+			cfg.GetInt("user-preferences.response-compression.min-size"),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	caching, err := configDocument(cfg, "user-preferences.caching.routes")
+	if err != nil {
+		return err
+	}
+	if app.caching, err = NewCachePolicy(caching, app.router); err != nil {
+		return err
+	}
+
+	app.jobs.Add("purge-expired-keys", cfg.GetDuration("user-preferences.jobs.purge-expired-keys.interval"), app.purgeExpired)
+	app.jobs.Add("purge-idempotency-keys", cfg.GetDuration("user-preferences.jobs.purge-idempotency-keys.interval"), app.purgeIdempotentResponses)
+	app.jobs.Add("purge-expired-sessions", cfg.GetDuration("user-preferences.jobs.purge-expired-sessions.interval"), app.purgeSessions)
+	app.jobs.Add("purge-expired-ui-sessions", cfg.GetDuration("user-preferences.jobs.purge-expired-ui-sessions.interval"), app.purgeUISessions)
+	if app.historyRetention > 0 {
+		app.jobs.Add("purge-history", cfg.GetDuration("user-preferences.jobs.purge-history.interval"), app.purgeHistory)
+	}
+	app.jobs.Add("apply-scheduled-changes", cfg.GetDuration("user-preferences.jobs.apply-scheduled-changes.interval"), app.applyScheduledChanges)
+
+	app.archiving = cfg.GetBool("user-preferences.archive.enabled")
+	app.archiveAfter = cfg.GetDuration("user-preferences.archive.after")
+	app.archiveBatchSize = cfg.GetInt("user-preferences.archive.batch-size")
+	if app.archiving && app.archiveAfter > 0 {
+		app.jobs.Add("archive-stale-preferences", cfg.GetDuration("user-preferences.jobs.archive-stale-preferences.interval"), app.archiveStale)
+	}
+
+	app.outbox, err = NewOutbox(
+		cfg.GetStringSlice("user-preferences.outbox.targets"),
+		cfg.GetString("user-preferences.outbox.subject"),
+		cfg.GetDuration("user-preferences.outbox.timeout"),
+		cfg.GetInt("user-preferences.outbox.batch-size"),
+		cfg.GetDuration("user-preferences.outbox.retention"),
+	)
+	if err != nil {
+		return err
+	}
+	if len(app.outbox.publishers) > 0 {
+		app.jobs.Add("dispatch-outbox", cfg.GetDuration("user-preferences.jobs.dispatch-outbox.interval"), app.dispatchOutbox)
+	}
+	app.jobs.Add("purge-outbox", cfg.GetDuration("user-preferences.jobs.purge-outbox.interval"), app.purgeOutbox)
+
+	metrics, err := contentMetricsConfig(cfg.GetStringSlice("user-preferences.content-metrics.keys"))
+	if err != nil {
+		return err
+	}
+	if len(metrics) > 0 {
+		app.contentMetrics = NewContentMetrics(metrics)
+		app.jobs.Add("sample-content-metrics", cfg.GetDuration("user-preferences.jobs.sample-content-metrics.interval"), app.sampleContent)
+	}
+
+	if cfg.GetBool("user-preferences.usage.enabled") {
+		app.usage = NewUsageTracker()
+		app.jobs.Add("flush-usage", cfg.GetDuration("user-preferences.jobs.flush-usage.interval"), app.flushUsage)
+	}
+
+	return nil
+}
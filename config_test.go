@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/spf13/viper"
+)
+
+// testConfig mirrors configurate.InitDefaults, merging the YAML over the
+// default configuration.
+func testConfig(t *testing.T, yaml string) *viper.Viper {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(bytes.NewBufferString(configurate.JobServicesDefaults + defaultConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.MergeConfig(bytes.NewBufferString(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestConfigDocument(t *testing.T) {
+	cfg := testConfig(t, `
+user-preferences:
+  defaults:
+    theme: light
+    tools:
+      r: true
+    recent: [one, two]
+`)
+
+	actual, err := configDocument(cfg, "user-preferences.defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"theme":  "light",
+		"tools":  map[string]interface{}{"r": true},
+		"recent": []interface{}{"one", "two"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("configDocument returned %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestConfigDocumentMissing(t *testing.T) {
+	actual, err := configDocument(testConfig(t, "db:\n  uri: foo\n"), "user-preferences.defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual == nil || len(actual) != 0 {
+		t.Errorf("configDocument returned %#v instead of an empty map", actual)
+	}
+}
+
+func TestConfigDocumentNotAMap(t *testing.T) {
+	if _, err := configDocument(testConfig(t, "user-preferences:\n  defaults: foo\n"), "user-preferences.defaults"); err == nil {
+		t.Error("a scalar setting did not cause an error")
+	}
+}
+
+func TestConfigureApp(t *testing.T) {
+	cfg := testConfig(t, `
+user-preferences:
+  admin:
+    key: secret
+  flags:
+    default: true
+  locks:
+    keys: [beta]
+    policy: strip
+`)
+	app := New(NewMockDB())
+	if err := configureApp(app, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.adminKey != "secret" || !app.flagDefault {
+		t.Errorf("admin key was %s and flag default was %t", app.adminKey, app.flagDefault)
+	}
+
+	if app.locks.policy != lockPolicyStrip || !reflect.DeepEqual(app.locks.keys, []string{"beta"}) {
+		t.Errorf("locks were %#v", app.locks)
+	}
+
+	if app.groups != nil {
+		t.Error("a group lookup was configured without an iplant-groups base URL")
+	}
+
+	if app.chaos != nil {
+		t.Error("fault injection was enabled by default")
+	}
+
+	if app.requireVersion {
+		t.Error("versions were required by default")
+	}
+
+	if app.share != nil {
+		t.Error("sharing was enabled without a secret")
+	}
+
+	if app.pii != nil {
+		t.Error("PII scanning was enabled by default")
+	}
+
+	if app.idempotencyWindow != 24*time.Hour {
+		t.Errorf("idempotency window was %s", app.idempotencyWindow)
+	}
+
+	if app.sessionTTL != 30*24*time.Hour {
+		t.Errorf("session TTL was %s", app.sessionTTL)
+	}
+
+	if app.quota != 1048576 {
+		t.Errorf("quota was %d", app.quota)
+	}
+
+	if app.uiSessionTTL != 0 || app.uiSessionLimit != 262144 {
+		t.Errorf("UI session TTL was %s and limit was %d", app.uiSessionTTL, app.uiSessionLimit)
+	}
+	if !app.impersonation || app.auth != nil {
+		t.Errorf("impersonation was %t and the authenticator was %v", app.impersonation, app.auth)
+	}
+
+	if app.historyRetention != 90*24*time.Hour {
+		t.Errorf("history retention was %s", app.historyRetention)
+	}
+
+	statuses := app.jobs.Status()
+	if len(statuses) != 7 || statuses[0].Interval != "1h0m0s" || statuses[4].Interval != "24h0m0s" || statuses[5].Interval != "1m0s" {
+		t.Errorf("jobs were %#v", statuses)
+	}
+	if statuses[6].Name != "purge-outbox" || app.outbox == nil || len(app.outbox.publishers) != 0 {
+		t.Errorf("the outbox jobs were %#v", statuses[5:])
+	}
+}
+
+func TestConfigureAppBadLockPolicy(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  locks:\n    policy: ignore\n")
+	if err := configureApp(New(NewMockDB()), cfg); err == nil {
+		t.Error("an unknown lock policy did not cause an error")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/user-preferences/msgpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The formats preferences documents can be sent and received in.
+const (
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+	formatYAML    = "yaml"
+)
+
+// Media types for request and response bodies.
+const (
+	msgpackType = "application/msgpack"
+	yamlType    = "application/yaml"
+)
+
+// mediaFormats maps the media types clients may use to the formats they
+// select. The x- forms are still sent by a lot of clients.
+var mediaFormats = map[string]string{
+	"application/json":      formatJSON,
+	msgpackType:             formatMsgpack,
+	"application/x-msgpack": formatMsgpack,
+	yamlType:                formatYAML,
+	"application/x-yaml":    formatYAML,
+	"text/yaml":             formatYAML,
+	"text/x-yaml":           formatYAML,
+}
+
+// requestFormat returns the format of the request body. Bodies without a
+// recognized Content-Type are treated as JSON.
+func requestFormat(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return formatJSON
+	}
+	if format, ok := mediaFormats[mediaType]; ok {
+		return format
+	}
+	return formatJSON
+}
+
+// responseFormat returns the format the client prefers for the response,
+// according to its Accept header. JSON wins ties, so clients that don't ask
+// for another format specifically keep getting JSON.
+func responseFormat(r *http.Request) string {
+	var (
+		best         = formatJSON
+		bestQ, jsonQ float64
+	)
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		format, ok := mediaFormats[mediaType]
+		if mediaType == "application/*" || mediaType == "*/*" {
+			format, ok = formatJSON, true
+		}
+
+		switch {
+		case !ok:
+		case format == formatJSON:
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case q > bestQ:
+			best, bestQ = format, q
+		}
+	}
+
+	if bestQ > jsonQ {
+		return best
+	}
+	return formatJSON
+}
+
+// normalizeDocument converts a value into the generic JSON types by
+// round-tripping it through JSON. Structs, such as the metadata, and the
+// integers and interface{}-keyed maps produced by the YAML parser all end up
+// the same as they would in a JSON document.
+func normalizeDocument(value interface{}) (interface{}, error) {
+	jsoned, err := documentJSON.Marshal(stringKeyed(value))
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err = documentJSON.Unmarshal(jsoned, &generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// decodeDocument decodes a preferences document from the request body, which
+// may be JSON, MessagePack, or YAML depending on its Content-Type.
+func decodeDocument(r *http.Request) (map[string]interface{}, error) {
+	var (
+		value interface{}
+		err   error
+	)
+
+	switch requestFormat(r) {
+	case formatMsgpack:
+		value, err = msgpack.Decode(r.Body)
+	case formatYAML:
+		var data []byte
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		value, err = normalizeDocument(value)
+	default:
+		var doc map[string]interface{}
+		if err = documentJSON.Decode(r.Body, &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := value.(map[string]interface{})
+	if value != nil && !ok {
+		return nil, fmt.Errorf("The request body must be a map")
+	}
+	return doc, nil
+}
+
+// encodeDocument returns the document encoded as MessagePack or YAML along
+// with its media type.
+func encodeDocument(format string, doc map[string]interface{}) ([]byte, string, error) {
+	switch format {
+	case formatMsgpack:
+		// Documents containing values other than the generic JSON types are
+		// normalized first.
+		encoded, err := msgpack.Marshal(doc)
+		if err == nil {
+			return encoded, msgpackType, nil
+		}
+
+		generic, err := normalizeDocument(doc)
+		if err != nil {
+			return nil, "", err
+		}
+		encoded, err = msgpack.Marshal(generic)
+		return encoded, msgpackType, err
+	case formatYAML:
+		// The YAML encoder doesn't use the JSON field names of structs, so the
+		// document is always normalized first.
+		generic, err := normalizeDocument(doc)
+		if err != nil {
+			return nil, "", err
+		}
+		encoded, err := yaml.Marshal(generic)
+		return encoded, yamlType, err
+	default:
+		return nil, "", fmt.Errorf("Unsupported document format %s", format)
+	}
+}
+
+// writeDocument writes the document to the client with the status as JSON,
+// MessagePack, or YAML, depending on what the client accepts. An empty
+// document is written as an empty object. MessagePack and YAML are encoded
+// before anything is written, so an error gets a 500; JSON is encoded straight
+// to the client, so an error while encoding it can't change the status any
+// more.
+func writeDocument(writer http.ResponseWriter, r *http.Request, status int, doc map[string]interface{}) error {
+	writer.Header().Add("Vary", "Accept")
+
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	if format := responseFormat(r); format != formatJSON {
+		encoded, contentType, err := encodeDocument(format, doc)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error generating the %s response: %s", format, err), http.StatusInternalServerError)
+			return err
+		}
+		writer.Header().Set("Content-Type", contentType)
+		writer.WriteHeader(status)
+		_, err = writer.Write(encoded)
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if len(doc) == 0 {
+		_, err := writer.Write([]byte("{}"))
+		return err
+	}
+
+	return documentJSON.Encode(writer, doc)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/user-preferences/msgpack"
+)
+
+func TestResponseFormat(t *testing.T) {
+	cases := map[string]string{
+		"":                                      formatJSON,
+		"application/json":                      formatJSON,
+		"application/msgpack":                   formatMsgpack,
+		"application/x-msgpack":                 formatMsgpack,
+		"application/json, application/msgpack": formatJSON,
+		"application/msgpack, application/json;q=0.5": formatMsgpack,
+		"application/msgpack;q=0.5, */*;q=0.1":        formatMsgpack,
+		"application/msgpack;q=0":                     formatJSON,
+		"application/msgpack;q=bogus":                 formatJSON,
+		"application/yaml":                            formatYAML,
+		"text/yaml, application/msgpack;q=0.9":        formatYAML,
+		"text/html":                                   formatJSON,
+	}
+	for accept, expected := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		if actual := responseFormat(r); actual != expected {
+			t.Errorf("responseFormat() returned %s instead of %s for %q", actual, expected, accept)
+		}
+	}
+}
+
+func TestRequestFormat(t *testing.T) {
+	cases := map[string]string{
+		"":                         formatJSON,
+		"application/json":         formatJSON,
+		"application/msgpack":      formatMsgpack,
+		"application/x-yaml":       formatYAML,
+		"text/yaml; charset=utf-8": formatYAML,
+		"text/plain":               formatJSON,
+		"not a media type;;":       formatJSON,
+	}
+	for contentType, expected := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Content-Type", contentType)
+		if actual := requestFormat(r); actual != expected {
+			t.Errorf("requestFormat() returned %s instead of %s for %q", actual, expected, contentType)
+		}
+	}
+}
+
+func TestMsgpackRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	doc := map[string]interface{}{"theme": "dark", "columns": []interface{}{1.0, 2.0}}
+	body, err := msgpack.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/test-user", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("Accept", "application/msgpack")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resBody, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("storing MessagePack preferences returned %d instead of %d: %s", res.StatusCode, http.StatusCreated, resBody)
+	}
+	if res.Header.Get("Content-Type") != msgpackType {
+		t.Errorf("the response content type was %s", res.Header.Get("Content-Type"))
+	}
+
+	decoded, err := msgpack.Unmarshal(resBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := decoded.(map[string]interface{})["preferences"]; !reflect.DeepEqual(stored, doc) {
+		t.Errorf("the stored preferences were %#v instead of %#v", stored, doc)
+	}
+
+	// The same preferences come back as JSON by default.
+	status, jsonBody := doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if status != http.StatusOK || string(jsonBody) != `{"columns":[1,2],"theme":"dark"}` {
+		t.Errorf("getting the preferences as JSON returned %d %s", status, jsonBody)
+	}
+
+	status, msgpackBody := doRequest(t, http.MethodGet, server.URL+"/test-user", nil, map[string]string{"Accept": "application/msgpack"})
+	if status != http.StatusOK {
+		t.Fatalf("getting the preferences as MessagePack returned %d", status)
+	}
+	if decoded, err = msgpack.Unmarshal(msgpackBody); err != nil || !reflect.DeepEqual(decoded, doc) {
+		t.Errorf("the MessagePack preferences were %#v (%v)", decoded, err)
+	}
+}
+
+func TestMsgpackRequestNotAMap(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body, _ := msgpack.Marshal([]interface{}{"not", "a", "map"})
+	status, _ := doRequest(t, http.MethodPost, server.URL+"/test-user", body, map[string]string{"Content-Type": "application/msgpack"})
+	if status == http.StatusOK || status == http.StatusCreated {
+		t.Errorf("storing a MessagePack array returned %d", status)
+	}
+}
+
+func TestYAMLRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte("theme: dark\ncolumns:\n  - 1\n  - 2\nnested:\n  enabled: true\n")
+	status, _ := doRequest(t, http.MethodPut, server.URL+"/test-user", body, map[string]string{"Content-Type": "application/yaml"})
+	if status != http.StatusCreated {
+		t.Fatalf("storing YAML preferences returned %d instead of %d", status, http.StatusCreated)
+	}
+
+	stored := mock.storage["test-user"]["user-prefs"].(string)
+	if stored != `{"columns":[1,2],"nested":{"enabled":true},"theme":"dark"}` {
+		t.Errorf("the stored preferences were %s", stored)
+	}
+
+	status, yamlBody := doRequest(t, http.MethodGet, server.URL+"/test-user", nil, map[string]string{"Accept": "application/yaml"})
+	if status != http.StatusOK {
+		t.Fatalf("getting the preferences as YAML returned %d", status)
+	}
+	if string(yamlBody) != "columns:\n- 1\n- 2\nnested:\n  enabled: true\ntheme: dark\n" {
+		t.Errorf("the YAML preferences were %q", yamlBody)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, server.URL+"/test-user", []byte("- a\n- b\n"), map[string]string{"Content-Type": "application/yaml"})
+	if status == http.StatusOK || status == http.StatusCreated {
+		t.Errorf("storing a YAML list returned %d", status)
+	}
+}
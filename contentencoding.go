@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseCompressionMetrics contains the response compression counters
+// published at /debug/vars: for each encoding, the number of responses and
+// the bytes before and after compression, along with the overall ratios.
+var responseCompressionMetrics = expvar.NewMap("response_compression")
+
+func init() {
+	responseCompressionMetrics.Set("ratio", expvar.Func(compressionRatios))
+}
+
+// compressionRatios returns the compressed size of the responses as a fraction
+// of their original size, for each encoding.
+func compressionRatios() interface{} {
+	ratios := make(map[string]float64)
+	for name := range contentEncoders {
+		in, _ := responseCompressionMetrics.Get(name + "_bytes_in").(*expvar.Int)
+		out, _ := responseCompressionMetrics.Get(name + "_bytes_out").(*expvar.Int)
+		if in != nil && out != nil && in.Value() > 0 {
+			ratios[name] = float64(out.Value()) / float64(in.Value())
+		}
+	}
+	return ratios
+}
+
+// contentEncoder returns a writer that compresses what's written to it into w.
+type contentEncoder func(w io.Writer) io.WriteCloser
+
+// contentEncoders contains the response encodings the service was built with,
+// by their Content-Encoding names. Brotli is only available in builds with
+// -tags brotli.
+var contentEncoders = map[string]contentEncoder{
+	"gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+}
+
+// encodingPreference orders the encodings when a client accepts several
+// equally; better compression comes first.
+var encodingPreference = []string{"br", "gzip"}
+
+// incompressibleTypes are the media types that are already compressed.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":   true,
+	"application/x-gzip": true,
+	"application/zip":    true,
+}
+
+// ResponseCompression compresses response bodies with the best encoding the
+// client accepts. Bodies smaller than the minimum size are sent as they are,
+// since compressing them saves little.
+type ResponseCompression struct {
+	encodings []string
+	minSize   int
+}
+
+// NewResponseCompression returns a newly created *ResponseCompression that
+// offers the encodings, in order of preference. Every encoding the service was
+// built with is offered if the list is empty.
+func NewResponseCompression(encodings []string, minSize int) (*ResponseCompression, error) {
+	if minSize < 0 {
+		return nil, fmt.Errorf("The response compression minimum size must not be negative")
+	}
+
+	c := &ResponseCompression{minSize: minSize}
+	if len(encodings) == 0 {
+		for _, name := range encodingPreference {
+			if _, ok := contentEncoders[name]; ok {
+				c.encodings = append(c.encodings, name)
+			}
+		}
+		return c, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range encodings {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := contentEncoders[name]; !ok {
+			if name == "br" {
+				return nil, fmt.Errorf("The br response encoding needs a build with -tags brotli")
+			}
+			return nil, fmt.Errorf("Unsupported response encoding %s", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			c.encodings = append(c.encodings, name)
+		}
+	}
+	return c, nil
+}
+
+// negotiate returns the encoding to use for a request with the Accept-Encoding
+// header value, or "" to send the response as it is. The encoding with the
+// highest quality value wins, and ties go to the one listed first in the
+// service's preferences.
+func (c *ResponseCompression) negotiate(acceptEncoding string) string {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+				quality = parsed
+			}
+		}
+		if name == "*" {
+			wildcard = quality
+		} else if name != "" {
+			qualities[name] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, name := range c.encodings {
+		quality, ok := qualities[name]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQuality {
+			best, bestQuality = name, quality
+		}
+	}
+	return best
+}
+
+// wrap returns the writer that compresses the response to the request, and a
+// function that must be called once the handler has finished.
+func (c *ResponseCompression) wrap(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if r.Method == http.MethodHead {
+		return writer, func() {}
+	}
+	cw := &compressingWriter{
+		ResponseWriter: writer,
+		encoding:       c.negotiate(r.Header.Get("Accept-Encoding")),
+		minSize:        c.minSize,
+	}
+	return cw, cw.finish
+}
+
+// compressingWriter holds the start of the response until it's reached the
+// minimum size, then compresses the rest of it as it's written. Responses
+// that finish below the minimum size are written out as they are.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	held     bytes.Buffer
+	decided  bool
+	encoder  io.WriteCloser
+	counter  *countingWriter
+	written  int64
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.start(false)
+	}
+}
+
+func (w *compressingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.held.Write(b)
+		if w.held.Len() >= w.minSize {
+			w.start(true)
+			return len(b), w.flushHeld()
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		w.written += int64(len(b))
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// compressible returns whether the response can be compressed, based on the
+// headers the handler set.
+func (w *compressingWriter) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return !incompressibleTypes[mediaType] && !strings.HasPrefix(mediaType, "image/")
+}
+
+// start writes out the response headers, compressing the body if large is set
+// and the response can be compressed.
+func (w *compressingWriter) start(large bool) {
+	w.decided = true
+	header := w.Header()
+
+	candidate := w.status != http.StatusNoContent && w.status != http.StatusNotModified && w.compressible()
+	if candidate && !headerListContains(header["Vary"], "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	compress := candidate && large && w.encoding != ""
+	if compress || w.status == http.StatusNotModified && w.encoding != "" {
+		// The compressed body isn't byte for byte the one the ETag was
+		// computed from, so it can only match weakly.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+	if compress {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.counter = &countingWriter{w: w.ResponseWriter}
+		w.encoder = contentEncoders[w.encoding](w.counter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// flushHeld writes the held start of the response.
+func (w *compressingWriter) flushHeld() error {
+	held := w.held.Bytes()
+	w.held = bytes.Buffer{}
+	if len(held) == 0 {
+		return nil
+	}
+	_, err := w.Write(held)
+	return err
+}
+
+// finish writes out anything still held and completes the compressed stream.
+func (w *compressingWriter) finish() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(false)
+		w.flushHeld()
+	}
+	if w.encoder == nil {
+		return
+	}
+
+	if err := w.encoder.Close(); err != nil {
+		log.Errorf("Error finishing the %s response body: %s", w.encoding, err)
+	}
+	responseCompressionMetrics.Add(w.encoding+"_responses", 1)
+	responseCompressionMetrics.Add(w.encoding+"_bytes_in", w.written)
+	responseCompressionMetrics.Add(w.encoding+"_bytes_out", w.counter.count)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.count += int64(n)
+	return n, err
+}
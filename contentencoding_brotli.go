@@ -0,0 +1,16 @@
+//go:build brotli
+// +build brotli
+
+package main
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+func init() {
+	contentEncoders["br"] = func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	c := &ResponseCompression{encodings: []string{"br", "gzip"}}
+	for _, tc := range []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"identity", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"*, br;q=0", "gzip"},
+		{"GZIP;q=bogus, br;q=0.2", "br"},
+	} {
+		if actual := c.negotiate(tc.header); actual != tc.expected {
+			t.Errorf("negotiate(%q) returned %q", tc.header, actual)
+		}
+	}
+}
+
+func TestNewResponseCompression(t *testing.T) {
+	c, err := NewResponseCompression(nil, 0)
+	if err != nil || len(c.encodings) != len(contentEncoders) || c.encodings[len(c.encodings)-1] != "gzip" {
+		t.Errorf("NewResponseCompression() returned %+v, %v", c, err)
+	}
+	if c, err = NewResponseCompression([]string{"GZIP", "gzip"}, 10); err != nil || len(c.encodings) != 1 {
+		t.Errorf("NewResponseCompression() returned %+v, %v", c, err)
+	}
+	for _, encodings := range [][]string{{"deflate"}, {"zstd", "gzip"}} {
+		if _, err = NewResponseCompression(encodings, 0); err == nil {
+			t.Errorf("NewResponseCompression(%v) did not return an error", encodings)
+		}
+	}
+	if _, err = NewResponseCompression(nil, -1); err == nil {
+		t.Error("a negative minimum size did not cause an error")
+	}
+	if _, ok := contentEncoders["br"]; !ok {
+		if _, err = NewResponseCompression([]string{"br"}, 0); err == nil || !strings.Contains(err.Error(), "-tags brotli") {
+			t.Errorf("asking for br without it returned %v", err)
+		}
+	}
+}
+
+// compressionApp returns an app with gzip response compression for bodies of
+// at least 100 bytes, and a user with a large document.
+func compressionApp(t *testing.T) *UserPreferencesApp {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"session":"`+strings.Repeat("abcd", 500)+`"}`)
+
+	n := New(mock)
+	cfg := testConfig(t, `user-preferences:
+  caching:
+    routes:
+      "/{username}":
+        max-age: 30s
+  response-compression:
+    enabled: true
+    encodings: [gzip]
+    min-size: 100
+`)
+	if err := configureApp(n, cfg); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	return n
+}
+
+func TestResponseCompression(t *testing.T) {
+	n := compressionApp(t)
+	counter := func(name string) int64 {
+		if v, ok := responseCompressionMetrics.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	responses := counter("gzip_responses")
+
+	r := httptest.NewRequest(http.MethodGet, "/alice", nil)
+	r.Header.Set("Accept-Encoding", "br;q=0.9, gzip")
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, r)
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("the response was %d with the encoding %q", recorder.Code, recorder.Header().Get("Content-Encoding"))
+	}
+	if !headerListContains(recorder.Header()["Vary"], "Accept-Encoding") {
+		t.Errorf("the Vary header was %v", recorder.Header()["Vary"])
+	}
+	etag := recorder.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("the ETag of a compressed response was %q", etag)
+	}
+
+	gz, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(body, &doc); err != nil || len(doc["session"].(string)) != 2000 {
+		t.Errorf("the decompressed body was %.80s", body)
+	}
+
+	if counter("gzip_responses") != responses+1 || counter("gzip_bytes_out") >= counter("gzip_bytes_in") {
+		t.Errorf("the metrics were %s", responseCompressionMetrics.String())
+	}
+	if ratio := compressionRatios().(map[string]float64)["gzip"]; ratio <= 0 || ratio >= 1 {
+		t.Errorf("the gzip compression ratio was %f", ratio)
+	}
+
+	r.Header.Set("If-None-Match", etag)
+	recorder = httptest.NewRecorder()
+	n.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("a GET with the weak ETag returned %d with %d bytes", recorder.Code, recorder.Body.Len())
+	}
+}
+
+func TestResponseCompressionSkipped(t *testing.T) {
+	n := compressionApp(t)
+
+	for _, tc := range []struct {
+		method, path, accept string
+	}{
+		{http.MethodGet, "/alice", ""},
+		{http.MethodGet, "/alice", "identity"},
+		{http.MethodGet, "/healthz", "gzip"},
+		{http.MethodHead, "/alice", "gzip"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, r)
+
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%s %s with Accept-Encoding %q was encoded with %s", tc.method, tc.path, tc.accept, encoding)
+		}
+		if tc.method == http.MethodGet && tc.path == "/alice" && !strings.Contains(recorder.Body.String(), "abcdabcd") {
+			t.Errorf("%s %s with Accept-Encoding %q returned %.80s", tc.method, tc.path, tc.accept, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdoptionMetric is a key whose adoption is sampled: the number of documents
+// that contain the key, or that contain it with a particular value.
+type AdoptionMetric struct {
+	Path     string
+	Value    interface{}
+	HasValue bool
+}
+
+// label returns the metric's value as a Prometheus label value.
+func (a AdoptionMetric) label() string {
+	if str, ok := a.Value.(string); ok {
+		return str
+	}
+	jsoned, _ := json.Marshal(a.Value)
+	return string(jsoned)
+}
+
+// ParseAdoptionMetric parses an adoption metric from the configuration. The
+// setting is either a dotted key path, or a path and a value separated by an
+// equals sign, as in ui.theme=dark. Values are parsed as JSON if they can be,
+// and used as strings otherwise.
+func ParseAdoptionMetric(setting string) (AdoptionMetric, error) {
+	parts := strings.SplitN(setting, "=", 2)
+	metric := AdoptionMetric{Path: strings.TrimSpace(parts[0])}
+	if metric.Path == "" {
+		return metric, fmt.Errorf("Missing key path in content metric %q", setting)
+	}
+
+	if len(parts) == 2 {
+		metric.HasValue = true
+		raw := strings.TrimSpace(parts[1])
+		if err := json.Unmarshal([]byte(raw), &metric.Value); err != nil {
+			metric.Value = raw
+		}
+	}
+	return metric, nil
+}
+
+// adoptionSample is the outcome of sampling an adoption metric.
+type adoptionSample struct {
+	metric AdoptionMetric
+	count  int64
+}
+
+// ContentMetrics periodically samples aggregate metrics about the contents of
+// the stored preferences and exposes them as Prometheus gauges.
+type ContentMetrics struct {
+	mu        sync.Mutex
+	metrics   []AdoptionMetric
+	samples   []adoptionSample
+	documents int64
+	sampledAt time.Time
+}
+
+// NewContentMetrics returns a newly created *ContentMetrics for the metrics.
+// Nothing is reported until the first sample is taken.
+func NewContentMetrics(metrics []AdoptionMetric) *ContentMetrics {
+	return &ContentMetrics{metrics: metrics}
+}
+
+// sample counts the documents matching each metric.
+func (c *ContentMetrics) sample(db DB, now time.Time) (int, error) {
+	documents, err := db.countDocuments()
+	if err != nil {
+		return 0, fmt.Errorf("Error counting preferences documents: %s", err)
+	}
+
+	samples := make([]adoptionSample, len(c.metrics))
+	for i, metric := range c.metrics {
+		samples[i].metric = metric
+		if metric.HasValue {
+			samples[i].count, err = db.countKeyValue(metric.Path, metric.Value)
+		} else {
+			samples[i].count, err = db.countKey(metric.Path)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Error sampling content metric for %s: %s", metric.Path, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = samples
+	c.documents = documents
+	c.sampledAt = now
+	return len(samples), nil
+}
+
+// promLabel escapes a Prometheus label value.
+func promLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// write writes the gauges in the Prometheus text exposition format.
+func (c *ContentMetrics) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sampledAt.IsZero() {
+		return
+	}
+
+	fmt.Fprintln(buf, "# HELP user_preferences_content_sampled_timestamp_seconds When the preferences contents were last sampled.")
+	fmt.Fprintln(buf, "# TYPE user_preferences_content_sampled_timestamp_seconds gauge")
+	fmt.Fprintf(buf, "user_preferences_content_sampled_timestamp_seconds %d\n", c.sampledAt.Unix())
+
+	fmt.Fprintln(buf, "# HELP user_preferences_documents The number of stored preferences documents.")
+	fmt.Fprintln(buf, "# TYPE user_preferences_documents gauge")
+	fmt.Fprintf(buf, "user_preferences_documents %d\n", c.documents)
+
+	labels := make([]string, len(c.samples))
+	for i, s := range c.samples {
+		labels[i] = fmt.Sprintf(`key="%s"`, promLabel(s.metric.Path))
+		if s.metric.HasValue {
+			labels[i] += fmt.Sprintf(`,value="%s"`, promLabel(s.metric.label()))
+		}
+	}
+
+	fmt.Fprintln(buf, "# HELP user_preferences_key_documents The number of documents containing the key, with the value if there is one.")
+	fmt.Fprintln(buf, "# TYPE user_preferences_key_documents gauge")
+	for i, s := range c.samples {
+		fmt.Fprintf(buf, "user_preferences_key_documents{%s} %d\n", labels[i], s.count)
+	}
+
+	fmt.Fprintln(buf, "# HELP user_preferences_key_adoption_ratio The fraction of documents containing the key, with the value if there is one.")
+	fmt.Fprintln(buf, "# TYPE user_preferences_key_adoption_ratio gauge")
+	for i, s := range c.samples {
+		ratio := 0.0
+		if c.documents > 0 {
+			ratio = float64(s.count) / float64(c.documents)
+		}
+		fmt.Fprintf(buf, "user_preferences_key_adoption_ratio{%s} %s\n", labels[i], strconv.FormatFloat(ratio, 'g', -1, 64))
+	}
+}
+
+// sampleContent is the background job that samples the content metrics.
+func (u *UserPreferencesApp) sampleContent(now time.Time) (int, error) {
+	return u.contentMetrics.sample(u.prefs, now)
+}
+
+// MetricsRequest handles writing out the content metrics in the Prometheus
+// text exposition format. It returns a 404 if content metrics aren't enabled.
+func (u *UserPreferencesApp) MetricsRequest(writer http.ResponseWriter, r *http.Request) {
+	if u.contentMetrics == nil {
+		notFound(writer, "Content metrics are not enabled")
+		return
+	}
+
+	var buf bytes.Buffer
+	u.contentMetrics.write(&buf)
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Write(buf.Bytes())
+}
+
+// countDocuments returns the number of stored preferences documents.
+func (p *PrefsDB) countDocuments() (int64, error) {
+	var count int64
+	err := p.db.QueryRow(`SELECT COUNT(*) FROM ` + p.tables.Preferences + ``).Scan(&count)
+	return count, err
+}
+
+// countKeyValue returns the number of documents in which the dotted key path
+// has the value.
+func (p *PrefsDB) countKeyValue(path string, value interface{}) (int64, error) {
+	query := `SELECT COUNT(*)
+                FROM ` + p.tables.Preferences + `
+               WHERE preferences::jsonb #> ` + documentPath("$1") + ` = $2::jsonb`
+
+	jsoned, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err = p.db.QueryRow(query, textArray(splitPath(path)), string(jsoned)).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	compressed, err := p.countCompressed(func(values map[string]interface{}) bool {
+		stored, ok := getPath(values, path)
+		return ok && reflect.DeepEqual(stored, value)
+	})
+	return count + compressed, err
+}
+
+// contentMetricsConfig returns the adoption metrics listed in the
+// configuration, sorted by path.
+func contentMetricsConfig(settings []string) ([]AdoptionMetric, error) {
+	var metrics []AdoptionMetric
+	for _, setting := range settings {
+		metric, err := ParseAdoptionMetric(setting)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Path < metrics[j].Path
+	})
+	return metrics, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseAdoptionMetric(t *testing.T) {
+	tests := []struct {
+		setting  string
+		expected AdoptionMetric
+	}{
+		{"tools.favorites", AdoptionMetric{Path: "tools.favorites"}},
+		{"ui.theme=dark", AdoptionMetric{Path: "ui.theme", Value: "dark", HasValue: true}},
+		{"ui.compact = true", AdoptionMetric{Path: "ui.compact", Value: true, HasValue: true}},
+		{"columns=3", AdoptionMetric{Path: "columns", Value: 3.0, HasValue: true}},
+		{`quoted="a=b"`, AdoptionMetric{Path: "quoted", Value: "a=b", HasValue: true}},
+	}
+	for _, test := range tests {
+		actual, err := ParseAdoptionMetric(test.setting)
+		if err != nil || !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("ParseAdoptionMetric(%q) returned %#v, %v", test.setting, actual, err)
+		}
+	}
+
+	if _, err := ParseAdoptionMetric("=dark"); err == nil {
+		t.Error("a metric without a path was accepted")
+	}
+}
+
+func TestContentMetrics(t *testing.T) {
+	mock := NewMockDB()
+	mock.insertPreferences("alice", `{"ui":{"theme":"dark"},"columns":3}`)
+	mock.insertPreferences("bob", `{"preferences":{"ui":{"theme":"dark"}}}`)
+	mock.insertPreferences("carol", `{"ui":{"theme":"light"}}`)
+	mock.insertPreferences("dave", `{}`)
+
+	metrics, err := contentMetricsConfig([]string{"ui.theme=dark", "columns", `say "hi"=1`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/metrics", nil, nil); status != http.StatusNotFound {
+		t.Errorf("the metrics endpoint returned %d while content metrics were disabled", status)
+	}
+
+	n.contentMetrics = NewContentMetrics(metrics)
+	if status, body := doRequest(t, http.MethodGet, server.URL+"/metrics", nil, nil); status != http.StatusOK || len(body) != 0 {
+		t.Errorf("the metrics endpoint returned %d before the first sample: %s", status, body)
+	}
+
+	sampled, err := n.sampleContent(time.Unix(1700000000, 0))
+	if err != nil || sampled != 3 {
+		t.Fatalf("sampleContent returned %d, %v", sampled, err)
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/metrics", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("the metrics endpoint returned %d", status)
+	}
+
+	for _, line := range []string{
+		"user_preferences_content_sampled_timestamp_seconds 1700000000",
+		"user_preferences_documents 4",
+		`user_preferences_key_documents{key="columns"} 1`,
+		`user_preferences_key_documents{key="ui.theme",value="dark"} 2`,
+		`user_preferences_key_documents{key="say \"hi\"",value="1"} 0`,
+		`user_preferences_key_adoption_ratio{key="columns"} 0.25`,
+		`user_preferences_key_adoption_ratio{key="ui.theme",value="dark"} 0.5`,
+		"# TYPE user_preferences_key_adoption_ratio gauge",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("the metrics didn't include %s:\n%s", line, body)
+		}
+	}
+}
+
+func TestContentMetricsWithoutDocuments(t *testing.T) {
+	c := NewContentMetrics([]AdoptionMetric{{Path: "columns"}})
+	if _, err := c.sample(NewMockDB(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	if !strings.Contains(buf.String(), `user_preferences_key_adoption_ratio{key="columns"} 0`+"\n") {
+		t.Errorf("the metrics were:\n%s", buf.String())
+	}
+}
+
+func TestConfigureContentMetrics(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  content-metrics:\n    keys: [ui.theme=dark]\n")
+	app := New(NewMockDB())
+	if err := configureApp(app, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if app.contentMetrics == nil || len(app.contentMetrics.metrics) != 1 {
+		t.Fatalf("the content metrics were %#v", app.contentMetrics)
+	}
+
+	found := false
+	for _, status := range app.jobs.Status() {
+		found = found || status.Name == "sample-content-metrics"
+	}
+	if !found {
+		t.Error("the sample-content-metrics job wasn't registered")
+	}
+}
+
+func TestCountKeyValue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_preferences WHERE preferences::jsonb #> (.+) = \\$2::jsonb").
+		WithArgs(`{"ui","theme"}`, `"dark"`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+	mock.ExpectQuery("SELECT id, version, encoding, compressed FROM user_preferences WHERE encoding <> 'identity'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "encoding", "compressed"}))
+
+	count, err := p.countKeyValue("ui.theme", "dark")
+	if err != nil || count != 4 {
+		t.Errorf("countKeyValue returned %d, %v", count, err)
+	}
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_preferences$").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(9))
+
+	if count, err = p.countDocuments(); err != nil || count != 9 {
+		t.Errorf("countDocuments returned %d, %v", count, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
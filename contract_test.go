@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pactsEnv names the environment variable listing the directories or files
+// containing the consumer contracts to verify, separated by colons. The
+// contracts in testdata/pacts are verified if it isn't set.
+const pactsEnv = "USER_PREFERENCES_PACTS"
+
+// pactFile is a consumer contract in the Pact specification's JSON format.
+// Only the parts of versions 2 and 3 that the DE's consumers use are
+// supported.
+type pactFile struct {
+	Consumer     struct{ Name string } `json:"consumer"`
+	Provider     struct{ Name string } `json:"provider"`
+	Interactions []pactInteraction     `json:"interactions"`
+}
+
+// pactInteraction is a request the consumer makes and the response it relies
+// on, given the provider's state.
+type pactInteraction struct {
+	Description    string `json:"description"`
+	ProviderState  string `json:"providerState"`
+	ProviderStates []struct {
+		Name string `json:"name"`
+	} `json:"providerStates"`
+	Request struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Query   string            `json:"query"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status        int                 `json:"status"`
+		Headers       map[string]string   `json:"headers"`
+		Body          json.RawMessage     `json:"body"`
+		MatchingRules map[string]pactRule `json:"matchingRules"`
+	} `json:"response"`
+}
+
+// pactRule is a Pact matching rule. Values matched by type only need to have
+// the same JSON type as the example, and so do the values nested in them.
+type pactRule struct {
+	Match string `json:"match"`
+	Regex string `json:"regex"`
+	Min   *int   `json:"min"`
+}
+
+// states returns the names of the provider states the interaction needs.
+func (i *pactInteraction) states() []string {
+	var states []string
+	if i.ProviderState != "" {
+		states = append(states, i.ProviderState)
+	}
+	for _, state := range i.ProviderStates {
+		states = append(states, state.Name)
+	}
+	return states
+}
+
+// providerStates set up the mocked database for the states named in the
+// contracts. Each interaction starts with a user named alice who has no
+// preferences.
+var providerStates = map[string]func(m *MockDB) error{
+	"alice has no preferences": func(m *MockDB) error {
+		return nil
+	},
+	"alice has preferences": func(m *MockDB) error {
+		return m.insertPreferences("alice", `{"defaultFileSelectorPath":"/iplant/home/alice","rememberLastPath":true}`)
+	},
+	"alice is not a user": func(m *MockDB) error {
+		delete(m.users, "alice")
+		return nil
+	},
+	"alice has saved searches": func(m *MockDB) error {
+		return m.replaceSearches("alice", map[string]string{"fastq": `{"label":"*.fastq"}`})
+	},
+	"alice has a UI session": func(m *MockDB) error {
+		return m.saveUISession("alice", `{"tabs":["data","apps"]}`, time.Time{})
+	},
+}
+
+// pactPaths returns the contract files to verify.
+func pactPaths(t *testing.T) []string {
+	sources := []string{filepath.Join("testdata", "pacts")}
+	if setting := os.Getenv(pactsEnv); setting != "" {
+		sources = strings.Split(setting, ":")
+	}
+
+	var paths []string
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			paths = append(paths, source)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(source, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// matchBody compares the actual value at the JSON path with the expected one,
+// returning a description of each mismatch. Objects may have keys that the
+// contract doesn't mention, since consumers ignore them.
+func matchBody(expected, actual interface{}, path string, rules map[string]pactRule, byType bool) []string {
+	rule, hasRule := rules[path]
+	if hasRule {
+		switch rule.Match {
+		case "type":
+			byType = true
+		case "regex":
+			s, ok := actual.(string)
+			if !ok || !regexp.MustCompile(rule.Regex).MatchString(s) {
+				return []string{fmt.Sprintf("%s: %v doesn't match %s", path, actual, rule.Regex)}
+			}
+			return nil
+		}
+	}
+
+	switch exp := expected.(type) {
+	case map[string]interface{}:
+		act, ok := actual.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %v", path, actual)}
+		}
+		var mismatches []string
+		for key, value := range exp {
+			actValue, present := act[key]
+			if !present {
+				mismatches = append(mismatches, fmt.Sprintf("%s.%s: missing", path, key))
+				continue
+			}
+			mismatches = append(mismatches, matchBody(value, actValue, path+"."+key, rules, byType)...)
+		}
+		return mismatches
+
+	case []interface{}:
+		act, ok := actual.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %v", path, actual)}
+		}
+		if byType {
+			if hasRule && rule.Min != nil && len(act) < *rule.Min {
+				return []string{fmt.Sprintf("%s: expected at least %d items, got %d", path, *rule.Min, len(act))}
+			}
+			var mismatches []string
+			for i, item := range act {
+				if len(exp) > 0 {
+					mismatches = append(mismatches, matchBody(exp[0], item, fmt.Sprintf("%s[%d]", path, i), rules, byType)...)
+				}
+			}
+			return mismatches
+		}
+		if len(act) != len(exp) {
+			return []string{fmt.Sprintf("%s: expected %d items, got %d", path, len(exp), len(act))}
+		}
+		var mismatches []string
+		for i := range exp {
+			mismatches = append(mismatches, matchBody(exp[i], act[i], fmt.Sprintf("%s[%d]", path, i), rules, byType)...)
+		}
+		return mismatches
+
+	default:
+		if byType {
+			if reflect.TypeOf(expected) != reflect.TypeOf(actual) {
+				return []string{fmt.Sprintf("%s: expected a value like %v, got %v", path, expected, actual)}
+			}
+			return nil
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			return []string{fmt.Sprintf("%s: expected %v, got %v", path, expected, actual)}
+		}
+		return nil
+	}
+}
+
+// verifyInteraction replays the interaction's request against a service in
+// the interaction's provider state and returns the ways the response differs
+// from the contract.
+func verifyInteraction(t *testing.T, interaction *pactInteraction) []string {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	for _, state := range interaction.states() {
+		setup, ok := providerStates[state]
+		if !ok {
+			return []string{fmt.Sprintf("unknown provider state %q", state)}
+		}
+		if err := setup(mock); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, "user-preferences:\n  terrain:\n    enabled: true\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	if len(interaction.Request.Body) > 0 {
+		body = interaction.Request.Body
+	}
+	target := interaction.Request.Path
+	if interaction.Request.Query != "" {
+		target += "?" + interaction.Request.Query
+	}
+	req := httptest.NewRequest(interaction.Request.Method, target, bytes.NewReader(body))
+	for name, value := range interaction.Request.Headers {
+		req.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	resp := recorder.Result()
+
+	var mismatches []string
+	if resp.StatusCode != interaction.Response.Status {
+		mismatches = append(mismatches, fmt.Sprintf("status: expected %d, got %d", interaction.Response.Status, resp.StatusCode))
+	}
+
+	for name, expected := range interaction.Response.Headers {
+		actual := resp.Header.Get(name)
+		if rule, ok := interaction.Response.MatchingRules["$.headers."+name]; ok && rule.Match == "regex" {
+			if !regexp.MustCompile(rule.Regex).MatchString(actual) {
+				mismatches = append(mismatches, fmt.Sprintf("header %s: %q doesn't match %s", name, actual, rule.Regex))
+			}
+			continue
+		}
+		if strings.EqualFold(name, "Content-Type") {
+			expected, _, _ = mime.ParseMediaType(expected)
+			actual, _, _ = mime.ParseMediaType(actual)
+		}
+		if actual != expected {
+			mismatches = append(mismatches, fmt.Sprintf("header %s: expected %q, got %q", name, expected, actual))
+		}
+	}
+
+	if len(interaction.Response.Body) == 0 {
+		return mismatches
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal(interaction.Response.Body, &expected); err != nil {
+		t.Fatal(err)
+	}
+	actualBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies that aren't JSON, like the plain text error messages, are
+	// compared as strings.
+	var actual interface{}
+	if _, isString := expected.(string); isString {
+		actual = strings.TrimSuffix(string(actualBody), "\n")
+	} else if err = json.Unmarshal(actualBody, &actual); err != nil {
+		return append(mismatches, fmt.Sprintf("body: expected JSON, got %q", actualBody))
+	}
+
+	return append(mismatches, matchBody(expected, actual, "$.body", interaction.Response.MatchingRules, false)...)
+}
+
+// TestConsumerContracts verifies the service against its consumers'
+// contracts, so that a change to a response's shape that a consumer relies on
+// fails before it's released. Point USER_PREFERENCES_PACTS at the contracts
+// published by the consumers to verify the current ones.
+func TestConsumerContracts(t *testing.T) {
+	defer log.SetLevel(log.Level())
+	log.SetLevel(ErrorLevel + 1)
+
+	paths := pactPaths(t)
+	if len(paths) == 0 {
+		t.Fatal("there are no contracts to verify")
+	}
+
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pact pactFile
+		if err = json.Unmarshal(contents, &pact); err != nil {
+			t.Fatalf("error parsing %s: %s", path, err)
+		}
+		if pact.Provider.Name != serviceName {
+			t.Errorf("%s is a contract with %s, not %s", path, pact.Provider.Name, serviceName)
+			continue
+		}
+
+		for i := range pact.Interactions {
+			interaction := &pact.Interactions[i]
+			t.Run(pact.Consumer.Name+"/"+interaction.Description, func(t *testing.T) {
+				for _, mismatch := range verifyInteraction(t, interaction) {
+					t.Error(mismatch)
+				}
+			})
+		}
+	}
+}
+
+func TestMatchBody(t *testing.T) {
+	rules := map[string]pactRule{
+		"$.body.preferences": {Match: "type"},
+		"$.body.meta.id":     {Match: "regex", Regex: "^[0-9a-f-]{36}$"},
+	}
+	expected := map[string]interface{}{
+		"preferences": map[string]interface{}{"theme": "dark", "recent": []interface{}{"a"}},
+		"meta":        map[string]interface{}{"id": "00000000-0000-0000-0000-000000000000", "version": float64(1)},
+	}
+
+	actual := map[string]interface{}{
+		"preferences": map[string]interface{}{"theme": "light", "recent": []interface{}{"b", "c"}, "extra": true},
+		"meta":        map[string]interface{}{"id": "0a1b2c3d-0000-0000-0000-000000000000", "version": float64(1)},
+	}
+	if mismatches := matchBody(expected, actual, "$.body", rules, false); len(mismatches) != 0 {
+		t.Errorf("a matching body had mismatches: %v", mismatches)
+	}
+
+	actual = map[string]interface{}{
+		"preferences": map[string]interface{}{"theme": 1, "recent": []interface{}{"b"}},
+		"meta":        map[string]interface{}{"id": "not-an-id", "version": float64(2)},
+	}
+	if mismatches := matchBody(expected, actual, "$.body", rules, false); len(mismatches) != 3 {
+		t.Errorf("a mismatched body had mismatches %v", mismatches)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reportedTables returns the tables whose statistics are included in the
+// database report.
+func reportedTables() []string {
+	return tables.relnames()
+}
+
+// sequentialScanRows is the number of rows a table needs before it's reported
+// for being scanned sequentially more often than by index.
+const sequentialScanRows = 10000
+
+// IndexAdvisory describes an index that the service's queries rely on.
+type IndexAdvisory struct {
+	Name      string `json:"name"`
+	Table     string `json:"table"`
+	Reason    string `json:"reason"`
+	Statement string `json:"statement"`
+
+	// method and leading identify an existing index that does the same job,
+	// whatever it's named: its access method and its first column or
+	// expression, as pg_get_indexdef prints them.
+	method  string
+	leading string
+}
+
+// indexAdvisories are the indexes checked for at startup and in the database
+// report. They're only checked for tables that haven't been renamed.
+var indexAdvisories = []IndexAdvisory{
+	{
+		Name:      "users_username_index",
+		Table:     "users",
+		Reason:    "Every request looks up the user by username",
+		Statement: "CREATE INDEX IF NOT EXISTS users_username_index ON users (username)",
+		method:    "btree",
+		leading:   "username",
+	},
+	{
+		Name:      "user_preferences_user_id_index",
+		Table:     "user_preferences",
+		Reason:    "Every read and write of a user's preferences joins them to the user by user_id",
+		Statement: "CREATE INDEX IF NOT EXISTS user_preferences_user_id_index ON user_preferences (user_id)",
+		method:    "btree",
+		leading:   "user_id",
+	},
+	{
+		Name:      "user_preferences_document_index",
+		Table:     "user_preferences",
+		Reason:    "Searches of the documents by key (?) or containment (@>) need a GIN index to avoid scanning every document",
+		Statement: "CREATE INDEX IF NOT EXISTS user_preferences_document_index ON user_preferences USING gin ((preferences::jsonb))",
+		method:    "gin",
+		leading:   "((preferences)::jsonb)",
+	},
+}
+
+// satisfiedBy returns whether the index definition does the advised index's
+// job.
+func (a IndexAdvisory) satisfiedBy(table, definition string) bool {
+	if table != a.Table {
+		return false
+	}
+	prefix := fmt.Sprintf(" USING %s (%s", a.method, a.leading)
+	i := strings.Index(definition, prefix)
+	if i < 0 {
+		return false
+	}
+	rest := definition[i+len(prefix):]
+	return strings.HasPrefix(rest, ")") || strings.HasPrefix(rest, ",") || strings.HasPrefix(rest, " ")
+}
+
+// TableStats describes how a table has been read since its statistics were
+// last reset.
+type TableStats struct {
+	Table           string `json:"table"`
+	Rows            int64  `json:"rows"`
+	SequentialScans int64  `json:"sequential_scans"`
+	IndexScans      int64  `json:"index_scans"`
+}
+
+// DatabaseReport is the result of inspecting the database for missing indexes.
+type DatabaseReport struct {
+	Tables          []TableStats    `json:"tables"`
+	MissingIndexes  []IndexAdvisory `json:"missing_indexes"`
+	Recommendations []string        `json:"recommendations"`
+}
+
+// missingIndexes returns the advised indexes that the database doesn't have a
+// valid equivalent of.
+func missingIndexes(db *sql.DB) ([]IndexAdvisory, error) {
+	query := `SELECT t.relname, pg_get_indexdef(i.indexrelid)
+                FROM pg_index i
+                JOIN pg_class t ON t.oid = i.indrelid
+               WHERE t.relname = ANY($1::text[])
+                 AND pg_table_is_visible(t.oid)
+                 AND i.indisvalid`
+
+	rows, err := db.Query(query, textArray(reportedTables()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reported := make(map[string]bool)
+	for _, table := range reportedTables() {
+		reported[table] = true
+	}
+
+	found := make([]bool, len(indexAdvisories))
+	for rows.Next() {
+		var table, definition string
+		if err = rows.Scan(&table, &definition); err != nil {
+			return nil, err
+		}
+		for i, advisory := range indexAdvisories {
+			if advisory.satisfiedBy(table, definition) {
+				found[i] = true
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	missing := []IndexAdvisory{}
+	for i, advisory := range indexAdvisories {
+		if !found[i] && reported[advisory.Table] {
+			missing = append(missing, advisory)
+		}
+	}
+	return missing, nil
+}
+
+// newDatabaseReport inspects the table statistics and indexes of the
+// database.
+func newDatabaseReport(db *sql.DB) (*DatabaseReport, error) {
+	query := `SELECT relname, n_live_tup, COALESCE(seq_scan, 0), COALESCE(idx_scan, 0)
+                FROM pg_stat_user_tables
+               WHERE relname = ANY($1::text[])
+            ORDER BY relname`
+
+	rows, err := db.Query(query, textArray(reportedTables()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &DatabaseReport{Tables: []TableStats{}, Recommendations: []string{}}
+	for rows.Next() {
+		var stats TableStats
+		if err = rows.Scan(&stats.Table, &stats.Rows, &stats.SequentialScans, &stats.IndexScans); err != nil {
+			return nil, err
+		}
+		report.Tables = append(report.Tables, stats)
+
+		if stats.Rows >= sequentialScanRows && stats.SequentialScans > stats.IndexScans {
+			report.Recommendations = append(report.Recommendations, fmt.Sprintf(
+				"Table %s has %d rows and was scanned sequentially %d times but by index only %d times; check its queries for a missing index",
+				stats.Table, stats.Rows, stats.SequentialScans, stats.IndexScans,
+			))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if report.MissingIndexes, err = missingIndexes(db); err != nil {
+		return nil, err
+	}
+	for _, advisory := range report.MissingIndexes {
+		report.Recommendations = append(report.Recommendations, fmt.Sprintf("%s: %s", advisory.Reason, advisory.Statement))
+	}
+
+	return report, nil
+}
+
+// databaseReport inspects the database for missing indexes.
+func (p *PrefsDB) databaseReport() (*DatabaseReport, error) {
+	return newDatabaseReport(p.db)
+}
+
+// checkIndexes logs the advised indexes that the database is missing, and
+// creates them if create is true. Failing to check is only logged, since the
+// database user may not be able to read the catalogs, but failing to create
+// an index is returned.
+func checkIndexes(db *sql.DB, create bool) error {
+	missing, err := missingIndexes(db)
+	if err != nil {
+		log.Warnf("Unable to check the database for missing indexes: %s", err)
+		return nil
+	}
+
+	for _, advisory := range missing {
+		if !create {
+			log.WithFields(Fields{"index": advisory.Name, "table": advisory.Table}).
+				Warnf("Missing a recommended index. %s: %s", advisory.Reason, advisory.Statement)
+			continue
+		}
+
+		log.Infof("Creating the index %s on %s", advisory.Name, advisory.Table)
+		if _, err = db.Exec(advisory.Statement); err != nil {
+			return fmt.Errorf("Error creating the index %s: %s", advisory.Name, err)
+		}
+	}
+	return nil
+}
+
+// DatabaseReportRequest handles writing out the table statistics and the
+// indexes the database is missing.
+func (u *UserPreferencesApp) DatabaseReportRequest(writer http.ResponseWriter, r *http.Request) {
+	report, err := u.prefs.databaseReport()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error inspecting the database: %s", err))
+		return
+	}
+
+	jsoned, err := json.Marshal(report)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating database report JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestIndexAdvisorySatisfiedBy(t *testing.T) {
+	username, document := indexAdvisories[0], indexAdvisories[2]
+	for _, tc := range []struct {
+		advisory   IndexAdvisory
+		table      string
+		definition string
+		expected   bool
+	}{
+		{username, "users", "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)", true},
+		{username, "users", "CREATE INDEX users_username_id ON public.users USING btree (username, id)", true},
+		{username, "users", "CREATE INDEX users_username_lower ON public.users USING btree (username_lower)", false},
+		{username, "users", "CREATE INDEX users_id_username ON public.users USING btree (id, username)", false},
+		{username, "user_preferences", "CREATE INDEX p ON public.user_preferences USING btree (username)", false},
+		{document, "user_preferences", "CREATE INDEX d ON public.user_preferences USING gin (((preferences)::jsonb))", true},
+		{document, "user_preferences", "CREATE INDEX d ON public.user_preferences USING gin (((preferences)::jsonb) jsonb_path_ops)", true},
+		{document, "user_preferences", "CREATE INDEX d ON public.user_preferences USING btree (((preferences)::jsonb))", false},
+	} {
+		if actual := tc.advisory.satisfiedBy(tc.table, tc.definition); actual != tc.expected {
+			t.Errorf("%s.satisfiedBy(%q) returned %t", tc.advisory.Name, tc.definition, actual)
+		}
+	}
+}
+
+// expectIndexes expects the query for the existing indexes.
+func expectIndexes(mock sqlmock.Sqlmock, definitions ...string) {
+	rows := sqlmock.NewRows([]string{"relname", "pg_get_indexdef"})
+	for i := 0; i < len(definitions); i += 2 {
+		rows.AddRow(definitions[i], definitions[i+1])
+	}
+	mock.ExpectQuery("SELECT t.relname, pg_get_indexdef").
+		WithArgs(`{"users","user_preferences"}`).
+		WillReturnRows(rows)
+}
+
+func TestNewDatabaseReport(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT relname, n_live_tup, (.+) FROM pg_stat_user_tables").
+		WithArgs(`{"users","user_preferences"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"relname", "n_live_tup", "seq_scan", "idx_scan"}).
+			AddRow("user_preferences", 50000, 900, 10).
+			AddRow("users", 50000, 3, 10000))
+	expectIndexes(mock,
+		"users", "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)",
+		"user_preferences", "CREATE INDEX user_preferences_user_id_index ON public.user_preferences USING btree (user_id)",
+	)
+
+	report, err := NewPrefsDB(db).databaseReport()
+	if err != nil {
+		t.Fatalf("databaseReport() returned %s", err)
+	}
+	if len(report.Tables) != 2 || report.Tables[0].SequentialScans != 900 {
+		t.Errorf("the table statistics were %+v", report.Tables)
+	}
+	if len(report.MissingIndexes) != 1 || report.MissingIndexes[0].Name != "user_preferences_document_index" {
+		t.Errorf("the missing indexes were %+v", report.MissingIndexes)
+	}
+	if len(report.Recommendations) != 2 {
+		t.Errorf("the recommendations were %q", report.Recommendations)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckIndexes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	expectIndexes(mock, "users", "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)")
+	if err = checkIndexes(db, false); err != nil {
+		t.Errorf("checkIndexes() returned %s without creating indexes", err)
+	}
+
+	expectIndexes(mock, "users", "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)")
+	mock.ExpectExec("CREATE INDEX IF NOT EXISTS user_preferences_user_id_index").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE INDEX IF NOT EXISTS user_preferences_document_index").WillReturnError(errors.New("invalid input syntax for type json"))
+	if err = checkIndexes(db, true); err == nil {
+		t.Error("checkIndexes() didn't return the error creating an index")
+	}
+
+	mock.ExpectQuery("SELECT t.relname, pg_get_indexdef").WillReturnError(errors.New("permission denied"))
+	if err = checkIndexes(db, true); err != nil {
+		t.Errorf("checkIndexes() returned %s when the catalogs couldn't be read", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDatabaseReportRequest(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/db-report", nil, nil); status != http.StatusForbidden {
+		t.Errorf("the database report returned %d without the admin key", status)
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/db-report", nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Fatalf("the database report returned %d: %s", status, body)
+	}
+	var report DatabaseReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tables) != 1 || report.MissingIndexes == nil {
+		t.Errorf("the database report was %s", body)
+	}
+}
+
+func TestMissingIndexesRenamedTables(t *testing.T) {
+	saved := tables
+	defer func() { tables = saved }()
+	tables.Users = "de_users"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT t.relname, pg_get_indexdef").
+		WithArgs(`{"de_users","user_preferences"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"relname", "pg_get_indexdef"}))
+
+	missing, err := missingIndexes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, advisory := range missing {
+		if advisory.Table == "users" {
+			t.Errorf("the index %s was advised for the renamed users table", advisory.Name)
+		}
+	}
+	if len(missing) != len(indexAdvisories)-1 {
+		t.Errorf("%d indexes were missing", len(missing))
+	}
+}
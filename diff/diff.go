@@ -0,0 +1,88 @@
+// Package diff computes structured differences between two preferences
+// documents so that consumers of change events can tell which keys changed
+// without comparing whole documents themselves.
+package diff
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Change describes a value that is present in both documents but differs.
+type Change struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff lists the dotted key paths that were added, removed, or changed between
+// two documents. Nested objects are compared key by key; any other value,
+// including arrays, is compared as a whole.
+type Diff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []Change `json:"changed"`
+}
+
+// Empty returns true if the documents were identical.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Compute returns the difference between the before and after documents. The
+// paths in each list are sorted.
+func Compute(before, after map[string]interface{}) *Diff {
+	d := &Diff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []Change{},
+	}
+	d.compare("", before, after)
+	d.Sort()
+	return d
+}
+
+// Sort sorts the paths in each list.
+func (d *Diff) Sort() {
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Slice(d.Changed, func(i, j int) bool {
+		return d.Changed[i].Path < d.Changed[j].Path
+	})
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func (d *Diff) compare(prefix string, before, after map[string]interface{}) {
+	for key, beforeValue := range before {
+		path := join(prefix, key)
+
+		afterValue, ok := after[key]
+		if !ok {
+			d.Removed = append(d.Removed, path)
+			continue
+		}
+
+		beforeMap, beforeIsMap := beforeValue.(map[string]interface{})
+		afterMap, afterIsMap := afterValue.(map[string]interface{})
+		if beforeIsMap && afterIsMap {
+			d.compare(path, beforeMap, afterMap)
+			continue
+		}
+
+		if !reflect.DeepEqual(beforeValue, afterValue) {
+			d.Changed = append(d.Changed, Change{Path: path, Before: beforeValue, After: afterValue})
+		}
+	}
+
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			d.Added = append(d.Added, join(prefix, key))
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompute(t *testing.T) {
+	before := map[string]interface{}{
+		"theme":   "light",
+		"removed": true,
+		"same":    []interface{}{"a", "b"},
+		"nested": map[string]interface{}{
+			"kept":    1.0,
+			"changed": "old",
+			"gone":    "x",
+		},
+		"replaced": map[string]interface{}{"a": 1.0},
+	}
+	after := map[string]interface{}{
+		"theme": "dark",
+		"added": "new",
+		"same":  []interface{}{"a", "b"},
+		"nested": map[string]interface{}{
+			"kept":    1.0,
+			"changed": "new",
+			"new":     "y",
+		},
+		"replaced": "scalar",
+	}
+
+	expected := &Diff{
+		Added:   []string{"added", "nested.new"},
+		Removed: []string{"nested.gone", "removed"},
+		Changed: []Change{
+			{Path: "nested.changed", Before: "old", After: "new"},
+			{Path: "replaced", Before: map[string]interface{}{"a": 1.0}, After: "scalar"},
+			{Path: "theme", Before: "light", After: "dark"},
+		},
+	}
+
+	actual := Compute(before, after)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Compute() returned %#v instead of %#v", actual, expected)
+	}
+
+	if actual.Empty() {
+		t.Error("Empty() returned true for different documents")
+	}
+}
+
+func TestComputeIdentical(t *testing.T) {
+	doc := map[string]interface{}{
+		"theme":  "light",
+		"nested": map[string]interface{}{"a": 1.0},
+	}
+
+	d := Compute(doc, doc)
+	if !d.Empty() {
+		t.Errorf("Compute() returned %#v for identical documents", d)
+	}
+}
+
+func TestComputeNil(t *testing.T) {
+	d := Compute(nil, map[string]interface{}{"theme": "light"})
+
+	if !reflect.DeepEqual(d.Added, []string{"theme"}) {
+		t.Errorf("added was %#v", d.Added)
+	}
+
+	d = Compute(map[string]interface{}{"theme": "light"}, nil)
+	if !reflect.DeepEqual(d.Removed, []string{"theme"}) {
+		t.Errorf("removed was %#v", d.Removed)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// lbStatusPath is the path load balancers check to decide whether to send
+// the instance traffic.
+const lbStatusPath = "/lb-status"
+
+// Drainer answers load balancer status checks in front of the handler, and
+// starts failing them once the process is told to shut down, so that the load
+// balancer takes the instance out of rotation before its listener closes.
+type Drainer struct {
+	handler  http.Handler
+	draining int32
+}
+
+// NewDrainer returns a newly created *Drainer in front of the handler.
+func NewDrainer(handler http.Handler) *Drainer {
+	return &Drainer{handler: handler}
+}
+
+// Drain makes the status checks fail from now on.
+func (d *Drainer) Drain() {
+	atomic.StoreInt32(&d.draining, 1)
+}
+
+// Draining returns whether the status checks are failing.
+func (d *Drainer) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// ServeHTTP answers status checks and passes every other request to the
+// handler. Requests keep being served while draining, since the load balancer
+// may still send some until it notices.
+func (d *Drainer) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != lbStatusPath {
+		d.handler.ServeHTTP(writer, r)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if d.Draining() {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte(`{"status":"draining"}`))
+		return
+	}
+	writer.Write([]byte(`{"status":"ok"}`))
+}
+
+// Serve runs the server until it receives a signal. On SIGTERM the status
+// checks start failing, and the server keeps serving for the drain delay
+// before it stops accepting connections; other signals skip the delay. The
+// server then waits up to the timeout for the requests in progress to finish.
+func (d *Drainer) Serve(server *http.Server, signals <-chan os.Signal, delay, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	var sig os.Signal
+	select {
+	case err := <-errs:
+		return err
+	case sig = <-signals:
+	}
+
+	d.Drain()
+	if sig == syscall.SIGTERM && delay > 0 {
+		log.Infof("Received %s; draining for %s before shutting down", sig, delay)
+		time.Sleep(delay)
+	}
+	log.Infof("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
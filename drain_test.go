@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDrainerStatus(t *testing.T) {
+	d := NewDrainer(New(NewMockDB()))
+	server := httptest.NewServer(d)
+	defer server.Close()
+
+	if status, body := doRequest(t, http.MethodGet, server.URL+lbStatusPath, nil, nil); status != http.StatusOK || string(body) != `{"status":"ok"}` {
+		t.Errorf("the status check returned %d: %s", status, body)
+	}
+
+	d.Drain()
+	if status, body := doRequest(t, http.MethodGet, server.URL+lbStatusPath, nil, nil); status != http.StatusServiceUnavailable || string(body) != `{"status":"draining"}` {
+		t.Errorf("the status check returned %d while draining: %s", status, body)
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/healthz", nil, nil); status != http.StatusOK {
+		t.Errorf("a request returned %d while draining", status)
+	}
+}
+
+// freeAddr returns a local address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// waitForStatus polls the status check until it's answered.
+func waitForStatus(t *testing.T, url string) int {
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the server never answered %s", url)
+	return 0
+}
+
+func TestDrainerServe(t *testing.T) {
+	for _, tc := range []struct {
+		signal    os.Signal
+		drains    bool
+		minUptime time.Duration
+	}{
+		{syscall.SIGTERM, true, 200 * time.Millisecond},
+		{os.Interrupt, false, 0},
+	} {
+		addr := freeAddr(t)
+		d := NewDrainer(New(NewMockDB()))
+		server := &http.Server{Addr: addr, Handler: d}
+		signals := make(chan os.Signal, 1)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- d.Serve(server, signals, 200*time.Millisecond, time.Second)
+		}()
+
+		url := "http://" + addr + lbStatusPath
+		if status := waitForStatus(t, url); status != http.StatusOK {
+			t.Fatalf("the status check returned %d before the signal", status)
+		}
+
+		sent := time.Now()
+		signals <- tc.signal
+		if tc.drains {
+			time.Sleep(50 * time.Millisecond)
+			if status := waitForStatus(t, url); status != http.StatusServiceUnavailable {
+				t.Errorf("the status check returned %d after %s", status, tc.signal)
+			}
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Serve() returned %s after %s", err, tc.signal)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Serve() didn't return after %s", tc.signal)
+		}
+		if elapsed := time.Since(sent); elapsed < tc.minUptime {
+			t.Errorf("the server shut down %s after %s", elapsed, tc.signal)
+		}
+		if _, err := http.Get(url); err == nil {
+			t.Errorf("the server was still listening after %s", tc.signal)
+		}
+	}
+}
+
+func TestDrainerServeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	d := NewDrainer(http.NotFoundHandler())
+	server := &http.Server{Addr: listener.Addr().String(), Handler: d}
+	if err = d.Serve(server, make(chan os.Signal), time.Second, time.Second); err == nil {
+		t.Error("Serve() didn't return an error when the address was in use")
+	}
+}
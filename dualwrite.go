@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// dualWriteMetrics contains the dual-write counters published at /debug/vars.
+var dualWriteMetrics = expvar.NewMap("dual_write")
+
+// DualWriteDB mirrors the preferences documents from the database the service
+// has been using into a new one while the tables are moved. The old database
+// stays authoritative: every write goes to it first and the resulting document
+// is then copied, version and all, into the new database. Reads prefer the new
+// database and fall back to the old one for documents it doesn't have yet.
+// Everything other than the documents is still read from and written to the
+// old database.
+type DualWriteDB struct {
+	*PrefsDB
+	target *PrefsDB
+}
+
+// NewDualWriteDB returns a DualWriteDB that mirrors the documents in source
+// into target.
+func NewDualWriteDB(source, target *PrefsDB) *DualWriteDB {
+	return &DualWriteDB{PrefsDB: source, target: target}
+}
+
+// dualWriteURI returns the URI of the new database for dual-write mode, with
+// the same statement timeout and schemas as the old one, or "" if dual-write
+// mode isn't enabled.
+func dualWriteURI(cfg *viper.Viper, schema string) (string, error) {
+	targetURI := cfg.GetString("user-preferences.dual-write.uri")
+	if targetURI == "" {
+		return "", nil
+	}
+
+	targetURI, err := withStatementTimeout(targetURI, cfg.GetDuration("user-preferences.timeouts.statement"))
+	if err != nil {
+		return "", err
+	}
+	return withSchemas(cfg, targetURI, schema)
+}
+
+// replacePreferences stores the document in the database for the user with the
+// given version, which is copied from another database. A stored document with
+// a later version is left alone, so that mirrored writes that finish out of
+// order don't go back in time.
+func (p *PrefsDB) replacePreferences(username, prefs string, version int64) error {
+	update := `UPDATE ` + p.onlyPreferences() + `
+                  SET preferences = $2,
+                      encoding = $3,
+                      compressed = $4,
+                      checksum = $5,
+                      version = $6
+                WHERE user_id = $1
+                  AND version <= $6`
+	insert := `INSERT INTO ` + p.tables.Preferences + ` (user_id, preferences, encoding, compressed, checksum, version)
+                    SELECT $1::uuid, $2::text, $3::text, $4::bytea, $5::text, $6::bigint
+                     WHERE NOT EXISTS (SELECT 1 FROM ` + p.tables.Preferences + ` WHERE user_id = $1::uuid)`
+
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+	stored, encoding, compressed, err := p.encodePreferences(prefs)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{userID, stored, encoding, compressed, preferencesChecksum(prefs), version}
+
+	result, err := p.db.Exec(update, args...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	_, err = p.db.Exec(insert, args...)
+	return err
+}
+
+// mirror copies the user's document from the old database into the new one,
+// or deletes it from the new one if the old one doesn't have it. Failures are
+// logged and counted, but writes don't fail because of them, since the old
+// database has already been updated; the reconciliation report finds the
+// documents they leave behind.
+func (d *DualWriteDB) mirror(username string) error {
+	err := func() error {
+		records, err := d.PrefsDB.getPreferences(username)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return d.target.deletePreferences(username)
+		}
+		return d.target.replacePreferences(username, records[0].Preferences, records[0].Version)
+	}()
+	if err != nil {
+		dualWriteMetrics.Add("mirror_failures", 1)
+		log.Errorf("Error mirroring the preferences of user %s to the new database: %s", username, err)
+	}
+	return err
+}
+
+// getPreferences reads the user's document from the new database, falling back
+// to the old one if the new one doesn't have it or can't be read.
+func (d *DualWriteDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+	records, err := d.target.getPreferences(username)
+	if err == nil && len(records) > 0 {
+		return records, nil
+	}
+	if err != nil {
+		log.Errorf("Error reading the preferences of user %s from the new database: %s", username, err)
+	}
+	dualWriteMetrics.Add("fallback_reads", 1)
+	return d.PrefsDB.getPreferences(username)
+}
+
+func (d *DualWriteDB) insertPreferences(username, prefs string) error {
+	if err := d.PrefsDB.insertPreferences(username, prefs); err != nil {
+		return err
+	}
+	d.mirror(username)
+	return nil
+}
+
+func (d *DualWriteDB) updatePreferences(username, prefs string) error {
+	if err := d.PrefsDB.updatePreferences(username, prefs); err != nil {
+		return err
+	}
+	d.mirror(username)
+	return nil
+}
+
+func (d *DualWriteDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	updated, err := d.PrefsDB.updatePreferencesIfVersion(username, prefs, version)
+	if err == nil && updated {
+		d.mirror(username)
+	}
+	return updated, err
+}
+
+func (d *DualWriteDB) deletePreferences(username string) error {
+	if err := d.PrefsDB.deletePreferences(username); err != nil {
+		return err
+	}
+	d.mirror(username)
+	return nil
+}
+
+func (d *DualWriteDB) upsertPreferences(prefs map[string]string) (map[string]bool, error) {
+	created, err := d.PrefsDB.upsertPreferences(prefs)
+	if err != nil {
+		return nil, err
+	}
+	for username := range prefs {
+		d.mirror(username)
+	}
+	return created, nil
+}
+
+// eraseUser erases the user from the old database and then deletes their
+// document from the new one.
+func (d *DualWriteDB) eraseUser(username string) (map[string]int64, error) {
+	deleted, err := d.PrefsDB.eraseUser(username)
+	if err != nil {
+		return nil, err
+	}
+	d.mirror(username)
+	return deleted, nil
+}
+
+// deleteKeyBatch deletes the key path from a batch of documents in both
+// databases. While they're in sync, the same documents are chosen in each.
+func (d *DualWriteDB) deleteKeyBatch(path string, limit int) (int64, error) {
+	updated, err := d.PrefsDB.deleteKeyBatch(path, limit)
+	if err != nil {
+		return updated, err
+	}
+	if _, err := d.target.deleteKeyBatch(path, limit); err != nil {
+		dualWriteMetrics.Add("mirror_failures", 1)
+		log.Errorf("Error deleting %s from the documents in the new database: %s", path, err)
+	}
+	return updated, nil
+}
+
+// renameKeyBatch renames the key path in a batch of documents in both
+// databases.
+func (d *DualWriteDB) renameKeyBatch(from, to string, limit int) (int64, error) {
+	updated, err := d.PrefsDB.renameKeyBatch(from, to, limit)
+	if err != nil {
+		return updated, err
+	}
+	if _, err := d.target.renameKeyBatch(from, to, limit); err != nil {
+		dualWriteMetrics.Add("mirror_failures", 1)
+		log.Errorf("Error renaming %s to %s in the documents in the new database: %s", from, to, err)
+	}
+	return updated, nil
+}
+
+// documentVersion identifies the contents of a stored document.
+type documentVersion struct {
+	Version  int64
+	Checksum sql.NullString
+}
+
+// documentVersions returns the version and checksum of each user's document.
+func (p *PrefsDB) documentVersions() (map[string]documentVersion, error) {
+	query := `SELECT u.username,
+                     p.version,
+                     p.checksum
+                FROM ` + p.tables.Preferences + ` p,
+                     ` + p.tables.usersSource() + ` u
+               WHERE p.user_id = u.id`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]documentVersion)
+	for rows.Next() {
+		var (
+			username string
+			version  documentVersion
+		)
+		if err = rows.Scan(&username, &version.Version, &version.Checksum); err != nil {
+			return nil, err
+		}
+		versions[username] = version
+	}
+
+	return versions, rows.Err()
+}
+
+// DualWriteReport compares the documents in the old and new databases.
+// Missing lists the users whose documents are only in the old database, Extra
+// the ones only in the new database, and Mismatched the ones whose versions or
+// checksums differ. Repaired counts the documents that were copied again.
+type DualWriteReport struct {
+	Checked    int      `json:"checked"`
+	Missing    []string `json:"missing"`
+	Extra      []string `json:"extra"`
+	Mismatched []string `json:"mismatched"`
+	Repaired   int      `json:"repaired"`
+}
+
+// reconcile compares the documents in the two databases and, if repair is
+// set, mirrors each of the documents that differ again.
+func (d *DualWriteDB) reconcile(repair bool) (*DualWriteReport, error) {
+	source, err := d.PrefsDB.documentVersions()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the old database: %s", err)
+	}
+	target, err := d.target.documentVersions()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the new database: %s", err)
+	}
+
+	report := &DualWriteReport{Missing: []string{}, Extra: []string{}, Mismatched: []string{}}
+	for username, expected := range source {
+		report.Checked++
+		actual, ok := target[username]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, username)
+		case actual.Version != expected.Version,
+			actual.Checksum.Valid && expected.Checksum.Valid && actual.Checksum.String != expected.Checksum.String:
+			report.Mismatched = append(report.Mismatched, username)
+		}
+	}
+	for username := range target {
+		if _, ok := source[username]; !ok {
+			report.Extra = append(report.Extra, username)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Mismatched)
+
+	if repair {
+		for _, usernames := range [][]string{report.Missing, report.Extra, report.Mismatched} {
+			for _, username := range usernames {
+				if d.mirror(username) == nil {
+					report.Repaired++
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// DualWriteRequest handles comparing the documents in the old and new
+// databases. A POST also copies the documents that differ from the old
+// database into the new one.
+func (u *UserPreferencesApp) DualWriteRequest(writer http.ResponseWriter, r *http.Request) {
+	if u.dualWrite == nil {
+		notFound(writer, "Dual-write mode is not enabled")
+		return
+	}
+
+	repair := r.Method == http.MethodPost
+	report, err := u.dualWrite.reconcile(repair)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error reconciling the databases: %s", err))
+		return
+	}
+	if repair {
+		u.audit("repair-dual-write", map[string]string{"repaired": fmt.Sprint(report.Repaired)})
+	}
+
+	jsoned, err := json.Marshal(report)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating reconciliation JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// newDualWriteMocks returns a DualWriteDB backed by two mocked databases.
+func newDualWriteMocks(t *testing.T) (*DualWriteDB, sqlmock.Sqlmock, sqlmock.Sqlmock, func()) {
+	sourceDB, source, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	targetDB, target, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	closeAll := func() {
+		sourceDB.Close()
+		targetDB.Close()
+	}
+	return NewDualWriteDB(NewPrefsDB(sourceDB), NewPrefsDB(targetDB)), source, target, closeAll
+}
+
+var preferencesColumns = []string{"id", "user_id", "preferences", "encoding", "compressed", "checksum", "created_at", "modified_at", "version"}
+
+func TestDualWriteReads(t *testing.T) {
+	d, source, target, closeAll := newDualWriteMocks(t)
+	defer closeAll()
+
+	now := time.Now()
+	target.ExpectQuery("SELECT p.id AS id").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(preferencesColumns).AddRow("t1", "u1", `{"new":true}`, "identity", nil, nil, now, now, 4))
+	target.ExpectQuery("SELECT p.id AS id").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows(preferencesColumns))
+	source.ExpectQuery("SELECT p.id AS id").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows(preferencesColumns).AddRow("s2", "u2", `{"old":true}`, "identity", nil, nil, now, now, 2))
+
+	records, err := d.getPreferences("alice")
+	if err != nil || len(records) != 1 || records[0].Preferences != `{"new":true}` {
+		t.Errorf("reading a mirrored document returned %+v, %v", records, err)
+	}
+
+	records, err = d.getPreferences("bob")
+	if err != nil || len(records) != 1 || records[0].Preferences != `{"old":true}` || records[0].Version != 2 {
+		t.Errorf("reading an unmirrored document returned %+v, %v", records, err)
+	}
+
+	for _, mock := range []sqlmock.Sqlmock{source, target} {
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expectations were not met: %s", err)
+		}
+	}
+}
+
+func TestDualWriteMirrorsWrites(t *testing.T) {
+	d, source, target, closeAll := newDualWriteMocks(t)
+	defer closeAll()
+
+	now := time.Now()
+	source.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	source.ExpectExec("UPDATE ONLY user_preferences SET (.+) version = version \\+ 1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	source.ExpectQuery("SELECT p.id AS id").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(preferencesColumns).AddRow("s1", "u1", `{"a":1}`, "identity", nil, preferencesChecksum(`{"a":1}`), now, now, 5))
+
+	target.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	target.ExpectExec("UPDATE ONLY user_preferences SET (.+) version = \\$6 WHERE user_id = \\$1 AND version <= \\$6").
+		WithArgs("u1", `{"a":1}`, "identity", []byte(nil), preferencesChecksum(`{"a":1}`), 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	target.ExpectExec("INSERT INTO user_preferences (.+) WHERE NOT EXISTS").
+		WithArgs("u1", `{"a":1}`, "identity", []byte(nil), preferencesChecksum(`{"a":1}`), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := d.updatePreferences("alice", `{"a":1}`); err != nil {
+		t.Fatalf("error from updatePreferences(): %s", err)
+	}
+
+	for _, mock := range []sqlmock.Sqlmock{source, target} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expectations were not met: %s", err)
+		}
+	}
+}
+
+func TestDualWriteMirrorFailure(t *testing.T) {
+	d, source, target, closeAll := newDualWriteMocks(t)
+	defer closeAll()
+
+	source.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	source.ExpectExec("DELETE FROM ONLY user_preferences").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	source.ExpectQuery("SELECT p.id AS id").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(preferencesColumns))
+	target.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("alice").
+		WillReturnError(sql.ErrConnDone)
+
+	failures := func() int64 {
+		if v, ok := dualWriteMetrics.Get("mirror_failures").(interface{ Value() int64 }); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := failures()
+
+	if err := d.deletePreferences("alice"); err != nil {
+		t.Errorf("a failure to mirror a delete failed it: %s", err)
+	}
+	if failures() != before+1 {
+		t.Errorf("the mirror failures went from %d to %d", before, failures())
+	}
+
+	for _, mock := range []sqlmock.Sqlmock{source, target} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expectations were not met: %s", err)
+		}
+	}
+}
+
+func TestDualWriteReconcile(t *testing.T) {
+	d, source, target, closeAll := newDualWriteMocks(t)
+	defer closeAll()
+
+	columns := []string{"username", "version", "checksum"}
+	source.ExpectQuery("SELECT u.username, p.version, p.checksum FROM user_preferences p, users u").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("alice", 2, "a").
+			AddRow("bob", 1, "b").
+			AddRow("dave", 3, "d").
+			AddRow("erin", 1, nil))
+	target.ExpectQuery("SELECT u.username, p.version, p.checksum FROM user_preferences p, users u").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("alice", 2, "a").
+			AddRow("carol", 1, "c").
+			AddRow("dave", 3, "x").
+			AddRow("erin", 1, "e"))
+
+	report, err := d.reconcile(false)
+	if err != nil {
+		t.Fatalf("error from reconcile(): %s", err)
+	}
+	expected := &DualWriteReport{
+		Checked:    4,
+		Missing:    []string{"bob"},
+		Extra:      []string{"carol"},
+		Mismatched: []string{"dave"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("the report was %+v", report)
+	}
+
+	for _, mock := range []sqlmock.Sqlmock{source, target} {
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expectations were not met: %s", err)
+		}
+	}
+}
+
+func TestDualWriteRequest(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	admin := map[string]string{adminKeyHeader: "secret"}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/dual-write", nil, admin); status != http.StatusNotFound {
+		t.Errorf("the reconciliation report returned %d while dual-write mode was disabled", status)
+	}
+
+	d, source, target, closeAll := newDualWriteMocks(t)
+	defer closeAll()
+	n.dualWrite = d
+
+	columns := []string{"username", "version", "checksum"}
+	source.ExpectQuery("SELECT u.username").WillReturnRows(sqlmock.NewRows(columns).AddRow("alice", 1, "a"))
+	target.ExpectQuery("SELECT u.username").WillReturnRows(sqlmock.NewRows(columns))
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/dual-write", nil, admin)
+	if status != http.StatusOK {
+		t.Fatalf("the reconciliation report returned %d: %s", status, body)
+	}
+
+	var report DualWriteReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || !reflect.DeepEqual(report.Missing, []string{"alice"}) || report.Repaired != 0 {
+		t.Errorf("the report was %s", body)
+	}
+}
+
+func TestDualWriteURI(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  timeouts:\n    statement: 0s\n")
+	if uri, err := dualWriteURI(cfg, "tenant"); err != nil || uri != "" {
+		t.Errorf("dualWriteURI() returned %q, %v without a URI", uri, err)
+	}
+
+	cfg = testConfig(t, "user-preferences:\n  dual-write:\n    uri: postgres://new/de\n  timeouts:\n    statement: 5s\n")
+	uri, err := dualWriteURI(cfg, "tenant")
+	if err != nil || uri != "postgres://new/de?search_path=tenant&statement_timeout=5000" {
+		t.Errorf("dualWriteURI() returned %q, %v", uri, err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// preferencesExistsHeader tells clients whether the user has stored
+// preferences, since a user without any gets an empty document.
+const preferencesExistsHeader = "X-Preferences-Exists"
+
+// checkPreferencesExist sets the X-Preferences-Exists header for the record
+// read for the user. If the user has no stored preferences and the service is
+// configured to treat that as missing, a 404 is written and false is returned.
+func (u *UserPreferencesApp) checkPreferencesExist(writer http.ResponseWriter, username string, record UserPreferencesRecord) bool {
+	exists := record.ID != ""
+	writer.Header().Set(preferencesExistsHeader, strconv.FormatBool(exists))
+
+	if !exists && u.emptyNotFound {
+		notFound(writer, fmt.Sprintf("User %s has no stored preferences", username))
+		return false
+	}
+	return true
+}
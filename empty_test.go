@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEmptyPreferences(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.users["other-user"] = true
+	if err := mock.insertPreferences("other-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	n := New(mock)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "{}" {
+		t.Errorf("GET of empty preferences returned %d '%s'", resp.StatusCode, body)
+	}
+	if exists := resp.Header.Get(preferencesExistsHeader); exists != "false" {
+		t.Errorf("GET of empty preferences returned %s %s", preferencesExistsHeader, exists)
+	}
+
+	status, raw := doRequest(t, http.MethodGet, server.URL+"/test-user?include-meta=true", nil, nil)
+	var wrapped map[string]interface{}
+	if err = json.Unmarshal(raw, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if prefs, ok := wrapped["preferences"].(map[string]interface{}); status != http.StatusOK || !ok || len(prefs) != 0 {
+		t.Errorf("GET of empty wrapped preferences returned %d '%s'", status, raw)
+	}
+
+	resp, err = http.Get(server.URL + "/other-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if exists := resp.Header.Get(preferencesExistsHeader); exists != "true" {
+		t.Errorf("GET of stored preferences returned %s %s", preferencesExistsHeader, exists)
+	}
+
+	if err = configureApp(n, testConfig(t, "user-preferences:\n  empty:\n    not-found: true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if status, raw = doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil); status != http.StatusNotFound {
+		t.Errorf("GET of empty preferences configured to 404 returned %d '%s'", status, raw)
+	}
+	if status, raw = doRequest(t, http.MethodGet, server.URL+"/other-user", nil, nil); status != http.StatusOK {
+		t.Errorf("GET of stored preferences configured to 404 returned %d '%s'", status, raw)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// systemKey is the top-level key of the object in each preferences document
+// that holds metadata managed by the service rather than the user.
+const systemKey = "_system"
+
+// experimentsPath is the key path of the user's experiment assignments, which
+// map experiment names to variants.
+const experimentsPath = systemKey + ".experiments"
+
+// Variant is one arm of an experiment. Users are split between the variants
+// in proportion to their weights.
+type Variant struct {
+	Name   string
+	Weight float64
+}
+
+// Experiment is an A/B experiment. Allocation is the percentage of users that
+// are enrolled in it; the rest aren't assigned a variant.
+type Experiment struct {
+	Name       string
+	Allocation float64
+	Variants   []Variant
+}
+
+// NewExperiments returns the experiments described by the config document,
+// which maps experiment names to settings. Each settings map needs a variants
+// map from variant names to weights and may have an allocation, which defaults
+// to 100.
+func NewExperiments(config map[string]interface{}) ([]Experiment, error) {
+	var names []string
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var experiments []Experiment
+	for _, name := range names {
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("Invalid experiment name %q", name)
+		}
+
+		settings, ok := config[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The settings for experiment %s must be a map", name)
+		}
+
+		experiment := Experiment{Name: name, Allocation: 100}
+		if allocation, ok := settings["allocation"]; ok {
+			if experiment.Allocation, ok = toFloat(allocation); !ok || experiment.Allocation < 0 || experiment.Allocation > 100 {
+				return nil, fmt.Errorf("The allocation for experiment %s must be a number between 0 and 100", name)
+			}
+		}
+
+		variants, _ := settings["variants"].(map[string]interface{})
+		if len(variants) == 0 {
+			return nil, fmt.Errorf("Experiment %s needs at least one variant", name)
+		}
+		for variant, value := range variants {
+			weight, ok := toFloat(value)
+			if !ok || weight <= 0 {
+				return nil, fmt.Errorf("The weight of variant %s of experiment %s must be a positive number", variant, name)
+			}
+			experiment.Variants = append(experiment.Variants, Variant{Name: variant, Weight: weight})
+		}
+		sort.Slice(experiment.Variants, func(i, j int) bool {
+			return experiment.Variants[i].Name < experiment.Variants[j].Name
+		})
+
+		experiments = append(experiments, experiment)
+	}
+
+	return experiments, nil
+}
+
+// toFloat returns a numeric configuration value as a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// assign returns the variant of the experiment the user is assigned to, and
+// false if the user isn't enrolled. Enrollment is decided the same way as the
+// cohort of a rollout, and the variant by a separate hash of the username, so
+// both are stable across requests and instances.
+func (e *Experiment) assign(username string) (string, bool) {
+	if !inRollout(e.Name, username, e.Allocation) {
+		return "", false
+	}
+
+	var total float64
+	for _, variant := range e.Variants {
+		total += variant.Weight
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":variant:" + username))
+	point := float64(h.Sum32()%rolloutBuckets) / rolloutBuckets * total
+	for _, variant := range e.Variants {
+		if point < variant.Weight {
+			return variant.Name, true
+		}
+		point -= variant.Weight
+	}
+	return e.Variants[len(e.Variants)-1].Name, true
+}
+
+// listExperimentAssignments returns the variants the user has been assigned
+// to, keyed by experiment name.
+func (p *PrefsDB) listExperimentAssignments(username string) (map[string]string, error) {
+	query := `SELECT e.experiment, e.variant
+              FROM user_preferences_experiments e,
+                   ` + p.tables.usersSource() + ` u
+             WHERE e.user_id = u.id
+               AND u.username = $1`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assigned := make(map[string]string)
+	for rows.Next() {
+		var experiment, variant string
+		if err = rows.Scan(&experiment, &variant); err != nil {
+			return nil, err
+		}
+		assigned[experiment] = variant
+	}
+
+	return assigned, rows.Err()
+}
+
+// addExperimentAssignment assigns the user to the variant of the experiment,
+// unless they've already been assigned to one.
+func (p *PrefsDB) addExperimentAssignment(username, experiment, variant string) error {
+	query := `INSERT INTO user_preferences_experiments (user_id, experiment, variant)
+                   SELECT u.id, $2, $3 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $1
+              ON CONFLICT (user_id, experiment) DO NOTHING`
+
+	_, err := p.db.Exec(query, username, experiment, variant)
+	return err
+}
+
+// assignExperiments returns the user's variant of each experiment they're
+// enrolled in. Users are assigned to the experiments they haven't seen yet the
+// first time their preferences are read, and the assignments are stored so
+// that they stick even if the experiments' settings change later. They're
+// stored in a table of their own rather than in the user's preferences, so
+// reading the preferences never writes them. Assignments that were saved in
+// the preferences before that are kept.
+func (u *UserPreferencesApp) assignExperiments(username string) (map[string]string, error) {
+	if len(u.experiments) == 0 {
+		return make(map[string]string), nil
+	}
+
+	assigned, err := u.prefs.listExperimentAssignments(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	changed := false
+	for i := range u.experiments {
+		experiment := &u.experiments[i]
+		if _, ok := assigned[experiment.Name]; ok {
+			continue
+		}
+
+		if values == nil {
+			if values, err = u.loadPreferences(username); err != nil {
+				return nil, err
+			}
+		}
+
+		variant, ok := getPath(values, experimentsPath+"."+experiment.Name)
+		name, saved := variant.(string)
+		if !ok || !saved {
+			var enrolled bool
+			if name, enrolled = experiment.assign(username); !enrolled {
+				continue
+			}
+		}
+
+		if err = u.prefs.addExperimentAssignment(username, experiment.Name, name); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+
+	// Another request may have assigned the user first, in which case its
+	// assignments are the ones that were kept.
+	if changed {
+		if assigned, err = u.prefs.listExperimentAssignments(username); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range assigned {
+		if !u.hasExperiment(name) {
+			delete(assigned, name)
+		}
+	}
+	return assigned, nil
+}
+
+// hasExperiment returns whether the named experiment is configured.
+func (u *UserPreferencesApp) hasExperiment(name string) bool {
+	for i := range u.experiments {
+		if u.experiments[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyExperiments adds the user's experiment assignments to the response
+// under _system.experiments, assigning them first if necessary. The response
+// is returned, since a new one is created if it's nil.
+func (u *UserPreferencesApp) applyExperiments(username string, response map[string]interface{}, wrap bool) (map[string]interface{}, error) {
+	if len(u.experiments) == 0 {
+		return response, nil
+	}
+
+	assigned, err := u.assignExperiments(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error assigning experiments for user %s: %s", username, err)
+	}
+	if len(assigned) == 0 {
+		return response, nil
+	}
+
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+	values := response
+	if wrap {
+		var ok bool
+		if values, ok = response["preferences"].(map[string]interface{}); !ok {
+			values = make(map[string]interface{})
+			response["preferences"] = values
+		}
+	}
+
+	for name, variant := range assigned {
+		setPath(values, experimentsPath+"."+name, variant)
+	}
+	return response, nil
+}
+
+// withoutAssignments returns a copy of a document that's about to be stored
+// without the experiment assignments that applyExperiments adds to responses,
+// so that clients writing back what they read aren't rejected for changing the
+// reserved keys. The _system object is removed too if that leaves it empty.
+func (u *UserPreferencesApp) withoutAssignments(values map[string]interface{}) map[string]interface{} {
+	if len(u.experiments) == 0 {
+		return values
+	}
+	if _, ok := getPath(values, experimentsPath); !ok {
+		return values
+	}
+
+	result := deepCopy(values).(map[string]interface{})
+	deletePath(result, experimentsPath)
+	if system, ok := result[systemKey].(map[string]interface{}); ok && len(system) == 0 {
+		delete(result, systemKey)
+	}
+	return result
+}
+
+// ExperimentsRequest handles getting the variants of the experiments the user
+// is enrolled in, assigning them first if necessary.
+func (u *UserPreferencesApp) ExperimentsRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	assigned, err := u.assignExperiments(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error assigning experiments for user %s: %s", username, err))
+		return
+	}
+
+	jsoned, err := json.Marshal(map[string]map[string]string{"experiments": assigned})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating experiments JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewExperiments(t *testing.T) {
+	cfg := testConfig(t, `
+user-preferences:
+  experiments:
+    new-editor:
+      allocation: 20
+      variants:
+        treatment: 1
+        control: 3
+    search:
+      variants:
+        classic: 1
+`)
+
+	config, err := configDocument(cfg, "user-preferences.experiments")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	experiments, err := NewExperiments(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Experiment{
+		{Name: "new-editor", Allocation: 20, Variants: []Variant{{"control", 3}, {"treatment", 1}}},
+		{Name: "search", Allocation: 100, Variants: []Variant{{"classic", 1}}},
+	}
+	if !reflect.DeepEqual(experiments, expected) {
+		t.Errorf("the experiments were %#v", experiments)
+	}
+}
+
+func TestNewExperimentsInvalid(t *testing.T) {
+	configs := []map[string]interface{}{
+		{"a": "not a map"},
+		{"a.b": map[string]interface{}{"variants": map[string]interface{}{"x": 1}}},
+		{"a": map[string]interface{}{}},
+		{"a": map[string]interface{}{"variants": map[string]interface{}{"x": 0}}},
+		{"a": map[string]interface{}{"variants": map[string]interface{}{"x": "heavy"}}},
+		{"a": map[string]interface{}{"allocation": 150, "variants": map[string]interface{}{"x": 1}}},
+	}
+	for _, config := range configs {
+		if _, err := NewExperiments(config); err == nil {
+			t.Errorf("%#v was accepted", config)
+		}
+	}
+}
+
+func TestExperimentAssign(t *testing.T) {
+	experiment := &Experiment{Name: "new-editor", Allocation: 50, Variants: []Variant{{"control", 3}, {"treatment", 1}}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		username := fmt.Sprintf("user%d", i)
+		variant, enrolled := experiment.assign(username)
+		if again, _ := experiment.assign(username); again != variant {
+			t.Fatalf("%s was assigned %s and then %s", username, variant, again)
+		}
+		if !enrolled {
+			variant = ""
+		}
+		counts[variant]++
+	}
+
+	if counts[""] < 1800 || counts[""] > 2200 {
+		t.Errorf("%d of 4000 users weren't enrolled", counts[""])
+	}
+	if counts["control"] < 3*counts["treatment"]*8/10 || counts["control"] > 3*counts["treatment"]*12/10 {
+		t.Errorf("the variants were split %v", counts)
+	}
+}
+
+func TestExperimentsRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	n := New(mock)
+	n.experiments = []Experiment{
+		{Name: "new-editor", Allocation: 100, Variants: []Variant{{"treatment", 1}}},
+		{Name: "search", Allocation: 0, Variants: []Variant{{"classic", 1}}},
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/test-user/experiments", nil, nil)
+	if status != http.StatusOK || string(body) != `{"experiments":{"new-editor":"treatment"}}` {
+		t.Errorf("getting the experiments returned %d: %s", status, body)
+	}
+
+	// The assignment sticks even if the experiment changes.
+	n.experiments[0].Variants = []Variant{{"control", 1}}
+	status, body = doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	var prefs map[string]interface{}
+	if err := json.Unmarshal(body, &prefs); err != nil || status != http.StatusOK {
+		t.Fatalf("getting the preferences returned %d: %s", status, body)
+	}
+	expected := map[string]interface{}{
+		"theme":   "dark",
+		systemKey: map[string]interface{}{"experiments": map[string]interface{}{"new-editor": "treatment"}},
+	}
+	if !reflect.DeepEqual(prefs, expected) {
+		t.Errorf("the preferences were %v", prefs)
+	}
+	if version := mock.storage["test-user"]["version"].(int64); version != 1 || len(mock.events) != 1 {
+		t.Errorf("assigning the experiments wrote the preferences: version %d, %d events", version, len(mock.events))
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/nobody/experiments", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("getting the experiments of a missing user returned %d", status)
+	}
+}
+
+func TestExperimentsSavedInPreferences(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"_system":{"experiments":{"new-editor":"control"}},"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	n := New(mock)
+	n.reserved = NewReservedKeys(systemKey)
+	n.experiments = []Experiment{
+		{Name: "new-editor", Allocation: 100, Variants: []Variant{{"treatment", 1}}},
+		{Name: "search", Allocation: 100, Variants: []Variant{{"classic", 1}}},
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/test-user/experiments", nil, nil)
+	if status != http.StatusOK || string(body) != `{"experiments":{"new-editor":"control","search":"classic"}}` {
+		t.Errorf("getting the experiments returned %d: %s", status, body)
+	}
+	if !reflect.DeepEqual(mock.assigned["test-user"], map[string]string{"new-editor": "control", "search": "classic"}) {
+		t.Errorf("the stored assignments were %v", mock.assigned["test-user"])
+	}
+
+	// The preferences as they were read can be written back, but only the
+	// variants saved in them before stay there.
+	_, body = doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if status, body = doRequest(t, http.MethodPut, server.URL+"/test-user", body, nil); status != http.StatusOK {
+		t.Fatalf("writing back the preferences returned %d: %s", status, body)
+	}
+	if stored := mock.storage["test-user"]["user-prefs"]; stored != `{"_system":{"experiments":{"new-editor":"control"}},"theme":"dark"}` {
+		t.Errorf("the stored preferences were %s", stored)
+	}
+}
+
+func TestWithoutAssignments(t *testing.T) {
+	n := New(NewMockDB())
+	n.experiments = []Experiment{{Name: "new-editor", Allocation: 100, Variants: []Variant{{"treatment", 1}}}}
+
+	values := map[string]interface{}{
+		"theme":   "dark",
+		systemKey: map[string]interface{}{"experiments": map[string]interface{}{"new-editor": "treatment"}},
+	}
+	if stripped := n.withoutAssignments(values); !reflect.DeepEqual(stripped, map[string]interface{}{"theme": "dark"}) {
+		t.Errorf("the document without assignments was %v", stripped)
+	}
+	if _, ok := values[systemKey]; !ok {
+		t.Error("the original document was changed")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// expiresHeader is the request header used to set expiration times for keys in
+// a preferences write. The value is a comma-separated list of key=expiration
+// pairs, where the key may be a dotted path and the expiration is either an
+// RFC 3339 timestamp or a duration relative to the time of the request.
+const expiresHeader = "X-Preferences-Expires"
+
+// expiresKey is the key in a wrapped request body that may contain a map of
+// key paths to expiration times, in the same formats accepted by the header.
+const expiresKey = "expires"
+
+// ExpiredKey identifies a single expired key in a user's preferences.
+type ExpiredKey struct {
+	Username string
+	Key      string
+}
+
+// getExpirations returns the expiration times of the user's expiring keys.
+func (p *PrefsDB) getExpirations(username string) (map[string]time.Time, error) {
+	query := `SELECT e.key,
+                   e.expires_at
+              FROM user_preferences_expirations e,
+                   ` + p.tables.usersSource() + ` u
+             WHERE e.user_id = u.id
+               AND u.username = $1`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expirations := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			key       string
+			expiresAt time.Time
+		)
+		if err := rows.Scan(&key, &expiresAt); err != nil {
+			return nil, err
+		}
+		expirations[key] = expiresAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return expirations, err
+	}
+
+	return expirations, nil
+}
+
+// setExpirations creates or replaces the expiration times for the given keys
+// in the user's preferences.
+func (p *PrefsDB) setExpirations(username string, expirations map[string]time.Time) error {
+	query := `INSERT INTO user_preferences_expirations (user_id, key, expires_at)
+                   VALUES ($1, $2, $3)
+              ON CONFLICT (user_id, key) DO UPDATE
+                      SET expires_at = EXCLUDED.expires_at`
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for key, expiresAt := range expirations {
+		if _, err = tx.Exec(query, userID, key, expiresAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deleteExpirations removes the expiration times for the given keys in the
+// user's preferences. All of the user's expiration times are removed if keys is
+// empty.
+func (p *PrefsDB) deleteExpirations(username string, keys []string) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		query := `DELETE FROM user_preferences_expirations WHERE user_id = $1`
+		_, err = p.db.Exec(query, userID)
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM user_preferences_expirations WHERE user_id = $1 AND key = $2`
+	for _, key := range keys {
+		if _, err = tx.Exec(query, userID, key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deleteExpiredKeys removes the expiration times for the given keys in the
+// user's preferences that expired before the given time. Expiration times that
+// were pushed back in the meantime are kept.
+func (p *PrefsDB) deleteExpiredKeys(username string, keys []string, before time.Time) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM user_preferences_expirations
+                    WHERE user_id = $1
+                      AND key = $2
+                      AND expires_at <= $3`
+	for _, key := range keys {
+		if _, err = tx.Exec(query, userID, key, before); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// listExpired returns all of the keys that expired before the given time.
+func (p *PrefsDB) listExpired(before time.Time) ([]ExpiredKey, error) {
+	query := `SELECT u.username,
+                   e.key
+              FROM user_preferences_expirations e,
+                   ` + p.tables.usersSource() + ` u
+             WHERE e.user_id = u.id
+               AND e.expires_at <= $1
+          ORDER BY u.username, e.key`
+
+	rows, err := p.db.Query(query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []ExpiredKey
+	for rows.Next() {
+		var key ExpiredKey
+		if err := rows.Scan(&key.Username, &key.Key); err != nil {
+			return nil, err
+		}
+		expired = append(expired, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return expired, err
+	}
+
+	return expired, nil
+}
+
+// parseExpiration parses an expiration given either as an RFC 3339 timestamp
+// or as a duration relative to now.
+func parseExpiration(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if expiresAt, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiresAt, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Expiration %s is neither an RFC 3339 timestamp nor a duration", value)
+	}
+
+	return now.Add(duration), nil
+}
+
+// requestExpirations collects the key expirations from the request's
+// expiration header and the expires key of a wrapped body. The expires key is
+// removed from the body so that it doesn't get stored.
+func requestExpirations(r *http.Request, body map[string]interface{}, now time.Time) (map[string]time.Time, error) {
+	expirations := make(map[string]time.Time)
+
+	for _, pair := range strings.Split(r.Header.Get(expiresHeader), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid %s entry: %s", expiresHeader, pair)
+		}
+
+		expiresAt, err := parseExpiration(parts[1], now)
+		if err != nil {
+			return nil, err
+		}
+		expirations[strings.TrimSpace(parts[0])] = expiresAt
+	}
+
+	if _, wrapped := body["preferences"]; !wrapped {
+		return expirations, nil
+	}
+
+	envelope, ok := body[expiresKey]
+	if !ok {
+		return expirations, nil
+	}
+	delete(body, expiresKey)
+
+	entries, ok := envelope.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The %s field must be an object", expiresKey)
+	}
+
+	for key, value := range entries {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("The expiration for %s must be a string", key)
+		}
+
+		expiresAt, err := parseExpiration(str, now)
+		if err != nil {
+			return nil, err
+		}
+		expirations[key] = expiresAt
+	}
+
+	return expirations, nil
+}
+
+// overwritesPath returns whether merging the patch into a document replaces or
+// removes the value at the dotted key path, either by writing the path itself or
+// by writing something other than an object at one of its parents.
+func overwritesPath(patch map[string]interface{}, path string) bool {
+	current := patch
+	for _, part := range splitPath(path) {
+		value, ok := current[part]
+		if !ok {
+			return false
+		}
+		next, ok := value.(map[string]interface{})
+		if !ok {
+			return true
+		}
+		current = next
+	}
+	return true
+}
+
+// storeExpirations sets the key expirations from a write of the unwrapped
+// patch, which left the unwrapped document stored, and removes the expirations
+// of the keys that were written without one. A replacement writes every key, so
+// it only keeps the expirations it sets. A merge also removes the expirations
+// of the keys that are no longer stored.
+func (u *UserPreferencesApp) storeExpirations(username string, patch, stored map[string]interface{}, merge bool, expirations map[string]time.Time) error {
+	existing, err := u.prefs.getExpirations(username)
+	if err != nil {
+		return fmt.Errorf("Error getting key expirations for user %s: %s", username, err)
+	}
+
+	var cleared []string
+	for key := range existing {
+		if _, ok := expirations[key]; ok {
+			continue
+		}
+		if _, kept := getPath(stored, key); merge && kept && !overwritesPath(patch, key) {
+			continue
+		}
+		cleared = append(cleared, key)
+	}
+	sort.Strings(cleared)
+
+	if len(cleared) > 0 {
+		if err = u.prefs.deleteExpirations(username, cleared); err != nil {
+			return fmt.Errorf("Error deleting key expirations for user %s: %s", username, err)
+		}
+	}
+
+	if len(expirations) > 0 {
+		if err = u.prefs.setExpirations(username, expirations); err != nil {
+			return fmt.Errorf("Error setting key expirations for user %s: %s", username, err)
+		}
+	}
+	return nil
+}
+
+// stripExpired removes the user's expired keys from the unwrapped preferences
+// document in place.
+func (u *UserPreferencesApp) stripExpired(username string, values map[string]interface{}, now time.Time) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	expirations, err := u.prefs.getExpirations(username)
+	if err != nil {
+		return fmt.Errorf("Error getting key expirations for user %s: %s", username, err)
+	}
+
+	for key, expiresAt := range expirations {
+		if !expiresAt.After(now) {
+			deletePath(values, key)
+		}
+	}
+
+	return nil
+}
+
+// purgeExpired permanently removes expired keys from the stored preferences
+// documents and returns the number of keys that were purged. A document is only
+// stored if it hasn't changed since it was read, and only the expirations that
+// are still past are removed, so the purge can't undo a concurrent write. The
+// keys of a document that changed are purged on the next run instead.
+func (u *UserPreferencesApp) purgeExpired(now time.Time) (int, error) {
+	expired, err := u.prefs.listExpired(now)
+	if err != nil {
+		return 0, fmt.Errorf("Error listing expired keys: %s", err)
+	}
+
+	byUser := make(map[string][]string)
+	for _, key := range expired {
+		byUser[key.Username] = append(byUser[key.Username], key.Key)
+	}
+
+	var usernames []string
+	for username := range byUser {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	purged := 0
+	for _, username := range usernames {
+		hasPrefs, err := u.prefs.hasPreferences(username)
+		if err != nil {
+			return purged, fmt.Errorf("Error checking preferences for user %s: %s", username, err)
+		}
+
+		if hasPrefs {
+			values, record, err := u.loadPreferencesRecord(username)
+			if err != nil {
+				return purged, err
+			}
+
+			stored, err := u.storePreferencesIfUnchanged(username, values, record)
+			if err != nil {
+				return purged, err
+			}
+			if !stored {
+				continue
+			}
+		}
+
+		if err = u.prefs.deleteExpiredKeys(username, byUser[username], now); err != nil {
+			return purged, fmt.Errorf("Error deleting key expirations for user %s: %s", username, err)
+		}
+
+		purged += len(byUser[username])
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseExpiration(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	actual, err := parseExpiration("2020-02-01T00:00:00Z", now)
+	if err != nil {
+		t.Error(err)
+	}
+	if !actual.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("timestamp was parsed as %s", actual)
+	}
+
+	actual, err = parseExpiration(" 2h ", now)
+	if err != nil {
+		t.Error(err)
+	}
+	if !actual.Equal(now.Add(2 * time.Hour)) {
+		t.Errorf("duration was parsed as %s", actual)
+	}
+
+	if _, err = parseExpiration("tomorrow", now); err == nil {
+		t.Error("an invalid expiration did not cause an error")
+	}
+}
+
+func TestRequestExpirations(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+	req.Header.Set(expiresHeader, "banner.dismissed=1h, snooze=2020-01-02T00:00:00Z")
+
+	body := map[string]interface{}{
+		"preferences": map[string]interface{}{"snooze": true},
+		"expires":     map[string]interface{}{"other": "30m"},
+	}
+
+	actual, err := requestExpirations(req, body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Time{
+		"banner.dismissed": now.Add(time.Hour),
+		"snooze":           time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		"other":            now.Add(30 * time.Minute),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expirations were %#v instead of %#v", actual, expected)
+	}
+
+	if _, ok := body["expires"]; ok {
+		t.Error("the expires field was not removed from the body")
+	}
+}
+
+func TestRequestExpirationsUnwrapped(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+	body := map[string]interface{}{"expires": "a user preference"}
+
+	actual, err := requestExpirations(req, body, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 0 {
+		t.Errorf("expirations were %#v", actual)
+	}
+	if _, ok := body["expires"]; !ok {
+		t.Error("the expires preference was removed from an unwrapped body")
+	}
+}
+
+func TestRequestExpirationsInvalid(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+	req.Header.Set(expiresHeader, "no-equals-sign")
+	if _, err := requestExpirations(req, nil, time.Now()); err == nil {
+		t.Error("an invalid header did not cause an error")
+	}
+}
+
+func TestExpiringKeys(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	body := []byte(`{"preferences":{"banner":true,"snooze":true,"theme":"dark"},"expires":{"snooze":"1h"}}`)
+	status, _ := doRequest(t, http.MethodPost, url, body, map[string]string{expiresHeader: "banner=1h"})
+	if status != http.StatusCreated {
+		t.Errorf("POST returned %d instead of %d", status, http.StatusCreated)
+	}
+
+	stored := mock.storage[username]["user-prefs"].(string)
+	if stored != `{"preferences":{"banner":true,"snooze":true,"theme":"dark"}}` {
+		t.Errorf("stored preferences were %s", stored)
+	}
+
+	if len(mock.expires[username]) != 2 {
+		t.Errorf("expirations were %#v", mock.expires[username])
+	}
+
+	mock.expires[username]["banner"] = time.Now().Add(-time.Minute)
+
+	status, resBody := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("GET returned %d instead of %d", status, http.StatusOK)
+	}
+	if string(resBody) != `{"snooze":true,"theme":"dark"}` {
+		t.Errorf("GET returned %s", resBody)
+	}
+
+	purged, err := n.purgeExpired(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("%d keys were purged instead of 1", purged)
+	}
+
+	stored = mock.storage[username]["user-prefs"].(string)
+	if stored != `{"snooze":true,"theme":"dark"}` {
+		t.Errorf("stored preferences were %s after purging", stored)
+	}
+
+	if _, ok := mock.expires[username]["snooze"]; !ok {
+		t.Error("an unexpired key's expiration was purged")
+	}
+}
+
+func TestWritesClearExpirations(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	mock.insertPreferences(username, `{"banner":true,"snooze":true,"theme":"dark","ui":{"panels":2}}`)
+	later := time.Now().Add(time.Hour)
+	reset := func() {
+		mock.expires[username] = map[string]time.Time{"banner": later, "snooze": later, "theme": later, "ui.panels": later}
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	expiring := func() []string {
+		var keys []string
+		for key := range mock.expires[username] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	reset()
+	if status, _ := doRequest(t, http.MethodPost, url, []byte(`{"banner":false,"snooze":null,"ui":3}`), map[string]string{expiresHeader: "theme=2h"}); status != http.StatusOK {
+		t.Errorf("POST returned %d", status)
+	}
+	if keys := expiring(); !reflect.DeepEqual(keys, []string{"theme"}) || !mock.expires[username]["theme"].After(later) {
+		t.Errorf("the expirations after a merge were %v", mock.expires[username])
+	}
+
+	reset()
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"banner":true,"theme":"light"}`), map[string]string{expiresHeader: "banner=2h"}); status != http.StatusOK {
+		t.Errorf("PUT returned %d", status)
+	}
+	if keys := expiring(); !reflect.DeepEqual(keys, []string{"banner"}) {
+		t.Errorf("the expirations after a replacement were %v", mock.expires[username])
+	}
+}
+
+func TestPurgeExpiredConcurrentChanges(t *testing.T) {
+	username := "test-user"
+	mock := &flagRaceDB{MockDB: NewMockDB()}
+	mock.users[username] = true
+	mock.insertPreferences(username, `{"banner":true,"theme":"dark"}`)
+	mock.expires[username] = map[string]time.Time{"banner": time.Now().Add(-time.Minute)}
+
+	n := New(mock)
+	mock.races = 1
+	purged, err := n.purgeExpired(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("%d keys were purged from a document that changed while it was purged", purged)
+	}
+	if _, ok := mock.expires[username]["banner"]; !ok {
+		t.Error("the expiration of a key that wasn't purged was removed")
+	}
+
+	mock.expires[username]["banner"] = time.Now().Add(time.Hour)
+	if err = n.prefs.deleteExpiredKeys(username, []string{"banner"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mock.expires[username]["banner"]; !ok {
+		t.Error("an expiration that was pushed back was removed")
+	}
+}
+
+func TestGetExpirations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	expiresAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT e.key, e.expires_at FROM user_preferences_expirations e, users u WHERE e.user_id = u.id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "expires_at"}).AddRow("snooze", expiresAt))
+
+	expirations, err := p.getExpirations("test-user")
+	if err != nil {
+		t.Errorf("error from getExpirations(): %s", err)
+	}
+
+	if !expirations["snooze"].Equal(expiresAt) {
+		t.Errorf("expirations were %#v", expirations)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteExpirations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences_expirations WHERE user_id = (.+) AND key =").
+		WithArgs("1", "snooze").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = p.deleteExpirations("test-user", []string{"snooze"}); err != nil {
+		t.Errorf("error deleting expirations: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDeleteExpiredKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences_expirations WHERE user_id = (.+) AND key = (.+) AND expires_at <=").
+		WithArgs("1", "snooze", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = p.deleteExpiredKeys("test-user", []string{"snooze"}, now); err != nil {
+		t.Errorf("error deleting expired keys: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
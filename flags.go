@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// flagResponse is the JSON body returned by the feature flag endpoints.
+type flagResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// requireUser pulls the username out of the request's URL and makes sure that
+// the user exists. It writes out an error response and returns false if either
+// of those checks fails.
+func (u *UserPreferencesApp) requireUser(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := u.pathUsername(writer, r)
+	if !ok {
+		return "", false
+	}
+
+	userExists, err := u.prefs.isUser(username)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+		return "", false
+	}
+
+	if !userExists {
+		handleNonUser(writer, r, username)
+		return "", false
+	}
+
+	return username, true
+}
+
+// loadPreferences returns the unwrapped preferences document for the user,
+// without any expired keys. An empty map is returned if the user doesn't have
+// any preferences stored.
+func (u *UserPreferencesApp) loadPreferences(username string) (map[string]interface{}, error) {
+	values, _, err := u.loadPreferencesRecord(username)
+	return values, err
+}
+
+// loadPreferencesRecord is loadPreferences that also returns the stored record,
+// which is empty if the user doesn't have any preferences stored.
+func (u *UserPreferencesApp) loadPreferencesRecord(username string) (map[string]interface{}, UserPreferencesRecord, error) {
+	var record UserPreferencesRecord
+
+	records, err := u.prefs.getPreferences(username)
+	if _, ok := err.(*ChecksumError); ok {
+		return nil, record, err
+	} else if err != nil {
+		return nil, record, fmt.Errorf("Error getting preferences for username %s: %s", username, err)
+	}
+
+	if len(records) >= 1 {
+		record = records[0]
+	}
+
+	values, err := convert(&record, false)
+	if err != nil {
+		return nil, record, fmt.Errorf("Error parsing preferences for username %s: %s", username, err)
+	}
+
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	if err = u.stripExpired(username, values, time.Now()); err != nil {
+		return nil, record, err
+	}
+
+	return values, record, nil
+}
+
+// storePreferences serializes the unwrapped preferences document and either
+// inserts or updates it depending on whether the user already has preferences.
+// It returns true if the preferences were inserted.
+func (u *UserPreferencesApp) storePreferences(username string, values map[string]interface{}) (bool, error) {
+	hasPrefs, err := u.prefs.hasPreferences(username)
+	if err != nil {
+		return false, fmt.Errorf("Error checking preferences for user %s: %s", username, err)
+	}
+
+	jsoned, err := u.encodeForStore(username, values)
+	if err != nil {
+		return false, err
+	}
+
+	if !hasPrefs {
+		if err = u.prefs.insertPreferences(username, jsoned); err != nil {
+			return false, fmt.Errorf("Error inserting preferences for user %s: %s", username, err)
+		}
+		return true, nil
+	}
+
+	if err = u.prefs.updatePreferences(username, jsoned); err != nil {
+		return false, fmt.Errorf("Error updating preferences for user %s: %s", username, err)
+	}
+	return false, nil
+}
+
+// storePreferencesIfUnchanged is storePreferences for a document derived from
+// the given stored record. It returns false without storing anything if the
+// stored document has been changed since the record was read.
+func (u *UserPreferencesApp) storePreferencesIfUnchanged(username string, values map[string]interface{}, record UserPreferencesRecord) (bool, error) {
+	jsoned, err := u.encodeForStore(username, values)
+	if err != nil {
+		return false, err
+	}
+
+	if record.ID == "" {
+		if err = u.prefs.insertPreferences(username, jsoned); err != nil {
+			return false, fmt.Errorf("Error inserting preferences for user %s: %s", username, err)
+		}
+		return true, nil
+	}
+
+	updated, err := u.prefs.updatePreferencesIfVersion(username, jsoned, record.Version)
+	if err != nil {
+		return false, fmt.Errorf("Error updating preferences for user %s: %s", username, err)
+	}
+	return updated, nil
+}
+
+// encodeForStore returns the JSON to store for the unwrapped preferences
+// document, or an error if it would put the user over their quota.
+func (u *UserPreferencesApp) encodeForStore(username string, values map[string]interface{}) (string, error) {
+	u.stripComputed(values)
+
+	jsoned, err := documentJSON.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("Error generating preferences JSON for user %s: %s", username, err)
+	}
+
+	if err = u.checkQuota(username, len(jsoned)); err != nil {
+		return "", err
+	}
+	return string(jsoned), nil
+}
+
+// flagValue returns the value of the named flag in the preferences, falling
+// back to the default if the flag hasn't been set. An error is returned if the
+// stored value isn't a boolean.
+func flagValue(values map[string]interface{}, flag string, def bool) (bool, error) {
+	stored, ok := values[flag]
+	if !ok || stored == nil {
+		return def, nil
+	}
+
+	enabled, ok := stored.(bool)
+	if !ok {
+		return false, fmt.Errorf("Preference %s is not a boolean", flag)
+	}
+
+	return enabled, nil
+}
+
+func writeFlag(writer http.ResponseWriter, enabled bool) {
+	jsoned, err := json.Marshal(&flagResponse{Enabled: enabled})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating flag JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// GetFlagRequest handles returning whether a boolean preference is enabled for
+// a user.
+func (u *UserPreferencesApp) GetFlagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	flag := mux.Vars(r)["flag"]
+
+	log.Infof("Getting flag %s for %s", flag, username)
+	values, err := u.loadPreferences(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	enabled, err := flagValue(values, flag, u.flagDefault)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	writeFlag(writer, enabled)
+}
+
+// toggleAttempts is the number of times a toggle is tried when the flag's
+// preferences are changed by other requests while it's being toggled.
+const toggleAttempts = 5
+
+// ToggleFlagRequest handles flipping a boolean preference for a user and
+// returns the new value. The toggled document is checked like any other write.
+// The new value is only stored if the preferences haven't changed since the
+// flag was read, so concurrent toggles of different flags don't lose each
+// other's changes.
+func (u *UserPreferencesApp) ToggleFlagRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	flag := mux.Vars(r)["flag"]
+
+	log.Infof("Toggling flag %s for %s", flag, username)
+	for attempt := 1; ; attempt++ {
+		values, record, err := u.loadPreferencesRecord(username)
+		if err != nil {
+			errored(writer, err.Error())
+			return
+		}
+
+		enabled, err := flagValue(values, flag, u.flagDefault)
+		if err != nil {
+			badRequest(writer, err.Error())
+			return
+		}
+
+		toggled := deepCopy(values).(map[string]interface{})
+		toggled[flag] = !enabled
+
+		toggled, ok = u.applyLocks(writer, r, username, toggled)
+		if !ok {
+			return
+		}
+
+		if toggled, _, ok = u.checkWrite(writer, username, toggled); !ok {
+			return
+		}
+
+		stored, err := u.storePreferencesIfUnchanged(username, toggled, record)
+		if err != nil {
+			storeFailed(writer, err)
+			return
+		}
+		if !stored {
+			if attempt >= toggleAttempts {
+				conflict(writer, fmt.Sprintf("The preferences for user %s kept changing while flag %s was being toggled", username, flag))
+				return
+			}
+			continue
+		}
+
+		if enabled, err = flagValue(toggled, flag, u.flagDefault); err != nil {
+			errored(writer, err.Error())
+			return
+		}
+
+		writeFlag(writer, enabled)
+		return
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlagValue(t *testing.T) {
+	values := map[string]interface{}{
+		"enabled":  true,
+		"disabled": false,
+		"string":   "true",
+	}
+
+	if actual, err := flagValue(values, "enabled", false); err != nil || !actual {
+		t.Errorf("flagValue returned %t, %v for an enabled flag", actual, err)
+	}
+
+	if actual, err := flagValue(values, "disabled", true); err != nil || actual {
+		t.Errorf("flagValue returned %t, %v for a disabled flag", actual, err)
+	}
+
+	if actual, err := flagValue(values, "missing", true); err != nil || !actual {
+		t.Errorf("flagValue returned %t, %v instead of the default", actual, err)
+	}
+
+	if _, err := flagValue(values, "string", false); err == nil {
+		t.Error("flagValue did not return an error for a non-boolean preference")
+	}
+}
+
+func doFlagRequest(t *testing.T, method, url string) (int, flagResponse) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var parsed flagResponse
+	if res.StatusCode == http.StatusOK {
+		if err = json.Unmarshal(body, &parsed); err != nil {
+			t.Fatalf("error parsing '%s': %s", body, err)
+		}
+	}
+
+	return res.StatusCode, parsed
+}
+
+func TestGetFlagRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"dark-mode":true,"name":"foo"}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, parsed := doFlagRequest(t, http.MethodGet, fmt.Sprintf("%s/%s/flags/dark-mode", server.URL, username))
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+	if !parsed.Enabled {
+		t.Error("dark-mode was not enabled")
+	}
+
+	status, parsed = doFlagRequest(t, http.MethodGet, fmt.Sprintf("%s/%s/flags/unset", server.URL, username))
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+	if parsed.Enabled {
+		t.Error("unset flag did not use the default")
+	}
+
+	status, _ = doFlagRequest(t, http.MethodGet, fmt.Sprintf("%s/%s/flags/name", server.URL, username))
+	if status != http.StatusBadRequest {
+		t.Errorf("status code was %d instead of %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestToggleFlagRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	n.flagDefault = true
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/flags/beta/toggle", server.URL, username)
+
+	status, parsed := doFlagRequest(t, http.MethodPost, url)
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+	if parsed.Enabled {
+		t.Error("toggling a flag with a true default did not disable it")
+	}
+
+	status, parsed = doFlagRequest(t, http.MethodPost, url)
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+	if !parsed.Enabled {
+		t.Error("toggling a disabled flag did not enable it")
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Error(err)
+	}
+	if stored["beta"] != true {
+		t.Errorf("stored value was %#v instead of true", stored["beta"])
+	}
+}
+
+func TestToggleFlagChecked(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	var err error
+	if n.keyFilter, err = NewKeyFilter(nil, []string{"debug"}, keyFilterReject); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/flags/debug/toggle", server.URL, username)
+	if status, _ := doFlagRequest(t, http.MethodPost, url); status != http.StatusUnprocessableEntity {
+		t.Errorf("toggling a denied flag returned %d", status)
+	}
+	if has, _ := mock.hasPreferences(username); has {
+		t.Error("a denied flag was stored")
+	}
+}
+
+// flagRaceDB changes a user's preferences just before each of the first writes
+// conditional on their version, the way a concurrent request would.
+type flagRaceDB struct {
+	*MockDB
+	races int
+}
+
+func (d *flagRaceDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	if d.races > 0 {
+		d.races--
+		values, _ := d.MockDB.storage[username]["user-prefs"].(string)
+		var parsed map[string]interface{}
+		json.Unmarshal([]byte(values), &parsed)
+		parsed[fmt.Sprintf("other-%d", d.races)] = true
+		jsoned, _ := json.Marshal(parsed)
+		d.MockDB.updatePreferences(username, string(jsoned))
+	}
+	return d.MockDB.updatePreferencesIfVersion(username, prefs, version)
+}
+
+func TestToggleFlagConcurrentChanges(t *testing.T) {
+	username := "test-user"
+	mock := &flagRaceDB{MockDB: NewMockDB()}
+	mock.users[username] = true
+	mock.insertPreferences(username, `{"theme":"dark"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/flags/beta/toggle", server.URL, username)
+
+	mock.races = toggleAttempts - 1
+	status, parsed := doFlagRequest(t, http.MethodPost, url)
+	if status != http.StatusOK || !parsed.Enabled {
+		t.Errorf("toggling the flag returned %d, %#v", status, parsed)
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < toggleAttempts-1; i++ {
+		if stored[fmt.Sprintf("other-%d", i)] != true {
+			t.Errorf("the concurrent change other-%d was lost: %v", i, stored)
+		}
+	}
+	if stored["beta"] != true {
+		t.Errorf("stored value was %#v instead of true", stored["beta"])
+	}
+
+	mock.races = toggleAttempts
+	if status, _ = doFlagRequest(t, http.MethodPost, url); status != http.StatusConflict {
+		t.Errorf("toggling a flag that kept changing returned %d instead of %d", status, http.StatusConflict)
+	}
+}
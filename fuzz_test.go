@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets cover the code that parses request paths and bodies. Run
+// one with "go test -run xxx -fuzz FuzzConvert", or all of them for a while
+// each with "make fuzz". Without -fuzz, they check the seed corpus and any
+// failures saved in testdata/fuzz.
+
+// fuzzDocuments seed the targets that take JSON documents.
+var fuzzDocuments = []string{
+	``,
+	`null`,
+	`{}`,
+	`[]`,
+	`"preferences"`,
+	`{"preferences":{}}`,
+	`{"preferences":null}`,
+	`{"preferences":"compact"}`,
+	`{"preferences":{"preferences":{"theme":"dark"}}}`,
+	`{"theme":"dark","tools":{"favorites":["a","b"]},"recentPaths":[]}`,
+	`{"tools":{"$literal":null},"apps":[{"id":1},{"id":2}]}`,
+	`{"a":1e400}`,
+	`{"a":"\ud800"}`,
+	`{"a":{"b":{"c":{"d":{"e":[[[[{}]]]]}}}}}`,
+}
+
+func FuzzConvert(f *testing.F) {
+	for _, doc := range fuzzDocuments {
+		f.Add(doc, false)
+		f.Add(doc, true)
+	}
+
+	f.Fuzz(func(t *testing.T, doc string, wrap bool) {
+		converted, err := convert(&UserPreferencesRecord{Preferences: doc}, wrap)
+		if err != nil || !wrap {
+			return
+		}
+		if _, ok := converted["preferences"].(map[string]interface{}); !ok && converted["preferences"] != nil {
+			t.Errorf("wrapping %s returned %v", doc, converted)
+		}
+	})
+}
+
+func FuzzReadDocument(f *testing.F) {
+	for _, doc := range fuzzDocuments {
+		f.Add([]byte(doc))
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		doc, err := readDocument(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		if doc == nil {
+			t.Fatalf("reading %q returned a nil document", body)
+		}
+
+		// The document reads the same after it's stored, wrapped the way
+		// the service stores it.
+		encoded, err := json.Marshal(map[string]interface{}{"preferences": doc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := readDocument(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("reading the stored copy of %q failed: %s", body, err)
+		}
+		if !reflect.DeepEqual(roundTrip(t, doc), again) {
+			t.Errorf("reading %q returned %v, then %v", body, doc, again)
+		}
+	})
+}
+
+// FuzzMergePatch covers merging a POST body into the stored document, which
+// is how patches are applied, with each of the array strategies.
+func FuzzMergePatch(f *testing.F) {
+	for _, stored := range fuzzDocuments {
+		for _, patch := range fuzzDocuments {
+			f.Add([]byte(stored), []byte(patch))
+		}
+	}
+
+	var strategies []mergeOptions
+	for _, arrays := range []string{arraysReplace, arraysAppend, arraysUnion, arraysUnionByID} {
+		opts, err := newMergeOptions(0, arrays, nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		strategies = append(strategies, opts)
+	}
+	shallow, err := newMergeOptions(1, arraysReplace, []string{"tools.favorites=union"})
+	if err != nil {
+		f.Fatal(err)
+	}
+	strategies = append(strategies, shallow)
+
+	f.Fuzz(func(t *testing.T, stored, patch []byte) {
+		var storedDoc, patchDoc map[string]interface{}
+		if json.Unmarshal(stored, &storedDoc) != nil || json.Unmarshal(patch, &patchDoc) != nil {
+			return
+		}
+		if storedDoc == nil {
+			storedDoc = map[string]interface{}{}
+		}
+
+		for _, opts := range strategies {
+			merged := deepMerge(storedDoc, patchDoc, opts)
+			if _, err := json.Marshal(merged); err != nil {
+				t.Errorf("merging %s into %s gave a document that can't be stored: %s", patch, stored, err)
+			}
+			for key, value := range patchDoc {
+				if _, present := merged[key]; value == nil && present {
+					t.Errorf("merging %s into %s didn't remove %s", patch, stored, key)
+				}
+			}
+		}
+	})
+}
+
+func FuzzUsername(f *testing.F) {
+	for _, seed := range []string{"alice", "Alice", "alice@iplantcollaborative.org", "alice@iplantcollaborative.org@iplantcollaborative.org", "", "ALİCE", "al ice", "ʎǝɹ", "a/b"} {
+		f.Add(seed)
+	}
+
+	var policies []*UsernamePolicy
+	for _, mode := range []string{suffixNone, suffixStrip, suffixAppend} {
+		policy, err := NewUsernamePolicy(`^[a-z0-9_.@-]+$`, 64, true, "@iplantcollaborative.org", mode)
+		if err != nil {
+			f.Fatal(err)
+		}
+		policies = append(policies, policy)
+	}
+
+	f.Fuzz(func(t *testing.T, username string) {
+		for _, policy := range policies {
+			normalized, err := policy.normalize(username)
+			if err != nil {
+				continue
+			}
+
+			// Normalizing a normalized username changes nothing, so that
+			// a username always maps to the same stored user.
+			again, err := policy.normalize(normalized)
+			if err != nil || again != normalized {
+				t.Errorf("normalizing %q in %s mode gave %q, then %q: %v", username, policy.suffixMode, normalized, again, err)
+			}
+			if policy.suffixMode == suffixStrip && strings.HasSuffix(normalized, policy.suffix) {
+				t.Errorf("normalizing %q in strip mode left the suffix: %q", username, normalized)
+			}
+		}
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AuditRecord is an entry in the audit log.
+type AuditRecord struct {
+	ID        int64
+	Action    string
+	Details   string
+	CreatedAt time.Time
+}
+
+// listUserAudits returns the audit log entries that name the user in their
+// details, oldest first.
+func (p *PrefsDB) listUserAudits(username string) ([]AuditRecord, error) {
+	query := `SELECT id, action, details, created_at
+              FROM user_preferences_audit
+             WHERE details::jsonb ->> 'user' = $1
+          ORDER BY id`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audits := []AuditRecord{}
+	for rows.Next() {
+		var record AuditRecord
+		if err := rows.Scan(&record.ID, &record.Action, &record.Details, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		audits = append(audits, record)
+	}
+
+	return audits, rows.Err()
+}
+
+// eraseStatement deletes a user's rows from one table.
+type eraseStatement struct {
+	table string
+	query string
+	arg   string
+}
+
+// eraseStatements returns the statements that delete everything stored about
+// the user, in the order they're run. The preferences and the archive are
+// deleted before the history and the outbox so that the rows their triggers
+// add are deleted too, which means the change events' consumers aren't told
+// about the erasure. Every table with a row per user has to be listed here;
+// TestEraseStatementsCoverTables checks the migrations for ones that aren't.
+func (p *PrefsDB) eraseStatements(userID, username string) []eraseStatement {
+	return []eraseStatement{
+		{"user_preferences", `DELETE FROM ` + p.onlyPreferences() + ` WHERE user_id = $1`, userID},
+		{"user_preferences_archive", `DELETE FROM user_preferences_archive WHERE user_id = $1`, userID},
+		{"user_preferences_history", `DELETE FROM user_preferences_history WHERE user_id = $1`, userID},
+		{"user_preferences_outbox", `DELETE FROM user_preferences_outbox WHERE username = $1`, username},
+		{"user_preferences_expirations", `DELETE FROM user_preferences_expirations WHERE user_id = $1`, userID},
+		{"user_preferences_searches", `DELETE FROM user_preferences_searches WHERE user_id = $1`, userID},
+		{"user_preferences_ui_sessions", `DELETE FROM user_preferences_ui_sessions WHERE user_id = $1`, userID},
+		{"user_preferences_bags", `DELETE FROM user_preferences_bags WHERE user_id = $1`, userID},
+		{"user_preferences_experiments", `DELETE FROM user_preferences_experiments WHERE user_id = $1`, userID},
+		{"user_preferences_undo", `DELETE FROM user_preferences_undo WHERE user_id = $1`, userID},
+		{"user_preferences_rollout_members", `DELETE FROM user_preferences_rollout_members WHERE user_id = $1`, userID},
+		{"user_preferences_usage", `DELETE FROM user_preferences_usage WHERE user_id = $1`, userID},
+		{"user_preferences_scheduled_changes", `DELETE FROM user_preferences_scheduled_changes WHERE target_type = 'user' AND target = $1`, username},
+		{"user_preferences_idempotency", `DELETE FROM user_preferences_idempotency WHERE username = $1`, username},
+		{"user_preferences_audit", `DELETE FROM user_preferences_audit WHERE details::jsonb ->> 'user' = $1`, username},
+	}
+}
+
+// eraseUser deletes everything stored about the user in a single transaction
+// and returns the number of rows deleted from each table. Documents in object
+// storage are deleted once the transaction commits. The row in the users table
+// is shared with other services and is left alone.
+func (p *PrefsDB) eraseUser(username string) (map[string]int64, error) {
+	userID, err := p.userID(username)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if p.objects != nil {
+		keysQuery := `SELECT compressed FROM ` + p.tables.Preferences + ` WHERE user_id = $1 AND encoding = 'object'
+                       UNION
+                      SELECT compressed FROM user_preferences_history WHERE user_id = $1 AND encoding = 'object'
+                       UNION
+                      SELECT compressed FROM user_preferences_archive WHERE user_id = $1 AND encoding = 'object'`
+		if keys, err = scanObjectKeys(tx.Query(keysQuery, userID)); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	deleted := make(map[string]int64)
+	for _, s := range p.eraseStatements(userID, username) {
+		result, err := tx.Exec(s.query, s.arg)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if deleted[s.table], err = result.RowsAffected(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		p.deleteObjects(keys)
+	}
+	return deleted, nil
+}
+
+// exportFile adds a JSON file to the export archive.
+func exportFile(archive *zip.Writer, name string, value interface{}) error {
+	jsoned, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error generating %s: %s", name, err)
+	}
+
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(jsoned)
+	return err
+}
+
+// auditExport is an audit log entry in an export archive.
+type auditExport struct {
+	ID        int64             `json:"id"`
+	Action    string            `json:"action"`
+	Details   map[string]string `json:"details"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// buildExport returns a zip archive of everything stored about the user:
+// the current preferences, their previous versions, the expiration times of
+// their keys, their experiment assignments, their usage counts, and the audit
+// log entries about them.
+func (u *UserPreferencesApp) buildExport(username string) ([]byte, error) {
+	records, err := u.prefs.getPreferences(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the preferences for user %s: %s", username, err)
+	}
+
+	current := map[string]interface{}{"preferences": map[string]interface{}{}}
+	if len(records) > 0 {
+		values, err := convert(&records[0], false)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the preferences for user %s: %s", username, err)
+		}
+		current = map[string]interface{}{
+			"preferences": values,
+			"version":     records[0].Version,
+			"created_at":  records[0].CreatedAt,
+			"modified_at": records[0].ModifiedAt,
+		}
+	}
+
+	history, err := u.prefs.listHistory(username, PageFilter{Limit: math.MaxInt32})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the preferences history for user %s: %s", username, err)
+	}
+
+	entries := make([]historyEntry, 0, len(history))
+	for _, record := range history {
+		prefs, err := convert(&UserPreferencesRecord{Preferences: record.Preferences}, false)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing version %d of the preferences for user %s: %s", record.Version, username, err)
+		}
+		entries = append(entries, historyEntry{
+			Version:     record.Version,
+			Preferences: prefs,
+			ModifiedAt:  record.ModifiedAt,
+			ReplacedAt:  record.ReplacedAt,
+		})
+	}
+
+	expirations, err := u.prefs.getExpirations(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the expiration times for user %s: %s", username, err)
+	}
+
+	searches, err := u.searchesDocument(username)
+	if err != nil {
+		return nil, err
+	}
+
+	session, _, err := u.loadUISession(username)
+	if err != nil {
+		return nil, err
+	}
+
+	bags, err := u.bagsExport(username)
+	if err != nil {
+		return nil, err
+	}
+
+	experiments, err := u.prefs.listExperimentAssignments(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the experiment assignments for user %s: %s", username, err)
+	}
+
+	usage, err := u.prefs.getUsage(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the usage for user %s: %s", username, err)
+	}
+
+	audits, err := u.prefs.listUserAudits(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the audit log entries for user %s: %s", username, err)
+	}
+
+	auditEntries := make([]auditExport, 0, len(audits))
+	for _, record := range audits {
+		var details map[string]string
+		if err := json.Unmarshal([]byte(record.Details), &details); err != nil {
+			return nil, fmt.Errorf("Error parsing audit log entry %d: %s", record.ID, err)
+		}
+		auditEntries = append(auditEntries, auditExport{
+			ID:        record.ID,
+			Action:    record.Action,
+			Details:   details,
+			CreatedAt: record.CreatedAt,
+		})
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files := []struct {
+		name  string
+		value interface{}
+	}{
+		{"preferences.json", current},
+		{"history.json", entries},
+		{"expirations.json", expirations},
+		{"searches.json", searches},
+		{"session.json", session},
+		{"bags.json", bags},
+		{"experiments.json", experiments},
+		{"usage.json", usage},
+		{"audit.json", auditEntries},
+	}
+	for _, file := range files {
+		if err = exportFile(archive, file.name, file.value); err != nil {
+			return nil, err
+		}
+	}
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GDPRExportRequest handles writing out a zip archive of everything stored
+// about a user for a data subject access request.
+func (u *UserPreferencesApp) GDPRExportRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	archive, err := u.buildExport(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if err = u.audit("gdpr-export", map[string]string{"user": username}); err != nil {
+		log.Error(err)
+	}
+
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+"-export.zip"))
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write(archive)
+}
+
+// erasureReceipt is the JSON body returned after erasing a user's data.
+type erasureReceipt struct {
+	ReceiptID string           `json:"receipt_id"`
+	User      string           `json:"user"`
+	ErasedAt  time.Time        `json:"erased_at"`
+	Deleted   map[string]int64 `json:"deleted"`
+}
+
+// newReceiptID returns a random identifier for an erasure receipt.
+func newReceiptID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// GDPREraseRequest handles permanently deleting everything stored about a
+// user, including their history and the audit log entries that name them. The
+// erasure itself is audited with a hash of the username rather than the
+// username, so the receipt can be matched against the log later.
+func (u *UserPreferencesApp) GDPREraseRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	receiptID, err := newReceiptID()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating an erasure receipt ID: %s", err))
+		return
+	}
+
+	deleted, err := u.prefs.eraseUser(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error erasing the data for user %s: %s", username, err))
+		return
+	}
+
+	receipt := &erasureReceipt{
+		ReceiptID: receiptID,
+		User:      username,
+		ErasedAt:  time.Now().UTC(),
+		Deleted:   deleted,
+	}
+
+	userHash := sha256.Sum256([]byte(username))
+	details := map[string]string{
+		"receipt_id": receiptID,
+		"user_hash":  hex.EncodeToString(userHash[:]),
+	}
+	for table, count := range deleted {
+		details[table] = strconv.FormatInt(count, 10)
+	}
+	if err = u.audit("gdpr-erase", details); err != nil {
+		log.Error(err)
+	}
+
+	jsoned, err := json.Marshal(receipt)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the erasure receipt JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// readExport returns the JSON files in an export archive, keyed by name.
+func readExport(t *testing.T, archive []byte) map[string]interface{} {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]interface{})
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var value interface{}
+		if err = json.Unmarshal(contents, &value); err != nil {
+			t.Fatalf("%s isn't valid JSON: %s", file.Name, err)
+		}
+		files[file.Name] = value
+	}
+	return files
+}
+
+func TestGDPRExportAndErase(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+	mock.insertPreferences("alice", `{"theme":"light"}`)
+	mock.insertPreferences("bob", `{"theme":"blue"}`)
+	mock.setExpirations("alice", map[string]time.Time{"theme": time.Now().Add(time.Hour)})
+	mock.putSearch("alice", "genomes", `{"query":"*.fasta"}`)
+	mock.saveUISession("alice", `{"layout":"grid"}`, time.Time{})
+	mock.putBag("alice", "reads", `["/iplant/home/alice/reads.fq"]`)
+	mock.addExperimentAssignment("alice", "new-editor", "control")
+	mock.recordAudit("share", `{"user":"alice","keys":"theme"}`)
+	mock.recordAudit("share", `{"user":"bob","keys":"theme"}`)
+	mock.recordAudit("delete-key", `{"key":"theme","operation":"1"}`)
+	mock.saveUndoState("alice", UndoState{Version: 2})
+	mock.createScheduledChange(&ScheduledChange{TargetType: "user", Target: "alice", Mode: "merge", Preferences: `{"theme":"dark"}`})
+	mock.createScheduledChange(&ScheduledChange{TargetType: "user", Target: "bob", Mode: "merge", Preferences: `{"theme":"dark"}`})
+	mock.saveIdempotentResponse(&IdempotentResponse{Key: "key-1", Username: "alice", Body: []byte(`{"theme":"light"}`), CreatedAt: time.Now()})
+
+	n := New(mock)
+	n.adminKey = "key"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+	admin := map[string]string{adminKeyHeader: "key"}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice/gdpr-export", nil, nil); status != http.StatusForbidden {
+		t.Errorf("an export without the admin key returned %d", status)
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/alice/gdpr-export", nil, admin)
+	if status != http.StatusOK {
+		t.Fatalf("the export returned %d: %s", status, body)
+	}
+
+	files := readExport(t, body)
+	if prefs := files["preferences.json"].(map[string]interface{}); !reflect.DeepEqual(prefs["preferences"], map[string]interface{}{"theme": "light"}) {
+		t.Errorf("the exported preferences were %#v", prefs)
+	}
+	if history := files["history.json"].([]interface{}); len(history) != 1 {
+		t.Errorf("the exported history was %#v", history)
+	}
+	if expirations := files["expirations.json"].(map[string]interface{}); len(expirations) != 1 {
+		t.Errorf("the exported expirations were %#v", expirations)
+	}
+	if searches := files["searches.json"].(map[string]interface{}); len(searches) != 1 {
+		t.Errorf("the exported searches were %#v", searches)
+	}
+	if session := files["session.json"].(map[string]interface{}); session["layout"] != "grid" {
+		t.Errorf("the exported UI session was %#v", session)
+	}
+	if bags := files["bags.json"].([]interface{}); len(bags) != 1 {
+		t.Errorf("the exported bags were %#v", bags)
+	}
+	if experiments := files["experiments.json"].(map[string]interface{}); experiments["new-editor"] != "control" {
+		t.Errorf("the exported experiment assignments were %#v", experiments)
+	}
+	if usage := files["usage.json"].(map[string]interface{}); usage["username"] != "alice" {
+		t.Errorf("the exported usage was %#v", usage)
+	}
+	if audits := files["audit.json"].([]interface{}); len(audits) != 1 {
+		t.Errorf("the exported audit entries were %#v", audits)
+	}
+
+	status, body = doRequest(t, http.MethodDelete, server.URL+"/alice/gdpr-erase", nil, admin)
+	if status != http.StatusOK {
+		t.Fatalf("the erasure returned %d: %s", status, body)
+	}
+
+	var receipt erasureReceipt
+	if err := json.Unmarshal(body, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"user_preferences":                   1,
+		"user_preferences_history":           1,
+		"user_preferences_expirations":       1,
+		"user_preferences_audit":             2,
+		"user_preferences_searches":          1,
+		"user_preferences_ui_sessions":       1,
+		"user_preferences_bags":              1,
+		"user_preferences_experiments":       1,
+		"user_preferences_rollout_members":   0,
+		"user_preferences_usage":             0,
+		"user_preferences_archive":           0,
+		"user_preferences_outbox":            0,
+		"user_preferences_undo":              1,
+		"user_preferences_scheduled_changes": 1,
+		"user_preferences_idempotency":       1,
+	}
+	if receipt.User != "alice" || receipt.ReceiptID == "" || !reflect.DeepEqual(receipt.Deleted, expected) {
+		t.Errorf("the receipt was %#v", receipt)
+	}
+
+	if has, _ := mock.hasPreferences("alice"); has || len(mock.history["alice"]) != 0 || len(mock.expires["alice"]) != 0 || len(mock.searches["alice"]) != 0 {
+		t.Error("alice's data wasn't erased")
+	}
+	if has, _ := mock.hasPreferences("bob"); !has {
+		t.Error("bob's preferences were erased")
+	}
+
+	for _, entry := range mock.audits {
+		if strings.Contains(entry, "alice") {
+			t.Errorf("the audit log still names alice: %s", entry)
+		}
+	}
+	last := mock.audits[len(mock.audits)-1]
+	if !strings.HasPrefix(last, "gdpr-erase ") || !strings.Contains(last, receipt.ReceiptID) {
+		t.Errorf("the erasure wasn't audited: %#v", mock.audits)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM ONLY user_preferences WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_archive WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_preferences_history WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("DELETE FROM user_preferences_outbox WHERE username = \\$1").
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec("DELETE FROM user_preferences_expirations WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_preferences_searches WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM user_preferences_ui_sessions WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_bags WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM user_preferences_experiments WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_undo WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_rollout_members WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_usage WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_scheduled_changes WHERE target_type = 'user' AND target = \\$1").
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_preferences_idempotency WHERE username = \\$1").
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM user_preferences_audit WHERE details::jsonb ->> 'user' = \\$1").
+		WithArgs("test-user").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	deleted, err := p.eraseUser("test-user")
+	if err != nil {
+		t.Fatalf("error erasing the user: %s", err)
+	}
+
+	expected := map[string]int64{
+		"user_preferences":                   1,
+		"user_preferences_history":           4,
+		"user_preferences_expirations":       0,
+		"user_preferences_audit":             2,
+		"user_preferences_searches":          3,
+		"user_preferences_ui_sessions":       1,
+		"user_preferences_bags":              2,
+		"user_preferences_experiments":       1,
+		"user_preferences_rollout_members":   1,
+		"user_preferences_usage":             1,
+		"user_preferences_archive":           0,
+		"user_preferences_outbox":            5,
+		"user_preferences_undo":              1,
+		"user_preferences_scheduled_changes": 1,
+		"user_preferences_idempotency":       3,
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("eraseUser returned %#v", deleted)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+// perUserColumn matches the column definitions that tie a table's rows to a
+// user.
+var perUserColumn = regexp.MustCompile(`^\s*(ADD COLUMN (IF NOT EXISTS )?)?(user_id|username|target_type)\s`)
+
+// TestEraseStatementsCoverTables checks that every table the migrations create
+// with a column naming a user is erased, so that a new per-user table can't be
+// left out of eraseUser.
+func TestEraseStatementsCoverTables(t *testing.T) {
+	migrations, err := loadMigrations(migrationsFS(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	erased := make(map[string]bool)
+	for _, s := range NewPrefsDB(nil).eraseStatements("1", "test-user") {
+		erased[s.table] = true
+	}
+
+	table := regexp.MustCompile(`^\s*(CREATE TABLE IF NOT EXISTS|ALTER TABLE) (\S+)`)
+	perUser := make(map[string]bool)
+	for _, m := range migrations {
+		sql, err := renderMigration(m.sql, defaultTableNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var current string
+		for _, line := range strings.Split(sql, "\n") {
+			if match := table.FindStringSubmatch(line); match != nil {
+				current = match[2]
+			}
+			if current != "" && perUserColumn.MatchString(line) {
+				perUser[current] = true
+			}
+			if strings.HasSuffix(strings.TrimSpace(line), ";") {
+				current = ""
+			}
+		}
+	}
+
+	if len(perUser) == 0 {
+		t.Fatal("no per-user tables were found in the migrations")
+	}
+	for name := range perUser {
+		if !erased[name] {
+			t.Errorf("eraseUser doesn't delete the user's rows from %s", name)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GroupLookup defines the interface for finding the groups a user belongs to.
+type GroupLookup interface {
+	groupsForUser(username string) ([]string, error)
+}
+
+// IplantGroupsClient implements the GroupLookup interface using the
+// iplant-groups service.
+type IplantGroupsClient struct {
+	base   string
+	user   string
+	client *http.Client
+}
+
+// NewIplantGroupsClient returns a newly created *IplantGroupsClient. The user
+// is the administrative user that iplant-groups requests are made as.
+func NewIplantGroupsClient(base, user string) *IplantGroupsClient {
+	return &IplantGroupsClient{
+		base:   strings.TrimSuffix(base, "/"),
+		user:   user,
+		client: outbound.client("iplant-groups", 30*time.Second),
+	}
+}
+
+// groupsForUser returns the names of the groups the user is a member of,
+// sorted by name.
+func (c *IplantGroupsClient) groupsForUser(username string) ([]string, error) {
+	requestURL := fmt.Sprintf(
+		"%s/subjects/%s/groups?user=%s",
+		c.base,
+		url.PathEscape(username),
+		url.QueryEscape(c.user),
+	)
+
+	resp, err := c.client.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("iplant-groups returned %d: %s", resp.StatusCode, body)
+	}
+
+	var parsed struct {
+		Groups []struct {
+			Name string `json:"name"`
+		} `json:"groups"`
+	}
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, group := range parsed.Groups {
+		names = append(names, group.Name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// getGroupPreferences returns the preferences document stored for the group.
+// sql.ErrNoRows is returned if the group doesn't have any preferences.
+func (p *PrefsDB) getGroupPreferences(group string) (string, error) {
+	query := `SELECT preferences FROM user_preferences_groups WHERE group_name = $1`
+	var prefs string
+	if err := p.db.QueryRow(query, group).Scan(&prefs); err != nil {
+		return "", err
+	}
+	return prefs, nil
+}
+
+// saveGroupPreferences creates or replaces the preferences for the group.
+func (p *PrefsDB) saveGroupPreferences(group, prefs string) error {
+	query := `INSERT INTO user_preferences_groups (group_name, preferences)
+                   VALUES ($1, $2)
+              ON CONFLICT (group_name) DO UPDATE
+                      SET preferences = EXCLUDED.preferences`
+	_, err := p.db.Exec(query, group, prefs)
+	return err
+}
+
+// deleteGroupPreferences removes the preferences for the group.
+func (p *PrefsDB) deleteGroupPreferences(group string) error {
+	query := `DELETE FROM user_preferences_groups WHERE group_name = $1`
+	_, err := p.db.Exec(query, group)
+	return err
+}
+
+// effectivePreferences resolves the user's effective preferences. The
+// configured defaults are overridden by the localized defaults, if any, and
+// then by the preferences of each group the user belongs to, which are in turn
+// overridden by the user's own preferences.
+func (u *UserPreferencesApp) effectivePreferences(username string, localized map[string]interface{}) (map[string]interface{}, error) {
+	effective := mergePreferences(mergePreferences(nil, u.defaults), localized)
+
+	if u.groups != nil {
+		groups, err := u.groups.groupsForUser(username)
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up groups for user %s: %s", username, err)
+		}
+
+		for _, group := range groups {
+			prefs, err := u.prefs.getGroupPreferences(group)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Error getting preferences for group %s: %s", group, err)
+			}
+
+			values, err := presetValues(prefs)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing preferences for group %s: %s", group, err)
+			}
+
+			effective = mergePreferences(effective, values)
+		}
+	}
+
+	values, err := u.loadPreferences(username)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergePreferences(effective, values), nil
+}
+
+// GetGroupRequest handles writing out a group's preferences as a response.
+func (u *UserPreferencesApp) GetGroupRequest(writer http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	prefs, err := u.prefs.getGroupPreferences(group)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Group %s does not have any preferences", group))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting preferences for group %s: %s", group, err))
+		return
+	}
+
+	values, err := presetValues(prefs)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error parsing preferences for group %s: %s", group, err))
+		return
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for group %s: %s", group, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// PutGroupRequest handles creating or replacing a group's preferences. A POST
+// in version 2 of the API merges the body into them instead.
+func (u *UserPreferencesApp) PutGroupRequest(writer http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	values, err := readDocument(r.Body)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if mergesOnPost(r) {
+		stored, err := u.prefs.getGroupPreferences(group)
+		if err != nil && err != sql.ErrNoRows {
+			errored(writer, fmt.Sprintf("Error getting preferences for group %s: %s", group, err))
+			return
+		}
+		if values, err = u.postedValues(r, stored, values); err != nil {
+			errored(writer, fmt.Sprintf("Error parsing preferences for group %s: %s", group, err))
+			return
+		}
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for group %s: %s", group, err))
+		return
+	}
+
+	log.Infof("Saving preferences for group %s", group)
+	if err = u.prefs.saveGroupPreferences(group, string(jsoned)); err != nil {
+		errored(writer, fmt.Sprintf("Error saving preferences for group %s: %s", group, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// DeleteGroupRequest handles deleting a group's preferences.
+func (u *UserPreferencesApp) DeleteGroupRequest(writer http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	log.Infof("Deleting preferences for group %s", group)
+	if err := u.prefs.deleteGroupPreferences(group); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting preferences for group %s: %s", group, err))
+	}
+}
+
+// EffectiveRequest handles writing out a user's effective preferences, which
+// include the defaults and group preferences that apply to the user.
+func (u *UserPreferencesApp) EffectiveRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	log.Infof("Getting effective preferences for %s", username)
+	values, err := u.effectivePreferences(username, nil)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if values, err = u.applyTemplates(r, username, values, false); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating effective preferences JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+type mockGroupLookup map[string][]string
+
+func (m mockGroupLookup) groupsForUser(username string) ([]string, error) {
+	return m[username], nil
+}
+
+func TestIplantGroupsClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/test-user/groups" {
+			t.Errorf("path was %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("user") != "de_grouper" {
+			t.Errorf("user was %s", r.URL.Query().Get("user"))
+		}
+		writer.Write([]byte(`{"groups":[{"name":"b:workshop"},{"name":"a:class"}]}`))
+	}))
+	defer server.Close()
+
+	client := NewIplantGroupsClient(server.URL+"/", "de_grouper")
+	groups, err := client.groupsForUser("test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a:class", "b:workshop"}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("groups were %#v instead of %#v", groups, expected)
+	}
+}
+
+func TestIplantGroupsClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		http.Error(writer, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if _, err := NewIplantGroupsClient(server.URL, "de_grouper").groupsForUser("test-user"); err == nil {
+		t.Error("an error response did not cause an error")
+	}
+}
+
+func TestEffectiveRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	mock.groups["a:class"] = `{"theme":"dark","layout":"grid","tools":{"r":true}}`
+	mock.groups["b:workshop"] = `{"layout":"list"}`
+	if err := mock.insertPreferences(username, `{"preferences":{"theme":"light","tools":{"python":true}}}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	n.defaults = map[string]interface{}{"theme": "default", "lang": "en"}
+	n.groups = mockGroupLookup{username: []string{"a:class", "b:workshop", "c:empty"}}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/%s/effective", server.URL, username), nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"theme":  "light",
+		"lang":   "en",
+		"layout": "list",
+		"tools":  map[string]interface{}{"r": true, "python": true},
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("effective preferences were %#v instead of %#v", parsed, expected)
+	}
+
+	if len(n.defaults) != 2 || n.defaults["theme"] != "default" {
+		t.Errorf("the defaults were modified: %#v", n.defaults)
+	}
+}
+
+func TestGroupRequests(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/groups/iplant:workshop", server.URL)
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	status, _ := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET returned %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, url, []byte(`{"a":"b"}`), nil)
+	if status != http.StatusForbidden {
+		t.Errorf("non-admin PUT returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, url, []byte(`{"a":"b"}`), admin)
+	if status != http.StatusOK {
+		t.Errorf("admin PUT returned %d instead of %d", status, http.StatusOK)
+	}
+
+	status, body := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK || string(body) != `{"a":"b"}` {
+		t.Errorf("GET returned %d '%s'", status, body)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, url, nil, admin)
+	if status != http.StatusOK {
+		t.Errorf("admin DELETE returned %d instead of %d", status, http.StatusOK)
+	}
+	if _, ok := mock.groups["iplant:workshop"]; ok {
+		t.Error("group preferences were not deleted")
+	}
+}
+
+func TestGetGroupPreferences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT preferences FROM user_preferences_groups WHERE group_name =").
+		WithArgs("iplant:workshop").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow("{}"))
+
+	prefs, err := p.getGroupPreferences("iplant:workshop")
+	if err != nil {
+		t.Errorf("error from getGroupPreferences(): %s", err)
+	}
+
+	if prefs != "{}" {
+		t.Errorf("preferences was %s instead of '{}'", prefs)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultHistoryLimit is the number of versions returned by the history
+// endpoint when the client doesn't ask for a specific number.
+const defaultHistoryLimit = 20
+
+// HistoryRecord is a previous version of a user's preferences. ModifiedAt is
+// when the version was written and ReplacedAt is when it was overwritten or
+// deleted.
+type HistoryRecord struct {
+	ID          int64
+	Version     int64
+	Preferences string
+	ModifiedAt  time.Time
+	ReplacedAt  time.Time
+}
+
+// historyColumns are the columns scanned by scanHistory.
+const historyColumns = `h.id,
+                   h.version,
+                   h.preferences,
+                   h.encoding,
+                   h.compressed,
+                   h.modified_at,
+                   h.replaced_at`
+
+// scanHistory scans a row containing the historyColumns.
+func (p *PrefsDB) scanHistory(row interface {
+	Scan(dest ...interface{}) error
+}) (HistoryRecord, error) {
+	var (
+		record     HistoryRecord
+		stored     sql.NullString
+		encoding   string
+		compressed []byte
+	)
+
+	err := row.Scan(&record.ID, &record.Version, &stored, &encoding, &compressed, &record.ModifiedAt, &record.ReplacedAt)
+	if err != nil {
+		return record, err
+	}
+
+	record.Preferences, err = p.decode(stored, encoding, compressed)
+	return record, err
+}
+
+// listHistory returns the page of the user's previous versions selected by
+// the filter, newest first. The time range applies to when the versions were
+// replaced.
+func (p *PrefsDB) listHistory(username string, filter PageFilter) ([]HistoryRecord, error) {
+	conditions, args := filter.conditions("h.id", "h.replaced_at", []interface{}{username})
+
+	where := ""
+	for _, condition := range conditions {
+		where += "\n               AND " + condition
+	}
+
+	args = append(args, filter.Limit)
+	query := `SELECT ` + historyColumns + `
+              FROM user_preferences_history h,
+                   ` + p.tables.usersSource() + ` u
+             WHERE h.user_id = u.id
+               AND u.username = $1` + where + `
+          ORDER BY h.id DESC
+             LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryRecord{}
+	for rows.Next() {
+		record, err := p.scanHistory(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, record)
+	}
+
+	return history, rows.Err()
+}
+
+// getHistoryVersion returns the most recently replaced copy of the version of
+// the user's preferences. sql.ErrNoRows is returned if there isn't one.
+func (p *PrefsDB) getHistoryVersion(username string, version int64) (*HistoryRecord, error) {
+	query := `SELECT ` + historyColumns + `
+              FROM user_preferences_history h,
+                   ` + p.tables.usersSource() + ` u
+             WHERE h.user_id = u.id
+               AND u.username = $1
+               AND h.version = $2
+          ORDER BY h.id DESC
+             LIMIT 1`
+
+	record, err := p.scanHistory(p.db.QueryRow(query, username, version))
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// purgeHistory deletes the versions that were replaced before the given time
+// and returns the number that were deleted. The documents of versions in
+// object storage are deleted too.
+func (p *PrefsDB) purgeHistory(before time.Time) (int64, error) {
+	var offloaded int64
+	if p.objects != nil {
+		objectQuery := `DELETE FROM user_preferences_history
+                         WHERE replaced_at < $1
+                           AND encoding = 'object'
+                     RETURNING compressed`
+		keys, err := scanObjectKeys(p.db.Query(objectQuery, before))
+		if err != nil {
+			return 0, err
+		}
+		p.deleteObjects(keys)
+		offloaded = int64(len(keys))
+	}
+
+	query := `DELETE FROM user_preferences_history WHERE replaced_at < $1`
+	result, err := p.db.Exec(query, before)
+	if err != nil {
+		return offloaded, err
+	}
+	purged, err := result.RowsAffected()
+	return offloaded + purged, err
+}
+
+// historyEntry is a single version in the history endpoint's response.
+type historyEntry struct {
+	Version     int64                  `json:"version"`
+	Preferences map[string]interface{} `json:"preferences"`
+	ModifiedAt  time.Time              `json:"modified_at"`
+	ReplacedAt  time.Time              `json:"replaced_at"`
+}
+
+// historyResponse is the JSON body returned by the history endpoint.
+type historyResponse struct {
+	History []historyEntry `json:"history"`
+	pageResponse
+}
+
+// HistoryRequest handles listing the previous versions of a user's
+// preferences, newest first, a page at a time. The page can be limited to the
+// versions replaced within a time range.
+func (u *UserPreferencesApp) HistoryRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	filter, err := parsePageFilter(r, defaultHistoryLimit, u.maxPageSize)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	records, err := u.prefs.listHistory(username, filter.peek())
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting the preferences history for user %s: %s", username, err))
+		return
+	}
+	count, page := filter.paginate(len(records), func(i int) int64 { return records[i].ID })
+	records = records[:count]
+
+	entries := make([]historyEntry, 0, len(records))
+	for _, record := range records {
+		prefs, err := convert(&UserPreferencesRecord{Preferences: record.Preferences}, false)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error parsing version %d of the preferences for user %s: %s", record.Version, username, err))
+			return
+		}
+		entries = append(entries, historyEntry{
+			Version:     record.Version,
+			Preferences: prefs,
+			ModifiedAt:  record.ModifiedAt,
+			ReplacedAt:  record.ReplacedAt,
+		})
+	}
+
+	jsoned, err := json.Marshal(&historyResponse{History: entries, pageResponse: page})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the history JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// RestoreRequest handles replacing a user's preferences with a previous
+// version from their history. The restored document is written as a new
+// version, so the restore itself can be undone the same way.
+func (u *UserPreferencesApp) RestoreRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	versionString := mux.Vars(r)["version"]
+	version, err := strconv.ParseInt(versionString, 10, 64)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Invalid version: %s", versionString))
+		return
+	}
+
+	record, err := u.prefs.getHistoryVersion(username, version)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Version %d of the preferences for user %s was not found", version, username))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting version %d of the preferences for user %s: %s", version, username, err))
+		return
+	}
+
+	log.Infof("Restoring version %d of the preferences for user %s", version, username)
+	created, ok := u.restoreHistory(writer, r, username, record)
+	if !ok {
+		return
+	}
+
+	u.writeStoredPreferences(writer, r, username, created, nil)
+}
+
+// restoreHistory writes the version from the user's history back as a new
+// version, keeping the values of any locked keys. It returns whether the
+// preferences were created, or false if an error response was written.
+func (u *UserPreferencesApp) restoreHistory(writer http.ResponseWriter, r *http.Request, username string, record *HistoryRecord) (bool, bool) {
+	values, err := convert(&UserPreferencesRecord{Preferences: record.Preferences}, false)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error parsing version %d of the preferences for user %s: %s", record.Version, username, err))
+		return false, false
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	values, ok := u.applyLocks(writer, r, username, values)
+	if !ok {
+		return false, false
+	}
+
+	created, err := u.storePreferences(username, values)
+	if err != nil {
+		storeFailed(writer, err)
+		return false, false
+	}
+	return created, true
+}
+
+// purgeHistory removes the versions that have been kept longer than the
+// retention period.
+func (u *UserPreferencesApp) purgeHistory(now time.Time) (int, error) {
+	purged, err := u.prefs.purgeHistory(now.Add(-u.historyRetention))
+	if err != nil {
+		return 0, fmt.Errorf("Error purging the preferences history: %s", err)
+	}
+	return int(purged), nil
+}
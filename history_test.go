@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHistoryRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"v":1}`)
+	mock.insertPreferences("test-user", `{"v":2}`)
+	mock.insertPreferences("test-user", `{"preferences":{"v":3}}`)
+	mock.insertPreferences("test-user", `{"v":4}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/test-user/history?limit=2", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("getting the history returned %d", status)
+	}
+
+	var history struct {
+		History []historyEntry `json:"history"`
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.History) != 2 {
+		t.Fatalf("%d versions were returned instead of 2", len(history.History))
+	}
+	if history.History[0].Version != 3 || history.History[0].Preferences["v"] != 3.0 {
+		t.Errorf("the newest version was %#v", history.History[0])
+	}
+	if history.History[1].Version != 2 {
+		t.Errorf("the second version was %#v", history.History[1])
+	}
+
+	var page pageResponse
+	json.Unmarshal(body, &page)
+	if page.NextCursor == "" {
+		t.Fatal("the first page didn't include a cursor")
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/test-user/history?limit=2&cursor="+page.NextCursor, nil, nil)
+	history.History = nil
+	json.Unmarshal(body, &history)
+	page = pageResponse{}
+	json.Unmarshal(body, &page)
+	if status != http.StatusOK || len(history.History) != 1 || history.History[0].Version != 1 || page.NextCursor != "" {
+		t.Errorf("the second page returned %d: %s", status, body)
+	}
+
+	for _, limit := range []string{"0", "-1", "x", "101"} {
+		status, _ = doRequest(t, http.MethodGet, server.URL+"/test-user/history?limit="+limit, nil, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("a limit of %s returned %d", limit, status)
+		}
+	}
+
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/nobody/history", nil, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("getting the history of a missing user returned %d", status)
+	}
+
+	for _, query := range []string{"cursor=bogus", "since=yesterday"} {
+		if status, _ = doRequest(t, http.MethodGet, server.URL+"/test-user/history?"+query, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("a request with %s returned %d", query, status)
+		}
+	}
+}
+
+func TestRestoreRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"v":1}`)
+	mock.insertPreferences("test-user", `{"v":2}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, _ := doRequest(t, http.MethodPost, server.URL+"/test-user/history/1/restore", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("restoring a version returned %d", status)
+	}
+	if stored := mock.storage["test-user"]["user-prefs"]; stored != `{"v":1}` {
+		t.Errorf("the restored preferences were %s", stored)
+	}
+	if len(mock.history["test-user"]) != 2 {
+		t.Errorf("the restore wasn't added to the history: %#v", mock.history["test-user"])
+	}
+
+	status, _ = doRequest(t, http.MethodPost, server.URL+"/test-user/history/9/restore", nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("restoring a missing version returned %d", status)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, server.URL+"/test-user/history/x/restore", nil, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("restoring an invalid version returned %d", status)
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	mock.insertPreferences("test-user", `{"v":1}`)
+	mock.insertPreferences("test-user", `{"v":2}`)
+
+	n := New(mock)
+	n.historyRetention = time.Hour
+
+	purged, err := n.purgeHistory(time.Now())
+	if err != nil || purged != 0 {
+		t.Errorf("purging recent history returned %d, %v", purged, err)
+	}
+
+	purged, err = n.purgeHistory(time.Now().Add(2 * time.Hour))
+	if err != nil || purged != 1 {
+		t.Errorf("purging old history returned %d, %v", purged, err)
+	}
+}
+
+func TestListHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	now := time.Now()
+
+	since := now.Add(-time.Hour)
+	mock.ExpectQuery("SELECT h.id, h.version, h.preferences, h.encoding, h.compressed, h.modified_at, h.replaced_at FROM user_preferences_history h, users u WHERE h.user_id = u.id AND u.username = \\$1 AND h.id < \\$2 AND h.replaced_at >= \\$3 ORDER BY h.id DESC LIMIT \\$4").
+		WithArgs("test-user", int64(7), since, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "preferences", "encoding", "compressed", "modified_at", "replaced_at"}).
+			AddRow(6, 2, `{"v":2}`, "identity", nil, now, now))
+
+	records, err := p.listHistory("test-user", PageFilter{Before: 7, Since: &since, Limit: 10})
+	if err != nil {
+		t.Fatalf("error from listHistory(): %s", err)
+	}
+	if len(records) != 1 || records[0].ID != 6 || records[0].Version != 2 || records[0].Preferences != `{"v":2}` {
+		t.Errorf("the records were %#v", records)
+	}
+
+	mock.ExpectQuery("SELECT h.id, h.version, .+ AND h.version = \\$2 ORDER BY h.id DESC LIMIT 1").
+		WithArgs("test-user", int64(5)).
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err = p.getHistoryVersion("test-user", 5); err != sql.ErrNoRows {
+		t.Errorf("getHistoryVersion() returned %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// outboundMetrics counts the requests made to other services by integration.
+// It's published at /debug/vars.
+var outboundMetrics = expvar.NewMap("outbound_http")
+
+// OutboundSettings configures the transport shared by the HTTP clients used
+// to call other services.
+type OutboundSettings struct {
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	Proxy               string
+	CAFile              string
+	InsecureSkipVerify  bool
+	Retries             int
+	RetryBackoff        time.Duration
+}
+
+// defaultOutboundSettings are used until the configuration is read, and by
+// the tests.
+var defaultOutboundSettings = OutboundSettings{
+	DialTimeout:         10 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+}
+
+// OutboundHTTP makes the HTTP clients for the service's integrations. The
+// clients share a pooled transport, so that connections to the same service
+// are reused across integrations.
+type OutboundHTTP struct {
+	transport    *http.Transport
+	retries      int
+	retryBackoff time.Duration
+}
+
+// outbound makes the clients for the integrations. It's replaced with one
+// built from the configuration at startup.
+var outbound, _ = NewOutboundHTTP(defaultOutboundSettings)
+
+// NewOutboundHTTP returns a newly created *OutboundHTTP with the settings.
+func NewOutboundHTTP(settings OutboundSettings) (*OutboundHTTP, error) {
+	proxy := http.ProxyFromEnvironment
+	if settings.Proxy != "" {
+		parsed, err := url.Parse(settings.Proxy)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("Invalid outbound HTTP proxy %q", settings.Proxy)
+		}
+		proxy = http.ProxyURL(parsed)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.InsecureSkipVerify}
+	if settings.CAFile != "" {
+		pem, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the outbound HTTP CA file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("The outbound HTTP CA file %s doesn't contain any certificates", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.Retries < 0 {
+		return nil, fmt.Errorf("The outbound HTTP retries can't be negative")
+	}
+
+	return &OutboundHTTP{
+		transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           (&net.Dialer{Timeout: settings.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+			IdleConnTimeout:       settings.IdleConnTimeout,
+			MaxIdleConns:          settings.MaxIdleConns,
+			MaxIdleConnsPerHost:   settings.MaxIdleConnsPerHost,
+			ExpectContinueTimeout: time.Second,
+		},
+		retries:      settings.Retries,
+		retryBackoff: settings.RetryBackoff,
+	}, nil
+}
+
+// outboundConfig returns the OutboundHTTP described by the configuration.
+func outboundConfig(cfg *viper.Viper) (*OutboundHTTP, error) {
+	return NewOutboundHTTP(OutboundSettings{
+		DialTimeout:         cfg.GetDuration("user-preferences.http-client.dial-timeout"),
+		TLSHandshakeTimeout: cfg.GetDuration("user-preferences.http-client.tls-handshake-timeout"),
+		IdleConnTimeout:     cfg.GetDuration("user-preferences.http-client.idle-conn-timeout"),
+		MaxIdleConns:        cfg.GetInt("user-preferences.http-client.max-idle-conns"),
+		MaxIdleConnsPerHost: cfg.GetInt("user-preferences.http-client.max-idle-conns-per-host"),
+		Proxy:               cfg.GetString("user-preferences.http-client.proxy"),
+		CAFile:              cfg.GetString("user-preferences.http-client.ca-file"),
+		InsecureSkipVerify:  cfg.GetBool("user-preferences.http-client.insecure-skip-verify"),
+		Retries:             cfg.GetInt("user-preferences.http-client.retries"),
+		RetryBackoff:        cfg.GetDuration("user-preferences.http-client.retry-backoff"),
+	})
+}
+
+// client returns a client for the named integration whose requests give up
+// after the timeout. Its requests are counted under the name.
+func (o *OutboundHTTP) client(name string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &outboundTransport{
+			name:         name,
+			base:         o.transport,
+			retries:      o.retries,
+			retryBackoff: o.retryBackoff,
+		},
+	}
+}
+
+// outboundTransport counts an integration's requests and retries the ones
+// that are safe to repeat.
+type outboundTransport struct {
+	name         string
+	base         http.RoundTripper
+	retries      int
+	retryBackoff time.Duration
+}
+
+// retryable returns whether the request can be sent again: its method has to
+// be idempotent, and its body, if any, has to be replayable.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return false
+	}
+}
+
+// retryStatus returns whether the response status suggests that the request
+// may succeed if it's sent again.
+func retryStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// RoundTrip sends the request, retrying idempotent requests that fail to
+// connect or get a 502, 503, or 504 response.
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	outboundMetrics.Add(t.name+".requests", 1)
+	defer func() {
+		outboundMetrics.Add(t.name+".duration_ms", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+	}()
+
+	attempts := 1
+	if retryable(req) {
+		attempts += t.retries
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= attempts || (err == nil && !retryStatus(resp.StatusCode)) {
+			if err != nil || resp.StatusCode >= 500 {
+				outboundMetrics.Add(t.name+".failures", 1)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			outboundMetrics.Add(t.name+".failures", 1)
+			return nil, req.Context().Err()
+		case <-time.After(t.retryBackoff << uint(attempt-1)):
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				outboundMetrics.Add(t.name+".failures", 1)
+				return nil, err
+			}
+			retry := req.Clone(req.Context())
+			retry.Body = body
+			req = retry
+		}
+		outboundMetrics.Add(t.name+".retries", 1)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer returns a server that responds with 503 to the first failures
+// requests and 200 after that, and the count of the requests it received.
+func flakyServer(failures int32) (*httptest.Server, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &count
+}
+
+func testOutbound(t *testing.T, retries int) *OutboundHTTP {
+	settings := defaultOutboundSettings
+	settings.Retries = retries
+	settings.RetryBackoff = time.Millisecond
+	o, err := NewOutboundHTTP(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOutboundRetries(t *testing.T) {
+	server, count := flakyServer(2)
+	defer server.Close()
+
+	client := testOutbound(t, 2).client("test-retries", time.Second)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(count) != 3 {
+		t.Errorf("the GET returned %d after %d requests", resp.StatusCode, atomic.LoadInt32(count))
+	}
+
+	if retries := outboundMetrics.Get("test-retries.retries"); retries == nil || retries.String() != "2" {
+		t.Errorf("the retries were counted as %v", retries)
+	}
+	if requests := outboundMetrics.Get("test-retries.requests"); requests == nil || requests.String() != "1" {
+		t.Errorf("the requests were counted as %v", requests)
+	}
+}
+
+func TestOutboundRetriesBody(t *testing.T) {
+	var bodies []string
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		bodies = append(bodies, buf.String())
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewBufferString("object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := testOutbound(t, 1).client("test-body", time.Second).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(bodies) != 2 || bodies[1] != "object" {
+		t.Errorf("the PUT returned %d with the bodies %q", resp.StatusCode, bodies)
+	}
+}
+
+func TestOutboundDoesNotRetryPost(t *testing.T) {
+	server, count := flakyServer(1)
+	defer server.Close()
+
+	client := testOutbound(t, 2).client("test-post", time.Second)
+	resp, err := client.Post(server.URL, "application/json", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(count) != 1 {
+		t.Errorf("the POST returned %d after %d requests", resp.StatusCode, atomic.LoadInt32(count))
+	}
+	if failures := outboundMetrics.Get("test-post.failures"); failures == nil || failures.String() != "1" {
+		t.Errorf("the failures were counted as %v", failures)
+	}
+}
+
+func TestNewOutboundHTTPInvalid(t *testing.T) {
+	settings := defaultOutboundSettings
+	settings.Proxy = "not a proxy"
+	if _, err := NewOutboundHTTP(settings); err == nil {
+		t.Error("an invalid proxy was accepted")
+	}
+
+	settings = defaultOutboundSettings
+	settings.CAFile = "/nonexistent/ca.pem"
+	if _, err := NewOutboundHTTP(settings); err == nil {
+		t.Error("a missing CA file was accepted")
+	}
+
+	settings = defaultOutboundSettings
+	settings.Retries = -1
+	if _, err := NewOutboundHTTP(settings); err == nil {
+		t.Error("negative retries were accepted")
+	}
+}
+
+func TestOutboundConfig(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  http-client:\n    proxy: http://proxy:3128\n    retries: 5\n")
+	o, err := outboundConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.retries != 5 || o.retryBackoff != 200*time.Millisecond || o.transport.MaxIdleConnsPerHost != 10 {
+		t.Errorf("the configured client had %d retries, a %s backoff, and %d idle connections per host",
+			o.retries, o.retryBackoff, o.transport.MaxIdleConnsPerHost)
+	}
+}
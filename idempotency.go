@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// idempotencyKeyHeader is the request header clients use to make a mutating
+// request safe to retry.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader is set on responses that were replayed from a
+// previous request with the same idempotency key.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// IdempotentResponse is the stored response to a request that included an
+// idempotency key. The key is reserved with a pending response while the
+// request is being handled. Username is the user named in the request's route,
+// if there is one; keys are only unique for each user, so that one user's key
+// can't collide with another's.
+type IdempotentResponse struct {
+	Key         string
+	RequestHash string
+	Username    string
+	Pending     bool
+	Status      int
+	ContentType string
+	Headers     http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// getIdempotentResponse returns the stored response for the user's idempotency
+// key. sql.ErrNoRows is returned if there isn't one.
+func (p *PrefsDB) getIdempotentResponse(username, key string) (*IdempotentResponse, error) {
+	query := `SELECT idempotency_key,
+                   request_hash,
+                   username,
+                   pending,
+                   status,
+                   content_type,
+                   headers,
+                   body,
+                   created_at
+              FROM user_preferences_idempotency
+             WHERE username = $1
+               AND idempotency_key = $2`
+
+	var (
+		resp    IdempotentResponse
+		headers string
+	)
+	err := p.db.QueryRow(query, username, key).Scan(
+		&resp.Key,
+		&resp.RequestHash,
+		&resp.Username,
+		&resp.Pending,
+		&resp.Status,
+		&resp.ContentType,
+		&headers,
+		&resp.Body,
+		&resp.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(headers), &resp.Headers); err != nil {
+		return nil, fmt.Errorf("Error parsing the stored headers for idempotency key %s: %s", key, err)
+	}
+	return &resp, nil
+}
+
+// reserveIdempotencyKey stores a pending response for the user's idempotency
+// key and returns true, unless a response created at or after expiredBefore is already
+// stored for the key, in which case it returns false. Expired responses are
+// replaced.
+func (p *PrefsDB) reserveIdempotencyKey(resp *IdempotentResponse, expiredBefore time.Time) (bool, error) {
+	query := `INSERT INTO user_preferences_idempotency
+                          (idempotency_key, request_hash, username, pending, status, content_type, headers, body, created_at)
+                   VALUES ($1, $2, $3, true, 0, '', '{}', '', $4)
+              ON CONFLICT (username, idempotency_key) DO UPDATE
+                      SET request_hash = EXCLUDED.request_hash,
+                          pending = true,
+                          status = 0,
+                          content_type = '',
+                          headers = '{}',
+                          body = '',
+                          created_at = EXCLUDED.created_at
+                    WHERE user_preferences_idempotency.created_at < $5`
+	result, err := p.db.Exec(query, resp.Key, resp.RequestHash, resp.Username, resp.CreatedAt, expiredBefore)
+	if err != nil {
+		return false, err
+	}
+	reserved, err := result.RowsAffected()
+	return reserved > 0, err
+}
+
+// saveIdempotentResponse completes the reservation for a user's idempotency key
+// with the response to its request.
+func (p *PrefsDB) saveIdempotentResponse(resp *IdempotentResponse) error {
+	headers, err := json.Marshal(resp.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE user_preferences_idempotency
+                 SET pending = false,
+                     status = $3,
+                     content_type = $4,
+                     headers = $5,
+                     body = $6
+               WHERE username = $1
+                 AND idempotency_key = $2`
+	_, err = p.db.Exec(query, resp.Username, resp.Key, resp.Status, resp.ContentType, string(headers), resp.Body)
+	return err
+}
+
+// releaseIdempotencyKey deletes the reservation for a user's idempotency key
+// whose request failed, so that it can be retried. Completed responses are left
+// alone.
+func (p *PrefsDB) releaseIdempotencyKey(username, key string) error {
+	query := `DELETE FROM user_preferences_idempotency
+                    WHERE username = $1
+                      AND idempotency_key = $2
+                      AND pending`
+	_, err := p.db.Exec(query, username, key)
+	return err
+}
+
+// purgeIdempotentResponses deletes the responses stored before the given time
+// and returns the number that were deleted.
+func (p *PrefsDB) purgeIdempotentResponses(before time.Time) (int64, error) {
+	query := `DELETE FROM user_preferences_idempotency WHERE created_at < $1`
+	result, err := p.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// requestHash identifies the request by its method, path, query, and body, so
+// that a reused idempotency key with a different request can be detected. The
+// query is included because the legacy routes name the user in it.
+func requestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter passes a response through to the underlying writer while
+// keeping a copy of the status and body.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// changedHeaders returns the headers in after that aren't the same in before,
+// which are the ones a handler set rather than the middleware wrapping it.
+func changedHeaders(before, after http.Header) http.Header {
+	changed := make(http.Header)
+	for name, values := range after {
+		if !reflect.DeepEqual(before[name], values) {
+			changed[name] = append([]string(nil), values...)
+		}
+	}
+	return changed
+}
+
+// copyHeaders returns a copy of the headers.
+func copyHeaders(h http.Header) http.Header {
+	copied := make(http.Header, len(h))
+	for name, values := range h {
+		copied[name] = append([]string(nil), values...)
+	}
+	return copied
+}
+
+// idempotent wraps a mutating handler so that requests with an idempotency key
+// are only applied once within the idempotency window. The key is reserved
+// before the request is handled; retries with the same key and request get a
+// 409 while the original is in flight and the original response, headers
+// included, once it's done. Reusing a key for a different request is rejected
+// with a 422.
+func (u *UserPreferencesApp) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || u.idempotencyWindow <= 0 {
+			h(writer, r)
+			return
+		}
+
+		// Stored responses skip the handler's own checks, so the caller has to
+		// be allowed to act for the user before anything is replayed to them.
+		// The administrative routes are checked by adminOnly before this. The
+		// handler is given the resolved username, so the checks aren't
+		// repeated.
+		var username string
+		if _, ok := mux.Vars(r)["username"]; ok {
+			if username, ok = u.pathUsername(writer, r); !ok {
+				return
+			}
+			r = withPathUsername(r, username)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error reading body: %s", err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := requestHash(r, body)
+
+		now := time.Now()
+		reservation := &IdempotentResponse{Key: key, RequestHash: hash, Username: username, Pending: true, CreatedAt: now}
+		reserved, err := u.prefs.reserveIdempotencyKey(reservation, now.Add(-u.idempotencyWindow))
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error reserving idempotency key %s: %s", key, err))
+			return
+		}
+		if !reserved {
+			u.replayIdempotentResponse(writer, username, key, hash)
+			return
+		}
+
+		// The reservation is released unless the response is stored, including
+		// when the handler panics, so that the client can retry.
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+			if err := u.prefs.releaseIdempotencyKey(username, key); err != nil {
+				log.Errorf("Error releasing idempotency key %s: %s", key, err)
+			}
+		}()
+
+		before := copyHeaders(writer.Header())
+		recorder := &recordingWriter{ResponseWriter: writer}
+		h(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// Server errors aren't stored so that the client can retry them.
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+
+		resp := &IdempotentResponse{
+			Key:         key,
+			RequestHash: hash,
+			Username:    username,
+			Status:      recorder.status,
+			ContentType: writer.Header().Get("Content-Type"),
+			Headers:     changedHeaders(before, writer.Header()),
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   now,
+		}
+		if err = u.prefs.saveIdempotentResponse(resp); err != nil {
+			log.Errorf("Error storing the response for idempotency key %s: %s", key, err)
+			return
+		}
+		stored = true
+	}
+}
+
+// replayIdempotentResponse writes out the response stored for a user's
+// idempotency key that couldn't be reserved.
+func (u *UserPreferencesApp) replayIdempotentResponse(writer http.ResponseWriter, username, key, hash string) {
+	stored, err := u.prefs.getIdempotentResponse(username, key)
+	switch {
+	case err == sql.ErrNoRows:
+		// The reservation was released by a failed request after this one
+		// tried to make its own.
+		conflict(writer, fmt.Sprintf("The request with idempotency key %s failed; retry it", key))
+		return
+	case err != nil:
+		errored(writer, fmt.Sprintf("Error looking up idempotency key %s: %s", key, err))
+		return
+	case stored.RequestHash != hash:
+		msg := fmt.Sprintf("Idempotency key %s was already used for a different request", key)
+		http.Error(writer, msg, http.StatusUnprocessableEntity)
+		log.Error(msg)
+		return
+	case stored.Pending:
+		conflict(writer, fmt.Sprintf("A request with idempotency key %s is still in progress", key))
+		return
+	}
+
+	log.Infof("Replaying the response for idempotency key %s", key)
+	for name, values := range stored.Headers {
+		writer.Header()[name] = values
+	}
+	if len(stored.Headers) == 0 && stored.ContentType != "" {
+		writer.Header().Set("Content-Type", stored.ContentType)
+	}
+	writer.Header().Set(idempotentReplayedHeader, "true")
+	writer.WriteHeader(stored.Status)
+	writer.Write(stored.Body)
+}
+
+// purgeIdempotentResponses removes the stored responses that have fallen out
+// of the idempotency window.
+func (u *UserPreferencesApp) purgeIdempotentResponses(now time.Time) (int, error) {
+	purged, err := u.prefs.purgeIdempotentResponses(now.Add(-u.idempotencyWindow))
+	if err != nil {
+		return 0, fmt.Errorf("Error purging idempotent responses: %s", err)
+	}
+	return int(purged), nil
+}
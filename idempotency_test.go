@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/flags/beta/toggle", server.URL, username)
+	headers := map[string]string{idempotencyKeyHeader: "key-1"}
+
+	status, first := doRequest(t, http.MethodPost, url, nil, headers)
+	if status != http.StatusOK || string(first) != `{"enabled":true}` {
+		t.Errorf("first toggle returned %d '%s'", status, first)
+	}
+
+	status, second := doRequest(t, http.MethodPost, url, nil, headers)
+	if status != http.StatusOK || string(second) != string(first) {
+		t.Errorf("retried toggle returned %d '%s' instead of '%s'", status, second, first)
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["beta"] != true {
+		t.Error("the retried toggle was applied twice")
+	}
+
+	status, third := doRequest(t, http.MethodPost, url, nil, map[string]string{idempotencyKeyHeader: "key-2"})
+	if status != http.StatusOK || string(third) != `{"enabled":false}` {
+		t.Errorf("toggle with a new key returned %d '%s'", status, third)
+	}
+}
+
+func TestIdempotentKeyReuse(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	headers := map[string]string{idempotencyKeyHeader: "key-1"}
+
+	status, _ := doRequest(t, http.MethodPost, url, []byte(`{"a":"b"}`), headers)
+	if status != http.StatusCreated {
+		t.Errorf("first POST returned %d", status)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"a":"c"}`), headers)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("POST reusing a key returned %d instead of %d", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotentExpiredWindow(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	n.idempotencyWindow = time.Minute
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	mock.idem[idemKey(username, "old-key")] = &IdempotentResponse{
+		Key:         "old-key",
+		Username:    username,
+		RequestHash: "something else",
+		Status:      http.StatusOK,
+		Body:        []byte("stale"),
+		CreatedAt:   time.Now().Add(-time.Hour),
+	}
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	status, body := doRequest(t, http.MethodPost, url, []byte(`{"a":"b"}`), map[string]string{idempotencyKeyHeader: "old-key"})
+	if status != http.StatusCreated || string(body) == "stale" {
+		t.Errorf("POST with an expired key returned %d '%s'", status, body)
+	}
+
+	purged, err := n.purgeIdempotentResponses(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || len(mock.idem) != 0 {
+		t.Errorf("%d responses were purged, leaving %d", purged, len(mock.idem))
+	}
+}
+
+func TestIdempotentServerErrorNotStored(t *testing.T) {
+	n := New(NewMockDB())
+	handler := n.idempotent(func(writer http.ResponseWriter, r *http.Request) {
+		errored(writer, "broken")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	handler(httptest.NewRecorder(), req)
+
+	if _, err := n.prefs.getIdempotentResponse("", "key-1"); err == nil {
+		t.Error("a server error response was stored")
+	}
+}
+
+func TestIdempotentHeadersReplayed(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	put := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%s", server.URL, username), strings.NewReader(`{"a":"b"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	first := put()
+	second := put()
+	if second.StatusCode != first.StatusCode || second.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("the retried PUT returned %d, replayed %q", second.StatusCode, second.Header.Get(idempotentReplayedHeader))
+	}
+	for _, name := range []string{"Location", versionHeader, valueHashHeader} {
+		if first.Header.Get(name) == "" || second.Header.Get(name) != first.Header.Get(name) {
+			t.Errorf("%s was replayed as %q instead of %q", name, second.Header.Get(name), first.Header.Get(name))
+		}
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	n := New(NewMockDB())
+
+	var retried int
+	var handler http.HandlerFunc
+	handler = n.idempotent(func(writer http.ResponseWriter, r *http.Request) {
+		// Retry the request while the original is still being handled.
+		retry := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		handler(retry, req)
+		retried = retry.Code
+
+		writer.WriteHeader(http.StatusCreated)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/test-user", nil)
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+
+	if recorder.Code != http.StatusCreated || retried != http.StatusConflict {
+		t.Errorf("the original request returned %d and the retry %d", recorder.Code, retried)
+	}
+	if stored, err := n.prefs.getIdempotentResponse("", "key-1"); err != nil || stored.Pending || stored.Status != http.StatusCreated {
+		t.Errorf("the stored response was %+v, %v", stored, err)
+	}
+}
+
+func TestIdempotentReplayAuthorized(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/alice", server.URL)
+	headers := map[string]string{idempotencyKeyHeader: "key-1"}
+
+	n.auth = fixedAuthenticator{username: "alice"}
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"a":"b"}`), headers); status != http.StatusCreated {
+		t.Fatalf("alice's PUT returned %d", status)
+	}
+
+	n.auth = fixedAuthenticator{username: "mallory"}
+	if status, body := doRequest(t, http.MethodPut, url, []byte(`{"a":"b"}`), headers); status != http.StatusForbidden {
+		t.Errorf("replaying alice's PUT to another user returned %d '%s'", status, body)
+	}
+}
+
+func TestIdempotentKeysPerUser(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{idempotencyKeyHeader: "key-1"}
+	if status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"a":"b"}`), headers); status != http.StatusCreated {
+		t.Fatalf("alice's PUT returned %d", status)
+	}
+	if status, body := doRequest(t, http.MethodPut, server.URL+"/bob", []byte(`{"c":"d"}`), headers); status != http.StatusCreated {
+		t.Errorf("bob's PUT with the same key returned %d '%s'", status, body)
+	}
+	if stored, _ := n.loadPreferences("bob"); stored["c"] != "d" {
+		t.Errorf("bob's preferences were %v", stored)
+	}
+}
+
+// pathUsernameCountingDB counts the calls to restorePreferences, which
+// pathUsername makes for every request while archiving is enabled.
+type pathUsernameCountingDB struct {
+	*MockDB
+	restores int
+}
+
+func (c *pathUsernameCountingDB) restorePreferences(username string) (bool, error) {
+	c.restores++
+	return c.MockDB.restorePreferences(username)
+}
+
+func TestIdempotentUsernameResolvedOnce(t *testing.T) {
+	mock := &pathUsernameCountingDB{MockDB: NewMockDB()}
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.archiving = true
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{idempotencyKeyHeader: "key-1"}
+	if status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"a":"b"}`), headers); status != http.StatusCreated {
+		t.Fatalf("the PUT returned %d", status)
+	}
+	if mock.restores != 1 {
+		t.Errorf("the username was resolved %d times", mock.restores)
+	}
+}
+
+func TestIdempotentQueryHashed(t *testing.T) {
+	get := func(target string) string {
+		return requestHash(httptest.NewRequest(http.MethodPost, target, nil), nil)
+	}
+	if get("/secured/preferences?user=alice") == get("/secured/preferences?user=bob") {
+		t.Error("requests for different users in the query hashed the same")
+	}
+}
+
+func TestGetIdempotentResponse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	createdAt := time.Now()
+
+	mock.ExpectQuery("SELECT idempotency_key, request_hash, username, pending, status, content_type, headers, body, created_at FROM user_preferences_idempotency WHERE username = \\$1 AND idempotency_key = \\$2").
+		WithArgs("alice", "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "request_hash", "username", "pending", "status", "content_type", "headers", "body", "created_at"}).
+			AddRow("key-1", "hash", "alice", false, 200, "application/json", `{"Location":["/alice"]}`, []byte("{}"), createdAt))
+
+	resp, err := p.getIdempotentResponse("alice", "key-1")
+	if err != nil {
+		t.Fatalf("error from getIdempotentResponse(): %s", err)
+	}
+
+	if resp.RequestHash != "hash" || resp.Username != "alice" || resp.Status != 200 || string(resp.Body) != "{}" || resp.Headers.Get("Location") != "/alice" {
+		t.Errorf("response was %#v", resp)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	now := time.Now()
+	resp := &IdempotentResponse{Key: "key-1", RequestHash: "hash", Username: "alice", Pending: true, CreatedAt: now}
+
+	mock.ExpectExec("INSERT INTO user_preferences_idempotency .* ON CONFLICT \\(username, idempotency_key\\) DO UPDATE .* WHERE user_preferences_idempotency.created_at <").
+		WithArgs("key-1", "hash", "alice", now, now.Add(-time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_preferences_idempotency").
+		WithArgs("key-1", "hash", "alice", now, now.Add(-time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_preferences_idempotency WHERE username = \\$1 AND idempotency_key = \\$2 AND pending").
+		WithArgs("alice", "key-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if reserved, err := p.reserveIdempotencyKey(resp, now.Add(-time.Minute)); err != nil || !reserved {
+		t.Errorf("the first reservation returned %t, %v", reserved, err)
+	}
+	if reserved, err := p.reserveIdempotencyKey(resp, now.Add(-time.Minute)); err != nil || reserved {
+		t.Errorf("the second reservation returned %t, %v", reserved, err)
+	}
+	if err = p.releaseIdempotencyKey("alice", "key-1"); err != nil {
+		t.Error(err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ImmutableKeys contains the preference keys that users may set once but not
+// change or remove afterwards, such as the keys filled in during signup. Only
+// administrative callers may modify them once they're set. Keys may be dotted
+// paths into nested objects.
+type ImmutableKeys struct {
+	keys []string
+}
+
+// NewImmutableKeys returns a newly created *ImmutableKeys.
+func NewImmutableKeys(keys []string) *ImmutableKeys {
+	return &ImmutableKeys{keys: keys}
+}
+
+// immutableViolation is an immutable key that a write tried to modify.
+type immutableViolation struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// violations returns the immutable keys that are set in the stored document
+// and would be changed or removed by the incoming document.
+func (k *ImmutableKeys) violations(stored, incoming map[string]interface{}) []immutableViolation {
+	var violations []immutableViolation
+	for _, key := range k.keys {
+		storedValue, ok := getPath(stored, key)
+		if !ok {
+			continue
+		}
+
+		incomingValue, ok := getPath(incoming, key)
+		switch {
+		case !ok:
+			violations = append(violations, immutableViolation{Key: key, Reason: "removed"})
+		case !reflect.DeepEqual(storedValue, incomingValue):
+			violations = append(violations, immutableViolation{Key: key, Reason: "changed"})
+		}
+	}
+	return violations
+}
+
+// immutableRejection is the JSON body returned when a write is rejected for
+// modifying immutable keys.
+type immutableRejection struct {
+	Error string               `json:"error"`
+	Keys  []immutableViolation `json:"keys"`
+}
+
+// rejectImmutable writes out a 403 listing the immutable keys the write tried
+// to modify.
+func rejectImmutable(writer http.ResponseWriter, username string, violations []immutableViolation) {
+	keys := make([]string, len(violations))
+	for i, v := range violations {
+		keys[i] = v.Key
+	}
+	msg := fmt.Sprintf("Immutable preferences cannot be modified for user %s: %s", username, strings.Join(keys, ", "))
+	log.Error(msg)
+
+	jsoned, err := json.Marshal(&immutableRejection{Error: msg, Keys: violations})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating immutable key JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusForbidden)
+	writer.Write(jsoned)
+}
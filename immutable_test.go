@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestImmutableViolations(t *testing.T) {
+	keys := NewImmutableKeys([]string{"home", "signup.source", "unset"})
+	stored := map[string]interface{}{
+		"home":   "/iplant/home/alice",
+		"signup": map[string]interface{}{"source": "portal"},
+	}
+
+	incoming := map[string]interface{}{
+		"home":   "/iplant/home/alice",
+		"signup": map[string]interface{}{"source": "portal"},
+		"unset":  "anything",
+	}
+	if violations := keys.violations(stored, incoming); len(violations) != 0 {
+		t.Errorf("a write setting an unset key had violations %#v", violations)
+	}
+
+	incoming = map[string]interface{}{"home": "/iplant/home/bob"}
+	expected := []immutableViolation{
+		{Key: "home", Reason: "changed"},
+		{Key: "signup.source", Reason: "removed"},
+	}
+	if violations := keys.violations(stored, incoming); !reflect.DeepEqual(violations, expected) {
+		t.Errorf("the violations were %#v", violations)
+	}
+}
+
+func TestImmutableWrites(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.immutable = NewImmutableKeys([]string{"home"})
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	status, _ := doRequest(t, http.MethodPut, url, []byte(`{"home":"/iplant/home/a"}`), nil)
+	if status != http.StatusCreated {
+		t.Errorf("setting an immutable key for the first time returned %d", status)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"home":"/iplant/home/a","theme":"dark"}`), nil)
+	if status != http.StatusOK {
+		t.Errorf("POST leaving an immutable key alone returned %d", status)
+	}
+
+	status, body := doRequest(t, http.MethodPost, url, []byte(`{"home":"/iplant/home/b"}`), nil)
+	var rejection immutableRejection
+	if err := json.Unmarshal(body, &rejection); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden || !reflect.DeepEqual(rejection.Keys, []immutableViolation{{Key: "home", Reason: "changed"}}) {
+		t.Errorf("POST changing an immutable key returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusForbidden {
+		t.Errorf("DELETE removing an immutable key returned %d", status)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"home":"/iplant/home/b"}`), map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Errorf("admin POST changing an immutable key returned %d", status)
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["home"] != "/iplant/home/b" {
+		t.Errorf("the stored preferences were %#v", stored)
+	}
+}
+
+func TestImmutableWithStrippedLocks(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"home":"/a","beta":false}`)
+
+	n := New(mock)
+	n.locks, _ = NewKeyLocks([]string{"beta"}, lockPolicyStrip)
+	n.immutable = NewImmutableKeys([]string{"home"})
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"home":"/b","beta":false}`), nil); status != http.StatusForbidden {
+		t.Errorf("changing an immutable key with the strip lock policy returned %d", status)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// impersonateUserHeader is the request header administrative callers use to
+// act on behalf of a user, such as when support staff adjust the settings of a
+// user who can't log in.
+const impersonateUserHeader = "X-Impersonate-User"
+
+// impersonate checks a request made on behalf of another user, writing an
+// error response and returning false unless impersonation is enabled, the
+// caller is an administrator, and the request is for the impersonated user.
+// Each allowed request is recorded in the audit log.
+func (u *UserPreferencesApp) impersonate(writer http.ResponseWriter, r *http.Request, username string) bool {
+	impersonated := r.Header.Get(impersonateUserHeader)
+
+	if !u.impersonation {
+		forbidden(writer, "Impersonation is disabled")
+		return false
+	}
+	if !u.isAdmin(r) {
+		forbidden(writer, "Impersonation requires administrative access")
+		return false
+	}
+	if !u.sameUser(impersonated, username) {
+		forbidden(writer, fmt.Sprintf("A request impersonating user %s may not access the preferences of user %s", impersonated, username))
+		return false
+	}
+
+	err := u.audit("impersonate", map[string]string{
+		"user":        username,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"remote_addr": r.RemoteAddr,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImpersonation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.auth = fixedAuthenticator{username: "bob"}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	admin := map[string]string{adminKeyHeader: "secret", impersonateUserHeader: "alice"}
+	if status, body := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"dark"}`), admin); status != http.StatusCreated {
+		t.Errorf("an impersonated write returned %d: %s", status, body)
+	}
+	if len(mock.audits) != 1 || !strings.HasPrefix(mock.audits[0], "impersonate ") || !strings.Contains(mock.audits[0], `"user":"alice"`) {
+		t.Errorf("the impersonated write wasn't audited: %v", mock.audits)
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/bob", nil, admin); status != http.StatusForbidden {
+		t.Errorf("a request for a user other than the impersonated one returned %d", status)
+	}
+
+	user := map[string]string{impersonateUserHeader: "alice"}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, user); status != http.StatusForbidden {
+		t.Errorf("an impersonated request without the admin key returned %d", status)
+	}
+
+	n.impersonation = false
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, admin); status != http.StatusForbidden {
+		t.Errorf("an impersonated request while impersonation was disabled returned %d", status)
+	}
+	if len(mock.audits) != 1 {
+		t.Errorf("rejected impersonations were audited: %v", mock.audits)
+	}
+}
@@ -0,0 +1,330 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// integrationDBEnv names the environment variable containing the URI of the
+// PostgreSQL database used by the integration tests. Each test run creates and
+// drops its own schema, so the database may be shared. The database isn't
+// started with testcontainers, which needs Go modules rather than the vendor
+// directory the service is built from.
+const integrationDBEnv = "USER_PREFERENCES_TEST_DB"
+
+// integrationCluster is a set of service instances, each with its own database
+// connection pool, backed by a single schema in a real database.
+type integrationCluster struct {
+	admin     *sql.DB
+	schema    string
+	dbs       []*sql.DB
+	instances []*httptest.Server
+}
+
+const integrationBaseSchema = `
+CREATE TABLE users (
+    id uuid NOT NULL PRIMARY KEY DEFAULT gen_random_uuid(),
+    username text NOT NULL UNIQUE
+);
+
+CREATE TABLE user_preferences (
+    id uuid NOT NULL PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users(id),
+    preferences text NOT NULL
+);
+`
+
+// newIntegrationCluster creates a schema containing the base tables, applies
+// the migrations, and starts the given number of service instances against it.
+func newIntegrationCluster(t testing.TB, size int) *integrationCluster {
+	dburi := os.Getenv(integrationDBEnv)
+	if dburi == "" {
+		t.Skipf("%s is not set", integrationDBEnv)
+	}
+	return startIntegrationCluster(t, dburi, size, func(db DB) DB { return db })
+}
+
+// startIntegrationCluster sets up a cluster in the database. Each instance's
+// storage is passed through wrap.
+func startIntegrationCluster(t testing.TB, dburi string, size int, wrap func(DB) DB) *integrationCluster {
+	admin, err := sql.Open("postgres", dburi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &integrationCluster{
+		admin:  admin,
+		schema: fmt.Sprintf("user_preferences_it_%d", time.Now().UnixNano()),
+	}
+
+	if _, err = admin.Exec(fmt.Sprintf("CREATE SCHEMA %s", c.schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	schemaURI, err := withSearchPath(dburi, c.schema)
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+
+	for i := 0; i < size; i++ {
+		db, err := sql.Open("postgres", schemaURI)
+		if err != nil {
+			c.Close()
+			t.Fatal(err)
+		}
+		c.dbs = append(c.dbs, db)
+
+		if i == 0 {
+			if _, err = db.Exec(integrationBaseSchema); err != nil {
+				c.Close()
+				t.Fatal(err)
+			}
+			if err = migrate(db, migrationsFS("")); err != nil {
+				c.Close()
+				t.Fatal(err)
+			}
+		}
+
+		c.instances = append(c.instances, httptest.NewServer(New(wrap(NewPrefsDB(db)))))
+	}
+
+	return c
+}
+
+// addUser creates a user in the cluster's schema.
+func (c *integrationCluster) addUser(t testing.TB, username string) {
+	if _, err := c.dbs[0].Exec(`INSERT INTO users (username) VALUES ($1)`, username); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// url returns the URL for the path on the instance, wrapping around if the
+// index is larger than the cluster.
+func (c *integrationCluster) url(instance int, path string) string {
+	return c.instances[instance%len(c.instances)].URL + path
+}
+
+// Close stops the instances and drops the cluster's schema.
+func (c *integrationCluster) Close() {
+	for _, instance := range c.instances {
+		instance.Close()
+	}
+	for _, db := range c.dbs {
+		db.Close()
+	}
+	c.admin.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", c.schema))
+	c.admin.Close()
+}
+
+// getIntegrationPreferences reads the user's unwrapped preferences from an
+// instance. It's safe to call from goroutines other than the test's.
+func getIntegrationPreferences(t *testing.T, url string) map[string]interface{} {
+	status, body := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("GET %s returned %d: %s", url, status, body)
+		return nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		t.Errorf("GET %s returned invalid JSON: %s", url, err)
+		return nil
+	}
+	return values
+}
+
+// toggleIntegrationFlag toggles a flag through an instance, trying again while
+// the toggle fails because the preferences kept changing under it. It's safe
+// to call from goroutines other than the test's.
+func toggleIntegrationFlag(t *testing.T, url string) {
+	postIntegration(t, url, nil)
+}
+
+// postIntegration makes a POST request through an instance, trying again while
+// it fails because the preferences kept changing under it. It's safe to call
+// from goroutines other than the test's.
+func postIntegration(t *testing.T, url string, body []byte) {
+	for attempt := 0; attempt < 20; attempt++ {
+		status, response := doRequest(t, http.MethodPost, url, body, nil)
+		if status == http.StatusOK {
+			return
+		}
+		if status != http.StatusConflict {
+			t.Errorf("POST %s returned %d: %s", url, status, response)
+			return
+		}
+	}
+	t.Errorf("POST %s kept conflicting with other writes", url)
+}
+
+// TestIntegrationNoLostUpdates toggles a different flag from each writer, and
+// merges a different key from as many others, spread across the instances, and
+// checks that every toggle and merge was kept.
+func TestIntegrationNoLostUpdates(t *testing.T) {
+	c := newIntegrationCluster(t, 2)
+	defer c.Close()
+
+	username := "lost-updates"
+	c.addUser(t, username)
+
+	status, _ := doRequest(t, http.MethodPut, c.url(0, "/"+username), []byte(`{}`), nil)
+	if status != http.StatusCreated {
+		t.Fatalf("creating the preferences returned %d", status)
+	}
+
+	writers := 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			toggleIntegrationFlag(t, c.url(i, fmt.Sprintf("/%s/flags/flag-%d/toggle", username, i)))
+		}(i)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			postIntegration(t, c.url(i+1, "/"+username), []byte(fmt.Sprintf(`{"merged-%d":true}`, i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for instance := range c.instances {
+		values := getIntegrationPreferences(t, c.url(instance, "/"+username))
+		for i := 0; i < writers; i++ {
+			if values[fmt.Sprintf("flag-%d", i)] != true {
+				t.Errorf("instance %d lost the update to flag-%d", instance, i)
+			}
+			if values[fmt.Sprintf("merged-%d", i)] != true {
+				t.Errorf("instance %d lost the merge of merged-%d", instance, i)
+			}
+		}
+	}
+}
+
+// TestIntegrationNoStaleReads writes through one instance and immediately reads
+// through the others, while other readers poll concurrently, and checks that
+// no read returns an older value than the last acknowledged write.
+func TestIntegrationNoStaleReads(t *testing.T) {
+	c := newIntegrationCluster(t, 2)
+	defer c.Close()
+
+	username := "stale-reads"
+	c.addUser(t, username)
+
+	var (
+		mu           sync.Mutex
+		acknowledged float64
+		done         = make(chan struct{})
+		wg           sync.WaitGroup
+	)
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				mu.Lock()
+				floor := acknowledged
+				mu.Unlock()
+
+				values := getIntegrationPreferences(t, c.url(r, "/"+username))
+				if counter, ok := values["counter"].(float64); ok && counter < floor {
+					t.Errorf("reader %d saw counter %v after %v was acknowledged", r, counter, floor)
+				}
+			}
+		}(r)
+	}
+
+	for i := 1; i <= 50; i++ {
+		body := []byte(fmt.Sprintf(`{"counter":%d}`, i))
+		status, _ := doRequest(t, http.MethodPost, c.url(i, "/"+username), body, nil)
+		if status != http.StatusOK && status != http.StatusCreated {
+			t.Fatalf("write %d returned %d", i, status)
+		}
+
+		mu.Lock()
+		acknowledged = float64(i)
+		mu.Unlock()
+
+		values := getIntegrationPreferences(t, c.url(i+1, "/"+username))
+		if values["counter"] != float64(i) {
+			t.Errorf("write %d was read back as %v from another instance", i, values["counter"])
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// benchmarkStorage runs fn b.N times against the database of a single instance
+// cluster, with the user's preferences set to a representative document.
+func benchmarkStorage(b *testing.B, entries int, fn func(p *PrefsDB, doc string) error) {
+	c := newIntegrationCluster(b, 1)
+	defer c.Close()
+	c.addUser(b, "bench-user")
+
+	encoded, err := json.Marshal(representativeDocument(entries))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	p := NewPrefsDB(c.dbs[0])
+	if err = p.insertPreferences("bench-user", string(encoded)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = fn(p, string(encoded)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStorageGetPreferences(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			benchmarkStorage(b, entries, func(p *PrefsDB, doc string) error {
+				_, err := p.getPreferences("bench-user")
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkStorageUpdatePreferences(b *testing.B) {
+	for _, entries := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d", entries), func(b *testing.B) {
+			benchmarkStorage(b, entries, func(p *PrefsDB, doc string) error {
+				return p.updatePreferences("bench-user", doc)
+			})
+		})
+	}
+}
+
+func BenchmarkStorageHasPreferences(b *testing.B) {
+	benchmarkStorage(b, benchmarkSizes[0], func(p *PrefsDB, doc string) error {
+		_, err := p.hasPreferences("bench-user")
+		return err
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// jobMetrics contains the per-job counters published at /debug/vars.
+var jobMetrics = expvar.NewMap("jobs")
+
+// JobFunc performs a single run of a background job. It returns the number of
+// items the run processed, which is only used for reporting.
+type JobFunc func(now time.Time) (int, error)
+
+// JobStatus describes the current state of a background job.
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	Running      bool       `json:"running"`
+	Runs         int64      `json:"runs"`
+	Failures     int64      `json:"failures"`
+	LastStarted  *time.Time `json:"last_started,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastResult   int        `json:"last_result"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+type job struct {
+	mu       sync.Mutex
+	name     string
+	interval time.Duration
+	run      JobFunc
+	status   JobStatus
+}
+
+// execute runs the job once and records the outcome.
+func (j *job) execute(now time.Time) {
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return
+	}
+	j.status.Running = true
+	j.mu.Unlock()
+
+	started := time.Now()
+	result, err := j.run(now)
+	duration := time.Since(started)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastStarted = &started
+	j.status.LastDuration = duration.String()
+	j.status.LastResult = result
+	j.status.LastError = ""
+
+	jobMetrics.Add(j.name+".runs", 1)
+	jobMetrics.Add(j.name+".processed", int64(result))
+	jobMetrics.Add(j.name+".duration_ms", int64(duration/time.Millisecond))
+
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		jobMetrics.Add(j.name+".failures", 1)
+		log.Errorf("Job %s failed: %s", j.name, err)
+		return
+	}
+
+	if result > 0 {
+		log.Infof("Job %s processed %d items in %s", j.name, result, duration)
+	}
+}
+
+// JobRunner periodically runs background maintenance jobs.
+type JobRunner struct {
+	mu      sync.Mutex
+	jobs    []*job
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// NewJobRunner returns a newly created *JobRunner with no jobs.
+func NewJobRunner() *JobRunner {
+	return &JobRunner{}
+}
+
+// Add registers a job that runs at the given interval once the runner is
+// started. Jobs with a non-positive interval are disabled.
+func (r *JobRunner) Add(name string, interval time.Duration, run JobFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.jobs = append(r.jobs, &job{
+		name:     name,
+		interval: interval,
+		run:      run,
+		status: JobStatus{
+			Name:     name,
+			Interval: interval.String(),
+		},
+	})
+}
+
+// Start launches a goroutine for each enabled job.
+func (r *JobRunner) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stop = make(chan struct{})
+	for _, j := range r.jobs {
+		if j.interval <= 0 {
+			log.Infof("Job %s is disabled", j.name)
+			continue
+		}
+
+		r.stopped.Add(1)
+		go func(j *job, stop chan struct{}) {
+			defer r.stopped.Done()
+
+			ticker := time.NewTicker(j.interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case now := <-ticker.C:
+					j.execute(now)
+				case <-stop:
+					return
+				}
+			}
+		}(j, r.stop)
+	}
+}
+
+// Stop stops all of the running jobs and waits for any in-progress runs to
+// finish.
+func (r *JobRunner) Stop() {
+	r.mu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.mu.Unlock()
+
+	r.stopped.Wait()
+}
+
+// RunNow runs the named job immediately, returning false if there's no such
+// job.
+func (r *JobRunner) RunNow(name string) bool {
+	r.mu.Lock()
+	var found *job
+	for _, j := range r.jobs {
+		if j.name == name {
+			found = j
+		}
+	}
+	r.mu.Unlock()
+
+	if found == nil {
+		return false
+	}
+
+	found.execute(time.Now())
+	return true
+}
+
+// Status returns the status of all of the registered jobs.
+func (r *JobRunner) Status() []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+	return statuses
+}
+
+// JobsRequest handles writing out the status of the background jobs.
+func (u *UserPreferencesApp) JobsRequest(writer http.ResponseWriter, r *http.Request) {
+	jsoned, err := json.Marshal(map[string][]JobStatus{"jobs": u.jobs.Status()})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating jobs JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// RunJobRequest handles running a background job immediately and writing out
+// its status afterwards.
+func (u *UserPreferencesApp) RunJobRequest(writer http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	log.Infof("Running job %s on request", name)
+	if !u.jobs.RunNow(name) {
+		notFound(writer, fmt.Sprintf("Job %s does not exist", name))
+		return
+	}
+
+	for _, status := range u.jobs.Status() {
+		if status.Name != name {
+			continue
+		}
+
+		jsoned, err := json.Marshal(status)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error generating job JSON: %s", err))
+			return
+		}
+		writer.Write(jsoned)
+		return
+	}
+}
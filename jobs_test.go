@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobRunnerRunNow(t *testing.T) {
+	runner := NewJobRunner()
+
+	runner.Add("succeeds", time.Hour, func(now time.Time) (int, error) {
+		return 3, nil
+	})
+	runner.Add("fails", time.Hour, func(now time.Time) (int, error) {
+		return 0, errors.New("broken")
+	})
+
+	if !runner.RunNow("succeeds") || !runner.RunNow("fails") {
+		t.Error("RunNow did not find a registered job")
+	}
+
+	if runner.RunNow("missing") {
+		t.Error("RunNow found a job that wasn't registered")
+	}
+
+	statuses := runner.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("%d statuses were returned instead of 2", len(statuses))
+	}
+
+	if statuses[0].Runs != 1 || statuses[0].Failures != 0 || statuses[0].LastResult != 3 || statuses[0].LastStarted == nil {
+		t.Errorf("status of the successful job was %#v", statuses[0])
+	}
+
+	if statuses[1].Runs != 1 || statuses[1].Failures != 1 || statuses[1].LastError != "broken" {
+		t.Errorf("status of the failing job was %#v", statuses[1])
+	}
+}
+
+func TestJobRunnerStartStop(t *testing.T) {
+	var runs int64
+
+	runner := NewJobRunner()
+	runner.Add("ticks", time.Millisecond, func(now time.Time) (int, error) {
+		atomic.AddInt64(&runs, 1)
+		return 0, nil
+	})
+	runner.Add("disabled", 0, func(now time.Time) (int, error) {
+		t.Error("a disabled job was run")
+		return 0, nil
+	})
+
+	runner.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&runs) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	runner.Stop()
+
+	stoppedAt := atomic.LoadInt64(&runs)
+	if stoppedAt < 2 {
+		t.Errorf("the job only ran %d times", stoppedAt)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&runs) != stoppedAt {
+		t.Error("the job kept running after the runner was stopped")
+	}
+}
+
+func TestJobsRequest(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	n.jobs.Add("purge-expired-keys", time.Hour, n.purgeExpired)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/admin/jobs", server.URL)
+
+	status, _ := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("non-admin GET returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	status, body := doRequest(t, http.MethodGet, url, nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Errorf("admin GET returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string][]JobStatus
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed["jobs"]) != 1 || parsed["jobs"][0].Name != "purge-expired-keys" || parsed["jobs"][0].Interval != "1h0m0s" {
+		t.Errorf("jobs were %#v", parsed["jobs"])
+	}
+}
+
+func TestRunJobRequest(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	n.jobs.Add("counts", time.Hour, func(now time.Time) (int, error) {
+		return 5, nil
+	})
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	status, _ := doRequest(t, http.MethodPost, fmt.Sprintf("%s/admin/jobs/missing/run", server.URL), nil, admin)
+	if status != http.StatusNotFound {
+		t.Errorf("running a missing job returned %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, body := doRequest(t, http.MethodPost, fmt.Sprintf("%s/admin/jobs/counts/run", server.URL), nil, admin)
+	if status != http.StatusOK {
+		t.Errorf("running a job returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed JobStatus
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Runs != 1 || parsed.LastResult != 5 {
+		t.Errorf("job status was %#v", parsed)
+	}
+}
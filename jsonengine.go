@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JSONEngine encodes and decodes preferences documents. Large documents spend
+// most of their time being parsed and serialized, so the implementation can be
+// swapped for a faster one.
+type JSONEngine interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+
+	// Decode reads a single JSON document from the reader without buffering
+	// the whole stream first. It returns io.EOF if the stream is empty and
+	// errTrailingData if anything other than whitespace follows the document.
+	Decode(r io.Reader, v interface{}) error
+
+	// Encode writes the value to the writer as JSON, without a trailing
+	// newline.
+	Encode(w io.Writer, v interface{}) error
+}
+
+// errTrailingData is returned when a request body contains more than one JSON
+// document.
+var errTrailingData = errors.New("Unexpected data after the JSON document")
+
+// strictBodies causes request bodies that are decoded into structs to be
+// rejected if they contain fields the struct doesn't have.
+var strictBodies bool
+
+// stdJSON is the JSONEngine backed by encoding/json.
+type stdJSON struct{}
+
+// Marshal encodes the value as JSON.
+func (stdJSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON into the value.
+func (stdJSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Decode reads a single JSON document from the reader.
+func (stdJSON) Decode(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if strictBodies {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+
+	return nil
+}
+
+// Encode writes the value to the writer as JSON. encoding/json buffers the
+// whole document before writing it even when using a json.Encoder, so this
+// doesn't use any more memory than an Encoder would.
+func (stdJSON) Encode(w io.Writer, v interface{}) error {
+	jsoned, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(jsoned)
+	return err
+}
+
+// documentJSON is the engine used for preferences documents. Responses that
+// contain anything other than a preferences document always use encoding/json.
+var documentJSON JSONEngine = stdJSON{}
+
+// jsonEngines contains the engines compiled into the service, by name.
+// Engines with external dependencies are only compiled in when their build tag
+// is set, as in "go build -tags jsoniter".
+var jsonEngines = map[string]JSONEngine{
+	"std": stdJSON{},
+}
+
+// newJSONEngine returns the JSONEngine with the given name. An empty name
+// selects the standard library's engine.
+func newJSONEngine(name string) (JSONEngine, error) {
+	if name == "" {
+		name = "std"
+	}
+
+	engine, ok := jsonEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown JSON engine: %s; is the service built with -tags %s?", name, name)
+	}
+
+	return engine, nil
+}
+
+// decodeBody decodes a request body into v as it's read. An empty body leaves
+// v unchanged.
+func decodeBody(body io.Reader, v interface{}) error {
+	if err := documentJSON.Decode(body, v); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// readDocument decodes a request body containing a preferences document,
+// unwrapping it if it's wrapped. An empty body is treated as an empty
+// document.
+func readDocument(body io.Reader) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := decodeBody(body, &values); err != nil {
+		return nil, err
+	}
+
+	if wrapped, ok := values["preferences"]; ok {
+		unwrapped, ok := wrapped.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The preferences in a wrapped document must be an object")
+		}
+		values = unwrapped
+	}
+
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	return values, nil
+}
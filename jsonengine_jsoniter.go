@@ -0,0 +1,51 @@
+//go:build jsoniter
+// +build jsoniter
+
+package main
+
+import (
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsoniterJSON is the JSONEngine backed by jsoniter, configured to behave like
+// encoding/json.
+type jsoniterJSON struct {
+	jsoniter.API
+}
+
+// Decode reads a single JSON document from the reader.
+func (j jsoniterJSON) Decode(r io.Reader, v interface{}) error {
+	dec := j.NewDecoder(r)
+	if strictBodies {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if dec.More() {
+		return errTrailingData
+	}
+
+	return nil
+}
+
+// Encode writes the value to the writer as JSON, flushing it to the writer as
+// the stream's buffer fills.
+func (j jsoniterJSON) Encode(w io.Writer, v interface{}) error {
+	stream := j.BorrowStream(w)
+	defer j.ReturnStream(stream)
+
+	stream.WriteVal(v)
+	if stream.Error != nil {
+		return stream.Error
+	}
+	return stream.Flush()
+}
+
+func init() {
+	jsonEngines["jsoniter"] = jsoniterJSON{jsoniter.ConfigCompatibleWithStandardLibrary}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// representativeDocument returns a preferences document shaped like the ones
+// stored by the Discovery Environment, with the given number of entries in
+// each of its lists.
+func representativeDocument(entries int) map[string]interface{} {
+	recent := make([]interface{}, entries)
+	searches := make([]interface{}, entries)
+	tools := make(map[string]interface{})
+	for i := 0; i < entries; i++ {
+		recent[i] = fmt.Sprintf("/iplant/home/test-user/analyses/run-%d/output.txt", i)
+		searches[i] = map[string]interface{}{
+			"name":  fmt.Sprintf("search %d", i),
+			"query": map[string]interface{}{"label": "*.fastq", "size": map[string]interface{}{"from": i, "to": i * 1024}},
+		}
+		tools[fmt.Sprintf("tool-%d", i)] = map[string]interface{}{"favorite": i%2 == 0, "version": "1.0"}
+	}
+
+	return map[string]interface{}{
+		"defaultFileSelectorPath": "/iplant/home/test-user",
+		"rememberLastPath":        true,
+		"enableEmailNotification": false,
+		"defaultOutputFolder":     map[string]interface{}{"id": "/iplant/home/test-user/analyses", "path": "/iplant/home/test-user/analyses"},
+		"keyboardShortcuts":       map[string]interface{}{"appsKeyShortCut": "A", "dataKeyShortCut": "D", "analysisKeyShortCut": "Y"},
+		"recentPaths":             recent,
+		"savedSearches":           searches,
+		"tools":                   tools,
+	}
+}
+
+// engineNames returns the names of the compiled-in engines, sorted.
+func engineNames() []string {
+	var names []string
+	for name := range jsonEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestNewJSONEngine(t *testing.T) {
+	engine, err := newJSONEngine("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := engine.(stdJSON); !ok {
+		t.Errorf("the default engine was %T", engine)
+	}
+
+	if _, err = newJSONEngine("bogus"); err == nil {
+		t.Error("an unknown engine did not return an error")
+	}
+}
+
+func TestJSONEnginesRoundTrip(t *testing.T) {
+	expected, err := json.Marshal(representativeDocument(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range engineNames() {
+		engine := jsonEngines[name]
+
+		var decoded map[string]interface{}
+		if err = engine.Unmarshal(expected, &decoded); err != nil {
+			t.Errorf("%s failed to decode the document: %s", name, err)
+			continue
+		}
+
+		encoded, err := engine.Marshal(decoded)
+		if err != nil {
+			t.Errorf("%s failed to encode the document: %s", name, err)
+			continue
+		}
+
+		if string(encoded) != string(expected) {
+			t.Errorf("%s changed the document during a round trip", name)
+		}
+	}
+}
+
+func TestJSONEngineRequests(t *testing.T) {
+	defer func() { documentJSON = stdJSON{} }()
+
+	username := "test-user"
+	for _, name := range engineNames() {
+		documentJSON = jsonEngines[name]
+
+		mock := NewMockDB()
+		mock.users[username] = true
+		server := httptest.NewServer(New(mock).router)
+
+		url := fmt.Sprintf("%s/%s", server.URL, username)
+		status, _ := doRequest(t, http.MethodPost, url, []byte(`{"count":1,"nested":{"enabled":true}}`), nil)
+		if status != http.StatusCreated {
+			t.Errorf("%s: POST returned %d instead of %d", name, status, http.StatusCreated)
+		}
+
+		_, body := doRequest(t, http.MethodGet, url, nil, nil)
+		server.Close()
+
+		var parsed map[string]interface{}
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]interface{}{"count": 1.0, "nested": map[string]interface{}{"enabled": true}}
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("%s: GET returned %#v instead of %#v", name, parsed, expected)
+		}
+	}
+}
+
+func TestReadDocument(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected map[string]interface{}
+	}{
+		{``, map[string]interface{}{}},
+		{`{"theme":"dark"}`, map[string]interface{}{"theme": "dark"}},
+		{`{"preferences":{"theme":"dark"}}`, map[string]interface{}{"theme": "dark"}},
+		{"  {\"theme\":\"dark\"}\n", map[string]interface{}{"theme": "dark"}},
+	}
+
+	for _, test := range tests {
+		actual, err := readDocument(strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("readDocument(%q) returned an error: %s", test.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("readDocument(%q) returned %#v instead of %#v", test.body, actual, test.expected)
+		}
+	}
+
+	for _, body := range []string{`{"a":1}{"b":2}`, `{"a":1}}`, `{"a":`, `{"preferences":"dark"}`} {
+		if _, err := readDocument(strings.NewReader(body)); err == nil {
+			t.Errorf("readDocument(%q) did not return an error", body)
+		}
+	}
+}
+
+func TestStrictBodies(t *testing.T) {
+	defer func() { strictBodies = false }()
+
+	body := `{"strategy":"client-wins","preferences":{},"extra":true}`
+
+	var parsed mergeRequest
+	if err := decodeBody(strings.NewReader(body), &parsed); err != nil {
+		t.Errorf("an unknown field was rejected without strict bodies: %s", err)
+	}
+
+	strictBodies = true
+	if err := decodeBody(strings.NewReader(body), &parsed); err == nil {
+		t.Error("an unknown field was accepted with strict bodies")
+	}
+
+	var values map[string]interface{}
+	if err := decodeBody(strings.NewReader(`{"anything":true}`), &values); err != nil {
+		t.Errorf("a preferences document was rejected with strict bodies: %s", err)
+	}
+}
+
+// BenchmarkJSONMarshal and BenchmarkJSONUnmarshal compare the compiled-in
+// engines. Build with the engines' tags to include them, as in
+// "go test -tags jsoniter -run xxx -bench JSON".
+func BenchmarkJSONMarshal(b *testing.B) {
+	for _, entries := range []int{10, 1000} {
+		doc := representativeDocument(entries)
+		for _, name := range engineNames() {
+			engine := jsonEngines[name]
+			b.Run(fmt.Sprintf("%s/%d", name, entries), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := engine.Marshal(doc); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkJSONUnmarshal(b *testing.B) {
+	for _, entries := range []int{10, 1000} {
+		encoded, err := json.Marshal(representativeDocument(entries))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range engineNames() {
+			engine := jsonEngines[name]
+			b.Run(fmt.Sprintf("%s/%d", name, entries), func(b *testing.B) {
+				b.SetBytes(int64(len(encoded)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var decoded map[string]interface{}
+					if err := engine.Unmarshal(encoded, &decoded); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
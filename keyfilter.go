@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Policies for handling writes that contain top-level keys the deployment
+// doesn't allow.
+const (
+	// keyFilterReject rejects the entire write with a 422.
+	keyFilterReject = "reject"
+
+	// keyFilterStrip removes the disallowed keys and stores the rest.
+	keyFilterStrip = "strip"
+)
+
+// strippedKeysHeader lists the disallowed keys that were removed from a write
+// under the strip policy.
+const strippedKeysHeader = "X-Preferences-Stripped-Keys"
+
+// KeyFilter limits the top-level keys that can be stored in preferences
+// documents. If the allow list is set, only the keys in it are allowed; keys
+// in the deny list are never allowed.
+type KeyFilter struct {
+	allow  map[string]bool
+	deny   map[string]bool
+	policy string
+}
+
+// NewKeyFilter returns a newly created *KeyFilter, or nil if neither list is
+// set. An error is returned if the policy isn't recognized.
+func NewKeyFilter(allow, deny []string, policy string) (*KeyFilter, error) {
+	if policy == "" {
+		policy = keyFilterReject
+	}
+	if policy != keyFilterReject && policy != keyFilterStrip {
+		return nil, fmt.Errorf("Unknown key filter policy %s", policy)
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f := &KeyFilter{deny: make(map[string]bool), policy: policy}
+	if len(allow) > 0 {
+		f.allow = make(map[string]bool)
+		for _, key := range allow {
+			f.allow[key] = true
+		}
+	}
+	for _, key := range deny {
+		f.deny[key] = true
+	}
+	return f, nil
+}
+
+// allows returns whether the top-level key may be stored.
+func (f *KeyFilter) allows(key string) bool {
+	if f.deny[key] {
+		return false
+	}
+	return f.allow == nil || f.allow[key]
+}
+
+// disallowed returns the top-level keys in the document that may not be
+// stored, sorted. Reserved keys are managed by the service and are always
+// allowed.
+func (f *KeyFilter) disallowed(doc map[string]interface{}, reserved *ReservedKeys) []string {
+	var keys []string
+	for key := range doc {
+		if !f.allows(key) && !reserved.isReserved(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyFilterRejection is the JSON body returned when a write is rejected for
+// containing disallowed keys.
+type keyFilterRejection struct {
+	Error string   `json:"error"`
+	Keys  []string `json:"keys"`
+}
+
+// filterWrite enforces the key filter on a write of the incoming document,
+// returning the document that should be stored. Under the strip policy the
+// removed keys are listed in the strippedKeysHeader. An error response is
+// written and false is returned if the write is rejected.
+func (u *UserPreferencesApp) filterWrite(writer http.ResponseWriter, username string, incoming map[string]interface{}) (map[string]interface{}, bool) {
+	if u.keyFilter == nil {
+		return incoming, true
+	}
+
+	keys := u.keyFilter.disallowed(incoming, u.reserved)
+	if len(keys) == 0 {
+		return incoming, true
+	}
+
+	if u.keyFilter.policy == keyFilterStrip {
+		filtered := make(map[string]interface{}, len(incoming))
+		for key, value := range incoming {
+			filtered[key] = value
+		}
+		for _, key := range keys {
+			delete(filtered, key)
+		}
+		writer.Header().Set(strippedKeysHeader, strings.Join(keys, ", "))
+		return filtered, true
+	}
+
+	msg := fmt.Sprintf("The preferences for user %s contain keys that aren't allowed: %s", username, strings.Join(keys, ", "))
+	log.Error(msg)
+
+	jsoned, err := json.Marshal(&keyFilterRejection{Error: msg, Keys: keys})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating key filter JSON: %s", err))
+		return nil, false
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusUnprocessableEntity)
+	writer.Write(jsoned)
+	return nil, false
+}
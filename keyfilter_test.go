@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewKeyFilter(t *testing.T) {
+	if f, err := NewKeyFilter(nil, nil, ""); f != nil || err != nil {
+		t.Errorf("a filter without lists was %v (%v)", f, err)
+	}
+	if _, err := NewKeyFilter([]string{"theme"}, nil, "ignore"); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+
+	f, err := NewKeyFilter([]string{"theme", "lang", "debug"}, []string{"debug"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.policy != keyFilterReject {
+		t.Errorf("the default policy was %s", f.policy)
+	}
+
+	doc := map[string]interface{}{"theme": "dark", "debug": true, "layout": "grid", "_system": map[string]interface{}{}}
+	if keys := f.disallowed(doc, NewReservedKeys("_system")); !reflect.DeepEqual(keys, []string{"debug", "layout"}) {
+		t.Errorf("the disallowed keys were %v", keys)
+	}
+}
+
+func TestKeyFilterWrites(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	var err error
+	if n.keyFilter, err = NewKeyFilter(nil, []string{"debug", "scratch"}, keyFilterReject); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	status, body := doRequest(t, http.MethodPut, url, []byte(`{"theme":"dark","debug":true,"scratch":1}`), nil)
+	if status != http.StatusUnprocessableEntity || string(body) != `{"error":"The preferences for user test-user contain keys that aren't allowed: debug, scratch","keys":["debug","scratch"]}` {
+		t.Errorf("a rejected write returned %d: %s", status, body)
+	}
+	if has, _ := mock.hasPreferences(username); has {
+		t.Error("a rejected write was stored")
+	}
+
+	n.keyFilter.policy = keyFilterStrip
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(`{"theme":"dark","debug":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get(strippedKeysHeader) != "debug" {
+		t.Errorf("a stripped write returned %d with %s: %q", resp.StatusCode, strippedKeysHeader, resp.Header.Get(strippedKeysHeader))
+	}
+	if _, body = doRequest(t, http.MethodGet, url, nil, nil); string(body) != `{"theme":"dark"}` {
+		t.Errorf("the stored preferences were %s", body)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// keyDetailParam is the query parameter clients use to request the type and
+// size of each key along with its name.
+const keyDetailParam = "detail"
+
+// KeyInfo describes a top-level key in a user's preferences. Type is the JSON
+// type of the value, as reported by jsonb_typeof, and Size is the length of
+// its JSON encoding in bytes.
+type KeyInfo struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+// jsonType returns the name jsonb_typeof uses for the type of the decoded JSON
+// value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64, json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// documentKeys returns the top-level keys in the preferences document, sorted
+// by name.
+func documentKeys(values map[string]interface{}) ([]KeyInfo, error) {
+	keys := make([]KeyInfo, 0, len(values))
+	for key, value := range values {
+		jsoned, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, KeyInfo{Key: key, Type: jsonType(value), Size: len(jsoned)})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys, nil
+}
+
+// listKeys returns the top-level keys in the user's stored preferences,
+// sorted by name, without reading their values out of the database. Compressed
+// documents can't be inspected by the database, so they're decompressed and
+// inspected here instead.
+func (p *PrefsDB) listKeys(username string) ([]KeyInfo, error) {
+	query := `SELECT k.key,
+                   jsonb_typeof(d.doc -> k.key),
+                   octet_length((d.doc -> k.key)::text)
+              FROM (SELECT CASE WHEN p.preferences::jsonb ? 'preferences'
+                                THEN p.preferences::jsonb -> 'preferences'
+                                ELSE p.preferences::jsonb
+                           END AS doc
+                      FROM ` + p.tables.Preferences + ` p,
+                           ` + p.tables.usersSource() + ` u
+                     WHERE p.user_id = u.id
+                       AND u.username = $1
+                       AND p.preferences IS NOT NULL) d,
+                   jsonb_object_keys(d.doc) k(key)
+          ORDER BY k.key`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []KeyInfo{}
+	for rows.Next() {
+		var key KeyInfo
+		if err = rows.Scan(&key.Key, &key.Type, &key.Size); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil || len(keys) > 0 {
+		return keys, err
+	}
+
+	prefs, err := p.getPreferences(username)
+	if err != nil || len(prefs) == 0 {
+		return keys, err
+	}
+
+	var doc map[string]interface{}
+	if err = json.Unmarshal([]byte(prefs[0].Preferences), &doc); err != nil {
+		return nil, err
+	}
+	return documentKeys(unwrappedDocument(doc))
+}
+
+// KeysRequest handles listing the top-level keys in a user's preferences
+// without their values. The names are returned as a list unless the detail
+// parameter is set, in which case the type and size of each value are
+// included. Keys that have expired are left out, and the saved searches are
+// listed like the other keys, as they are in GET /{username}.
+func (u *UserPreferencesApp) KeysRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	detail, _ := strconv.ParseBool(r.URL.Query().Get(keyDetailParam))
+
+	keys, err := u.prefs.listKeys(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing preference keys for user %s: %s", username, err))
+		return
+	}
+
+	expirations, err := u.prefs.getExpirations(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting key expirations for user %s: %s", username, err))
+		return
+	}
+	now := time.Now()
+	kept := keys[:0]
+	for _, key := range keys {
+		if expiresAt, ok := expirations[key.Key]; ok && !expiresAt.After(now) {
+			continue
+		}
+		if key.Key != savedSearchesKey {
+			kept = append(kept, key)
+		}
+	}
+	keys = kept
+
+	searches, err := u.searchesDocument(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+	if len(searches) > 0 {
+		jsoned, err := json.Marshal(searches)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error generating saved searches JSON for user %s: %s", username, err))
+			return
+		}
+		keys = append(keys, KeyInfo{Key: savedSearchesKey, Type: "object", Size: len(jsoned)})
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	}
+
+	var response interface{}
+	if detail {
+		response = map[string][]KeyInfo{"keys": keys}
+	} else {
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			names[i] = key.Key
+		}
+		response = map[string][]string{"keys": names}
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating preference keys JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
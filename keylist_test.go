@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestKeysRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	if err := mock.insertPreferences("alice", `{"theme":"dark","layout":{"columns":3},"banner":"hello","recent":[1,2]}`); err != nil {
+		t.Fatal(err)
+	}
+	mock.setExpirations("alice", map[string]time.Time{"banner": time.Now().Add(-time.Minute)})
+	mock.putSearch("alice", "reads", `{"query":"reads"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/alice/keys", nil, nil)
+	var names map[string][]string
+	json.Unmarshal(body, &names)
+	expected := []string{"layout", "recent", savedSearchesKey, "theme"}
+	if status != http.StatusOK || !reflect.DeepEqual(names["keys"], expected) {
+		t.Errorf("listing the keys returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/alice/keys?detail=true", nil, nil)
+	var detailed map[string][]KeyInfo
+	json.Unmarshal(body, &detailed)
+	if status != http.StatusOK || len(detailed["keys"]) != 4 {
+		t.Fatalf("listing the keys in detail returned %d: %s", status, body)
+	}
+	if layout := detailed["keys"][0]; layout != (KeyInfo{Key: "layout", Type: "object", Size: len(`{"columns":3}`)}) {
+		t.Errorf("the layout key was described as %+v", layout)
+	}
+	if recent := detailed["keys"][1]; recent.Type != "array" || recent.Size != len(`[1,2]`) {
+		t.Errorf("the recent key was described as %+v", recent)
+	}
+
+	mock.users["bob"] = true
+	if status, body := doRequest(t, http.MethodGet, server.URL+"/bob/keys", nil, nil); status != http.StatusOK || string(body) != `{"keys":[]}` {
+		t.Errorf("listing the keys for a user without preferences returned %d: %s", status, body)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT k.key, jsonb_typeof\\(d.doc -> k.key\\)").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "type", "size"}).
+			AddRow("layout", "object", 13).
+			AddRow("theme", "string", 6))
+
+	keys, err := p.listKeys("test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyInfo{{"layout", "object", 13}, {"theme", "string", 6}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("listKeys returned %+v", keys)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
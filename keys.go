@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// textArray returns a PostgreSQL text array literal containing the values.
+func textArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		escaped := strings.Replace(value, `\`, `\\`, -1)
+		escaped = strings.Replace(escaped, `"`, `\"`, -1)
+		quoted[i] = `"` + escaped + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// documentPath returns a SQL expression that evaluates to the JSON path within
+// a stored document for the path passed as the text array parameter, taking
+// wrapped documents into account.
+func documentPath(param string) string {
+	return fmt.Sprintf(`(CASE WHEN preferences::jsonb ? 'preferences'
+                            THEN '{preferences}'::text[] || %[1]s::text[]
+                            ELSE %[1]s::text[]
+                       END)`, param)
+}
+
+// unwrappedDocument returns the preferences within a stored document.
+func unwrappedDocument(doc map[string]interface{}) map[string]interface{} {
+	if wrapped, ok := doc["preferences"].(map[string]interface{}); ok {
+		return wrapped
+	}
+	return doc
+}
+
+// countKey returns the number of documents containing the dotted key path.
+func (p *PrefsDB) countKey(path string) (int64, error) {
+	query := `SELECT COUNT(*)
+                FROM ` + p.tables.Preferences + `
+               WHERE preferences::jsonb #> ` + documentPath("$1") + ` IS NOT NULL`
+
+	var count int64
+	if err := p.db.QueryRow(query, textArray(splitPath(path))).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	compressed, err := p.countCompressed(func(values map[string]interface{}) bool {
+		_, ok := getPath(values, path)
+		return ok
+	})
+	return count + compressed, err
+}
+
+// deleteKeyBatch removes the dotted key path from up to limit documents that
+// contain it and returns the number of documents that were updated.
+func (p *PrefsDB) deleteKeyBatch(path string, limit int) (int64, error) {
+	deleted := `(preferences::jsonb #- ` + documentPath("$1") + `)::text`
+	query := `UPDATE ` + p.tables.Preferences + `
+                 SET preferences = ` + deleted + `,
+                     checksum = ` + checksumSQL(deleted) + `,
+                     version = version + 1
+               WHERE id IN (
+                     SELECT id
+                       FROM ` + p.tables.Preferences + `
+                      WHERE preferences::jsonb #> ` + documentPath("$1") + ` IS NOT NULL
+                      LIMIT $2
+               )`
+
+	result, err := p.db.Exec(query, textArray(splitPath(path)), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil || updated >= int64(limit) {
+		return updated, err
+	}
+
+	compressed, err := p.rewriteCompressed(int64(limit)-updated, func(values map[string]interface{}) bool {
+		return deletePath(values, path)
+	})
+	return updated + compressed, err
+}
+
+// renameable is a SQL condition that matches the documents in which the key
+// path in $1 can be renamed to the key path in $2: the document contains $1,
+// doesn't contain $2, and the parent of $2, which is passed in $3, is an
+// object. Documents that don't match are left alone rather than having their
+// values overwritten or dropped.
+var renameable = `preferences::jsonb #> ` + documentPath("$1") + ` IS NOT NULL
+               AND preferences::jsonb #> ` + documentPath("$2") + ` IS NULL
+               AND jsonb_typeof(preferences::jsonb #> ` + documentPath("$3") + `) = 'object'`
+
+// canRename is the renameable condition for a parsed document.
+func canRename(values map[string]interface{}, from, to string) bool {
+	if _, ok := getPath(values, from); !ok {
+		return false
+	}
+	if _, ok := getPath(values, to); ok {
+		return false
+	}
+	parts := splitPath(to)
+	if len(parts) == 1 {
+		return true
+	}
+	parent, _ := getPath(values, strings.Join(parts[:len(parts)-1], "."))
+	_, ok := parent.(map[string]interface{})
+	return ok
+}
+
+// renameArgs returns the query arguments for the renameable condition.
+func renameArgs(from, to string) []interface{} {
+	toParts := splitPath(to)
+	return []interface{}{
+		textArray(splitPath(from)),
+		textArray(toParts),
+		textArray(toParts[:len(toParts)-1]),
+	}
+}
+
+// countRenameable returns the number of documents in which the key path can
+// be renamed.
+func (p *PrefsDB) countRenameable(from, to string) (int64, error) {
+	query := `SELECT COUNT(*) FROM ` + p.tables.Preferences + ` WHERE ` + renameable
+
+	var count int64
+	if err := p.db.QueryRow(query, renameArgs(from, to)...).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	compressed, err := p.countCompressed(func(values map[string]interface{}) bool {
+		return canRename(values, from, to)
+	})
+	return count + compressed, err
+}
+
+// renameKeyBatch renames the key path in up to limit documents and returns the
+// number of documents that were updated. Each document is rewritten by a single
+// statement, so the old key is never removed without the new one being added.
+func (p *PrefsDB) renameKeyBatch(from, to string, limit int) (int64, error) {
+	renamed := `jsonb_set(
+                         preferences::jsonb #- ` + documentPath("$1") + `,
+                         ` + documentPath("$2") + `,
+                         preferences::jsonb #> ` + documentPath("$1") + `,
+                         true
+                     )::text`
+	query := `UPDATE ` + p.tables.Preferences + `
+                 SET preferences = ` + renamed + `,
+                     checksum = ` + checksumSQL(renamed) + `,
+                     version = version + 1
+               WHERE id IN (
+                     SELECT id
+                       FROM ` + p.tables.Preferences + `
+                      WHERE ` + renameable + `
+                      LIMIT $4
+               )`
+
+	result, err := p.db.Exec(query, append(renameArgs(from, to), limit)...)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil || updated >= int64(limit) {
+		return updated, err
+	}
+
+	compressed, err := p.rewriteCompressed(int64(limit)-updated, func(values map[string]interface{}) bool {
+		if !canRename(values, from, to) {
+			return false
+		}
+		value, _ := getPath(values, from)
+		deletePath(values, from)
+		setPath(values, to, value)
+		return true
+	})
+	return updated + compressed, err
+}
+
+// renameRequest is the JSON body accepted by the rename endpoint.
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// validate checks that the key paths can be renamed from one to the other.
+func (b *renameRequest) validate() error {
+	if b.From == "" || b.To == "" {
+		return fmt.Errorf("Both from and to must be set")
+	}
+
+	for _, path := range []string{b.From, b.To} {
+		for _, part := range splitPath(path) {
+			if part == "" {
+				return fmt.Errorf("Invalid key path: %s", path)
+			}
+		}
+	}
+
+	if b.From == b.To || strings.HasPrefix(b.To, b.From+".") || strings.HasPrefix(b.From, b.To+".") {
+		return fmt.Errorf("Cannot rename %s to %s; neither key may contain the other", b.From, b.To)
+	}
+
+	return nil
+}
+
+// dryRunResponse is the JSON body returned for dry runs of the key operations.
+type dryRunResponse struct {
+	DryRun  bool              `json:"dry_run"`
+	Kind    string            `json:"kind"`
+	Params  map[string]string `json:"params"`
+	Matched int64             `json:"matched"`
+}
+
+// isDryRun returns whether the request only asked for a dry run.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+	return dryRun
+}
+
+func writeDryRun(writer http.ResponseWriter, kind string, params map[string]string, matched int64) {
+	jsoned, err := json.Marshal(&dryRunResponse{
+		DryRun:  true,
+		Kind:    kind,
+		Params:  params,
+		Matched: matched,
+	})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating dry run JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// DeleteKeyRequest handles removing a top-level key or dotted key path from
+// every user's preferences. With ?dry-run=true it only reports how many
+// documents contain the key; otherwise the key is removed in batches in the
+// background and the response describes the operation tracking the progress.
+func (u *UserPreferencesApp) DeleteKeyRequest(writer http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	params := map[string]string{"key": key}
+
+	if isDryRun(r) {
+		matched, err := u.prefs.countKey(key)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error counting documents containing %s: %s", key, err))
+			return
+		}
+		writeDryRun(writer, "delete-key", params, matched)
+		return
+	}
+
+	log.Infof("Deleting %s from all preferences", key)
+	op := u.operations.Start("delete-key", params, func(batchSize int) (int64, error) {
+		return u.prefs.deleteKeyBatch(key, batchSize)
+	})
+
+	if err := u.audit("delete-key", map[string]string{"key": key, "operation": op.ID}); err != nil {
+		log.Error(err)
+	}
+	writeOperationStarted(writer, r, op)
+}
+
+// RenameKeyRequest handles renaming a top-level key or dotted key path in
+// every user's preferences. Documents that already contain the new key, or in
+// which the new key's parent isn't an object, are left unchanged. With
+// ?dry-run=true it only reports how many documents would be changed.
+func (u *UserPreferencesApp) RenameKeyRequest(writer http.ResponseWriter, r *http.Request) {
+	var body renameRequest
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if err := body.validate(); err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	params := map[string]string{"from": body.From, "to": body.To}
+
+	if isDryRun(r) {
+		matched, err := u.prefs.countRenameable(body.From, body.To)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error counting documents containing %s: %s", body.From, err))
+			return
+		}
+		writeDryRun(writer, "rename-key", params, matched)
+		return
+	}
+
+	log.Infof("Renaming %s to %s in all preferences", body.From, body.To)
+	op := u.operations.Start("rename-key", params, func(batchSize int) (int64, error) {
+		return u.prefs.renameKeyBatch(body.From, body.To, batchSize)
+	})
+
+	if err := u.audit("rename-key", map[string]string{"from": body.From, "to": body.To, "operation": op.ID}); err != nil {
+		log.Error(err)
+	}
+
+	writeOperationStarted(writer, r, op)
+}
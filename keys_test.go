@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTextArray(t *testing.T) {
+	actual := textArray([]string{"tools", `say "hi"`, `back\slash`})
+	expected := `{"tools","say \"hi\"","back\\slash"}`
+	if actual != expected {
+		t.Errorf("textArray returned %s instead of %s", actual, expected)
+	}
+}
+
+func TestDeleteKeyRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.insertPreferences("alice", `{"retired":{"feature":true,"other":1},"theme":"dark"}`)
+	mock.insertPreferences("bob", `{"preferences":{"retired":{"feature":false}}}`)
+	mock.insertPreferences("carol", `{"theme":"light"}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.operations = NewOperationTracker(1)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{adminKeyHeader: "secret"}
+
+	status, body := doRequest(t, http.MethodDelete, server.URL+"/admin/keys/retired.feature?dry-run=true", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("a dry run returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var dryRun dryRunResponse
+	if err := json.Unmarshal(body, &dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Matched != 2 {
+		t.Errorf("the dry run matched %d documents instead of 2", dryRun.Matched)
+	}
+
+	status, body = doRequest(t, http.MethodDelete, server.URL+"/admin/keys/retired.feature", nil, headers)
+	if status != http.StatusAccepted {
+		t.Fatalf("deleting a key returned %d instead of %d", status, http.StatusAccepted)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(body, &op); err != nil {
+		t.Fatal(err)
+	}
+	op = waitForOperation(t, n.operations, op.ID)
+	if op.Status != operationCompleted || op.Updated != 2 {
+		t.Errorf("the operation was %#v", op)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/admin/operations/"+op.ID, nil, headers)
+	if status != http.StatusOK {
+		t.Errorf("getting the operation returned %d instead of %d", status, http.StatusOK)
+	}
+
+	_, docs := mock.mockDocuments()
+	expected := map[string]map[string]interface{}{
+		"alice": {"retired": map[string]interface{}{"other": 1.0}, "theme": "dark"},
+		"bob":   {"preferences": map[string]interface{}{"retired": map[string]interface{}{}}},
+		"carol": {"theme": "light"},
+	}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Errorf("the documents were %#v instead of %#v", docs, expected)
+	}
+
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/admin/operations/9999", nil, headers)
+	if status != http.StatusNotFound {
+		t.Errorf("getting a missing operation returned %d instead of %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeleteKeyBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec(`UPDATE user_preferences SET preferences = \(preferences::jsonb #- .+\)::text, checksum = encode\(sha256\(convert_to\(.+\)\), 'hex'\), version = version \+ 1 WHERE id IN \(.+ LIMIT \$2 \)`).
+		WithArgs(`{"retired","feature"}`, 100).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+	mock.ExpectQuery("SELECT id, version, encoding, compressed FROM user_preferences WHERE encoding <> 'identity'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "encoding", "compressed"}))
+
+	updated, err := p.deleteKeyBatch("retired.feature", 100)
+	if err != nil {
+		t.Fatalf("error from deleteKeyBatch(): %s", err)
+	}
+	if updated != 42 {
+		t.Errorf("deleteKeyBatch() returned %d instead of 42", updated)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestRenameKeyRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.insertPreferences("alice", `{"oldName":{"a":1},"theme":"dark"}`)
+	mock.insertPreferences("bob", `{"preferences":{"oldName":true}}`)
+	mock.insertPreferences("carol", `{"oldName":1,"newName":2}`)
+	mock.insertPreferences("dave", `{"theme":"light"}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.operations = NewOperationTracker(1)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{adminKeyHeader: "secret"}
+	body := []byte(`{"from":"oldName","to":"newName"}`)
+
+	status, resp := doRequest(t, http.MethodPost, server.URL+"/admin/keys/rename?dry-run=true", body, headers)
+	if status != http.StatusOK {
+		t.Fatalf("a dry run returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var dryRun dryRunResponse
+	if err := json.Unmarshal(resp, &dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Matched != 2 {
+		t.Errorf("the dry run matched %d documents instead of 2", dryRun.Matched)
+	}
+
+	status, resp = doRequest(t, http.MethodPost, server.URL+"/admin/keys/rename", body, headers)
+	if status != http.StatusAccepted {
+		t.Fatalf("renaming a key returned %d instead of %d", status, http.StatusAccepted)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(resp, &op); err != nil {
+		t.Fatal(err)
+	}
+	op = waitForOperation(t, n.operations, op.ID)
+	if op.Status != operationCompleted || op.Updated != 2 {
+		t.Errorf("the operation was %#v", op)
+	}
+
+	_, docs := mock.mockDocuments()
+	expected := map[string]map[string]interface{}{
+		"alice": {"newName": map[string]interface{}{"a": 1.0}, "theme": "dark"},
+		"bob":   {"preferences": map[string]interface{}{"newName": true}},
+		"carol": {"oldName": 1.0, "newName": 2.0},
+		"dave":  {"theme": "light"},
+	}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Errorf("the documents were %#v instead of %#v", docs, expected)
+	}
+
+	if len(mock.audits) != 1 || !strings.HasPrefix(mock.audits[0], "rename-key ") {
+		t.Errorf("the audit log was %#v", mock.audits)
+	}
+}
+
+func TestRenameKeyRequestInvalid(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{adminKeyHeader: "secret"}
+	bodies := []string{
+		`{"from":"oldName"}`,
+		`{"from":"a","to":"a"}`,
+		`{"from":"a","to":"a.b"}`,
+		`{"from":"a..b","to":"c"}`,
+		`not json`,
+	}
+	for _, body := range bodies {
+		status, _ := doRequest(t, http.MethodPost, server.URL+"/admin/keys/rename", []byte(body), headers)
+		if status != http.StatusBadRequest {
+			t.Errorf("renaming with %s returned %d instead of %d", body, status, http.StatusBadRequest)
+		}
+	}
+
+	status, _ := doRequest(t, http.MethodPost, server.URL+"/admin/keys/rename", []byte(`{"from":"a","to":"b"}`), nil)
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		t.Errorf("renaming without the admin key returned %d", status)
+	}
+}
+
+func TestRenameKeyBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec(`UPDATE user_preferences SET preferences = jsonb_set\(.+\)::text, checksum = encode\(sha256\(convert_to\(jsonb_set\(.+\)\), 'hex'\), version = version \+ 1 WHERE id IN \(.+ LIMIT \$4 \)`).
+		WithArgs(`{"old","name"}`, `{"new"}`, `{}`, 100).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+	mock.ExpectQuery("SELECT id, version, encoding, compressed FROM user_preferences WHERE encoding <> 'identity'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "encoding", "compressed"}))
+
+	updated, err := p.renameKeyBatch("old.name", "new", 100)
+	if err != nil {
+		t.Fatalf("error from renameKeyBatch(): %s", err)
+	}
+	if updated != 7 {
+		t.Errorf("renameKeyBatch() returned %d instead of 7", updated)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// lambdaRuntimeEnv names the environment variable that AWS Lambda sets to the
+// address of the runtime API. The service runs as a Lambda function instead of
+// a standalone server when it's set.
+const lambdaRuntimeEnv = "AWS_LAMBDA_RUNTIME_API"
+
+// lambdaRuntimePrefix is the path of the invocation endpoints in the runtime
+// API.
+const lambdaRuntimePrefix = "/2018-06-01/runtime/invocation/"
+
+// apiGatewayEvent is an HTTP request from API Gateway in either the REST API
+// (version 1.0) or HTTP API (version 2.0) proxy integration format.
+type apiGatewayEvent struct {
+	Version         string            `json:"version"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+
+	// Set in version 1.0 events.
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+
+	// Set in version 2.0 events.
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	RequestContext struct {
+		Stage string `json:"stage"`
+		HTTP  struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// apiGatewayResponse is the response returned to API Gateway. Version 1.0
+// events get multiValueHeaders; version 2.0 events get cookies.
+type apiGatewayResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// isV2 returns whether the event is in the HTTP API format.
+func (e *apiGatewayEvent) isV2() bool {
+	return e.Version == "2.0"
+}
+
+// request returns the HTTP request described by the event.
+func (e *apiGatewayEvent) request(ctx context.Context) (*http.Request, error) {
+	var (
+		method, path, query, remote string
+	)
+
+	if e.isV2() {
+		method, path, query = e.RequestContext.HTTP.Method, e.RawPath, e.RawQueryString
+		remote = e.RequestContext.HTTP.SourceIP
+
+		// Named stages of HTTP APIs are included in the raw path.
+		if stage := e.RequestContext.Stage; stage != "" && stage != "$default" {
+			path = strings.TrimPrefix(path, "/"+stage)
+		}
+	} else {
+		method, path = e.HTTPMethod, e.Path
+		remote = e.RequestContext.Identity.SourceIP
+
+		params := url.Values{}
+		for key, values := range e.MultiValueQueryStringParameters {
+			params[key] = values
+		}
+		for key, value := range e.QueryStringParameters {
+			if _, ok := params[key]; !ok {
+				params.Set(key, value)
+			}
+		}
+		query = params.Encode()
+	}
+
+	if method == "" {
+		return nil, fmt.Errorf("The event isn't an API Gateway proxy request")
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding the request body: %s", err)
+		}
+		body = decoded
+	}
+
+	target := path
+	if query != "" {
+		target += "?" + query
+	}
+	r, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+
+	for name, values := range e.MultiValueHeaders {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	for name, value := range e.Headers {
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+	for _, cookie := range e.Cookies {
+		r.Header.Add("Cookie", cookie)
+	}
+
+	r.Host = r.Header.Get("Host")
+	r.RequestURI = target
+	if remote != "" {
+		r.RemoteAddr = remote + ":0"
+	}
+	return r, nil
+}
+
+// response returns the recorded response in the format the event expects.
+// Bodies that aren't valid UTF-8, such as compressed or MessagePack ones, are
+// base64 encoded.
+func (e *apiGatewayEvent) response(recorded *httptest.ResponseRecorder) *apiGatewayResponse {
+	resp := &apiGatewayResponse{
+		StatusCode: recorded.Code,
+		Headers:    make(map[string]string),
+	}
+
+	for name, values := range recorded.Header() {
+		if e.isV2() && name == "Set-Cookie" {
+			resp.Cookies = append(resp.Cookies, values...)
+			continue
+		}
+		resp.Headers[name] = strings.Join(values, ", ")
+	}
+	if !e.isV2() {
+		resp.MultiValueHeaders = recorded.Header()
+	}
+
+	body := recorded.Body.Bytes()
+	if utf8.Valid(body) {
+		resp.Body = string(body)
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(body)
+		resp.IsBase64Encoded = true
+	}
+	return resp
+}
+
+// serveLambdaEvent serves the API Gateway event with the handler and returns
+// the encoded response.
+func serveLambdaEvent(ctx context.Context, handler http.Handler, payload []byte) ([]byte, error) {
+	var event apiGatewayEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("Error parsing the event: %s", err)
+	}
+
+	r, err := event.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	return json.Marshal(event.response(recorder))
+}
+
+// lambdaError is the body posted to the runtime API when an event can't be
+// handled.
+type lambdaError struct {
+	Message string `json:"errorMessage"`
+	Type    string `json:"errorType"`
+}
+
+// runLambda serves the events delivered by the Lambda runtime API at the
+// address until the runtime can't be reached.
+func runLambda(runtimeAPI string, handler http.Handler) error {
+	client := &http.Client{}
+	base := "http://" + runtimeAPI + lambdaRuntimePrefix
+
+	for {
+		resp, err := client.Get(base + "next")
+		if err != nil {
+			return fmt.Errorf("Error getting the next Lambda event: %s", err)
+		}
+		payload, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Error reading the next Lambda event: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("The Lambda runtime returned %d: %s", resp.StatusCode, payload)
+		}
+
+		id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		if trace := resp.Header.Get("Lambda-Runtime-Trace-Id"); trace != "" {
+			os.Setenv("_X_AMZN_TRACE_ID", trace)
+		}
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+			ctx, cancel = context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+		}
+
+		result, err := serveLambdaEvent(ctx, handler, payload)
+		cancel()
+
+		target, contentType := base+id+"/response", "application/json"
+		if err != nil {
+			log.Errorf("Error handling Lambda event %s: %s", id, err)
+			result, _ = json.Marshal(lambdaError{Message: err.Error(), Type: "InvalidEvent"})
+			target = base + id + "/error"
+		}
+
+		posted, err := client.Post(target, contentType, bytes.NewReader(result))
+		if err != nil {
+			return fmt.Errorf("Error returning the result of Lambda event %s: %s", id, err)
+		}
+		posted.Body.Close()
+	}
+}
+
+// lambdaPool is the connection pool configuration for running as a Lambda
+// function. Each instance handles a single request at a time and may be
+// frozen between requests, so it keeps few connections and drops idle ones
+// quickly, leaving pooling to RDS Proxy.
+type lambdaPool struct {
+	maxOpen     int
+	maxIdle     int
+	maxLifetime time.Duration
+	maxIdleTime time.Duration
+}
+
+// newLambdaPool returns the configured pool settings.
+func newLambdaPool(cfg *viper.Viper) lambdaPool {
+	return lambdaPool{
+		maxOpen:     cfg.GetInt("user-preferences.lambda.max-open-conns"),
+		maxIdle:     cfg.GetInt("user-preferences.lambda.max-idle-conns"),
+		maxLifetime: cfg.GetDuration("user-preferences.lambda.conn-max-lifetime"),
+		maxIdleTime: cfg.GetDuration("user-preferences.lambda.conn-max-idle-time"),
+	}
+}
+
+// apply configures the database's connection pool.
+func (p lambdaPool) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.maxOpen)
+	db.SetMaxIdleConns(p.maxIdle)
+	db.SetConnMaxLifetime(p.maxLifetime)
+	db.SetConnMaxIdleTime(p.maxIdleTime)
+}
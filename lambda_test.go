@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveTestEvent serves the event with an app backed by the mock and returns
+// the decoded response.
+func serveTestEvent(t *testing.T, mock *MockDB, event string) *apiGatewayResponse {
+	result, err := serveLambdaEvent(context.Background(), New(mock), []byte(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp apiGatewayResponse
+	if err = json.Unmarshal(result, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestLambdaRESTEvent(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	resp := serveTestEvent(t, mock, `{
+		"httpMethod": "PUT",
+		"path": "/alice",
+		"multiValueHeaders": {"Content-Type": ["application/json"]},
+		"queryStringParameters": {"ignored": "yes"},
+		"body": "{\"theme\":\"dark\"}",
+		"requestContext": {"stage": "prod", "identity": {"sourceIp": "192.0.2.1"}}
+	}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT returned %d: %s", resp.StatusCode, resp.Body)
+	}
+	if resp.MultiValueHeaders["Content-Type"][0] != "application/json" || resp.Headers["Content-Type"] != "application/json" {
+		t.Errorf("the response headers were %v and %v", resp.Headers, resp.MultiValueHeaders)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(`{"layout":"grid"}`))
+	resp = serveTestEvent(t, mock, fmt.Sprintf(`{
+		"httpMethod": "POST",
+		"path": "/alice",
+		"body": %q,
+		"isBase64Encoded": true
+	}`, encoded))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, `"layout":"grid"`) || !strings.Contains(resp.Body, `"theme":"dark"`) {
+		t.Errorf("a base64 encoded POST returned %d: %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestLambdaHTTPEvent(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	if err := mock.insertPreferences("alice", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serveTestEvent(t, mock, `{
+		"version": "2.0",
+		"rawPath": "/prod/alice",
+		"rawQueryString": "include-meta=true",
+		"headers": {"accept": "application/json"},
+		"requestContext": {"stage": "prod", "http": {"method": "GET", "sourceIp": "192.0.2.1"}}
+	}`)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, `"meta"`) {
+		t.Errorf("GET returned %d: %s", resp.StatusCode, resp.Body)
+	}
+	if resp.MultiValueHeaders != nil {
+		t.Errorf("an HTTP API response included multiValueHeaders: %v", resp.MultiValueHeaders)
+	}
+
+	resp = serveTestEvent(t, mock, `{
+		"version": "2.0",
+		"rawPath": "/alice",
+		"headers": {"accept": "application/msgpack"},
+		"requestContext": {"stage": "$default", "http": {"method": "GET"}}
+	}`)
+	if resp.StatusCode != http.StatusOK || !resp.IsBase64Encoded {
+		t.Errorf("a MessagePack GET returned %d, base64 encoded %t", resp.StatusCode, resp.IsBase64Encoded)
+	}
+}
+
+func TestLambdaInvalidEvent(t *testing.T) {
+	if _, err := serveLambdaEvent(context.Background(), New(NewMockDB()), []byte(`{"Records":[]}`)); err == nil {
+		t.Error("an event that isn't an HTTP request was served")
+	}
+	if _, err := serveLambdaEvent(context.Background(), New(NewMockDB()), []byte(`not json`)); err == nil {
+		t.Error("an event that isn't JSON was served")
+	}
+}
+
+func TestRunLambda(t *testing.T) {
+	events := []string{
+		`{"version":"2.0","rawPath":"/version","requestContext":{"http":{"method":"GET"}}}`,
+		`{"Records":[]}`,
+	}
+	results := make(map[string]string)
+
+	runtime := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == lambdaRuntimePrefix+"next" {
+			if len(events) == 0 {
+				http.Error(writer, "no more events", http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Lambda-Runtime-Aws-Request-Id", fmt.Sprintf("request-%d", len(events)))
+			writer.Header().Set("Lambda-Runtime-Deadline-Ms", "32503680000000")
+			fmt.Fprint(writer, events[0])
+			events = events[1:]
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		results[strings.TrimPrefix(r.URL.Path, lambdaRuntimePrefix)] = string(body)
+		writer.WriteHeader(http.StatusAccepted)
+	}))
+	defer runtime.Close()
+
+	err := runLambda(strings.TrimPrefix(runtime.URL, "http://"), New(NewMockDB()))
+	if err == nil || !strings.Contains(err.Error(), "no more events") {
+		t.Errorf("runLambda returned %v", err)
+	}
+
+	if !strings.Contains(results["request-2/response"], `"statusCode":200`) {
+		t.Errorf("the first event's response was %q", results["request-2/response"])
+	}
+	if !strings.Contains(results["request-1/error"], "InvalidEvent") {
+		t.Errorf("the second event's error was %q", results["request-1/error"])
+	}
+}
+
+func TestLambdaPool(t *testing.T) {
+	pool := newLambdaPool(testConfig(t, ""))
+	if pool.maxOpen != 2 || pool.maxIdle != 1 || pool.maxIdleTime.Seconds() != 30 || pool.maxLifetime.Minutes() != 5 {
+		t.Errorf("the default Lambda pool was %+v", pool)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LocaleDefaults contains the default preferences for each locale. Locales
+// are language tags such as es or pt-BR, and are matched without regard to
+// case.
+type LocaleDefaults struct {
+	defaults map[string]map[string]interface{}
+	fallback string
+}
+
+// NewLocaleDefaults returns a newly created *LocaleDefaults from the documents
+// in defaults, keyed by locale. The fallback locale is used when none of the
+// requested locales has defaults.
+func NewLocaleDefaults(defaults map[string]interface{}, fallback string) (*LocaleDefaults, error) {
+	l := &LocaleDefaults{
+		defaults: make(map[string]map[string]interface{}, len(defaults)),
+		fallback: normalizeLocale(fallback),
+	}
+	for locale, value := range defaults {
+		doc, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The defaults for locale %s must be a map", locale)
+		}
+		l.defaults[normalizeLocale(locale)] = doc
+	}
+	if l.fallback != "" && l.defaults[l.fallback] == nil {
+		return nil, fmt.Errorf("The fallback locale %s doesn't have any defaults", fallback)
+	}
+	return l, nil
+}
+
+// normalizeLocale returns the locale in lower case with hyphens separating its
+// subtags.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// resolve returns the first of the requested locales that has defaults, trying
+// each one's less specific forms before moving on to the next, along with a
+// copy of its defaults. The fallback locale is used if none of them match, and
+// an empty locale and nil are returned if there's no fallback.
+func (l *LocaleDefaults) resolve(requested []string) (string, map[string]interface{}) {
+	for _, locale := range requested {
+		for candidate := normalizeLocale(locale); candidate != ""; {
+			if doc, ok := l.defaults[candidate]; ok {
+				return candidate, deepCopy(doc).(map[string]interface{})
+			}
+			i := strings.LastIndex(candidate, "-")
+			if i < 0 {
+				break
+			}
+			candidate = candidate[:i]
+		}
+	}
+	if l.fallback != "" {
+		return l.fallback, deepCopy(l.defaults[l.fallback]).(map[string]interface{})
+	}
+	return "", nil
+}
+
+// requestedLocales returns the locales the request asked for: the locale query
+// parameter if it's set, and otherwise the languages in the Accept-Language
+// header in order of preference.
+func requestedLocales(r *http.Request) []string {
+	if locale := r.URL.Query().Get("locale"); locale != "" {
+		return []string{locale}
+	}
+
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			languages = append(languages, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].q > languages[j].q })
+
+	locales := make([]string, len(languages))
+	for i, language := range languages {
+		locales[i] = language.locale
+	}
+	return locales
+}
+
+// BundleRequest handles writing out a user's effective preferences layered
+// over the defaults for the requested locale. The locale that was used is
+// returned in the Content-Language header.
+func (u *UserPreferencesApp) BundleRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var (
+		locale    string
+		localized map[string]interface{}
+	)
+	if u.locales != nil {
+		locale, localized = u.locales.resolve(requestedLocales(r))
+	}
+
+	log.Infof("Getting the preferences bundle for %s in locale %q", username, locale)
+	values, err := u.effectivePreferences(username, localized)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if values, err = u.applyTemplates(r, username, values, false); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the preferences bundle JSON for user %s: %s", username, err))
+		return
+	}
+
+	if locale != "" {
+		writer.Header().Set("Content-Language", locale)
+	}
+	writer.Header().Add("Vary", "Accept-Language")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewLocaleDefaultsErrors(t *testing.T) {
+	if _, err := NewLocaleDefaults(map[string]interface{}{"es": "oops"}, ""); err == nil {
+		t.Error("defaults that weren't a map were accepted")
+	}
+	if _, err := NewLocaleDefaults(map[string]interface{}{"es": map[string]interface{}{}}, "fr"); err == nil {
+		t.Error("a fallback locale without defaults was accepted")
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	l, err := NewLocaleDefaults(map[string]interface{}{
+		"en":    map[string]interface{}{"date": "MM/DD/YYYY"},
+		"es":    map[string]interface{}{"date": "DD/MM/YYYY"},
+		"pt-br": map[string]interface{}{"date": "DD/MM/YYYY", "currency": "BRL"},
+	}, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requested []string
+		expected  string
+	}{
+		{[]string{"es"}, "es"},
+		{[]string{"es-MX"}, "es"},
+		{[]string{"pt_BR"}, "pt-br"},
+		{[]string{"de", "es"}, "es"},
+		{[]string{"de"}, "en"},
+		{nil, "en"},
+	}
+	for _, test := range tests {
+		locale, doc := l.resolve(test.requested)
+		if locale != test.expected || doc == nil {
+			t.Errorf("%v resolved to %q with %v instead of %q", test.requested, locale, doc, test.expected)
+		}
+	}
+
+	_, doc := l.resolve([]string{"es"})
+	doc["date"] = "changed"
+	if _, doc = l.resolve([]string{"es"}); doc["date"] != "DD/MM/YYYY" {
+		t.Error("changing the resolved defaults changed the configured ones")
+	}
+
+	none, err := NewLocaleDefaults(map[string]interface{}{"es": map[string]interface{}{}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale, doc := none.resolve([]string{"de"}); locale != "" || doc != nil {
+		t.Errorf("an unknown locale without a fallback resolved to %q with %v", locale, doc)
+	}
+}
+
+func TestRequestedLocales(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/alice/bundle?locale=es", nil)
+	r.Header.Set("Accept-Language", "fr")
+	if locales := requestedLocales(r); !reflect.DeepEqual(locales, []string{"es"}) {
+		t.Errorf("the locales were %v", locales)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/alice/bundle", nil)
+	r.Header.Set("Accept-Language", "de;q=0.5, fr-CA, *;q=0.1, it;q=0, en;q=0.8")
+	if locales := requestedLocales(r); !reflect.DeepEqual(locales, []string{"fr-CA", "en", "de"}) {
+		t.Errorf("the locales were %v", locales)
+	}
+}
+
+func TestBundleRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"preferences":{"theme":"light"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	cfg := testConfig(t, `
+user-preferences:
+  defaults:
+    theme: default
+    lang: en
+  locales:
+    fallback: en
+    defaults:
+      en:
+        date: MM/DD/YYYY
+      es:
+        lang: es
+        date: DD/MM/YYYY
+`)
+	if err := configureApp(n, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	tests := []struct {
+		query    string
+		locale   string
+		expected map[string]interface{}
+	}{
+		{"?locale=es", "es", map[string]interface{}{"theme": "light", "lang": "es", "date": "DD/MM/YYYY"}},
+		{"?locale=de", "en", map[string]interface{}{"theme": "light", "lang": "en", "date": "MM/DD/YYYY"}},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/%s/bundle%s", server.URL, username, test.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&parsed)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status code was %d instead of %d", resp.StatusCode, http.StatusOK)
+		}
+		if language := resp.Header.Get("Content-Language"); language != test.locale {
+			t.Errorf("the bundle for %s was in locale %q instead of %q", test.query, language, test.locale)
+		}
+		if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("the bundle for %s was %#v instead of %#v", test.query, parsed, test.expected)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Policies for handling user-level writes that touch locked keys.
+const (
+	// lockPolicyReject rejects the entire write with a 403.
+	lockPolicyReject = "reject"
+
+	// lockPolicyStrip silently keeps the stored values of the locked keys and
+	// applies the rest of the write.
+	lockPolicyStrip = "strip"
+)
+
+// KeyLocks contains the set of preference keys that may only be modified by
+// administrative callers and the policy for handling writes that touch them.
+// Keys may be dotted paths into nested objects.
+type KeyLocks struct {
+	keys   []string
+	policy string
+}
+
+// NewKeyLocks returns a newly created *KeyLocks. An error is returned if the
+// policy isn't recognized.
+func NewKeyLocks(keys []string, policy string) (*KeyLocks, error) {
+	if policy == "" {
+		policy = lockPolicyReject
+	}
+	if policy != lockPolicyReject && policy != lockPolicyStrip {
+		return nil, fmt.Errorf("Unknown locked key policy %s", policy)
+	}
+	return &KeyLocks{
+		keys:   keys,
+		policy: policy,
+	}, nil
+}
+
+// violations returns the locked keys whose values differ between the stored and
+// incoming documents.
+func (l *KeyLocks) violations(stored, incoming map[string]interface{}) []string {
+	var touched []string
+	for _, key := range l.keys {
+		storedValue, storedOK := getPath(stored, key)
+		incomingValue, incomingOK := getPath(incoming, key)
+		if storedOK != incomingOK || !reflect.DeepEqual(storedValue, incomingValue) {
+			touched = append(touched, key)
+		}
+	}
+	return touched
+}
+
+// strip returns a copy of the incoming document with the locked keys restored
+// to their stored values.
+func (l *KeyLocks) strip(stored, incoming map[string]interface{}) map[string]interface{} {
+	result := deepCopy(incoming).(map[string]interface{})
+	for _, key := range l.keys {
+		if storedValue, ok := getPath(stored, key); ok {
+			setPath(result, key, deepCopy(storedValue))
+		} else {
+			deletePath(result, key)
+		}
+	}
+	return result
+}
+
+// lockedFor returns whether reserved, locked, or immutable keys need to be
+// enforced for the request.
+func (u *UserPreferencesApp) lockedFor(r *http.Request) bool {
+	locked := u.locks != nil && len(u.locks.keys) > 0
+	immutable := u.immutable != nil && len(u.immutable.keys) > 0
+	return (u.reserved.enabled() || locked || immutable) && !u.isAdmin(r)
+}
+
+// applyLocks enforces the reserved, locked, and immutable keys on a write of
+// the incoming document, returning the document that should be stored. An
+// error response is written and false is returned if the write is rejected.
+// Writes that modify reserved or immutable keys are always rejected, whatever
+// the locked key policy is.
+func (u *UserPreferencesApp) applyLocks(writer http.ResponseWriter, r *http.Request, username string, incoming map[string]interface{}) (map[string]interface{}, bool) {
+	if !u.lockedFor(r) {
+		return incoming, true
+	}
+
+	stored, err := u.loadPreferences(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return nil, false
+	}
+
+	if u.reserved.enabled() {
+		incoming = u.withoutAssignments(incoming)
+		if touched := u.reserved.violations(stored, incoming); len(touched) > 0 {
+			forbidden(writer, fmt.Sprintf("Reserved preferences cannot be modified for user %s: %s", username, strings.Join(touched, ", ")))
+			return nil, false
+		}
+		incoming = u.reserved.preserve(stored, incoming)
+	}
+
+	if u.immutable != nil {
+		if violations := u.immutable.violations(stored, incoming); len(violations) > 0 {
+			rejectImmutable(writer, username, violations)
+			return nil, false
+		}
+	}
+
+	if u.locks == nil {
+		return incoming, true
+	}
+
+	touched := u.locks.violations(stored, incoming)
+	if len(touched) == 0 {
+		return incoming, true
+	}
+
+	if u.locks.policy == lockPolicyStrip {
+		return u.locks.strip(stored, incoming), true
+	}
+
+	forbidden(writer, fmt.Sprintf("Locked preferences cannot be modified for user %s: %s", username, strings.Join(touched, ", ")))
+	return nil, false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewKeyLocks(t *testing.T) {
+	locks, err := NewKeyLocks([]string{"a"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locks.policy != lockPolicyReject {
+		t.Errorf("default policy was %s instead of %s", locks.policy, lockPolicyReject)
+	}
+
+	if _, err = NewKeyLocks([]string{"a"}, "ignore"); err == nil {
+		t.Error("an unknown policy did not cause an error")
+	}
+}
+
+func TestKeyLocksViolations(t *testing.T) {
+	locks, err := NewKeyLocks([]string{"beta", "ui.experimental"}, lockPolicyReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := map[string]interface{}{
+		"beta": false,
+		"ui":   map[string]interface{}{"experimental": false, "theme": "dark"},
+	}
+
+	unchanged := map[string]interface{}{
+		"beta":  false,
+		"ui":    map[string]interface{}{"experimental": false, "theme": "light"},
+		"other": 1.0,
+	}
+	if touched := locks.violations(stored, unchanged); len(touched) != 0 {
+		t.Errorf("violations returned %#v for a write that doesn't touch locked keys", touched)
+	}
+
+	changed := map[string]interface{}{
+		"ui": map[string]interface{}{"experimental": true},
+	}
+	expected := []string{"beta", "ui.experimental"}
+	if touched := locks.violations(stored, changed); !reflect.DeepEqual(touched, expected) {
+		t.Errorf("violations returned %#v instead of %#v", touched, expected)
+	}
+}
+
+func TestKeyLocksStrip(t *testing.T) {
+	locks, err := NewKeyLocks([]string{"beta", "ui.experimental"}, lockPolicyStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := map[string]interface{}{
+		"ui": map[string]interface{}{"experimental": false},
+	}
+	incoming := map[string]interface{}{
+		"beta":  true,
+		"ui":    map[string]interface{}{"experimental": true, "theme": "dark"},
+		"other": 1.0,
+	}
+	expected := map[string]interface{}{
+		"ui":    map[string]interface{}{"experimental": false, "theme": "dark"},
+		"other": 1.0,
+	}
+
+	actual := locks.strip(stored, incoming)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("strip returned %#v instead of %#v", actual, expected)
+	}
+
+	if incoming["beta"] != true {
+		t.Error("strip modified the incoming document")
+	}
+}
+
+func TestPostRequestLockedReject(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"beta":false}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.locks, _ = NewKeyLocks([]string{"beta"}, lockPolicyReject)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	status, _ := doRequest(t, http.MethodPost, url, []byte(`{"beta":true}`), nil)
+	if status != http.StatusForbidden {
+		t.Errorf("POST touching a locked key returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"beta":false,"theme":"dark"}`), nil)
+	if status != http.StatusOK {
+		t.Errorf("POST leaving a locked key alone returned %d instead of %d", status, http.StatusOK)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"beta":true}`), map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Errorf("admin POST touching a locked key returned %d instead of %d", status, http.StatusOK)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, url, nil, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("DELETE of locked keys returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, fmt.Sprintf("%s/flags/beta/toggle", url), nil, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("toggling a locked flag returned %d instead of %d", status, http.StatusForbidden)
+	}
+}
+
+func TestPostRequestLockedStrip(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"beta":false}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	n.locks, _ = NewKeyLocks([]string{"beta"}, lockPolicyStrip)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	status, body := doRequest(t, http.MethodPost, url, []byte(`{"preferences":{"beta":true,"theme":"dark"}}`), nil)
+	if status != http.StatusOK {
+		t.Errorf("POST returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"beta": false, "theme": "dark"}
+	if !reflect.DeepEqual(parsed["preferences"], expected) {
+		t.Errorf("POST returned %#v instead of %#v", parsed["preferences"], expected)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("DELETE returned %d instead of %d", status, http.StatusOK)
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, map[string]interface{}{"beta": false}) {
+		t.Errorf("DELETE left %#v instead of the locked keys", stored)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel is the severity of a log message. Messages below the logger's level
+// are dropped.
+type LogLevel int32
+
+// The log levels, from least to most severe.
+const (
+	DebugLevel LogLevel = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// logLevelNames are the names used for the levels in configuration settings
+// and the log level endpoint.
+var logLevelNames = map[LogLevel]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+// logLevelLabels are the labels used for the levels in log messages. They
+// match the ones logcabin used, so that existing log searches keep working.
+var logLevelLabels = map[LogLevel]string{
+	DebugLevel: "TRACE",
+	InfoLevel:  "INFO",
+	WarnLevel:  "WARN",
+	ErrorLevel: "ERR",
+}
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel returns the level with the name.
+func parseLogLevel(name string) (LogLevel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %s; use debug, info, warn, or error", name)
+}
+
+// Fields are structured values added to log messages.
+type Fields map[string]interface{}
+
+// Logger is a leveled, structured logger. Loggers derived with WithFields share
+// their parent's level and output.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+
+	WithFields(fields Fields) Logger
+	SetLevel(level LogLevel)
+	Level() LogLevel
+}
+
+// jsonLoggerOutput is the destination and level shared by a logger and the
+// loggers derived from it.
+type jsonLoggerOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+}
+
+// jsonLogger is a Logger that writes each message as a line of JSON in the
+// format logstash expects from the DE services.
+type jsonLogger struct {
+	output  *jsonLoggerOutput
+	service string
+	fields  Fields
+}
+
+// NewLogger returns a Logger that writes messages at or above the level to w,
+// labeled with the service name.
+func NewLogger(w io.Writer, service string, level LogLevel) Logger {
+	return &jsonLogger{
+		output:  &jsonLoggerOutput{w: w, level: int32(level)},
+		service: service,
+	}
+}
+
+// log is the service's logger. Every message names the running version.
+var log = NewLogger(os.Stdout, serviceName, InfoLevel).WithFields(Fields{"version": serviceVersion()})
+
+// SetLevel changes the level of the logger and every logger sharing its
+// output.
+func (l *jsonLogger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.output.level, int32(level))
+}
+
+// Level returns the logger's current level.
+func (l *jsonLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.output.level))
+}
+
+// WithFields returns a logger that adds the fields to each message.
+func (l *jsonLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &jsonLogger{output: l.output, service: l.service, fields: merged}
+}
+
+// write writes the message if the level is enabled. The caller is the file
+// and line of the code that logged the message.
+func (l *jsonLogger) write(level LogLevel, message string) {
+	if level < l.Level() {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+7)
+	for key, value := range l.fields {
+		entry[key] = value
+	}
+	entry["service"] = l.service
+	entry["art-id"] = l.service
+	entry["group-id"] = "org.iplantc"
+	entry["level"] = logLevelLabels[level]
+	entry["timeMillis"] = time.Now().UnixNano() / int64(time.Millisecond)
+	entry["message"] = strings.TrimSuffix(message, "\n")
+	if _, file, line, ok := runtime.Caller(2); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	jsoned, err := json.Marshal(entry)
+	if err != nil {
+		jsoned, _ = json.Marshal(map[string]interface{}{
+			"service": l.service,
+			"level":   logLevelLabels[ErrorLevel],
+			"message": fmt.Sprintf("Error generating log message JSON: %s", err),
+		})
+	}
+
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+	l.output.w.Write(append(jsoned, '\n'))
+}
+
+func (l *jsonLogger) Debug(args ...interface{}) { l.write(DebugLevel, fmt.Sprint(args...)) }
+func (l *jsonLogger) Info(args ...interface{})  { l.write(InfoLevel, fmt.Sprint(args...)) }
+func (l *jsonLogger) Warn(args ...interface{})  { l.write(WarnLevel, fmt.Sprint(args...)) }
+func (l *jsonLogger) Error(args ...interface{}) { l.write(ErrorLevel, fmt.Sprint(args...)) }
+
+func (l *jsonLogger) Debugf(format string, args ...interface{}) {
+	l.write(DebugLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) Infof(format string, args ...interface{}) {
+	l.write(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) Warnf(format string, args ...interface{}) {
+	l.write(WarnLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) Errorf(format string, args ...interface{}) {
+	l.write(ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs the message as an error and exits.
+func (l *jsonLogger) Fatal(args ...interface{}) {
+	l.write(ErrorLevel, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+// Fatalf logs the message as an error and exits.
+func (l *jsonLogger) Fatalf(format string, args ...interface{}) {
+	l.write(ErrorLevel, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// logLevelBody is the body accepted and returned by the log level endpoint.
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// writeLogLevel writes the logger's current level as a response.
+func writeLogLevel(writer http.ResponseWriter) {
+	jsoned, err := json.Marshal(logLevelBody{Level: log.Level().String()})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating log level JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// GetLogLevelRequest handles getting the current log level.
+func (u *UserPreferencesApp) GetLogLevelRequest(writer http.ResponseWriter, r *http.Request) {
+	writeLogLevel(writer)
+}
+
+// PutLogLevelRequest handles changing the log level while the service is
+// running. The change isn't persisted; the configured level is used again
+// after a restart.
+func (u *UserPreferencesApp) PutLogLevelRequest(writer http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	level, err := parseLogLevel(body.Level)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	previous := log.Level()
+	log.SetLevel(level)
+	log.WithFields(Fields{"from": previous.String(), "to": level.String()}).Info("Changed the log level")
+	if err = u.audit("set-log-level", map[string]string{"from": previous.String(), "to": level.String()}); err != nil {
+		log.Error(err)
+	}
+
+	writeLogLevel(writer)
+}
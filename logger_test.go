@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "user-preferences", InfoLevel)
+
+	logger.Debug("dropped")
+	logger.WithFields(Fields{"user": "alice"}).Infof("Wrote %d keys", 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d lines were logged: %s", len(lines), buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["message"] != "Wrote 3 keys" || entry["level"] != "INFO" || entry["user"] != "alice" || entry["service"] != "user-preferences" {
+		t.Errorf("the entry was %v", entry)
+	}
+	if caller, _ := entry["caller"].(string); !strings.HasPrefix(caller, "logger_test.go:") {
+		t.Errorf("the caller was %v", entry["caller"])
+	}
+
+	buf.Reset()
+	derived := logger.WithFields(Fields{"user": "bob"})
+	logger.SetLevel(ErrorLevel)
+	derived.Warn("dropped")
+	if buf.Len() != 0 || derived.Level() != ErrorLevel {
+		t.Errorf("a derived logger didn't share the level: %s", buf.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, expected := range map[string]LogLevel{"debug": DebugLevel, "INFO": InfoLevel, "warning": WarnLevel, " error ": ErrorLevel} {
+		if level, err := parseLogLevel(name); err != nil || level != expected {
+			t.Errorf("%q was parsed as %s, %v", name, level, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("an unknown level was accepted")
+	}
+}
+
+func TestLogLevelRequest(t *testing.T) {
+	defer log.SetLevel(log.Level())
+
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	status, body := doRequest(t, http.MethodPut, server.URL+"/admin/loglevel", []byte(`{"level":"debug"}`), admin)
+	if status != http.StatusOK || string(body) != `{"level":"debug"}` || log.Level() != DebugLevel {
+		t.Errorf("setting the log level returned %d: %s", status, body)
+	}
+	if len(mock.audits) != 1 || !strings.HasPrefix(mock.audits[0], "set-log-level ") {
+		t.Errorf("the change wasn't audited: %v", mock.audits)
+	}
+
+	if status, body = doRequest(t, http.MethodGet, server.URL+"/admin/loglevel", nil, admin); status != http.StatusOK || string(body) != `{"level":"debug"}` {
+		t.Errorf("getting the log level returned %d: %s", status, body)
+	}
+	if status, _ = doRequest(t, http.MethodPut, server.URL+"/admin/loglevel", []byte(`{"level":"loud"}`), admin); status != http.StatusBadRequest {
+		t.Errorf("setting an unknown log level returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodPut, server.URL+"/admin/loglevel", []byte(`{"level":"error"}`), nil); status != http.StatusForbidden {
+		t.Errorf("setting the log level without the admin key returned %d", status)
+	}
+}
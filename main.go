@@ -3,18 +3,20 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	_ "expvar"
+	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cyverse-de/configurate"
 	"github.com/cyverse-de/dbutil"
-	"github.com/cyverse-de/logcabin"
-	"github.com/cyverse-de/queries"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
@@ -34,6 +36,9 @@ type UserPreferencesRecord struct {
 	ID          string
 	Preferences string
 	UserID      string
+	CreatedAt   time.Time
+	ModifiedAt  time.Time
+	Version     int64
 }
 
 // convert makes sure that the JSON has the correct format. "wrap" tells convert
@@ -42,15 +47,19 @@ func convert(record *UserPreferencesRecord, wrap bool) (map[string]interface{},
 	var values map[string]interface{}
 
 	if record.Preferences != "" {
-		if err := json.Unmarshal([]byte(record.Preferences), &values); err != nil {
+		if err := documentJSON.Unmarshal([]byte(record.Preferences), &values); err != nil {
 			return nil, err
 		}
 	}
 
+	// A document is only wrapped if its preferences key holds an object. A
+	// preferences key holding anything else is an ordinary preference.
+	_, wrapped := values["preferences"].(map[string]interface{})
+
 	// We don't want the return value wrapped in a preferences object, so unwrap it
 	// if it is wrapped.
 	if !wrap {
-		if _, ok := values["preferences"]; ok {
+		if wrapped {
 			return values["preferences"].(map[string]interface{}), nil
 		}
 		return values, nil
@@ -58,7 +67,10 @@ func convert(record *UserPreferencesRecord, wrap bool) (map[string]interface{},
 
 	// We do want the return value wrapped in a preferences object, so wrap it if it
 	// isn't already.
-	if _, ok := values["preferences"]; !ok {
+	if !wrapped {
+		if values == nil {
+			values = make(map[string]interface{})
+		}
 		newmap := make(map[string]interface{})
 		newmap["preferences"] = values
 		return newmap, nil
@@ -74,32 +86,148 @@ type DB interface {
 	getPreferences(username string) ([]UserPreferencesRecord, error)
 	insertPreferences(username, prefs string) error
 	updatePreferences(username, prefs string) error
+	updatePreferencesIfVersion(username, prefs string, version int64) (bool, error)
 	deletePreferences(username string) error
+	listPresets() ([]string, error)
+	getPreset(name string) (string, error)
+	savePreset(name, prefs string) error
+	deletePreset(name string) error
+	getGroupPreferences(group string) (string, error)
+	saveGroupPreferences(group, prefs string) error
+	deleteGroupPreferences(group string) error
+	getExpirations(username string) (map[string]time.Time, error)
+	setExpirations(username string, expirations map[string]time.Time) error
+	deleteExpirations(username string, keys []string) error
+	deleteExpiredKeys(username string, keys []string, before time.Time) error
+	listExpired(before time.Time) ([]ExpiredKey, error)
+	getIdempotentResponse(username, key string) (*IdempotentResponse, error)
+	reserveIdempotencyKey(resp *IdempotentResponse, expiredBefore time.Time) (bool, error)
+	saveIdempotentResponse(resp *IdempotentResponse) error
+	releaseIdempotencyKey(username, key string) error
+	purgeIdempotentResponses(before time.Time) (int64, error)
+	createSession(token, prefs string, expiresAt time.Time) error
+	getSession(token string) (*SessionRecord, error)
+	updateSession(token, prefs string, expiresAt time.Time) error
+	deleteSession(token string) error
+	purgeSessions(before time.Time) (int64, error)
+	listUsers(filter UserFilter) ([]UserSummary, error)
+	countKey(path string) (int64, error)
+	countDocuments() (int64, error)
+	countKeyValue(path string, value interface{}) (int64, error)
+	deleteKeyBatch(path string, limit int) (int64, error)
+	countRenameable(from, to string) (int64, error)
+	renameKeyBatch(from, to string, limit int) (int64, error)
+	recordAudit(action, details string) error
+	listHistory(username string, filter PageFilter) ([]HistoryRecord, error)
+	getHistoryVersion(username string, version int64) (*HistoryRecord, error)
+	purgeHistory(before time.Time) (int64, error)
+	listUserAudits(username string) ([]AuditRecord, error)
+	eraseUser(username string) (map[string]int64, error)
+	upsertPreferences(prefs map[string]string) (map[string]bool, error)
+	listSearches(username string) ([]SavedSearch, error)
+	getSearch(username, id string) (*SavedSearch, error)
+	putSearch(username, id, search string) (bool, error)
+	deleteSearch(username, id string) (bool, error)
+	replaceSearches(username string, searches map[string]string) error
+	getUISession(username string) (*UISessionRecord, error)
+	saveUISession(username, session string, expiresAt time.Time) error
+	deleteUISession(username string) error
+	purgeUISessions(before time.Time) (int64, error)
+	listBags(username string) ([]BagRecord, error)
+	getBag(username, name string) (*BagRecord, error)
+	getDefaultBag(username string) (*BagRecord, error)
+	putBag(username, name, contents string) (bool, error)
+	deleteBag(username, name string) (bool, error)
+	setDefaultBag(username, name string) (bool, error)
+	listExperimentAssignments(username string) (map[string]string, error)
+	addExperimentAssignment(username, experiment, variant string) error
+	listAudits(filter AuditFilter) ([]AuditRecord, error)
+	listKeys(username string) ([]KeyInfo, error)
+	getUndoState(username string) (*UndoState, error)
+	saveUndoState(username string, state UndoState) error
+	createScheduledChange(change *ScheduledChange) error
+	getScheduledChange(id int64) (*ScheduledChange, error)
+	listScheduledChanges(filter ScheduleFilter) ([]ScheduledChange, error)
+	cancelScheduledChange(id int64) (bool, error)
+	claimScheduledChange(id int64, at time.Time) (bool, error)
+	failScheduledChange(id int64, msg string) error
+	getRollout(name string) (*Rollout, error)
+	listRollouts() ([]Rollout, error)
+	saveRollout(rollout *Rollout) error
+	getRolloutMembers(name string, usernames []string) (map[string]string, error)
+	addRolloutMember(name, username, previous string) error
+	removeRolloutMember(name, username string) error
+	verifyChecksums() (*ChecksumReport, error)
+	dispatchEvents(limit int, publish func(event *OutboxEvent) error) (int, error)
+	purgeEvents(before time.Time, all bool) (int64, error)
+	pendingEvents() (int64, *time.Time, error)
+	replayEvents(filter EventFilter) ([]OutboxEvent, error)
+	databaseReport() (*DatabaseReport, error)
+	addUsage(usage []UserUsage) error
+	getUsage(username string) (*UserUsage, error)
+	archivePreferences(before time.Time, limit int) (int64, error)
+	restorePreferences(username string) (bool, error)
+	listRegisteredKeys() ([]RegisteredKey, error)
+	saveRegisteredKey(k *RegisteredKey) error
+	deleteRegisteredKey(key string) (bool, error)
+	lookupUsername(username string) (string, error)
 }
 
 // PrefsDB implements the DB interface for interacting with the user-preferences
 // database.
 type PrefsDB struct {
 	db *sql.DB
+
+	// tables are the names of the tables that the queries are built with.
+	tables TableNames
+
+	// cockroach is true if the database is CockroachDB.
+	cockroach bool
+
+	// compressAbove is the size in bytes above which documents are stored
+	// compressed. Compression is disabled if it's 0.
+	compressAbove int
+
+	// objects stores documents larger than its threshold in object storage.
+	// Offloading is disabled if it's nil.
+	objects *ObjectStore
 }
 
 // NewPrefsDB returns a newly created *PrefsDB.
 func NewPrefsDB(db *sql.DB) *PrefsDB {
 	return &PrefsDB{
-		db: db,
+		db:        db,
+		tables:    tables,
+		cockroach: cockroachMode,
 	}
 }
 
 // isUser returns whether the user exists in the database or not.
 func (p *PrefsDB) isUser(username string) (bool, error) {
-	return queries.IsUser(p.db, username)
+	query := `SELECT COUNT(*) FROM ( SELECT DISTINCT ` + p.tables.UserID + ` FROM ` + p.tables.Users +
+		` WHERE ` + p.tables.Username + ` = $1 ) AS check_user`
+	var count int64
+	if err := p.db.QueryRow(query, username).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// userID returns the ID of the user in the users table.
+func (p *PrefsDB) userID(username string) (string, error) {
+	query := `SELECT ` + p.tables.UserID + ` FROM ` + p.tables.Users + ` WHERE ` + p.tables.Username + ` = $1`
+	var userID string
+	if err := p.db.QueryRow(query, username).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, nil
 }
 
 // hasPreferences returns whether or not the given user has preferences already.
 func (p *PrefsDB) hasPreferences(username string) (bool, error) {
 	query := `SELECT COUNT(p.*)
-              FROM user_preferences p,
-                   users u
+              FROM ` + p.tables.Preferences + ` p,
+                   ` + p.tables.usersSource() + ` u
              WHERE p.user_id = u.id
                AND u.username = $1`
 	var count int64
@@ -114,9 +242,15 @@ func (p *PrefsDB) hasPreferences(username string) (bool, error) {
 func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
 	query := `SELECT p.id AS id,
                    p.user_id AS user_id,
-                   p.preferences AS preferences
-              FROM user_preferences p,
-                   users u
+                   p.preferences AS preferences,
+                   p.encoding AS encoding,
+                   p.compressed AS compressed,
+                   p.checksum AS checksum,
+                   p.created_at AS created_at,
+                   p.modified_at AS modified_at,
+                   p.version AS version
+              FROM ` + p.tables.Preferences + ` p,
+                   ` + p.tables.usersSource() + ` u
              WHERE p.user_id = u.id
                AND u.username = $1`
 
@@ -128,8 +262,31 @@ func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, erro
 
 	var prefs []UserPreferencesRecord
 	for rows.Next() {
-		var pref UserPreferencesRecord
-		if err := rows.Scan(&pref.ID, &pref.UserID, &pref.Preferences); err != nil {
+		var (
+			pref       UserPreferencesRecord
+			stored     sql.NullString
+			encoding   string
+			compressed []byte
+			checksum   sql.NullString
+		)
+		err := rows.Scan(
+			&pref.ID,
+			&pref.UserID,
+			&stored,
+			&encoding,
+			&compressed,
+			&checksum,
+			&pref.CreatedAt,
+			&pref.ModifiedAt,
+			&pref.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if pref.Preferences, err = p.decode(stored, encoding, compressed); err != nil {
+			return nil, fmt.Errorf("Error decoding preferences for user %s: %s", username, err)
+		}
+		if err = verifyChecksum(username, pref.Preferences, checksum); err != nil {
 			return nil, err
 		}
 		prefs = append(prefs, pref)
@@ -144,33 +301,73 @@ func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, erro
 
 // insertPreferences adds a new preferences to the database for the user.
 func (p *PrefsDB) insertPreferences(username, prefs string) error {
-	query := `INSERT INTO user_preferences (user_id, preferences)
-                 VALUES ($1, $2)`
-	userID, err := queries.UserID(p.db, username)
+	query := `INSERT INTO ` + p.tables.Preferences + ` (user_id, preferences, encoding, compressed, checksum)
+                 VALUES ($1, $2, $3, $4, $5)`
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+	stored, encoding, compressed, err := p.encodePreferences(prefs)
 	if err != nil {
 		return err
 	}
-	_, err = p.db.Exec(query, userID, prefs)
+	_, err = p.db.Exec(query, userID, stored, encoding, compressed, preferencesChecksum(prefs))
 	return err
 }
 
 // updatePreferences updates the preferences in the database for the user.
 func (p *PrefsDB) updatePreferences(username, prefs string) error {
-	query := `UPDATE ONLY user_preferences
-                    SET preferences = $2
+	query := `UPDATE ` + p.onlyPreferences() + `
+                    SET preferences = $2,
+                        encoding = $3,
+                        compressed = $4,
+                        checksum = $5,
+                        version = version + 1
                   WHERE user_id = $1`
-	userID, err := queries.UserID(p.db, username)
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+	stored, encoding, compressed, err := p.encodePreferences(prefs)
 	if err != nil {
 		return err
 	}
-	_, err = p.db.Exec(query, userID, prefs)
+	_, err = p.db.Exec(query, userID, stored, encoding, compressed, preferencesChecksum(prefs))
 	return err
 }
 
+// updatePreferencesIfVersion updates the preferences in the database for the
+// user only if the stored version is still the one given, and returns whether
+// they were updated.
+func (p *PrefsDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	query := `UPDATE ` + p.onlyPreferences() + `
+                    SET preferences = $2,
+                        encoding = $3,
+                        compressed = $4,
+                        checksum = $5,
+                        version = version + 1
+                  WHERE user_id = $1
+                    AND version = $6`
+	userID, err := p.userID(username)
+	if err != nil {
+		return false, err
+	}
+	stored, encoding, compressed, err := p.encodePreferences(prefs)
+	if err != nil {
+		return false, err
+	}
+	result, err := p.db.Exec(query, userID, stored, encoding, compressed, preferencesChecksum(prefs), version)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
 // deletePreferences deletes the user's preferences from the database.
 func (p *PrefsDB) deletePreferences(username string) error {
-	query := `DELETE FROM ONLY user_preferences WHERE user_id = $1`
-	userID, err := queries.UserID(p.db, username)
+	query := `DELETE FROM ` + p.onlyPreferences() + ` WHERE user_id = $1`
+	userID, err := p.userID(username)
 	if err != nil {
 		return err
 	}
@@ -180,20 +377,38 @@ func (p *PrefsDB) deletePreferences(username string) error {
 
 func badRequest(writer http.ResponseWriter, msg string) {
 	http.Error(writer, msg, http.StatusBadRequest)
-	logcabin.Error.Print(msg)
+	log.Error(msg)
+}
+
+func forbidden(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusForbidden)
+	log.Error(msg)
+}
+
+func notFound(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusNotFound)
+	log.Error(msg)
 }
 
 func errored(writer http.ResponseWriter, msg string) {
 	http.Error(writer, msg, http.StatusInternalServerError)
-	logcabin.Error.Print(msg)
+	log.Error(msg)
 }
 
-func handleNonUser(writer http.ResponseWriter, username string) {
+// handleNonUser writes out the response for a request naming a user that
+// doesn't exist: a 400 naming the user in version 1 of the API, and a 404 in
+// version 2.
+func handleNonUser(writer http.ResponseWriter, r *http.Request, username string) {
 	var (
 		retval []byte
 		err    error
 	)
 
+	if apiVersion(r) >= apiV2 {
+		notFound(writer, fmt.Sprintf("User %s does not exist", username))
+		return
+	}
+
 	retval, err = json.Marshal(map[string]string{
 		"user": username,
 	})
@@ -210,36 +425,191 @@ func handleNonUser(writer http.ResponseWriter, username string) {
 // UserPreferencesApp is an implementation of the App interface created to manage
 // user preferences.
 type UserPreferencesApp struct {
-	prefs  DB
-	router *mux.Router
+	prefs       DB
+	router      *mux.Router
+	flagDefault bool
+	adminKey    string
+	identity    serviceIdentity
+	openapi     []byte
+	usernames   *UsernamePolicy
+	auth        Authenticator
+	groups      GroupLookup
+	defaults    map[string]interface{}
+	locales     *LocaleDefaults
+	locks       *KeyLocks
+	immutable   *ImmutableKeys
+	reserved    *ReservedKeys
+	keyFilter   *KeyFilter
+	computed    []ComputedKey
+	experiments []Experiment
+	templates   *Templates
+	jobs        *JobRunner
+	breaker     *CircuitBreaker
+	caching     *CachePolicy
+	compression *ResponseCompression
+	dualWrite   *DualWriteDB
+	outbox      *Outbox
+	operations  *OperationTracker
+	chaos       *Chaos
+	share       *ShareSigner
+	pii         *PIIScanner
+	webhooks    *WebhookPolicy
+	usage       *UsageTracker
+	pools       map[string]*sql.DB
+
+	contentMetrics *ContentMetrics
+
+	idempotencyWindow time.Duration
+	sessionTTL        time.Duration
+	uiSessionTTL      time.Duration
+	historyRetention  time.Duration
+	archiveAfter      time.Duration
+	archiveBatchSize  int
+	quota             int
+	uiSessionLimit    int
+	maxPageSize       int
+	merge             mergeOptions
+	requireVersion    bool
+	impersonation     bool
+	emptyNotFound     bool
+	archiving         bool
+	undoDepth         int
+	quotaWarningAt    float64
+	warnOnly          bool
+	foldUsernames     bool
+
+	warnUnregisteredKeys bool
+	warnDeprecatedKeys   bool
 }
 
 // New returns a new *UserPreferencesApp
 func New(db DB) *UserPreferencesApp {
 	p := &UserPreferencesApp{
-		prefs:  db,
-		router: mux.NewRouter(),
+		prefs:    db,
+		router:   mux.NewRouter(),
+		jobs:     NewJobRunner(),
+		identity: serviceIdentity{name: serviceName, description: defaultServiceDescription},
+		openapi:  embeddedOpenAPI,
+
+		caching:    &CachePolicy{},
+		templates:  NewTemplates(nil, nil),
+		webhooks:   NewWebhookPolicy(nil, nil, 10*time.Second),
+		operations: NewOperationTracker(500),
+
+		idempotencyWindow: 24 * time.Hour,
+		sessionTTL:        30 * 24 * time.Hour,
+		merge:             mergeOptions{arrays: arrayStrategy{name: arraysReplace}},
+		impersonation:     true,
+		maxPageSize:       100,
+		undoDepth:         10,
 	}
 	p.router.HandleFunc("/", p.Greeting).Methods("GET")
+	p.router.HandleFunc("/healthz", p.HealthRequest).Methods("GET")
+	p.router.HandleFunc("/readyz", p.ReadyRequest).Methods("GET")
+	p.router.HandleFunc("/openapi.json", p.OpenAPIRequest).Methods("GET")
+	p.router.HandleFunc("/metrics", p.MetricsRequest).Methods("GET")
+	p.router.HandleFunc("/version", p.VersionRequest).Methods("GET")
+	p.router.HandleFunc("/admin/dual-write", p.adminOnly(p.DualWriteRequest)).Methods("GET", "POST")
+	p.router.HandleFunc("/admin/jobs", p.adminOnly(p.JobsRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/jobs/{name}/run", p.adminOnly(p.RunJobRequest)).Methods("POST")
+	p.router.HandleFunc("/admin/audit", p.adminOnly(p.AuditRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/checksums", p.adminOnly(p.ChecksumsRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/db-report", p.adminOnly(p.DatabaseReportRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/registry/{key}", p.adminOnly(p.idempotent(p.RegisterKeyRequest))).Methods("PUT")
+	p.router.HandleFunc("/admin/registry/{key}", p.adminOnly(p.idempotent(p.UnregisterKeyRequest))).Methods("DELETE")
+	p.router.HandleFunc("/admin/usage/{username}", p.adminOnly(p.UsageRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/loglevel", p.adminOnly(p.GetLogLevelRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/loglevel", p.adminOnly(p.PutLogLevelRequest)).Methods("PUT")
+	p.router.HandleFunc("/admin/users", p.adminOnly(p.ListUsersRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/keys/rename", p.adminOnly(p.RenameKeyRequest)).Methods("POST")
+	p.router.HandleFunc("/admin/keys/{key}", p.adminOnly(p.DeleteKeyRequest)).Methods("DELETE")
+	p.router.HandleFunc("/admin/preferences", p.adminOnly(p.idempotent(p.BulkWriteRequest))).Methods("PUT")
+	p.router.HandleFunc("/admin/events", p.adminOnly(p.EventsRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/outbox", p.adminOnly(p.OutboxRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/operations", p.adminOnly(p.OperationsRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/operations/{id}", p.adminOnly(p.OperationRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/runtime", p.adminOnly(p.RuntimeRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/rollout", p.adminOnly(p.ListRolloutsRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/rollout", p.adminOnly(p.idempotent(p.RolloutRequest))).Methods("POST")
+	p.router.HandleFunc("/admin/rollout/{name}", p.adminOnly(p.GetRolloutRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/rollout/{name}/rollback", p.adminOnly(p.idempotent(p.RollbackRequest))).Methods("POST")
+	p.router.HandleFunc("/admin/schedule", p.adminOnly(p.ListScheduledChangesRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/schedule", p.adminOnly(p.idempotent(p.ScheduleChangeRequest))).Methods("POST")
+	p.router.HandleFunc("/admin/schedule/{id}", p.adminOnly(p.GetScheduledChangeRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/schedule/{id}", p.adminOnly(p.CancelScheduledChangeRequest)).Methods("DELETE")
+	p.router.HandleFunc("/admin/ui", p.AdminUIRedirect).Methods("GET")
+	p.router.HandleFunc("/admin/ui/", p.adminUI(p.AdminUIRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/ui/api/users/{username}", p.adminUI(p.GetRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/ui/api/users/{username}", p.adminUI(p.PutRequest)).Methods("PUT")
+	p.router.HandleFunc("/admin/ui/api/users/{username}/history", p.adminUI(p.HistoryRequest)).Methods("GET")
+	p.router.HandleFunc("/admin/ui/api/users/{username}/history/{version}/restore", p.adminUI(p.RestoreRequest)).Methods("POST")
+	p.router.HandleFunc("/registry", p.RegistryRequest).Methods("GET")
+	p.router.HandleFunc("/presets", p.ListPresetsRequest).Methods("GET")
+	p.router.HandleFunc("/presets/{name}", p.GetPresetRequest).Methods("GET")
+	p.router.HandleFunc("/presets/{name}", p.adminOnly(p.idempotent(p.PutPresetRequest))).Methods("PUT", "POST")
+	p.router.HandleFunc("/presets/{name}", p.adminOnly(p.idempotent(p.DeletePresetRequest))).Methods("DELETE")
+	p.router.HandleFunc("/groups/{group}", p.GetGroupRequest).Methods("GET")
+	p.router.HandleFunc("/groups/{group}", p.adminOnly(p.idempotent(p.PutGroupRequest))).Methods("PUT", "POST")
+	p.router.HandleFunc("/groups/{group}", p.adminOnly(p.idempotent(p.DeleteGroupRequest))).Methods("DELETE")
+	p.router.HandleFunc("/sessions", p.CreateSessionRequest).Methods("POST")
+	p.router.HandleFunc("/sessions/{token}", p.GetSessionRequest).Methods("GET")
+	p.router.HandleFunc("/sessions/{token}", p.PutSessionRequest).Methods("PUT", "POST")
+	p.router.HandleFunc("/sessions/{token}", p.DeleteSessionRequest).Methods("DELETE")
+	p.router.HandleFunc("/shared/{token}", p.SharedRequest).Methods("GET")
 	p.router.HandleFunc("/{username}", p.GetRequest).Methods("GET")
-	p.router.HandleFunc("/{username}", p.PutRequest).Methods("PUT")
-	p.router.HandleFunc("/{username}", p.PostRequest).Methods("POST")
-	p.router.HandleFunc("/{username}", p.DeleteRequest).Methods("DELETE")
-	p.router.Handle("/debug/vars", http.DefaultServeMux)
+	p.router.HandleFunc("/{username}", p.idempotent(p.PutRequest)).Methods("PUT")
+	p.router.HandleFunc("/{username}", p.idempotent(p.PostRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}", p.idempotent(p.DeleteRequest)).Methods("DELETE")
+	p.router.HandleFunc("/{username}/flags/{flag}", p.GetFlagRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/flags/{flag}/toggle", p.idempotent(p.ToggleFlagRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}/apply-preset/{name}", p.idempotent(p.ApplyPresetRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}/effective", p.EffectiveRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/bundle", p.BundleRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/experiments", p.ExperimentsRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/typed", p.TypedRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/keys", p.KeysRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/webhooks/test", p.WebhookTestRequest).Methods("POST")
+	p.router.HandleFunc("/{username}/session", p.GetUISessionRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/session", p.PutUISessionRequest).Methods("PUT")
+	p.router.HandleFunc("/{username}/session", p.PostUISessionRequest).Methods("POST")
+	p.router.HandleFunc("/{username}/session", p.DeleteUISessionRequest).Methods("DELETE")
+	p.router.HandleFunc("/{username}/searches", p.ListSearchesRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/searches", p.idempotent(p.ReplaceSearchesRequest)).Methods("PUT")
+	p.router.HandleFunc("/{username}/searches", p.idempotent(p.DeleteSearchesRequest)).Methods("DELETE")
+	p.router.HandleFunc("/{username}/searches/{id}", p.GetSearchRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/searches/{id}", p.idempotent(p.PutSearchRequest)).Methods("PUT")
+	p.router.HandleFunc("/{username}/searches/{id}", p.idempotent(p.DeleteSearchRequest)).Methods("DELETE")
+	p.router.HandleFunc("/{username}/bags", p.ListBagsRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/bags/{name}", p.GetBagRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/bags/{name}", p.idempotent(p.PutBagRequest)).Methods("PUT")
+	p.router.HandleFunc("/{username}/bags/{name}", p.idempotent(p.DeleteBagRequest)).Methods("DELETE")
+	p.router.HandleFunc("/{username}/default-bag", p.GetDefaultBagRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/default-bag", p.idempotent(p.PutDefaultBagRequest)).Methods("PUT")
+	p.router.HandleFunc("/{username}/adopt-session/{token}", p.idempotent(p.AdoptSessionRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}/quota", p.QuotaRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/merge", p.idempotent(p.MergeRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}/history", p.HistoryRequest).Methods("GET")
+	p.router.HandleFunc("/{username}/share", p.ShareRequest).Methods("POST")
+	p.router.HandleFunc("/{username}/gdpr-export", p.adminOnly(p.GDPRExportRequest)).Methods("GET")
+	p.router.HandleFunc("/{username}/gdpr-erase", p.adminOnly(p.GDPREraseRequest)).Methods("DELETE")
+	p.router.HandleFunc("/{username}/history/{version}/restore", p.idempotent(p.RestoreRequest)).Methods("POST")
+	p.router.HandleFunc("/{username}/undo", p.idempotent(p.UndoRequest)).Methods("POST")
+	p.router.HandleFunc("/debug/vars", p.adminOnly(expvar.Handler().ServeHTTP)).Methods("GET")
 	return p
 }
 
-// Greeting prints out a greeting to the writer.
-func (u *UserPreferencesApp) Greeting(writer http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(writer, "Hello from user-preferences.")
-}
-
-func (u *UserPreferencesApp) getUserPreferencesForRequest(username string, wrap bool) ([]byte, error) {
+// preferencesResponse returns the response document for the user's
+// preferences, with any expired keys removed, along with the record that the
+// preferences were read from. The record is empty if the user doesn't have any
+// preferences.
+func (u *UserPreferencesApp) preferencesResponse(username string, wrap bool) (map[string]interface{}, UserPreferencesRecord, error) {
 	var retval UserPreferencesRecord
 
 	prefs, err := u.prefs.getPreferences(username)
-	if err != nil {
-		return nil, fmt.Errorf("Error getting preferences for username %s: %s", username, err)
+	if _, ok := err.(*ChecksumError); ok {
+		return nil, retval, err
+	} else if err != nil {
+		return nil, retval, fmt.Errorf("Error getting preferences for username %s: %s", username, err)
 	}
 
 	if len(prefs) >= 1 {
@@ -248,12 +618,29 @@ func (u *UserPreferencesApp) getUserPreferencesForRequest(username string, wrap
 
 	response, err := convert(&retval, wrap)
 	if err != nil {
-		return nil, fmt.Errorf("Error generating response for username %s: %s", username, err)
+		return nil, retval, fmt.Errorf("Error generating response for username %s: %s", username, err)
+	}
+
+	values := response
+	if wrap {
+		values, _ = response["preferences"].(map[string]interface{})
+	}
+	if err = u.stripExpired(username, values, time.Now()); err != nil {
+		return nil, retval, err
+	}
+
+	return response, retval, nil
+}
+
+func (u *UserPreferencesApp) getUserPreferencesForRequest(username string, wrap bool) ([]byte, error) {
+	response, _, err := u.preferencesResponse(username, wrap)
+	if err != nil {
+		return nil, err
 	}
 
 	var jsoned []byte
 	if len(response) > 0 {
-		jsoned, err = json.Marshal(response)
+		jsoned, err = documentJSON.Marshal(response)
 		if err != nil {
 			return nil, fmt.Errorf("Error generating preferences JSON for user %s: %s", username, err)
 		}
@@ -264,6 +651,105 @@ func (u *UserPreferencesApp) getUserPreferencesForRequest(username string, wrap
 	return jsoned, nil
 }
 
+// includeMetaParam is the query parameter clients use to request the full
+// metadata about the stored preferences record.
+const includeMetaParam = "include-meta"
+
+// preferencesMeta contains metadata about a stored preferences record. The
+// version and size are only included when the client asks for them.
+type preferencesMeta struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Version    int64     `json:"version,omitempty"`
+	Size       int       `json:"size,omitempty"`
+}
+
+// includeMeta returns whether the request asked for the full metadata.
+func includeMeta(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get(includeMetaParam))
+	return include
+}
+
+// newPreferencesMeta returns the metadata for the record, including the
+// version and size if full is true.
+func newPreferencesMeta(record UserPreferencesRecord, full bool) *preferencesMeta {
+	meta := &preferencesMeta{
+		ID:         record.ID,
+		CreatedAt:  record.CreatedAt,
+		ModifiedAt: record.ModifiedAt,
+	}
+	if full {
+		meta.Version = record.Version
+		meta.Size = len(record.Preferences)
+	}
+	return meta
+}
+
+// checkLastModified sets the Last-Modified header from the record's
+// modification time. If the request's If-Modified-Since header shows that the
+// client's copy is current, a 304 is written and true is returned.
+func checkLastModified(writer http.ResponseWriter, r *http.Request, record UserPreferencesRecord) bool {
+	lastModified := record.ModifiedAt.UTC().Truncate(time.Second)
+	writer.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.After(since) {
+		return false
+	}
+
+	writer.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeStoredPreferences writes out the wrapped preferences after a write,
+// along with metadata about the stored record and any warnings about the
+// write. First-time writes get a 201 and a Location header pointing at the
+// user's preferences.
+func (u *UserPreferencesApp) writeStoredPreferences(writer http.ResponseWriter, r *http.Request, username string, created bool, warnings []WriteWarning) {
+	response, record, err := u.preferencesResponse(username, true)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	stored, _ := response["preferences"].(map[string]interface{})
+	hash, err := valueHash(stored)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error hashing preferences for user %s: %s", username, err))
+		return
+	}
+	writer.Header().Set(valueHashHeader, hash)
+	writer.Header().Set(versionHeader, strconv.FormatInt(record.Version, 10))
+
+	if response, err = u.applyComputed(username, response, true); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if response, err = u.applySearches(username, response, true); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	response["meta"] = newPreferencesMeta(record, includeMeta(r))
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	writer.Header().Set("Last-Modified", record.ModifiedAt.UTC().Format(http.TimeFormat))
+
+	status := http.StatusOK
+	if created {
+		writer.Header().Set("Location", externalPath(r, "/"+url.PathEscape(username)))
+		status = http.StatusCreated
+	}
+
+	if err = writeDocument(writer, r, status, response); err != nil {
+		log.Errorf("Error writing preferences for user %s: %s", username, err)
+	}
+}
+
 // GetRequest handles writing out a user's preferences as a response.
 func (u *UserPreferencesApp) GetRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
@@ -271,51 +757,105 @@ func (u *UserPreferencesApp) GetRequest(writer http.ResponseWriter, r *http.Requ
 		userExists bool
 		err        error
 		ok         bool
-		v          = mux.Vars(r)
 	)
 
-	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+	if username, ok = u.pathUsername(writer, r); !ok {
 		return
 	}
 
-	logcabin.Info.Printf("Getting user preferences for %s", username)
+	log.Infof("Getting user preferences for %s", username)
 	if userExists, err = u.prefs.isUser(username); err != nil {
 		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	jsoned, err := u.getUserPreferencesForRequest(username, false)
+	wrap := includeMeta(r)
+	response, record, err := u.preferencesResponse(username, wrap)
 	if err != nil {
+		readFailed(writer, err)
+		return
+	}
+
+	if !u.checkPreferencesExist(writer, username, record) {
+		return
+	}
+
+	stored := response
+	if wrap {
+		stored, _ = response["preferences"].(map[string]interface{})
+	}
+	hash, err := valueHash(stored)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error hashing preferences for user %s: %s", username, err))
+		return
+	}
+	writer.Header().Set(valueHashHeader, hash)
+	writer.Header().Set(versionHeader, strconv.FormatInt(record.Version, 10))
+
+	if response, err = u.applyComputed(username, response, wrap); err != nil {
 		errored(writer, err.Error())
+		return
+	}
+
+	if response, err = u.applyExperiments(username, response, wrap); err != nil {
+		readFailed(writer, err)
+		return
+	}
+
+	if response, err = u.applySearches(username, response, wrap); err != nil {
+		errored(writer, err.Error())
+		return
 	}
 
-	writer.Write(jsoned)
+	if response, err = u.applyTemplates(r, username, response, wrap); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if record.ID != "" {
+		if checkLastModified(writer, r, record) {
+			return
+		}
+
+		if wrap {
+			response["meta"] = newPreferencesMeta(record, true)
+		}
+	}
+
+	if err = writeDocument(writer, r, http.StatusOK, response); err != nil {
+		log.Errorf("Error writing preferences for user %s: %s", username, err)
+	}
 }
 
-// PutRequest handles creating new user preferences.
+// PutRequest handles creating or replacing a user's preferences. The body
+// replaces the entire stored document.
 func (u *UserPreferencesApp) PutRequest(writer http.ResponseWriter, r *http.Request) {
-	u.PostRequest(writer, r)
+	u.writeRequest(writer, r, false)
 }
 
-// PostRequest handles modifying an existing user's preferences.
+// PostRequest handles modifying a user's preferences. The body is deep-merged
+// into the stored document, so keys it doesn't mention are left alone.
 func (u *UserPreferencesApp) PostRequest(writer http.ResponseWriter, r *http.Request) {
+	u.writeRequest(writer, r, true)
+}
+
+// writeRequest handles writing a user's preferences, merging the body into the
+// stored document if merge is true and replacing the document otherwise.
+func (u *UserPreferencesApp) writeRequest(writer http.ResponseWriter, r *http.Request, merge bool) {
 	var (
 		username   string
 		userExists bool
 		hasPrefs   bool
 		err        error
 		ok         bool
-		v          = mux.Vars(r)
 	)
 
-	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+	if username, ok = u.pathUsername(writer, r); !ok {
 		return
 	}
 
@@ -325,7 +865,7 @@ func (u *UserPreferencesApp) PostRequest(writer http.ResponseWriter, r *http.Req
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
@@ -334,41 +874,216 @@ func (u *UserPreferencesApp) PostRequest(writer http.ResponseWriter, r *http.Req
 		return
 	}
 
-	var checked map[string]interface{}
-	bodyBuffer, err := ioutil.ReadAll(r.Body)
+	checked, err := decodeDocument(r)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
 		return
 	}
 
-	if err = json.Unmarshal(bodyBuffer, &checked); err != nil {
-		errored(writer, fmt.Sprintf("Error parsing request body: %s", err))
+	cond, checked, err := parseWriteCondition(r, checked)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing write condition: %s", err))
 		return
 	}
 
-	bodyString := string(bodyBuffer)
-	if !hasPrefs {
-		if err = u.prefs.insertPreferences(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
+	if u.requireVersion && (cond == nil || cond.version == nil) {
+		preconditionRequired(writer, fmt.Sprintf("Writes must include the version they read in the %s header or the %s field", ifVersionHeader, versionKey))
+		return
+	}
+
+	expirations, err := requestExpirations(r, checked, time.Now())
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing key expirations: %s", err))
+		return
+	}
+
+	var (
+		searches    map[string]interface{}
+		hasSearches bool
+	)
+	if wrapped, ok := checked["preferences"].(map[string]interface{}); ok {
+		searches, hasSearches, err = extractSearches(wrapped)
+	} else {
+		searches, hasSearches, err = extractSearches(checked)
+	}
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	var opts mergeOptions
+	if merge {
+		if opts, err = u.merge.forRequest(r); err != nil {
+			badRequest(writer, fmt.Sprintf("Error parsing the %s header: %s", mergeArraysHeader, err))
 			return
 		}
-	} else {
-		if err = u.prefs.updatePreferences(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+	}
+
+	var (
+		warnings []WriteWarning
+		body     map[string]interface{}
+	)
+	for attempt := 1; ; attempt++ {
+		var (
+			record     UserPreferencesRecord
+			bodyString string
+		)
+		body = checked
+		if merge {
+			if body, record, ok = u.mergeStored(writer, username, checked, opts); !ok {
+				return
+			}
+		}
+
+		if bodyString, warnings, ok = u.prepareWrite(writer, r, username, body); !ok {
 			return
 		}
+
+		if cond != nil {
+			if !u.storeIfMatches(writer, r, username, bodyString, cond) {
+				return
+			}
+		} else if merge && record.ID != "" {
+			// The merged document is only stored if the preferences it was
+			// merged into are still current, so that concurrent merges don't
+			// lose each other's changes.
+			updated, err := u.prefs.updatePreferencesIfVersion(username, bodyString, record.Version)
+			if err != nil {
+				errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+				return
+			}
+			if !updated {
+				if attempt >= mergeAttempts {
+					conflict(writer, fmt.Sprintf("The preferences for user %s kept changing while they were being merged", username))
+					return
+				}
+				continue
+			}
+		} else if !hasPrefs {
+			if err = u.prefs.insertPreferences(username, bodyString); err != nil {
+				errored(writer, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
+				return
+			}
+		} else {
+			if err = u.prefs.updatePreferences(username, bodyString); err != nil {
+				errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+				return
+			}
+		}
+		break
 	}
 
-	jsoned, err := u.getUserPreferencesForRequest(username, true)
-	if err != nil {
+	written, stored := checked, body
+	if wrapped, ok := checked["preferences"].(map[string]interface{}); ok {
+		written = wrapped
+	}
+	if wrapped, ok := body["preferences"].(map[string]interface{}); ok {
+		stored = wrapped
+	}
+	if err = u.storeExpirations(username, written, stored, merge, expirations); err != nil {
 		errored(writer, err.Error())
 		return
 	}
 
-	writer.Write(jsoned)
+	if hasSearches {
+		if err = u.storeDocumentSearches(username, searches, merge); err != nil {
+			errored(writer, err.Error())
+			return
+		}
+	}
+
+	u.writeStoredPreferences(writer, r, username, !hasPrefs, warnings)
+}
+
+// mergeStored returns the request's document merged into the user's stored
+// preferences, along with the record they were read from. The request's
+// document isn't modified, so that the merge can be tried again. It writes out
+// an error response and returns false if the preferences can't be read.
+func (u *UserPreferencesApp) mergeStored(writer http.ResponseWriter, username string, checked map[string]interface{}, opts mergeOptions) (map[string]interface{}, UserPreferencesRecord, bool) {
+	stored, record, err := u.loadPreferencesRecord(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return nil, record, false
+	}
+
+	merged := deepCopy(checked).(map[string]interface{})
+	if wrapped, ok := merged["preferences"].(map[string]interface{}); ok {
+		merged["preferences"] = deepMerge(stored, wrapped, opts)
+	} else {
+		merged = deepMerge(stored, merged, opts)
+	}
+	return merged, record, true
+}
+
+// prepareWrite enforces the locked keys on a request's document and checks it,
+// returning the JSON to store and any validation warnings. It writes out an
+// error response and returns false if the write is rejected.
+func (u *UserPreferencesApp) prepareWrite(writer http.ResponseWriter, r *http.Request, username string, checked map[string]interface{}) (string, []WriteWarning, bool) {
+	var ok bool
+	if u.lockedFor(r) {
+		incoming := checked
+		if wrapped, ok := checked["preferences"].(map[string]interface{}); ok {
+			incoming = wrapped
+		}
+
+		if checked, ok = u.applyLocks(writer, r, username, incoming); !ok {
+			return "", nil, false
+		}
+	}
+
+	var warnings []WriteWarning
+	if wrapped, ok := checked["preferences"].(map[string]interface{}); ok {
+		if checked["preferences"], warnings, ok = u.checkWrite(writer, username, wrapped); !ok {
+			return "", nil, false
+		}
+	} else if checked, warnings, ok = u.checkWrite(writer, username, checked); !ok {
+		return "", nil, false
+	}
+
+	if wrapped, ok := checked["preferences"].(map[string]interface{}); ok {
+		u.stripComputed(wrapped)
+	} else {
+		u.stripComputed(checked)
+	}
+
+	// The body is re-encoded rather than stored as it was sent, so that the
+	// expirations in a wrapped body aren't stored as part of the preferences.
+	bodyJSON, err := documentJSON.Marshal(checked)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating preferences JSON for user %s: %s", username, err))
+		return "", nil, false
+	}
+
+	if err = u.checkQuota(username, len(bodyJSON)); err != nil {
+		storeFailed(writer, err)
+		return "", nil, false
+	}
+	return string(bodyJSON), warnings, true
 }
 
-// DeleteRequest handles deleting a user's preferences.
+// checkWrite passes an unwrapped document that's about to be stored through the
+// PII scan, the key filter, and validation, returning the document to store and
+// any validation warnings. It writes out an error response and returns false
+// if the write is rejected.
+func (u *UserPreferencesApp) checkWrite(writer http.ResponseWriter, username string, incoming map[string]interface{}) (map[string]interface{}, []WriteWarning, bool) {
+	incoming, ok := u.scanWrite(writer, username, incoming)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if incoming, ok = u.filterWrite(writer, username, incoming); !ok {
+		return nil, nil, false
+	}
+
+	warnings, ok := u.validateWrite(writer, username, incoming)
+	if !ok {
+		return nil, nil, false
+	}
+	return incoming, warnings, true
+}
+
+// DeleteRequest handles deleting a user's preferences. Clients that ask for
+// it with return=representation get the document as it was before the delete.
 func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
 		username   string
@@ -376,11 +1091,9 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 		hasPrefs   bool
 		err        error
 		ok         bool
-		v          = mux.Vars(r)
 	)
 
-	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+	if username, ok = u.pathUsername(writer, r); !ok {
 		return
 	}
 
@@ -390,7 +1103,7 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
@@ -399,13 +1112,49 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 		return
 	}
 
+	var (
+		removed map[string]interface{}
+		record  UserPreferencesRecord
+	)
+	if wantsRepresentation(r) {
+		if removed, record, err = u.deletedDocument(username, hasPrefs); err != nil {
+			errored(writer, err.Error())
+			return
+		}
+	}
+
 	if !hasPrefs {
+		u.finishDelete(writer, r, username, removed, record)
 		return
 	}
 
+	if u.lockedFor(r) {
+		remaining, ok := u.applyLocks(writer, r, username, make(map[string]interface{}))
+		if !ok {
+			return
+		}
+
+		if len(remaining) > 0 {
+			if _, err = u.storePreferences(username, remaining); err != nil {
+				storeFailed(writer, err)
+				return
+			}
+			u.finishDelete(writer, r, username, removed, record)
+			return
+		}
+	}
+
 	if err = u.prefs.deletePreferences(username); err != nil {
 		errored(writer, fmt.Sprintf("Error deleting preferences for user %s: %s", username, err))
+		return
 	}
+
+	if err = u.prefs.deleteExpirations(username, nil); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting key expirations for user %s: %s", username, err))
+		return
+	}
+
+	u.finishDelete(writer, r, username, removed, record)
 }
 
 func fixAddr(addr string) string {
@@ -415,22 +1164,139 @@ func fixAddr(addr string) string {
 	return addr
 }
 
-var (
-	gitref  string
-	appver  string
-	builtby string
-)
+// withConnParam returns the database URI with the connection parameter set.
+// Both URL and key/value style URIs are supported. Parameters that aren't
+// driver settings are sent to the server as run-time parameters.
+func withConnParam(dburi, key, value string) (string, error) {
+	if !strings.Contains(dburi, "://") {
+		return fmt.Sprintf("%s %s=%s", dburi, key, value), nil
+	}
+
+	parsed, err := url.Parse(dburi)
+	if err != nil {
+		return "", err
+	}
+
+	values := parsed.Query()
+	values.Set(key, value)
+	parsed.RawQuery = values.Encode()
+
+	return parsed.String(), nil
+}
+
+// connectDatabase connects to the database and applies migrations if
+// requested. When running as a Lambda function, pool configures the connection
+// pool.
+func connectDatabase(connector *dbutil.Connector, dburi string, runMigrate bool, migrations string, pool *lambdaPool) (*sql.DB, error) {
+	log.Info("Connecting to the database...")
+	db, err := connector.Connect("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Connected to the database.")
+
+	if pool != nil {
+		pool.apply(db)
+	}
+
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	log.Info("Successfully pinged the database")
+
+	if runMigrate {
+		if migrations == "" {
+			log.Info("Applying the embedded database migrations")
+		} else {
+			log.Infof("Applying database migrations from %s", migrations)
+		}
+		if err = migrate(db, migrationsFS(migrations)); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// startApp connects to the database, applies migrations if requested, and
+// returns a configured *UserPreferencesApp with its background jobs running.
+// The name identifies the app's database metrics. If targetURI is set, the
+// preferences are mirrored into that database as well. When running as a
+// Lambda function, pool configures the connection pool, and the background
+// jobs and change listener aren't started, since the function is frozen
+// between requests.
+func startApp(cfg *viper.Viper, name string, connector *dbutil.Connector, dburi, targetURI string, runMigrate bool, migrations string, pool *lambdaPool) (*UserPreferencesApp, error) {
+	db, err := connectDatabase(connector, dburi, runMigrate, migrations, pool)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkIndexes(db, runMigrate && cfg.GetBool("user-preferences.database.create-indexes")); err != nil {
+		return nil, err
+	}
+
+	breaker := NewCircuitBreaker(
+		name,
+		cfg.GetInt("user-preferences.database.breaker.failures"),
+		cfg.GetDuration("user-preferences.database.breaker.cooldown"),
+	)
+	prefsDB := NewPrefsDB(db)
+	prefsDB.compressAbove = cfg.GetInt("user-preferences.compression.threshold")
+	if prefsDB.objects, err = objectStoreConfig(cfg); err != nil {
+		return nil, err
+	}
 
-// AppVersion prints the version information to stdout
-func AppVersion() {
-	if appver != "" {
-		fmt.Printf("App-Version: %s\n", appver)
+	var (
+		store     DB = prefsDB
+		dualWrite *DualWriteDB
+	)
+	if targetURI != "" {
+		log.Info("Dual-write mode is enabled; mirroring the preferences into the new database")
+		targetDB, err := connectDatabase(connector, targetURI, runMigrate, migrations, pool)
+		if err != nil {
+			return nil, err
+		}
+		target := NewPrefsDB(targetDB)
+		target.compressAbove = prefsDB.compressAbove
+		target.objects = prefsDB.objects
+		dualWrite = NewDualWriteDB(prefsDB, target)
+		store = dualWrite
 	}
-	if gitref != "" {
-		fmt.Printf("Git-Ref: %s\n", gitref)
+
+	resilient := NewResilientDB(
+		store,
+		breaker,
+		cfg.GetInt("user-preferences.database.retries"),
+		cfg.GetDuration("user-preferences.database.backoff"),
+	)
+	resilient.slowQuery = cfg.GetDuration("user-preferences.database.slow-query")
+
+	app := New(resilient)
+	app.breaker = breaker
+	app.dualWrite = dualWrite
+	app.pools = map[string]*sql.DB{"primary": db}
+	if dualWrite != nil {
+		app.pools["dual-write"] = dualWrite.target.db
 	}
-	if builtby != "" {
-		fmt.Printf("Built-By: %s\n", builtby)
+	if err = configureApp(app, cfg); err != nil {
+		return nil, err
+	}
+
+	if pool != nil {
+		log.Info("Not starting the background jobs in a Lambda function")
+		return app, nil
+	}
+
+	app.jobs.Start()
+	return app, nil
+}
+
+// Stop stops the app's background jobs.
+func (u *UserPreferencesApp) Stop() {
+	u.jobs.Stop()
+	if u.usage != nil {
+		if _, err := u.flushUsage(time.Now()); err != nil {
+			log.Errorf("Error flushing the usage counts: %s", err)
+		}
 	}
 }
 
@@ -439,6 +1305,11 @@ func main() {
 		showVersion = flag.Bool("version", false, "Print the version information")
 		cfgPath     = flag.String("config", "/etc/iplant/de/jobservices.yml", "The path to the config file")
 		port        = flag.String("port", "60000", "The port number to listen on")
+		runMigrate  = flag.Bool("migrate", false, "Apply any pending database migrations at startup")
+		migrations  = flag.String("migrations", "", "The path to a directory of database migrations to apply instead of the embedded ones")
+		basePath    = flag.String("base-path", "", "The path prefix to serve all routes under, such as /user-preferences/v1")
+		tenant      = flag.String("tenant", "", "The tenant to back up, restore, or export when tenants are configured")
+		anonymize   = flag.Bool("anonymize", false, "Pseudonymize usernames and remove the configured sensitive keys in an export")
 		err         error
 		cfg         *viper.Viper
 	)
@@ -451,34 +1322,134 @@ func main() {
 	}
 
 	if *cfgPath == "" {
-		logcabin.Error.Fatal("--config must be set")
+		log.Fatal("--config must be set")
+	}
+
+	if cfg, err = configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults+defaultConfig); err != nil {
+		log.Fatal(err)
 	}
 
-	if cfg, err = configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults); err != nil {
-		logcabin.Error.Fatal(err)
+	level, err := parseLogLevel(cfg.GetString("user-preferences.log.level"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(level)
+
+	if documentJSON, err = newJSONEngine(cfg.GetString("user-preferences.json.engine")); err != nil {
+		log.Fatal(err)
+	}
+	strictBodies = cfg.GetBool("user-preferences.json.strict")
+
+	if outbound, err = outboundConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if tables, err = tableNamesConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	cockroachConfig(cfg)
+
+	dburi, err := withStatementTimeout(cfg.GetString("db.uri"), cfg.GetDuration("user-preferences.timeouts.statement"))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	dburi := cfg.GetString("db.uri")
 	connector, err := dbutil.NewDefaultConnector("1m")
 	if err != nil {
-		logcabin.Error.Fatal(err)
+		log.Fatal(err)
 	}
 
-	logcabin.Info.Println("Connecting to the database...")
-	db, err := connector.Connect("postgres", dburi)
+	if args := flag.Args(); len(args) > 0 {
+		if err = runCommand(cfg, connector, dburi, *tenant, *anonymize, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var pool *lambdaPool
+	runtimeAPI := os.Getenv(lambdaRuntimeEnv)
+	if runtimeAPI != "" {
+		settings := newLambdaPool(cfg)
+		pool = &settings
+	}
+
+	var handler http.Handler
+	tenants := cfg.GetStringMapString("user-preferences.tenants.schemas")
+	if len(tenants) == 0 {
+		schemaURI, err := withSchemas(cfg, dburi, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		targetURI, err := dualWriteURI(cfg, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		app, err := startApp(cfg, "default", connector, schemaURI, targetURI, *runMigrate, *migrations, pool)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer app.Stop()
+		handler = app
+	} else {
+		tenantRouter := NewTenantRouter(cfg.GetString("user-preferences.tenants.default"))
+		for tenant, schema := range tenants {
+			log.Infof("Setting up tenant %s using schema %s", tenant, schema)
+			tenantURI, err := withSchemas(cfg, dburi, schema)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			targetURI, err := dualWriteURI(cfg, schema)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			app, err := startApp(cfg, tenant, connector, tenantURI, targetURI, *runMigrate, *migrations, pool)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer app.Stop()
+			tenantRouter.Add(tenant, app)
+		}
+		handler = tenantRouter
+	}
+
+	server, err := newServer(cfg, fixAddr(*port), handler)
 	if err != nil {
-		logcabin.Error.Fatal(err)
+		log.Fatal(err)
 	}
-	defer db.Close()
-	logcabin.Info.Println("Connected to the database.")
+	server.Handler = NewBasePath(*basePath, server.Handler)
 
-	if err := db.Ping(); err != nil {
-		logcabin.Error.Fatal(err)
+	if runtimeAPI != "" {
+		log.Infof("Serving Lambda events from %s", runtimeAPI)
+		log.Fatal(runLambda(runtimeAPI, server.Handler))
 	}
-	logcabin.Info.Println("Successfully pinged the database")
 
-	logcabin.Info.Printf("Listening on port %s", *port)
-	prefsDB := NewPrefsDB(db)
-	app := New(prefsDB)
-	logcabin.Error.Fatal(http.ListenAndServe(fixAddr(*port), app.router))
+	if debugAddr := cfg.GetString("user-preferences.debug.addr"); debugAddr != "" {
+		log.Infof("Serving the debugging endpoints on %s", debugAddr)
+		debugServer := newDebugServer(debugAddr)
+		go func() {
+			log.Errorf("Error serving the debugging endpoints: %s", debugServer.ListenAndServe())
+		}()
+	}
+
+	drainer := NewDrainer(server.Handler)
+	server.Handler = drainer
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	log.Infof("Listening on port %s", *port)
+	err = drainer.Serve(
+		server,
+		signals,
+		cfg.GetDuration("user-preferences.shutdown.drain-delay"),
+		cfg.GetDuration("user-preferences.shutdown.timeout"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
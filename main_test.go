@@ -2,26 +2,75 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/user-preferences/diff"
 )
 
 type MockDB struct {
-	storage map[string]map[string]interface{}
-	users   map[string]bool
+	storage  map[string]map[string]interface{}
+	users    map[string]bool
+	presets  map[string]string
+	groups   map[string]string
+	expires  map[string]map[string]time.Time
+	idem     map[string]*IdempotentResponse
+	sess     map[string]*SessionRecord
+	audits   []string
+	history  map[string][]HistoryRecord
+	searches map[string]map[string]string
+	ui       map[string]*UISessionRecord
+	bags     map[string]map[string]*BagRecord
+	undo     map[string]UndoState
+	schedule []*ScheduledChange
+	rollouts map[string]*Rollout
+	members  map[string]map[string]string
+	events   []*mockEvent
+	usage    map[string]UserUsage
+	archived map[string]map[string]interface{}
+	registry map[string]RegisteredKey
+	assigned map[string]map[string]string
+}
+
+// mockEvent is a change event in the mock outbox.
+type mockEvent struct {
+	OutboxEvent
+	published bool
+	attempts  int
+	lastError string
 }
 
 func NewMockDB() *MockDB {
 	return &MockDB{
-		storage: make(map[string]map[string]interface{}),
-		users:   make(map[string]bool),
+		storage:  make(map[string]map[string]interface{}),
+		users:    make(map[string]bool),
+		presets:  make(map[string]string),
+		groups:   make(map[string]string),
+		expires:  make(map[string]map[string]time.Time),
+		idem:     make(map[string]*IdempotentResponse),
+		sess:     make(map[string]*SessionRecord),
+		history:  make(map[string][]HistoryRecord),
+		searches: make(map[string]map[string]string),
+		ui:       make(map[string]*UISessionRecord),
+		bags:     make(map[string]map[string]*BagRecord),
+		undo:     make(map[string]UndoState),
+		rollouts: make(map[string]*Rollout),
+		members:  make(map[string]map[string]string),
+		usage:    make(map[string]UserUsage),
+		archived: make(map[string]map[string]interface{}),
+		registry: make(map[string]RegisteredKey),
+		assigned: make(map[string]map[string]string),
 	}
 }
 
@@ -49,20 +98,83 @@ func (m *MockDB) hasPreferences(username string) (bool, error) {
 }
 
 func (m *MockDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+	prefs, ok := m.storage[username]["user-prefs"].(string)
+	if !ok {
+		return []UserPreferencesRecord{}, nil
+	}
+	checksum, ok := m.storage[username]["checksum"].(string)
+	if err := verifyChecksum(username, prefs, sql.NullString{String: checksum, Valid: ok}); err != nil {
+		return nil, err
+	}
 	return []UserPreferencesRecord{
 		UserPreferencesRecord{
 			ID:          "id",
 			Preferences: m.storage[username]["user-prefs"].(string),
 			UserID:      "user-id",
+			CreatedAt:   m.storage[username]["created-at"].(time.Time),
+			ModifiedAt:  m.storage[username]["modified-at"].(time.Time),
+			Version:     m.storage[username]["version"].(int64),
 		},
 	}, nil
 }
 
+// recordHistory mimics the history trigger by copying the user's current
+// preferences into the history.
+func (m *MockDB) recordHistory(username string) {
+	records, _ := m.getPreferences(username)
+	if len(records) == 0 {
+		return
+	}
+	m.history[username] = append(m.history[username], HistoryRecord{
+		ID:          int64(len(m.history[username]) + 1),
+		Version:     records[0].Version,
+		Preferences: records[0].Preferences,
+		ModifiedAt:  records[0].ModifiedAt,
+		ReplacedAt:  time.Now(),
+	})
+}
+
+// recordEvent mimics the outbox trigger by adding a change event for the
+// documents before and after the change.
+func (m *MockDB) recordEvent(username, operation string, version int64, before, after string) {
+	var beforeValues, afterValues map[string]interface{}
+	json.Unmarshal([]byte(before), &beforeValues)
+	json.Unmarshal([]byte(after), &afterValues)
+
+	m.events = append(m.events, &mockEvent{OutboxEvent: OutboxEvent{
+		ID:        int64(len(m.events) + 1),
+		Username:  username,
+		Operation: operation,
+		Version:   version,
+		CreatedAt: time.Now(),
+		Diff:      diff.Compute(beforeValues, afterValues),
+
+		TransactionID: int64(len(m.events) + 1),
+	}})
+}
+
 func (m *MockDB) insertPreferences(username, prefs string) error {
+	now := time.Now()
+	stored, existed := m.storage[username]["user-prefs"]
+	if existed && stored != prefs {
+		m.recordHistory(username)
+	}
 	if _, ok := m.storage[username]["user-prefs"]; !ok {
-		m.storage[username] = make(map[string]interface{})
+		m.storage[username] = map[string]interface{}{
+			"created-at": now,
+			"version":    int64(0),
+		}
 	}
 	m.storage[username]["user-prefs"] = prefs
+	m.storage[username]["checksum"] = preferencesChecksum(prefs)
+	m.storage[username]["modified-at"] = now
+	m.storage[username]["version"] = m.storage[username]["version"].(int64) + 1
+	switch {
+	case !existed:
+		m.recordEvent(username, "insert", m.storage[username]["version"].(int64), "", prefs)
+	case stored != prefs:
+		m.recordEvent(username, "update", m.storage[username]["version"].(int64), stored.(string), prefs)
+	}
 	return nil
 }
 
@@ -70,11 +182,1006 @@ func (m *MockDB) updatePreferences(username, prefs string) error {
 	return m.insertPreferences(username, prefs)
 }
 
+func (m *MockDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	if current, ok := m.storage[username]["version"].(int64); !ok || current != version {
+		return false, nil
+	}
+	return true, m.insertPreferences(username, prefs)
+}
+
 func (m *MockDB) deletePreferences(username string) error {
+	m.recordHistory(username)
+	if version, ok := m.storage[username]["version"].(int64); ok {
+		stored, _ := m.storage[username]["user-prefs"].(string)
+		m.recordEvent(username, "delete", version, stored, "")
+	}
 	delete(m.storage, username)
 	return nil
 }
 
+// inPage returns whether the entry with the ID and timestamp is selected by
+// the filter, ignoring its limit.
+func inPage(filter PageFilter, id int64, at time.Time) bool {
+	return (filter.Before == 0 || id < filter.Before) &&
+		(filter.Since == nil || !at.Before(*filter.Since)) &&
+		(filter.Until == nil || at.Before(*filter.Until))
+}
+
+func (m *MockDB) listHistory(username string, filter PageFilter) ([]HistoryRecord, error) {
+	history := []HistoryRecord{}
+	records := m.history[username]
+	for i := len(records) - 1; i >= 0 && len(history) < filter.Limit; i-- {
+		if inPage(filter, records[i].ID, records[i].ReplacedAt) {
+			history = append(history, records[i])
+		}
+	}
+	return history, nil
+}
+
+func (m *MockDB) getHistoryVersion(username string, version int64) (*HistoryRecord, error) {
+	records := m.history[username]
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Version == version {
+			record := records[i]
+			return &record, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockDB) purgeHistory(before time.Time) (int64, error) {
+	var purged int64
+	for username, records := range m.history {
+		var kept []HistoryRecord
+		for _, record := range records {
+			if record.ReplacedAt.Before(before) {
+				purged++
+			} else {
+				kept = append(kept, record)
+			}
+		}
+		m.history[username] = kept
+	}
+	return purged, nil
+}
+
+// auditUser returns the user named in the details of a mock audit entry.
+func auditUser(entry string) string {
+	var details map[string]string
+	json.Unmarshal([]byte(entry[strings.Index(entry, " ")+1:]), &details)
+	return details["user"]
+}
+
+func (m *MockDB) listUserAudits(username string) ([]AuditRecord, error) {
+	audits := []AuditRecord{}
+	for i, entry := range m.audits {
+		if auditUser(entry) == username {
+			parts := strings.SplitN(entry, " ", 2)
+			audits = append(audits, AuditRecord{ID: int64(i + 1), Action: parts[0], Details: parts[1]})
+		}
+	}
+	return audits, nil
+}
+
+func (m *MockDB) listAudits(filter AuditFilter) ([]AuditRecord, error) {
+	audits := []AuditRecord{}
+	for i := len(m.audits) - 1; i >= 0 && len(audits) < filter.Limit; i-- {
+		parts := strings.SplitN(m.audits[i], " ", 2)
+		if filter.Action != "" && parts[0] != filter.Action {
+			continue
+		}
+		if filter.User != "" && auditUser(m.audits[i]) != filter.User {
+			continue
+		}
+		if inPage(filter.PageFilter, int64(i+1), time.Time{}) {
+			audits = append(audits, AuditRecord{ID: int64(i + 1), Action: parts[0], Details: parts[1]})
+		}
+	}
+	return audits, nil
+}
+
+func (m *MockDB) eraseUser(username string) (map[string]int64, error) {
+	deleted := map[string]int64{
+		"user_preferences":                   0,
+		"user_preferences_history":           int64(len(m.history[username])),
+		"user_preferences_expirations":       int64(len(m.expires[username])),
+		"user_preferences_audit":             0,
+		"user_preferences_searches":          int64(len(m.searches[username])),
+		"user_preferences_ui_sessions":       0,
+		"user_preferences_bags":              int64(len(m.bags[username])),
+		"user_preferences_experiments":       int64(len(m.assigned[username])),
+		"user_preferences_rollout_members":   0,
+		"user_preferences_usage":             0,
+		"user_preferences_archive":           0,
+		"user_preferences_outbox":            0,
+		"user_preferences_undo":              0,
+		"user_preferences_scheduled_changes": 0,
+		"user_preferences_idempotency":       0,
+	}
+	if _, ok := m.undo[username]; ok {
+		deleted["user_preferences_undo"] = 1
+	}
+	delete(m.undo, username)
+	var schedule []*ScheduledChange
+	for _, change := range m.schedule {
+		if change.TargetType == "user" && change.Target == username {
+			deleted["user_preferences_scheduled_changes"]++
+		} else {
+			schedule = append(schedule, change)
+		}
+	}
+	m.schedule = schedule
+	for key, resp := range m.idem {
+		if resp.Username == username {
+			deleted["user_preferences_idempotency"]++
+			delete(m.idem, key)
+		}
+	}
+	if len(m.archived[username]) > 0 {
+		deleted["user_preferences_archive"] = 1
+	}
+	delete(m.archived, username)
+	if _, ok := m.usage[username]; ok {
+		deleted["user_preferences_usage"] = 1
+	}
+	delete(m.usage, username)
+	if _, ok := m.ui[username]; ok {
+		deleted["user_preferences_ui_sessions"] = 1
+	}
+	if _, ok := m.storage[username]["user-prefs"]; ok {
+		deleted["user_preferences"] = 1
+	}
+	delete(m.storage, username)
+	delete(m.searches, username)
+	delete(m.ui, username)
+	delete(m.bags, username)
+	delete(m.assigned, username)
+	delete(m.history, username)
+	delete(m.expires, username)
+	for _, members := range m.members {
+		if _, ok := members[username]; ok {
+			deleted["user_preferences_rollout_members"]++
+			delete(members, username)
+		}
+	}
+
+	var kept []string
+	for _, entry := range m.audits {
+		if auditUser(entry) == username {
+			deleted["user_preferences_audit"]++
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	m.audits = kept
+	return deleted, nil
+}
+
+func (m *MockDB) upsertPreferences(prefs map[string]string) (map[string]bool, error) {
+	created := make(map[string]bool)
+	for username, doc := range prefs {
+		created[username] = m.storage[username]["user-prefs"] == nil
+		m.insertPreferences(username, doc)
+	}
+	return created, nil
+}
+
+func (m *MockDB) listSearches(username string) ([]SavedSearch, error) {
+	searches := []SavedSearch{}
+	for id, search := range m.searches[username] {
+		searches = append(searches, SavedSearch{ID: id, Search: search})
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].ID < searches[j].ID })
+	return searches, nil
+}
+
+func (m *MockDB) getSearch(username, id string) (*SavedSearch, error) {
+	search, ok := m.searches[username][id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &SavedSearch{ID: id, Search: search}, nil
+}
+
+func (m *MockDB) putSearch(username, id, search string) (bool, error) {
+	if m.searches[username] == nil {
+		m.searches[username] = make(map[string]string)
+	}
+	_, exists := m.searches[username][id]
+	m.searches[username][id] = search
+	return !exists, nil
+}
+
+func (m *MockDB) deleteSearch(username, id string) (bool, error) {
+	_, exists := m.searches[username][id]
+	delete(m.searches[username], id)
+	return exists, nil
+}
+
+func (m *MockDB) replaceSearches(username string, searches map[string]string) error {
+	m.searches[username] = make(map[string]string)
+	for id, search := range searches {
+		m.searches[username][id] = search
+	}
+	return nil
+}
+
+func (m *MockDB) getUISession(username string) (*UISessionRecord, error) {
+	record, ok := m.ui[username]
+	if !ok || (!record.ExpiresAt.IsZero() && !record.ExpiresAt.After(time.Now())) {
+		return nil, sql.ErrNoRows
+	}
+	return record, nil
+}
+
+func (m *MockDB) saveUISession(username, session string, expiresAt time.Time) error {
+	m.ui[username] = &UISessionRecord{Session: session, ModifiedAt: time.Now(), ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *MockDB) deleteUISession(username string) error {
+	delete(m.ui, username)
+	return nil
+}
+
+func (m *MockDB) purgeUISessions(before time.Time) (int64, error) {
+	var purged int64
+	for username, record := range m.ui {
+		if !record.ExpiresAt.IsZero() && !record.ExpiresAt.After(before) {
+			delete(m.ui, username)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MockDB) listKeys(username string) ([]KeyInfo, error) {
+	stored, ok := m.storage[username]["user-prefs"].(string)
+	if !ok {
+		return []KeyInfo{}, nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(stored), &doc); err != nil {
+		return nil, err
+	}
+	return documentKeys(unwrappedDocument(doc))
+}
+
+func (m *MockDB) listExperimentAssignments(username string) (map[string]string, error) {
+	assigned := make(map[string]string)
+	for experiment, variant := range m.assigned[username] {
+		assigned[experiment] = variant
+	}
+	return assigned, nil
+}
+
+func (m *MockDB) addExperimentAssignment(username, experiment, variant string) error {
+	if _, ok := m.assigned[username][experiment]; ok {
+		return nil
+	}
+	if m.assigned[username] == nil {
+		m.assigned[username] = make(map[string]string)
+	}
+	m.assigned[username][experiment] = variant
+	return nil
+}
+
+func (m *MockDB) listBags(username string) ([]BagRecord, error) {
+	bags := []BagRecord{}
+	for _, bag := range m.bags[username] {
+		bags = append(bags, *bag)
+	}
+	sort.Slice(bags, func(i, j int) bool { return bags[i].Name < bags[j].Name })
+	return bags, nil
+}
+
+func (m *MockDB) getBag(username, name string) (*BagRecord, error) {
+	bag, ok := m.bags[username][name]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *bag
+	return &copied, nil
+}
+
+func (m *MockDB) getDefaultBag(username string) (*BagRecord, error) {
+	for _, bag := range m.bags[username] {
+		if bag.Default {
+			copied := *bag
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockDB) putBag(username, name, contents string) (bool, error) {
+	if m.bags[username] == nil {
+		m.bags[username] = make(map[string]*BagRecord)
+	}
+	bag, ok := m.bags[username][name]
+	if !ok {
+		bag = &BagRecord{Name: name}
+		m.bags[username][name] = bag
+	}
+	bag.Contents = contents
+	bag.ModifiedAt = time.Now()
+	return !ok, nil
+}
+
+func (m *MockDB) deleteBag(username, name string) (bool, error) {
+	_, ok := m.bags[username][name]
+	delete(m.bags[username], name)
+	return ok, nil
+}
+
+func (m *MockDB) setDefaultBag(username, name string) (bool, error) {
+	if _, ok := m.bags[username][name]; !ok {
+		return false, nil
+	}
+	for _, bag := range m.bags[username] {
+		bag.Default = bag.Name == name
+	}
+	return true, nil
+}
+
+func (m *MockDB) listPresets() ([]string, error) {
+	var names []string
+	for name := range m.presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MockDB) getPreset(name string) (string, error) {
+	prefs, ok := m.presets[name]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return prefs, nil
+}
+
+func (m *MockDB) savePreset(name, prefs string) error {
+	m.presets[name] = prefs
+	return nil
+}
+
+func (m *MockDB) deletePreset(name string) error {
+	delete(m.presets, name)
+	return nil
+}
+
+func (m *MockDB) getGroupPreferences(group string) (string, error) {
+	prefs, ok := m.groups[group]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return prefs, nil
+}
+
+func (m *MockDB) saveGroupPreferences(group, prefs string) error {
+	m.groups[group] = prefs
+	return nil
+}
+
+func (m *MockDB) deleteGroupPreferences(group string) error {
+	delete(m.groups, group)
+	return nil
+}
+
+func (m *MockDB) getExpirations(username string) (map[string]time.Time, error) {
+	expirations := make(map[string]time.Time)
+	for key, expiresAt := range m.expires[username] {
+		expirations[key] = expiresAt
+	}
+	return expirations, nil
+}
+
+func (m *MockDB) setExpirations(username string, expirations map[string]time.Time) error {
+	if _, ok := m.expires[username]; !ok {
+		m.expires[username] = make(map[string]time.Time)
+	}
+	for key, expiresAt := range expirations {
+		m.expires[username][key] = expiresAt
+	}
+	return nil
+}
+
+func (m *MockDB) deleteExpirations(username string, keys []string) error {
+	if len(keys) == 0 {
+		delete(m.expires, username)
+		return nil
+	}
+	for _, key := range keys {
+		delete(m.expires[username], key)
+	}
+	return nil
+}
+
+func (m *MockDB) deleteExpiredKeys(username string, keys []string, before time.Time) error {
+	for _, key := range keys {
+		if expiresAt, ok := m.expires[username][key]; ok && !expiresAt.After(before) {
+			delete(m.expires[username], key)
+		}
+	}
+	return nil
+}
+
+func (m *MockDB) listExpired(before time.Time) ([]ExpiredKey, error) {
+	var expired []ExpiredKey
+	for username, expirations := range m.expires {
+		for key, expiresAt := range expirations {
+			if !expiresAt.After(before) {
+				expired = append(expired, ExpiredKey{Username: username, Key: key})
+			}
+		}
+	}
+	return expired, nil
+}
+
+// idemKey is the key of the MockDB's stored response for a user's idempotency
+// key.
+func idemKey(username, key string) string {
+	return username + "/" + key
+}
+
+func (m *MockDB) getIdempotentResponse(username, key string) (*IdempotentResponse, error) {
+	resp, ok := m.idem[idemKey(username, key)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return resp, nil
+}
+
+func (m *MockDB) reserveIdempotencyKey(resp *IdempotentResponse, expiredBefore time.Time) (bool, error) {
+	if existing, ok := m.idem[idemKey(resp.Username, resp.Key)]; ok && !existing.CreatedAt.Before(expiredBefore) {
+		return false, nil
+	}
+	m.idem[idemKey(resp.Username, resp.Key)] = resp
+	return true, nil
+}
+
+func (m *MockDB) saveIdempotentResponse(resp *IdempotentResponse) error {
+	m.idem[idemKey(resp.Username, resp.Key)] = resp
+	return nil
+}
+
+func (m *MockDB) releaseIdempotencyKey(username, key string) error {
+	if resp, ok := m.idem[idemKey(username, key)]; ok && resp.Pending {
+		delete(m.idem, idemKey(username, key))
+	}
+	return nil
+}
+
+func (m *MockDB) purgeIdempotentResponses(before time.Time) (int64, error) {
+	var purged int64
+	for key, resp := range m.idem {
+		if resp.CreatedAt.Before(before) {
+			delete(m.idem, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MockDB) createSession(token, prefs string, expiresAt time.Time) error {
+	m.sess[token] = &SessionRecord{
+		Token:       token,
+		Preferences: prefs,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	}
+	return nil
+}
+
+func (m *MockDB) getSession(token string) (*SessionRecord, error) {
+	session, ok := m.sess[token]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (m *MockDB) updateSession(token, prefs string, expiresAt time.Time) error {
+	if session, ok := m.sess[token]; ok {
+		session.Preferences = prefs
+		session.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (m *MockDB) deleteSession(token string) error {
+	delete(m.sess, token)
+	return nil
+}
+
+func (m *MockDB) purgeSessions(before time.Time) (int64, error) {
+	var purged int64
+	for token, session := range m.sess {
+		if !session.ExpiresAt.After(before) {
+			delete(m.sess, token)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MockDB) listUsers(filter UserFilter) ([]UserSummary, error) {
+	users := []UserSummary{}
+	for username := range m.users {
+		user := UserSummary{Username: username}
+		if records, _ := m.getPreferences(username); len(records) > 0 {
+			user.HasPreferences = true
+			user.CreatedAt = &records[0].CreatedAt
+			user.ModifiedAt = &records[0].ModifiedAt
+			user.Version = records[0].Version
+			user.Size = len(records[0].Preferences)
+		}
+
+		if filter.HasPreferences != nil && *filter.HasPreferences != user.HasPreferences {
+			continue
+		}
+		if filter.ModifiedSince != nil && (user.ModifiedAt == nil || user.ModifiedAt.Before(*filter.ModifiedSince)) {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if filter.Sort == "size" && users[i].Size != users[j].Size {
+			return (users[i].Size < users[j].Size) != filter.Descending
+		}
+		return (users[i].Username < users[j].Username) != filter.Descending
+	})
+
+	if filter.Offset >= len(users) {
+		return []UserSummary{}, nil
+	}
+	users = users[filter.Offset:]
+	if len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, nil
+}
+
+// mockDocuments returns the usernames with stored preferences, sorted, and
+// their parsed documents.
+func (m *MockDB) mockDocuments() ([]string, map[string]map[string]interface{}) {
+	var usernames []string
+	docs := make(map[string]map[string]interface{})
+	for username := range m.storage {
+		records, _ := m.getPreferences(username)
+		if len(records) == 0 {
+			continue
+		}
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(records[0].Preferences), &doc)
+		usernames = append(usernames, username)
+		docs[username] = doc
+	}
+	sort.Strings(usernames)
+	return usernames, docs
+}
+
+func (m *MockDB) countKey(path string) (int64, error) {
+	var count int64
+	_, docs := m.mockDocuments()
+	for _, doc := range docs {
+		if _, ok := getPath(unwrappedDocument(doc), path); ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockDB) countDocuments() (int64, error) {
+	usernames, _ := m.mockDocuments()
+	return int64(len(usernames)), nil
+}
+
+func (m *MockDB) countKeyValue(path string, value interface{}) (int64, error) {
+	var count int64
+	_, docs := m.mockDocuments()
+	for _, doc := range docs {
+		if stored, ok := getPath(unwrappedDocument(doc), path); ok && reflect.DeepEqual(stored, value) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockDB) deleteKeyBatch(path string, limit int) (int64, error) {
+	var updated int64
+	usernames, docs := m.mockDocuments()
+	for _, username := range usernames {
+		if updated >= int64(limit) {
+			break
+		}
+		doc := docs[username]
+		if deletePath(unwrappedDocument(doc), path) {
+			jsoned, _ := json.Marshal(doc)
+			m.updatePreferences(username, string(jsoned))
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (m *MockDB) countRenameable(from, to string) (int64, error) {
+	var count int64
+	_, docs := m.mockDocuments()
+	for _, doc := range docs {
+		if canRename(unwrappedDocument(doc), from, to) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockDB) renameKeyBatch(from, to string, limit int) (int64, error) {
+	var updated int64
+	usernames, docs := m.mockDocuments()
+	for _, username := range usernames {
+		if updated >= int64(limit) {
+			break
+		}
+		doc := unwrappedDocument(docs[username])
+		if !canRename(doc, from, to) {
+			continue
+		}
+		value, _ := getPath(doc, from)
+		deletePath(doc, from)
+		setPath(doc, to, value)
+		jsoned, _ := json.Marshal(docs[username])
+		m.updatePreferences(username, string(jsoned))
+		updated++
+	}
+	return updated, nil
+}
+
+func (m *MockDB) recordAudit(action, details string) error {
+	m.audits = append(m.audits, action+" "+details)
+	return nil
+}
+
+func (m *MockDB) getUndoState(username string) (*UndoState, error) {
+	state, ok := m.undo[username]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &state, nil
+}
+
+func (m *MockDB) saveUndoState(username string, state UndoState) error {
+	m.undo[username] = state
+	return nil
+}
+
+func (m *MockDB) createScheduledChange(change *ScheduledChange) error {
+	change.ID = 1
+	for _, scheduled := range m.schedule {
+		if scheduled.ID >= change.ID {
+			change.ID = scheduled.ID + 1
+		}
+	}
+	change.CreatedAt = time.Now()
+	stored := *change
+	m.schedule = append(m.schedule, &stored)
+	return nil
+}
+
+func (m *MockDB) getScheduledChange(id int64) (*ScheduledChange, error) {
+	for _, change := range m.schedule {
+		if change.ID == id {
+			found := *change
+			return &found, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockDB) listScheduledChanges(filter ScheduleFilter) ([]ScheduledChange, error) {
+	changes := []ScheduledChange{}
+	for _, change := range m.schedule {
+		if filter.Status != "" && change.Status() != filter.Status {
+			continue
+		}
+		if filter.DueBy != nil && (change.AppliedAt != nil || change.EffectiveAt.After(*filter.DueBy)) {
+			continue
+		}
+		changes = append(changes, *change)
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].EffectiveAt.Before(changes[j].EffectiveAt) })
+	return changes, nil
+}
+
+func (m *MockDB) cancelScheduledChange(id int64) (bool, error) {
+	for i, change := range m.schedule {
+		if change.ID == id && change.AppliedAt == nil {
+			m.schedule = append(m.schedule[:i], m.schedule[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockDB) claimScheduledChange(id int64, at time.Time) (bool, error) {
+	for _, change := range m.schedule {
+		if change.ID == id && change.AppliedAt == nil {
+			change.AppliedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockDB) getRollout(name string) (*Rollout, error) {
+	rollout, ok := m.rollouts[name]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *rollout
+	found.Members = int64(len(m.members[name]))
+	return &found, nil
+}
+
+func (m *MockDB) listRollouts() ([]Rollout, error) {
+	rollouts := []Rollout{}
+	for name := range m.rollouts {
+		rollout, _ := m.getRollout(name)
+		rollouts = append(rollouts, *rollout)
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].Name < rollouts[j].Name })
+	return rollouts, nil
+}
+
+func (m *MockDB) saveRollout(rollout *Rollout) error {
+	rollout.UpdatedAt = time.Now()
+	if existing, ok := m.rollouts[rollout.Name]; ok {
+		rollout.CreatedAt = existing.CreatedAt
+	} else {
+		rollout.CreatedAt = rollout.UpdatedAt
+	}
+	stored := *rollout
+	m.rollouts[rollout.Name] = &stored
+	return nil
+}
+
+func (m *MockDB) getRolloutMembers(name string, usernames []string) (map[string]string, error) {
+	members := make(map[string]string)
+	for _, username := range usernames {
+		if previous, ok := m.members[name][username]; ok {
+			members[username] = previous
+		}
+	}
+	return members, nil
+}
+
+func (m *MockDB) addRolloutMember(name, username, previous string) error {
+	if m.members[name] == nil {
+		m.members[name] = make(map[string]string)
+	}
+	m.members[name][username] = previous
+	return nil
+}
+
+func (m *MockDB) removeRolloutMember(name, username string) error {
+	delete(m.members[name], username)
+	return nil
+}
+
+func (m *MockDB) verifyChecksums() (*ChecksumReport, error) {
+	report := &ChecksumReport{Corrupt: []CorruptDocument{}}
+	var usernames []string
+	for username, stored := range m.storage {
+		if _, ok := stored["user-prefs"].(string); ok {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		report.Checked++
+		stored := m.storage[username]
+		expected, ok := stored["checksum"].(string)
+		if !ok {
+			report.Unverified++
+			continue
+		}
+		if actual := preferencesChecksum(stored["user-prefs"].(string)); actual != expected {
+			report.Corrupt = append(report.Corrupt, CorruptDocument{
+				Username:   username,
+				Version:    stored["version"].(int64),
+				ModifiedAt: stored["modified-at"].(time.Time),
+				Expected:   expected,
+				Actual:     actual,
+			})
+		}
+	}
+	return report, nil
+}
+
+func (m *MockDB) dispatchEvents(limit int, publish func(event *OutboxEvent) error) (int, error) {
+	published, seen := 0, 0
+	blocked := make(map[string]bool)
+	for _, event := range m.events {
+		if event.published {
+			continue
+		}
+		if seen++; seen > limit {
+			break
+		}
+		if blocked[event.Username] {
+			continue
+		}
+		event.attempts++
+		if err := publish(&event.OutboxEvent); err != nil {
+			blocked[event.Username] = true
+			event.lastError = err.Error()
+			continue
+		}
+		event.published = true
+		published++
+	}
+	return published, nil
+}
+
+func (m *MockDB) purgeEvents(before time.Time, all bool) (int64, error) {
+	var (
+		kept   []*mockEvent
+		purged int64
+	)
+	for _, event := range m.events {
+		if event.CreatedAt.Before(before) && (event.published || all) {
+			purged++
+			continue
+		}
+		kept = append(kept, event)
+	}
+	m.events = kept
+	return purged, nil
+}
+
+func (m *MockDB) pendingEvents() (int64, *time.Time, error) {
+	var (
+		count  int64
+		oldest *time.Time
+	)
+	for _, event := range m.events {
+		if event.published {
+			continue
+		}
+		if count++; oldest == nil {
+			at := event.CreatedAt
+			oldest = &at
+		}
+	}
+	return count, oldest, nil
+}
+
+func (m *MockDB) replayEvents(filter EventFilter) ([]OutboxEvent, error) {
+	events := []OutboxEvent{}
+	for _, event := range m.events {
+		if event.TransactionID < filter.After.Transaction ||
+			event.TransactionID == filter.After.Transaction && event.ID <= filter.After.ID {
+			continue
+		}
+		if filter.User != "" && event.Username != filter.User {
+			continue
+		}
+		if len(events) == filter.Limit {
+			break
+		}
+		events = append(events, event.OutboxEvent)
+	}
+	return events, nil
+}
+
+func (m *MockDB) databaseReport() (*DatabaseReport, error) {
+	return &DatabaseReport{
+		Tables:          []TableStats{{Table: "user_preferences", Rows: int64(len(m.storage))}},
+		MissingIndexes:  []IndexAdvisory{},
+		Recommendations: []string{},
+	}, nil
+}
+
+func (m *MockDB) addUsage(usage []UserUsage) error {
+	for _, u := range usage {
+		if !m.users[u.Username] {
+			continue
+		}
+		stored := m.usage[u.Username]
+		stored.Username = u.Username
+		stored.add(u)
+		m.usage[u.Username] = stored
+	}
+	return nil
+}
+
+func (m *MockDB) getUsage(username string) (*UserUsage, error) {
+	usage := m.usage[username]
+	usage.Username = username
+	return &usage, nil
+}
+
+func (m *MockDB) archivePreferences(before time.Time, limit int) (int64, error) {
+	var archived int64
+	for username, stored := range m.storage {
+		if int(archived) == limit {
+			break
+		}
+		modified, ok := stored["modified-at"].(time.Time)
+		if !ok || !modified.Before(before) {
+			continue
+		}
+		if last := m.usage[username].LastAccess; last != nil && !last.Before(before) {
+			continue
+		}
+		m.archived[username] = stored
+		delete(m.storage, username)
+		archived++
+	}
+	return archived, nil
+}
+
+func (m *MockDB) restorePreferences(username string) (bool, error) {
+	stored, ok := m.archived[username]
+	if !ok {
+		return false, nil
+	}
+	m.storage[username] = stored
+	delete(m.archived, username)
+	return true, nil
+}
+
+func (m *MockDB) listRegisteredKeys() ([]RegisteredKey, error) {
+	keys := []RegisteredKey{}
+	for _, k := range m.registry {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys, nil
+}
+
+func (m *MockDB) saveRegisteredKey(k *RegisteredKey) error {
+	k.ModifiedAt = time.Now()
+	m.registry[k.Key] = *k
+	return nil
+}
+
+func (m *MockDB) deleteRegisteredKey(key string) (bool, error) {
+	_, ok := m.registry[key]
+	delete(m.registry, key)
+	return ok, nil
+}
+
+func (m *MockDB) lookupUsername(username string) (string, error) {
+	if m.users[username] {
+		return username, nil
+	}
+	var found []string
+	for stored := range m.users {
+		if strings.EqualFold(stored, username) {
+			found = append(found, stored)
+		}
+	}
+	if len(found) == 0 {
+		return "", sql.ErrNoRows
+	}
+	sort.Strings(found)
+	return found[0], nil
+}
+
+func (m *MockDB) failScheduledChange(id int64, msg string) error {
+	for _, change := range m.schedule {
+		if change.ID == id {
+			change.Error = msg
+		}
+	}
+	return nil
+}
+
 func TestConvertBlankPreferences(t *testing.T) {
 	record := &UserPreferencesRecord{
 		ID:          "test_id",
@@ -123,6 +1230,29 @@ func TestConvertEmbeddedPreferences(t *testing.T) {
 	}
 }
 
+func TestConvertNonObjectPreferences(t *testing.T) {
+	record := &UserPreferencesRecord{
+		ID:          "test_id",
+		Preferences: `{"preferences":"compact"}`,
+		UserID:      "test_user_id",
+	}
+	actual, err := convert(record, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual["preferences"] != "compact" {
+		t.Errorf("unwrapping returned %v", actual)
+	}
+
+	actual, err = convert(record, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped, ok := actual["preferences"].(map[string]interface{}); !ok || wrapped["preferences"] != "compact" {
+		t.Errorf("wrapping returned %v", actual)
+	}
+}
+
 func TestConvertNormalPreferences(t *testing.T) {
 	record := &UserPreferencesRecord{
 		ID:          "test_id",
@@ -204,7 +1334,7 @@ func TestHandleNonUser(t *testing.T) {
 	)
 
 	recorder := httptest.NewRecorder()
-	handleNonUser(recorder, "test-user")
+	handleNonUser(recorder, httptest.NewRequest(http.MethodGet, "/test-user", nil), "test-user")
 	actualMsg := recorder.Body.String()
 	actualStatus := recorder.Code
 
@@ -224,9 +1354,15 @@ func TestGreeting(t *testing.T) {
 	server := httptest.NewServer(n.router)
 	defer server.Close()
 
-	res, err := http.Get(server.URL)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	expectedBody := []byte("Hello from user-preferences.")
@@ -416,6 +1552,140 @@ func TestPostRequest(t *testing.T) {
 	}
 }
 
+func TestPostRequestCreated(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	n := New(mock)
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	res, err := http.Post(url, "application/json", bytes.NewReader([]byte(`{"one":"two"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("first POST status code was %d instead of %d", res.StatusCode, http.StatusCreated)
+	}
+
+	expectedLocation := "/" + username
+	if location := res.Header.Get("Location"); location != expectedLocation {
+		t.Errorf("Location was '%s' instead of '%s'", location, expectedLocation)
+	}
+
+	res, err = http.Post(url, "application/json", bytes.NewReader([]byte(`{"one":"three"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("second POST status code was %d instead of %d", res.StatusCode, http.StatusOK)
+	}
+
+	if res.Header.Get("Location") != "" {
+		t.Error("second POST included a Location header")
+	}
+
+	var parsed map[string]map[string]string
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["meta"]["id"] != "id" {
+		t.Errorf("meta was %#v", parsed["meta"])
+	}
+}
+
+func TestGetRequestIncludeMeta(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"one":"two"}`); err != nil {
+		t.Error(err)
+	}
+	if err := mock.updatePreferences(username, `{"one":"three"}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/%s?include-meta=true", server.URL, username), nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("status code was %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed struct {
+		Preferences map[string]string `json:"preferences"`
+		Meta        preferencesMeta   `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Preferences["one"] != "three" {
+		t.Errorf("preferences were %#v", parsed.Preferences)
+	}
+
+	if parsed.Meta.ID != "id" || parsed.Meta.Version != 2 || parsed.Meta.Size != len(`{"one":"three"}`) {
+		t.Errorf("meta was %#v", parsed.Meta)
+	}
+
+	if parsed.Meta.CreatedAt.IsZero() || parsed.Meta.ModifiedAt.Before(parsed.Meta.CreatedAt) {
+		t.Errorf("timestamps were %s and %s", parsed.Meta.CreatedAt, parsed.Meta.ModifiedAt)
+	}
+}
+
+func TestGetRequestLastModified(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"one":"two"}`); err != nil {
+		t.Error(err)
+	}
+
+	modifiedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.storage[username]["modified-at"] = modifiedAt
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expected := modifiedAt.Format(http.TimeFormat)
+	if actual := res.Header.Get("Last-Modified"); actual != expected {
+		t.Errorf("Last-Modified was '%s' instead of '%s'", actual, expected)
+	}
+
+	status, _ := doRequest(t, http.MethodGet, url, nil, map[string]string{"If-Modified-Since": expected})
+	if status != http.StatusNotModified {
+		t.Errorf("current If-Modified-Since returned %d instead of %d", status, http.StatusNotModified)
+	}
+
+	earlier := modifiedAt.Add(-time.Hour).Format(http.TimeFormat)
+	status, body := doRequest(t, http.MethodGet, url, nil, map[string]string{"If-Modified-Since": earlier})
+	if status != http.StatusOK || string(body) != `{"one":"two"}` {
+		t.Errorf("stale If-Modified-Since returned %d '%s'", status, body)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	username := "test-user"
 	expected := []byte(`{"one":"two"}`)
@@ -589,9 +1859,12 @@ func TestGetPreferences(t *testing.T) {
 		t.Error("NewPrefsDB returned nil")
 	}
 
-	mock.ExpectQuery("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	modifiedAt := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT p.id AS id, p.user_id AS user_id, p.preferences AS preferences, p.encoding AS encoding, p.compressed AS compressed, p.checksum AS checksum, p.created_at AS created_at, p.modified_at AS modified_at, p.version AS version FROM user_preferences p, users u WHERE p.user_id = u.id AND u.username =").
 		WithArgs("test-user").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences", "encoding", "compressed", "checksum", "created_at", "modified_at", "version"}).AddRow("1", "2", "{}", "identity", nil, preferencesChecksum("{}"), createdAt, modifiedAt, 3))
 
 	records, err := p.getPreferences("test-user")
 	if err != nil {
@@ -615,6 +1888,14 @@ func TestGetPreferences(t *testing.T) {
 		t.Errorf("preferences was %s instead of '{}'", prefs.Preferences)
 	}
 
+	if !prefs.CreatedAt.Equal(createdAt) || !prefs.ModifiedAt.Equal(modifiedAt) {
+		t.Errorf("timestamps were %s and %s", prefs.CreatedAt, prefs.ModifiedAt)
+	}
+
+	if prefs.Version != 3 {
+		t.Errorf("version was %d instead of 3", prefs.Version)
+	}
+
 	if err = mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("expectations were not met: %s", err)
 	}
@@ -636,8 +1917,8 @@ func TestInsertPreferences(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
-	mock.ExpectExec("INSERT INTO user_preferences \\(user_id, preferences\\) VALUES").
-		WithArgs("1", "{}").
+	mock.ExpectExec("INSERT INTO user_preferences \\(user_id, preferences, encoding, compressed, checksum\\) VALUES").
+		WithArgs("1", "{}", "identity", []byte(nil), preferencesChecksum("{}")).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	if err = p.insertPreferences("test-user", "{}"); err != nil {
@@ -665,8 +1946,8 @@ func TestUpdatePreferences(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
-	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences =").
-		WithArgs("1", "{}").
+	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences = (.+), encoding = (.+), compressed = (.+), checksum = (.+), version = version \\+ 1").
+		WithArgs("1", "{}", "identity", []byte(nil), preferencesChecksum("{}")).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	if err = p.updatePreferences("test-user", "{}"); err != nil {
@@ -706,3 +1987,34 @@ func TestDeletePreferences(t *testing.T) {
 		t.Errorf("expectations were not met: %s", err)
 	}
 }
+
+// doRequest sends a request with an optional body and headers, returning the
+// response status code and body.
+func doRequest(t *testing.T, method, url string, body []byte, headers map[string]string) (int, []byte) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode, resBody
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/cyverse-de/user-preferences/merge"
+)
+
+// mergePreferences recursively merges src into dst and returns dst. Nested
+// objects present in both documents are merged key by key; any other value in
+// src replaces the value in dst.
+func mergePreferences(dst, src map[string]interface{}) map[string]interface{} {
+	return merge.Documents(dst, src)
+}
+
+// The strategies supported for merging arrays in POST bodies into the stored
+// arrays.
+const (
+	// arraysReplace replaces the stored array with the incoming one.
+	arraysReplace = "replace"
+
+	// arraysAppend appends the incoming array's items to the stored array.
+	arraysAppend = "append"
+
+	// arraysUnion appends the incoming items that aren't already in the stored
+	// array.
+	arraysUnion = "union"
+
+	// arraysUnionByID matches objects in the two arrays by the value of an ID
+	// key. Incoming objects replace the stored objects with the same ID and
+	// the rest are appended.
+	arraysUnionByID = "union-by-id"
+)
+
+// mergeArraysHeader selects the array strategy for all of the arrays in a
+// POST body, overriding the configured strategies.
+const mergeArraysHeader = "Merge-Arrays"
+
+// mergeAttempts is the number of times a merge is tried when the preferences
+// are changed by other requests while they're being merged.
+const mergeAttempts = 5
+
+// defaultIDKey is the ID key used by the union-by-id strategy if one isn't
+// given.
+const defaultIDKey = "id"
+
+// arrayStrategy is how arrays are merged, and the key objects are matched by
+// for the union-by-id strategy.
+type arrayStrategy struct {
+	name  string
+	idKey string
+}
+
+// parseArrayStrategy parses an array strategy setting. The union-by-id
+// strategy takes the ID key after a colon, as in union-by-id:uuid, and uses
+// the id key otherwise.
+func parseArrayStrategy(setting string) (arrayStrategy, error) {
+	parts := strings.SplitN(strings.TrimSpace(setting), ":", 2)
+	strategy := arrayStrategy{name: parts[0]}
+
+	switch strategy.name {
+	case "":
+		strategy.name = arraysReplace
+	case arraysReplace, arraysAppend, arraysUnion:
+	case arraysUnionByID:
+		strategy.idKey = defaultIDKey
+		if len(parts) == 2 && parts[1] != "" {
+			strategy.idKey = parts[1]
+		}
+		return strategy, nil
+	default:
+		return strategy, fmt.Errorf("Unknown array merge strategy %s", setting)
+	}
+
+	if len(parts) == 2 {
+		return strategy, fmt.Errorf("The %s array merge strategy doesn't take an ID key", strategy.name)
+	}
+	return strategy, nil
+}
+
+// merge returns the result of merging the incoming array into the stored one.
+func (a arrayStrategy) merge(stored, incoming []interface{}) []interface{} {
+	switch a.name {
+	case arraysAppend:
+		return append(stored, incoming...)
+
+	case arraysUnion:
+		for _, item := range incoming {
+			if indexOf(stored, item) < 0 {
+				stored = append(stored, item)
+			}
+		}
+		return stored
+
+	case arraysUnionByID:
+		for _, item := range incoming {
+			if i := a.indexOfID(stored, item); i >= 0 {
+				stored[i] = item
+			} else if indexOf(stored, item) < 0 {
+				stored = append(stored, item)
+			}
+		}
+		return stored
+	}
+
+	return incoming
+}
+
+// indexOf returns the index of the first item in the array that's equal to
+// the value, or -1 if there isn't one.
+func indexOf(array []interface{}, value interface{}) int {
+	for i, item := range array {
+		if reflect.DeepEqual(item, value) {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexOfID returns the index of the first object in the array with the same
+// ID as the value, or -1 if there isn't one or the value doesn't have an ID.
+func (a arrayStrategy) indexOfID(array []interface{}, value interface{}) int {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return -1
+	}
+	id, ok := obj[a.idKey]
+	if !ok {
+		return -1
+	}
+
+	for i, item := range array {
+		if itemObj, ok := item.(map[string]interface{}); ok {
+			if itemID, ok := itemObj[a.idKey]; ok && reflect.DeepEqual(itemID, id) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// mergeOptions controls how the body of a POST is merged into the stored
+// preferences. Objects nested more than depth levels deep are replaced rather
+// than merged; a depth of 0 merges objects at every level. Arrays are merged
+// using the strategy for their dotted key path in keys, or the arrays strategy
+// if they don't have one.
+type mergeOptions struct {
+	depth  int
+	arrays arrayStrategy
+	keys   map[string]arrayStrategy
+}
+
+// newMergeOptions returns the mergeOptions for the settings. Each of the key
+// settings is a dotted key path and an array strategy separated by an equals
+// sign, as in apps.pinned=union. An error is returned if the depth is negative
+// or a strategy isn't recognized.
+func newMergeOptions(depth int, arrays string, keys []string) (mergeOptions, error) {
+	if depth < 0 {
+		return mergeOptions{}, fmt.Errorf("The merge depth must not be negative: %d", depth)
+	}
+
+	opts := mergeOptions{depth: depth, keys: make(map[string]arrayStrategy)}
+
+	var err error
+	if opts.arrays, err = parseArrayStrategy(arrays); err != nil {
+		return mergeOptions{}, err
+	}
+
+	for _, setting := range keys {
+		parts := strings.SplitN(setting, "=", 2)
+		path := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || path == "" {
+			return mergeOptions{}, fmt.Errorf("Invalid array merge setting %q", setting)
+		}
+		if opts.keys[path], err = parseArrayStrategy(parts[1]); err != nil {
+			return mergeOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// forRequest returns the options to use for the request, taking the array
+// strategy from the Merge-Arrays header if it's present.
+func (m mergeOptions) forRequest(r *http.Request) (mergeOptions, error) {
+	setting := r.Header.Get(mergeArraysHeader)
+	if setting == "" {
+		return m, nil
+	}
+
+	strategy, err := parseArrayStrategy(setting)
+	if err != nil {
+		return m, err
+	}
+	return mergeOptions{depth: m.depth, arrays: strategy}, nil
+}
+
+// arraysFor returns the array strategy for the dotted key path.
+func (m mergeOptions) arraysFor(path string) arrayStrategy {
+	if strategy, ok := m.keys[path]; ok {
+		return strategy
+	}
+	return m.arrays
+}
+
+// deepMerge merges src into a copy of dst using the options and returns the
+// copy. Neither document is modified. As in JSON Merge Patch, a null in src
+// removes the key from the result, and $literal objects are stored as they're
+// given.
+func deepMerge(dst, src map[string]interface{}, opts mergeOptions) map[string]interface{} {
+	return merge.Patch(dst, src, opts.depth, func(path string, stored, incoming []interface{}) []interface{} {
+		return opts.arraysFor(path).merge(stored, incoming)
+	})
+}
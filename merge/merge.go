@@ -0,0 +1,139 @@
+// Package merge merges preferences documents the way the service does, so that
+// other packages, such as the fake service in testutil, can merge documents
+// exactly as it would.
+package merge
+
+// Literal marks an object in a patch whose value is stored exactly as it's
+// given, as in {"$literal": null}. It's how a null is stored rather than
+// deleting the key, and how an object replaces the stored one rather than
+// being merged into it.
+const Literal = "$literal"
+
+// ArrayFunc returns the result of merging the incoming array into the stored
+// one at the dotted key path.
+type ArrayFunc func(path string, stored, incoming []interface{}) []interface{}
+
+// Documents recursively merges src into dst and returns dst. Nested objects
+// present in both documents are merged key by key; any other value in src
+// replaces the value in dst.
+func Documents(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = make(map[string]interface{})
+	}
+
+	for key, srcValue := range src {
+		srcMap, srcIsMap := srcValue.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			dst[key] = Documents(dstMap, srcMap)
+			continue
+		}
+		dst[key] = srcValue
+	}
+
+	return dst
+}
+
+// LiteralValue returns the value wrapped in a $literal object and whether the
+// value was one.
+func LiteralValue(value interface{}) (interface{}, bool) {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return nil, false
+	}
+	literal, ok := obj[Literal]
+	return literal, ok
+}
+
+// PatchValue returns a copy of a value from a patch with nulls removed from its
+// objects and $literal objects unwrapped, the way the value is stored when
+// there's nothing to merge it into. Arrays are copied as they are.
+func PatchValue(value interface{}) interface{} {
+	if literal, ok := LiteralValue(value); ok {
+		return deepCopy(literal)
+	}
+
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return deepCopy(value)
+	}
+
+	result := make(map[string]interface{}, len(obj))
+	for key, item := range obj {
+		if item != nil {
+			result[key] = PatchValue(item)
+		}
+	}
+	return result
+}
+
+// Patch merges src into a copy of dst and returns the copy. Neither document is
+// modified. As in JSON Merge Patch, a null in src removes the key from the
+// result. Objects nested more than depth levels deep are replaced rather than
+// merged; a depth of 0 merges objects at every level. Arrays present in both
+// documents are merged by arrays, or replaced if it's nil.
+func Patch(dst, src map[string]interface{}, depth int, arrays ArrayFunc) map[string]interface{} {
+	result, _ := deepCopy(dst).(map[string]interface{})
+	if result == nil {
+		result = make(map[string]interface{})
+	}
+	patchLevel(result, src, depth, arrays, "", 1)
+	return result
+}
+
+// patchLevel merges src into dst, where dst is the object at the dotted key
+// path and the given level of the document.
+func patchLevel(dst, src map[string]interface{}, depth int, arrays ArrayFunc, path string, level int) {
+	for key, srcValue := range src {
+		if srcValue == nil {
+			delete(dst, key)
+			continue
+		}
+		if literal, ok := LiteralValue(srcValue); ok {
+			dst[key] = deepCopy(literal)
+			continue
+		}
+
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+
+		switch srcTyped := srcValue.(type) {
+		case map[string]interface{}:
+			dstMap, ok := dst[key].(map[string]interface{})
+			if ok && (depth == 0 || level < depth) {
+				patchLevel(dstMap, srcTyped, depth, arrays, child, level+1)
+				continue
+			}
+		case []interface{}:
+			if dstArray, ok := dst[key].([]interface{}); ok && arrays != nil {
+				dst[key] = arrays(child, dstArray, deepCopy(srcTyped).([]interface{}))
+				continue
+			}
+		}
+
+		dst[key] = PatchValue(srcValue)
+	}
+}
+
+// deepCopy returns a copy of a parsed JSON value that shares no maps or slices
+// with the original.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return value
+	}
+}
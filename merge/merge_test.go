@@ -0,0 +1,66 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDocuments(t *testing.T) {
+	dst := map[string]interface{}{
+		"keep":   "me",
+		"nested": map[string]interface{}{"a": 1.0, "b": 2.0},
+	}
+	src := map[string]interface{}{
+		"nested": map[string]interface{}{"b": 3.0},
+		"added":  nil,
+	}
+	expected := map[string]interface{}{
+		"keep":   "me",
+		"nested": map[string]interface{}{"a": 1.0, "b": 3.0},
+		"added":  nil,
+	}
+
+	if actual := Documents(dst, src); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Documents returned %#v", actual)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	dst := map[string]interface{}{
+		"remove": "me",
+		"ui":     map[string]interface{}{"theme": "dark", "panels": map[string]interface{}{"left": true}},
+		"list":   []interface{}{"a"},
+	}
+	src := map[string]interface{}{
+		"remove":  nil,
+		"ui":      map[string]interface{}{"panels": map[string]interface{}{"right": true}},
+		"list":    []interface{}{"b"},
+		"cleared": map[string]interface{}{Literal: nil},
+	}
+
+	expected := map[string]interface{}{
+		"ui":      map[string]interface{}{"theme": "dark", "panels": map[string]interface{}{"left": true, "right": true}},
+		"list":    []interface{}{"b"},
+		"cleared": nil,
+	}
+	if actual := Patch(dst, src, 0, nil); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Patch returned %#v", actual)
+	}
+	if _, ok := dst["remove"]; !ok {
+		t.Error("Patch modified the destination")
+	}
+
+	appended := func(path string, stored, incoming []interface{}) []interface{} {
+		if path != "list" {
+			t.Errorf("the arrays were merged at %s", path)
+		}
+		return append(stored, incoming...)
+	}
+	actual := Patch(dst, src, 1, appended)
+	if !reflect.DeepEqual(actual["list"], []interface{}{"a", "b"}) {
+		t.Errorf("the arrays were merged into %#v", actual["list"])
+	}
+	if !reflect.DeepEqual(actual["ui"], map[string]interface{}{"panels": map[string]interface{}{"right": true}}) {
+		t.Errorf("the objects past the depth limit were merged into %#v", actual["ui"])
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/user-preferences/merge"
+)
+
+func TestMergePreferences(t *testing.T) {
+	dst := map[string]interface{}{
+		"keep":     "me",
+		"replace":  "old",
+		"nested":   map[string]interface{}{"a": 1.0, "b": 2.0},
+		"toobject": "scalar",
+	}
+	src := map[string]interface{}{
+		"replace":  "new",
+		"nested":   map[string]interface{}{"b": 3.0, "c": 4.0},
+		"toobject": map[string]interface{}{"x": true},
+		"added":    []interface{}{"one"},
+	}
+	expected := map[string]interface{}{
+		"keep":     "me",
+		"replace":  "new",
+		"nested":   map[string]interface{}{"a": 1.0, "b": 3.0, "c": 4.0},
+		"toobject": map[string]interface{}{"x": true},
+		"added":    []interface{}{"one"},
+	}
+
+	actual := mergePreferences(dst, src)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("merge returned %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestMergePreferencesNilDestination(t *testing.T) {
+	src := map[string]interface{}{"foo": "bar"}
+
+	actual := mergePreferences(nil, src)
+	if !reflect.DeepEqual(actual, src) {
+		t.Errorf("merge returned %#v instead of %#v", actual, src)
+	}
+}
+
+func TestDeepMerge(t *testing.T) {
+	dst := map[string]interface{}{
+		"keep": "me",
+		"ui":   map[string]interface{}{"theme": "dark", "panels": map[string]interface{}{"left": true, "right": true}},
+		"apps": []interface{}{"a"},
+	}
+	src := map[string]interface{}{
+		"ui":   map[string]interface{}{"panels": map[string]interface{}{"right": false}},
+		"apps": []interface{}{"b"},
+	}
+
+	tests := []struct {
+		opts     mergeOptions
+		expected map[string]interface{}
+	}{
+		{
+			mergeOptions{arrays: arrayStrategy{name: arraysReplace}},
+			map[string]interface{}{
+				"keep": "me",
+				"ui":   map[string]interface{}{"theme": "dark", "panels": map[string]interface{}{"left": true, "right": false}},
+				"apps": []interface{}{"b"},
+			},
+		},
+		{
+			mergeOptions{depth: 1, arrays: arrayStrategy{name: arraysAppend}},
+			map[string]interface{}{
+				"keep": "me",
+				"ui":   map[string]interface{}{"panels": map[string]interface{}{"right": false}},
+				"apps": []interface{}{"a", "b"},
+			},
+		},
+		{
+			mergeOptions{depth: 2, arrays: arrayStrategy{name: arraysReplace}},
+			map[string]interface{}{
+				"keep": "me",
+				"ui":   map[string]interface{}{"theme": "dark", "panels": map[string]interface{}{"right": false}},
+				"apps": []interface{}{"b"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		actual := deepMerge(dst, src, test.opts)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("deepMerge with %#v returned %#v", test.opts, actual)
+		}
+	}
+
+	if !reflect.DeepEqual(dst["apps"], []interface{}{"a"}) || len(dst["ui"].(map[string]interface{})["panels"].(map[string]interface{})) != 2 {
+		t.Errorf("deepMerge modified the destination: %#v", dst)
+	}
+}
+
+func TestNewMergeOptions(t *testing.T) {
+	opts, err := newMergeOptions(0, "", []string{"saved-searches = union-by-id:uuid", "apps.pinned=union"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mergeOptions{
+		arrays: arrayStrategy{name: arraysReplace},
+		keys: map[string]arrayStrategy{
+			"saved-searches": {name: arraysUnionByID, idKey: "uuid"},
+			"apps.pinned":    {name: arraysUnion},
+		},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("newMergeOptions returned %#v", opts)
+	}
+
+	for _, invalid := range []struct {
+		depth  int
+		arrays string
+		keys   []string
+	}{
+		{-1, arraysReplace, nil},
+		{0, "shuffle", nil},
+		{0, "append:id", nil},
+		{0, "", []string{"apps.pinned"}},
+		{0, "", []string{"=union"}},
+		{0, "", []string{"apps.pinned=shuffle"}},
+	} {
+		if _, err = newMergeOptions(invalid.depth, invalid.arrays, invalid.keys); err == nil {
+			t.Errorf("the settings %#v were accepted", invalid)
+		}
+	}
+}
+
+func TestArrayStrategies(t *testing.T) {
+	stored := []interface{}{
+		"a",
+		map[string]interface{}{"id": 1.0, "name": "one"},
+		map[string]interface{}{"id": 2.0, "name": "two"},
+	}
+	incoming := []interface{}{
+		"a",
+		"b",
+		map[string]interface{}{"id": 2.0, "name": "TWO"},
+		map[string]interface{}{"id": 3.0, "name": "three"},
+	}
+
+	tests := []struct {
+		setting  string
+		expected []interface{}
+	}{
+		{"replace", incoming},
+		{"append", append(append([]interface{}{}, stored...), incoming...)},
+		{"union", []interface{}{
+			"a",
+			map[string]interface{}{"id": 1.0, "name": "one"},
+			map[string]interface{}{"id": 2.0, "name": "two"},
+			"b",
+			map[string]interface{}{"id": 2.0, "name": "TWO"},
+			map[string]interface{}{"id": 3.0, "name": "three"},
+		}},
+		{"union-by-id", []interface{}{
+			"a",
+			map[string]interface{}{"id": 1.0, "name": "one"},
+			map[string]interface{}{"id": 2.0, "name": "TWO"},
+			"b",
+			map[string]interface{}{"id": 3.0, "name": "three"},
+		}},
+	}
+
+	for _, test := range tests {
+		strategy, err := parseArrayStrategy(test.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := strategy.merge(deepCopy(stored).([]interface{}), deepCopy(incoming).([]interface{}))
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("the %s strategy returned %#v", test.setting, actual)
+		}
+	}
+
+	strategy, _ := parseArrayStrategy("union-by-id:name")
+	actual := strategy.merge(
+		[]interface{}{map[string]interface{}{"name": "x", "v": 1.0}},
+		[]interface{}{map[string]interface{}{"name": "x", "v": 2.0}},
+	)
+	if !reflect.DeepEqual(actual, []interface{}{map[string]interface{}{"name": "x", "v": 2.0}}) {
+		t.Errorf("union-by-id with a custom key returned %#v", actual)
+	}
+}
+
+func TestMergeArraysByKey(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"pinned":["a"],"searches":[{"id":1,"q":"old"}],"recent":["x"]}`)
+
+	n := New(mock)
+	n.merge, _ = newMergeOptions(0, arraysReplace, []string{"pinned=union", "searches=union-by-id"})
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"pinned":["a","b"],"searches":[{"id":1,"q":"new"},{"id":2,"q":"two"}],"recent":["y"]}`)
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", body, nil); status != http.StatusOK {
+		t.Errorf("POST returned %d", status)
+	}
+
+	stored, _ := n.loadPreferences("alice")
+	expected := map[string]interface{}{
+		"pinned":   []interface{}{"a", "b"},
+		"searches": []interface{}{map[string]interface{}{"id": 1.0, "q": "new"}, map[string]interface{}{"id": 2.0, "q": "two"}},
+		"recent":   []interface{}{"y"},
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("POST stored %#v", stored)
+	}
+
+	headers := map[string]string{mergeArraysHeader: "append"}
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"pinned":["a"]}`), headers); status != http.StatusOK {
+		t.Errorf("POST with the %s header returned %d", mergeArraysHeader, status)
+	}
+	stored, _ = n.loadPreferences("alice")
+	if !reflect.DeepEqual(stored["pinned"], []interface{}{"a", "b", "a"}) {
+		t.Errorf("POST with the %s header stored %#v", mergeArraysHeader, stored["pinned"])
+	}
+
+	headers[mergeArraysHeader] = "shuffle"
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{}`), headers); status != http.StatusBadRequest {
+		t.Errorf("POST with an unknown strategy returned %d", status)
+	}
+}
+
+func TestPutReplacesPostMerges(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark","ui":{"compact":true}}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"ui":{"panels":2}}`), nil); status != http.StatusOK {
+		t.Errorf("POST returned %d", status)
+	}
+	stored, _ := n.loadPreferences("alice")
+	expected := map[string]interface{}{"theme": "dark", "ui": map[string]interface{}{"compact": true, "panels": 2.0}}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("POST stored %#v", stored)
+	}
+
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"preferences":{"theme":"light"}}`), nil); status != http.StatusOK {
+		t.Errorf("POST with a wrapped body returned %d", status)
+	}
+	stored, _ = n.loadPreferences("alice")
+	expected["theme"] = "light"
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("POST with a wrapped body stored %#v", stored)
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"ui":{"panels":2}}`), nil); status != http.StatusOK {
+		t.Errorf("PUT returned %d", status)
+	}
+	stored, _ = n.loadPreferences("alice")
+	if !reflect.DeepEqual(stored, map[string]interface{}{"ui": map[string]interface{}{"panels": 2.0}}) {
+		t.Errorf("PUT stored %#v", stored)
+	}
+}
+
+func TestPostMergeConcurrentChanges(t *testing.T) {
+	mock := &flagRaceDB{MockDB: NewMockDB()}
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	mock.races = mergeAttempts - 1
+	if status, body := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"ui":{"panels":2}}`), nil); status != http.StatusOK {
+		t.Errorf("POST returned %d: %s", status, body)
+	}
+
+	stored, _ := n.loadPreferences("alice")
+	for i := 0; i < mergeAttempts-1; i++ {
+		if stored[fmt.Sprintf("other-%d", i)] != true {
+			t.Errorf("the concurrent change other-%d was lost: %v", i, stored)
+		}
+	}
+	if stored["theme"] != "dark" || !reflect.DeepEqual(stored["ui"], map[string]interface{}{"panels": 2.0}) {
+		t.Errorf("POST stored %#v", stored)
+	}
+
+	mock.races = mergeAttempts
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", []byte(`{"theme":"light"}`), nil); status != http.StatusConflict {
+		t.Errorf("merging into preferences that kept changing returned %d instead of %d", status, http.StatusConflict)
+	}
+}
+
+func TestDeepMergeNulls(t *testing.T) {
+	dst := map[string]interface{}{
+		"remove": "me",
+		"ui":     map[string]interface{}{"theme": "dark", "compact": true},
+		"search": map[string]interface{}{"q": "old", "page": 2.0},
+	}
+	src := map[string]interface{}{
+		"remove":  nil,
+		"missing": nil,
+		"ui":      map[string]interface{}{"compact": nil},
+		"search":  map[string]interface{}{merge.Literal: map[string]interface{}{"q": "new"}},
+		"cleared": map[string]interface{}{merge.Literal: nil},
+		"added":   map[string]interface{}{"a": nil, "b": 1.0, "c": map[string]interface{}{merge.Literal: nil}},
+		"list":    []interface{}{nil, 1.0},
+	}
+	expected := map[string]interface{}{
+		"ui":      map[string]interface{}{"theme": "dark"},
+		"search":  map[string]interface{}{"q": "new"},
+		"cleared": nil,
+		"added":   map[string]interface{}{"b": 1.0, "c": nil},
+		"list":    []interface{}{nil, 1.0},
+	}
+
+	actual := deepMerge(dst, src, mergeOptions{arrays: arrayStrategy{name: arraysReplace}})
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("deepMerge returned %#v", actual)
+	}
+
+	actual = deepMerge(dst, map[string]interface{}{"ui": map[string]interface{}{"compact": nil, "panels": 2.0}}, mergeOptions{depth: 1})
+	if !reflect.DeepEqual(actual["ui"], map[string]interface{}{"panels": 2.0}) {
+		t.Errorf("deepMerge past the depth limit returned %#v", actual["ui"])
+	}
+}
+
+func TestPostNullDeletesKey(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark","columns":3}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"columns":null,"last_search":{"$literal":null}}`)
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice", body, nil); status != http.StatusOK {
+		t.Errorf("POST returned %d", status)
+	}
+
+	prefs, _ := mock.getPreferences("alice")
+	if prefs[0].Preferences != `{"last_search":null,"theme":"dark"}` {
+		t.Errorf("the stored preferences were %s", prefs[0].Preferences)
+	}
+}
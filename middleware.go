@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// middleware is a step that every request passes through on its way to the
+// router. It returns the writer and request for the steps after it, along with
+// a function to call once the response has been written, if it needs one. It
+// returns false if it wrote out the response itself, which ends the request.
+type middleware func(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool)
+
+// middleware returns the app's steps in the order requests pass through them.
+// The writers they wrap are finished in the reverse order.
+func (u *UserPreferencesApp) middleware() []middleware {
+	return []middleware{
+		setServiceVersion,
+		routeAPIVersion,
+		u.trimTrailingSlash,
+		u.compressResponse,
+		u.setCacheHeaders,
+		prettyPrint,
+		structureErrors,
+		u.injectFaults,
+		u.rejectWhileBreakerOpen,
+		u.countUsage,
+	}
+}
+
+// ServeHTTP passes the request through the app's middleware and then to its
+// router.
+func (u *UserPreferencesApp) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	var finishers []func()
+	defer func() {
+		for i := len(finishers) - 1; i >= 0; i-- {
+			finishers[i]()
+		}
+	}()
+
+	for _, step := range u.middleware() {
+		var (
+			finish func()
+			ok     bool
+		)
+		writer, r, finish, ok = step(writer, r)
+		if finish != nil {
+			finishers = append(finishers, finish)
+		}
+		if !ok {
+			return
+		}
+	}
+	u.router.ServeHTTP(writer, r)
+}
+
+// setServiceVersion names the running version in the X-Service-Version header
+// of every response.
+func setServiceVersion(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	writer.Header().Set(serviceVersionHeader, serviceVersion())
+	return writer, r, nil, true
+}
+
+// routeAPIVersion routes the request by API version; see withAPIVersion.
+func routeAPIVersion(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	return writer, withAPIVersion(writer, r), nil, true
+}
+
+// trimTrailingSlash routes paths with a trailing slash like the ones without;
+// see withoutTrailingSlash.
+func (u *UserPreferencesApp) trimTrailingSlash(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	return writer, u.withoutTrailingSlash(r), nil, true
+}
+
+// compressResponse compresses the response if response compression is
+// enabled.
+func (u *UserPreferencesApp) compressResponse(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if u.compression == nil {
+		return writer, r, nil, true
+	}
+	writer, finish := u.compression.wrap(writer, r)
+	return writer, r, finish, true
+}
+
+// setCacheHeaders gives the response the caching headers from the cache
+// policy.
+func (u *UserPreferencesApp) setCacheHeaders(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	writer, finish := u.caching.wrap(writer, r, u.router)
+	return writer, r, finish, true
+}
+
+// prettyPrint indents JSON responses for requests that ask for it.
+func prettyPrint(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if !wantsPretty(r) {
+		return writer, r, nil, true
+	}
+	pretty := &prettyWriter{ResponseWriter: writer}
+	return pretty, r, pretty.finish, true
+}
+
+// structureErrors turns plain text error responses into JSON for version 2 of
+// the API and later.
+func structureErrors(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if apiVersion(r) < apiV2 {
+		return writer, r, nil, true
+	}
+	structured := &structuredErrorWriter{ResponseWriter: writer}
+	return structured, r, structured.finish, true
+}
+
+// injectFaults fails or delays the request if faults are being injected into
+// it.
+func (u *UserPreferencesApp) injectFaults(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if u.chaos != nil && u.chaos.inject(writer, r) {
+		return writer, r, nil, false
+	}
+	return writer, r, nil, true
+}
+
+// alwaysAvailable lists the service descriptor, health, readiness, metrics,
+// version, OpenAPI, and runtime endpoints, which are served while the database
+// circuit breaker is open. So are the profiling endpoints.
+var alwaysAvailable = map[string]bool{
+	"/":              true,
+	"/healthz":       true,
+	"/readyz":        true,
+	"/metrics":       true,
+	"/version":       true,
+	"/openapi.json":  true,
+	"/admin/runtime": true,
+}
+
+// rejectWhileBreakerOpen fails fast with a 503 while the database circuit
+// breaker is rejecting calls, except for the endpoints that are always
+// available.
+func (u *UserPreferencesApp) rejectWhileBreakerOpen(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if alwaysAvailable[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		return writer, r, nil, true
+	}
+	if u.breaker != nil && u.breaker.Rejecting() {
+		unavailable(writer, ErrCircuitOpen.Error())
+		return writer, r, nil, false
+	}
+	return writer, r, nil, true
+}
+
+// countUsage counts the request in the usage statistics, if they're enabled.
+func (u *UserPreferencesApp) countUsage(writer http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(), bool) {
+	if u.usage != nil {
+		u.observeUsage(r)
+	}
+	return writer, r, nil, true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRejectWhileBreakerOpen(t *testing.T) {
+	n := New(NewMockDB())
+	n.breaker = NewCircuitBreaker("test-middleware", 1, time.Minute)
+	n.breaker.record(driver.ErrBadConn)
+
+	for _, path := range []string{"/healthz", "/version", "/debug/pprof/heap"} {
+		recorder := httptest.NewRecorder()
+		if _, _, _, ok := n.rejectWhileBreakerOpen(recorder, httptest.NewRequest(http.MethodGet, path, nil)); !ok {
+			t.Errorf("%s was rejected with an open breaker", path)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	if _, _, _, ok := n.rejectWhileBreakerOpen(recorder, httptest.NewRequest(http.MethodGet, "/test-user", nil)); ok || recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("a request was passed along with an open breaker, returning %d", recorder.Code)
+	}
+}
+
+// TestMiddlewareFinishes checks that the writers wrapped by the steps before a
+// step that ends the request are still finished.
+func TestMiddlewareFinishes(t *testing.T) {
+	n := New(NewMockDB())
+	n.breaker = NewCircuitBreaker("test-middleware-finish", 1, time.Minute)
+	n.breaker.record(driver.ErrBadConn)
+
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v2/test-user", nil))
+
+	var parsed apiError
+	if err := json.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil || parsed.Status != http.StatusServiceUnavailable {
+		t.Errorf("the rejected request returned %d '%s'", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get(serviceVersionHeader) == "" {
+		t.Error("the rejected request didn't name the service version")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// migration is a single schema change loaded from a migrations directory.
+// Migration files are named <version>_<description>.sql and are applied in
+// version order. Their SQL is a template for the table names; see
+// renderMigration.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads all of the *.sql files at the top of the file system and
+// returns them sorted by version.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, file := range paths {
+		name := path.Base(file)
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Migration %s does not start with a version number: %s", name, err)
+		}
+
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{
+			version: version,
+			name:    name,
+			sql:     string(contents),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("Migrations %s and %s have the same version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// migrate applies any of the migrations in the file system that haven't been
+// applied to the database yet. Each migration runs in its own transaction.
+func migrate(db *sql.DB, fsys fs.FS) error {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	createQuery := `CREATE TABLE IF NOT EXISTS user_preferences_migrations (
+                        version integer NOT NULL PRIMARY KEY,
+                        name text NOT NULL,
+                        applied_at timestamp NOT NULL DEFAULT now()
+                    )`
+	if _, err = db.Exec(createQuery); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		var count int64
+		checkQuery := `SELECT COUNT(*) FROM user_preferences_migrations WHERE version = $1`
+		if err = db.QueryRow(checkQuery, m.version).Scan(&count); err != nil {
+			return err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		log.Infof("Applying migration %s", m.name)
+		if err = applyMigration(db, m); err != nil {
+			return fmt.Errorf("Error applying migration %s: %s", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	statements, err := renderMigration(migrationSQL(m), tables)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if statements != "" {
+		if _, err = tx.Exec(statements); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	insertQuery := `INSERT INTO user_preferences_migrations (version, name) VALUES ($1, $2)`
+	if _, err = tx.Exec(insertQuery, m.version, m.name); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// renderMigration fills the table names into the migration's SQL, which is a
+// template referring to them as {{.Preferences}}, {{.Users}}, {{.UserID}}, and
+// {{.Username}}.
+func renderMigration(statements string, names TableNames) (string, error) {
+	tmpl, err := template.New("migration").Parse(statements)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered strings.Builder
+	if err = tmpl.Execute(&rendered, names); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
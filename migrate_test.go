@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func writeMigrations(files map[string]string) fstest.MapFS {
+	fsys := make(fstest.MapFS)
+	for name, contents := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(contents)}
+	}
+	return fsys
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := writeMigrations(map[string]string{
+		"0002_second.sql": "SELECT 2",
+		"0001_first.sql":  "SELECT 1",
+		"README":          "not a migration",
+	})
+
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("%d migrations were loaded instead of 2", len(migrations))
+	}
+
+	if migrations[0].version != 1 || migrations[0].sql != "SELECT 1" {
+		t.Errorf("first migration was %#v", migrations[0])
+	}
+
+	if migrations[1].version != 2 || migrations[1].name != "0002_second.sql" {
+		t.Errorf("second migration was %#v", migrations[1])
+	}
+}
+
+func TestLoadMigrationsDuplicateVersion(t *testing.T) {
+	fsys := writeMigrations(map[string]string{
+		"0001_first.sql": "SELECT 1",
+		"1_again.sql":    "SELECT 1",
+	})
+
+	if _, err := loadMigrations(fsys); err == nil {
+		t.Error("duplicate migration versions did not cause an error")
+	}
+}
+
+func TestLoadMigrationsBadName(t *testing.T) {
+	fsys := writeMigrations(map[string]string{
+		"first.sql": "SELECT 1",
+	})
+
+	if _, err := loadMigrations(fsys); err == nil {
+		t.Error("a migration without a version did not cause an error")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	fsys := writeMigrations(map[string]string{
+		"0001_first.sql":  "CREATE TABLE first (id integer)",
+		"0002_second.sql": "CREATE TABLE second (id integer)",
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS user_preferences_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_preferences_migrations WHERE version =").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_preferences_migrations WHERE version =").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE second").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_preferences_migrations \\(version, name\\) VALUES").
+		WithArgs(2, "0002_second.sql").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = migrate(db, fsys); err != nil {
+		t.Errorf("error migrating: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	embedded, err := loadMigrations(migrationsFS(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := loadMigrations(migrationsFS("migrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(embedded) == 0 || len(embedded) != len(onDisk) {
+		t.Fatalf("%d migrations were embedded, but there are %d in migrations/", len(embedded), len(onDisk))
+	}
+	for i := range embedded {
+		if embedded[i] != onDisk[i] {
+			t.Errorf("the embedded migration %s doesn't match the one in migrations/", embedded[i].name)
+		}
+	}
+}
+
+func TestRenderMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationsFS(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := TableNames{Preferences: "prefs", Users: "de.de_users", UserID: "user_id", Username: "login"}
+	for _, m := range migrations {
+		statements, err := renderMigration(m.sql, defaultTableNames)
+		if err != nil {
+			t.Errorf("%s didn't render: %s", m.name, err)
+			continue
+		}
+		if strings.Contains(statements, "{{") {
+			t.Errorf("%s has template actions left after rendering", m.name)
+		}
+
+		if statements, err = renderMigration(m.sql, renamed); err != nil {
+			t.Errorf("%s didn't render with renamed tables: %s", m.name, err)
+			continue
+		}
+		for _, name := range []string{"REFERENCES users", "ON user_preferences ", "ON user_preferences\n", "TABLE user_preferences ", "FROM users "} {
+			if strings.Contains(statements, name) {
+				t.Errorf("%s still refers to the default names with %q", m.name, name)
+			}
+		}
+	}
+
+	statements, err := renderMigration("SELECT current_setting('user_preferences.archiving') FROM {{.Preferences}}", renamed)
+	if err != nil || statements != "SELECT current_setting('user_preferences.archiving') FROM prefs" {
+		t.Errorf("the migration was rendered as %q, %v", statements, err)
+	}
+}
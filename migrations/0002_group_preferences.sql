@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS user_preferences_groups (
+    group_name text NOT NULL PRIMARY KEY,
+    preferences text NOT NULL
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_preferences_expirations (
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    key text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_expirations_expires_at_index
+    ON user_preferences_expirations (expires_at);
@@ -0,0 +1,20 @@
+-- Keys are only unique for each user, and the username is '' on routes that
+-- don't name one. Keys are reserved before their requests are handled, so that
+-- a retry that arrives while the original request is still in flight can be
+-- turned away. The headers the handler set are stored as JSON alongside the
+-- body so that replays carry them too.
+CREATE TABLE IF NOT EXISTS user_preferences_idempotency (
+    username text NOT NULL DEFAULT '',
+    idempotency_key text NOT NULL,
+    request_hash text NOT NULL,
+    pending boolean NOT NULL DEFAULT false,
+    status integer NOT NULL,
+    content_type text NOT NULL DEFAULT '',
+    headers text NOT NULL DEFAULT '{}',
+    body bytea NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_idempotency_created_at_index
+    ON user_preferences_idempotency (created_at);
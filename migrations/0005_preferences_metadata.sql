@@ -0,0 +1,4 @@
+ALTER TABLE {{.Preferences}}
+    ADD COLUMN IF NOT EXISTS created_at timestamp with time zone NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
@@ -0,0 +1,12 @@
+CREATE OR REPLACE FUNCTION user_preferences_set_modified_at() RETURNS trigger AS $$
+BEGIN
+    NEW.modified_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_preferences_modified_at ON {{.Preferences}};
+
+CREATE TRIGGER user_preferences_modified_at
+    BEFORE UPDATE ON {{.Preferences}}
+    FOR EACH ROW EXECUTE PROCEDURE user_preferences_set_modified_at();
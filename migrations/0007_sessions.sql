@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_preferences_sessions (
+    token text NOT NULL PRIMARY KEY,
+    preferences text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_sessions_expires_at_index
+    ON user_preferences_sessions (expires_at);
@@ -0,0 +1,5 @@
+CREATE INDEX IF NOT EXISTS user_preferences_modified_at_index
+    ON {{.Preferences}} (modified_at);
+
+CREATE INDEX IF NOT EXISTS user_preferences_user_id_index
+    ON {{.Preferences}} (user_id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_preferences_audit (
+    id bigserial NOT NULL PRIMARY KEY,
+    action text NOT NULL,
+    details text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_audit_created_at_index
+    ON user_preferences_audit (created_at);
@@ -0,0 +1,9 @@
+ALTER TABLE {{.Preferences}} ALTER COLUMN preferences DROP NOT NULL;
+
+ALTER TABLE {{.Preferences}} ADD COLUMN IF NOT EXISTS encoding text NOT NULL DEFAULT 'identity';
+
+ALTER TABLE {{.Preferences}} ADD COLUMN IF NOT EXISTS compressed bytea;
+
+CREATE INDEX IF NOT EXISTS user_preferences_compressed_index
+    ON {{.Preferences}} (id)
+    WHERE encoding <> 'identity';
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS user_preferences_history (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    version bigint NOT NULL,
+    preferences text,
+    encoding text NOT NULL DEFAULT 'identity',
+    compressed bytea,
+    modified_at timestamp with time zone NOT NULL,
+    replaced_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_history_user_id_index
+    ON user_preferences_history (user_id, id);
+
+CREATE INDEX IF NOT EXISTS user_preferences_history_replaced_at_index
+    ON user_preferences_history (replaced_at);
+
+-- Every version of a document is copied into the history when it's replaced or
+-- deleted, no matter which code path changed it.
+CREATE OR REPLACE FUNCTION user_preferences_record_history() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+       AND OLD.preferences IS NOT DISTINCT FROM NEW.preferences
+       AND OLD.compressed IS NOT DISTINCT FROM NEW.compressed THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO user_preferences_history (user_id, version, preferences, encoding, compressed, modified_at)
+         VALUES (OLD.user_id, OLD.version, OLD.preferences, OLD.encoding, OLD.compressed, OLD.modified_at);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_preferences_record_history ON {{.Preferences}};
+
+CREATE TRIGGER user_preferences_record_history
+    AFTER UPDATE OR DELETE ON {{.Preferences}}
+    FOR EACH ROW EXECUTE PROCEDURE user_preferences_record_history();
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_preferences_searches (
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    id text NOT NULL,
+    search text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_preferences_ui_sessions (
+    user_id uuid NOT NULL PRIMARY KEY REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    session text NOT NULL,
+    modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_ui_sessions_expires_at_index
+    ON user_preferences_ui_sessions (expires_at);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_preferences_bags (
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    name text NOT NULL,
+    contents text NOT NULL,
+    is_default boolean NOT NULL DEFAULT false,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, name)
+);
@@ -0,0 +1,10 @@
+-- The position of each user's undo stack. Version is the version of the
+-- preferences written by the most recent undo and history_id is the history
+-- entry it restored; the next undo continues from there as long as the
+-- preferences are still at that version.
+CREATE TABLE IF NOT EXISTS user_preferences_undo (
+    user_id uuid NOT NULL PRIMARY KEY REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    version bigint NOT NULL,
+    history_id bigint NOT NULL,
+    depth integer NOT NULL
+);
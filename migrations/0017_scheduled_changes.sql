@@ -0,0 +1,19 @@
+-- Changes to a user's or group's preferences that an administrator has
+-- scheduled for later. They're applied by the apply-scheduled-changes job once
+-- effective_at has passed; applied_at is set when a change is applied, along
+-- with error if it couldn't be.
+CREATE TABLE IF NOT EXISTS user_preferences_scheduled_changes (
+    id bigserial NOT NULL PRIMARY KEY,
+    target_type text NOT NULL CHECK (target_type IN ('user', 'group')),
+    target text NOT NULL,
+    mode text NOT NULL CHECK (mode IN ('merge', 'replace')),
+    preferences text NOT NULL,
+    effective_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    applied_at timestamp with time zone,
+    error text
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_scheduled_changes_pending_index
+    ON user_preferences_scheduled_changes (effective_at)
+    WHERE applied_at IS NULL;
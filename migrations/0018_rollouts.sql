@@ -0,0 +1,21 @@
+-- Preference changes rolled out to a percentage of users. The cohort is chosen
+-- by hashing the rollout's name with each username, so raising the percentage
+-- only adds users to it.
+CREATE TABLE IF NOT EXISTS user_preferences_rollouts (
+    name text NOT NULL PRIMARY KEY,
+    preferences text NOT NULL,
+    percentage double precision NOT NULL CHECK (percentage >= 0 AND percentage <= 100),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- The users a rollout has been applied to. previous holds the values the
+-- rolled out key paths had beforehand, so that they can be restored if the
+-- user leaves the cohort.
+CREATE TABLE IF NOT EXISTS user_preferences_rollout_members (
+    rollout text NOT NULL REFERENCES user_preferences_rollouts(name) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    previous text NOT NULL,
+    applied_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (rollout, user_id)
+);
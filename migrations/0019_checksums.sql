@@ -0,0 +1,23 @@
+-- The hex SHA-256 checksum of each preferences document, computed from the
+-- uncompressed JSON when it's written and verified whenever it's read. Rows
+-- written before checksums existed have a NULL checksum and aren't verified.
+ALTER TABLE {{.Preferences}} ADD COLUMN IF NOT EXISTS checksum text;
+
+-- Writers that change the document without computing a new checksum, such as
+-- manual fixes, leave the row unverified instead of making it look corrupt.
+CREATE OR REPLACE FUNCTION user_preferences_clear_stale_checksum() RETURNS trigger AS $$
+BEGIN
+    IF NEW.checksum IS NOT DISTINCT FROM OLD.checksum
+       AND (OLD.preferences IS DISTINCT FROM NEW.preferences
+            OR OLD.compressed IS DISTINCT FROM NEW.compressed) THEN
+        NEW.checksum = NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_preferences_stale_checksum ON {{.Preferences}};
+
+CREATE TRIGGER user_preferences_stale_checksum
+    BEFORE UPDATE ON {{.Preferences}}
+    FOR EACH ROW EXECUTE PROCEDURE user_preferences_clear_stale_checksum();
@@ -0,0 +1,130 @@
+-- Change events waiting to be published. Rows are added by a trigger in the
+-- same transaction as the change itself, so an event is recorded for every
+-- committed change even if the service crashes before publishing it. Each
+-- event keeps the keys the change added, removed, or changed rather than the
+-- documents themselves, so rows stay small; diff is NULL if the documents
+-- couldn't be compared.
+CREATE TABLE IF NOT EXISTS user_preferences_outbox (
+    id bigserial NOT NULL PRIMARY KEY,
+    username text NOT NULL,
+    operation text NOT NULL,
+    version bigint NOT NULL,
+    diff jsonb,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    published_at timestamp with time zone,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text
+);
+
+CREATE INDEX IF NOT EXISTS user_preferences_outbox_pending_index
+    ON user_preferences_outbox (id)
+    WHERE published_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS user_preferences_outbox_created_at_index
+    ON user_preferences_outbox (created_at);
+
+-- The unwrapped document stored in the preferences columns, or NULL if it can't
+-- be read here because it's compressed or in object storage.
+CREATE OR REPLACE FUNCTION user_preferences_event_document(encoding text, preferences text) RETURNS jsonb AS $$
+DECLARE
+    doc jsonb;
+BEGIN
+    IF encoding <> 'identity' THEN
+        RETURN NULL;
+    END IF;
+
+    doc := COALESCE(NULLIF(preferences, ''), '{}')::jsonb;
+    IF jsonb_typeof(doc->'preferences') = 'object' THEN
+        RETURN doc->'preferences';
+    ELSIF jsonb_typeof(doc) = 'object' THEN
+        RETURN doc;
+    END IF;
+    RETURN NULL;
+EXCEPTION WHEN OTHERS THEN
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The dotted key paths added, removed, or changed between two documents, in the
+-- form the service publishes, or NULL if either document is. Nested objects are
+-- compared key by key and any other value as a whole. The objects still to be
+-- compared are kept in a list rather than compared recursively.
+CREATE OR REPLACE FUNCTION user_preferences_diff(before_doc jsonb, after_doc jsonb) RETURNS jsonb AS $$
+DECLARE
+    pending jsonb;
+    item jsonb;
+    keys text[];
+    path text;
+    added jsonb := '[]';
+    removed jsonb := '[]';
+    changed jsonb := '[]';
+BEGIN
+    IF before_doc IS NULL OR after_doc IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    pending := jsonb_build_array(jsonb_build_array('', before_doc, after_doc));
+    WHILE jsonb_array_length(pending) > 0 LOOP
+        item := pending->0;
+        pending := pending - 0;
+
+        SELECT array_agg(k) INTO keys FROM jsonb_object_keys((item->1) || (item->2)) AS k;
+        FOR i IN 1..COALESCE(array_length(keys, 1), 0) LOOP
+            path := CASE WHEN item->>0 = '' THEN keys[i] ELSE (item->>0) || '.' || keys[i] END;
+            IF NOT (item->2) ? keys[i] THEN
+                removed := removed || to_jsonb(path);
+            ELSIF NOT (item->1) ? keys[i] THEN
+                added := added || to_jsonb(path);
+            ELSIF jsonb_typeof(item->1->keys[i]) = 'object' AND jsonb_typeof(item->2->keys[i]) = 'object' THEN
+                pending := pending || jsonb_build_array(jsonb_build_array(path, item->1->keys[i], item->2->keys[i]));
+            ELSIF item->1->keys[i] IS DISTINCT FROM item->2->keys[i] THEN
+                changed := changed || jsonb_build_array(jsonb_build_object(
+                    'path', path, 'before', item->1->keys[i], 'after', item->2->keys[i]));
+            END IF;
+        END LOOP;
+    END LOOP;
+
+    RETURN jsonb_build_object('added', added, 'removed', removed, 'changed', changed);
+END;
+$$ LANGUAGE plpgsql;
+
+-- An insert is compared with an empty document, and a delete with an empty
+-- document after it.
+CREATE OR REPLACE FUNCTION user_preferences_record_event() RETURNS trigger AS $$
+DECLARE
+    changed_user text;
+BEGIN
+    IF TG_OP = 'UPDATE'
+       AND OLD.preferences IS NOT DISTINCT FROM NEW.preferences
+       AND OLD.compressed IS NOT DISTINCT FROM NEW.compressed THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT {{.Username}} INTO changed_user FROM {{.Users}} WHERE {{.UserID}} = COALESCE(NEW.user_id, OLD.user_id);
+    IF changed_user IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'insert', NEW.version,
+                     user_preferences_diff('{}', user_preferences_event_document(NEW.encoding, NEW.preferences)));
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'update', NEW.version,
+                     user_preferences_diff(user_preferences_event_document(OLD.encoding, OLD.preferences),
+                                           user_preferences_event_document(NEW.encoding, NEW.preferences)));
+    ELSE
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'delete', OLD.version,
+                     user_preferences_diff(user_preferences_event_document(OLD.encoding, OLD.preferences), '{}'));
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_preferences_record_event ON {{.Preferences}};
+
+CREATE TRIGGER user_preferences_record_event
+    AFTER INSERT OR UPDATE OR DELETE ON {{.Preferences}}
+    FOR EACH ROW EXECUTE PROCEDURE user_preferences_record_event();
@@ -0,0 +1,9 @@
+-- The transaction that recorded each change event. Event IDs are handed out
+-- before their transactions commit, so a later ID can become visible first;
+-- replaying events in transaction order, and only once every earlier
+-- transaction has finished, keeps readers from skipping past late commits.
+ALTER TABLE user_preferences_outbox
+    ADD COLUMN IF NOT EXISTS transaction_id bigint NOT NULL DEFAULT txid_current();
+
+CREATE INDEX IF NOT EXISTS user_preferences_outbox_transaction_index
+    ON user_preferences_outbox (transaction_id, id);
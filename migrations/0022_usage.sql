@@ -0,0 +1,8 @@
+-- Per-user request counts, flushed periodically from the counters kept in
+-- memory by each instance.
+CREATE TABLE IF NOT EXISTS user_preferences_usage (
+    user_id uuid NOT NULL PRIMARY KEY REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    reads bigint NOT NULL DEFAULT 0,
+    writes bigint NOT NULL DEFAULT 0,
+    last_access timestamp with time zone NOT NULL
+);
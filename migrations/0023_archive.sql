@@ -0,0 +1,72 @@
+-- Preferences documents of users who haven't used the DE in a while, moved out
+-- of user_preferences to keep it small. They're moved back when the user
+-- returns.
+CREATE TABLE IF NOT EXISTS user_preferences_archive (
+    user_id uuid NOT NULL PRIMARY KEY REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    preferences text,
+    encoding text NOT NULL DEFAULT 'identity',
+    compressed bytea,
+    checksum text,
+    created_at timestamp with time zone NOT NULL,
+    modified_at timestamp with time zone NOT NULL,
+    version bigint NOT NULL,
+    archived_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Moving a document into or out of the archive doesn't change it, so the
+-- transactions that do it set user_preferences.archiving to keep the history
+-- and change event triggers from recording the move.
+CREATE OR REPLACE FUNCTION user_preferences_record_history() RETURNS trigger AS $$
+BEGIN
+    IF current_setting('user_preferences.archiving', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'UPDATE'
+       AND OLD.preferences IS NOT DISTINCT FROM NEW.preferences
+       AND OLD.compressed IS NOT DISTINCT FROM NEW.compressed THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO user_preferences_history (user_id, version, preferences, encoding, compressed, modified_at)
+         VALUES (OLD.user_id, OLD.version, OLD.preferences, OLD.encoding, OLD.compressed, OLD.modified_at);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION user_preferences_record_event() RETURNS trigger AS $$
+DECLARE
+    changed_user text;
+BEGIN
+    IF current_setting('user_preferences.archiving', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'UPDATE'
+       AND OLD.preferences IS NOT DISTINCT FROM NEW.preferences
+       AND OLD.compressed IS NOT DISTINCT FROM NEW.compressed THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT {{.Username}} INTO changed_user FROM {{.Users}} WHERE {{.UserID}} = COALESCE(NEW.user_id, OLD.user_id);
+    IF changed_user IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'insert', NEW.version,
+                     user_preferences_diff('{}', user_preferences_event_document(NEW.encoding, NEW.preferences)));
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'update', NEW.version,
+                     user_preferences_diff(user_preferences_event_document(OLD.encoding, OLD.preferences),
+                                           user_preferences_event_document(NEW.encoding, NEW.preferences)));
+    ELSE
+        INSERT INTO user_preferences_outbox (username, operation, version, diff)
+             VALUES (changed_user, 'delete', OLD.version,
+                     user_preferences_diff(user_preferences_event_document(OLD.encoding, OLD.preferences), '{}'));
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,10 @@
+-- The documented preference keys, registered by the teams that own them.
+CREATE TABLE IF NOT EXISTS user_preferences_registry (
+    key text NOT NULL PRIMARY KEY,
+    description text NOT NULL DEFAULT '',
+    type text NOT NULL DEFAULT '',
+    owner text NOT NULL DEFAULT '',
+    deprecated boolean NOT NULL DEFAULT false,
+    replacement text NOT NULL DEFAULT '',
+    modified_at timestamp with time zone NOT NULL DEFAULT now()
+);
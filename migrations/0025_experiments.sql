@@ -0,0 +1,10 @@
+-- The variant of each experiment that each user has been assigned to. The
+-- assignments are kept apart from the preferences so that assigning them
+-- doesn't write a new version of the user's document.
+CREATE TABLE IF NOT EXISTS user_preferences_experiments (
+    user_id uuid NOT NULL REFERENCES {{.Users}}({{.UserID}}) ON DELETE CASCADE,
+    experiment text NOT NULL,
+    variant text NOT NULL,
+    assigned_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, experiment)
+);
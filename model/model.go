@@ -0,0 +1,192 @@
+// Package model defines Go types for the well-known preferences stored by the
+// Discovery Environment, so that Go services can work with them without
+// picking apart map[string]interface{} documents. Keys the model doesn't know
+// about are ignored by Decode; they're still stored and returned by the
+// service.
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Folder is a data folder chosen by the user.
+type Folder struct {
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path"`
+}
+
+// WebhookType is the kind of service a webhook posts to, such as Slack or
+// Zapier.
+type WebhookType struct {
+	Type     string `json:"type"`
+	Template string `json:"template,omitempty"`
+}
+
+// Webhook is a URL that notifications about the topics are posted to.
+type Webhook struct {
+	ID     string      `json:"id,omitempty"`
+	URL    string      `json:"url"`
+	Type   WebhookType `json:"type"`
+	Topics []string    `json:"topics"`
+}
+
+// Preferences contains the well-known Discovery Environment preferences. Every
+// field is optional; a nil field wasn't set by the user.
+type Preferences struct {
+	RememberLastPath                *bool     `json:"rememberLastPath,omitempty"`
+	SaveSession                     *bool     `json:"saveSession,omitempty"`
+	EnableEmailNotification         *bool     `json:"enableEmailNotification,omitempty"`
+	EnableAnalysisEmailNotification *bool     `json:"enableAnalysisEmailNotification,omitempty"`
+	EnableImportEmailNotification   *bool     `json:"enableImportEmailNotification,omitempty"`
+	EnableWaitTimeMessage           *bool     `json:"enableWaitTimeMessage,omitempty"`
+	DefaultOutputFolder             *Folder   `json:"defaultOutputFolder,omitempty"`
+	SystemDefaultOutputDir          *Folder   `json:"systemDefaultOutputDir,omitempty"`
+	DefaultFileSelectorPath         *string   `json:"defaultFileSelectorPath,omitempty"`
+	AppsKeyShortCut                 *string   `json:"appsKeyShortCut,omitempty"`
+	DataKeyShortCut                 *string   `json:"dataKeyShortCut,omitempty"`
+	AnalysisKeyShortCut             *string   `json:"analysisKeyShortCut,omitempty"`
+	NotificationKeyShortCut         *string   `json:"notificationKeyShortCut,omitempty"`
+	CloseKeyShortCut                *string   `json:"closeKeyShortCut,omitempty"`
+	Webhooks                        []Webhook `json:"webhooks,omitempty"`
+}
+
+// FieldError is a problem with the value of a well-known preference.
+type FieldError struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// ValidationError lists the problems found in a preferences document.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		msgs[i] = field.Error()
+	}
+	return fmt.Sprintf("Invalid preferences: %s", strings.Join(msgs, "; "))
+}
+
+// jsonKey returns the key a struct field is encoded with.
+func jsonKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// Decode returns the well-known preferences in the document. A
+// *ValidationError listing every problem is returned if any of them have the
+// wrong type or an invalid value.
+func Decode(doc map[string]interface{}) (*Preferences, error) {
+	prefs := &Preferences{}
+	var errs []FieldError
+
+	v := reflect.ValueOf(prefs).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := jsonKey(v.Type().Field(i))
+		value, ok := doc[key]
+		if !ok || value == nil {
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			errs = append(errs, FieldError{Key: key, Message: err.Error()})
+			continue
+		}
+
+		field := reflect.New(v.Field(i).Type())
+		if err = json.Unmarshal(encoded, field.Interface()); err != nil {
+			errs = append(errs, FieldError{Key: key, Message: typeMessage(err)})
+			continue
+		}
+		v.Field(i).Set(field.Elem())
+	}
+
+	errs = append(errs, prefs.validate()...)
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+		return nil, &ValidationError{Fields: errs}
+	}
+	return prefs, nil
+}
+
+// typeMessage returns a readable message for a decoding error.
+func typeMessage(err error) string {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Sprintf("expected %s but got %s", typeName(typeErr.Type), typeErr.Value)
+	}
+	return err.Error()
+}
+
+// typeName returns the JSON name of the Go type.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return t.String()
+}
+
+// validate checks the values that decoded successfully.
+func (p *Preferences) validate() []FieldError {
+	var errs []FieldError
+
+	for key, folder := range map[string]*Folder{
+		"defaultOutputFolder":    p.DefaultOutputFolder,
+		"systemDefaultOutputDir": p.SystemDefaultOutputDir,
+	} {
+		if folder != nil && !strings.HasPrefix(folder.Path, "/") {
+			errs = append(errs, FieldError{Key: key + ".path", Message: "must be an absolute path"})
+		}
+	}
+
+	if p.DefaultFileSelectorPath != nil && *p.DefaultFileSelectorPath != "" && !strings.HasPrefix(*p.DefaultFileSelectorPath, "/") {
+		errs = append(errs, FieldError{Key: "defaultFileSelectorPath", Message: "must be an absolute path"})
+	}
+
+	for key, shortcut := range map[string]*string{
+		"appsKeyShortCut":         p.AppsKeyShortCut,
+		"dataKeyShortCut":         p.DataKeyShortCut,
+		"analysisKeyShortCut":     p.AnalysisKeyShortCut,
+		"notificationKeyShortCut": p.NotificationKeyShortCut,
+		"closeKeyShortCut":        p.CloseKeyShortCut,
+	} {
+		if shortcut != nil && len([]rune(*shortcut)) != 1 {
+			errs = append(errs, FieldError{Key: key, Message: "must be a single character"})
+		}
+	}
+
+	for i, webhook := range p.Webhooks {
+		key := fmt.Sprintf("webhooks.%d", i)
+		if parsed, err := url.Parse(webhook.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, FieldError{Key: key + ".url", Message: "must be an http or https URL"})
+		}
+		if webhook.Type.Type == "" {
+			errs = append(errs, FieldError{Key: key + ".type", Message: "must have a type"})
+		}
+		if len(webhook.Topics) == 0 {
+			errs = append(errs, FieldError{Key: key + ".topics", Message: "must list at least one topic"})
+		}
+	}
+
+	return errs
+}
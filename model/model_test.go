@@ -0,0 +1,71 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, doc string) map[string]interface{} {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestDecode(t *testing.T) {
+	doc := decodeJSON(t, `{
+		"rememberLastPath": true,
+		"defaultOutputFolder": {"id": "/iplant/home/alice/analyses", "path": "/iplant/home/alice/analyses"},
+		"appsKeyShortCut": "A",
+		"webhooks": [{"url": "https://hooks.slack.com/x", "type": {"type": "Slack"}, "topics": ["data"]}],
+		"somethingElse": [1, 2, 3]
+	}`)
+
+	prefs, err := Decode(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prefs.RememberLastPath == nil || !*prefs.RememberLastPath {
+		t.Errorf("rememberLastPath was %v", prefs.RememberLastPath)
+	}
+	if prefs.SaveSession != nil {
+		t.Error("a missing key was set")
+	}
+	if prefs.DefaultOutputFolder == nil || prefs.DefaultOutputFolder.Path != "/iplant/home/alice/analyses" {
+		t.Errorf("defaultOutputFolder was %#v", prefs.DefaultOutputFolder)
+	}
+	expected := []Webhook{{URL: "https://hooks.slack.com/x", Type: WebhookType{Type: "Slack"}, Topics: []string{"data"}}}
+	if !reflect.DeepEqual(prefs.Webhooks, expected) {
+		t.Errorf("webhooks were %#v", prefs.Webhooks)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	doc := decodeJSON(t, `{
+		"saveSession": "yes",
+		"defaultOutputFolder": {"path": "analyses"},
+		"closeKeyShortCut": "ctrl-q",
+		"webhooks": [{"url": "ftp://example.org", "type": {"type": "Zapier"}, "topics": []}]
+	}`)
+
+	_, err := Decode(doc)
+	invalid, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Decode returned %v", err)
+	}
+
+	var keys []string
+	for _, field := range invalid.Fields {
+		keys = append(keys, field.Key)
+	}
+	expected := []string{"closeKeyShortCut", "defaultOutputFolder.path", "saveSession", "webhooks.0.topics", "webhooks.0.url"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("the invalid keys were %v", keys)
+	}
+	if invalid.Fields[2].Message != "expected a boolean but got string" {
+		t.Errorf("the type error was %q", invalid.Fields[2].Message)
+	}
+}
@@ -0,0 +1,388 @@
+// Package msgpack encodes and decodes MessagePack representations of the
+// values that make up preferences documents: the same maps, arrays, strings,
+// numbers, booleans, and nulls that encoding/json produces when it decodes
+// into an interface{}.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// ErrTrailingData is returned by Unmarshal when the data contains more than
+// one value.
+var ErrTrailingData = errors.New("Unexpected data after the MessagePack value")
+
+// Marshal returns the MessagePack encoding of v. Map keys are written in sorted
+// order so that equal documents always have the same encoding, and floats
+// holding whole numbers are written as integers.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case string:
+		encodeString(buf, value)
+	case []byte:
+		encodeBinary(buf, value)
+	case int:
+		encodeInt(buf, int64(value))
+	case int8:
+		encodeInt(buf, int64(value))
+	case int16:
+		encodeInt(buf, int64(value))
+	case int32:
+		encodeInt(buf, int64(value))
+	case int64:
+		encodeInt(buf, value)
+	case uint:
+		encodeUint(buf, uint64(value))
+	case uint8:
+		encodeUint(buf, uint64(value))
+	case uint16:
+		encodeUint(buf, uint64(value))
+	case uint32:
+		encodeUint(buf, uint64(value))
+	case uint64:
+		encodeUint(buf, value)
+	case float32:
+		encodeFloat(buf, float64(value))
+	case float64:
+		encodeFloat(buf, value)
+	case []interface{}:
+		encodeLength(buf, len(value), 0x90, 15, 0xdc, 0xdd)
+		for _, item := range value {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		encodeLength(buf, len(value), 0x80, 15, 0xde, 0xdf)
+		for _, key := range keys {
+			encodeString(buf, key)
+			if err := encode(buf, value[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type %T for MessagePack encoding", v)
+	}
+	return nil
+}
+
+// encodeLength writes the header for a string, array, or map of length n,
+// using the fixed format if n fits in it and the 16 or 32 bit format if not.
+func encodeLength(buf *bytes.Buffer, n int, fixed byte, fixedMax int, code16, code32 byte) {
+	switch {
+	case n <= fixedMax:
+		buf.WriteByte(fixed | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(len(s)))
+	} else {
+		encodeLength(buf, len(s), 0xa0, 31, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+func encodeBinary(buf *bytes.Buffer, b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	}
+	buf.Write(b)
+}
+
+func encodeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		encodeUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeFloat(buf *bytes.Buffer, f float64) {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		encodeInt(buf, int64(f))
+		return
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+// Unmarshal decodes a single MessagePack value. Numbers are returned as
+// float64, maps as map[string]interface{}, and arrays as []interface{}, just
+// like encoding/json. Binary values are returned as []byte. Maps with keys
+// that aren't strings and extension types aren't supported.
+func Unmarshal(data []byte) (interface{}, error) {
+	r := bytes.NewReader(data)
+	v, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, ErrTrailingData
+	}
+	return v, nil
+}
+
+// Decode reads and decodes a single MessagePack value from the reader. See
+// Unmarshal for the types that are returned.
+func Decode(r io.Reader) (interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
+
+func decode(r *bytes.Reader) (interface{}, error) {
+	code, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch {
+	case code <= 0x7f:
+		return float64(code), nil
+	case code >= 0xe0:
+		return float64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return decodeMap(r, int(code&0x0f))
+	case code&0xf0 == 0x90:
+		return decodeArray(r, int(code&0x0f))
+	case code&0xe0 == 0xa0:
+		return decodeString(r, int(code&0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readLength(r, code-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readBytes(r, n)
+	case 0xca:
+		var bits uint32
+		err = binary.Read(r, binary.BigEndian, &bits)
+		return float64(math.Float32frombits(bits)), unexpectedEOF(err)
+	case 0xcb:
+		var bits uint64
+		err = binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), unexpectedEOF(err)
+	case 0xcc:
+		var n uint8
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xcd:
+		var n uint16
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xce:
+		var n uint32
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xcf:
+		var n uint64
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xd0:
+		var n int8
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xd1:
+		var n int16
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xd2:
+		var n int32
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xd3:
+		var n int64
+		err = binary.Read(r, binary.BigEndian, &n)
+		return float64(n), unexpectedEOF(err)
+	case 0xd9, 0xda, 0xdb:
+		n, err := readLength(r, code-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return decodeString(r, n)
+	case 0xdc, 0xdd:
+		n, err := readLength(r, code-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readLength(r, code-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMap(r, n)
+	}
+
+	return nil, fmt.Errorf("Unsupported MessagePack type 0x%02x", code)
+}
+
+// readLength reads a big-endian length that's 1, 2, or 4 bytes long for a
+// size of 0, 1, or 2 respectively.
+func readLength(r *bytes.Reader, size byte) (int, error) {
+	switch size {
+	case 0:
+		n, err := r.ReadByte()
+		return int(n), unexpectedEOF(err)
+	case 1:
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), unexpectedEOF(err)
+	default:
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), unexpectedEOF(err)
+	}
+}
+
+func readBytes(r *bytes.Reader, n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, unexpectedEOF(err)
+}
+
+func decodeString(r *bytes.Reader, n int) (interface{}, error) {
+	b, err := readBytes(r, n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func decodeArray(r *bytes.Reader, n int) (interface{}, error) {
+	// Every item takes at least a byte, which keeps a bogus length from
+	// allocating a huge slice.
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		item, err := decode(r)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func decodeMap(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := decode(r)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported MessagePack map key type %T", key)
+		}
+		if m[s], err = decode(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, since running out
+// of data part way through a value means the value was truncated.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
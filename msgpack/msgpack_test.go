@@ -0,0 +1,102 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	doc := map[string]interface{}{
+		"null":     nil,
+		"true":     true,
+		"false":    false,
+		"small":    7.0,
+		"negative": -5.0,
+		"byte":     200.0,
+		"short":    -3000.0,
+		"int":      70000.0,
+		"long":     -5000000000.0,
+		"huge":     math.Pow(2, 40),
+		"float":    1.5,
+		"string":   "hello",
+		"long-str": strings.Repeat("x", 300),
+		"array":    []interface{}{1.0, "two", []interface{}{}},
+		"nested":   map[string]interface{}{"a": map[string]interface{}{"b": false}},
+		"big":      make([]interface{}, 20),
+	}
+
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actual, doc) {
+		t.Errorf("the round trip returned %#v instead of %#v", actual, doc)
+	}
+}
+
+func TestMarshalEncodings(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{1.0, []byte{0x01}},
+		{-1, []byte{0xff}},
+		{256, []byte{0xcd, 0x01, 0x00}},
+		{"ab", []byte{0xa2, 'a', 'b'}},
+		{[]interface{}{false}, []byte{0x91, 0xc2}},
+		{map[string]interface{}{"b": 1, "a": 2}, []byte{0x82, 0xa1, 'a', 0x02, 0xa1, 'b', 0x01}},
+		{0.5, []byte{0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, c := range cases {
+		actual, err := Marshal(c.value)
+		if err != nil {
+			t.Errorf("error marshaling %#v: %s", c.value, err)
+			continue
+		}
+		if !bytes.Equal(actual, c.expected) {
+			t.Errorf("%#v was encoded as %x instead of %x", c.value, actual, c.expected)
+		}
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	if _, err := Marshal(map[string]interface{}{"ch": make(chan int)}); err == nil {
+		t.Error("no error was returned for a channel")
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated string": {0xa3, 'a'},
+		"truncated map":    {0x81, 0xa1, 'a'},
+		"huge array":       {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"integer key":      {0x81, 0x01, 0x01},
+		"extension":        {0xd4, 0x01, 0x01},
+		"empty":            {},
+	}
+	for name, data := range cases {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("no error was returned for the %s", name)
+		}
+	}
+
+	if _, err := Unmarshal([]byte{0x01, 0x02}); err != ErrTrailingData {
+		t.Errorf("trailing data returned %v", err)
+	}
+
+	if _, err := Unmarshal([]byte{0xa3, 'a'}); err != io.ErrUnexpectedEOF {
+		t.Errorf("a truncated value returned %v", err)
+	}
+}
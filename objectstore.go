@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// encodingObject is the encoding of documents stored in object storage. The
+// compressed column holds the object's key, and the preferences column is
+// NULL.
+const encodingObject = "object"
+
+// objectMetrics contains the object storage counters published at
+// /debug/vars.
+var objectMetrics = expvar.NewMap("object_storage")
+
+// ObjectStore keeps oversized preferences documents in an S3-compatible
+// bucket. Requests are signed with AWS Signature Version 4 and use path-style
+// URLs, which every S3-compatible service accepts.
+type ObjectStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	threshold int
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewObjectStore returns a newly created *ObjectStore for the bucket at the
+// endpoint. Documents larger than threshold bytes are stored in the bucket
+// under keys starting with prefix.
+func NewObjectStore(endpoint, bucket, region, accessKey, secretKey, prefix string, threshold int, timeout time.Duration) (*ObjectStore, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("Invalid object storage endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("Missing object storage bucket")
+	}
+	if threshold <= 0 {
+		return nil, fmt.Errorf("The object storage threshold must be positive, not %d", threshold)
+	}
+
+	return &ObjectStore{
+		endpoint:  parsed,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		prefix:    prefix,
+		threshold: threshold,
+		client:    outbound.client("object-storage", timeout),
+		now:       time.Now,
+	}, nil
+}
+
+// objectStoreConfig returns the object store for oversized documents described
+// by the configuration, or nil if it doesn't name an endpoint.
+func objectStoreConfig(cfg *viper.Viper) (*ObjectStore, error) {
+	endpoint := cfg.GetString("user-preferences.object-storage.endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	return NewObjectStore(
+		endpoint,
+		cfg.GetString("user-preferences.object-storage.bucket"),
+		cfg.GetString("user-preferences.object-storage.region"),
+		cfg.GetString("user-preferences.object-storage.access-key"),
+		cfg.GetString("user-preferences.object-storage.secret-key"),
+		cfg.GetString("user-preferences.object-storage.prefix"),
+		cfg.GetInt("user-preferences.object-storage.threshold"),
+		cfg.GetDuration("user-preferences.object-storage.timeout"),
+	)
+}
+
+// newKey returns a new random key for a document. Every write gets its own
+// object, so the versions in the history keep their documents.
+func (s *ObjectStore) newKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return s.prefix + hex.EncodeToString(b) + ".json", nil
+}
+
+// put stores the document under a new key and returns the key.
+func (s *ObjectStore) put(doc []byte) (string, error) {
+	key, err := s.newKey()
+	if err != nil {
+		return "", err
+	}
+	if _, err = s.do(http.MethodPut, key, doc); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// get returns the document stored under the key.
+func (s *ObjectStore) get(key string) ([]byte, error) {
+	return s.do(http.MethodGet, key, nil)
+}
+
+// delete deletes the document stored under the key. Deleting a key that
+// doesn't exist succeeds.
+func (s *ObjectStore) delete(key string) error {
+	_, err := s.do(http.MethodDelete, key, nil)
+	return err
+}
+
+// do sends a signed request for the key and returns the response body.
+func (s *ObjectStore) do(method, key string, body []byte) ([]byte, error) {
+	operation := strings.ToLower(method)
+	objectMetrics.Add(operation+".requests", 1)
+
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		objectMetrics.Add(operation+".failures", 1)
+		return nil, fmt.Errorf("Error sending the object storage request for %s: %s", key, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		objectMetrics.Add(operation+".failures", 1)
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		objectMetrics.Add(operation+".failures", 1)
+		return nil, fmt.Errorf("Object storage returned %d for %s %s: %.200s", resp.StatusCode, method, key, respBody)
+	}
+	return respBody, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (s *ObjectStore) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// sha256Hex returns the hex SHA-256 hash of the data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncodePath encodes the path the way Signature Version 4 expects: every
+// byte except the unreserved characters and slashes is percent-encoded.
+func uriEncodePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decode returns the document stored in the preferences, encoding, and
+// compressed columns, fetching it from object storage if it was offloaded.
+func (p *PrefsDB) decode(prefs sql.NullString, encoding string, compressed []byte) (string, error) {
+	if encoding != encodingObject {
+		return decodePreferences(prefs, encoding, compressed)
+	}
+	if p.objects == nil {
+		return "", fmt.Errorf("The preferences are in object storage, which isn't configured")
+	}
+
+	doc, err := p.objects.get(string(compressed))
+	if err != nil {
+		return "", err
+	}
+	return string(doc), nil
+}
+
+// deleteObjects deletes the offloaded documents that are no longer referenced.
+// Failures are only logged, since they leave nothing but unused objects
+// behind.
+func (p *PrefsDB) deleteObjects(keys []string) {
+	for _, key := range keys {
+		if err := p.objects.delete(key); err != nil {
+			log.WithFields(Fields{"key": key}).Warnf("Unable to delete an offloaded document: %s", err)
+		}
+	}
+}
+
+// scanObjectKeys returns the keys in the rows, which contain a single column
+// of object keys.
+func scanObjectKeys(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key []byte
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxOperations is the number of finished operations kept for reporting.
+const maxOperations = 100
+
+// The states an operation can be in.
+const (
+	operationRunning   = "running"
+	operationCompleted = "completed"
+	operationFailed    = "failed"
+)
+
+// Operation describes the progress of a long-running administrative change
+// that's applied to every user's preferences in batches.
+type Operation struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Params     map[string]string `json:"params"`
+	Status     string            `json:"status"`
+	Batches    int               `json:"batches"`
+	Updated    int64             `json:"updated"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// OperationFunc applies one batch of an operation and returns the number of
+// documents it updated. The operation finishes when a batch updates fewer
+// documents than the batch size.
+type OperationFunc func(batchSize int) (int64, error)
+
+// OperationTracker runs operations in the background and keeps track of their
+// progress.
+type OperationTracker struct {
+	mu         sync.Mutex
+	operations map[string]*Operation
+	nextID     int
+	batchSize  int
+}
+
+// NewOperationTracker returns a newly created *OperationTracker that applies
+// operations in batches of the given size.
+func NewOperationTracker(batchSize int) *OperationTracker {
+	return &OperationTracker{
+		operations: make(map[string]*Operation),
+		batchSize:  batchSize,
+	}
+}
+
+// Start begins running the operation in the background and returns a snapshot
+// of its initial status.
+func (t *OperationTracker) Start(kind string, params map[string]string, run OperationFunc) Operation {
+	t.mu.Lock()
+	t.nextID++
+	op := &Operation{
+		ID:        strconv.Itoa(t.nextID),
+		Kind:      kind,
+		Params:    params,
+		Status:    operationRunning,
+		StartedAt: time.Now(),
+	}
+	t.operations[op.ID] = op
+	t.prune()
+	snapshot := *op
+	batchSize := t.batchSize
+	t.mu.Unlock()
+
+	log.Infof("Starting operation %s: %s %v", op.ID, kind, params)
+	go t.run(op, batchSize, run)
+
+	return snapshot
+}
+
+func (t *OperationTracker) run(op *Operation, batchSize int, run OperationFunc) {
+	for {
+		updated, err := run(batchSize)
+
+		t.mu.Lock()
+		op.Batches++
+		op.Updated += updated
+		done := err != nil || updated < int64(batchSize)
+		if done {
+			finished := time.Now()
+			op.FinishedAt = &finished
+			op.Status = operationCompleted
+			if err != nil {
+				op.Status = operationFailed
+				op.Error = err.Error()
+			}
+		}
+		snapshot := *op
+		t.mu.Unlock()
+
+		if err != nil {
+			log.Errorf("Operation %s failed after %d batches: %s", snapshot.ID, snapshot.Batches, err)
+			return
+		}
+
+		log.Infof("Operation %s updated %d documents in batch %d", snapshot.ID, updated, snapshot.Batches)
+		if done {
+			log.Infof("Operation %s completed; %d documents updated", snapshot.ID, snapshot.Updated)
+			return
+		}
+	}
+}
+
+// prune removes the oldest finished operations once there are too many. The
+// caller must hold the lock.
+func (t *OperationTracker) prune() {
+	if len(t.operations) <= maxOperations {
+		return
+	}
+
+	var finished []*Operation
+	for _, op := range t.operations {
+		if op.FinishedAt != nil {
+			finished = append(finished, op)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartedAt.Before(finished[j].StartedAt)
+	})
+
+	for _, op := range finished {
+		if len(t.operations) <= maxOperations {
+			return
+		}
+		delete(t.operations, op.ID)
+	}
+}
+
+// Get returns a snapshot of the operation's status.
+func (t *OperationTracker) Get(id string) (Operation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	op, ok := t.operations[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+// List returns snapshots of all of the operations, most recent first.
+func (t *OperationTracker) List() []Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ops := make([]Operation, 0, len(t.operations))
+	for _, op := range t.operations {
+		ops = append(ops, *op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].StartedAt.After(ops[j].StartedAt)
+	})
+	return ops
+}
+
+// writeOperationStarted writes out the response for an operation that was
+// started in the background.
+func writeOperationStarted(writer http.ResponseWriter, r *http.Request, op Operation) {
+	jsoned, err := json.Marshal(op)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating operation JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Location", externalPath(r, "/admin/operations/"+op.ID))
+	writer.WriteHeader(http.StatusAccepted)
+	writer.Write(jsoned)
+}
+
+// OperationsRequest handles writing out the status of the recent operations.
+func (u *UserPreferencesApp) OperationsRequest(writer http.ResponseWriter, r *http.Request) {
+	jsoned, err := json.Marshal(map[string][]Operation{"operations": u.operations.List()})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating operations JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// OperationRequest handles writing out the status of a single operation.
+func (u *UserPreferencesApp) OperationRequest(writer http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	op, ok := u.operations.Get(id)
+	if !ok {
+		notFound(writer, fmt.Sprintf("Operation %s does not exist", id))
+		return
+	}
+
+	jsoned, err := json.Marshal(op)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating operation JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
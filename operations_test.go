@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForOperation polls the tracker until the operation finishes.
+func waitForOperation(t *testing.T, tracker *OperationTracker, id string) Operation {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		op, ok := tracker.Get(id)
+		if !ok {
+			t.Fatalf("operation %s does not exist", id)
+		}
+		if op.FinishedAt != nil {
+			return op
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("operation %s did not finish", id)
+	return Operation{}
+}
+
+func TestOperationTracker(t *testing.T) {
+	tracker := NewOperationTracker(2)
+
+	remaining := int64(5)
+	op := tracker.Start("test", map[string]string{"key": "value"}, func(batchSize int) (int64, error) {
+		updated := remaining
+		if updated > int64(batchSize) {
+			updated = int64(batchSize)
+		}
+		remaining -= updated
+		return updated, nil
+	})
+
+	if op.Status != operationRunning {
+		t.Errorf("the operation started as %s", op.Status)
+	}
+
+	op = waitForOperation(t, tracker, op.ID)
+	if op.Status != operationCompleted || op.Updated != 5 || op.Batches != 3 {
+		t.Errorf("the finished operation was %#v", op)
+	}
+
+	failed := tracker.Start("test", nil, func(batchSize int) (int64, error) {
+		return 0, errors.New("broken")
+	})
+	failed = waitForOperation(t, tracker, failed.ID)
+	if failed.Status != operationFailed || failed.Error != "broken" {
+		t.Errorf("the failed operation was %#v", failed)
+	}
+
+	ops := tracker.List()
+	if len(ops) != 2 || ops[0].ID != failed.ID {
+		t.Errorf("the operations were %#v", ops)
+	}
+}
+
+func TestOperationTrackerPrune(t *testing.T) {
+	tracker := NewOperationTracker(1)
+	for i := 0; i < maxOperations+10; i++ {
+		op := tracker.Start("test", nil, func(batchSize int) (int64, error) { return 0, nil })
+		waitForOperation(t, tracker, op.ID)
+	}
+
+	if count := len(tracker.List()); count > maxOperations+1 {
+		t.Errorf("%d operations were kept", count)
+	}
+}
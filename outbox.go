@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-preferences/diff"
+)
+
+// outboxMetrics contains the outbox counters published at /debug/vars.
+var outboxMetrics = expvar.NewMap("outbox")
+
+// OutboxEvent is a change to a user's preferences waiting to be published.
+// Operation is insert, update, or delete, and Version is the version of the
+// document that was written, or that was deleted. Diff lists the keys the
+// change added, removed, or changed; it's missing for events recorded before
+// the documents were, and for events whose documents couldn't be read.
+type OutboxEvent struct {
+	ID        int64      `json:"id"`
+	Username  string     `json:"user"`
+	Operation string     `json:"operation"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"at"`
+	Diff      *diff.Diff `json:"diff,omitempty"`
+
+	// TransactionID is the database transaction that recorded the event, which
+	// orders events for replay.
+	TransactionID int64 `json:"-"`
+}
+
+// EventPublisher delivers change events to a destination. Publish returns only
+// once the destination has accepted the event.
+type EventPublisher interface {
+	Publish(event *OutboxEvent, payload []byte) error
+}
+
+// httpPublisher posts events to a URL as JSON.
+type httpPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *httpPublisher) Publish(event *OutboxEvent, payload []byte) error {
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", p.url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// natsPublisher publishes events to a subject on a NATS server, using the
+// plain text client protocol. Each publish is followed by a PING, and the event
+// only counts as delivered once the server answers with a PONG, which it does
+// after processing everything sent before it.
+type natsPublisher struct {
+	addr    string
+	subject string
+	user    *url.Userinfo
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// connect opens the connection to the server, if it isn't open already.
+func (p *natsPublisher) connect() error {
+	if p.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("Unexpected greeting from NATS server %s: %s", p.addr, strings.TrimSpace(line))
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "user-preferences"}
+	if p.user != nil {
+		options["user"] = p.user.Username()
+		if password, ok := p.user.Password(); ok {
+			options["pass"] = password
+		} else {
+			options["auth_token"] = p.user.Username()
+			delete(options, "user")
+		}
+	}
+	jsoned, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\n", jsoned); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn, p.reader = conn, reader
+	return nil
+}
+
+// close drops the connection so that the next publish reconnects.
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.reader = nil, nil
+	}
+}
+
+func (p *natsPublisher) Publish(event *OutboxEvent, payload []byte) error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\nPING\r\n", p.subject, len(payload), payload); err != nil {
+		p.close()
+		return err
+	}
+
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			p.close()
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = p.conn.Write([]byte("PONG\r\n")); err != nil {
+				p.close()
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			p.close()
+			return fmt.Errorf("NATS server %s rejected the event: %s", p.addr, line)
+		}
+	}
+}
+
+// newEventPublisher returns the publisher for a target URL. http and https
+// URLs are posted to; nats URLs are published to on the subject.
+func newEventPublisher(target, subject string, timeout time.Duration) (EventPublisher, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid outbox target %s: %s", target, err)
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return &httpPublisher{url: target, client: outbound.client("outbox", timeout)}, nil
+	case "nats":
+		addr := parsed.Host
+		if parsed.Port() == "" {
+			addr = net.JoinHostPort(parsed.Hostname(), "4222")
+		}
+		return &natsPublisher{addr: addr, subject: subject, user: parsed.User, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported outbox target %s: the scheme must be http, https, or nats", target)
+	}
+}
+
+// Outbox publishes the recorded change events to each of its publishers.
+type Outbox struct {
+	publishers []EventPublisher
+	batchSize  int
+	retention  time.Duration
+}
+
+// NewOutbox returns a newly created *Outbox that publishes to the targets. NATS
+// targets publish on the subject.
+func NewOutbox(targets []string, subject string, timeout time.Duration, batchSize int, retention time.Duration) (*Outbox, error) {
+	if strings.TrimSpace(subject) == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("Invalid outbox subject %q", subject)
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("The outbox batch size must be positive")
+	}
+
+	o := &Outbox{batchSize: batchSize, retention: retention}
+	for _, target := range targets {
+		publisher, err := newEventPublisher(target, subject, timeout)
+		if err != nil {
+			return nil, err
+		}
+		o.publishers = append(o.publishers, publisher)
+	}
+	return o, nil
+}
+
+// publish delivers the event to every publisher. An event that fails for any
+// of them is retried for all of them, so publishers may see it more than once.
+func (o *Outbox) publish(event *OutboxEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for _, publisher := range o.publishers {
+		if err = publisher.Publish(event, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEventDiff sets the event's diff from the one the trigger stored with it,
+// which is NULL if the trigger couldn't compare the documents. The trigger
+// doesn't order the paths, so they're sorted here. An event whose diff can't be
+// read is still published without one, so that it doesn't hold back the user's
+// later events.
+func setEventDiff(event *OutboxEvent, stored []byte) {
+	if stored == nil {
+		return
+	}
+
+	var d diff.Diff
+	if err := json.Unmarshal(stored, &d); err != nil {
+		log.Errorf("Error reading the diff of change event %d for user %s: %s", event.ID, event.Username, err)
+		return
+	}
+	d.Sort()
+	event.Diff = &d
+}
+
+// dispatchEvents publishes up to limit pending events in order. Once an event
+// for a user fails, the user's later events are held back until it succeeds,
+// so each user's events are published in the order they happened. Only one
+// instance dispatches at a time; the others return right away. It returns the
+// number of events that were published.
+func (p *PrefsDB) dispatchEvents(limit int, publish func(event *OutboxEvent) error) (int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock(hashtext('user_preferences_outbox'))`).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	query := `SELECT id, username, operation, version, created_at, diff
+                FROM user_preferences_outbox
+               WHERE published_at IS NULL
+            ORDER BY id
+               LIMIT $1`
+	rows, err := tx.Query(query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var (
+			event  OutboxEvent
+			stored []byte
+		)
+		if err = rows.Scan(&event.ID, &event.Username, &event.Operation, &event.Version, &event.CreatedAt, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		setEventDiff(&event, stored)
+		events = append(events, event)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	blocked := make(map[string]bool)
+	for i := range events {
+		event := &events[i]
+		if blocked[event.Username] {
+			continue
+		}
+
+		if err := publish(event); err != nil {
+			blocked[event.Username] = true
+			update := `UPDATE user_preferences_outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1`
+			if _, err = tx.Exec(update, event.ID, err.Error()); err != nil {
+				return published, err
+			}
+			continue
+		}
+
+		if _, err := tx.Exec(`UPDATE user_preferences_outbox SET published_at = now(), attempts = attempts + 1 WHERE id = $1`, event.ID); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, tx.Commit()
+}
+
+// purgeEvents deletes the published events recorded before the time, and the
+// unpublished ones as well if all is set.
+func (p *PrefsDB) purgeEvents(before time.Time, all bool) (int64, error) {
+	query := `DELETE FROM user_preferences_outbox
+               WHERE created_at < $1
+                 AND (published_at IS NOT NULL OR $2)`
+	result, err := p.db.Exec(query, before, all)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// pendingEvents returns the number of events that haven't been published and
+// when the oldest of them was recorded.
+func (p *PrefsDB) pendingEvents() (int64, *time.Time, error) {
+	var (
+		count  int64
+		oldest *time.Time
+	)
+	query := `SELECT COUNT(*), MIN(created_at) FROM user_preferences_outbox WHERE published_at IS NULL`
+	if err := p.db.QueryRow(query).Scan(&count, &oldest); err != nil {
+		return 0, nil, err
+	}
+	return count, oldest, nil
+}
+
+// dispatchOutbox publishes a batch of pending change events.
+func (u *UserPreferencesApp) dispatchOutbox(now time.Time) (int, error) {
+	published, err := u.prefs.dispatchEvents(u.outbox.batchSize, func(event *OutboxEvent) error {
+		if err := u.outbox.publish(event); err != nil {
+			outboxMetrics.Add("failures", 1)
+			log.Errorf("Error publishing change event %d for user %s: %s", event.ID, event.Username, err)
+			return err
+		}
+		return nil
+	})
+	outboxMetrics.Add("published", int64(published))
+	if err != nil {
+		return published, fmt.Errorf("Error dispatching change events: %s", err)
+	}
+	return published, nil
+}
+
+// purgeOutbox deletes the change events that are older than the retention
+// period. Unpublished events are only deleted when there's nowhere to publish
+// them.
+func (u *UserPreferencesApp) purgeOutbox(now time.Time) (int, error) {
+	purged, err := u.prefs.purgeEvents(now.Add(-u.outbox.retention), len(u.outbox.publishers) == 0)
+	if err != nil {
+		return 0, fmt.Errorf("Error purging change events: %s", err)
+	}
+	return int(purged), nil
+}
+
+// outboxResponse is the JSON body returned by the outbox endpoint.
+type outboxResponse struct {
+	Pending int64      `json:"pending"`
+	Oldest  *time.Time `json:"oldest,omitempty"`
+}
+
+// OutboxRequest handles writing out how many change events are waiting to be
+// published.
+func (u *UserPreferencesApp) OutboxRequest(writer http.ResponseWriter, r *http.Request) {
+	pending, oldest, err := u.prefs.pendingEvents()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error counting pending change events: %s", err))
+		return
+	}
+
+	jsoned, err := json.Marshal(&outboxResponse{Pending: pending, Oldest: oldest})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating outbox JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/user-preferences/diff"
+)
+
+var outboxColumns = []string{
+	"id", "username", "operation", "version", "created_at", "diff",
+}
+
+func TestDispatchEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT id, username, operation, version, created_at, diff FROM user_preferences_outbox").
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, "alice", "insert", 1, now, `{"added":["theme"],"removed":[],"changed":[]}`).
+			AddRow(2, "bob", "insert", 1, now, nil).
+			AddRow(3, "alice", "update", 2, now, `{"added":["size","color"],"removed":[],"changed":[{"path":"theme","before":"dark","after":"light"}]}`).
+			AddRow(4, "bob", "update", 2, now, nil))
+	mock.ExpectExec("UPDATE user_preferences_outbox SET published_at = now\\(\\)").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_preferences_outbox SET attempts = attempts \\+ 1, last_error = \\$2").
+		WithArgs(2, "unavailable").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_preferences_outbox SET published_at = now\\(\\)").
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var attempted []int64
+	diffs := make(map[int64]*diff.Diff)
+	published, err := NewPrefsDB(db).dispatchEvents(10, func(event *OutboxEvent) error {
+		attempted = append(attempted, event.ID)
+		diffs[event.ID] = event.Diff
+		if event.Username == "bob" {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error from dispatchEvents(): %s", err)
+	}
+	if published != 2 {
+		t.Errorf("%d events were published", published)
+	}
+	if len(attempted) != 3 || attempted[2] != 3 {
+		t.Errorf("the events attempted were %v; bob's second event should have been held back", attempted)
+	}
+	if d := diffs[1]; d == nil || !reflect.DeepEqual(d.Added, []string{"theme"}) {
+		t.Errorf("the insert's diff was %+v", d)
+	}
+	if d := diffs[3]; d == nil || !reflect.DeepEqual(d.Added, []string{"color", "size"}) || len(d.Changed) != 1 || d.Changed[0].After != "light" {
+		t.Errorf("the update's diff was %+v", d)
+	}
+	if diffs[2] != nil {
+		t.Errorf("an event without a stored diff had the diff %+v", diffs[2])
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestDispatchEventsLocked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+
+	published, err := NewPrefsDB(db).dispatchEvents(10, func(event *OutboxEvent) error {
+		t.Errorf("event %d was published while another instance held the lock", event.ID)
+		return nil
+	})
+	if err != nil || published != 0 {
+		t.Errorf("dispatchEvents() returned %d, %v", published, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestPurgeEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	before := time.Now()
+	mock.ExpectExec("DELETE FROM user_preferences_outbox WHERE created_at < \\$1 AND \\(published_at IS NOT NULL OR \\$2\\)").
+		WithArgs(before, false).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := NewPrefsDB(db).purgeEvents(before, false)
+	if err != nil || purged != 3 {
+		t.Errorf("purgeEvents() returned %d, %v", purged, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	var received OutboxEvent
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("the event was not JSON: %s", body)
+		}
+	}))
+	defer server.Close()
+
+	o, err := NewOutbox([]string{server.URL}, "user-preferences.changed", time.Second, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("error from NewOutbox(): %s", err)
+	}
+
+	event := &OutboxEvent{ID: 5, Username: "alice", Operation: "update", Version: 3, CreatedAt: time.Now().UTC()}
+	if err = o.publish(event); err != nil {
+		t.Fatalf("error from publish(): %s", err)
+	}
+	if received.ID != 5 || received.Username != "alice" || received.Version != 3 {
+		t.Errorf("the target received %+v", received)
+	}
+
+	fail = true
+	if err = o.publish(event); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("publishing to a failing target returned %v", err)
+	}
+}
+
+// fakeNATS accepts a single NATS client and sends each message it publishes on
+// the channel. It rejects messages whose payload contains "reject".
+func fakeNATS(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch fields := strings.Fields(line); {
+			case len(fields) == 0:
+			case fields[0] == "PING":
+				conn.Write([]byte("PONG\r\n"))
+			case fields[0] == "PUB":
+				payload, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.Contains(payload, "reject") {
+					conn.Write([]byte("-ERR 'Permissions Violation'\r\n"))
+					continue
+				}
+				messages <- fields[1] + " " + strings.TrimSpace(payload)
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func TestNATSPublisher(t *testing.T) {
+	addr, messages := fakeNATS(t)
+
+	o, err := NewOutbox([]string{"nats://token@" + addr}, "prefs.changed", time.Second, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("error from NewOutbox(): %s", err)
+	}
+
+	if err = o.publish(&OutboxEvent{ID: 1, Username: "alice", Operation: "insert", Version: 1}); err != nil {
+		t.Fatalf("error from publish(): %s", err)
+	}
+	select {
+	case message := <-messages:
+		if !strings.HasPrefix(message, `prefs.changed {"id":1,"user":"alice"`) {
+			t.Errorf("the server received %q", message)
+		}
+	default:
+		t.Error("the server had not received the event when publish() returned")
+	}
+
+	if err = o.publish(&OutboxEvent{ID: 2, Username: "reject", Operation: "insert", Version: 1}); err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("publishing a rejected event returned %v", err)
+	}
+}
+
+func TestNewOutbox(t *testing.T) {
+	for _, tc := range []struct {
+		targets   []string
+		subject   string
+		batchSize int
+	}{
+		{[]string{"ftp://example.com"}, "changed", 10},
+		{nil, "", 10},
+		{nil, "user preferences", 10},
+		{nil, "changed", 0},
+	} {
+		if _, err := NewOutbox(tc.targets, tc.subject, time.Second, tc.batchSize, time.Hour); err == nil {
+			t.Errorf("NewOutbox(%v, %q, %d) did not return an error", tc.targets, tc.subject, tc.batchSize)
+		}
+	}
+
+	publisher, err := newEventPublisher("nats://nats.example.com", "changed", time.Second)
+	if err != nil || publisher.(*natsPublisher).addr != "nats.example.com:4222" {
+		t.Errorf("newEventPublisher() returned %#v, %v", publisher, err)
+	}
+}
+
+func TestOutboxJobs(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+
+	var delivered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event OutboxEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		delivered = append(delivered, event.Username+" "+event.Operation)
+	}))
+	defer server.Close()
+
+	var err error
+	if n.outbox, err = NewOutbox([]string{server.URL}, "changed", time.Second, 10, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.insertPreferences("alice", `{"a":1}`)
+	mock.insertPreferences("alice", `{"a":2}`)
+	mock.deletePreferences("alice")
+
+	api := httptest.NewServer(n)
+	defer api.Close()
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	_, body := doRequest(t, http.MethodGet, api.URL+"/admin/outbox", nil, admin)
+	var pending outboxResponse
+	if err = json.Unmarshal(body, &pending); err != nil || pending.Pending != 3 || pending.Oldest == nil {
+		t.Errorf("the outbox status was %s", body)
+	}
+
+	published, err := n.dispatchOutbox(time.Now())
+	if err != nil || published != 3 {
+		t.Errorf("dispatchOutbox() returned %d, %v", published, err)
+	}
+	if strings.Join(delivered, ",") != "alice insert,alice update,alice delete" {
+		t.Errorf("the events delivered were %v", delivered)
+	}
+
+	if purged, err := n.purgeOutbox(time.Now().Add(2 * time.Hour)); err != nil || purged != 3 {
+		t.Errorf("purgeOutbox() returned %d, %v", purged, err)
+	}
+	if status, _ := doRequest(t, http.MethodGet, api.URL+"/admin/outbox", nil, nil); status != http.StatusForbidden {
+		t.Errorf("the outbox status returned %d without the admin key", status)
+	}
+}
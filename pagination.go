@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PageFilter selects a page of a listing that's ordered newest first, such as
+// the history or the audit log. Pages are chained with cursors rather than
+// offsets, so entries added while a client is paging don't shift the pages.
+type PageFilter struct {
+	// Before limits the page to entries with IDs below it. The page starts
+	// with the newest entry if it's zero.
+	Before int64
+
+	// Since and Until limit the page to entries timestamped within the range,
+	// if they're set. Since is inclusive and Until is exclusive.
+	Since *time.Time
+	Until *time.Time
+
+	Limit int
+}
+
+// pageResponse contains the paging fields included in listing responses.
+// NextCursor is only set if there are more entries to list.
+type pageResponse struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor returns the cursor for the page following the entry with the
+// ID. Clients should treat cursors as opaque.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// decodeCursor returns the ID encoded in the cursor.
+func decodeCursor(cursor string) (int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(decoded), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	return id, nil
+}
+
+// parsePageFilter builds a PageFilter from the listing request's cursor,
+// since, until, and limit query parameters. Limits above maxLimit are
+// rejected.
+func parsePageFilter(r *http.Request, defaultLimit, maxLimit int) (PageFilter, error) {
+	var (
+		filter = PageFilter{Limit: defaultLimit}
+		params = r.URL.Query()
+		err    error
+	)
+	if filter.Limit > maxLimit {
+		filter.Limit = maxLimit
+	}
+
+	if value := params.Get("cursor"); value != "" {
+		if filter.Before, err = decodeCursor(value); err != nil {
+			return filter, fmt.Errorf("Invalid cursor: %s", value)
+		}
+	}
+
+	for name, dest := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := params.Get(name); value != "" {
+			parsed, parseErr := time.Parse(time.RFC3339, value)
+			if parseErr != nil {
+				return filter, fmt.Errorf("Invalid %s value %s; use an RFC 3339 timestamp", name, value)
+			}
+			*dest = &parsed
+		}
+	}
+
+	if value := params.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			return filter, fmt.Errorf("Invalid limit %s; use a number from 1 to %d", value, maxLimit)
+		}
+	}
+
+	return filter, nil
+}
+
+// conditions returns the SQL conditions selecting the page, given the columns
+// holding the entries' IDs and timestamps, and the arguments with the
+// conditions' parameters appended.
+func (f PageFilter) conditions(idColumn, timeColumn string, args []interface{}) ([]string, []interface{}) {
+	var conditions []string
+
+	if f.Before > 0 {
+		args = append(args, f.Before)
+		conditions = append(conditions, fmt.Sprintf("%s < $%d", idColumn, len(args)))
+	}
+	if f.Since != nil {
+		args = append(args, *f.Since)
+		conditions = append(conditions, fmt.Sprintf("%s >= $%d", timeColumn, len(args)))
+	}
+	if f.Until != nil {
+		args = append(args, *f.Until)
+		conditions = append(conditions, fmt.Sprintf("%s < $%d", timeColumn, len(args)))
+	}
+
+	return conditions, args
+}
+
+// peek returns a copy of the filter that selects one more entry than the page
+// holds, so that the listing can tell whether there's another page.
+func (f PageFilter) peek() PageFilter {
+	f.Limit++
+	return f
+}
+
+// paginate trims the entries fetched with the peeking filter to the page and
+// returns the paging fields for the response. id returns the ID of the entry
+// at the index.
+func (f PageFilter) paginate(count int, id func(i int) int64) (int, pageResponse) {
+	response := pageResponse{Limit: f.Limit}
+	if count > f.Limit {
+		count = f.Limit
+		response.NextCursor = encodeCursor(id(count - 1))
+	}
+	return count, response
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCursors(t *testing.T) {
+	id, err := decodeCursor(encodeCursor(42))
+	if err != nil || id != 42 {
+		t.Errorf("a cursor decoded to %d, %v", id, err)
+	}
+
+	for _, cursor := range []string{"!!", encodeCursor(0), "YWJj"} {
+		if _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("the cursor %s was accepted", cursor)
+		}
+	}
+}
+
+func TestParsePageFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?since=2026-01-01T00:00:00Z&until=2026-02-01T00:00:00Z&limit=5&cursor="+encodeCursor(10), nil)
+	filter, err := parsePageFilter(r, 20, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Limit != 5 || filter.Before != 10 || filter.Since == nil || filter.Until == nil || filter.Since.Month() != 1 || filter.Until.Month() != 2 {
+		t.Errorf("the filter was %+v", filter)
+	}
+
+	conditions, args := filter.conditions("id", "created_at", []interface{}{"alice"})
+	if len(conditions) != 3 || conditions[0] != "id < $2" || conditions[2] != "created_at < $4" || len(args) != 4 {
+		t.Errorf("the conditions were %v with %v", conditions, args)
+	}
+
+	filter, err = parsePageFilter(httptest.NewRequest("GET", "/", nil), 200, 100)
+	if err != nil || filter.Limit != 100 {
+		t.Errorf("the default limit wasn't capped: %+v, %v", filter, err)
+	}
+
+	if _, err = parsePageFilter(httptest.NewRequest("GET", "/?limit=101", nil), 20, 100); err == nil {
+		t.Error("a limit over the maximum was accepted")
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	filter := PageFilter{Limit: 2}
+	ids := []int64{9, 8, 7}
+
+	count, page := filter.paginate(len(ids), func(i int) int64 { return ids[i] })
+	if count != 2 || page.NextCursor != encodeCursor(8) {
+		t.Errorf("paginating a full page returned %d, %+v", count, page)
+	}
+
+	count, page = filter.paginate(2, func(i int) int64 { return ids[i] })
+	if count != 2 || page.NextCursor != "" {
+		t.Errorf("paginating the last page returned %d, %+v", count, page)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// splitPath splits a dotted key path such as "notifications.email" into its
+// components.
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// getPath returns the value at the dotted key path in the document and whether
+// it was present.
+func getPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	parts := splitPath(path)
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	value, ok := current[parts[len(parts)-1]]
+	return value, ok
+}
+
+// setPath sets the value at the dotted key path in the document, creating any
+// intermediate objects that are needed. Intermediate values that aren't objects
+// are replaced.
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	parts := splitPath(path)
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+// deletePath removes the value at the dotted key path from the document and
+// returns whether anything was removed.
+func deletePath(doc map[string]interface{}, path string) bool {
+	parts := splitPath(path)
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		current = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := current[last]; !ok {
+		return false
+	}
+	delete(current, last)
+	return true
+}
+
+// deepCopy returns a copy of a parsed JSON value that shares no maps or slices
+// with the original.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return value
+	}
+}
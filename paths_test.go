@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"top":    "value",
+		"nested": map[string]interface{}{"inner": 1.0},
+	}
+
+	if value, ok := getPath(doc, "top"); !ok || value != "value" {
+		t.Errorf("getPath returned %#v, %t for a top-level key", value, ok)
+	}
+
+	if value, ok := getPath(doc, "nested.inner"); !ok || value != 1.0 {
+		t.Errorf("getPath returned %#v, %t for a nested key", value, ok)
+	}
+
+	if _, ok := getPath(doc, "nested.missing"); ok {
+		t.Error("getPath found a missing nested key")
+	}
+
+	if _, ok := getPath(doc, "top.inner"); ok {
+		t.Error("getPath traversed into a scalar")
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	doc := map[string]interface{}{"scalar": "value"}
+
+	setPath(doc, "a.b.c", true)
+	setPath(doc, "scalar.inner", 1.0)
+
+	expected := map[string]interface{}{
+		"a":      map[string]interface{}{"b": map[string]interface{}{"c": true}},
+		"scalar": map[string]interface{}{"inner": 1.0},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("setPath produced %#v instead of %#v", doc, expected)
+	}
+}
+
+func TestDeletePath(t *testing.T) {
+	doc := map[string]interface{}{
+		"nested": map[string]interface{}{"inner": 1.0, "other": 2.0},
+	}
+
+	if !deletePath(doc, "nested.inner") {
+		t.Error("deletePath did not remove a nested key")
+	}
+
+	if deletePath(doc, "nested.inner") {
+		t.Error("deletePath removed a missing key")
+	}
+
+	if deletePath(doc, "missing.inner") {
+		t.Error("deletePath removed a key from a missing object")
+	}
+
+	expected := map[string]interface{}{
+		"nested": map[string]interface{}{"other": 2.0},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("deletePath produced %#v instead of %#v", doc, expected)
+	}
+}
+
+func TestDeepCopy(t *testing.T) {
+	original := map[string]interface{}{
+		"nested": map[string]interface{}{"inner": 1.0},
+		"list":   []interface{}{"one"},
+	}
+
+	copied := deepCopy(original).(map[string]interface{})
+	copied["nested"].(map[string]interface{})["inner"] = 2.0
+	copied["list"].([]interface{})[0] = "two"
+
+	if original["nested"].(map[string]interface{})["inner"] != 1.0 {
+		t.Error("modifying the copy modified a nested map in the original")
+	}
+
+	if original["list"].([]interface{})[0] != "one" {
+		t.Error("modifying the copy modified a slice in the original")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Policies for handling writes that contain likely secrets or personal
+// information.
+const (
+	// piiPolicyReject rejects the entire write with a 422.
+	piiPolicyReject = "reject"
+
+	// piiPolicyRedact replaces the matching text with piiRedacted and applies
+	// the write.
+	piiPolicyRedact = "redact"
+
+	// piiPolicyFlag applies the write unchanged. The findings are still
+	// recorded in the audit log.
+	piiPolicyFlag = "flag"
+)
+
+// piiRedacted replaces the matching text in redacted values.
+const piiRedacted = "[REDACTED]"
+
+// piiDetector finds one kind of sensitive text in string values. If check is
+// set, a match is only reported if it returns true.
+type piiDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	check   func(match string) bool
+}
+
+// piiDetectors are the detectors that can be enabled, by kind.
+var piiDetectors = map[string]piiDetector{
+	"email": {
+		kind:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	"credit-card": {
+		kind:    "credit-card",
+		pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		check:   luhnValid,
+	},
+	"token": {
+		kind: "token",
+		pattern: regexp.MustCompile(strings.Join([]string{
+			`-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+			`\bAKIA[0-9A-Z]{16}\b`,
+			`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+			`\bxox[abprs]-[A-Za-z0-9-]{10,}`,
+			`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`,
+			`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{20,}=*`,
+		}, "|")),
+	},
+}
+
+// luhnValid returns whether the digits in the text pass the Luhn check used by
+// payment card numbers.
+func luhnValid(text string) bool {
+	sum := 0
+	double := false
+	for i := len(text) - 1; i >= 0; i-- {
+		c := text[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// PIIFinding is a key whose value appears to contain sensitive text. Values in
+// arrays are reported under the key of the array.
+type PIIFinding struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"`
+}
+
+// PIIScanner detects likely secrets and personal information in the string
+// values of incoming preferences documents.
+type PIIScanner struct {
+	detectors []piiDetector
+	policy    string
+	allowed   []string
+}
+
+// NewPIIScanner returns a newly created *PIIScanner that uses the detectors of
+// the given kinds, or all of them if kinds is empty. Values at or below the
+// allowed key paths aren't scanned. An error is returned if a kind or the
+// policy isn't recognized.
+func NewPIIScanner(kinds []string, policy string, allowed []string) (*PIIScanner, error) {
+	if policy == "" {
+		policy = piiPolicyReject
+	}
+	if policy != piiPolicyReject && policy != piiPolicyRedact && policy != piiPolicyFlag {
+		return nil, fmt.Errorf("Unknown PII policy %s", policy)
+	}
+
+	if len(kinds) == 0 {
+		for kind := range piiDetectors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+	}
+
+	scanner := &PIIScanner{policy: policy, allowed: allowed}
+	for _, kind := range kinds {
+		detector, ok := piiDetectors[kind]
+		if !ok {
+			return nil, fmt.Errorf("Unknown PII detector %s", kind)
+		}
+		scanner.detectors = append(scanner.detectors, detector)
+	}
+	return scanner, nil
+}
+
+// isAllowed returns whether the key path is at or below an allowed key path.
+func (s *PIIScanner) isAllowed(path string) bool {
+	for _, allowed := range s.allowed {
+		if path == allowed || strings.HasPrefix(path, allowed+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// scanString returns the kinds of sensitive text in the value and the value
+// with that text redacted.
+func (s *PIIScanner) scanString(value string) ([]string, string) {
+	var kinds []string
+	for _, d := range s.detectors {
+		found := false
+		value = d.pattern.ReplaceAllStringFunc(value, func(match string) string {
+			if d.check != nil && !d.check(match) {
+				return match
+			}
+			found = true
+			return piiRedacted
+		})
+		if found {
+			kinds = append(kinds, d.kind)
+		}
+	}
+	return kinds, value
+}
+
+// scanValue scans the value found at the key path, returning the value with
+// any sensitive text redacted.
+func (s *PIIScanner) scanValue(path string, value interface{}, findings map[PIIFinding]bool) interface{} {
+	if path != "" && s.isAllowed(path) {
+		return value
+	}
+
+	switch v := value.(type) {
+	case string:
+		kinds, redacted := s.scanString(v)
+		for _, kind := range kinds {
+			findings[PIIFinding{Key: path, Kind: kind}] = true
+		}
+		return redacted
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = s.scanValue(path, item, findings)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			result[key] = s.scanValue(child, item, findings)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// scan returns the findings in the document, sorted by key, and a copy of the
+// document with the sensitive text redacted.
+func (s *PIIScanner) scan(doc map[string]interface{}) ([]PIIFinding, map[string]interface{}) {
+	found := make(map[PIIFinding]bool)
+	redacted := s.scanValue("", doc, found).(map[string]interface{})
+
+	findings := make([]PIIFinding, 0, len(found))
+	for finding := range found {
+		findings = append(findings, finding)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Key != findings[j].Key {
+			return findings[i].Key < findings[j].Key
+		}
+		return findings[i].Kind < findings[j].Kind
+	})
+	return findings, redacted
+}
+
+// piiRejection is the JSON body returned when a write is rejected because of
+// its findings.
+type piiRejection struct {
+	Error    string       `json:"error"`
+	Findings []PIIFinding `json:"findings"`
+}
+
+// scanWrite enforces the PII policy on a write of the incoming document,
+// returning the document that should be stored. The findings, but not the
+// values, are recorded in the audit log. An error response is written and
+// false is returned if the write is rejected.
+func (u *UserPreferencesApp) scanWrite(writer http.ResponseWriter, username string, incoming map[string]interface{}) (map[string]interface{}, bool) {
+	if u.pii == nil {
+		return incoming, true
+	}
+
+	findings, redacted := u.pii.scan(incoming)
+	if len(findings) == 0 {
+		return incoming, true
+	}
+
+	keys := make([]string, len(findings))
+	for i, finding := range findings {
+		keys[i] = finding.Key + ":" + finding.Kind
+	}
+	err := u.audit("pii-detected", map[string]string{
+		"user":     username,
+		"policy":   u.pii.policy,
+		"findings": strings.Join(keys, ","),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+
+	switch u.pii.policy {
+	case piiPolicyRedact:
+		return redacted, true
+	case piiPolicyFlag:
+		return incoming, true
+	}
+
+	msg := fmt.Sprintf("The preferences for user %s appear to contain secrets or personal information", username)
+	log.Errorf("%s: %s", msg, strings.Join(keys, ", "))
+
+	jsoned, err := json.Marshal(&piiRejection{Error: msg, Findings: findings})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating PII findings JSON: %s", err))
+		return nil, false
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusUnprocessableEntity)
+	writer.Write(jsoned)
+	return nil, false
+}
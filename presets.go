@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// listPresets returns the names of all of the presets, sorted by name.
+func (p *PrefsDB) listPresets() ([]string, error) {
+	query := `SELECT name FROM user_preferences_presets ORDER BY name`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return names, err
+	}
+
+	return names, nil
+}
+
+// getPreset returns the preferences document stored for the named preset.
+// sql.ErrNoRows is returned if the preset doesn't exist.
+func (p *PrefsDB) getPreset(name string) (string, error) {
+	query := `SELECT preferences FROM user_preferences_presets WHERE name = $1`
+	var prefs string
+	if err := p.db.QueryRow(query, name).Scan(&prefs); err != nil {
+		return "", err
+	}
+	return prefs, nil
+}
+
+// savePreset creates the named preset or replaces it if it already exists.
+func (p *PrefsDB) savePreset(name, prefs string) error {
+	query := `INSERT INTO user_preferences_presets (name, preferences)
+                   VALUES ($1, $2)
+              ON CONFLICT (name) DO UPDATE
+                      SET preferences = EXCLUDED.preferences`
+	_, err := p.db.Exec(query, name, prefs)
+	return err
+}
+
+// deletePreset removes the named preset.
+func (p *PrefsDB) deletePreset(name string) error {
+	query := `DELETE FROM user_preferences_presets WHERE name = $1`
+	_, err := p.db.Exec(query, name)
+	return err
+}
+
+// presetValues parses a stored preset into a preferences map. Presets are
+// stored unwrapped, but wrapped documents are accepted for consistency with
+// user preferences.
+func presetValues(prefs string) (map[string]interface{}, error) {
+	values, err := convert(&UserPreferencesRecord{Preferences: prefs}, false)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return values, nil
+}
+
+// lookupPreset loads and parses the named preset, writing out an error response
+// and returning false if that isn't possible.
+func (u *UserPreferencesApp) lookupPreset(writer http.ResponseWriter, name string) (map[string]interface{}, bool) {
+	prefs, err := u.prefs.getPreset(name)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Preset %s does not exist", name))
+		return nil, false
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting preset %s: %s", name, err))
+		return nil, false
+	}
+
+	values, err := presetValues(prefs)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error parsing preset %s: %s", name, err))
+		return nil, false
+	}
+
+	return values, true
+}
+
+// ListPresetsRequest handles listing the names of the available presets.
+func (u *UserPreferencesApp) ListPresetsRequest(writer http.ResponseWriter, r *http.Request) {
+	names, err := u.prefs.listPresets()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing presets: %s", err))
+		return
+	}
+
+	if names == nil {
+		names = []string{}
+	}
+
+	jsoned, err := json.Marshal(map[string][]string{"presets": names})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating presets JSON: %s", err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// GetPresetRequest handles writing out a preset's preferences as a response.
+func (u *UserPreferencesApp) GetPresetRequest(writer http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	values, ok := u.lookupPreset(writer, name)
+	if !ok {
+		return
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for preset %s: %s", name, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// PutPresetRequest handles creating or replacing a preset. A POST in version 2
+// of the API merges the body into the preset instead.
+func (u *UserPreferencesApp) PutPresetRequest(writer http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	values, err := readDocument(r.Body)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if mergesOnPost(r) {
+		stored, err := u.prefs.getPreset(name)
+		if err != nil && err != sql.ErrNoRows {
+			errored(writer, fmt.Sprintf("Error getting preset %s: %s", name, err))
+			return
+		}
+		if values, err = u.postedValues(r, stored, values); err != nil {
+			errored(writer, fmt.Sprintf("Error parsing preset %s: %s", name, err))
+			return
+		}
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for preset %s: %s", name, err))
+		return
+	}
+
+	log.Infof("Saving preset %s", name)
+	if err = u.prefs.savePreset(name, string(jsoned)); err != nil {
+		errored(writer, fmt.Sprintf("Error saving preset %s: %s", name, err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
+
+// DeletePresetRequest handles deleting a preset.
+func (u *UserPreferencesApp) DeletePresetRequest(writer http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	log.Infof("Deleting preset %s", name)
+	if err := u.prefs.deletePreset(name); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting preset %s: %s", name, err))
+	}
+}
+
+// ApplyPresetRequest handles merging a preset into a user's preferences. The
+// preset's values win over the user's existing values.
+func (u *UserPreferencesApp) ApplyPresetRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+
+	preset, ok := u.lookupPreset(writer, name)
+	if !ok {
+		return
+	}
+
+	log.Infof("Applying preset %s to %s", name, username)
+	values, err := u.loadPreferences(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	created, err := u.storePreferences(username, mergePreferences(values, preset))
+	if err != nil {
+		storeFailed(writer, err)
+		return
+	}
+
+	u.writeStoredPreferences(writer, r, username, created, nil)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPresetRequests(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/presets/classroom", server.URL)
+	admin := map[string]string{adminKeyHeader: "secret"}
+	preset := []byte(`{"preferences":{"theme":"light"}}`)
+
+	status, _ := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET of a missing preset returned %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, url, preset, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("non-admin PUT returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	status, body := doRequest(t, http.MethodPut, url, preset, admin)
+	if status != http.StatusOK {
+		t.Errorf("admin PUT returned %d instead of %d", status, http.StatusOK)
+	}
+	if string(body) != `{"theme":"light"}` {
+		t.Errorf("admin PUT returned '%s'", body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("GET returned %d instead of %d", status, http.StatusOK)
+	}
+	if string(body) != `{"theme":"light"}` {
+		t.Errorf("GET returned '%s'", body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/presets", server.URL), nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("list returned %d instead of %d", status, http.StatusOK)
+	}
+	if string(body) != `{"presets":["classroom"]}` {
+		t.Errorf("list returned '%s'", body)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, url, nil, admin)
+	if status != http.StatusOK {
+		t.Errorf("admin DELETE returned %d instead of %d", status, http.StatusOK)
+	}
+	if _, ok := mock.presets["classroom"]; ok {
+		t.Error("preset was not deleted")
+	}
+}
+
+func TestPutPresetUnparseable(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/presets/broken", server.URL)
+	status, _ := doRequest(t, http.MethodPut, url, []byte("-----"), map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusBadRequest {
+		t.Errorf("PUT returned %d instead of %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestApplyPresetRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	mock.presets["power-user"] = `{"theme":"dark","editor":{"vim":true}}`
+	if err := mock.insertPreferences(username, `{"theme":"light","editor":{"tabs":4}}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, _ := doRequest(t, http.MethodPost, fmt.Sprintf("%s/%s/apply-preset/missing", server.URL, username), nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("applying a missing preset returned %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, body := doRequest(t, http.MethodPost, fmt.Sprintf("%s/%s/apply-preset/power-user", server.URL, username), nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("applying a preset returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"theme":  "dark",
+		"editor": map[string]interface{}{"vim": true, "tabs": 4.0},
+	}
+	if !reflect.DeepEqual(parsed["preferences"], expected) {
+		t.Errorf("apply-preset returned %#v instead of %#v", parsed["preferences"], expected)
+	}
+}
+
+func TestGetPreset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT preferences FROM user_preferences_presets WHERE name =").
+		WithArgs("classroom").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow("{}"))
+
+	prefs, err := p.getPreset("classroom")
+	if err != nil {
+		t.Errorf("error from getPreset(): %s", err)
+	}
+
+	if prefs != "{}" {
+		t.Errorf("preferences was %s instead of '{}'", prefs)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestSavePreset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec("INSERT INTO user_preferences_presets \\(name, preferences\\) VALUES (.+) ON CONFLICT").
+		WithArgs("classroom", "{}").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = p.savePreset("classroom", "{}"); err != nil {
+		t.Errorf("error saving preset: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
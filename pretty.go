@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// prettyParam is the query parameter that asks for indented JSON responses.
+const prettyParam = "pretty"
+
+// prettyIndent is the indentation used for pretty-printed JSON.
+const prettyIndent = "  "
+
+// wantsPretty returns whether the client asked for indented JSON, either with
+// the pretty query parameter or with a pretty or indent parameter on the JSON
+// media type in its Accept header, as in application/json; pretty=true.
+func wantsPretty(r *http.Request) bool {
+	if value := r.URL.Query().Get(prettyParam); value != "" {
+		pretty, err := strconv.ParseBool(value)
+		return err == nil && pretty
+	}
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		if pretty, err := strconv.ParseBool(params["pretty"]); err == nil {
+			return pretty
+		}
+		if indent, err := strconv.Atoi(params["indent"]); err == nil {
+			return indent > 0
+		}
+	}
+	return false
+}
+
+// prettyWriter indents the JSON responses written by the handlers. Responses
+// that are JSON, or that don't name a content type, are held until the
+// handler finishes and indented if they parse; everything else is passed
+// through as it's written.
+type prettyWriter struct {
+	http.ResponseWriter
+	status    int
+	buffering bool
+	decided   bool
+	body      bytes.Buffer
+}
+
+// decide determines whether the response is held for indenting, based on its
+// content type.
+func (w *prettyWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	w.buffering = mediaType == "" || mediaType == "application/json"
+}
+
+func (w *prettyWriter) WriteHeader(status int) {
+	w.decide()
+	if w.buffering {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *prettyWriter) Write(b []byte) (int, error) {
+	w.decide()
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes out the held response, indented if it's JSON.
+func (w *prettyWriter) finish() {
+	if !w.buffering {
+		return
+	}
+
+	body := w.body.Bytes()
+	var indented bytes.Buffer
+	if len(body) > 0 && json.Indent(&indented, bytes.TrimSpace(body), "", prettyIndent) == nil {
+		indented.WriteByte('\n')
+		body = indented.Bytes()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Length")
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if len(body) > 0 {
+		w.ResponseWriter.Write(body)
+	}
+}
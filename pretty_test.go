@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsPretty(t *testing.T) {
+	tests := []struct {
+		url      string
+		accept   string
+		expected bool
+	}{
+		{"/test-user", "", false},
+		{"/test-user?pretty=true", "", true},
+		{"/test-user?pretty=1", "", true},
+		{"/test-user?pretty=false", "application/json; pretty=true", false},
+		{"/test-user?pretty=bogus", "", false},
+		{"/test-user", "application/json; pretty=true", true},
+		{"/test-user", "application/json;indent=2", true},
+		{"/test-user", "application/json;indent=0", false},
+		{"/test-user", "application/yaml; pretty=true", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		r.Header.Set("Accept", test.accept)
+		if actual := wantsPretty(r); actual != test.expected {
+			t.Errorf("wantsPretty(%s, %q) returned %t", test.url, test.accept, actual)
+		}
+	}
+}
+
+func TestPrettyResponses(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	mock.presets["dark"] = `{"theme":"dark"}`
+	server := httptest.NewServer(New(mock))
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/test-user?pretty=true", nil, nil)
+	if status != http.StatusOK || string(body) != "{\n  \"theme\": \"dark\"\n}\n" {
+		t.Errorf("GET of preferences returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/presets/dark", nil, map[string]string{"Accept": "application/json; pretty=true"})
+	if status != http.StatusOK || string(body) != "{\n  \"theme\": \"dark\"\n}\n" {
+		t.Errorf("GET of a preset returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/test-user", nil, nil)
+	if status != http.StatusOK || string(body) != `{"theme":"dark"}` {
+		t.Errorf("GET without pretty returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/v2/missing-user?pretty=true", nil, nil)
+	expected := "{\n  \"status\": 404,\n  \"error\": \"Not Found\",\n  \"message\": \"User missing-user does not exist\"\n}\n"
+	if status != http.StatusNotFound || string(body) != expected {
+		t.Errorf("a v2 error returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/missing-user?pretty=true", nil, nil)
+	if status != http.StatusBadRequest || string(body) != "{\"user\":\"missing-user\"}\n" {
+		t.Errorf("a plain text error returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/?pretty=true", nil, map[string]string{"Accept": "text/plain"})
+	if status != http.StatusOK || string(body) != "Hello from user-preferences." {
+		t.Errorf("the plain text greeting returned %d '%s'", status, body)
+	}
+}
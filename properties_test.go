@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/cyverse-de/user-preferences/merge"
+)
+
+// propertyKeys are the keys used in generated documents. There are few of them
+// so that generated documents often share keys, and they include the keys
+// that the service treats specially.
+var propertyKeys = []string{"a", "b", "c", "id", "preferences", merge.Literal}
+
+// randomJSON returns a random value of the kind produced by decoding JSON,
+// nesting objects and arrays at most depth levels deep.
+func randomJSON(rand *rand.Rand, depth int) interface{} {
+	kinds := 7
+	if depth <= 0 {
+		kinds = 5
+	}
+
+	switch rand.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return rand.Intn(2) == 0
+	case 2:
+		return float64(rand.Intn(2000) - 1000)
+	case 3:
+		return rand.NormFloat64() * 1e6
+	case 4:
+		return propertyKeys[rand.Intn(len(propertyKeys))] + string(rune('a'+rand.Intn(26)))
+	case 5:
+		array := make([]interface{}, rand.Intn(4))
+		for i := range array {
+			array[i] = randomJSON(rand, depth-1)
+		}
+		return array
+	default:
+		return randomObject(rand, depth-1)
+	}
+}
+
+// randomObject returns a random JSON object.
+func randomObject(rand *rand.Rand, depth int) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for i := rand.Intn(5); i > 0; i-- {
+		obj[propertyKeys[rand.Intn(len(propertyKeys))]] = randomJSON(rand, depth)
+	}
+	return obj
+}
+
+// jsonDocument is a random JSON object for testing/quick.
+type jsonDocument map[string]interface{}
+
+func (jsonDocument) Generate(rand *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(jsonDocument(randomObject(rand, 4)))
+}
+
+// jsonText is the encoding of a random JSON value, which may not be an object.
+type jsonText string
+
+func (jsonText) Generate(rand *rand.Rand, size int) reflect.Value {
+	encoded, _ := json.Marshal(randomJSON(rand, 4))
+	return reflect.ValueOf(jsonText(encoded))
+}
+
+// checkProperty fails the test with the counterexample if the property
+// doesn't hold. It's checked five times as often as -quickchecks says.
+func checkProperty(t *testing.T, property interface{}) {
+	t.Helper()
+	if err := quick.Check(property, &quick.Config{MaxCountScale: 5}); err != nil {
+		t.Error(err)
+	}
+}
+
+// roundTrip returns the document after encoding and decoding it, as it's read
+// back after being stored.
+func roundTrip(t *testing.T, doc map[string]interface{}) map[string]interface{} {
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestPropertyConvertNeverPanics(t *testing.T) {
+	checkProperty(t, func(text jsonText, wrap bool) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Logf("convert(%s, %t) panicked: %v", text, wrap, r)
+				ok = false
+			}
+		}()
+		convert(&UserPreferencesRecord{Preferences: string(text)}, wrap)
+		return true
+	})
+
+	checkProperty(t, func(text string, wrap bool) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Logf("convert(%q, %t) panicked: %v", text, wrap, r)
+				ok = false
+			}
+		}()
+		convert(&UserPreferencesRecord{Preferences: text}, wrap)
+		return true
+	})
+}
+
+func TestPropertyConvertWrapping(t *testing.T) {
+	checkProperty(t, func(doc jsonDocument) bool {
+		encoded, _ := json.Marshal(doc)
+		record := &UserPreferencesRecord{Preferences: string(encoded)}
+
+		wrapped, err := convert(record, true)
+		if err != nil {
+			return false
+		}
+		unwrapped, err := convert(record, false)
+		if err != nil {
+			return false
+		}
+		if _, ok := wrapped["preferences"]; !ok {
+			return false
+		}
+
+		// Wrapping is idempotent, and unwrapping a wrapped document gives
+		// the unwrapped one.
+		rewrapped, _ := json.Marshal(wrapped)
+		again, err := convert(&UserPreferencesRecord{Preferences: string(rewrapped)}, true)
+		if err != nil || !reflect.DeepEqual(again, wrapped) {
+			return false
+		}
+		reunwrapped, err := convert(&UserPreferencesRecord{Preferences: string(rewrapped)}, false)
+		return err == nil && reflect.DeepEqual(reunwrapped, unwrapped)
+	})
+}
+
+// mergedInto returns whether the merged document reflects every change in
+// the patch: keys set to null are gone, $literal values are stored as given,
+// objects are merged into stored objects, and anything else is stored as a
+// patch value. Arrays are replaced.
+func mergedInto(merged, patch map[string]interface{}) bool {
+	for key, value := range patch {
+		stored, present := merged[key]
+		if value == nil {
+			if present {
+				return false
+			}
+			continue
+		}
+		if literal, ok := merge.LiteralValue(value); ok {
+			if !reflect.DeepEqual(stored, literal) {
+				return false
+			}
+			continue
+		}
+		obj, isObj := value.(map[string]interface{})
+		storedObj, storedIsObj := stored.(map[string]interface{})
+		if isObj && storedIsObj {
+			if !mergedInto(storedObj, obj) {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(stored, merge.PatchValue(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPropertyMerge(t *testing.T) {
+	opts, err := newMergeOptions(0, arraysReplace, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProperty(t, func(stored, patch jsonDocument) bool {
+		storedCopy := roundTrip(t, stored)
+		patchCopy := roundTrip(t, patch)
+
+		merged := deepMerge(storedCopy, patchCopy, opts)
+
+		// The inputs aren't modified.
+		if !reflect.DeepEqual(storedCopy, roundTrip(t, stored)) || !reflect.DeepEqual(patchCopy, roundTrip(t, patch)) {
+			return false
+		}
+
+		// Reading the merged document back gives what was merged.
+		read := roundTrip(t, merged)
+		if !reflect.DeepEqual(read, merged) || !mergedInto(read, patchCopy) {
+			return false
+		}
+
+		// Merging the same patch again changes nothing.
+		return reflect.DeepEqual(deepMerge(merged, patchCopy, opts), merged)
+	})
+
+	checkProperty(t, func(stored jsonDocument) bool {
+		doc := roundTrip(t, stored)
+		return reflect.DeepEqual(deepMerge(doc, map[string]interface{}{}, opts), doc)
+	})
+}
+
+func TestPropertyValueHash(t *testing.T) {
+	checkProperty(t, func(doc jsonDocument) bool {
+		first, err := valueHash(doc)
+		if err != nil {
+			return false
+		}
+
+		// Hashing is unaffected by storing and reading the document, and
+		// hashing twice gives the same result.
+		second, err := valueHash(roundTrip(t, doc))
+		if err != nil || first != second {
+			return false
+		}
+		third, err := valueHash(doc)
+		return err == nil && first == third
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// QuotaExceededError is returned when storing a user's preferences would take
+// the document past the size quota.
+type QuotaExceededError struct {
+	Username string
+	Size     int
+	Limit    int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf(
+		"The preferences for %s would use %d bytes, which exceeds the quota of %d bytes; remove some preferences and try again",
+		e.Username, e.Size, e.Limit,
+	)
+}
+
+// quotaResponse is the JSON body returned by the quota endpoint.
+type quotaResponse struct {
+	Usage     int `json:"usage"`
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+}
+
+// preferencesSize returns the size in bytes of the user's stored preferences.
+func (u *UserPreferencesApp) preferencesSize(username string) (int, error) {
+	records, err := u.prefs.getPreferences(username)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting preferences for username %s: %s", username, err)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	return len(records[0].Preferences), nil
+}
+
+// checkQuota returns a *QuotaExceededError if storing a document of the given
+// size would put the user over the quota. Documents that are already over the
+// quota may still shrink, so that users can get back under it. A quota of zero
+// disables the check.
+func (u *UserPreferencesApp) checkQuota(username string, size int) error {
+	if u.quota <= 0 || size <= u.quota {
+		return nil
+	}
+
+	current, err := u.preferencesSize(username)
+	if err != nil {
+		return err
+	}
+
+	if size <= current {
+		return nil
+	}
+
+	return &QuotaExceededError{Username: username, Size: size, Limit: u.quota}
+}
+
+// storeFailed writes out the response for an error returned while storing a
+// user's preferences.
+func storeFailed(writer http.ResponseWriter, err error) {
+	if _, ok := err.(*QuotaExceededError); ok {
+		http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		log.Error(err.Error())
+		return
+	}
+	errored(writer, err.Error())
+}
+
+// QuotaRequest handles writing out how much of the quota a user's preferences
+// are using.
+func (u *UserPreferencesApp) QuotaRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	usage, err := u.preferencesSize(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	response := &quotaResponse{Usage: usage, Limit: u.quota}
+	if u.quota > 0 && usage < u.quota {
+		response.Remaining = u.quota - usage
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating quota JSON: %s", err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotaEnforcement(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+
+	n := New(mock)
+	n.quota = 30
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	status, _ := doRequest(t, http.MethodPost, url, []byte(`{"theme":"dark"}`), nil)
+	if status != http.StatusCreated {
+		t.Errorf("a write under the quota returned %d instead of %d", status, http.StatusCreated)
+	}
+
+	status, body := doRequest(t, http.MethodPost, url, []byte(`{"theme":"dark","layout":"a very long layout name"}`), nil)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a write over the quota returned %d instead of %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if !strings.Contains(string(body), "exceeds the quota of 30 bytes") {
+		t.Errorf("a write over the quota returned '%s'", body)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url+"/flags/a-long-flag-name/toggle", nil, nil)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a toggle over the quota returned %d instead of %d", status, http.StatusRequestEntityTooLarge)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url+"/quota", nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("GET quota returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed quotaResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := quotaResponse{Usage: 16, Limit: 30, Remaining: 14}
+	if parsed != expected {
+		t.Errorf("GET quota returned %#v instead of %#v", parsed, expected)
+	}
+}
+
+func TestQuotaAllowsShrinking(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"theme":"dark","layout":"a very long layout name"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	n.quota = 30
+
+	if err := n.checkQuota(username, 40); err != nil {
+		t.Errorf("shrinking a document over the quota returned an error: %s", err)
+	}
+
+	err := n.checkQuota(username, 100)
+	if _, ok := err.(*QuotaExceededError); !ok {
+		t.Errorf("growing a document over the quota returned %v", err)
+	}
+
+	n.quota = 0
+	if err = n.checkQuota(username, 100); err != nil {
+		t.Errorf("a disabled quota returned an error: %s", err)
+	}
+}
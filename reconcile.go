@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The strategies supported for reconciling a client's copy of the preferences
+// with the copy stored on the server.
+const (
+	serverWins = "server-wins"
+	clientWins = "client-wins"
+	newestWins = "newest-wins"
+)
+
+// mergeRequest is the JSON body accepted by the merge endpoint. Timestamps
+// contains the time each top-level key was last modified on the client and is
+// only used by the newest-wins strategy.
+type mergeRequest struct {
+	Preferences map[string]interface{} `json:"preferences"`
+	Strategy    string                 `json:"strategy"`
+	Timestamps  map[string]time.Time   `json:"timestamps"`
+}
+
+// reconcilePreferences combines the client's and server's copies of the
+// preferences using the named strategy. The server doesn't track modification
+// times for individual keys, so newest-wins compares the client's timestamp
+// for each top-level key against the time the server's copy was last modified.
+// Client keys without a timestamp are treated as older than the server's copy.
+func reconcilePreferences(server, client map[string]interface{}, strategy string, modifiedAt time.Time, timestamps map[string]time.Time) (map[string]interface{}, error) {
+	server = deepCopy(server).(map[string]interface{})
+	client = deepCopy(client).(map[string]interface{})
+
+	switch strategy {
+	case "", serverWins:
+		return mergePreferences(client, server), nil
+
+	case clientWins:
+		return mergePreferences(server, client), nil
+
+	case newestWins:
+		for key, value := range client {
+			_, onServer := server[key]
+			clientTime, ok := timestamps[key]
+			if !onServer || (ok && clientTime.After(modifiedAt)) {
+				server[key] = value
+			}
+		}
+		return server, nil
+	}
+
+	return nil, fmt.Errorf("Unknown merge strategy: %s", strategy)
+}
+
+// MergeRequest handles reconciling a client's copy of a user's preferences
+// with the stored copy and storing the result.
+func (u *UserPreferencesApp) MergeRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var body mergeRequest
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	log.Infof("Merging client preferences for %s using %s", username, body.Strategy)
+	server, record, err := u.preferencesResponse(username, false)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+	if server == nil {
+		server = make(map[string]interface{})
+	}
+
+	merged, err := reconcilePreferences(server, body.Preferences, body.Strategy, record.ModifiedAt, body.Timestamps)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	merged, ok = u.applyLocks(writer, r, username, merged)
+	if !ok {
+		return
+	}
+
+	merged, ok = u.scanWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	merged, ok = u.filterWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	warnings, ok := u.validateWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	created, err := u.storePreferences(username, merged)
+	if err != nil {
+		storeFailed(writer, err)
+		return
+	}
+
+	u.writeStoredPreferences(writer, r, username, created, warnings)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconcilePreferences(t *testing.T) {
+	modifiedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := map[string]interface{}{
+		"theme":  "light",
+		"layout": "list",
+		"nested": map[string]interface{}{"a": "server"},
+	}
+	client := map[string]interface{}{
+		"theme":  "dark",
+		"layout": "grid",
+		"nested": map[string]interface{}{"a": "client", "b": "client"},
+		"extra":  true,
+	}
+	timestamps := map[string]time.Time{
+		"theme":  modifiedAt.Add(time.Hour),
+		"layout": modifiedAt.Add(-time.Hour),
+	}
+
+	tests := []struct {
+		strategy string
+		expected map[string]interface{}
+	}{
+		{
+			serverWins,
+			map[string]interface{}{
+				"theme":  "light",
+				"layout": "list",
+				"nested": map[string]interface{}{"a": "server", "b": "client"},
+				"extra":  true,
+			},
+		},
+		{
+			clientWins,
+			map[string]interface{}{
+				"theme":  "dark",
+				"layout": "grid",
+				"nested": map[string]interface{}{"a": "client", "b": "client"},
+				"extra":  true,
+			},
+		},
+		{
+			newestWins,
+			map[string]interface{}{
+				"theme":  "dark",
+				"layout": "list",
+				"nested": map[string]interface{}{"a": "server"},
+				"extra":  true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := reconcilePreferences(server, client, test.strategy, modifiedAt, timestamps)
+		if err != nil {
+			t.Errorf("%s returned an error: %s", test.strategy, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s returned %#v instead of %#v", test.strategy, actual, test.expected)
+		}
+	}
+
+	if server["theme"] != "light" || client["theme"] != "dark" {
+		t.Error("the inputs were modified")
+	}
+
+	if _, err := reconcilePreferences(server, client, "oldest-wins", modifiedAt, timestamps); err == nil {
+		t.Error("an unknown strategy did not return an error")
+	}
+}
+
+func TestMergeRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"theme":"light"}`); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s/merge", server.URL, username)
+
+	status, body := doRequest(t, http.MethodPost, url, []byte(`{"strategy":"client-wins","preferences":{"theme":"dark","layout":"grid"}}`), nil)
+	if status != http.StatusOK {
+		t.Errorf("merging returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"theme": "dark", "layout": "grid"}
+	if !reflect.DeepEqual(parsed["preferences"], expected) {
+		t.Errorf("preferences were %#v instead of %#v", parsed["preferences"], expected)
+	}
+
+	stored, err := n.loadPreferences(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("stored preferences were %#v instead of %#v", stored, expected)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, url, []byte(`{"strategy":"bogus","preferences":{}}`), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("an unknown strategy returned %d instead of %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// registryMetrics counts the writes containing keys that aren't in the
+// registry. It's published at /debug/vars.
+var registryMetrics = expvar.NewMap("registry")
+
+// registeredTypes are the types a registered key may be documented as having.
+// An empty type means any type.
+var registeredTypes = map[string]bool{
+	"":        true,
+	"string":  true,
+	"number":  true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+}
+
+// RegisteredKey documents a preference key. Registering a key also documents
+// the keys nested within it.
+type RegisteredKey struct {
+	Key         string    `json:"key"`
+	Description string    `json:"description"`
+	Type        string    `json:"type,omitempty"`
+	Owner       string    `json:"owner"`
+	Deprecated  bool      `json:"deprecated"`
+	Replacement string    `json:"replacement,omitempty"`
+	ModifiedAt  time.Time `json:"modified_at"`
+}
+
+// validate checks that the registration names a key and a known type.
+func (k *RegisteredKey) validate() error {
+	for _, part := range splitPath(k.Key) {
+		if part == "" {
+			return fmt.Errorf("The key %q has an empty path segment", k.Key)
+		}
+	}
+	if k.Owner == "" {
+		return fmt.Errorf("The key %s must have an owner", k.Key)
+	}
+	if !registeredTypes[k.Type] {
+		return fmt.Errorf("The key %s has an unknown type %q", k.Key, k.Type)
+	}
+	if k.Replacement != "" && !k.Deprecated {
+		return fmt.Errorf("Only deprecated keys can have a replacement")
+	}
+	return nil
+}
+
+// listRegisteredKeys returns the registered keys, sorted by key.
+func (p *PrefsDB) listRegisteredKeys() ([]RegisteredKey, error) {
+	query := `SELECT key, description, type, owner, deprecated, replacement, modified_at
+                FROM user_preferences_registry
+            ORDER BY key`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []RegisteredKey{}
+	for rows.Next() {
+		var k RegisteredKey
+		if err = rows.Scan(&k.Key, &k.Description, &k.Type, &k.Owner, &k.Deprecated, &k.Replacement, &k.ModifiedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// saveRegisteredKey registers the key or replaces its registration, and sets
+// its modification time.
+func (p *PrefsDB) saveRegisteredKey(k *RegisteredKey) error {
+	query := `INSERT INTO user_preferences_registry (key, description, type, owner, deprecated, replacement)
+                   VALUES ($1, $2, $3, $4, $5, $6)
+              ON CONFLICT (key) DO UPDATE
+                      SET description = EXCLUDED.description,
+                          type = EXCLUDED.type,
+                          owner = EXCLUDED.owner,
+                          deprecated = EXCLUDED.deprecated,
+                          replacement = EXCLUDED.replacement,
+                          modified_at = now()
+                RETURNING modified_at`
+	return p.db.QueryRow(query, k.Key, k.Description, k.Type, k.Owner, k.Deprecated, k.Replacement).Scan(&k.ModifiedAt)
+}
+
+// deleteRegisteredKey removes the key from the registry, and returns whether it
+// was registered.
+func (p *PrefsDB) deleteRegisteredKey(key string) (bool, error) {
+	result, err := p.db.Exec(`DELETE FROM user_preferences_registry WHERE key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// KeyRegistry looks up the registrations that cover the keys in documents.
+type KeyRegistry struct {
+	keys map[string]RegisteredKey
+
+	// prefixes contains the paths of the objects that registered keys are
+	// nested within.
+	prefixes map[string]bool
+}
+
+// NewKeyRegistry returns a newly created *KeyRegistry for the registered keys.
+func NewKeyRegistry(keys []RegisteredKey) *KeyRegistry {
+	r := &KeyRegistry{
+		keys:     make(map[string]RegisteredKey, len(keys)),
+		prefixes: make(map[string]bool),
+	}
+	for _, k := range keys {
+		r.keys[k.Key] = k
+		parts := splitPath(k.Key)
+		for i := 1; i < len(parts); i++ {
+			r.prefixes[strings.Join(parts[:i], ".")] = true
+		}
+	}
+	return r
+}
+
+// unregistered returns the dotted paths of the keys in the document that
+// aren't covered by a registration, sorted. An object that isn't registered
+// and doesn't contain any registered keys is reported once, rather than for
+// each of the keys within it.
+func (r *KeyRegistry) unregistered(doc map[string]interface{}) []string {
+	var paths []string
+	r.walk(doc, "", func(path string, _ interface{}) bool {
+		if _, ok := r.keys[path]; ok {
+			return false
+		}
+		if r.prefixes[path] {
+			return true
+		}
+		paths = append(paths, path)
+		return false
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+// walk calls visit with the dotted path and value of each key in the document,
+// descending into the objects it returns true for.
+func (r *KeyRegistry) walk(doc map[string]interface{}, prefix string, visit func(path string, value interface{}) bool) {
+	for key, value := range doc {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if visit(path, value) {
+			if nested, ok := value.(map[string]interface{}); ok {
+				r.walk(nested, path, visit)
+			}
+		}
+	}
+}
+
+// deprecated returns the registrations of the deprecated keys in the
+// document, sorted by key.
+func (r *KeyRegistry) deprecated(doc map[string]interface{}) []RegisteredKey {
+	var found []RegisteredKey
+	r.walk(doc, "", func(path string, _ interface{}) bool {
+		if k, ok := r.keys[path]; ok && k.Deprecated {
+			found = append(found, k)
+		}
+		return true
+	})
+	sort.Slice(found, func(i, j int) bool { return found[i].Key < found[j].Key })
+	return found
+}
+
+// registryWarnings returns warnings for the keys in the incoming document that
+// aren't in the registry or are deprecated, for whichever of the checks have
+// been enabled. Unregistered keys are also logged and counted. The write isn't
+// affected, even if the registry can't be read.
+func (u *UserPreferencesApp) registryWarnings(username string, incoming map[string]interface{}) []WriteWarning {
+	if !u.warnUnregisteredKeys && !u.warnDeprecatedKeys {
+		return nil
+	}
+
+	keys, err := u.prefs.listRegisteredKeys()
+	if err != nil {
+		log.Warnf("Unable to check the keys written for user %s against the registry: %s", username, err)
+		return nil
+	}
+	registry := NewKeyRegistry(keys)
+
+	var warnings []WriteWarning
+	if u.warnUnregisteredKeys {
+		paths := registry.unregistered(incoming)
+		if len(paths) > 0 {
+			registryMetrics.Add("unregistered_writes", 1)
+			registryMetrics.Add("unregistered_keys", int64(len(paths)))
+			log.WithFields(Fields{"user": username, "keys": strings.Join(paths, ",")}).
+				Warnf("Wrote %d keys that aren't in the registry", len(paths))
+		}
+		for _, path := range paths {
+			warnings = append(warnings, WriteWarning{Kind: warningUnregistered, Key: path, Message: "The key isn't in the registry"})
+		}
+	}
+
+	if u.warnDeprecatedKeys {
+		for _, k := range registry.deprecated(incoming) {
+			msg := "The key is deprecated"
+			if k.Replacement != "" {
+				msg = fmt.Sprintf("The key is deprecated; use %s instead", k.Replacement)
+			}
+			warnings = append(warnings, WriteWarning{Kind: warningDeprecated, Key: k.Key, Message: msg})
+		}
+	}
+	return warnings
+}
+
+// RegistryRequest handles listing the registered keys.
+func (u *UserPreferencesApp) RegistryRequest(writer http.ResponseWriter, r *http.Request) {
+	keys, err := u.prefs.listRegisteredKeys()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing the registered keys: %s", err))
+		return
+	}
+
+	jsoned, err := json.Marshal(map[string][]RegisteredKey{"keys": keys})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating registry JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// RegisterKeyRequest handles registering a key or replacing its registration.
+func (u *UserPreferencesApp) RegisterKeyRequest(writer http.ResponseWriter, r *http.Request) {
+	var k RegisteredKey
+	if err := decodeBody(r.Body, &k); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+	k.Key = mux.Vars(r)["key"]
+	if err := k.validate(); err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	log.Infof("Registering the key %s for %s", k.Key, k.Owner)
+	if err := u.prefs.saveRegisteredKey(&k); err != nil {
+		errored(writer, fmt.Sprintf("Error registering the key %s: %s", k.Key, err))
+		return
+	}
+
+	details := map[string]string{"key": k.Key, "owner": k.Owner, "deprecated": fmt.Sprint(k.Deprecated)}
+	if err := u.audit("register-key", details); err != nil {
+		log.Error(err)
+	}
+
+	jsoned, err := json.Marshal(&k)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for the key %s: %s", k.Key, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// UnregisterKeyRequest handles removing a key from the registry.
+func (u *UserPreferencesApp) UnregisterKeyRequest(writer http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	log.Infof("Unregistering the key %s", key)
+	deleted, err := u.prefs.deleteRegisteredKey(key)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error unregistering the key %s: %s", key, err))
+		return
+	}
+	if !deleted {
+		notFound(writer, fmt.Sprintf("The key %s isn't registered", key))
+		return
+	}
+
+	if err = u.audit("unregister-key", map[string]string{"key": key}); err != nil {
+		log.Error(err)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegisteredKeyValidate(t *testing.T) {
+	tests := []struct {
+		key   RegisteredKey
+		valid bool
+	}{
+		{RegisteredKey{Key: "theme", Owner: "ui", Type: "string"}, true},
+		{RegisteredKey{Key: "tools.r", Owner: "apps"}, true},
+		{RegisteredKey{Key: "old", Owner: "ui", Deprecated: true, Replacement: "new"}, true},
+		{RegisteredKey{Key: "tools..r", Owner: "apps"}, false},
+		{RegisteredKey{Key: "theme", Type: "string"}, false},
+		{RegisteredKey{Key: "theme", Owner: "ui", Type: "color"}, false},
+		{RegisteredKey{Key: "old", Owner: "ui", Replacement: "new"}, false},
+	}
+	for _, test := range tests {
+		if err := test.key.validate(); (err == nil) != test.valid {
+			t.Errorf("validate() of %+v returned %v", test.key, err)
+		}
+	}
+}
+
+func TestUnregisteredKeys(t *testing.T) {
+	registry := NewKeyRegistry([]RegisteredKey{
+		{Key: "theme"},
+		{Key: "tools.r"},
+		{Key: "notifications"},
+	})
+
+	doc := map[string]interface{}{
+		"theme":         "dark",
+		"notifications": map[string]interface{}{"email": true},
+		"tools":         map[string]interface{}{"r": true, "python": true},
+		"mystery":       map[string]interface{}{"a": 1, "b": 2},
+	}
+	expected := []string{"mystery", "tools.python"}
+	if paths := registry.unregistered(doc); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("the unregistered keys were %v instead of %v", paths, expected)
+	}
+}
+
+func TestRegistryRequests(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"description":"The UI theme","type":"string","owner":"ui-team"}`)
+	status, _ := doRequest(t, http.MethodPut, server.URL+"/admin/registry/theme", body, nil)
+	if status != http.StatusForbidden && status != http.StatusUnauthorized {
+		t.Errorf("registering without the admin key returned %d", status)
+	}
+
+	status, resp := doRequest(t, http.MethodPut, server.URL+"/admin/registry/theme", body, admin)
+	if status != http.StatusOK {
+		t.Fatalf("registering theme returned %d: %s", status, resp)
+	}
+	status, _ = doRequest(t, http.MethodPut, server.URL+"/admin/registry/layout", []byte(`{"type":"color","owner":"ui-team"}`), admin)
+	if status != http.StatusBadRequest {
+		t.Errorf("registering a key with an unknown type returned %d", status)
+	}
+
+	status, resp = doRequest(t, http.MethodGet, server.URL+"/registry", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing the registry returned %d", status)
+	}
+	var listed struct {
+		Keys []RegisteredKey `json:"keys"`
+	}
+	if err := json.Unmarshal(resp, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Keys) != 1 || listed.Keys[0].Key != "theme" || listed.Keys[0].Owner != "ui-team" {
+		t.Errorf("the registry was %+v", listed.Keys)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, server.URL+"/admin/registry/theme", nil, admin); status != http.StatusNoContent {
+		t.Errorf("unregistering theme returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodDelete, server.URL+"/admin/registry/theme", nil, admin); status != http.StatusNotFound {
+		t.Errorf("unregistering theme again returned %d", status)
+	}
+}
+
+func TestWarnUnregistered(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log
+	log = NewLogger(&buf, serviceName, InfoLevel)
+	defer func() { log = saved }()
+
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	mock.registry["theme"] = RegisteredKey{Key: "theme", Owner: "ui-team"}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"theme":"dark","mystery":1}`), nil); status != http.StatusCreated {
+		t.Fatalf("the write returned %d", status)
+	}
+	if strings.Contains(buf.String(), "mystery") {
+		t.Errorf("an unregistered key was logged while the warnings were off: %s", buf.String())
+	}
+
+	n.warnUnregisteredKeys = true
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"theme":"dark","mystery":1}`), nil); status != http.StatusOK {
+		t.Fatalf("the write returned %d", status)
+	}
+	if !strings.Contains(buf.String(), "mystery") || strings.Contains(buf.String(), `"keys":"theme`) {
+		t.Errorf("the unregistered key wasn't logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultReplayLimit is the number of events returned by the event replay
+// endpoint when the request doesn't include a limit.
+const defaultReplayLimit = 100
+
+// eventCursor marks a position in the replayed change events. Events are
+// replayed in the order of the transactions that recorded them, then by ID.
+type eventCursor struct {
+	Transaction int64
+	ID          int64
+}
+
+// encode returns the cursor as an opaque string.
+func (c eventCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Transaction, c.ID)))
+}
+
+// decodeEventCursor returns the position encoded in the cursor.
+func decodeEventCursor(cursor string) (eventCursor, error) {
+	var c eventCursor
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	parts := strings.Split(string(decoded), ".")
+	if len(parts) != 2 {
+		return c, fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	if c.Transaction, err = strconv.ParseInt(parts[0], 10, 64); err != nil || c.Transaction < 1 {
+		return c, fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	if c.ID, err = strconv.ParseInt(parts[1], 10, 64); err != nil || c.ID < 1 {
+		return c, fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	return c, nil
+}
+
+// EventFilter selects the change events to replay: those after the cursor,
+// optionally only for a single user.
+type EventFilter struct {
+	After eventCursor
+	User  string
+	Limit int
+}
+
+// replayEvents returns the change events after the filter's cursor, oldest
+// first, whether or not they've been published. Events are only returned once
+// every transaction that started before theirs has finished, so a page never
+// skips an event that commits later with an earlier position. CockroachDB
+// doesn't have transaction IDs, so there the events are returned as soon as
+// they're visible.
+func (p *PrefsDB) replayEvents(filter EventFilter) ([]OutboxEvent, error) {
+	args := []interface{}{filter.After.Transaction, filter.After.ID}
+	conditions := []string{"(transaction_id, id) > ($1, $2)"}
+	if !cockroachMode {
+		conditions = append(conditions, "transaction_id < txid_snapshot_xmin(txid_current_snapshot())")
+	}
+	if filter.User != "" {
+		args = append(args, filter.User)
+		conditions = append(conditions, fmt.Sprintf("username = $%d", len(args)))
+	}
+
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT id, username, operation, version, created_at, transaction_id, diff
+              FROM user_preferences_outbox
+             WHERE %s
+          ORDER BY transaction_id, id
+             LIMIT $%d`, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var (
+			event  OutboxEvent
+			stored []byte
+		)
+		if err = rows.Scan(&event.ID, &event.Username, &event.Operation, &event.Version, &event.CreatedAt, &event.TransactionID, &stored); err != nil {
+			return nil, err
+		}
+		setEventDiff(&event, stored)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// eventsResponse is the JSON body returned by the event replay endpoint.
+// NextCursor is set whenever there's a position to resume from, including once
+// a consumer has caught up, so that it can keep polling from there; More says
+// whether there are further events right away.
+type eventsResponse struct {
+	Events     []OutboxEvent `json:"events"`
+	Limit      int           `json:"limit"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	More       bool          `json:"more"`
+}
+
+// EventsRequest handles replaying the recorded change events, oldest first, a
+// page at a time, starting after the cursor in the since parameter. Without a
+// cursor it starts at the oldest event still kept.
+func (u *UserPreferencesApp) EventsRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		params = r.URL.Query()
+		filter = EventFilter{User: params.Get("user"), Limit: defaultReplayLimit}
+		err    error
+	)
+	if filter.Limit > u.maxPageSize {
+		filter.Limit = u.maxPageSize
+	}
+
+	if value := params.Get("since"); value != "" {
+		if filter.After, err = decodeEventCursor(value); err != nil {
+			badRequest(writer, err.Error())
+			return
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > u.maxPageSize {
+			badRequest(writer, fmt.Sprintf("Invalid limit %s; use a number from 1 to %d", value, u.maxPageSize))
+			return
+		}
+	}
+
+	limit := filter.Limit
+	filter.Limit++
+	events, err := u.prefs.replayEvents(filter)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error replaying change events: %s", err))
+		return
+	}
+
+	response := eventsResponse{Events: events, Limit: limit}
+	if len(events) > limit {
+		response.Events, response.More = events[:limit], true
+	}
+	next := filter.After
+	if count := len(response.Events); count > 0 {
+		last := response.Events[count-1]
+		next = eventCursor{Transaction: last.TransactionID, ID: last.ID}
+	}
+	if next.ID > 0 {
+		response.NextCursor = next.encode()
+	}
+
+	jsoned, err := json.Marshal(&response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the change events JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
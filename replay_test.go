@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEventCursor(t *testing.T) {
+	cursor := eventCursor{Transaction: 900, ID: 12}
+	if decoded, err := decodeEventCursor(cursor.encode()); err != nil || decoded != cursor {
+		t.Errorf("a cursor decoded to %+v, %v", decoded, err)
+	}
+	for _, value := range []string{"!!", encodeCursor(12), eventCursor{Transaction: 0, ID: 1}.encode()} {
+		if _, err := decodeEventCursor(value); err == nil {
+			t.Errorf("the cursor %s was accepted", value)
+		}
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	query := "SELECT id, username, operation, version, created_at, transaction_id, diff " +
+		"FROM user_preferences_outbox " +
+		"WHERE (transaction_id, id) > ($1, $2) AND transaction_id < txid_snapshot_xmin(txid_current_snapshot()) " +
+		"AND username = $3 ORDER BY transaction_id, id LIMIT $4"
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(900, 12, "alice", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "operation", "version", "created_at", "transaction_id", "diff"}).
+			AddRow(11, "alice", "update", 4, now, 901, `{"added":[],"removed":[],"changed":[{"path":"a","before":1,"after":2}]}`).
+			AddRow(14, "alice", "delete", 4, now, 903, `{"added":[],"removed":["a"],"changed":[]}`))
+
+	events, err := NewPrefsDB(db).replayEvents(EventFilter{
+		After: eventCursor{Transaction: 900, ID: 12},
+		User:  "alice",
+		Limit: 5,
+	})
+	if err != nil {
+		t.Fatalf("error from replayEvents(): %s", err)
+	}
+	if len(events) != 2 || events[0].ID != 11 || events[0].TransactionID != 901 || events[1].Operation != "delete" {
+		t.Errorf("the events were %+v", events)
+	}
+	if len(events) == 2 && (len(events[0].Diff.Changed) != 1 || len(events[1].Diff.Removed) != 1) {
+		t.Errorf("the diffs were %+v and %+v", events[0].Diff, events[1].Diff)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestEventsRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.insertPreferences("alice", `{"a":1}`)
+	mock.insertPreferences("bob", `{"b":1}`)
+	mock.insertPreferences("alice", `{"a":2}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	replay := func(query string) eventsResponse {
+		t.Helper()
+		status, body := doRequest(t, http.MethodGet, server.URL+"/admin/events"+query, nil, admin)
+		if status != http.StatusOK {
+			t.Fatalf("replaying %s returned %d: %s", query, status, body)
+		}
+		var response eventsResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	operations := func(events []OutboxEvent) string {
+		var ops []string
+		for _, event := range events {
+			ops = append(ops, event.Username+" "+event.Operation)
+		}
+		return strings.Join(ops, ",")
+	}
+
+	page := replay("?limit=2")
+	if operations(page.Events) != "alice insert,bob insert" || !page.More || page.NextCursor == "" {
+		t.Fatalf("the first page was %+v", page)
+	}
+
+	page = replay("?limit=2&since=" + page.NextCursor)
+	if operations(page.Events) != "alice update" || page.More {
+		t.Fatalf("the second page was %+v", page)
+	}
+
+	caughtUp := replay("?since=" + page.NextCursor)
+	if len(caughtUp.Events) != 0 || caughtUp.NextCursor != page.NextCursor {
+		t.Errorf("replaying after the last event returned %+v", caughtUp)
+	}
+
+	mock.deletePreferences("alice")
+	if page = replay("?user=alice&since=" + caughtUp.NextCursor); operations(page.Events) != "alice delete" {
+		t.Errorf("replaying alice's new events returned %+v", page)
+	}
+	if page = replay("?user=bob"); operations(page.Events) != "bob insert" {
+		t.Errorf("replaying bob's events returned %+v", page)
+	}
+
+	for _, query := range []string{"?since=bogus", "?limit=0", "?limit=1000"} {
+		if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/events"+query, nil, admin); status != http.StatusBadRequest {
+			t.Errorf("replaying %s returned %d", query, status)
+		}
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/events", nil, nil); status != http.StatusForbidden {
+		t.Errorf("replaying without the admin key returned %d", status)
+	}
+}
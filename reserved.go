@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ReservedKeys is the namespace of top-level preference keys that hold
+// metadata managed by the service, such as experiment assignments. Users can't
+// create, change, or remove the keys that start with the prefix; only
+// administrative callers and the service itself can.
+type ReservedKeys struct {
+	prefix string
+}
+
+// NewReservedKeys returns a newly created *ReservedKeys. No keys are reserved
+// if the prefix is empty.
+func NewReservedKeys(prefix string) *ReservedKeys {
+	return &ReservedKeys{prefix: prefix}
+}
+
+// enabled returns whether any keys are reserved.
+func (k *ReservedKeys) enabled() bool {
+	return k != nil && k.prefix != ""
+}
+
+// isReserved returns whether the top-level key is in the reserved namespace.
+func (k *ReservedKeys) isReserved(key string) bool {
+	return k.enabled() && strings.HasPrefix(key, k.prefix)
+}
+
+// violations returns the reserved keys that the incoming document would create
+// or change, sorted. Reserved keys that the incoming document leaves out
+// aren't violations, since they're carried over by preserve.
+func (k *ReservedKeys) violations(stored, incoming map[string]interface{}) []string {
+	var touched []string
+	for key, incomingValue := range incoming {
+		if !k.isReserved(key) {
+			continue
+		}
+		if storedValue, ok := stored[key]; !ok || !reflect.DeepEqual(storedValue, incomingValue) {
+			touched = append(touched, key)
+		}
+	}
+	sort.Strings(touched)
+	return touched
+}
+
+// preserve returns a copy of the incoming document with the stored reserved
+// keys carried over, so that writes that replace or delete the whole document
+// don't remove them.
+func (k *ReservedKeys) preserve(stored, incoming map[string]interface{}) map[string]interface{} {
+	result := deepCopy(incoming).(map[string]interface{})
+	for key, value := range stored {
+		if k.isReserved(key) {
+			result[key] = deepCopy(value)
+		}
+	}
+	return result
+}
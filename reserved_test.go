@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestReservedViolations(t *testing.T) {
+	keys := NewReservedKeys("_system")
+	stored := map[string]interface{}{
+		"_system": map[string]interface{}{"experiments": map[string]interface{}{"new-editor": "control"}},
+		"theme":   "dark",
+	}
+
+	incoming := map[string]interface{}{"theme": "light"}
+	if violations := keys.violations(stored, incoming); len(violations) != 0 {
+		t.Errorf("a write leaving out the reserved keys had violations %v", violations)
+	}
+	expected := map[string]interface{}{"_system": stored["_system"], "theme": "light"}
+	if preserved := keys.preserve(stored, incoming); !reflect.DeepEqual(preserved, expected) {
+		t.Errorf("the preserved document was %v", preserved)
+	}
+
+	incoming = map[string]interface{}{
+		"_system":       map[string]interface{}{},
+		"_system_extra": true,
+		"system":        true,
+	}
+	if violations := keys.violations(stored, incoming); !reflect.DeepEqual(violations, []string{"_system", "_system_extra"}) {
+		t.Errorf("the violations were %v", violations)
+	}
+
+	if NewReservedKeys("").isReserved("_system") {
+		t.Error("a key was reserved without a prefix")
+	}
+}
+
+func TestReservedWrites(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"_system":{"experiments":{"new-editor":"control"}},"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	n.adminKey = "secret"
+	n.reserved = NewReservedKeys("_system")
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	tests := map[string]string{
+		http.MethodPut:  `{"_system":{"experiments":{"new-editor":"treatment"}}}`,
+		http.MethodPost: `{"_system":{"experiments":{"new-editor":"treatment"}}}`,
+	}
+	for method, body := range tests {
+		if status, _ := doRequest(t, method, url, []byte(body), nil); status != http.StatusForbidden {
+			t.Errorf("%s modifying a reserved key returned %d", method, status)
+		}
+	}
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"_systemic":true}`), nil); status != http.StatusForbidden {
+		t.Errorf("PUT creating a reserved key returned %d", status)
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"theme":"light"}`), nil); status != http.StatusOK {
+		t.Errorf("PUT leaving out the reserved keys returned %d", status)
+	}
+	if status, body := doRequest(t, http.MethodGet, url, nil, nil); string(body) != `{"_system":{"experiments":{"new-editor":"control"}},"theme":"light"}` {
+		t.Errorf("the preferences were %d %s after the PUT", status, body)
+	}
+
+	if status, _ := doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusOK {
+		t.Errorf("DELETE returned %d", status)
+	}
+	if _, body := doRequest(t, http.MethodGet, url, nil, nil); string(body) != `{"_system":{"experiments":{"new-editor":"control"}}}` {
+		t.Errorf("the preferences were %s after the DELETE", body)
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"_system":{}}`), admin); status != http.StatusOK {
+		t.Errorf("an admin PUT modifying a reserved key returned %d", status)
+	}
+}
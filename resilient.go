@@ -0,0 +1,899 @@
+package main
+
+import "time"
+
+// ResilientDB wraps a DB, retrying calls that fail with transient errors and
+// failing fast while the circuit breaker is open. Concurrent reads of the same
+// user's preferences share a single database query, which reads that start
+// after a change to the preferences don't join. Calls that take longer than
+// the slow query threshold are logged and counted.
+type ResilientDB struct {
+	db        DB
+	breaker   *CircuitBreaker
+	retries   int
+	backoff   time.Duration
+	sleep     func(time.Duration)
+	reads     flightGroup
+	slowQuery time.Duration
+}
+
+// NewResilientDB returns a newly created *ResilientDB. Failed calls are retried
+// up to retries times, waiting backoff before the first retry and doubling the
+// wait before each one after that.
+func NewResilientDB(db DB, breaker *CircuitBreaker, retries int, backoff time.Duration) *ResilientDB {
+	return &ResilientDB{
+		db:      db,
+		breaker: breaker,
+		retries: retries,
+		backoff: backoff,
+		sleep:   time.Sleep,
+	}
+}
+
+// do makes the call, retrying it if it fails with a transient error, and
+// records the outcome with the circuit breaker. It's only used for reads; see
+// change.
+func (r *ResilientDB) do(call func() error) error {
+	return r.doFor("", call)
+}
+
+// doFor is do for calls made on behalf of a user, who's named if the call is
+// slow.
+func (r *ResilientDB) doFor(username string, call func() error) error {
+	return r.try(username, isTransient, call)
+}
+
+// change is do for calls that write to the database, which are only retried if
+// they certainly weren't applied; see isRetryableWrite.
+func (r *ResilientDB) change(call func() error) error {
+	return r.changeFor("", call)
+}
+
+// changeFor is change for calls made on behalf of a user.
+func (r *ResilientDB) changeFor(username string, call func() error) error {
+	return r.try(username, isRetryableWrite, call)
+}
+
+// try makes the call, retrying it while it fails with errors that retryable
+// accepts, and records the outcome with the circuit breaker.
+func (r *ResilientDB) try(username string, retryable func(error) bool, call func() error) error {
+	if err := r.breaker.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		err = call()
+		if elapsed := time.Since(started); r.slowQuery > 0 && elapsed >= r.slowQuery {
+			r.recordSlowQuery(username, elapsed, err)
+		}
+		if err == nil || !retryable(err) || attempt >= r.retries {
+			break
+		}
+		databaseMetrics.Add(r.breaker.name+".retries", 1)
+		r.sleep(r.backoff << uint(attempt))
+	}
+
+	r.breaker.record(err)
+	return err
+}
+
+// writeFor is changeFor for calls that change the user's preferences. Reads that
+// start afterwards make their own query instead of sharing one that may have
+// started before the change. That's done even if the call fails, since it may
+// have failed after the change was committed.
+func (r *ResilientDB) writeFor(username string, call func() error) error {
+	defer r.reads.forget(username)
+	return r.changeFor(username, call)
+}
+
+// write is writeFor for calls that may change any user's preferences.
+func (r *ResilientDB) write(call func() error) error {
+	defer r.reads.forgetAll()
+	return r.change(call)
+}
+
+// The remaining methods implement the DB interface by passing each call through
+// to the wrapped DB.
+
+func (r *ResilientDB) isUser(username string) (bool, error) {
+	var retval bool
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.isUser(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) hasPreferences(username string) (bool, error) {
+	var retval bool
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.hasPreferences(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+	result, err, shared := r.reads.do(username, func() (interface{}, error) {
+		var retval []UserPreferencesRecord
+		err := r.doFor(username, func() error {
+			var err error
+			retval, err = r.db.getPreferences(username)
+			return err
+		})
+		return retval, err
+	})
+	if shared {
+		databaseMetrics.Add(r.breaker.name+".shared_reads", 1)
+	}
+
+	// Each caller gets its own copy of the records, since they're values that
+	// callers are free to modify.
+	records, _ := result.([]UserPreferencesRecord)
+	return append([]UserPreferencesRecord(nil), records...), err
+}
+
+func (r *ResilientDB) insertPreferences(username, prefs string) error {
+	return r.writeFor(username, func() error {
+		return r.db.insertPreferences(username, prefs)
+	})
+}
+
+func (r *ResilientDB) updatePreferences(username, prefs string) error {
+	return r.writeFor(username, func() error {
+		return r.db.updatePreferences(username, prefs)
+	})
+}
+
+func (r *ResilientDB) updatePreferencesIfVersion(username, prefs string, version int64) (bool, error) {
+	var retval bool
+	err := r.writeFor(username, func() error {
+		var err error
+		retval, err = r.db.updatePreferencesIfVersion(username, prefs, version)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) deletePreferences(username string) error {
+	return r.writeFor(username, func() error {
+		return r.db.deletePreferences(username)
+	})
+}
+
+func (r *ResilientDB) listPresets() ([]string, error) {
+	var retval []string
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listPresets()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getPreset(name string) (string, error) {
+	var retval string
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getPreset(name)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) savePreset(name, prefs string) error {
+	return r.change(func() error {
+		return r.db.savePreset(name, prefs)
+	})
+}
+
+func (r *ResilientDB) deletePreset(name string) error {
+	return r.change(func() error {
+		return r.db.deletePreset(name)
+	})
+}
+
+func (r *ResilientDB) getGroupPreferences(group string) (string, error) {
+	var retval string
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getGroupPreferences(group)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveGroupPreferences(group, prefs string) error {
+	return r.change(func() error {
+		return r.db.saveGroupPreferences(group, prefs)
+	})
+}
+
+func (r *ResilientDB) deleteGroupPreferences(group string) error {
+	return r.change(func() error {
+		return r.db.deleteGroupPreferences(group)
+	})
+}
+
+func (r *ResilientDB) getExpirations(username string) (map[string]time.Time, error) {
+	var retval map[string]time.Time
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getExpirations(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) setExpirations(username string, expirations map[string]time.Time) error {
+	return r.changeFor(username, func() error {
+		return r.db.setExpirations(username, expirations)
+	})
+}
+
+func (r *ResilientDB) deleteExpirations(username string, keys []string) error {
+	return r.changeFor(username, func() error {
+		return r.db.deleteExpirations(username, keys)
+	})
+}
+
+func (r *ResilientDB) deleteExpiredKeys(username string, keys []string, before time.Time) error {
+	return r.changeFor(username, func() error {
+		return r.db.deleteExpiredKeys(username, keys, before)
+	})
+}
+
+func (r *ResilientDB) listExpired(before time.Time) ([]ExpiredKey, error) {
+	var retval []ExpiredKey
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listExpired(before)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getIdempotentResponse(username, key string) (*IdempotentResponse, error) {
+	var retval *IdempotentResponse
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getIdempotentResponse(username, key)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) reserveIdempotencyKey(resp *IdempotentResponse, expiredBefore time.Time) (bool, error) {
+	var retval bool
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.reserveIdempotencyKey(resp, expiredBefore)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveIdempotentResponse(resp *IdempotentResponse) error {
+	return r.change(func() error {
+		return r.db.saveIdempotentResponse(resp)
+	})
+}
+
+func (r *ResilientDB) releaseIdempotencyKey(username, key string) error {
+	return r.change(func() error {
+		return r.db.releaseIdempotencyKey(username, key)
+	})
+}
+
+func (r *ResilientDB) purgeIdempotentResponses(before time.Time) (int64, error) {
+	var retval int64
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.purgeIdempotentResponses(before)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) createSession(token, prefs string, expiresAt time.Time) error {
+	return r.change(func() error {
+		return r.db.createSession(token, prefs, expiresAt)
+	})
+}
+
+func (r *ResilientDB) getSession(token string) (*SessionRecord, error) {
+	var retval *SessionRecord
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getSession(token)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) updateSession(token, prefs string, expiresAt time.Time) error {
+	return r.change(func() error {
+		return r.db.updateSession(token, prefs, expiresAt)
+	})
+}
+
+func (r *ResilientDB) deleteSession(token string) error {
+	return r.change(func() error {
+		return r.db.deleteSession(token)
+	})
+}
+
+func (r *ResilientDB) purgeSessions(before time.Time) (int64, error) {
+	var retval int64
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.purgeSessions(before)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listUsers(filter UserFilter) ([]UserSummary, error) {
+	var retval []UserSummary
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listUsers(filter)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) countKey(path string) (int64, error) {
+	var retval int64
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.countKey(path)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) countDocuments() (int64, error) {
+	var retval int64
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.countDocuments()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) countKeyValue(path string, value interface{}) (int64, error) {
+	var retval int64
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.countKeyValue(path, value)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) deleteKeyBatch(path string, limit int) (int64, error) {
+	var retval int64
+	err := r.write(func() error {
+		var err error
+		retval, err = r.db.deleteKeyBatch(path, limit)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) countRenameable(from, to string) (int64, error) {
+	var retval int64
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.countRenameable(from, to)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) renameKeyBatch(from, to string, limit int) (int64, error) {
+	var retval int64
+	err := r.write(func() error {
+		var err error
+		retval, err = r.db.renameKeyBatch(from, to, limit)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) recordAudit(action, details string) error {
+	return r.change(func() error {
+		return r.db.recordAudit(action, details)
+	})
+}
+
+func (r *ResilientDB) listHistory(username string, filter PageFilter) ([]HistoryRecord, error) {
+	var retval []HistoryRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listHistory(username, filter)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getHistoryVersion(username string, version int64) (*HistoryRecord, error) {
+	var retval *HistoryRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getHistoryVersion(username, version)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) purgeHistory(before time.Time) (int64, error) {
+	var retval int64
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.purgeHistory(before)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listUserAudits(username string) ([]AuditRecord, error) {
+	var retval []AuditRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listUserAudits(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) eraseUser(username string) (map[string]int64, error) {
+	var retval map[string]int64
+	err := r.writeFor(username, func() error {
+		var err error
+		retval, err = r.db.eraseUser(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) upsertPreferences(prefs map[string]string) (map[string]bool, error) {
+	var retval map[string]bool
+	err := r.write(func() error {
+		var err error
+		retval, err = r.db.upsertPreferences(prefs)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listSearches(username string) ([]SavedSearch, error) {
+	var retval []SavedSearch
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listSearches(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getSearch(username, id string) (*SavedSearch, error) {
+	var retval *SavedSearch
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getSearch(username, id)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) putSearch(username, id, search string) (bool, error) {
+	var retval bool
+	err := r.changeFor(username, func() error {
+		var err error
+		retval, err = r.db.putSearch(username, id, search)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) deleteSearch(username, id string) (bool, error) {
+	var retval bool
+	err := r.changeFor(username, func() error {
+		var err error
+		retval, err = r.db.deleteSearch(username, id)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) replaceSearches(username string, searches map[string]string) error {
+	return r.changeFor(username, func() error {
+		return r.db.replaceSearches(username, searches)
+	})
+}
+
+func (r *ResilientDB) getUISession(username string) (*UISessionRecord, error) {
+	var retval *UISessionRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getUISession(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveUISession(username, session string, expiresAt time.Time) error {
+	return r.changeFor(username, func() error {
+		return r.db.saveUISession(username, session, expiresAt)
+	})
+}
+
+func (r *ResilientDB) deleteUISession(username string) error {
+	return r.changeFor(username, func() error {
+		return r.db.deleteUISession(username)
+	})
+}
+
+func (r *ResilientDB) purgeUISessions(before time.Time) (int64, error) {
+	var retval int64
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.purgeUISessions(before)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listBags(username string) ([]BagRecord, error) {
+	var retval []BagRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listBags(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getBag(username, name string) (*BagRecord, error) {
+	var retval *BagRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getBag(username, name)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getDefaultBag(username string) (*BagRecord, error) {
+	var retval *BagRecord
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getDefaultBag(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) putBag(username, name, contents string) (bool, error) {
+	var retval bool
+	err := r.changeFor(username, func() error {
+		var err error
+		retval, err = r.db.putBag(username, name, contents)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) deleteBag(username, name string) (bool, error) {
+	var retval bool
+	err := r.changeFor(username, func() error {
+		var err error
+		retval, err = r.db.deleteBag(username, name)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) setDefaultBag(username, name string) (bool, error) {
+	var retval bool
+	err := r.changeFor(username, func() error {
+		var err error
+		retval, err = r.db.setDefaultBag(username, name)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listKeys(username string) ([]KeyInfo, error) {
+	var retval []KeyInfo
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listKeys(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listExperimentAssignments(username string) (map[string]string, error) {
+	var retval map[string]string
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.listExperimentAssignments(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) addExperimentAssignment(username, experiment, variant string) error {
+	return r.changeFor(username, func() error {
+		return r.db.addExperimentAssignment(username, experiment, variant)
+	})
+}
+
+func (r *ResilientDB) listAudits(filter AuditFilter) ([]AuditRecord, error) {
+	var retval []AuditRecord
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listAudits(filter)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) getUndoState(username string) (*UndoState, error) {
+	var retval *UndoState
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getUndoState(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveUndoState(username string, state UndoState) error {
+	return r.changeFor(username, func() error {
+		return r.db.saveUndoState(username, state)
+	})
+}
+
+func (r *ResilientDB) createScheduledChange(change *ScheduledChange) error {
+	return r.change(func() error {
+		return r.db.createScheduledChange(change)
+	})
+}
+
+func (r *ResilientDB) getScheduledChange(id int64) (*ScheduledChange, error) {
+	var retval *ScheduledChange
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getScheduledChange(id)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listScheduledChanges(filter ScheduleFilter) ([]ScheduledChange, error) {
+	var retval []ScheduledChange
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listScheduledChanges(filter)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) cancelScheduledChange(id int64) (bool, error) {
+	var retval bool
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.cancelScheduledChange(id)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) claimScheduledChange(id int64, at time.Time) (bool, error) {
+	var retval bool
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.claimScheduledChange(id, at)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) failScheduledChange(id int64, msg string) error {
+	return r.change(func() error {
+		return r.db.failScheduledChange(id, msg)
+	})
+}
+
+func (r *ResilientDB) getRollout(name string) (*Rollout, error) {
+	var retval *Rollout
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getRollout(name)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listRollouts() ([]Rollout, error) {
+	var retval []Rollout
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listRollouts()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveRollout(rollout *Rollout) error {
+	return r.change(func() error {
+		return r.db.saveRollout(rollout)
+	})
+}
+
+func (r *ResilientDB) getRolloutMembers(name string, usernames []string) (map[string]string, error) {
+	var retval map[string]string
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.getRolloutMembers(name, usernames)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) addRolloutMember(name, username, previous string) error {
+	return r.change(func() error {
+		return r.db.addRolloutMember(name, username, previous)
+	})
+}
+
+func (r *ResilientDB) removeRolloutMember(name, username string) error {
+	return r.change(func() error {
+		return r.db.removeRolloutMember(name, username)
+	})
+}
+
+func (r *ResilientDB) verifyChecksums() (*ChecksumReport, error) {
+	var retval *ChecksumReport
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.verifyChecksums()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) dispatchEvents(limit int, publish func(event *OutboxEvent) error) (int, error) {
+	var retval int
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.dispatchEvents(limit, publish)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) purgeEvents(before time.Time, all bool) (int64, error) {
+	var retval int64
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.purgeEvents(before, all)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) pendingEvents() (int64, *time.Time, error) {
+	var (
+		count  int64
+		oldest *time.Time
+	)
+	err := r.do(func() error {
+		var err error
+		count, oldest, err = r.db.pendingEvents()
+		return err
+	})
+	return count, oldest, err
+}
+
+func (r *ResilientDB) replayEvents(filter EventFilter) ([]OutboxEvent, error) {
+	var retval []OutboxEvent
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.replayEvents(filter)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) databaseReport() (*DatabaseReport, error) {
+	var retval *DatabaseReport
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.databaseReport()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) addUsage(usage []UserUsage) error {
+	return r.change(func() error {
+		return r.db.addUsage(usage)
+	})
+}
+
+func (r *ResilientDB) getUsage(username string) (*UserUsage, error) {
+	var retval *UserUsage
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.getUsage(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) archivePreferences(before time.Time, limit int) (int64, error) {
+	var retval int64
+	err := r.write(func() error {
+		var err error
+		retval, err = r.db.archivePreferences(before, limit)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) restorePreferences(username string) (bool, error) {
+	var retval bool
+	err := r.writeFor(username, func() error {
+		var err error
+		retval, err = r.db.restorePreferences(username)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) listRegisteredKeys() ([]RegisteredKey, error) {
+	var retval []RegisteredKey
+	err := r.do(func() error {
+		var err error
+		retval, err = r.db.listRegisteredKeys()
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) saveRegisteredKey(k *RegisteredKey) error {
+	return r.change(func() error {
+		return r.db.saveRegisteredKey(k)
+	})
+}
+
+func (r *ResilientDB) deleteRegisteredKey(key string) (bool, error) {
+	var retval bool
+	err := r.change(func() error {
+		var err error
+		retval, err = r.db.deleteRegisteredKey(key)
+		return err
+	})
+	return retval, err
+}
+
+func (r *ResilientDB) lookupUsername(username string) (string, error) {
+	var retval string
+	err := r.doFor(username, func() error {
+		var err error
+		retval, err = r.db.lookupUsername(username)
+		return err
+	})
+	return retval, err
+}
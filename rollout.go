@@ -0,0 +1,490 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rolloutBuckets is the number of buckets users are hashed into for rollouts,
+// which allows percentages down to a hundredth of a percent.
+const rolloutBuckets = 10000
+
+// Rollout is a preferences patch applied to a percentage of users. Members is
+// the number of users it has been applied to.
+type Rollout struct {
+	Name        string
+	Preferences string
+	Percentage  float64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Members     int64
+}
+
+// inRollout returns whether the user is in the cohort of the named rollout at
+// the percentage. The cohort is chosen by hashing the rollout's name with the
+// username, so it's stable across requests and instances, each rollout gets a
+// different cohort, and raising the percentage only adds users to it.
+func inRollout(name, username string, percentage float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + username))
+	return float64(h.Sum32()%rolloutBuckets) < percentage*rolloutBuckets/100
+}
+
+// patchPaths returns the dotted key paths of the values set by the patch,
+// sorted. Nested objects are descended into, so a patch only touches the keys
+// it names.
+func patchPaths(patch map[string]interface{}, prefix string) []string {
+	var paths []string
+	for key, value := range patch {
+		path := prefix + key
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			paths = append(paths, patchPaths(nested, path+".")...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// rolloutColumns are the columns scanned by scanRollout.
+const rolloutColumns = `r.name,
+                   r.preferences,
+                   r.percentage,
+                   r.created_at,
+                   r.updated_at,
+                   (SELECT count(*) FROM user_preferences_rollout_members m WHERE m.rollout = r.name)`
+
+// scanRollout scans a row containing the rolloutColumns.
+func scanRollout(row interface {
+	Scan(dest ...interface{}) error
+}) (*Rollout, error) {
+	var rollout Rollout
+	err := row.Scan(&rollout.Name, &rollout.Preferences, &rollout.Percentage, &rollout.CreatedAt, &rollout.UpdatedAt, &rollout.Members)
+	if err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// getRollout returns the named rollout. sql.ErrNoRows is returned if it
+// doesn't exist.
+func (p *PrefsDB) getRollout(name string) (*Rollout, error) {
+	query := `SELECT ` + rolloutColumns + `
+              FROM user_preferences_rollouts r
+             WHERE r.name = $1`
+	return scanRollout(p.db.QueryRow(query, name))
+}
+
+// listRollouts returns all of the rollouts, sorted by name.
+func (p *PrefsDB) listRollouts() ([]Rollout, error) {
+	query := `SELECT ` + rolloutColumns + `
+              FROM user_preferences_rollouts r
+          ORDER BY r.name`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollouts := []Rollout{}
+	for rows.Next() {
+		rollout, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, *rollout)
+	}
+
+	return rollouts, rows.Err()
+}
+
+// saveRollout creates the rollout or updates its percentage, setting its
+// creation and modification times.
+func (p *PrefsDB) saveRollout(rollout *Rollout) error {
+	query := `INSERT INTO user_preferences_rollouts (name, preferences, percentage)
+                   VALUES ($1, $2, $3)
+              ON CONFLICT (name) DO UPDATE
+                      SET percentage = EXCLUDED.percentage,
+                          updated_at = now()
+                RETURNING created_at, updated_at`
+	return p.db.QueryRow(query, rollout.Name, rollout.Preferences, rollout.Percentage).
+		Scan(&rollout.CreatedAt, &rollout.UpdatedAt)
+}
+
+// getRolloutMembers returns the previous values recorded for the users who are
+// members of the rollout, keyed by username. Users who aren't members are left
+// out.
+func (p *PrefsDB) getRolloutMembers(name string, usernames []string) (map[string]string, error) {
+	query := `SELECT u.username, m.previous
+              FROM user_preferences_rollout_members m,
+                   ` + p.tables.usersSource() + ` u
+             WHERE m.user_id = u.id
+               AND m.rollout = $1
+               AND u.username = ANY($2::text[])`
+
+	rows, err := p.db.Query(query, name, textArray(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]string)
+	for rows.Next() {
+		var username, previous string
+		if err = rows.Scan(&username, &previous); err != nil {
+			return nil, err
+		}
+		members[username] = previous
+	}
+
+	return members, rows.Err()
+}
+
+// addRolloutMember records that the rollout was applied to the user, along
+// with the values the rolled out key paths had beforehand.
+func (p *PrefsDB) addRolloutMember(name, username, previous string) error {
+	query := `INSERT INTO user_preferences_rollout_members (rollout, user_id, previous)
+                   SELECT $1, u.id, $3 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $2
+              ON CONFLICT (rollout, user_id) DO UPDATE
+                      SET previous = EXCLUDED.previous,
+                          applied_at = now()`
+	_, err := p.db.Exec(query, name, username, previous)
+	return err
+}
+
+// removeRolloutMember records that the rollout was reverted for the user.
+func (p *PrefsDB) removeRolloutMember(name, username string) error {
+	query := `DELETE FROM user_preferences_rollout_members m
+                    USING ` + p.tables.usersSource() + ` u
+              WHERE m.user_id = u.id
+                AND m.rollout = $1
+                AND u.username = $2`
+	_, err := p.db.Exec(query, name, username)
+	return err
+}
+
+// applyRollout merges the rollout's patch into the user's preferences and
+// records the user as a member, along with the values the patch replaced.
+func (u *UserPreferencesApp) applyRollout(rollout *Rollout, patch map[string]interface{}, username string) error {
+	current, err := u.loadPreferences(username)
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]interface{})
+	for _, path := range patchPaths(patch, "") {
+		if value, ok := getPath(current, path); ok {
+			previous[path] = deepCopy(value)
+		}
+	}
+	jsoned, err := json.Marshal(previous)
+	if err != nil {
+		return fmt.Errorf("Error generating the previous values for user %s: %s", username, err)
+	}
+
+	if _, err = u.storePreferences(username, deepMerge(current, patch, u.merge)); err != nil {
+		return err
+	}
+
+	if err = u.prefs.addRolloutMember(rollout.Name, username, string(jsoned)); err != nil {
+		return fmt.Errorf("Error adding user %s to rollout %s: %s", username, rollout.Name, err)
+	}
+	return nil
+}
+
+// revertRollout restores the values the rollout's patch replaced in the user's
+// preferences and removes the user from the rollout. Key paths that the user
+// has changed since the rollout was applied are left alone.
+func (u *UserPreferencesApp) revertRollout(rollout *Rollout, patch map[string]interface{}, username, stored string) error {
+	var previous map[string]interface{}
+	if err := json.Unmarshal([]byte(stored), &previous); err != nil {
+		return fmt.Errorf("Error parsing the previous values for user %s: %s", username, err)
+	}
+
+	current, err := u.loadPreferences(username)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, path := range patchPaths(patch, "") {
+		rolled, _ := getPath(patch, path)
+		value, ok := getPath(current, path)
+		if (ok && !reflect.DeepEqual(value, rolled)) || (!ok && rolled != nil) {
+			continue
+		}
+
+		if old, had := previous[path]; had {
+			setPath(current, path, old)
+		} else {
+			deletePath(current, path)
+		}
+		changed = true
+	}
+
+	if changed {
+		if _, err = u.storePreferences(username, current); err != nil {
+			return err
+		}
+	}
+
+	if err = u.prefs.removeRolloutMember(rollout.Name, username); err != nil {
+		return fmt.Errorf("Error removing user %s from rollout %s: %s", username, rollout.Name, err)
+	}
+	return nil
+}
+
+// reconcileRollout returns the operation that brings the rollout's members in
+// line with its percentage. Users are visited in batches in username order;
+// the patch is applied to those in the cohort who aren't members yet, and
+// reverted for members who have fallen out of it.
+func (u *UserPreferencesApp) reconcileRollout(rollout *Rollout) (OperationFunc, error) {
+	patch, err := presetValues(rollout.Preferences)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing rollout %s: %s", rollout.Name, err)
+	}
+
+	offset := 0
+	return func(batchSize int) (int64, error) {
+		var updated int64
+		for {
+			users, err := u.prefs.listUsers(UserFilter{Limit: batchSize, Offset: offset})
+			if err != nil {
+				return updated, fmt.Errorf("Error listing users: %s", err)
+			}
+			offset += len(users)
+
+			usernames := make([]string, len(users))
+			for i, user := range users {
+				usernames[i] = user.Username
+			}
+			members, err := u.prefs.getRolloutMembers(rollout.Name, usernames)
+			if err != nil {
+				return updated, fmt.Errorf("Error getting the members of rollout %s: %s", rollout.Name, err)
+			}
+
+			for _, username := range usernames {
+				previous, member := members[username]
+				switch in := inRollout(rollout.Name, username, rollout.Percentage); {
+				case in && !member:
+					err = u.applyRollout(rollout, patch, username)
+				case !in && member:
+					err = u.revertRollout(rollout, patch, username, previous)
+				default:
+					continue
+				}
+				if err != nil {
+					return updated, err
+				}
+				updated++
+			}
+
+			if len(users) < batchSize || updated >= int64(batchSize) {
+				return updated, nil
+			}
+		}
+	}, nil
+}
+
+// rolloutRequest is the body accepted by the rollout endpoint. Preferences may
+// be left out when changing the percentage of an existing rollout.
+type rolloutRequest struct {
+	Name        string                 `json:"name"`
+	Preferences map[string]interface{} `json:"preferences"`
+	Percentage  *float64               `json:"percentage"`
+}
+
+// rolloutResponse is a rollout in the rollout endpoints' responses.
+type rolloutResponse struct {
+	Name        string                 `json:"name"`
+	Preferences map[string]interface{} `json:"preferences"`
+	Percentage  float64                `json:"percentage"`
+	Members     int64                  `json:"members"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+// newRolloutResponse returns the response for the rollout.
+func newRolloutResponse(rollout *Rollout) (*rolloutResponse, error) {
+	values, err := presetValues(rollout.Preferences)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing rollout %s: %s", rollout.Name, err)
+	}
+	return &rolloutResponse{
+		Name:        rollout.Name,
+		Preferences: values,
+		Percentage:  rollout.Percentage,
+		Members:     rollout.Members,
+		CreatedAt:   rollout.CreatedAt,
+		UpdatedAt:   rollout.UpdatedAt,
+	}, nil
+}
+
+// startRollout saves the rollout at the percentage and starts the operation
+// that reconciles its members, writing out the operation or an error response.
+func (u *UserPreferencesApp) startRollout(writer http.ResponseWriter, r *http.Request, action string, rollout *Rollout) {
+	if err := u.prefs.saveRollout(rollout); err != nil {
+		errored(writer, fmt.Sprintf("Error saving rollout %s: %s", rollout.Name, err))
+		return
+	}
+
+	run, err := u.reconcileRollout(rollout)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	percentage := strconv.FormatFloat(rollout.Percentage, 'f', -1, 64)
+	log.Infof("Rolling out %s to %s%% of users", rollout.Name, percentage)
+	params := map[string]string{"name": rollout.Name, "percentage": percentage}
+	op := u.operations.Start(action, params, run)
+
+	if err = u.audit(action, map[string]string{"name": rollout.Name, "percentage": percentage, "operation": op.ID}); err != nil {
+		log.Error(err)
+	}
+	writeOperationStarted(writer, r, op)
+}
+
+// RolloutRequest handles rolling out a preferences patch to a percentage of
+// users. Posting an existing rollout's name with a new percentage expands it
+// to more users or rolls it back for some of them; the patch itself can't be
+// changed. The members are updated in the background and the response
+// describes the operation tracking the progress.
+func (u *UserPreferencesApp) RolloutRequest(writer http.ResponseWriter, r *http.Request) {
+	var body rolloutRequest
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	if body.Name == "" {
+		badRequest(writer, "A rollout must have a name")
+		return
+	}
+	if body.Percentage == nil || *body.Percentage < 0 || *body.Percentage > 100 {
+		badRequest(writer, "A rollout must have a percentage between 0 and 100")
+		return
+	}
+
+	rollout, err := u.prefs.getRollout(body.Name)
+	if err != nil && err != sql.ErrNoRows {
+		errored(writer, fmt.Sprintf("Error getting rollout %s: %s", body.Name, err))
+		return
+	}
+
+	if rollout == nil {
+		if len(body.Preferences) == 0 {
+			badRequest(writer, fmt.Sprintf("Rollout %s must have preferences", body.Name))
+			return
+		}
+		jsoned, err := documentJSON.Marshal(body.Preferences)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error generating JSON for rollout %s: %s", body.Name, err))
+			return
+		}
+		rollout = &Rollout{Name: body.Name, Preferences: string(jsoned)}
+	} else if body.Preferences != nil {
+		existing, err := presetValues(rollout.Preferences)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error parsing rollout %s: %s", rollout.Name, err))
+			return
+		}
+		if !reflect.DeepEqual(existing, body.Preferences) {
+			conflict(writer, fmt.Sprintf("Rollout %s already exists with different preferences", rollout.Name))
+			return
+		}
+	}
+
+	rollout.Percentage = *body.Percentage
+	u.startRollout(writer, r, "rollout", rollout)
+}
+
+// RollbackRequest handles rolling back a rollout for all of its members. The
+// rollout is kept at 0% so that it can be expanded again later.
+func (u *UserPreferencesApp) RollbackRequest(writer http.ResponseWriter, r *http.Request) {
+	rollout, ok := u.lookupRollout(writer, mux.Vars(r)["name"])
+	if !ok {
+		return
+	}
+
+	rollout.Percentage = 0
+	u.startRollout(writer, r, "rollback", rollout)
+}
+
+// lookupRollout returns the named rollout, writing out an error response and
+// returning false if that isn't possible.
+func (u *UserPreferencesApp) lookupRollout(writer http.ResponseWriter, name string) (*Rollout, bool) {
+	rollout, err := u.prefs.getRollout(name)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Rollout %s does not exist", name))
+		return nil, false
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting rollout %s: %s", name, err))
+		return nil, false
+	}
+	return rollout, true
+}
+
+// ListRolloutsRequest handles listing the rollouts.
+func (u *UserPreferencesApp) ListRolloutsRequest(writer http.ResponseWriter, r *http.Request) {
+	rollouts, err := u.prefs.listRollouts()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing rollouts: %s", err))
+		return
+	}
+
+	responses := make([]*rolloutResponse, 0, len(rollouts))
+	for i := range rollouts {
+		response, err := newRolloutResponse(&rollouts[i])
+		if err != nil {
+			errored(writer, err.Error())
+			return
+		}
+		responses = append(responses, response)
+	}
+
+	jsoned, err := json.Marshal(map[string][]*rolloutResponse{"rollouts": responses})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating rollouts JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// GetRolloutRequest handles getting a rollout and the number of users it has
+// been applied to.
+func (u *UserPreferencesApp) GetRolloutRequest(writer http.ResponseWriter, r *http.Request) {
+	rollout, ok := u.lookupRollout(writer, mux.Vars(r)["name"])
+	if !ok {
+		return
+	}
+
+	response, err := newRolloutResponse(rollout)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating rollout JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
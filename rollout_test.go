@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestInRollout(t *testing.T) {
+	in := 0
+	for i := 0; i < 1000; i++ {
+		username := fmt.Sprintf("user%d", i)
+		if inRollout("dark-theme", username, 0) || !inRollout("dark-theme", username, 100) {
+			t.Fatalf("%s was misplaced at 0%% or 100%%", username)
+		}
+		if inRollout("dark-theme", username, 10) && !inRollout("dark-theme", username, 20) {
+			t.Fatalf("raising the percentage dropped %s from the cohort", username)
+		}
+		if inRollout("dark-theme", username, 20) {
+			in++
+		}
+	}
+	if in < 150 || in > 250 {
+		t.Errorf("%d of 1000 users were in a 20%% cohort", in)
+	}
+}
+
+func TestPatchPaths(t *testing.T) {
+	patch := map[string]interface{}{
+		"theme": "dark",
+		"ui":    map[string]interface{}{"density": "compact", "panels": map[string]interface{}{"left": true}},
+		"empty": map[string]interface{}{},
+	}
+	expected := []string{"empty", "theme", "ui.density", "ui.panels.left"}
+	if actual := patchPaths(patch, ""); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("the patch paths were %v", actual)
+	}
+}
+
+// startRolloutRequest posts the body to the rollout URL and waits for the
+// operation it starts to finish.
+func startRolloutRequest(t *testing.T, n *UserPreferencesApp, url, body string) Operation {
+	status, resBody := doRequest(t, http.MethodPost, url, []byte(body), map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusAccepted {
+		t.Fatalf("posting %s returned %d: %s", body, status, resBody)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(resBody, &op); err != nil {
+		t.Fatal(err)
+	}
+	return waitForOperation(t, n.operations, op.ID)
+}
+
+func TestRollout(t *testing.T) {
+	mock := NewMockDB()
+	var usernames []string
+	for i := 0; i < 20; i++ {
+		username := fmt.Sprintf("user%02d", i)
+		usernames = append(usernames, username)
+		mock.users[username] = true
+		if i%2 == 0 {
+			if err := mock.insertPreferences(username, `{"theme":"light","lang":"en"}`); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n := New(mock)
+	n.adminKey = "secret"
+	n.operations = NewOperationTracker(3)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/admin/rollout"
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	for _, body := range []string{`{"preferences":{"theme":"dark"},"percentage":50}`, `{"name":"dark-theme","preferences":{"theme":"dark"},"percentage":101}`, `{"name":"dark-theme","percentage":50}`} {
+		if status, _ := doRequest(t, http.MethodPost, url, []byte(body), admin); status != http.StatusBadRequest {
+			t.Errorf("posting %s returned %d", body, status)
+		}
+	}
+
+	op := startRolloutRequest(t, n, url, `{"name":"dark-theme","preferences":{"theme":"dark"},"percentage":50}`)
+	if op.Status != operationCompleted {
+		t.Fatalf("the rollout was %#v", op)
+	}
+
+	var cohort []string
+	for _, username := range usernames {
+		prefs, err := n.loadPreferences(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, member := mock.members["dark-theme"][username]
+		in := inRollout("dark-theme", username, 50)
+		if in != member || in != (prefs["theme"] == "dark") {
+			t.Errorf("%s was in the cohort: %t, a member: %t, with preferences %v", username, in, member, prefs)
+		}
+		if in {
+			cohort = append(cohort, username)
+		}
+	}
+	if op.Updated != int64(len(cohort)) {
+		t.Errorf("the rollout updated %d users instead of %d", op.Updated, len(cohort))
+	}
+
+	if status, _ := doRequest(t, http.MethodPost, url, []byte(`{"name":"dark-theme","preferences":{"theme":"blue"},"percentage":60}`), admin); status != http.StatusConflict {
+		t.Errorf("changing the rollout's preferences returned %d", status)
+	}
+
+	op = startRolloutRequest(t, n, url, `{"name":"dark-theme","percentage":100}`)
+	if op.Status != operationCompleted || op.Updated != int64(len(usernames)-len(cohort)) {
+		t.Errorf("expanding the rollout was %#v", op)
+	}
+
+	status, body := doRequest(t, http.MethodGet, url+"/dark-theme", nil, admin)
+	var rollout rolloutResponse
+	if err := json.Unmarshal(body, &rollout); err != nil || status != http.StatusOK || rollout.Members != 20 || rollout.Percentage != 100 {
+		t.Errorf("getting the rollout returned %d: %s", status, body)
+	}
+
+	if err := mock.insertPreferences("user00", `{"theme":"blue","lang":"en"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	op = startRolloutRequest(t, n, url+"/dark-theme/rollback", "")
+	if op.Status != operationCompleted || op.Updated != 20 || len(mock.members["dark-theme"]) != 0 {
+		t.Errorf("rolling back the rollout was %#v", op)
+	}
+
+	expected := map[string]map[string]interface{}{
+		"user00": {"theme": "blue", "lang": "en"},
+		"user01": {},
+		"user02": {"theme": "light", "lang": "en"},
+	}
+	for username, prefs := range expected {
+		if actual, _ := n.loadPreferences(username); !reflect.DeepEqual(actual, prefs) {
+			t.Errorf("%s's preferences were %v after the rollback", username, actual)
+		}
+	}
+
+	if status, _ = doRequest(t, http.MethodPost, url+"/missing/rollback", nil, admin); status != http.StatusNotFound {
+		t.Errorf("rolling back a missing rollout returned %d", status)
+	}
+}
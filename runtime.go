@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// startedAt is when the process started, for reporting its uptime.
+var startedAt = time.Now()
+
+// memoryStats is the subset of runtime.MemStats returned by the runtime
+// endpoint.
+type memoryStats struct {
+	Alloc        uint64     `json:"alloc"`
+	TotalAlloc   uint64     `json:"total_alloc"`
+	Sys          uint64     `json:"sys"`
+	HeapAlloc    uint64     `json:"heap_alloc"`
+	HeapInuse    uint64     `json:"heap_inuse"`
+	HeapObjects  uint64     `json:"heap_objects"`
+	NumGC        uint32     `json:"num_gc"`
+	PauseTotalNs uint64     `json:"pause_total_ns"`
+	LastGC       *time.Time `json:"last_gc,omitempty"`
+}
+
+// poolStats describes a database connection pool.
+type poolStats struct {
+	MaxOpen           int    `json:"max_open"`
+	Open              int    `json:"open"`
+	InUse             int    `json:"in_use"`
+	Idle              int    `json:"idle"`
+	WaitCount         int64  `json:"wait_count"`
+	WaitDuration      string `json:"wait_duration"`
+	MaxIdleClosed     int64  `json:"max_idle_closed"`
+	MaxLifetimeClosed int64  `json:"max_lifetime_closed"`
+}
+
+// runtimeResponse is the JSON body returned by the runtime endpoint.
+type runtimeResponse struct {
+	GoVersion  string               `json:"go_version"`
+	Uptime     string               `json:"uptime"`
+	Goroutines int                  `json:"goroutines"`
+	CPUs       int                  `json:"cpus"`
+	GOMAXPROCS int                  `json:"gomaxprocs"`
+	Memory     memoryStats          `json:"memory"`
+	Pools      map[string]poolStats `json:"database_pools"`
+}
+
+// newPoolStats converts the connection pool statistics for the response.
+func newPoolStats(stats sql.DBStats) poolStats {
+	return poolStats{
+		MaxOpen:           stats.MaxOpenConnections,
+		Open:              stats.OpenConnections,
+		InUse:             stats.InUse,
+		Idle:              stats.Idle,
+		WaitCount:         stats.WaitCount,
+		WaitDuration:      stats.WaitDuration.String(),
+		MaxIdleClosed:     stats.MaxIdleClosed,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+	}
+}
+
+// RuntimeRequest handles writing out the process's goroutine count, memory
+// statistics, and database connection pool statistics.
+func (u *UserPreferencesApp) RuntimeRequest(writer http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	response := runtimeResponse{
+		GoVersion:  runtime.Version(),
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Memory: memoryStats{
+			Alloc:        mem.Alloc,
+			TotalAlloc:   mem.TotalAlloc,
+			Sys:          mem.Sys,
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapObjects:  mem.HeapObjects,
+			NumGC:        mem.NumGC,
+			PauseTotalNs: mem.PauseTotalNs,
+		},
+		Pools: make(map[string]poolStats),
+	}
+	if mem.LastGC > 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC)).UTC()
+		response.Memory.LastGC = &lastGC
+	}
+
+	names := make([]string, 0, len(u.pools))
+	for name := range u.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		response.Pools[name] = newPoolStats(u.pools[name].Stats())
+	}
+
+	jsoned, err := json.Marshal(&response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating runtime JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// enablePprof serves the pprof profiles under /debug/pprof/ to administrative
+// callers.
+func (u *UserPreferencesApp) enablePprof() {
+	u.router.HandleFunc("/debug/pprof/cmdline", u.adminOnly(pprof.Cmdline))
+	u.router.HandleFunc("/debug/pprof/profile", u.adminOnly(pprof.Profile))
+	u.router.HandleFunc("/debug/pprof/symbol", u.adminOnly(pprof.Symbol))
+	u.router.HandleFunc("/debug/pprof/trace", u.adminOnly(pprof.Trace))
+	u.router.PathPrefix("/debug/pprof/").HandlerFunc(u.adminOnly(pprof.Index))
+}
+
+// newDebugServer returns a server for the pprof profiles and expvar counters
+// on their own address, without administrative access checks, so that it can
+// be bound to an address only operators can reach.
+func newDebugServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
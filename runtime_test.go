@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRuntimeRequest(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	n.pools = map[string]*sql.DB{"primary": db}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/runtime", nil, nil); status != http.StatusForbidden {
+		t.Errorf("the runtime endpoint returned %d without the admin key", status)
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/runtime", nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK {
+		t.Fatalf("the runtime endpoint returned %d: %s", status, body)
+	}
+
+	var response runtimeResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Goroutines < 1 || response.GOMAXPROCS < 1 || response.Memory.Sys == 0 || response.GoVersion == "" {
+		t.Errorf("the runtime response was %s", body)
+	}
+	if pool, ok := response.Pools["primary"]; !ok || pool.MaxOpen != 7 {
+		t.Errorf("the connection pools were %+v", response.Pools)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	n := New(NewMockDB())
+	if err := configureApp(n, testConfig(t, "user-preferences:\n  admin:\n    key: secret\n  debug:\n    pprof: true\n")); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	admin := map[string]string{adminKeyHeader: "secret"}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		if status, _ := doRequest(t, http.MethodGet, server.URL+path, nil, nil); status != http.StatusForbidden {
+			t.Errorf("%s returned %d without the admin key", path, status)
+		}
+		if status, body := doRequest(t, http.MethodGet, server.URL+path, nil, admin); status != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s returned %d: %.80s", path, status, body)
+		}
+	}
+
+	_, body := doRequest(t, http.MethodGet, server.URL+"/debug/pprof/goroutine?debug=1", nil, admin)
+	if !strings.Contains(string(body), "goroutine profile") {
+		t.Errorf("the goroutine profile was %.80s", body)
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, _ := doRequest(t, http.MethodGet, server.URL+"/debug/pprof/goroutine", nil, map[string]string{adminKeyHeader: "secret"})
+	if status == http.StatusOK {
+		t.Error("the pprof profiles were served without being enabled")
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	server := httptest.NewServer(newDebugServer("").Handler)
+	defer server.Close()
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/heap?debug=1"} {
+		if status, body := doRequest(t, http.MethodGet, server.URL+path, nil, nil); status != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s returned %d from the debug server", path, status)
+		}
+	}
+}
+
+func TestDebugVarsAdminOnly(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/debug/vars", nil, nil); status != http.StatusForbidden {
+		t.Errorf("/debug/vars returned %d without the admin key", status)
+	}
+	status, body := doRequest(t, http.MethodGet, server.URL+"/debug/vars", nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusOK || !strings.Contains(string(body), "memstats") {
+		t.Errorf("/debug/vars returned %d: %.80s", status, body)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The targets a scheduled change can apply to.
+const (
+	scheduleTargetUser  = "user"
+	scheduleTargetGroup = "group"
+)
+
+// The ways a scheduled change can be applied to the stored preferences.
+const (
+	scheduleModeMerge   = "merge"
+	scheduleModeReplace = "replace"
+)
+
+// The statuses of scheduled changes.
+const (
+	scheduleStatusPending = "pending"
+	scheduleStatusApplied = "applied"
+	scheduleStatusFailed  = "failed"
+)
+
+// ScheduledChange is a change to a user's or group's preferences that's
+// applied once EffectiveAt has passed. AppliedAt is nil until the change has
+// been applied, and Error is set if it couldn't be.
+type ScheduledChange struct {
+	ID          int64
+	TargetType  string
+	Target      string
+	Mode        string
+	Preferences string
+	EffectiveAt time.Time
+	CreatedAt   time.Time
+	AppliedAt   *time.Time
+	Error       string
+}
+
+// Status returns whether the change is pending, applied, or failed.
+func (c *ScheduledChange) Status() string {
+	switch {
+	case c.AppliedAt == nil:
+		return scheduleStatusPending
+	case c.Error != "":
+		return scheduleStatusFailed
+	default:
+		return scheduleStatusApplied
+	}
+}
+
+// ScheduleFilter selects the changes returned by listScheduledChanges. Status
+// limits the listing to changes with that status, and DueBy to pending changes
+// that take effect by then, if they're set.
+type ScheduleFilter struct {
+	Status string
+	DueBy  *time.Time
+}
+
+// scheduledChangeColumns are the columns scanned by scanScheduledChange.
+const scheduledChangeColumns = `id,
+                   target_type,
+                   target,
+                   mode,
+                   preferences,
+                   effective_at,
+                   created_at,
+                   applied_at,
+                   error`
+
+// scanScheduledChange scans a row containing the scheduledChangeColumns.
+func scanScheduledChange(row interface {
+	Scan(dest ...interface{}) error
+}) (*ScheduledChange, error) {
+	var (
+		change    ScheduledChange
+		appliedAt sql.NullTime
+		errorMsg  sql.NullString
+	)
+
+	err := row.Scan(&change.ID, &change.TargetType, &change.Target, &change.Mode, &change.Preferences,
+		&change.EffectiveAt, &change.CreatedAt, &appliedAt, &errorMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	if appliedAt.Valid {
+		change.AppliedAt = &appliedAt.Time
+	}
+	change.Error = errorMsg.String
+	return &change, nil
+}
+
+// createScheduledChange stores the change, setting its ID and creation time.
+func (p *PrefsDB) createScheduledChange(change *ScheduledChange) error {
+	query := `INSERT INTO user_preferences_scheduled_changes (target_type, target, mode, preferences, effective_at)
+                   VALUES ($1, $2, $3, $4, $5)
+                RETURNING id, created_at`
+	return p.db.QueryRow(query, change.TargetType, change.Target, change.Mode, change.Preferences, change.EffectiveAt).
+		Scan(&change.ID, &change.CreatedAt)
+}
+
+// getScheduledChange returns the scheduled change with the ID. sql.ErrNoRows
+// is returned if it doesn't exist.
+func (p *PrefsDB) getScheduledChange(id int64) (*ScheduledChange, error) {
+	query := `SELECT ` + scheduledChangeColumns + `
+              FROM user_preferences_scheduled_changes
+             WHERE id = $1`
+	return scanScheduledChange(p.db.QueryRow(query, id))
+}
+
+// listScheduledChanges returns the scheduled changes selected by the filter,
+// in the order they take effect.
+func (p *PrefsDB) listScheduledChanges(filter ScheduleFilter) ([]ScheduledChange, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	switch filter.Status {
+	case scheduleStatusPending:
+		conditions = append(conditions, "applied_at IS NULL")
+	case scheduleStatusApplied:
+		conditions = append(conditions, "applied_at IS NOT NULL", "error IS NULL")
+	case scheduleStatusFailed:
+		conditions = append(conditions, "error IS NOT NULL")
+	}
+	if filter.DueBy != nil {
+		args = append(args, *filter.DueBy)
+		conditions = append(conditions, "applied_at IS NULL", fmt.Sprintf("effective_at <= $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	query := fmt.Sprintf(`SELECT %s
+              FROM user_preferences_scheduled_changes
+              %s
+          ORDER BY effective_at, id`, scheduledChangeColumns, where)
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []ScheduledChange{}
+	for rows.Next() {
+		change, err := scanScheduledChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+
+	return changes, rows.Err()
+}
+
+// cancelScheduledChange deletes the change if it's still pending and returns
+// whether it was.
+func (p *PrefsDB) cancelScheduledChange(id int64) (bool, error) {
+	query := `DELETE FROM user_preferences_scheduled_changes WHERE id = $1 AND applied_at IS NULL`
+	result, err := p.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// claimScheduledChange marks the change as applied at the given time, if it's
+// still pending, and returns whether it was. Claiming a change before applying
+// it keeps it from being applied twice when several instances run the job.
+func (p *PrefsDB) claimScheduledChange(id int64, at time.Time) (bool, error) {
+	query := `UPDATE user_preferences_scheduled_changes
+                 SET applied_at = $2
+               WHERE id = $1
+                 AND applied_at IS NULL`
+	result, err := p.db.Exec(query, id, at)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+// failScheduledChange records why the claimed change couldn't be applied.
+func (p *PrefsDB) failScheduledChange(id int64, msg string) error {
+	query := `UPDATE user_preferences_scheduled_changes SET error = $2 WHERE id = $1`
+	_, err := p.db.Exec(query, id, msg)
+	return err
+}
+
+// scheduleRequest is the body accepted by the schedule endpoint. Exactly one
+// of User and Group must be set.
+type scheduleRequest struct {
+	User        string                 `json:"user"`
+	Group       string                 `json:"group"`
+	Mode        string                 `json:"mode"`
+	Preferences map[string]interface{} `json:"preferences"`
+	EffectiveAt time.Time              `json:"effective_at"`
+}
+
+// scheduledChangeResponse is a scheduled change in the schedule endpoints'
+// responses.
+type scheduledChangeResponse struct {
+	ID          int64                  `json:"id"`
+	User        string                 `json:"user,omitempty"`
+	Group       string                 `json:"group,omitempty"`
+	Mode        string                 `json:"mode"`
+	Preferences map[string]interface{} `json:"preferences"`
+	EffectiveAt time.Time              `json:"effective_at"`
+	CreatedAt   time.Time              `json:"created_at"`
+	AppliedAt   *time.Time             `json:"applied_at,omitempty"`
+	Status      string                 `json:"status"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// newScheduledChangeResponse returns the response for the change.
+func newScheduledChangeResponse(change *ScheduledChange) (*scheduledChangeResponse, error) {
+	values, err := presetValues(change.Preferences)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing scheduled change %d: %s", change.ID, err)
+	}
+
+	response := &scheduledChangeResponse{
+		ID:          change.ID,
+		Mode:        change.Mode,
+		Preferences: values,
+		EffectiveAt: change.EffectiveAt,
+		CreatedAt:   change.CreatedAt,
+		AppliedAt:   change.AppliedAt,
+		Status:      change.Status(),
+		Error:       change.Error,
+	}
+	if change.TargetType == scheduleTargetGroup {
+		response.Group = change.Target
+	} else {
+		response.User = change.Target
+	}
+	return response, nil
+}
+
+// writeScheduledChange writes out the change as a response with the status.
+func writeScheduledChange(writer http.ResponseWriter, status int, change *ScheduledChange) {
+	response, err := newScheduledChangeResponse(change)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating scheduled change JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsoned)
+}
+
+// newScheduledChange validates the body of a schedule request and returns the
+// change it describes.
+func (u *UserPreferencesApp) newScheduledChange(body *scheduleRequest) (*ScheduledChange, error) {
+	change := &ScheduledChange{Mode: body.Mode, EffectiveAt: body.EffectiveAt}
+
+	switch {
+	case body.User != "" && body.Group != "":
+		return nil, fmt.Errorf("A scheduled change may be for a user or a group, but not both")
+	case body.User != "":
+		exists, err := u.prefs.isUser(body.User)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking for username %s: %s", body.User, err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("Unknown user %s", body.User)
+		}
+		change.TargetType, change.Target = scheduleTargetUser, body.User
+	case body.Group != "":
+		change.TargetType, change.Target = scheduleTargetGroup, body.Group
+	default:
+		return nil, fmt.Errorf("A scheduled change must name a user or a group")
+	}
+
+	switch change.Mode {
+	case "":
+		change.Mode = scheduleModeMerge
+	case scheduleModeMerge, scheduleModeReplace:
+	default:
+		return nil, fmt.Errorf("Unknown mode %s; use merge or replace", change.Mode)
+	}
+
+	if change.EffectiveAt.IsZero() {
+		return nil, fmt.Errorf("A scheduled change must include effective_at")
+	}
+
+	values := body.Preferences
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	jsoned, err := documentJSON.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating JSON for the scheduled change: %s", err)
+	}
+	change.Preferences = string(jsoned)
+
+	return change, nil
+}
+
+// parseScheduledChangeID returns the scheduled change ID in the URL, writing
+// out an error response and returning false if it isn't valid.
+func parseScheduledChangeID(writer http.ResponseWriter, r *http.Request) (int64, bool) {
+	idString := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idString, 10, 64)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Invalid scheduled change ID: %s", idString))
+		return 0, false
+	}
+	return id, true
+}
+
+// ScheduleChangeRequest handles scheduling a change to a user's or group's
+// preferences. The change is merged into or replaces the stored preferences
+// once its effective time has passed.
+func (u *UserPreferencesApp) ScheduleChangeRequest(writer http.ResponseWriter, r *http.Request) {
+	var body scheduleRequest
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	change, err := u.newScheduledChange(&body)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	if err = u.prefs.createScheduledChange(change); err != nil {
+		errored(writer, fmt.Sprintf("Error scheduling a change for %s %s: %s", change.TargetType, change.Target, err))
+		return
+	}
+
+	details := map[string]string{
+		"id":           strconv.FormatInt(change.ID, 10),
+		"mode":         change.Mode,
+		"effective_at": change.EffectiveAt.UTC().Format(time.RFC3339),
+	}
+	details[change.TargetType] = change.Target
+	if err = u.audit("schedule-change", details); err != nil {
+		log.Error(err)
+	}
+
+	writer.Header().Set("Location", externalPath(r, fmt.Sprintf("/admin/schedule/%d", change.ID)))
+	writeScheduledChange(writer, http.StatusCreated, change)
+}
+
+// ListScheduledChangesRequest handles listing the scheduled changes in the
+// order they take effect. Only pending changes are listed unless the status
+// parameter asks for applied, failed, or all of them.
+func (u *UserPreferencesApp) ListScheduledChangesRequest(writer http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = scheduleStatusPending
+	case "all":
+		status = ""
+	case scheduleStatusPending, scheduleStatusApplied, scheduleStatusFailed:
+	default:
+		badRequest(writer, fmt.Sprintf("Unknown status %s; use pending, applied, failed, or all", status))
+		return
+	}
+
+	changes, err := u.prefs.listScheduledChanges(ScheduleFilter{Status: status})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing scheduled changes: %s", err))
+		return
+	}
+
+	responses := make([]*scheduledChangeResponse, 0, len(changes))
+	for i := range changes {
+		response, err := newScheduledChangeResponse(&changes[i])
+		if err != nil {
+			errored(writer, err.Error())
+			return
+		}
+		responses = append(responses, response)
+	}
+
+	jsoned, err := json.Marshal(map[string][]*scheduledChangeResponse{"changes": responses})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating scheduled changes JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// GetScheduledChangeRequest handles getting a scheduled change.
+func (u *UserPreferencesApp) GetScheduledChangeRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := parseScheduledChangeID(writer, r)
+	if !ok {
+		return
+	}
+
+	change, err := u.prefs.getScheduledChange(id)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Scheduled change %d does not exist", id))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting scheduled change %d: %s", id, err))
+		return
+	}
+
+	writeScheduledChange(writer, http.StatusOK, change)
+}
+
+// CancelScheduledChangeRequest handles cancelling a pending scheduled change.
+// Changes that have already been applied can't be cancelled.
+func (u *UserPreferencesApp) CancelScheduledChangeRequest(writer http.ResponseWriter, r *http.Request) {
+	id, ok := parseScheduledChangeID(writer, r)
+	if !ok {
+		return
+	}
+
+	cancelled, err := u.prefs.cancelScheduledChange(id)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error cancelling scheduled change %d: %s", id, err))
+		return
+	}
+	if !cancelled {
+		if _, err = u.prefs.getScheduledChange(id); err == sql.ErrNoRows {
+			notFound(writer, fmt.Sprintf("Scheduled change %d does not exist", id))
+			return
+		}
+		conflict(writer, fmt.Sprintf("Scheduled change %d has already been applied", id))
+		return
+	}
+
+	if err = u.audit("cancel-scheduled-change", map[string]string{"id": strconv.FormatInt(id, 10)}); err != nil {
+		log.Error(err)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// applyScheduledChange merges the change into, or replaces, the stored
+// preferences of its user or group.
+func (u *UserPreferencesApp) applyScheduledChange(change *ScheduledChange) error {
+	values, err := presetValues(change.Preferences)
+	if err != nil {
+		return fmt.Errorf("Error parsing scheduled change %d: %s", change.ID, err)
+	}
+
+	if change.TargetType == scheduleTargetGroup {
+		if change.Mode == scheduleModeMerge {
+			stored, err := u.prefs.getGroupPreferences(change.Target)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("Error getting preferences for group %s: %s", change.Target, err)
+			}
+			current, err := presetValues(stored)
+			if err != nil {
+				return fmt.Errorf("Error parsing preferences for group %s: %s", change.Target, err)
+			}
+			values = deepMerge(current, values, u.merge)
+		}
+
+		jsoned, err := json.Marshal(values)
+		if err != nil {
+			return fmt.Errorf("Error generating JSON for group %s: %s", change.Target, err)
+		}
+		if err = u.prefs.saveGroupPreferences(change.Target, string(jsoned)); err != nil {
+			return fmt.Errorf("Error saving preferences for group %s: %s", change.Target, err)
+		}
+		return nil
+	}
+
+	exists, err := u.prefs.isUser(change.Target)
+	if err != nil {
+		return fmt.Errorf("Error checking for username %s: %s", change.Target, err)
+	}
+	if !exists {
+		return fmt.Errorf("Unknown user %s", change.Target)
+	}
+
+	if change.Mode == scheduleModeMerge {
+		current, err := u.loadPreferences(change.Target)
+		if err != nil {
+			return err
+		}
+		values = deepMerge(current, values, u.merge)
+	}
+
+	_, err = u.storePreferences(change.Target, values)
+	return err
+}
+
+// applyScheduledChanges applies the pending changes whose effective time has
+// passed and returns the number that were applied. Changes that can't be
+// applied are marked as failed rather than retried.
+func (u *UserPreferencesApp) applyScheduledChanges(now time.Time) (int, error) {
+	changes, err := u.prefs.listScheduledChanges(ScheduleFilter{DueBy: &now})
+	if err != nil {
+		return 0, fmt.Errorf("Error listing due scheduled changes: %s", err)
+	}
+
+	applied, failed := 0, 0
+	for i := range changes {
+		change := &changes[i]
+
+		claimed, err := u.prefs.claimScheduledChange(change.ID, now)
+		if err != nil {
+			return applied, fmt.Errorf("Error claiming scheduled change %d: %s", change.ID, err)
+		}
+		if !claimed {
+			continue
+		}
+
+		if err = u.applyScheduledChange(change); err != nil {
+			failed++
+			log.Errorf("Error applying scheduled change %d: %s", change.ID, err)
+			if err = u.prefs.failScheduledChange(change.ID, err.Error()); err != nil {
+				log.Errorf("Error marking scheduled change %d as failed: %s", change.ID, err)
+			}
+			continue
+		}
+
+		applied++
+		details := map[string]string{"id": strconv.FormatInt(change.ID, 10), "mode": change.Mode}
+		details[change.TargetType] = change.Target
+		if err = u.audit("apply-scheduled-change", details); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if failed > 0 {
+		return applied, fmt.Errorf("%d scheduled changes couldn't be applied", failed)
+	}
+	return applied, nil
+}
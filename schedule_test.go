@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	url := server.URL + "/admin/schedule"
+	admin := map[string]string{adminKeyHeader: "secret"}
+	effective := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := []byte(fmt.Sprintf(`{"user":"test-user","preferences":{"theme":"dark"},"effective_at":"%s"}`, effective))
+
+	if status, _ := doRequest(t, http.MethodPost, url, body, nil); status != http.StatusForbidden {
+		t.Errorf("scheduling without the admin key returned %d", status)
+	}
+
+	status, resBody := doRequest(t, http.MethodPost, url, body, admin)
+	if status != http.StatusCreated {
+		t.Fatalf("scheduling returned %d: %s", status, resBody)
+	}
+	var created scheduledChangeResponse
+	if err := json.Unmarshal(resBody, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 1 || created.User != "test-user" || created.Mode != scheduleModeMerge || created.Status != scheduleStatusPending {
+		t.Errorf("the scheduled change was %+v", created)
+	}
+
+	status, resBody = doRequest(t, http.MethodGet, url+"/1", nil, admin)
+	if status != http.StatusOK || !strings.Contains(string(resBody), `"theme":"dark"`) {
+		t.Errorf("getting the scheduled change returned %d: %s", status, resBody)
+	}
+
+	status, resBody = doRequest(t, http.MethodGet, url, nil, admin)
+	var listed struct {
+		Changes []scheduledChangeResponse `json:"changes"`
+	}
+	if err := json.Unmarshal(resBody, &listed); err != nil || status != http.StatusOK || len(listed.Changes) != 1 {
+		t.Errorf("listing the scheduled changes returned %d: %s", status, resBody)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url+"/1", nil, admin); status != http.StatusNoContent {
+		t.Errorf("cancelling the scheduled change returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodDelete, url+"/1", nil, admin); status != http.StatusNotFound {
+		t.Errorf("cancelling a missing scheduled change returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodGet, url+"/bogus", nil, admin); status != http.StatusBadRequest {
+		t.Errorf("getting a scheduled change with an invalid ID returned %d", status)
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	n := New(mock)
+
+	effective := time.Now()
+	tests := map[string]*scheduleRequest{
+		"no target":       {EffectiveAt: effective},
+		"both targets":    {User: "test-user", Group: "staff", EffectiveAt: effective},
+		"unknown user":    {User: "nobody", EffectiveAt: effective},
+		"unknown mode":    {User: "test-user", Mode: "patch", EffectiveAt: effective},
+		"no effective at": {Group: "staff"},
+	}
+	for name, body := range tests {
+		if _, err := n.newScheduledChange(body); err == nil {
+			t.Errorf("a request with %s was accepted", name)
+		}
+	}
+
+	change, err := n.newScheduledChange(&scheduleRequest{Group: "staff", Mode: scheduleModeReplace, EffectiveAt: effective})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.TargetType != scheduleTargetGroup || change.Preferences != "{}" {
+		t.Errorf("the change was %+v", change)
+	}
+}
+
+func TestApplyScheduledChanges(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"light","lang":"en"}`); err != nil {
+		t.Fatal(err)
+	}
+	mock.groups["staff"] = `{"theme":"light","lang":"en"}`
+	n := New(mock)
+
+	now := time.Now()
+	changes := []*ScheduledChange{
+		{TargetType: scheduleTargetUser, Target: "test-user", Mode: scheduleModeMerge, Preferences: `{"theme":"dark"}`, EffectiveAt: now.Add(-time.Minute)},
+		{TargetType: scheduleTargetGroup, Target: "staff", Mode: scheduleModeReplace, Preferences: `{"theme":"dark"}`, EffectiveAt: now.Add(-time.Minute)},
+		{TargetType: scheduleTargetUser, Target: "nobody", Mode: scheduleModeMerge, Preferences: `{}`, EffectiveAt: now.Add(-time.Minute)},
+		{TargetType: scheduleTargetUser, Target: "test-user", Mode: scheduleModeReplace, Preferences: `{}`, EffectiveAt: now.Add(time.Hour)},
+	}
+	for _, change := range changes {
+		if err := mock.createScheduledChange(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied, err := n.applyScheduledChanges(now)
+	if applied != 2 || err == nil {
+		t.Errorf("applying the scheduled changes returned %d, %v", applied, err)
+	}
+
+	prefs, err := n.loadPreferences("test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prefs, map[string]interface{}{"theme": "dark", "lang": "en"}) {
+		t.Errorf("the user's preferences were %v", prefs)
+	}
+	if mock.groups["staff"] != `{"theme":"dark"}` {
+		t.Errorf("the group's preferences were %s", mock.groups["staff"])
+	}
+
+	statuses := map[int64]string{}
+	for _, change := range mock.schedule {
+		statuses[change.ID] = change.Status()
+	}
+	expected := map[int64]string{1: scheduleStatusApplied, 2: scheduleStatusApplied, 3: scheduleStatusFailed, 4: scheduleStatusPending}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the statuses were %v", statuses)
+	}
+
+	if applied, err = n.applyScheduledChanges(now); applied != 0 || err != nil {
+		t.Errorf("applying the scheduled changes again returned %d, %v", applied, err)
+	}
+}
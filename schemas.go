@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// validSchema matches the schema names that can be listed in a search_path
+// without quoting.
+var validSchema = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// searchPath returns the search_path listing the schemas in order, skipping
+// empty and repeated ones.
+func searchPath(schemas ...string) (string, error) {
+	var path []string
+	seen := make(map[string]bool)
+	for _, schema := range schemas {
+		if schema == "" || seen[schema] {
+			continue
+		}
+		if !validSchema.MatchString(schema) {
+			return "", fmt.Errorf("Invalid schema name %q", schema)
+		}
+		seen[schema] = true
+		path = append(path, schema)
+	}
+	return strings.Join(path, ","), nil
+}
+
+// withSchemas returns the database URI with its search_path set so that the
+// service's tables resolve within the preferences schema and the users table
+// resolves within the users schema. The tenant's schema, if there is one,
+// replaces the configured preferences schema. Tables are created in the first
+// schema listed. The URI is returned unchanged if no schemas are configured.
+func withSchemas(cfg *viper.Viper, dburi, tenantSchema string) (string, error) {
+	prefsSchema := cfg.GetString("user-preferences.database.schema")
+	if tenantSchema != "" {
+		prefsSchema = tenantSchema
+	}
+
+	path, err := searchPath(prefsSchema, cfg.GetString("user-preferences.database.users-schema"))
+	if err != nil || path == "" {
+		return dburi, err
+	}
+	return withSearchPath(dburi, path)
+}
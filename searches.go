@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// savedSearchesKey is the key that holds the user's saved searches, keyed by
+// ID, in the combined preferences document. The searches are stored in their
+// own table, but clients that predate the searches endpoints still read and
+// write them through the document.
+const savedSearchesKey = "savedSearches"
+
+// SavedSearch is one of a user's saved searches. Search is the JSON encoding
+// of the search.
+type SavedSearch struct {
+	ID     string
+	Search string
+}
+
+// listSearches returns the user's saved searches, sorted by ID.
+func (p *PrefsDB) listSearches(username string) ([]SavedSearch, error) {
+	query := `SELECT s.id, s.search
+                FROM user_preferences_searches s,
+                     ` + p.tables.usersSource() + ` u
+               WHERE s.user_id = u.id
+                 AND u.username = $1
+            ORDER BY s.id`
+
+	rows, err := p.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var search SavedSearch
+		if err := rows.Scan(&search.ID, &search.Search); err != nil {
+			return nil, err
+		}
+		searches = append(searches, search)
+	}
+
+	return searches, rows.Err()
+}
+
+// getSearch returns one of the user's saved searches. sql.ErrNoRows is
+// returned if it doesn't exist.
+func (p *PrefsDB) getSearch(username, id string) (*SavedSearch, error) {
+	query := `SELECT s.id, s.search
+                FROM user_preferences_searches s,
+                     ` + p.tables.usersSource() + ` u
+               WHERE s.user_id = u.id
+                 AND u.username = $1
+                 AND s.id = $2`
+
+	var search SavedSearch
+	if err := p.db.QueryRow(query, username, id).Scan(&search.ID, &search.Search); err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+// putSearch creates or replaces one of the user's saved searches and returns
+// whether it was created.
+func (p *PrefsDB) putSearch(username, id, search string) (bool, error) {
+	query := `INSERT INTO user_preferences_searches (user_id, id, search)
+                   SELECT u.id, $2, $3 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $1
+              ON CONFLICT (user_id, id) DO UPDATE
+                      SET search = EXCLUDED.search,
+                          modified_at = now()
+                RETURNING (xmax = 0)`
+
+	var created bool
+	if err := p.db.QueryRow(query, username, id, search).Scan(&created); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// deleteSearch removes one of the user's saved searches and returns whether it
+// existed.
+func (p *PrefsDB) deleteSearch(username, id string) (bool, error) {
+	query := `DELETE FROM user_preferences_searches s
+                    USING ` + p.tables.usersSource() + ` u
+                    WHERE s.user_id = u.id
+                      AND u.username = $1
+                      AND s.id = $2`
+
+	result, err := p.db.Exec(query, username, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// replaceSearches replaces all of the user's saved searches in a single
+// transaction. An empty map deletes them all.
+func (p *PrefsDB) replaceSearches(username string, searches map[string]string) error {
+	userID, err := p.userID(username)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(searches))
+	for id := range searches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM user_preferences_searches WHERE user_id = $1`, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	insert := `INSERT INTO user_preferences_searches (user_id, id, search) VALUES ($1, $2, $3)`
+	for _, id := range ids {
+		if _, err = tx.Exec(insert, userID, id, searches[id]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// searchesDocument returns the user's saved searches keyed by ID.
+func (u *UserPreferencesApp) searchesDocument(username string) (map[string]interface{}, error) {
+	searches, err := u.prefs.listSearches(username)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting saved searches for user %s: %s", username, err)
+	}
+
+	doc := make(map[string]interface{}, len(searches))
+	for _, search := range searches {
+		var value interface{}
+		if err = json.Unmarshal([]byte(search.Search), &value); err != nil {
+			return nil, fmt.Errorf("Error parsing saved search %s for user %s: %s", search.ID, username, err)
+		}
+		doc[search.ID] = value
+	}
+	return doc, nil
+}
+
+// applySearches adds the user's saved searches to the combined preferences
+// document, if they have any.
+func (u *UserPreferencesApp) applySearches(username string, response map[string]interface{}, wrap bool) (map[string]interface{}, error) {
+	searches, err := u.searchesDocument(username)
+	if err != nil || len(searches) == 0 {
+		return response, err
+	}
+
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+
+	values := response
+	if wrap {
+		var ok bool
+		if values, ok = response["preferences"].(map[string]interface{}); !ok {
+			values = make(map[string]interface{})
+			response["preferences"] = values
+		}
+	}
+	values[savedSearchesKey] = searches
+	return response, nil
+}
+
+// extractSearches removes the saved searches from a preferences document so
+// that they can be stored separately. The second return value is false if the
+// document didn't contain any. A search may be null, which deletes it in a
+// merge, and so may the whole key, which deletes them all.
+func extractSearches(values map[string]interface{}) (map[string]interface{}, bool, error) {
+	value, ok := values[savedSearchesKey]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(values, savedSearchesKey)
+
+	if value == nil {
+		return nil, true, nil
+	}
+
+	searches, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("The %s key must be an object of searches keyed by ID", savedSearchesKey)
+	}
+	for id, search := range searches {
+		if _, ok := search.(map[string]interface{}); !ok && search != nil {
+			return nil, false, fmt.Errorf("Saved search %s must be an object", id)
+		}
+	}
+	return searches, true, nil
+}
+
+// encodeSearches returns the JSON encoding of each of the searches, skipping
+// null ones.
+func encodeSearches(searches map[string]interface{}) (map[string]string, error) {
+	encoded := make(map[string]string, len(searches))
+	for id, search := range searches {
+		if search == nil {
+			continue
+		}
+		jsoned, err := json.Marshal(search)
+		if err != nil {
+			return nil, fmt.Errorf("Error generating JSON for saved search %s: %s", id, err)
+		}
+		encoded[id] = string(jsoned)
+	}
+	return encoded, nil
+}
+
+// storeDocumentSearches stores the saved searches taken from a write of the
+// combined document. A merge updates the searches it contains and deletes the
+// null ones; otherwise they replace all of the user's searches.
+func (u *UserPreferencesApp) storeDocumentSearches(username string, searches map[string]interface{}, merge bool) error {
+	encoded, err := encodeSearches(searches)
+	if err != nil {
+		return err
+	}
+
+	if !merge || searches == nil {
+		return u.prefs.replaceSearches(username, encoded)
+	}
+
+	for id, search := range searches {
+		if search == nil {
+			_, err = u.prefs.deleteSearch(username, id)
+		} else {
+			_, err = u.prefs.putSearch(username, id, encoded[id])
+		}
+		if err != nil {
+			return fmt.Errorf("Error saving search %s for user %s: %s", id, username, err)
+		}
+	}
+	return nil
+}
+
+// deleteDocumentSearches deletes the user's saved searches along with their
+// preferences document, since they used to be part of it. An error response is
+// written and false is returned if that fails.
+func (u *UserPreferencesApp) deleteDocumentSearches(writer http.ResponseWriter, username string) bool {
+	if err := u.prefs.replaceSearches(username, nil); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting saved searches for user %s: %s", username, err))
+		return false
+	}
+	return true
+}
+
+// writeSearches writes the user's saved searches as a response.
+func (u *UserPreferencesApp) writeSearches(writer http.ResponseWriter, username string) {
+	searches, err := u.searchesDocument(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(searches)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating saved searches JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// ListSearchesRequest handles getting all of a user's saved searches, keyed by
+// ID.
+func (u *UserPreferencesApp) ListSearchesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	u.writeSearches(writer, username)
+}
+
+// ReplaceSearchesRequest handles replacing all of a user's saved searches with
+// the ones in the body, which are keyed by ID.
+func (u *UserPreferencesApp) ReplaceSearchesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	searches, _, err := extractSearches(map[string]interface{}{savedSearchesKey: body})
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	encoded, err := encodeSearches(searches)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	log.Infof("Replacing %d saved searches for %s", len(encoded), username)
+	if err = u.prefs.replaceSearches(username, encoded); err != nil {
+		errored(writer, fmt.Sprintf("Error replacing saved searches for user %s: %s", username, err))
+		return
+	}
+
+	u.writeSearches(writer, username)
+}
+
+// DeleteSearchesRequest handles deleting all of a user's saved searches.
+func (u *UserPreferencesApp) DeleteSearchesRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	log.Infof("Deleting saved searches for %s", username)
+	if err := u.prefs.replaceSearches(username, nil); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting saved searches for user %s: %s", username, err))
+	}
+}
+
+// GetSearchRequest handles getting one of a user's saved searches.
+func (u *UserPreferencesApp) GetSearchRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	search, err := u.prefs.getSearch(username, id)
+	if err == sql.ErrNoRows {
+		notFound(writer, fmt.Sprintf("Saved search %s does not exist for user %s", id, username))
+		return
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting saved search %s for user %s: %s", id, username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(search.Search))
+}
+
+// PutSearchRequest handles creating or replacing one of a user's saved
+// searches. A 201 is returned if it was created.
+func (u *UserPreferencesApp) PutSearchRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	var body map[string]interface{}
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+	if body == nil {
+		badRequest(writer, fmt.Sprintf("Saved search %s must be an object", id))
+		return
+	}
+
+	jsoned, err := json.Marshal(body)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating JSON for saved search %s: %s", id, err))
+		return
+	}
+
+	created, err := u.prefs.putSearch(username, id, string(jsoned))
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error saving search %s for user %s: %s", id, username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if created {
+		writer.WriteHeader(http.StatusCreated)
+	}
+	writer.Write(jsoned)
+}
+
+// DeleteSearchRequest handles deleting one of a user's saved searches.
+func (u *UserPreferencesApp) DeleteSearchRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	deleted, err := u.prefs.deleteSearch(username, id)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error deleting saved search %s for user %s: %s", id, username, err))
+		return
+	}
+	if !deleted {
+		notFound(writer, fmt.Sprintf("Saved search %s does not exist for user %s", id, username))
+	}
+}
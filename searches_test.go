@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSearchesRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/searches"
+
+	status, body := doRequest(t, http.MethodPut, url+"/genomes", []byte(`{"query":"*.fasta"}`), nil)
+	if status != http.StatusCreated || string(body) != `{"query":"*.fasta"}` {
+		t.Errorf("creating a search returned %d: %s", status, body)
+	}
+	if status, _ = doRequest(t, http.MethodPut, url+"/genomes", []byte(`{"query":"*.fa"}`), nil); status != http.StatusOK {
+		t.Errorf("replacing a search returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodPut, url+"/bad", []byte(`null`), nil); status != http.StatusBadRequest {
+		t.Errorf("saving a null search returned %d", status)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url+"/genomes", nil, nil)
+	if status != http.StatusOK || string(body) != `{"query":"*.fa"}` {
+		t.Errorf("getting a search returned %d: %s", status, body)
+	}
+	if status, _ = doRequest(t, http.MethodGet, url+"/missing", nil, nil); status != http.StatusNotFound {
+		t.Errorf("getting a missing search returned %d", status)
+	}
+
+	status, body = doRequest(t, http.MethodPut, url, []byte(`{"a":{"query":"a"},"b":{"query":"b"}}`), nil)
+	if status != http.StatusOK || string(body) != `{"a":{"query":"a"},"b":{"query":"b"}}` {
+		t.Errorf("replacing the searches returned %d: %s", status, body)
+	}
+	if _, ok := mock.searches["alice"]["genomes"]; ok {
+		t.Error("replacing the searches kept an old one")
+	}
+	if status, _ = doRequest(t, http.MethodPut, url, []byte(`{"a":"query"}`), nil); status != http.StatusBadRequest {
+		t.Errorf("replacing the searches with a string returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url+"/a", nil, nil); status != http.StatusOK {
+		t.Errorf("deleting a search returned %d", status)
+	}
+	if status, _ = doRequest(t, http.MethodDelete, url+"/a", nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleting a missing search returned %d", status)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK || string(body) != `{"b":{"query":"b"}}` {
+		t.Errorf("listing the searches returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusOK || len(mock.searches["alice"]) != 0 {
+		t.Errorf("deleting the searches returned %d", status)
+	}
+}
+
+func TestSearchesInDocument(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice"
+	body := []byte(`{"theme":"dark","savedSearches":{"a":{"query":"a"},"b":{"query":"b"}}}`)
+	if status, resBody := doRequest(t, http.MethodPut, url, body, nil); status != http.StatusCreated {
+		t.Fatalf("PUT returned %d: %s", status, resBody)
+	}
+
+	if prefs, _ := mock.getPreferences("alice"); prefs[0].Preferences != `{"theme":"dark"}` {
+		t.Errorf("the searches were stored in the document: %s", prefs[0].Preferences)
+	}
+	if len(mock.searches["alice"]) != 2 {
+		t.Errorf("the stored searches were %#v", mock.searches["alice"])
+	}
+
+	body = []byte(`{"savedSearches":{"a":null,"c":{"query":"c"}}}`)
+	if status, resBody := doRequest(t, http.MethodPost, url, body, nil); status != http.StatusOK {
+		t.Fatalf("POST returned %d: %s", status, resBody)
+	}
+
+	status, resBody := doRequest(t, http.MethodGet, url, nil, nil)
+	var values map[string]interface{}
+	if err := json.Unmarshal(resBody, &values); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"theme": "dark",
+		"savedSearches": map[string]interface{}{
+			"b": map[string]interface{}{"query": "b"},
+			"c": map[string]interface{}{"query": "c"},
+		},
+	}
+	if status != http.StatusOK || !reflect.DeepEqual(values, expected) {
+		t.Errorf("GET returned %d: %s", status, resBody)
+	}
+
+	if status, _ = doRequest(t, http.MethodPut, url, []byte(`{"theme":"light"}`), nil); status != http.StatusOK || len(mock.searches["alice"]) != 2 {
+		t.Errorf("a PUT without searches changed them: %#v", mock.searches["alice"])
+	}
+
+	if status, _ = doRequest(t, http.MethodPut, url, []byte(`{"savedSearches":[]}`), nil); status != http.StatusBadRequest {
+		t.Errorf("a PUT with invalid searches returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusOK || len(mock.searches["alice"]) != 0 {
+		t.Errorf("deleting the preferences left the searches: %#v", mock.searches["alice"])
+	}
+}
+
+func TestPutSearch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("INSERT INTO user_preferences_searches (.+) ON CONFLICT \\(user_id, id\\) DO UPDATE").
+		WithArgs("test-user", "genomes", `{"query":"*.fasta"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+
+	created, err := p.putSearch("test-user", "genomes", `{"query":"*.fasta"}`)
+	if err != nil || !created {
+		t.Errorf("putSearch returned %v, %v", created, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
+func TestReplaceSearches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_preferences_searches WHERE user_id = \\$1").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("INSERT INTO user_preferences_searches \\(user_id, id, search\\)").
+		WithArgs("1", "a", `{"query":"a"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO user_preferences_searches \\(user_id, id, search\\)").
+		WithArgs("1", "b", `{"query":"b"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = p.replaceSearches("test-user", map[string]string{"b": `{"query":"b"}`, "a": `{"query":"a"}`})
+	if err != nil {
+		t.Fatalf("error replacing searches: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
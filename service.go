@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultServiceDescription is the description the service gives of itself
+// when none is configured.
+const defaultServiceDescription = "Stores the Discovery Environment's user preferences."
+
+// serviceIdentity is how the service names and describes itself.
+type serviceIdentity struct {
+	name        string
+	description string
+}
+
+// serviceDescriptor is the JSON body returned from the root of the service,
+// which tooling that lists the DE's services scrapes.
+type serviceDescriptor struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Version     string            `json:"version"`
+	Links       map[string]string `json:"links"`
+}
+
+// serviceLinks are the links to the service's operational endpoints included
+// in the descriptor.
+var serviceLinks = map[string]string{
+	"health":  "/healthz",
+	"ready":   "/readyz",
+	"metrics": "/metrics",
+	"version": "/version",
+	"openapi": "/openapi.json",
+}
+
+// prefersPlainText returns whether the request's Accept header ranks
+// text/plain above JSON.
+func prefersPlainText(r *http.Request) bool {
+	var textQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "text/plain":
+			if q > textQ {
+				textQ = q
+			}
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return textQ > jsonQ
+}
+
+// Greeting handles requests for the root of the service, which describes the
+// service and links to its operational endpoints. Clients that ask for plain
+// text get the traditional greeting instead.
+func (u *UserPreferencesApp) Greeting(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Add("Vary", "Accept")
+
+	if prefersPlainText(r) {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(writer, "Hello from %s.", u.identity.name)
+		return
+	}
+
+	jsoned, err := json.Marshal(&serviceDescriptor{
+		Name:        u.identity.name,
+		Description: u.identity.description,
+		Version:     serviceVersion(),
+		Links:       prefixedLinks(r, serviceLinks),
+	})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating the service descriptor JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
+
+// HealthRequest handles reporting that the service is alive. Unlike the
+// readiness endpoint, it doesn't depend on the database.
+func (u *UserPreferencesApp) HealthRequest(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(`{"status":"ok"}`))
+}
+
+// OpenAPIRequest handles getting the OpenAPI description of the service.
+func (u *UserPreferencesApp) OpenAPIRequest(writer http.ResponseWriter, r *http.Request) {
+	if len(u.openapi) == 0 {
+		notFound(writer, "The OpenAPI description isn't available")
+		return
+	}
+
+	spec := u.openapi
+	if prefix := pathPrefix(r); prefix != "" {
+		spec = withServerURL(spec, prefix)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(spec)
+}
+
+// loadOpenAPI reads the OpenAPI description served by the service, in place of
+// the embedded one. The embedded description is kept, with a warning, if the
+// file can't be read.
+func (u *UserPreferencesApp) loadOpenAPI(path string) {
+	spec, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warnf("Not serving the OpenAPI description: %s", err)
+		return
+	}
+	u.openapi = spec
+}
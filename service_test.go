@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGreetingDescriptor(t *testing.T) {
+	n := New(NewMockDB())
+	n.identity = serviceIdentity{name: "prefs", description: "Preferences for testing."}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/", nil, map[string]string{"Accept": "application/json"})
+	if status != http.StatusOK {
+		t.Fatalf("the greeting returned %d: %s", status, body)
+	}
+
+	var descriptor serviceDescriptor
+	if err := json.Unmarshal(body, &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.Name != "prefs" || descriptor.Description != "Preferences for testing." || descriptor.Version != serviceVersion() {
+		t.Errorf("the descriptor was %+v", descriptor)
+	}
+	if descriptor.Links["health"] != "/healthz" || descriptor.Links["openapi"] != "/openapi.json" {
+		t.Errorf("the descriptor's links were %v", descriptor.Links)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/", nil, map[string]string{"Accept": "text/plain"})
+	if status != http.StatusOK || string(body) != "Hello from prefs." {
+		t.Errorf("the plain text greeting returned %d: %s", status, body)
+	}
+}
+
+func TestPrefersPlainText(t *testing.T) {
+	tests := map[string]bool{
+		"":                                   false,
+		"*/*":                                false,
+		"text/plain":                         true,
+		"application/json":                   false,
+		"text/plain, application/json":       false,
+		"application/json;q=0.5, text/plain": true,
+		"text/plain;q=0.2, */*;q=0.1":        true,
+	}
+	for accept, expected := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		if actual := prefersPlainText(r); actual != expected {
+			t.Errorf("prefersPlainText(%q) returned %t", accept, actual)
+		}
+	}
+}
+
+func TestHealthRequest(t *testing.T) {
+	n := New(NewMockDB())
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/healthz", nil, nil)
+	if status != http.StatusOK || string(body) != `{"status":"ok"}` {
+		t.Errorf("the health check returned %d: %s", status, body)
+	}
+}
+
+func TestOpenAPIRequest(t *testing.T) {
+	n := New(NewMockDB())
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	expected, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := doRequest(t, http.MethodGet, server.URL+"/openapi.json", nil, nil)
+	if status != http.StatusOK || string(body) != string(expected) {
+		t.Errorf("the embedded OpenAPI description returned %d and didn't match openapi.json", status)
+	}
+
+	override := filepath.Join(t.TempDir(), "openapi.json")
+	if err = ioutil.WriteFile(override, []byte(`{"openapi":"3.0.3"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n.loadOpenAPI(override)
+	if status, body = doRequest(t, http.MethodGet, server.URL+"/openapi.json", nil, nil); status != http.StatusOK || string(body) != `{"openapi":"3.0.3"}` {
+		t.Errorf("the configured OpenAPI description returned %d: %s", status, body)
+	}
+
+	n.loadOpenAPI(filepath.Join(t.TempDir(), "missing.json"))
+	if status, body = doRequest(t, http.MethodGet, server.URL+"/openapi.json", nil, nil); status != http.StatusOK || string(body) != `{"openapi":"3.0.3"}` {
+		t.Errorf("a missing OpenAPI description replaced the loaded one: %d", status)
+	}
+
+	n.openapi = nil
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/openapi.json", nil, nil); status != http.StatusNotFound {
+		t.Errorf("the missing OpenAPI description returned %d", status)
+	}
+}
+
+// TestOpenAPIPaths checks that openapi.json describes every route, so that it
+// doesn't fall behind the router.
+func TestOpenAPIPaths(t *testing.T) {
+	contents, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spec struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err = json.Unmarshal(contents, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(NewMockDB())
+	err = n.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		if _, ok := spec.Paths[template]; !ok {
+			t.Errorf("openapi.json doesn't describe %s", template)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
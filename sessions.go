@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SessionRecord represents the preferences stored for an anonymous session.
+type SessionRecord struct {
+	Token       string
+	Preferences string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// sessionResponse is the JSON body returned by the session endpoints.
+type sessionResponse struct {
+	Token       string                 `json:"token"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+	Preferences map[string]interface{} `json:"preferences"`
+}
+
+// createSession stores a new session.
+func (p *PrefsDB) createSession(token, prefs string, expiresAt time.Time) error {
+	query := `INSERT INTO user_preferences_sessions (token, preferences, expires_at)
+                   VALUES ($1, $2, $3)`
+	_, err := p.db.Exec(query, token, prefs, expiresAt)
+	return err
+}
+
+// getSession returns the session with the given token. sql.ErrNoRows is
+// returned if the session doesn't exist or has expired.
+func (p *PrefsDB) getSession(token string) (*SessionRecord, error) {
+	query := `SELECT token,
+                   preferences,
+                   created_at,
+                   expires_at
+              FROM user_preferences_sessions
+             WHERE token = $1
+               AND expires_at > now()`
+
+	var session SessionRecord
+	err := p.db.QueryRow(query, token).Scan(
+		&session.Token,
+		&session.Preferences,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// updateSession replaces the preferences for the session and extends its
+// expiration time.
+func (p *PrefsDB) updateSession(token, prefs string, expiresAt time.Time) error {
+	query := `UPDATE user_preferences_sessions
+                 SET preferences = $2,
+                     expires_at = $3
+               WHERE token = $1`
+	_, err := p.db.Exec(query, token, prefs, expiresAt)
+	return err
+}
+
+// deleteSession removes the session.
+func (p *PrefsDB) deleteSession(token string) error {
+	query := `DELETE FROM user_preferences_sessions WHERE token = $1`
+	_, err := p.db.Exec(query, token)
+	return err
+}
+
+// purgeSessions deletes the sessions that expired before the given time and
+// returns the number that were deleted.
+func (p *PrefsDB) purgeSessions(before time.Time) (int64, error) {
+	query := `DELETE FROM user_preferences_sessions WHERE expires_at <= $1`
+	result, err := p.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// newSessionToken returns a random, unguessable session token.
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// lookupSession loads the session for the token in the URL, writing out an
+// error response and returning false if that isn't possible.
+func (u *UserPreferencesApp) lookupSession(writer http.ResponseWriter, token string) (*SessionRecord, map[string]interface{}, bool) {
+	session, err := u.prefs.getSession(token)
+	if err == sql.ErrNoRows {
+		notFound(writer, "Session does not exist or has expired")
+		return nil, nil, false
+	}
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting session: %s", err))
+		return nil, nil, false
+	}
+
+	values, err := presetValues(session.Preferences)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error parsing session preferences: %s", err))
+		return nil, nil, false
+	}
+
+	return session, values, true
+}
+
+func writeSession(writer http.ResponseWriter, token string, expiresAt time.Time, values map[string]interface{}) {
+	jsoned, err := json.Marshal(&sessionResponse{
+		Token:       token,
+		ExpiresAt:   expiresAt,
+		Preferences: values,
+	})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating session JSON: %s", err))
+		return
+	}
+	writer.Write(jsoned)
+}
+
+// readSessionBody parses the request body into a preferences document. An
+// empty body is treated as an empty document.
+func readSessionBody(writer http.ResponseWriter, r *http.Request) (map[string]interface{}, string, bool) {
+	values, err := readDocument(r.Body)
+	if err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return nil, "", false
+	}
+
+	jsoned, err := json.Marshal(values)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating session JSON: %s", err))
+		return nil, "", false
+	}
+
+	return values, string(jsoned), true
+}
+
+// CreateSessionRequest handles creating a new anonymous session, optionally
+// with initial preferences, and returns its token.
+func (u *UserPreferencesApp) CreateSessionRequest(writer http.ResponseWriter, r *http.Request) {
+	values, prefs, ok := readSessionBody(writer, r)
+	if !ok {
+		return
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating session token: %s", err))
+		return
+	}
+
+	expiresAt := time.Now().Add(u.sessionTTL)
+	if err = u.prefs.createSession(token, prefs, expiresAt); err != nil {
+		errored(writer, fmt.Sprintf("Error creating session: %s", err))
+		return
+	}
+
+	writer.Header().Set("Location", externalPath(r, "/sessions/"+token))
+	writer.WriteHeader(http.StatusCreated)
+	writeSession(writer, token, expiresAt, values)
+}
+
+// GetSessionRequest handles writing out a session's preferences.
+func (u *UserPreferencesApp) GetSessionRequest(writer http.ResponseWriter, r *http.Request) {
+	session, values, ok := u.lookupSession(writer, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+	writeSession(writer, session.Token, session.ExpiresAt, values)
+}
+
+// PutSessionRequest handles replacing a session's preferences, which also
+// extends the session's expiration time. A POST in version 2 of the API merges
+// the body into the session's preferences instead.
+func (u *UserPreferencesApp) PutSessionRequest(writer http.ResponseWriter, r *http.Request) {
+	session, _, ok := u.lookupSession(writer, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+
+	values, prefs, ok := readSessionBody(writer, r)
+	if !ok {
+		return
+	}
+
+	if mergesOnPost(r) {
+		merged, err := u.postedValues(r, session.Preferences, values)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error parsing session preferences: %s", err))
+			return
+		}
+		jsoned, err := json.Marshal(merged)
+		if err != nil {
+			errored(writer, fmt.Sprintf("Error generating session JSON: %s", err))
+			return
+		}
+		values, prefs = merged, string(jsoned)
+	}
+
+	expiresAt := time.Now().Add(u.sessionTTL)
+	if err := u.prefs.updateSession(session.Token, prefs, expiresAt); err != nil {
+		errored(writer, fmt.Sprintf("Error updating session: %s", err))
+		return
+	}
+
+	writeSession(writer, session.Token, expiresAt, values)
+}
+
+// DeleteSessionRequest handles deleting a session.
+func (u *UserPreferencesApp) DeleteSessionRequest(writer http.ResponseWriter, r *http.Request) {
+	if err := u.prefs.deleteSession(mux.Vars(r)["token"]); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting session: %s", err))
+	}
+}
+
+// AdoptSessionRequest handles merging a session's preferences into a user's
+// preferences and deleting the session. Values the user has already stored
+// take precedence over the session's values.
+func (u *UserPreferencesApp) AdoptSessionRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	session, sessionValues, ok := u.lookupSession(writer, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+
+	log.Infof("Adopting a session's preferences for %s", username)
+	values, err := u.loadPreferences(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	merged, ok := u.applyLocks(writer, r, username, mergePreferences(sessionValues, values))
+	if !ok {
+		return
+	}
+
+	merged, ok = u.scanWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	merged, ok = u.filterWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	warnings, ok := u.validateWrite(writer, username, merged)
+	if !ok {
+		return
+	}
+
+	created, err := u.storePreferences(username, merged)
+	if err != nil {
+		storeFailed(writer, err)
+		return
+	}
+
+	if err = u.prefs.deleteSession(session.Token); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting adopted session: %s", err))
+		return
+	}
+
+	u.writeStoredPreferences(writer, r, username, created, warnings)
+}
+
+// purgeSessions removes the sessions that have expired.
+func (u *UserPreferencesApp) purgeSessions(now time.Time) (int, error) {
+	purged, err := u.prefs.purgeSessions(now)
+	if err != nil {
+		return 0, fmt.Errorf("Error purging expired sessions: %s", err)
+	}
+	return int(purged), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSessionRequests(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.sessionTTL = time.Hour
+
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodPost, fmt.Sprintf("%s/sessions", server.URL), []byte(`{"theme":"dark"}`), nil)
+	if status != http.StatusCreated {
+		t.Fatalf("creating a session returned %d instead of %d", status, http.StatusCreated)
+	}
+
+	var created sessionResponse
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(created.Token) != 64 {
+		t.Errorf("token was '%s'", created.Token)
+	}
+
+	if created.Preferences["theme"] != "dark" {
+		t.Errorf("preferences were %#v", created.Preferences)
+	}
+
+	url := fmt.Sprintf("%s/sessions/%s", server.URL, created.Token)
+
+	status, body = doRequest(t, http.MethodPut, url, []byte(`{"theme":"light"}`), nil)
+	if status != http.StatusOK {
+		t.Errorf("updating a session returned %d instead of %d", status, http.StatusOK)
+	}
+
+	status, body = doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("getting a session returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var fetched sessionResponse
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Preferences["theme"] != "light" {
+		t.Errorf("preferences were %#v after an update", fetched.Preferences)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, url, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("deleting a session returned %d instead of %d", status, http.StatusOK)
+	}
+
+	status, _ = doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("getting a deleted session returned %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, _ = doRequest(t, http.MethodPut, url, []byte(`{}`), nil)
+	if status != http.StatusNotFound {
+		t.Errorf("updating a deleted session returned %d instead of %d", status, http.StatusNotFound)
+	}
+}
+
+func TestAdoptSessionRequest(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	if err := mock.insertPreferences(username, `{"theme":"light"}`); err != nil {
+		t.Error(err)
+	}
+	if err := mock.createSession("token", `{"theme":"dark","layout":"grid"}`, time.Now().Add(time.Hour)); err != nil {
+		t.Error(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodPost, fmt.Sprintf("%s/%s/adopt-session/token", server.URL, username), nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("adopting a session returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"theme": "light", "layout": "grid"}
+	if !reflect.DeepEqual(parsed["preferences"], expected) {
+		t.Errorf("preferences were %#v instead of %#v", parsed["preferences"], expected)
+	}
+
+	if _, ok := mock.sess["token"]; ok {
+		t.Error("the adopted session was not deleted")
+	}
+
+	status, _ = doRequest(t, http.MethodPost, fmt.Sprintf("%s/%s/adopt-session/token", server.URL, username), nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("adopting a deleted session returned %d instead of %d", status, http.StatusNotFound)
+	}
+}
+
+func TestPurgeSessions(t *testing.T) {
+	mock := NewMockDB()
+	now := time.Now()
+	mock.createSession("expired", "{}", now.Add(-time.Minute))
+	mock.createSession("current", "{}", now.Add(time.Minute))
+
+	purged, err := New(mock).purgeSessions(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Errorf("%d sessions were purged instead of 1", purged)
+	}
+
+	if _, ok := mock.sess["current"]; !ok {
+		t.Error("a current session was purged")
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT token, preferences, created_at, expires_at FROM user_preferences_sessions WHERE token = (.+) AND expires_at > now\\(\\)").
+		WithArgs("token").
+		WillReturnRows(sqlmock.NewRows([]string{"token", "preferences", "created_at", "expires_at"}).AddRow("token", "{}", now, now))
+
+	session, err := p.getSession("token")
+	if err != nil {
+		t.Fatalf("error from getSession(): %s", err)
+	}
+
+	if session.Token != "token" || session.Preferences != "{}" {
+		t.Errorf("session was %#v", session)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
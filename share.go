@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// shareClaims is the signed payload of a share token: the tenant and user
+// whose preferences may be read, the keys that may be read, and when the token
+// expires. The tenant is empty unless tenants are configured.
+type shareClaims struct {
+	Tenant    string   `json:"t,omitempty"`
+	Username  string   `json:"u"`
+	Keys      []string `json:"k"`
+	ExpiresAt int64    `json:"e"`
+}
+
+// ShareSigner mints and verifies share tokens. A token is the base64url
+// encoding of its claims and of their HMAC-SHA256 signature, separated by a
+// dot, so no state needs to be stored for it. The tenants share the signing
+// secret, so a signer only accepts the tokens minted for its own tenant.
+type ShareSigner struct {
+	secret []byte
+	maxTTL time.Duration
+	tenant string
+}
+
+// NewShareSigner returns a newly created *ShareSigner. Tokens may be valid for
+// at most maxTTL.
+func NewShareSigner(secret string, maxTTL time.Duration) *ShareSigner {
+	return &ShareSigner{secret: []byte(secret), maxTTL: maxTTL}
+}
+
+// signature returns the signature of the encoded claims.
+func (s *ShareSigner) signature(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Mint returns a token allowing the keys of the user's preferences to be read
+// until expiresAt.
+func (s *ShareSigner) Mint(username string, keys []string, expiresAt time.Time) (string, error) {
+	jsoned, err := json.Marshal(shareClaims{Tenant: s.tenant, Username: username, Keys: keys, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(jsoned)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.signature(payload)), nil
+}
+
+// Verify returns the claims of the token if its signature is valid, it was
+// minted for the signer's tenant, and it hasn't expired.
+func (s *ShareSigner) Verify(token string, now time.Time) (*shareClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Malformed share token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.signature(parts[0])) {
+		return nil, fmt.Errorf("Invalid share token")
+	}
+
+	jsoned, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed share token")
+	}
+
+	var claims shareClaims
+	if err = json.Unmarshal(jsoned, &claims); err != nil {
+		return nil, fmt.Errorf("Malformed share token")
+	}
+	if claims.Tenant != s.tenant {
+		return nil, fmt.Errorf("The share token was minted for a different tenant")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("The share token has expired")
+	}
+	return &claims, nil
+}
+
+// shareRequest is the JSON body accepted by the share endpoint. TTL is a
+// duration such as 30m and defaults to an hour.
+type shareRequest struct {
+	Keys []string `json:"keys"`
+	TTL  string   `json:"ttl"`
+}
+
+// shareResponse is the JSON body returned after minting a share token.
+type shareResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	Keys      []string  `json:"keys"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// defaultShareTTL is how long share tokens are valid for if the request
+// doesn't say.
+const defaultShareTTL = time.Hour
+
+// sharedKeys validates and normalizes the requested keys: each must be a
+// non-empty dotted key path, and duplicates are removed.
+func sharedKeys(keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("At least one key must be shared")
+	}
+
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		for _, part := range splitPath(key) {
+			if part == "" {
+				return nil, fmt.Errorf("Invalid key %q", key)
+			}
+		}
+		if !seen[key] {
+			seen[key] = true
+			normalized = append(normalized, key)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// ShareRequest handles minting a token that grants read-only access to some of
+// a user's preferences until it expires.
+func (u *UserPreferencesApp) ShareRequest(writer http.ResponseWriter, r *http.Request) {
+	if u.share == nil {
+		notFound(writer, "Sharing preferences is not enabled")
+		return
+	}
+
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var body shareRequest
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	keys, err := sharedKeys(body.Keys)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	ttl := defaultShareTTL
+	if body.TTL != "" {
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl <= 0 {
+			badRequest(writer, fmt.Sprintf("Invalid ttl %q", body.TTL))
+			return
+		}
+	}
+	if ttl > u.share.maxTTL {
+		badRequest(writer, fmt.Sprintf("The ttl may be at most %s", u.share.maxTTL))
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := u.share.Mint(username, keys, expiresAt)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error minting share token for user %s: %s", username, err))
+		return
+	}
+
+	err = u.audit("share", map[string]string{
+		"user":       username,
+		"keys":       strings.Join(keys, ","),
+		"expires_at": strconv.FormatInt(expiresAt.Unix(), 10),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+
+	jsoned, err := json.Marshal(&shareResponse{
+		Token:     token,
+		URL:       externalPath(r, "/shared/"+url.PathEscape(token)),
+		Keys:      keys,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating share JSON: %s", err))
+		return
+	}
+
+	writer.WriteHeader(http.StatusCreated)
+	writer.Write(jsoned)
+}
+
+// SharedRequest handles writing out the keys of a user's preferences that a
+// share token grants access to. Shared keys the user hasn't set are left out.
+func (u *UserPreferencesApp) SharedRequest(writer http.ResponseWriter, r *http.Request) {
+	if u.share == nil {
+		notFound(writer, "Sharing preferences is not enabled")
+		return
+	}
+
+	claims, err := u.share.Verify(mux.Vars(r)["token"], time.Now())
+	if err != nil {
+		forbidden(writer, err.Error())
+		return
+	}
+
+	values, err := u.loadPreferences(claims.Username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+	if values, err = u.applyComputed(claims.Username, values, false); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	shared := make(map[string]interface{})
+	for _, key := range claims.Keys {
+		if value, ok := getPath(values, key); ok {
+			setPath(shared, key, deepCopy(value))
+		}
+	}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	if err = writeDocument(writer, r, http.StatusOK, shared); err != nil {
+		log.Errorf("Error writing shared preferences for user %s: %s", claims.Username, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSigner(t *testing.T) {
+	signer := NewShareSigner("secret", time.Hour)
+	now := time.Now()
+
+	token, err := signer.Mint("alice", []string{"ui.theme"}, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := signer.Verify(token, now)
+	if err != nil || claims.Username != "alice" || !reflect.DeepEqual(claims.Keys, []string{"ui.theme"}) {
+		t.Errorf("Verify returned %#v, %v", claims, err)
+	}
+
+	if _, err = signer.Verify(token, now.Add(time.Minute)); err == nil {
+		t.Error("an expired token was accepted")
+	}
+
+	if _, err = NewShareSigner("other", time.Hour).Verify(token, now); err == nil {
+		t.Error("a token signed with another secret was accepted")
+	}
+
+	forged, _ := NewShareSigner("other", time.Hour).Mint("alice", []string{"ui"}, now.Add(time.Minute))
+	parts := strings.Split(token, ".")
+	if _, err = signer.Verify(strings.Split(forged, ".")[0]+"."+parts[1], now); err == nil {
+		t.Error("a token with modified claims was accepted")
+	}
+
+	other := NewShareSigner("secret", time.Hour)
+	other.tenant = "other"
+	if _, err = other.Verify(token, now); err == nil {
+		t.Error("a token minted for another tenant was accepted")
+	}
+	if token, err = other.Mint("alice", []string{"ui.theme"}, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if claims, err = other.Verify(token, now); err != nil || claims.Tenant != "other" {
+		t.Errorf("Verify returned %#v, %v for the tenant's own token", claims, err)
+	}
+	if _, err = signer.Verify(token, now); err == nil {
+		t.Error("a tenant's token was accepted without tenants")
+	}
+
+	for _, malformed := range []string{"", "abc", "a.b.c", "!!!.???"} {
+		if _, err = signer.Verify(malformed, now); err == nil {
+			t.Errorf("the token %q was accepted", malformed)
+		}
+	}
+}
+
+func TestSharedKeys(t *testing.T) {
+	keys, err := sharedKeys([]string{"ui.theme", " columns ", "ui.theme"})
+	if err != nil || !reflect.DeepEqual(keys, []string{"columns", "ui.theme"}) {
+		t.Errorf("sharedKeys returned %#v, %v", keys, err)
+	}
+
+	for _, invalid := range [][]string{nil, {""}, {"ui..theme"}, {"ui."}} {
+		if _, err = sharedKeys(invalid); err == nil {
+			t.Errorf("the keys %#v were accepted", invalid)
+		}
+	}
+}
+
+func TestShareRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"ui":{"theme":"dark","secret":"x"},"columns":3,"private":true}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"keys":["ui.theme","columns","missing"],"ttl":"10m"}`)
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice/share", body, nil); status != http.StatusNotFound {
+		t.Errorf("sharing returned %d while it was disabled", status)
+	}
+
+	n.share = NewShareSigner("secret", time.Hour)
+
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/alice/share", []byte(`{"keys":["ui"],"ttl":"2h"}`), nil); status != http.StatusBadRequest {
+		t.Errorf("a ttl over the maximum returned %d", status)
+	}
+
+	if status, _ := doRequest(t, http.MethodPost, server.URL+"/bob/share", body, nil); status != http.StatusBadRequest {
+		t.Errorf("sharing for an unknown user returned %d", status)
+	}
+
+	status, resBody := doRequest(t, http.MethodPost, server.URL+"/alice/share", body, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("sharing returned %d: %s", status, resBody)
+	}
+
+	var shared shareResponse
+	if err := json.Unmarshal(resBody, &shared); err != nil {
+		t.Fatal(err)
+	}
+	if shared.URL != "/shared/"+shared.Token || time.Until(shared.ExpiresAt) > 10*time.Minute {
+		t.Errorf("the share response was %#v", shared)
+	}
+	if len(mock.audits) != 1 || !strings.HasPrefix(mock.audits[0], "share ") {
+		t.Errorf("the audit log was %#v", mock.audits)
+	}
+
+	status, resBody = doRequest(t, http.MethodGet, server.URL+shared.URL, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("reading the shared preferences returned %d: %s", status, resBody)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(resBody, &values); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"ui": map[string]interface{}{"theme": "dark"}, "columns": 3.0}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("the shared preferences were %#v", values)
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+shared.URL+"x", nil, nil); status != http.StatusForbidden {
+		t.Errorf("a tampered token returned %d", status)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// flight is a call in progress, or just completed, for a flightGroup key.
+type flight struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// flightGroup deduplicates concurrent calls with the same key: while a call
+// for a key is in progress, other callers for that key wait for it and share
+// its result instead of making their own call. The zero value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do makes the call for the key, or waits for the call already in progress
+// for it. The returned bool is true if the result came from another caller's
+// call.
+func (g *flightGroup) do(key string, call func() (interface{}, error)) (interface{}, error, bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.result, f.err, true
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.result, f.err = call()
+	return f.result, f.err, false
+}
+
+// forget stops later callers for the key from sharing the result of the call
+// in progress for it, which may have started before a change that it doesn't
+// reflect. Callers that are already waiting still get its result.
+func (g *flightGroup) forget(key string) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+}
+
+// forgetAll is forget for every key.
+func (g *flightGroup) forgetAll() {
+	g.mu.Lock()
+	g.flights = nil
+	g.mu.Unlock()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// routed returns whether the request matches one of the routes.
+func (u *UserPreferencesApp) routed(r *http.Request) bool {
+	var match mux.RouteMatch
+	return u.router.Match(r, &match)
+}
+
+// withoutTrailingSlash returns the request with the trailing slash removed from
+// its path if the path doesn't match a route but would without the slash, so
+// that /alice/ is handled like /alice. Routes that end in a slash, such as
+// /admin/ui/, keep it. The request is returned unchanged otherwise.
+func (u *UserPreferencesApp) withoutTrailingSlash(r *http.Request) *http.Request {
+	path := r.URL.Path
+	if path == "/" || !strings.HasSuffix(path, "/") || u.routed(r) {
+		return r
+	}
+
+	trimmed := *r.URL
+	trimmed.Path = strings.TrimRight(path, "/")
+	if trimmed.Path == "" {
+		return r
+	}
+	if trimmed.RawPath != "" {
+		trimmed.RawPath = strings.TrimRight(trimmed.RawPath, "/")
+	}
+
+	candidate := r.WithContext(r.Context())
+	candidate.URL = &trimmed
+	if !u.routed(candidate) {
+		return r
+	}
+	return candidate
+}
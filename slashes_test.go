@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrailingSlashes(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	if err := mock.insertPreferences("alice", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	for _, path := range []string{"/alice", "/alice/", "/v2/alice/", "/alice/keys/"} {
+		status, body := doRequest(t, http.MethodGet, server.URL+path, nil, nil)
+		if status != http.StatusOK || !strings.Contains(string(body), "theme") {
+			t.Errorf("GET %s returned %d: %s", path, status, body)
+		}
+	}
+
+	status, body := doRequest(t, http.MethodPut, server.URL+"/alice/", []byte(`{"theme":"light"}`), nil)
+	if status != http.StatusOK || !strings.Contains(string(body), "light") {
+		t.Errorf("PUT /alice/ returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/alice/nonexistent/", nil, nil); status != http.StatusNotFound {
+		t.Errorf("GET of an unknown route with a trailing slash returned %d", status)
+	}
+}
+
+func TestWithoutTrailingSlashKeepsSlashedRoutes(t *testing.T) {
+	n := New(NewMockDB())
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/ui/", nil)
+	if trimmed := n.withoutTrailingSlash(r); trimmed.URL.Path != "/admin/ui/" {
+		t.Errorf("the path of a route ending in a slash became %s", trimmed.URL.Path)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	if trimmed := n.withoutTrailingSlash(r); trimmed.URL.Path != "/" {
+		t.Errorf("the root path became %s", trimmed.URL.Path)
+	}
+}
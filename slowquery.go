@@ -0,0 +1,71 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// slowQueryMetrics counts the slow database calls by operation. It's
+// published at /debug/vars.
+var slowQueryMetrics = expvar.NewMap("slow_queries")
+
+// recordSlowQuery logs and counts a database call that took longer than the
+// slow query threshold.
+func (r *ResilientDB) recordSlowQuery(username string, elapsed time.Duration, err error) {
+	operation := databaseOperation()
+	databaseMetrics.Add(r.breaker.name+".slow_queries", 1)
+	slowQueryMetrics.Add(operation, 1)
+
+	fields := Fields{
+		"database":    r.breaker.name,
+		"operation":   operation,
+		"duration_ms": elapsed.Nanoseconds() / int64(time.Millisecond),
+	}
+	if username != "" {
+		fields["user"] = username
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	log.WithFields(fields).Warnf("Slow database call %s took %s", operation, elapsed.Round(time.Millisecond))
+}
+
+// retryWrappers are the ResilientDB methods that make the calls on behalf of
+// the DB methods.
+var retryWrappers = map[string]bool{
+	"do":              true,
+	"doFor":           true,
+	"change":          true,
+	"changeFor":       true,
+	"write":           true,
+	"writeFor":        true,
+	"try":             true,
+	"recordSlowQuery": true,
+}
+
+// databaseOperation returns the name of the DB method being called, found by
+// walking up the stack to the first ResilientDB method that isn't one of the
+// retry wrappers.
+func databaseOperation() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		if i := strings.Index(name, "(*ResilientDB)."); i >= 0 {
+			name = name[i+len("(*ResilientDB)."):]
+			if dot := strings.Index(name, "."); dot >= 0 {
+				// Drop the suffix of a closure within the method.
+				name = name[:dot]
+			}
+			if !retryWrappers[name] {
+				return name
+			}
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowDB takes a while to look up users.
+type slowDB struct {
+	*MockDB
+	delay time.Duration
+}
+
+func (s *slowDB) isUser(username string) (bool, error) {
+	time.Sleep(s.delay)
+	return s.MockDB.isUser(username)
+}
+
+func TestSlowQueryLogging(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log
+	log = NewLogger(&buf, serviceName, InfoLevel)
+	defer func() { log = saved }()
+
+	slow := &slowDB{MockDB: NewMockDB(), delay: 20 * time.Millisecond}
+	r := NewResilientDB(slow, NewCircuitBreaker("test-slow", 5, time.Minute), 0, 0)
+	r.slowQuery = 10 * time.Millisecond
+
+	before := slowQueryCount(t, "isUser")
+	if _, err := r.isUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if count := slowQueryCount(t, "isUser"); count != before+1 {
+		t.Errorf("the slow isUser count went from %d to %d", before, count)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &entry); err != nil {
+		t.Fatalf("the log was %q: %s", buf.String(), err)
+	}
+	if entry["level"] != "WARN" || entry["operation"] != "isUser" || entry["user"] != "alice" || entry["database"] != "test-slow" {
+		t.Errorf("the entry was %v", entry)
+	}
+	if ms, _ := entry["duration_ms"].(float64); ms < 20 {
+		t.Errorf("the duration was %v", entry["duration_ms"])
+	}
+
+	buf.Reset()
+	slow.delay = 0
+	if _, err := r.isUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	r.slowQuery = 0
+	slow.delay = 20 * time.Millisecond
+	if _, err := r.isUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("a fast or unmonitored call was logged: %s", buf.String())
+	}
+}
+
+// slowQueryCount returns the number of slow calls counted for the operation.
+func slowQueryCount(t *testing.T, operation string) int64 {
+	v := slowQueryMetrics.Get(operation)
+	if v == nil {
+		return 0
+	}
+	var count int64
+	if err := json.Unmarshal([]byte(v.String()), &count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
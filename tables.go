@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// TableNames are the names of the tables and columns that deployments may have
+// renamed. The storage builds them into its queries when it's created, and the
+// migrations are templates that they're filled in to.
+type TableNames struct {
+	// Preferences is the table holding the preferences documents.
+	Preferences string
+
+	// Users is the table of users shared with the other services, and UserID
+	// and Username are its ID and username columns.
+	Users    string
+	UserID   string
+	Username string
+}
+
+// defaultTableNames are the names the service's queries are written with.
+var defaultTableNames = TableNames{
+	Preferences: "user_preferences",
+	Users:       "users",
+	UserID:      "id",
+	Username:    "username",
+}
+
+// tables holds the names used by the database connections. It's set from the
+// configuration at startup.
+var tables = defaultTableNames
+
+// validTable matches the table names that can be used without quoting,
+// optionally qualified with a schema.
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+// tableNamesConfig returns the table and column names in the configuration.
+func tableNamesConfig(cfg *viper.Viper) (TableNames, error) {
+	names := TableNames{
+		Preferences: cfg.GetString("user-preferences.database.tables.preferences"),
+		Users:       cfg.GetString("user-preferences.database.tables.users"),
+		UserID:      cfg.GetString("user-preferences.database.tables.users-id"),
+		Username:    cfg.GetString("user-preferences.database.tables.users-username"),
+	}
+	for _, table := range []string{names.Preferences, names.Users} {
+		if !validTable.MatchString(table) {
+			return names, fmt.Errorf("Invalid table name %q", table)
+		}
+	}
+	for _, column := range []string{names.UserID, names.Username} {
+		if !validSchema.MatchString(column) {
+			return names, fmt.Errorf("Invalid column name %q", column)
+		}
+	}
+	return names, nil
+}
+
+// relnames returns the unqualified names of the preferences and users tables,
+// as they appear in the Postgres catalogs.
+func (t TableNames) relnames() []string {
+	relname := func(table string) string {
+		return table[strings.LastIndex(table, ".")+1:]
+	}
+	return []string{relname(t.Users), relname(t.Preferences)}
+}
+
+// usersSource returns the users table as queries select from it. If its
+// columns have been renamed, it's a subquery that gives them their default
+// names, so the queries can use id and username either way. It has to be given
+// an alias.
+func (t TableNames) usersSource() string {
+	if t.UserID == defaultTableNames.UserID && t.Username == defaultTableNames.Username {
+		return t.Users
+	}
+	return fmt.Sprintf("(SELECT %s AS id, %s AS username FROM %s)", t.UserID, t.Username, t.Users)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUsersSource(t *testing.T) {
+	if source := defaultTableNames.usersSource(); source != "users" {
+		t.Errorf("the default users table was selected from as %s", source)
+	}
+
+	names := defaultTableNames
+	names.Users = "de.de_users"
+	if source := names.usersSource(); source != "de.de_users" {
+		t.Errorf("the renamed users table was selected from as %s", source)
+	}
+
+	names.UserID = "user_id"
+	names.Username = "login"
+	if source := names.usersSource(); source != "(SELECT user_id AS id, login AS username FROM de.de_users)" {
+		t.Errorf("the users table with renamed columns was selected from as %s", source)
+	}
+}
+
+func TestRenamedTableQueries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	p.tables = TableNames{Preferences: "prefs", Users: "de.de_users", UserID: "user_id", Username: "login"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM ( SELECT DISTINCT user_id FROM de.de_users WHERE login = $1 ) AS check_user")).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM prefs p, (SELECT user_id AS id, login AS username FROM de.de_users) u WHERE p.user_id = u.id")).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences", "encoding", "compressed", "checksum", "created_at", "modified_at", "version"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM de.de_users WHERE login = $1")).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("alice-id"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM ONLY prefs WHERE user_id = $1")).
+		WithArgs("alice-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if exists, err := p.isUser("alice"); err != nil || !exists {
+		t.Errorf("isUser returned %t, %v", exists, err)
+	}
+	if _, err = p.getPreferences("alice"); err != nil {
+		t.Error(err)
+	}
+	if err = p.deletePreferences("alice"); err != nil {
+		t.Error(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTableNamesConfig(t *testing.T) {
+	names, err := tableNamesConfig(testConfig(t, ""))
+	if err != nil || names != defaultTableNames {
+		t.Errorf("the default configuration returned %+v, %v", names, err)
+	}
+
+	cfg := testConfig(t, "user-preferences:\n  database:\n    tables:\n      users: de.de_users\n      users-id: user_id\n")
+	names, err = tableNamesConfig(cfg)
+	if err != nil || names.Users != "de.de_users" || names.UserID != "user_id" || names.Username != "username" {
+		t.Errorf("the configuration returned %+v, %v", names, err)
+	}
+	if relnames := names.relnames(); !reflect.DeepEqual(relnames, []string{"de_users", "user_preferences"}) {
+		t.Errorf("the relnames were %v", relnames)
+	}
+
+	invalid := []string{
+		"user-preferences:\n  database:\n    tables:\n      users: \"users; DROP TABLE users\"\n",
+		"user-preferences:\n  database:\n    tables:\n      preferences: a.b.c\n",
+		"user-preferences:\n  database:\n    tables:\n      users-username: \"\"\n",
+	}
+	for _, yaml := range invalid {
+		if names, err = tableNamesConfig(testConfig(t, yaml)); err == nil {
+			t.Errorf("the names %+v were accepted", names)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expandParam is the query parameter that asks for template variables in the
+// returned preferences to be expanded.
+const expandParam = "expand"
+
+// templateVariable matches a variable reference such as {{username}} or
+// {{ home_dir }}.
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// VariableSource defines the interface for looking up the template variables
+// for a user.
+type VariableSource interface {
+	variablesFor(username string) (map[string]string, error)
+}
+
+// HTTPVariableSource implements the VariableSource interface by fetching a
+// JSON object of variables for the user from an HTTP endpoint. The URL may
+// refer to the {{username}} variable.
+type HTTPVariableSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPVariableSource returns a newly created *HTTPVariableSource.
+func NewHTTPVariableSource(url string) *HTTPVariableSource {
+	return &HTTPVariableSource{
+		url:    url,
+		client: outbound.client("template-variables", 30*time.Second),
+	}
+}
+
+// variablesFor returns the variables the endpoint returns for the user.
+// Values that aren't strings are converted to their JSON encodings.
+func (s *HTTPVariableSource) variablesFor(username string) (map[string]string, error) {
+	requestURL := strings.Replace(s.url, "{{username}}", url.PathEscape(username), -1)
+
+	resp, err := s.client.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The template variable endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var parsed map[string]interface{}
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string, len(parsed))
+	for name, value := range parsed {
+		if str, ok := value.(string); ok {
+			vars[name] = str
+		} else {
+			jsoned, _ := json.Marshal(value)
+			vars[name] = string(jsoned)
+		}
+	}
+	return vars, nil
+}
+
+// Templates expands template variables in preference values. The username
+// variable is always available. The configured variables are patterns that
+// may refer to the username, such as /iplant/home/{{username}} for home_dir,
+// and the variables from the source, if there is one, take precedence over
+// both.
+type Templates struct {
+	variables map[string]string
+	source    VariableSource
+}
+
+// NewTemplates returns a newly created *Templates.
+func NewTemplates(variables map[string]string, source VariableSource) *Templates {
+	return &Templates{variables: variables, source: source}
+}
+
+// variablesFor returns all of the variables for the user.
+func (t *Templates) variablesFor(username string) (map[string]string, error) {
+	vars := map[string]string{"username": username}
+	for name, pattern := range t.variables {
+		vars[name] = expandString(pattern, map[string]string{"username": username})
+	}
+
+	if t.source != nil {
+		fetched, err := t.source.variablesFor(username)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting the template variables for user %s: %s", username, err)
+		}
+		for name, value := range fetched {
+			vars[name] = value
+		}
+	}
+
+	return vars, nil
+}
+
+// expandString replaces the variable references in the string with their
+// values. References to unknown variables are left as they are.
+func expandString(value string, vars map[string]string) string {
+	return templateVariable.ReplaceAllStringFunc(value, func(ref string) string {
+		name := templateVariable.FindStringSubmatch(ref)[1]
+		if expanded, ok := vars[name]; ok {
+			return expanded
+		}
+		return ref
+	})
+}
+
+// expandValue returns a copy of the value with the variable references in all
+// of its strings replaced.
+func expandValue(value interface{}, vars map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandString(v, vars)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded[i] = expandValue(item, vars)
+		}
+		return expanded
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			expanded[key] = expandValue(item, vars)
+		}
+		return expanded
+	default:
+		return value
+	}
+}
+
+// expandRequested returns whether the request asked for template variables to
+// be expanded.
+func expandRequested(r *http.Request) bool {
+	expand, _ := strconv.ParseBool(r.URL.Query().Get(expandParam))
+	return expand
+}
+
+// applyTemplates expands the template variables in the document for the user
+// if the request asked for it. Only the preferences are expanded in a wrapped
+// document.
+func (u *UserPreferencesApp) applyTemplates(r *http.Request, username string, doc map[string]interface{}, wrap bool) (map[string]interface{}, error) {
+	if !expandRequested(r) || u.templates == nil {
+		return doc, nil
+	}
+
+	vars, err := u.templates.variablesFor(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrap {
+		if values, ok := doc["preferences"].(map[string]interface{}); ok {
+			doc["preferences"] = expandValue(values, vars)
+		}
+		return doc, nil
+	}
+	return expandValue(doc, vars).(map[string]interface{}), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// staticVariables is a VariableSource that returns the same variables for
+// every user.
+type staticVariables map[string]string
+
+func (s staticVariables) variablesFor(username string) (map[string]string, error) {
+	return s, nil
+}
+
+func TestExpandValue(t *testing.T) {
+	vars := map[string]string{"username": "alice", "home_dir": "/iplant/home/alice"}
+	value := map[string]interface{}{
+		"output":  "{{home_dir}}/analyses",
+		"spaced":  "{{ username }}",
+		"unknown": "{{nope}} stays",
+		"list":    []interface{}{"{{username}}", 3.0},
+		"nested":  map[string]interface{}{"greeting": "hi {{username}}!"},
+	}
+	expected := map[string]interface{}{
+		"output":  "/iplant/home/alice/analyses",
+		"spaced":  "alice",
+		"unknown": "{{nope}} stays",
+		"list":    []interface{}{"alice", 3.0},
+		"nested":  map[string]interface{}{"greeting": "hi alice!"},
+	}
+
+	if actual := expandValue(value, vars); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expandValue returned %#v", actual)
+	}
+	if value["output"] != "{{home_dir}}/analyses" {
+		t.Error("expandValue modified its argument")
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	templates := NewTemplates(
+		map[string]string{"home_dir": "/iplant/home/{{username}}", "zone": "iplant"},
+		staticVariables{"zone": "cyverse"},
+	)
+
+	vars, err := templates.variablesFor("alice")
+	expected := map[string]string{"username": "alice", "home_dir": "/iplant/home/alice", "zone": "cyverse"}
+	if err != nil || !reflect.DeepEqual(vars, expected) {
+		t.Errorf("variablesFor returned %#v, %v", vars, err)
+	}
+}
+
+func TestHTTPVariableSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/users/alice%20b" {
+			http.NotFound(writer, r)
+			return
+		}
+		fmt.Fprint(writer, `{"home_dir":"/home/alice","quota":10}`)
+	}))
+	defer server.Close()
+
+	vars, err := NewHTTPVariableSource(server.URL + "/users/{{username}}").variablesFor("alice b")
+	if err != nil || !reflect.DeepEqual(vars, map[string]string{"home_dir": "/home/alice", "quota": "10"}) {
+		t.Errorf("variablesFor returned %#v, %v", vars, err)
+	}
+
+	if _, err = NewHTTPVariableSource(server.URL + "/missing").variablesFor("alice"); err == nil {
+		t.Error("an error response was accepted")
+	}
+}
+
+func TestGetRequestExpand(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"output":"{{home_dir}}/analyses"}`)
+
+	n := New(mock)
+	n.templates = NewTemplates(map[string]string{"home_dir": "/iplant/home/{{username}}"}, nil)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	tests := []struct {
+		query    string
+		expected interface{}
+	}{
+		{"", "{{home_dir}}/analyses"},
+		{"?expand=true", "/iplant/home/alice/analyses"},
+	}
+
+	for _, test := range tests {
+		status, body := doRequest(t, http.MethodGet, server.URL+"/alice"+test.query, nil, nil)
+		var values map[string]interface{}
+		if err := json.Unmarshal(body, &values); err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK || values["output"] != test.expected {
+			t.Errorf("GET /alice%s returned %d: %s", test.query, status, body)
+		}
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/alice?expand=true&include-meta=true", nil, nil)
+	var wrapped map[string]map[string]interface{}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || wrapped["preferences"]["output"] != "/iplant/home/alice/analyses" {
+		t.Errorf("GET with metadata returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/alice/effective?expand=1", nil, nil)
+	var effective map[string]interface{}
+	if err := json.Unmarshal(body, &effective); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || effective["output"] != "/iplant/home/alice/analyses" {
+		t.Errorf("GET effective returned %d: %s", status, body)
+	}
+}
+
+func TestConfigureTemplates(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  templates:\n    variables:\n      home_dir: /iplant/home/{{username}}\n")
+	app := New(NewMockDB())
+	if err := configureApp(app, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(app.templates.variables, map[string]string{"home_dir": "/iplant/home/{{username}}"}) || app.templates.source != nil {
+		t.Errorf("the templates were %#v", app.templates)
+	}
+
+	cfg = testConfig(t, "user-preferences:\n  templates:\n    variables:\n      home_dir: [a]\n")
+	if err := configureApp(New(NewMockDB()), cfg); err == nil {
+		t.Error("a template variable that isn't a string was accepted")
+	}
+}
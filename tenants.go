@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantHeader is the request header that selects the tenant a request is
+// for.
+const tenantHeader = "X-Tenant-ID"
+
+// tenantPathPrefix is the path prefix that may be used instead of the tenant
+// header, as in /tenants/{tenant}/{username}.
+const tenantPathPrefix = "/tenants/"
+
+// TenantRouter dispatches requests to a separate *UserPreferencesApp for each
+// tenant. Each tenant's app has its own database connection, which uses the
+// tenant's schema, so tenants are fully isolated from one another.
+type TenantRouter struct {
+	apps          map[string]*UserPreferencesApp
+	defaultTenant string
+}
+
+// NewTenantRouter returns a newly created *TenantRouter. Requests that don't
+// specify a tenant are sent to the default tenant, or rejected if the default
+// tenant is empty.
+func NewTenantRouter(defaultTenant string) *TenantRouter {
+	return &TenantRouter{
+		apps:          make(map[string]*UserPreferencesApp),
+		defaultTenant: strings.ToLower(defaultTenant),
+	}
+}
+
+// Add registers the app that handles requests for the tenant. Tenant IDs are
+// case-insensitive. The app's share tokens are bound to the tenant, so that a
+// token minted for one tenant can't be used to read another's preferences.
+func (t *TenantRouter) Add(tenant string, app *UserPreferencesApp) {
+	tenant = strings.ToLower(tenant)
+	if app.share != nil {
+		app.share.tenant = tenant
+	}
+	t.apps[tenant] = app
+}
+
+// resolveTenant determines the tenant for the request and strips the tenant
+// path prefix from the request URL if it's present.
+func (t *TenantRouter) resolveTenant(r *http.Request) (string, error) {
+	var pathTenant string
+	if strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+		rest := strings.TrimPrefix(r.URL.Path, tenantPathPrefix)
+		parts := strings.SplitN(rest, "/", 2)
+		pathTenant = strings.ToLower(parts[0])
+		if len(parts) > 1 {
+			r.URL.Path = "/" + parts[1]
+		} else {
+			r.URL.Path = "/"
+		}
+		r.URL.RawPath = ""
+	}
+
+	headerTenant := strings.ToLower(r.Header.Get(tenantHeader))
+	switch {
+	case pathTenant != "" && headerTenant != "" && pathTenant != headerTenant:
+		return "", fmt.Errorf("The tenant in the path (%s) does not match the %s header (%s)", pathTenant, tenantHeader, headerTenant)
+	case pathTenant != "":
+		return pathTenant, nil
+	case headerTenant != "":
+		return headerTenant, nil
+	case t.defaultTenant != "":
+		return t.defaultTenant, nil
+	default:
+		return "", fmt.Errorf("Missing tenant; set the %s header or use a %s{tenant} path prefix", tenantHeader, tenantPathPrefix)
+	}
+}
+
+// ServeHTTP sends the request to the app for the request's tenant.
+func (t *TenantRouter) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	tenant, err := t.resolveTenant(r)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+	if r.URL.Path != path {
+		r = withPathPrefix(r, strings.TrimSuffix(path, r.URL.Path))
+	}
+
+	app, ok := t.apps[tenant]
+	if !ok {
+		notFound(writer, fmt.Sprintf("Unknown tenant %s", tenant))
+		return
+	}
+
+	r.Header.Set(tenantHeader, tenant)
+	app.ServeHTTP(writer, r)
+}
+
+// withSearchPath returns the database URI with its search_path set to the
+// schema, so that all unqualified table names resolve within the schema.
+func withSearchPath(dburi, schema string) (string, error) {
+	return withConnParam(dburi, "search_path", schema)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// terrainUserParam is the query parameter that names the user in the legacy
+// Terrain-style routes.
+const terrainUserParam = "user"
+
+// terrainRoute is a legacy Terrain-style route and the handler that serves it.
+type terrainRoute struct {
+	path    string
+	method  string
+	handler http.HandlerFunc
+}
+
+// terrainRoutes returns the legacy routes, relative to the prefix, mapped onto
+// the service's handlers. Terrain wrote whole documents with POST, so POST maps
+// onto the replacing handlers.
+func (u *UserPreferencesApp) terrainRoutes() []terrainRoute {
+	return []terrainRoute{
+		{"/preferences", http.MethodGet, u.GetRequest},
+		{"/preferences", http.MethodPost, u.idempotent(u.PutRequest)},
+		{"/preferences", http.MethodDelete, u.idempotent(u.DeleteRequest)},
+		{"/saved-searches", http.MethodGet, u.ListSearchesRequest},
+		{"/saved-searches", http.MethodPost, u.idempotent(u.ReplaceSearchesRequest)},
+		{"/saved-searches", http.MethodDelete, u.idempotent(u.DeleteSearchesRequest)},
+		{"/user-session", http.MethodGet, u.GetUISessionRequest},
+		{"/user-session", http.MethodPost, u.PutUISessionRequest},
+		{"/user-session", http.MethodDelete, u.DeleteUISessionRequest},
+	}
+}
+
+// missingTerrainUser handles legacy requests that don't name a user.
+func missingTerrainUser(writer http.ResponseWriter, r *http.Request) {
+	badRequest(writer, fmt.Sprintf("Missing %s query parameter", terrainUserParam))
+}
+
+// enableTerrainRoutes exposes the legacy Terrain-style routes under the
+// prefix, such as GET /secured/preferences?user=alice, so that Terrain can
+// proxy requests straight through. The routes are checked before the
+// service's own, since the prefix would otherwise be taken for a username;
+// everything else falls through to the service's router.
+func (u *UserPreferencesApp) enableTerrainRoutes(prefix string) {
+	log.Infof("Serving Terrain-style routes under %s", prefix)
+
+	router := mux.NewRouter()
+	for _, route := range u.terrainRoutes() {
+		router.HandleFunc(prefix+route.path, route.handler).
+			Methods(route.method).
+			Queries(terrainUserParam, "{username}")
+		router.HandleFunc(prefix+route.path, missingTerrainUser).Methods(route.method)
+	}
+	router.NotFoundHandler = u.router
+
+	u.router = router
+}
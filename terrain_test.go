@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTerrainRoutes(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["secured"] = true
+
+	cfg := testConfig(t, "user-preferences:\n  terrain:\n    enabled: true\n")
+	n := New(mock)
+	if err := configureApp(n, cfg); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/secured/preferences?user=alice"
+
+	if status, body := doRequest(t, http.MethodPost, url, []byte(`{"theme":"dark"}`), nil); status != http.StatusCreated {
+		t.Errorf("POST returned %d: %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodPost, url, []byte(`{"layout":"grid"}`), nil); status != http.StatusOK {
+		t.Errorf("a second POST returned %d: %s", status, body)
+	}
+	if prefs, _ := mock.getPreferences("alice"); prefs[0].Preferences != `{"layout":"grid"}` {
+		t.Errorf("a POST didn't replace the preferences: %s", prefs[0].Preferences)
+	}
+
+	if status, body := doRequest(t, http.MethodGet, url, nil, nil); status != http.StatusOK || string(body) != `{"layout":"grid"}` {
+		t.Errorf("GET returned %d: %s", status, body)
+	}
+
+	searches := server.URL + "/secured/saved-searches?user=alice"
+	if status, body := doRequest(t, http.MethodPost, searches, []byte(`{"a":{"query":"a"}}`), nil); status != http.StatusOK {
+		t.Errorf("POST of the saved searches returned %d: %s", status, body)
+	}
+
+	session := server.URL + "/secured/user-session?user=alice"
+	if status, body := doRequest(t, http.MethodPost, session, []byte(`{"tabs":["data"]}`), nil); status != http.StatusOK {
+		t.Errorf("POST of the UI session returned %d: %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodGet, session, nil, nil); status != http.StatusOK || string(body) != `{"tabs":["data"]}` {
+		t.Errorf("GET of the UI session returned %d: %s", status, body)
+	}
+
+	if status, _ := doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusOK {
+		t.Errorf("DELETE returned %d", status)
+	}
+	if has, _ := mock.hasPreferences("alice"); has {
+		t.Error("DELETE didn't delete the preferences")
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/secured/preferences", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("a request without a user returned %d", status)
+	}
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil); status != http.StatusOK {
+		t.Errorf("the service's own routes returned %d", status)
+	}
+}
+
+func TestTerrainRoutesDisabled(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, "")); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/secured/preferences?user=alice", nil, nil); status != http.StatusNotFound {
+		t.Errorf("a Terrain-style route returned %d while they were disabled", status)
+	}
+}
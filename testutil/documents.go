@@ -0,0 +1,42 @@
+package testutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// readBody returns the request body, or nil if it can't be read.
+func readBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// writeJSON writes the value to the client as JSON with the status.
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+// copyDocument returns a deep copy of the document. Documents are copied by
+// round-tripping them through JSON, so the copy has the same types a client
+// would see.
+func copyDocument(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	var copied map[string]interface{}
+	json.Unmarshal(encoded, &copied)
+	return copied
+}
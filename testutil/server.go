@@ -0,0 +1,363 @@
+// Package testutil provides a fake user-preferences service that keeps
+// preferences in memory. Services that depend on user-preferences, and the
+// client package, can test against it without a database. Failures and
+// latency can be injected to exercise error handling.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/user-preferences/merge"
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+// Request is a request received by the fake service.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// failure is an injected error response.
+type failure struct {
+	match   func(*http.Request) bool
+	status  int
+	message string
+}
+
+// record is a user's stored preferences and their metadata.
+type record struct {
+	id          string
+	preferences map[string]interface{}
+	createdAt   time.Time
+	modifiedAt  time.Time
+	version     int64
+}
+
+// Server is a fake user-preferences service. It handles GET, PUT, POST, and
+// DELETE on /{username}, POST on /{username}/merge, and GET on
+// /{username}/typed, with the same status codes and response bodies as the
+// real service.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	records  map[string]*record
+	users    map[string]bool
+	latency  time.Duration
+	failures []failure
+	next     []failure
+	requests []Request
+	nextID   int
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithUsers restricts the users the fake service knows about. Requests for
+// any other user get the same 400 response as the real service returns for
+// users that don't exist. All users exist by default.
+func WithUsers(usernames ...string) Option {
+	return func(s *Server) {
+		s.users = make(map[string]bool)
+		for _, username := range usernames {
+			s.users[username] = true
+		}
+	}
+}
+
+// WithPreferences stores preferences for the user before the service starts.
+func WithPreferences(username string, prefs map[string]interface{}) Option {
+	return func(s *Server) {
+		s.store(username, prefs)
+	}
+}
+
+// WithLatency delays every response by d.
+func WithLatency(d time.Duration) Option {
+	return func(s *Server) {
+		s.latency = d
+	}
+}
+
+// WithFailure makes the fake service respond to every request that match
+// returns true for with the status and message instead of handling it. A nil
+// match fails every request.
+func WithFailure(match func(*http.Request) bool, status int, message string) Option {
+	return func(s *Server) {
+		s.failures = append(s.failures, failure{match, status, message})
+	}
+}
+
+// NewServer starts a fake user-preferences service. Callers should call Close
+// when they're done with it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{records: make(map[string]*record)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// FailNext makes the fake service respond to the next request with the status
+// and message. Calls queue up, so calling it twice fails the next two
+// requests.
+func (s *Server) FailNext(status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = append(s.next, failure{nil, status, message})
+}
+
+// SetLatency changes the delay added to every response.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Preferences returns a copy of the preferences stored for the user, or nil if
+// there aren't any.
+func (s *Server) Preferences(username string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[username]
+	if !ok {
+		return nil
+	}
+	return copyDocument(rec.preferences)
+}
+
+// SetPreferences stores preferences for the user.
+func (s *Server) SetPreferences(username string, prefs map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(username, prefs)
+}
+
+// Requests returns the requests the fake service has received, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// store saves a copy of the preferences for the user and returns whether a new
+// record was created. The caller must hold the lock, or be constructing the
+// Server.
+func (s *Server) store(username string, prefs map[string]interface{}) bool {
+	now := time.Now()
+	rec, ok := s.records[username]
+	if !ok {
+		s.nextID++
+		rec = &record{id: fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextID), createdAt: now}
+		s.records[username] = rec
+	}
+	rec.preferences = copyDocument(prefs)
+	rec.modifiedAt = now
+	rec.version++
+	return !ok
+}
+
+// injectedFailure returns the failure to respond to the request with, if any.
+// The caller must hold the lock.
+func (s *Server) injectedFailure(r *http.Request) *failure {
+	if len(s.next) > 0 {
+		f := s.next[0]
+		s.next = s.next[1:]
+		return &f
+	}
+	for i := range s.failures {
+		if s.failures[i].match == nil || s.failures[i].match(r) {
+			return &s.failures[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) handle(writer http.ResponseWriter, r *http.Request) {
+	body := readBody(r)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.EscapedPath(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	latency := s.latency
+	f := s.injectedFailure(r)
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if f != nil {
+		http.Error(writer, f.message, f.status)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	username, err := url.PathUnescape(parts[0])
+	if err != nil || username == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "merge" && parts[1] != "typed") {
+		http.NotFound(writer, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users != nil && !s.users[username] {
+		encoded, _ := json.Marshal(map[string]string{"user": username})
+		http.Error(writer, string(encoded), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "typed" && r.Method == http.MethodGet:
+		s.typed(writer, username)
+	case len(parts) == 2 && parts[1] == "merge" && r.Method == http.MethodPost:
+		s.merge(writer, r, username, body)
+	case len(parts) == 2:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	case r.Method == http.MethodGet:
+		prefs := map[string]interface{}{}
+		if rec, ok := s.records[username]; ok && rec.preferences != nil {
+			prefs = rec.preferences
+		}
+		writeJSON(writer, http.StatusOK, prefs)
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		var prefs map[string]interface{}
+		if err := json.Unmarshal(body, &prefs); err != nil {
+			http.Error(writer, fmt.Sprintf("Error parsing request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			stored := map[string]interface{}{}
+			if rec, ok := s.records[username]; ok {
+				stored = copyDocument(rec.preferences)
+			}
+			// The service's default settings merge objects at every level
+			// and replace arrays.
+			prefs = merge.Patch(stored, prefs, 0, nil)
+		}
+		if _, err := model.Decode(prefs); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeStored(writer, r, username, s.store(username, prefs))
+	case r.Method == http.MethodDelete:
+		delete(s.records, username)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// typed writes the user's well-known preferences in the form defined by the
+// model package. The caller must hold the lock.
+func (s *Server) typed(writer http.ResponseWriter, username string) {
+	prefs := map[string]interface{}{}
+	if rec, ok := s.records[username]; ok && rec.preferences != nil {
+		prefs = rec.preferences
+	}
+
+	decoded, err := model.Decode(prefs)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(writer, http.StatusOK, decoded)
+}
+
+// mergeBody is the body accepted by the merge endpoint.
+type mergeBody struct {
+	Preferences map[string]interface{} `json:"preferences"`
+	Strategy    string                 `json:"strategy"`
+	Timestamps  map[string]time.Time   `json:"timestamps"`
+}
+
+// merge reconciles the client's preferences with the stored copy the same way
+// the real service does. The caller must hold the lock.
+func (s *Server) merge(writer http.ResponseWriter, r *http.Request, username string, body []byte) {
+	var req mergeBody
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		server     = map[string]interface{}{}
+		modifiedAt time.Time
+	)
+	if rec, ok := s.records[username]; ok {
+		server = copyDocument(rec.preferences)
+		modifiedAt = rec.modifiedAt
+	}
+	client := copyDocument(req.Preferences)
+
+	var merged map[string]interface{}
+	switch req.Strategy {
+	case "", "server-wins":
+		merged = merge.Documents(client, server)
+	case "client-wins":
+		merged = merge.Documents(server, client)
+	case "newest-wins":
+		for key, value := range client {
+			_, onServer := server[key]
+			clientTime, ok := req.Timestamps[key]
+			if !onServer || (ok && clientTime.After(modifiedAt)) {
+				server[key] = value
+			}
+		}
+		merged = server
+	default:
+		http.Error(writer, fmt.Sprintf("Unknown merge strategy: %s", req.Strategy), http.StatusBadRequest)
+		return
+	}
+
+	s.writeStored(writer, r, username, s.store(username, merged))
+}
+
+// writeStored writes the response the real service sends after storing a
+// user's preferences. The caller must hold the lock.
+func (s *Server) writeStored(writer http.ResponseWriter, r *http.Request, username string, created bool) {
+	rec := s.records[username]
+
+	meta := map[string]interface{}{
+		"id":          rec.id,
+		"created_at":  rec.createdAt,
+		"modified_at": rec.modifiedAt,
+	}
+	if full, _ := strconv.ParseBool(r.URL.Query().Get("include-meta")); full {
+		encoded, _ := json.Marshal(rec.preferences)
+		meta["version"] = rec.version
+		meta["size"] = len(encoded)
+	}
+
+	status := http.StatusOK
+	if created {
+		writer.Header().Set("Location", "/"+url.PathEscape(username))
+		status = http.StatusCreated
+	}
+	writer.Header().Set("Last-Modified", rec.modifiedAt.UTC().Format(http.TimeFormat))
+
+	prefs := rec.preferences
+	if prefs == nil {
+		prefs = map[string]interface{}{}
+	}
+	writeJSON(writer, status, map[string]interface{}{"preferences": prefs, "meta": meta})
+}
@@ -0,0 +1,127 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func send(t *testing.T, s *Server, method, path, body string) (int, map[string]interface{}, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	var doc map[string]interface{}
+	json.Unmarshal(data, &doc)
+	return resp.StatusCode, doc, strings.TrimSpace(string(data))
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(WithPreferences("alice", map[string]interface{}{"theme": "dark"}))
+	defer s.Close()
+
+	status, doc, _ := send(t, s, http.MethodGet, "/alice", "")
+	if status != http.StatusOK || !reflect.DeepEqual(doc, map[string]interface{}{"theme": "dark"}) {
+		t.Errorf("GET returned %d %#v", status, doc)
+	}
+
+	status, doc, _ = send(t, s, http.MethodGet, "/bob", "")
+	if status != http.StatusOK || len(doc) != 0 {
+		t.Errorf("GET for a user without preferences returned %d %#v", status, doc)
+	}
+
+	status, doc, _ = send(t, s, http.MethodPut, "/bob?include-meta=true", `{"columns":3}`)
+	meta, _ := doc["meta"].(map[string]interface{})
+	if status != http.StatusCreated || !reflect.DeepEqual(doc["preferences"], map[string]interface{}{"columns": 3.0}) || meta["version"] != 1.0 {
+		t.Errorf("PUT for a new user returned %d %#v", status, doc)
+	}
+
+	status, _, _ = send(t, s, http.MethodPost, "/bob", `{"theme":"blue","columns":null,"ui":{"$literal":null}}`)
+	if status != http.StatusOK || !reflect.DeepEqual(s.Preferences("bob"), map[string]interface{}{"theme": "blue", "ui": nil}) {
+		t.Errorf("POST for an existing user returned %d and stored %#v", status, s.Preferences("bob"))
+	}
+
+	status, doc, _ = send(t, s, http.MethodPost, "/alice/merge", `{"preferences":{"theme":"light","tools":true},"strategy":"server-wins"}`)
+	if status != http.StatusOK || !reflect.DeepEqual(doc["preferences"], map[string]interface{}{"theme": "dark", "tools": true}) {
+		t.Errorf("a server-wins merge returned %d %#v", status, doc)
+	}
+
+	status, _, body := send(t, s, http.MethodPost, "/alice/merge", `{"strategy":"loudest-wins"}`)
+	if status != http.StatusBadRequest || body != "Unknown merge strategy: loudest-wins" {
+		t.Errorf("an unknown merge strategy returned %d %s", status, body)
+	}
+
+	if status, _, _ = send(t, s, http.MethodDelete, "/alice", ""); status != http.StatusOK || s.Preferences("alice") != nil {
+		t.Errorf("DELETE returned %d and left %#v", status, s.Preferences("alice"))
+	}
+
+	requests := s.Requests()
+	if len(requests) != 7 || requests[2].Method != http.MethodPut || !bytes.Equal(requests[2].Body, []byte(`{"columns":3}`)) {
+		t.Errorf("the requests were %#v", requests)
+	}
+}
+
+func TestServerUsers(t *testing.T) {
+	s := NewServer(WithUsers("alice"))
+	defer s.Close()
+
+	if status, _, _ := send(t, s, http.MethodGet, "/alice", ""); status != http.StatusOK {
+		t.Errorf("GET for a known user returned %d", status)
+	}
+	if status, _, body := send(t, s, http.MethodGet, "/bob", ""); status != http.StatusBadRequest || body != `{"user":"bob"}` {
+		t.Errorf("GET for an unknown user returned %d %s", status, body)
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	s := NewServer(WithFailure(func(r *http.Request) bool {
+		return r.Method == http.MethodDelete
+	}, http.StatusServiceUnavailable, "down"))
+	defer s.Close()
+
+	if status, _, body := send(t, s, http.MethodDelete, "/alice", ""); status != http.StatusServiceUnavailable || body != "down" {
+		t.Errorf("a matching request returned %d %s", status, body)
+	}
+	if status, _, _ := send(t, s, http.MethodGet, "/alice", ""); status != http.StatusOK {
+		t.Errorf("a request that doesn't match returned %d", status)
+	}
+
+	s.FailNext(http.StatusInternalServerError, "once")
+	if status, _, body := send(t, s, http.MethodGet, "/alice", ""); status != http.StatusInternalServerError || body != "once" {
+		t.Errorf("the next request returned %d %s", status, body)
+	}
+	if status, _, _ := send(t, s, http.MethodGet, "/alice", ""); status != http.StatusOK {
+		t.Errorf("the request after the failure returned %d", status)
+	}
+}
+
+func TestServerLatency(t *testing.T) {
+	s := NewServer(WithLatency(50 * time.Millisecond))
+	defer s.Close()
+
+	start := time.Now()
+	send(t, s, http.MethodGet, "/alice", "")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("the response took %s", elapsed)
+	}
+
+	s.SetLatency(0)
+	start = time.Now()
+	send(t, s, http.MethodGet, "/alice", "")
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("the response took %s after removing the latency", elapsed)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RequestBudgets limits how long requests may take to handle. Requests that
+// exceed their budget get a 503 response. The default budget may be
+// overridden for requests whose paths start with a configured prefix, and the
+// longest matching prefix wins.
+type RequestBudgets struct {
+	handler http.Handler
+	budget  time.Duration
+	routes  map[string]time.Duration
+}
+
+// NewRequestBudgets returns a newly created *RequestBudgets wrapping the
+// handler. A budget of zero disables the limit.
+func NewRequestBudgets(handler http.Handler, budget time.Duration, routes map[string]time.Duration) *RequestBudgets {
+	return &RequestBudgets{
+		handler: handler,
+		budget:  budget,
+		routes:  routes,
+	}
+}
+
+// budgetFor returns the budget for a request path. The tenant path prefix is
+// ignored so that overrides apply to every tenant.
+func (b *RequestBudgets) budgetFor(path string) time.Duration {
+	if strings.HasPrefix(path, tenantPathPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(path, tenantPathPrefix), "/", 2)
+		path = "/"
+		if len(parts) > 1 {
+			path += parts[1]
+		}
+	}
+	if _, rest, ok := splitAPIVersion(path); ok {
+		path = rest
+	}
+
+	budget := b.budget
+	longest := -1
+	for prefix, routeBudget := range b.routes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		matches := path == prefix || strings.HasPrefix(path, prefix+"/")
+		if matches && len(prefix) > longest {
+			budget = routeBudget
+			longest = len(prefix)
+		}
+	}
+
+	return budget
+}
+
+// ServeHTTP handles the request within its budget.
+func (b *RequestBudgets) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	budget := b.budgetFor(r.URL.Path)
+	if budget <= 0 {
+		b.handler.ServeHTTP(writer, r)
+		return
+	}
+
+	msg := fmt.Sprintf("The request could not be completed within its time budget of %s", budget)
+	http.TimeoutHandler(b.handler, budget, msg).ServeHTTP(writer, r)
+}
+
+// routeBudgets parses the per-route budget overrides from the configuration.
+func routeBudgets(cfg *viper.Viper) (map[string]time.Duration, error) {
+	routes := make(map[string]time.Duration)
+	for prefix, value := range cfg.GetStringMapString("user-preferences.timeouts.routes") {
+		budget, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time budget for route %s: %s", prefix, err)
+		}
+		routes[prefix] = budget
+	}
+	return routes, nil
+}
+
+// newServer returns an *http.Server for the handler with the configured
+// connection timeouts and request budgets. The write timeout should be longer
+// than the longest request budget, or clients won't see the 503 responses.
+func newServer(cfg *viper.Viper, addr string, handler http.Handler) (*http.Server, error) {
+	routes, err := routeBudgets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:         addr,
+		Handler:      NewRequestBudgets(handler, cfg.GetDuration("user-preferences.timeouts.handler"), routes),
+		ReadTimeout:  cfg.GetDuration("user-preferences.timeouts.read"),
+		WriteTimeout: cfg.GetDuration("user-preferences.timeouts.write"),
+		IdleTimeout:  cfg.GetDuration("user-preferences.timeouts.idle"),
+	}, nil
+}
+
+// withStatementTimeout returns the database URI with the PostgreSQL
+// statement_timeout set, so that the database cancels stuck queries instead of
+// tying up the goroutines waiting on them. A timeout of zero leaves the URI
+// unchanged.
+func withStatementTimeout(dburi string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dburi, nil
+	}
+	return withConnParam(dburi, "statement_timeout", fmt.Sprintf("%d", timeout/time.Millisecond))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBudgetFor(t *testing.T) {
+	b := NewRequestBudgets(nil, time.Second, map[string]time.Duration{
+		"/admin":      time.Minute,
+		"/admin/jobs": time.Hour,
+	})
+
+	tests := []struct {
+		path     string
+		expected time.Duration
+	}{
+		{"/test-user", time.Second},
+		{"/admin", time.Minute},
+		{"/admin/other", time.Minute},
+		{"/administrator", time.Second},
+		{"/admin/jobs/purge-expired-keys/run", time.Hour},
+		{"/tenants/a/admin/jobs", time.Hour},
+		{"/tenants/a", time.Second},
+		{"/v2/admin/jobs", time.Hour},
+		{"/tenants/a/v1/admin", time.Minute},
+	}
+
+	for _, test := range tests {
+		if actual := b.budgetFor(test.path); actual != test.expected {
+			t.Errorf("budgetFor(%s) returned %s instead of %s", test.path, actual, test.expected)
+		}
+	}
+}
+
+func TestRequestBudgets(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		writer.Write([]byte("done"))
+	})
+
+	server := httptest.NewServer(NewRequestBudgets(handler, 10*time.Millisecond, nil))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("a slow request returned %d instead of %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(string(body), "time budget of 10ms") {
+		t.Errorf("a slow request returned '%s'", body)
+	}
+
+	res, err = http.Get(server.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("a fast request returned %d instead of %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	cfg := testConfig(t, `
+user-preferences:
+  timeouts:
+    routes:
+      /admin: 5m
+`)
+
+	server, err := newServer(cfg, ":60000", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.ReadTimeout != 30*time.Second || server.WriteTimeout != 90*time.Second || server.IdleTimeout != 2*time.Minute {
+		t.Errorf("server timeouts were %s, %s, and %s", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	budgets := server.Handler.(*RequestBudgets)
+	if budgets.budget != time.Minute {
+		t.Errorf("handler budget was %s", budgets.budget)
+	}
+	if budgets.budgetFor("/admin/jobs") != 5*time.Minute {
+		t.Errorf("admin budget was %s", budgets.budgetFor("/admin/jobs"))
+	}
+
+	cfg = testConfig(t, `
+user-preferences:
+  timeouts:
+    routes:
+      /admin: forever
+`)
+	if _, err = newServer(cfg, ":60000", http.NotFoundHandler()); err == nil {
+		t.Error("an invalid route budget did not return an error")
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	actual, err := withStatementTimeout("host=dedb dbname=de", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "host=dedb dbname=de statement_timeout=30000"
+	if actual != expected {
+		t.Errorf("withStatementTimeout returned %s instead of %s", actual, expected)
+	}
+
+	actual, err = withStatementTimeout("host=dedb", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "host=dedb" {
+		t.Errorf("withStatementTimeout returned %s with no timeout", actual)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// returnParam is the query parameter that asks for the deleted document in
+// the response to a DELETE, for clients that can't set the Prefer header.
+const returnParam = "return"
+
+// returnRepresentation is the preference, from RFC 7240, for getting the
+// deleted document back.
+const returnRepresentation = "return=representation"
+
+// wantsRepresentation returns whether the client asked for the deleted
+// document, with ?return=representation or Prefer: return=representation.
+func wantsRepresentation(r *http.Request) bool {
+	if r.URL.Query().Get(returnParam) == "representation" {
+		return true
+	}
+	for _, header := range r.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), returnRepresentation) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deletedDocument returns the user's document as it's about to be deleted,
+// with their saved searches, so that storing it again with a PUT undoes the
+// delete. An empty document is returned if the user has no preferences.
+func (u *UserPreferencesApp) deletedDocument(username string, hasPrefs bool) (map[string]interface{}, UserPreferencesRecord, error) {
+	if !hasPrefs {
+		return make(map[string]interface{}), UserPreferencesRecord{}, nil
+	}
+
+	response, record, err := u.preferencesResponse(username, false)
+	if err != nil {
+		return nil, record, err
+	}
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+	response, err = u.applySearches(username, response, false)
+	return response, record, err
+}
+
+// finishDelete deletes the user's saved searches once their preferences have
+// been deleted and, if removed isn't nil, writes it out as the deleted
+// document. The version it was stored as is in the Preferences-Version header,
+// along with a link for restoring it from the history.
+func (u *UserPreferencesApp) finishDelete(writer http.ResponseWriter, r *http.Request, username string, removed map[string]interface{}, record UserPreferencesRecord) {
+	if !u.deleteDocumentSearches(writer, username) || removed == nil {
+		return
+	}
+
+	writer.Header().Set("Preference-Applied", returnRepresentation)
+	if record.ID != "" {
+		restore := fmt.Sprintf("/%s/history/%d/restore", url.PathEscape(username), record.Version)
+		writer.Header().Set(versionHeader, strconv.FormatInt(record.Version, 10))
+		writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="restore"`, externalPath(r, restore)))
+	}
+
+	if err := writeDocument(writer, r, http.StatusOK, removed); err != nil {
+		log.Errorf("Error writing the deleted preferences for user %s: %s", username, err)
+	}
+}
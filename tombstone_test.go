@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsRepresentation(t *testing.T) {
+	tests := []struct {
+		url      string
+		prefer   string
+		expected bool
+	}{
+		{"/test-user", "", false},
+		{"/test-user?return=representation", "", true},
+		{"/test-user?return=minimal", "", false},
+		{"/test-user", "return=representation", true},
+		{"/test-user", "respond-async, Return=Representation", true},
+		{"/test-user", "return=minimal", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodDelete, test.url, nil)
+		if test.prefer != "" {
+			r.Header.Set("Prefer", test.prefer)
+		}
+		if actual := wantsRepresentation(r); actual != test.expected {
+			t.Errorf("wantsRepresentation(%s, %q) returned %t", test.url, test.prefer, actual)
+		}
+	}
+}
+
+func TestDeleteRepresentation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(mock))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/v2/test-user?return=representation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"theme":"dark"}` {
+		t.Errorf("DELETE with return=representation returned %d '%s'", resp.StatusCode, body)
+	}
+	if resp.Header.Get(versionHeader) != "1" || resp.Header.Get("Preference-Applied") != returnRepresentation {
+		t.Errorf("DELETE with return=representation returned the headers %v", resp.Header)
+	}
+	if link := resp.Header.Get("Link"); link != `</v2/test-user/history/1/restore>; rel="restore"` {
+		t.Errorf("DELETE with return=representation returned the restore link %s", link)
+	}
+	if records, _ := mock.getPreferences("test-user"); len(records) != 0 {
+		t.Error("DELETE with return=representation didn't delete the preferences")
+	}
+
+	status, body := doRequest(t, http.MethodDelete, server.URL+"/test-user", nil, map[string]string{"Prefer": returnRepresentation})
+	if status != http.StatusOK || string(body) != "{}" {
+		t.Errorf("DELETE of missing preferences with return=representation returned %d '%s'", status, body)
+	}
+
+	if err = mock.insertPreferences("test-user", `{"theme":"light"}`); err != nil {
+		t.Fatal(err)
+	}
+	status, body = doRequest(t, http.MethodDelete, server.URL+"/test-user", nil, nil)
+	if status != http.StatusOK || len(body) != 0 {
+		t.Errorf("DELETE without return=representation returned %d '%s'", status, body)
+	}
+}
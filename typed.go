@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+// typedRejection is the JSON body returned when the well-known preferences in
+// a document don't match the model.
+type typedRejection struct {
+	Error  string             `json:"error"`
+	Fields []model.FieldError `json:"fields"`
+}
+
+// writeTypedRejection writes a response with the status listing the problems
+// in the validation error.
+func writeTypedRejection(writer http.ResponseWriter, status int, msg string, err error) {
+	var fields []model.FieldError
+	if invalid, ok := err.(*model.ValidationError); ok {
+		fields = invalid.Fields
+	} else {
+		fields = []model.FieldError{}
+	}
+	log.Errorf("%s: %s", msg, err)
+
+	jsoned, err := json.Marshal(&typedRejection{Error: msg, Fields: fields})
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating validation JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsoned)
+}
+
+// validateWrite checks the well-known preferences in the incoming document
+// against the model and the webhooks in it against the webhook allowlists, and
+// returns the warnings to include in the response. Unknown keys are left
+// alone, apart from the registry checks. An error response is written and
+// false is returned if any of them are invalid, unless validation only warns.
+func (u *UserPreferencesApp) validateWrite(writer http.ResponseWriter, username string, incoming map[string]interface{}) ([]WriteWarning, bool) {
+	prefs, err := model.Decode(incoming)
+	if err == nil && u.webhooks != nil {
+		if errs := u.webhooks.check(prefs.Webhooks); len(errs) > 0 {
+			err = &model.ValidationError{Fields: errs}
+		}
+	}
+
+	var warnings []WriteWarning
+	if err != nil {
+		if !u.warnOnly {
+			writeTypedRejection(writer, http.StatusBadRequest, fmt.Sprintf("Invalid preferences for user %s", username), err)
+			return nil, false
+		}
+		log.Warnf("Storing invalid preferences for user %s: %s", username, err)
+		warnings = invalidWarnings(err)
+	}
+
+	warnings = append(warnings, u.registryWarnings(username, incoming)...)
+
+	if u.quota > 0 && u.quotaWarningAt > 0 {
+		jsoned, err := documentJSON.Marshal(incoming)
+		if err == nil {
+			if warning := u.quotaWarning(len(jsoned)); warning != nil {
+				warnings = append(warnings, *warning)
+			}
+		}
+	}
+
+	countWarnings(warnings)
+	return warnings, true
+}
+
+// TypedRequest handles getting the well-known preferences of a user in the
+// form defined by the model package. Keys the model doesn't know about are
+// left out. A 422 is returned if the stored preferences don't match the model,
+// which can happen if they were written before it existed.
+func (u *UserPreferencesApp) TypedRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	stored, err := u.loadPreferences(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	if stored, err = u.applyComputed(username, stored, false); err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	prefs, err := model.Decode(stored)
+	if err != nil {
+		writeTypedRejection(writer, http.StatusUnprocessableEntity, fmt.Sprintf("The stored preferences for user %s don't match the model", username), err)
+		return
+	}
+
+	jsoned, err := json.Marshal(prefs)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating typed preferences JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTypedRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.users["bob"] = true
+	mock.insertPreferences("alice", `{"saveSession":true,"appsKeyShortCut":"A","other":1}`)
+	mock.insertPreferences("bob", `{"saveSession":"yes"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/alice/typed", nil, nil)
+	if status != http.StatusOK || string(body) != `{"saveSession":true,"appsKeyShortCut":"A"}` {
+		t.Errorf("GET /alice/typed returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/bob/typed", nil, nil)
+	var rejection typedRejection
+	if err := json.Unmarshal(body, &rejection); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusUnprocessableEntity || len(rejection.Fields) != 1 || rejection.Fields[0].Key != "saveSession" {
+		t.Errorf("GET /bob/typed returned %d: %s", status, body)
+	}
+
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/nobody/typed", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("GET for an unknown user returned %d", status)
+	}
+}
+
+func TestTypedWriteValidation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice"
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		status, body := doRequest(t, method, url, []byte(`{"enableEmailNotification":"sometimes"}`), nil)
+		if status != http.StatusBadRequest || !strings.Contains(string(body), "enableEmailNotification") {
+			t.Errorf("an invalid %s returned %d: %s", method, status, body)
+		}
+	}
+	if prefs, _ := mock.getPreferences("alice"); prefs[0].Preferences != `{"theme":"dark"}` {
+		t.Errorf("an invalid write was stored: %s", prefs[0].Preferences)
+	}
+
+	if status, body := doRequest(t, http.MethodPost, url, []byte(`{"enableEmailNotification":true,"anything":"goes"}`), nil); status != http.StatusOK {
+		t.Errorf("a valid write returned %d: %s", status, body)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// uiSessionTTLParam is the query parameter that sets how long a write to a
+// user's UI session lasts, overriding the configured TTL.
+const uiSessionTTLParam = "ttl"
+
+// UISessionRecord is the transient UI state, such as window layouts and open
+// tabs, stored for a user. ExpiresAt is the zero time if it doesn't expire.
+type UISessionRecord struct {
+	Session    string
+	ModifiedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// getUISession returns the user's UI session. sql.ErrNoRows is returned if the
+// user doesn't have one or it has expired.
+func (p *PrefsDB) getUISession(username string) (*UISessionRecord, error) {
+	query := `SELECT s.session,
+                   s.modified_at,
+                   s.expires_at
+              FROM user_preferences_ui_sessions s,
+                   ` + p.tables.usersSource() + ` u
+             WHERE s.user_id = u.id
+               AND u.username = $1
+               AND (s.expires_at IS NULL OR s.expires_at > now())`
+
+	var (
+		record    UISessionRecord
+		expiresAt *time.Time
+	)
+	if err := p.db.QueryRow(query, username).Scan(&record.Session, &record.ModifiedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	if expiresAt != nil {
+		record.ExpiresAt = *expiresAt
+	}
+	return &record, nil
+}
+
+// saveUISession creates or replaces the user's UI session. The session doesn't
+// expire if expiresAt is the zero time.
+func (p *PrefsDB) saveUISession(username, session string, expiresAt time.Time) error {
+	query := `INSERT INTO user_preferences_ui_sessions (user_id, session, expires_at)
+                   SELECT u.id, $2, $3 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $1
+              ON CONFLICT (user_id) DO UPDATE
+                      SET session = EXCLUDED.session,
+                          expires_at = EXCLUDED.expires_at,
+                          modified_at = now()`
+
+	var expires interface{}
+	if !expiresAt.IsZero() {
+		expires = expiresAt
+	}
+	_, err := p.db.Exec(query, username, session, expires)
+	return err
+}
+
+// deleteUISession removes the user's UI session.
+func (p *PrefsDB) deleteUISession(username string) error {
+	query := `DELETE FROM user_preferences_ui_sessions s
+                    USING ` + p.tables.usersSource() + ` u
+                    WHERE s.user_id = u.id
+                      AND u.username = $1`
+	_, err := p.db.Exec(query, username)
+	return err
+}
+
+// purgeUISessions deletes the UI sessions that expired before the given time
+// and returns the number that were deleted.
+func (p *PrefsDB) purgeUISessions(before time.Time) (int64, error) {
+	query := `DELETE FROM user_preferences_ui_sessions WHERE expires_at <= $1`
+	result, err := p.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// loadUISession returns the user's UI session, or an empty one if they don't
+// have one.
+func (u *UserPreferencesApp) loadUISession(username string) (map[string]interface{}, *UISessionRecord, error) {
+	record, err := u.prefs.getUISession(username)
+	if err == sql.ErrNoRows {
+		return make(map[string]interface{}), nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error getting the UI session for user %s: %s", username, err)
+	}
+
+	var session map[string]interface{}
+	if err = json.Unmarshal([]byte(record.Session), &session); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the UI session for user %s: %s", username, err)
+	}
+	if session == nil {
+		session = make(map[string]interface{})
+	}
+	return session, record, nil
+}
+
+// uiSessionExpiration returns when a write to the UI session made by the
+// request should expire, or the zero time if it shouldn't.
+func (u *UserPreferencesApp) uiSessionExpiration(r *http.Request, now time.Time) (time.Time, error) {
+	ttl := u.uiSessionTTL
+	if param := r.URL.Query().Get(uiSessionTTLParam); param != "" {
+		parsed, err := time.ParseDuration(param)
+		if err != nil || parsed <= 0 {
+			return time.Time{}, fmt.Errorf("The %s parameter must be a positive duration", uiSessionTTLParam)
+		}
+		ttl = parsed
+	}
+
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+	return now.Add(ttl), nil
+}
+
+// writeUISession writes the session as a response, with an Expires header if
+// it expires.
+func writeUISession(writer http.ResponseWriter, username string, session map[string]interface{}, expiresAt time.Time) {
+	jsoned, err := json.Marshal(session)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating UI session JSON for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !expiresAt.IsZero() {
+		writer.Header().Set("Expires", expiresAt.UTC().Format(http.TimeFormat))
+	}
+	writer.Write(jsoned)
+}
+
+// GetUISessionRequest handles getting a user's UI session. An empty object is
+// returned if they don't have one.
+func (u *UserPreferencesApp) GetUISessionRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	session, record, err := u.loadUISession(username)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+
+	var expiresAt time.Time
+	if record != nil {
+		expiresAt = record.ExpiresAt
+	}
+	writeUISession(writer, username, session, expiresAt)
+}
+
+// PutUISessionRequest handles replacing a user's UI session.
+func (u *UserPreferencesApp) PutUISessionRequest(writer http.ResponseWriter, r *http.Request) {
+	u.writeUISessionRequest(writer, r, false)
+}
+
+// PostUISessionRequest handles merging the body into a user's UI session, so
+// that the top-level keys it doesn't mention are left alone.
+func (u *UserPreferencesApp) PostUISessionRequest(writer http.ResponseWriter, r *http.Request) {
+	u.writeUISessionRequest(writer, r, true)
+}
+
+// writeUISessionRequest handles writing a user's UI session. Sessions are
+// written often, so unlike preferences they aren't versioned, audited, or
+// scanned; the write is a single upsert, limited only by the configured size.
+func (u *UserPreferencesApp) writeUISessionRequest(writer http.ResponseWriter, r *http.Request, merge bool) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	expiresAt, err := u.uiSessionExpiration(r, time.Now())
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	var session map[string]interface{}
+	if err = decodeBody(r.Body, &session); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+	if session == nil {
+		session = make(map[string]interface{})
+	}
+
+	if merge {
+		stored, _, err := u.loadUISession(username)
+		if err != nil {
+			errored(writer, err.Error())
+			return
+		}
+		session = mergePreferences(stored, session)
+	}
+
+	jsoned, err := json.Marshal(session)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating UI session JSON for user %s: %s", username, err))
+		return
+	}
+
+	if u.uiSessionLimit > 0 && len(jsoned) > u.uiSessionLimit {
+		msg := fmt.Sprintf("The UI session for user %s would be %d bytes, which is over the limit of %d bytes", username, len(jsoned), u.uiSessionLimit)
+		http.Error(writer, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err = u.prefs.saveUISession(username, string(jsoned), expiresAt); err != nil {
+		errored(writer, fmt.Sprintf("Error saving the UI session for user %s: %s", username, err))
+		return
+	}
+
+	writeUISession(writer, username, session, expiresAt)
+}
+
+// DeleteUISessionRequest handles deleting a user's UI session.
+func (u *UserPreferencesApp) DeleteUISessionRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	if err := u.prefs.deleteUISession(username); err != nil {
+		errored(writer, fmt.Sprintf("Error deleting the UI session for user %s: %s", username, err))
+	}
+}
+
+// purgeUISessions removes the UI sessions that have expired.
+func (u *UserPreferencesApp) purgeUISessions(now time.Time) (int, error) {
+	purged, err := u.prefs.purgeUISessions(now)
+	if err != nil {
+		return 0, fmt.Errorf("Error purging expired UI sessions: %s", err)
+	}
+	return int(purged), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUISessionRequests(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+
+	n := New(mock)
+	n.uiSessionLimit = 64
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/session"
+
+	status, body := doRequest(t, http.MethodGet, url, nil, nil)
+	if status != http.StatusOK || string(body) != `{}` {
+		t.Errorf("GET without a session returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodPut, url, []byte(`{"layout":"grid","tabs":["data"]}`), nil)
+	if status != http.StatusOK || string(body) != `{"layout":"grid","tabs":["data"]}` {
+		t.Errorf("PUT returned %d: %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodPost, url, []byte(`{"tabs":["apps"]}`), nil)
+	if status != http.StatusOK || string(body) != `{"layout":"grid","tabs":["apps"]}` {
+		t.Errorf("POST returned %d: %s", status, body)
+	}
+
+	if prefs, _ := mock.getPreferences("alice"); prefs[0].Preferences != `{"theme":"dark"}` {
+		t.Errorf("writing the session changed the preferences: %s", prefs[0].Preferences)
+	}
+	if len(mock.history["alice"]) != 0 {
+		t.Error("writing the session recorded history")
+	}
+
+	big := []byte(`{"layout":"` + strings.Repeat("x", 64) + `"}`)
+	if status, _ = doRequest(t, http.MethodPut, url, big, nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a session over the limit returned %d", status)
+	}
+
+	if status, _ = doRequest(t, http.MethodDelete, url, nil, nil); status != http.StatusOK {
+		t.Errorf("DELETE returned %d", status)
+	}
+	if status, body = doRequest(t, http.MethodGet, url, nil, nil); string(body) != `{}` {
+		t.Errorf("GET after DELETE returned %d: %s", status, body)
+	}
+}
+
+func TestUISessionTTL(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.uiSessionTTL = time.Hour
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/session"
+
+	start := time.Now()
+	if status, _ := doRequest(t, http.MethodPut, url, []byte(`{"layout":"grid"}`), nil); status != http.StatusOK {
+		t.Fatalf("PUT returned %d", status)
+	}
+	if expires := mock.ui["alice"].ExpiresAt; expires.Before(start.Add(time.Hour)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("the session expires at %s", expires)
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, url+"?ttl=5m", []byte(`{"layout":"grid"}`), nil); status != http.StatusOK {
+		t.Fatalf("PUT with a TTL returned %d", status)
+	}
+	if expires := mock.ui["alice"].ExpiresAt; expires.After(time.Now().Add(5 * time.Minute)) {
+		t.Errorf("the session with a TTL expires at %s", expires)
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, url+"?ttl=soon", []byte(`{}`), nil); status != http.StatusBadRequest {
+		t.Errorf("an invalid TTL returned %d", status)
+	}
+
+	mock.ui["alice"].ExpiresAt = time.Now().Add(-time.Minute)
+	if status, body := doRequest(t, http.MethodGet, url, nil, nil); string(body) != `{}` {
+		t.Errorf("GET of an expired session returned %d: %s", status, body)
+	}
+	if purged, err := n.purgeUISessions(time.Now()); err != nil || purged != 1 {
+		t.Errorf("purgeUISessions returned %d, %v", purged, err)
+	}
+}
+
+func TestSaveUISession(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+
+	mock.ExpectExec("INSERT INTO user_preferences_ui_sessions (.+) ON CONFLICT \\(user_id\\) DO UPDATE").
+		WithArgs("test-user", `{"layout":"grid"}`, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = p.saveUISession("test-user", `{"layout":"grid"}`, time.Time{}); err != nil {
+		t.Errorf("error saving the UI session: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// undoRemainingHeader tells clients how many more changes can be undone in a
+// row, so that an undo button can be disabled once there aren't any.
+const undoRemainingHeader = "X-Undo-Remaining"
+
+// conflict writes out a 409 response for a request that can't be carried out
+// in the current state of the resource.
+func conflict(writer http.ResponseWriter, msg string) {
+	http.Error(writer, msg, http.StatusConflict)
+	log.Error(msg)
+}
+
+// UndoState is the position of a user's undo stack. Version is the version of
+// the preferences written by the most recent undo, HistoryID is the history
+// entry it restored, and Depth is the number of undos made in a row.
+type UndoState struct {
+	Version   int64
+	HistoryID int64
+	Depth     int
+}
+
+// getUndoState returns the position of the user's undo stack. sql.ErrNoRows
+// is returned if they've never undone a change.
+func (p *PrefsDB) getUndoState(username string) (*UndoState, error) {
+	query := `SELECT d.version, d.history_id, d.depth
+              FROM user_preferences_undo d,
+                   ` + p.tables.usersSource() + ` u
+             WHERE d.user_id = u.id
+               AND u.username = $1`
+
+	var state UndoState
+	if err := p.db.QueryRow(query, username).Scan(&state.Version, &state.HistoryID, &state.Depth); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveUndoState records the position of the user's undo stack.
+func (p *PrefsDB) saveUndoState(username string, state UndoState) error {
+	query := `INSERT INTO user_preferences_undo (user_id, version, history_id, depth)
+                   SELECT u.id, $2, $3, $4 FROM ` + p.tables.usersSource() + ` u WHERE u.username = $1
+              ON CONFLICT (user_id) DO UPDATE
+                      SET version = EXCLUDED.version,
+                          history_id = EXCLUDED.history_id,
+                          depth = EXCLUDED.depth`
+	_, err := p.db.Exec(query, username, state.Version, state.HistoryID, state.Depth)
+	return err
+}
+
+// undoTarget returns the history entry that an undo restores and how many
+// undos in a row it makes. An undo made right after another one continues
+// down the stack from the entry the last one restored; otherwise it restores
+// the version replaced by the most recent change. A nil entry is returned if
+// there's nothing left to undo.
+func (u *UserPreferencesApp) undoTarget(username string, current UserPreferencesRecord) (*HistoryRecord, int, error) {
+	filter, depth := PageFilter{Limit: 1}, 1
+
+	state, err := u.prefs.getUndoState(username)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, fmt.Errorf("Error getting the undo state for user %s: %s", username, err)
+	}
+	if state != nil && current.ID != "" && state.Version == current.Version {
+		filter.Before, depth = state.HistoryID, state.Depth+1
+	}
+
+	if depth > u.undoDepth {
+		return nil, depth, nil
+	}
+
+	records, err := u.prefs.listHistory(username, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error getting the preferences history for user %s: %s", username, err)
+	}
+	if len(records) == 0 {
+		return nil, depth, nil
+	}
+	return &records[0], depth, nil
+}
+
+// UndoRequest handles reverting the most recent change to a user's
+// preferences by restoring the version it replaced from the history. Undoing
+// again right away reverts the change before that, up to the configured
+// depth. Like a restore, the undo is written as a new version.
+func (u *UserPreferencesApp) UndoRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	if u.undoDepth <= 0 {
+		notFound(writer, "Undo is disabled")
+		return
+	}
+
+	records, err := u.prefs.getPreferences(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error getting preferences for username %s: %s", username, err))
+		return
+	}
+	var current UserPreferencesRecord
+	if len(records) > 0 {
+		current = records[0]
+	}
+
+	target, depth, err := u.undoTarget(username, current)
+	if err != nil {
+		errored(writer, err.Error())
+		return
+	}
+	if target == nil {
+		conflict(writer, fmt.Sprintf("There are no more changes to the preferences of user %s to undo", username))
+		return
+	}
+
+	log.Infof("Undoing a change to the preferences of user %s by restoring version %d", username, target.Version)
+	created, ok := u.restoreHistory(writer, r, username, target)
+	if !ok {
+		return
+	}
+
+	if records, err = u.prefs.getPreferences(username); err != nil || len(records) == 0 {
+		errored(writer, fmt.Sprintf("Error getting the undone preferences for user %s: %v", username, err))
+		return
+	}
+	state := UndoState{Version: records[0].Version, HistoryID: target.ID, Depth: depth}
+	if err = u.prefs.saveUndoState(username, state); err != nil {
+		errored(writer, fmt.Sprintf("Error saving the undo state for user %s: %s", username, err))
+		return
+	}
+
+	writer.Header().Set(undoRemainingHeader, strconv.Itoa(u.undoDepth-depth))
+	u.writeStoredPreferences(writer, r, username, created, nil)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// undo makes an undo request for test-user and returns the status and the
+// restored preferences.
+func undo(t *testing.T, server *httptest.Server) (int, map[string]interface{}) {
+	status, body := doRequest(t, http.MethodPost, server.URL+"/test-user/undo", nil, nil)
+	if status != http.StatusOK && status != http.StatusCreated {
+		return status, nil
+	}
+
+	var response struct {
+		Preferences map[string]interface{} `json:"preferences"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("the undo response wasn't JSON: %s", body)
+	}
+	return status, response.Preferences
+}
+
+func TestUndo(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	for _, prefs := range []string{`{"step":1}`, `{"step":2}`, `{"step":3}`} {
+		if err := mock.insertPreferences("test-user", prefs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := New(mock)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	for _, expected := range []float64{2, 1} {
+		status, prefs := undo(t, server)
+		if status != http.StatusOK || !reflect.DeepEqual(prefs, map[string]interface{}{"step": expected}) {
+			t.Errorf("undo returned %d %v instead of step %v", status, prefs, expected)
+		}
+	}
+	if status, _ := undo(t, server); status != http.StatusConflict {
+		t.Errorf("undo with nothing left to undo returned %d", status)
+	}
+
+	if status, body := doRequest(t, http.MethodPut, server.URL+"/test-user", []byte(`{"step":4}`), nil); status != http.StatusOK {
+		t.Fatalf("PUT returned %d: %s", status, body)
+	}
+	if status, prefs := undo(t, server); status != http.StatusOK || !reflect.DeepEqual(prefs, map[string]interface{}{"step": 1.0}) {
+		t.Errorf("undo after a new change returned %d %v", status, prefs)
+	}
+
+	n.undoDepth = 1
+	if status, body := doRequest(t, http.MethodPut, server.URL+"/test-user", []byte(`{"step":5}`), nil); status != http.StatusOK {
+		t.Fatalf("PUT returned %d: %s", status, body)
+	}
+	if status, _ := undo(t, server); status != http.StatusOK {
+		t.Errorf("undo within the depth returned %d", status)
+	}
+	if status, _ := undo(t, server); status != http.StatusConflict {
+		t.Errorf("undo beyond the depth returned %d", status)
+	}
+
+	n.undoDepth = 0
+	if status, _ := undo(t, server); status != http.StatusNotFound {
+		t.Errorf("undo while disabled returned %d", status)
+	}
+}
+
+func TestUndoDelete(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(mock))
+	defer server.Close()
+
+	if status, body := doRequest(t, http.MethodDelete, server.URL+"/test-user", nil, nil); status != http.StatusOK {
+		t.Fatalf("DELETE returned %d: %s", status, body)
+	}
+
+	resp, err := http.Post(server.URL+"/test-user/undo", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get(undoRemainingHeader) != "9" {
+		t.Errorf("undo of a delete returned %d with %s %s", resp.StatusCode, undoRemainingHeader, resp.Header.Get(undoRemainingHeader))
+	}
+	if records, _ := mock.getPreferences("test-user"); len(records) != 1 || records[0].Preferences != `{"theme":"dark"}` {
+		t.Errorf("undo of a delete stored %v", records)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPendingUsage is the number of users whose usage is held in memory between
+// flushes. Requests for other users are dropped until the next flush, so that
+// requests for made-up usernames can't exhaust the memory.
+const maxPendingUsage = 100000
+
+// usageDropped counts the requests that weren't counted because too many users
+// were waiting to be flushed. It's published at /debug/vars.
+var usageDropped = expvar.NewInt("usage_dropped")
+
+// UserUsage is the number of reads and writes of a user's data, and when the
+// user's data was last accessed.
+type UserUsage struct {
+	Username   string     `json:"username"`
+	Reads      int64      `json:"reads"`
+	Writes     int64      `json:"writes"`
+	LastAccess *time.Time `json:"last_access"`
+}
+
+// add adds the other usage to this one.
+func (u *UserUsage) add(other UserUsage) {
+	u.Reads += other.Reads
+	u.Writes += other.Writes
+	if other.LastAccess != nil && (u.LastAccess == nil || other.LastAccess.After(*u.LastAccess)) {
+		at := *other.LastAccess
+		u.LastAccess = &at
+	}
+}
+
+// UsageTracker counts the requests for each user's data in memory until
+// they're flushed to the database.
+type UsageTracker struct {
+	mu      sync.Mutex
+	pending map[string]*UserUsage
+}
+
+// NewUsageTracker returns a newly created *UsageTracker.
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{pending: make(map[string]*UserUsage)}
+}
+
+// record counts a read or write of the user's data.
+func (t *UsageTracker) record(username string, write bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage, ok := t.pending[username]
+	if !ok {
+		if len(t.pending) >= maxPendingUsage {
+			usageDropped.Add(1)
+			return
+		}
+		usage = &UserUsage{Username: username}
+		t.pending[username] = usage
+	}
+
+	if write {
+		usage.Writes++
+	} else {
+		usage.Reads++
+	}
+	usage.LastAccess = &now
+}
+
+// take returns the usage recorded since the last flush and starts counting
+// afresh.
+func (t *UsageTracker) take() []UserUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage := make([]UserUsage, 0, len(t.pending))
+	for _, u := range t.pending {
+		usage = append(usage, *u)
+	}
+	t.pending = make(map[string]*UserUsage)
+	return usage
+}
+
+// restore puts back usage that couldn't be flushed, so that it's included in
+// the next flush.
+func (t *UsageTracker) restore(usage []UserUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, u := range usage {
+		if pending, ok := t.pending[u.Username]; ok {
+			pending.add(u)
+			continue
+		}
+		restored := u
+		t.pending[u.Username] = &restored
+	}
+}
+
+// pendingFor returns the usage recorded for the user since the last flush.
+func (t *UsageTracker) pendingFor(username string) UserUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if usage, ok := t.pending[username]; ok {
+		return *usage
+	}
+	return UserUsage{Username: username}
+}
+
+// addUsage adds the usage to the stored totals in a single transaction. Usage
+// for usernames that aren't in the users table is discarded.
+func (p *PrefsDB) addUsage(usage []UserUsage) error {
+	query := `INSERT INTO user_preferences_usage (user_id, reads, writes, last_access)
+                   SELECT ` + p.tables.UserID + `, $2, $3, $4 FROM ` + p.tables.Users + ` WHERE ` + p.tables.Username + ` = $1
+              ON CONFLICT (user_id) DO UPDATE
+                      SET reads = user_preferences_usage.reads + EXCLUDED.reads,
+                          writes = user_preferences_usage.writes + EXCLUDED.writes,
+                          last_access = GREATEST(user_preferences_usage.last_access, EXCLUDED.last_access)`
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range usage {
+		if _, err = tx.Exec(query, u.Username, u.Reads, u.Writes, u.LastAccess); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getUsage returns the stored usage totals for the user, which are zero if
+// none have been flushed.
+func (p *PrefsDB) getUsage(username string) (*UserUsage, error) {
+	query := `SELECT s.reads, s.writes, s.last_access
+                FROM user_preferences_usage s,
+                     ` + p.tables.usersSource() + ` u
+               WHERE s.user_id = u.id
+                 AND u.username = $1`
+
+	usage := &UserUsage{Username: username}
+	var lastAccess time.Time
+	err := p.db.QueryRow(query, username).Scan(&usage.Reads, &usage.Writes, &lastAccess)
+	if err == sql.ErrNoRows {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage.LastAccess = &lastAccess
+	return usage, nil
+}
+
+// observeUsage counts the request if it's routed to one of a user's resources.
+// Administrative routes aren't counted, since they aren't made by the user's
+// clients, and neither are requests with invalid usernames.
+func (u *UserPreferencesApp) observeUsage(r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	var match mux.RouteMatch
+	if !u.router.Match(r, &match) || match.Route == nil {
+		return
+	}
+	username, ok := match.Vars["username"]
+	if !ok {
+		return
+	}
+	if template, err := match.Route.GetPathTemplate(); err != nil || strings.HasPrefix(template, "/admin/") {
+		return
+	}
+	if u.usernames != nil {
+		normalized, err := u.usernames.normalize(username)
+		if err != nil {
+			return
+		}
+		username = normalized
+	}
+
+	u.usage.record(username, r.Method != http.MethodGet && r.Method != http.MethodHead, time.Now())
+}
+
+// flushUsage adds the usage recorded in memory to the stored totals.
+func (u *UserPreferencesApp) flushUsage(now time.Time) (int, error) {
+	usage := u.usage.take()
+	if len(usage) == 0 {
+		return 0, nil
+	}
+
+	if err := u.prefs.addUsage(usage); err != nil {
+		u.usage.restore(usage)
+		return 0, err
+	}
+	return len(usage), nil
+}
+
+// UsageRequest handles writing out the number of reads and writes of a user's
+// data, including the ones that haven't been flushed to the database yet.
+func (u *UserPreferencesApp) UsageRequest(writer http.ResponseWriter, r *http.Request) {
+	if u.usage == nil {
+		notFound(writer, "Usage tracking is not enabled")
+		return
+	}
+
+	username, ok := u.pathUsername(writer, r)
+	if !ok {
+		return
+	}
+	usage, err := u.prefs.getUsage(username)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error looking up the usage for user %s: %s", username, err))
+		return
+	}
+	usage.add(u.usage.pendingFor(username))
+
+	jsoned, err := json.Marshal(usage)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating usage JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
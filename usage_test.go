@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUsageTracker(t *testing.T) {
+	tracker := NewUsageTracker()
+	first := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tracker.record("alice", false, first)
+	tracker.record("alice", true, first.Add(time.Minute))
+	tracker.record("bob", false, first)
+
+	if pending := tracker.pendingFor("alice"); pending.Reads != 1 || pending.Writes != 1 || !pending.LastAccess.Equal(first.Add(time.Minute)) {
+		t.Errorf("the pending usage for alice was %+v", pending)
+	}
+
+	usage := tracker.take()
+	if len(usage) != 2 {
+		t.Fatalf("%d users' usage was taken", len(usage))
+	}
+	if pending := tracker.pendingFor("alice"); pending.Reads != 0 || pending.LastAccess != nil {
+		t.Errorf("the usage wasn't reset after it was taken: %+v", pending)
+	}
+
+	tracker.record("alice", false, first.Add(2*time.Minute))
+	tracker.restore(usage)
+	if pending := tracker.pendingFor("alice"); pending.Reads != 2 || pending.Writes != 1 || !pending.LastAccess.Equal(first.Add(2*time.Minute)) {
+		t.Errorf("the restored usage for alice was %+v", pending)
+	}
+	if pending := tracker.pendingFor("bob"); pending.Reads != 1 {
+		t.Errorf("the restored usage for bob was %+v", pending)
+	}
+}
+
+func TestUsageTrackerLimit(t *testing.T) {
+	tracker := NewUsageTracker()
+	for i := 0; i < maxPendingUsage; i++ {
+		tracker.pending[strconv.Itoa(i)] = &UserUsage{}
+	}
+
+	before := usageDropped.Value()
+	tracker.record("alice", false, time.Now())
+	if usageDropped.Value() != before+1 || len(tracker.pending) != maxPendingUsage {
+		t.Errorf("a request for a new user was counted with %d users pending", maxPendingUsage)
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user_preferences_usage (.+) SELECT id, \\$2, \\$3, \\$4 FROM users WHERE username = \\$1 ON CONFLICT").
+		WithArgs("alice", int64(3), int64(1), &now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_preferences_usage").
+		WithArgs("bob", int64(0), int64(2), &now).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	usage := []UserUsage{
+		{Username: "alice", Reads: 3, Writes: 1, LastAccess: &now},
+		{Username: "bob", Writes: 2, LastAccess: &now},
+	}
+	if err = NewPrefsDB(db).addUsage(usage); err == nil {
+		t.Error("addUsage() didn't return the error")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT s.reads, s.writes, s.last_access FROM user_preferences_usage s").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"reads", "writes", "last_access"}).AddRow(5, 2, now))
+	mock.ExpectQuery("SELECT s.reads, s.writes, s.last_access FROM user_preferences_usage s").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"reads", "writes", "last_access"}))
+
+	p := NewPrefsDB(db)
+	usage, err := p.getUsage("alice")
+	if err != nil || usage.Reads != 5 || usage.Writes != 2 || usage.LastAccess == nil {
+		t.Errorf("getUsage(alice) returned %+v, %v", usage, err)
+	}
+	usage, err = p.getUsage("bob")
+	if err != nil || usage.Reads != 0 || usage.LastAccess != nil {
+		t.Errorf("getUsage(bob) returned %+v, %v", usage, err)
+	}
+}
+
+func TestUsageRequest(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	n := New(mock)
+	if err := configureApp(n, testConfig(t, "user-preferences:\n  admin:\n    key: secret\n  usage:\n    enabled: true\n")); err != nil {
+		t.Fatalf("error from configureApp(): %s", err)
+	}
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	admin := map[string]string{adminKeyHeader: "secret"}
+	doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil)
+	doRequest(t, http.MethodPut, server.URL+"/alice", []byte(`{"theme":"dark"}`), nil)
+	doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil)
+	if _, err := n.flushUsage(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	doRequest(t, http.MethodGet, server.URL+"/alice", nil, nil)
+	doRequest(t, http.MethodGet, server.URL+"/admin/users", nil, admin)
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/usage/alice", nil, admin)
+	if status != http.StatusOK {
+		t.Fatalf("the usage request returned %d: %s", status, body)
+	}
+	var usage UserUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Username != "alice" || usage.Reads != 3 || usage.Writes != 1 || usage.LastAccess == nil {
+		t.Errorf("the usage was %s", body)
+	}
+	if mock.usage["alice"].Reads != 2 {
+		t.Errorf("the flushed usage was %+v", mock.usage["alice"])
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/admin/usage/alice", nil, admin)
+	if err := json.Unmarshal(body, &usage); err != nil || usage.Reads != 3 {
+		t.Errorf("reading the usage was counted as usage: %s", body)
+	}
+}
+
+func TestUsageRequestDisabled(t *testing.T) {
+	n := New(NewMockDB())
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/usage/alice", nil, map[string]string{adminKeyHeader: "secret"})
+	if status != http.StatusNotFound {
+		t.Errorf("the usage request returned %d without usage tracking", status)
+	}
+}
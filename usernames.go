@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Ways of handling the domain suffix on usernames.
+const (
+	suffixNone   = "none"
+	suffixStrip  = "strip"
+	suffixAppend = "append"
+)
+
+// UsernamePolicy normalizes the usernames in request paths and rejects the ones
+// that can't be valid, so that misrouted requests fail before they cost a
+// database query. The pattern and length are checked against the username
+// without its domain suffix.
+type UsernamePolicy struct {
+	pattern    *regexp.Regexp
+	maxLength  int
+	lowercase  bool
+	suffix     string
+	suffixMode string
+}
+
+// NewUsernamePolicy returns a newly created *UsernamePolicy. An empty pattern
+// or a maxLength of zero isn't checked. The suffix, such as
+// "@iplantcollaborative.org", is removed from usernames if suffixMode is
+// "strip" and added to them if it's "append".
+func NewUsernamePolicy(pattern string, maxLength int, lowercase bool, suffix, suffixMode string) (*UsernamePolicy, error) {
+	p := &UsernamePolicy{
+		maxLength:  maxLength,
+		lowercase:  lowercase,
+		suffix:     suffix,
+		suffixMode: suffixMode,
+	}
+
+	if pattern != "" {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid username pattern %s: %s", pattern, err)
+		}
+		p.pattern = compiled
+	}
+
+	switch suffixMode {
+	case "":
+		p.suffixMode = suffixNone
+	case suffixNone:
+	case suffixStrip, suffixAppend:
+		if suffix == "" {
+			return nil, fmt.Errorf("A username suffix must be set to %s it", suffixMode)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown username suffix mode %s", suffixMode)
+	}
+	if lowercase {
+		p.suffix = strings.ToLower(p.suffix)
+	}
+
+	return p, nil
+}
+
+// normalize returns the username as it's stored, or an error describing why
+// it isn't valid.
+func (p *UsernamePolicy) normalize(username string) (string, error) {
+	if p.lowercase {
+		username = strings.ToLower(username)
+	}
+
+	name := username
+	if p.suffixMode != suffixNone {
+		name = strings.TrimSuffix(username, p.suffix)
+		if strings.HasSuffix(name, p.suffix) {
+			return "", fmt.Errorf("The username %s has the suffix %s more than once", username, p.suffix)
+		}
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("The username %s is empty", username)
+	}
+	if p.maxLength > 0 && utf8.RuneCountInString(name) > p.maxLength {
+		return "", fmt.Errorf("The username %s is longer than %d characters", username, p.maxLength)
+	}
+	if p.pattern != nil && !p.pattern.MatchString(name) {
+		return "", fmt.Errorf("The username %s doesn't match the pattern %s", username, p.pattern)
+	}
+
+	if p.suffixMode == suffixAppend {
+		return name + p.suffix, nil
+	}
+	return name, nil
+}
+
+// lookupUsername returns the username as it's spelled in the users table,
+// matching it without regard to case. An exact match is preferred, and
+// sql.ErrNoRows is returned if there isn't any match.
+func (p *PrefsDB) lookupUsername(username string) (string, error) {
+	query := `SELECT u.username
+                FROM ` + p.tables.usersSource() + ` u
+               WHERE lower(u.username) = lower($1)
+            ORDER BY u.username = $1 DESC, u.username
+               LIMIT 1`
+
+	var stored string
+	if err := p.db.QueryRow(query, username).Scan(&stored); err != nil {
+		return "", err
+	}
+	return stored, nil
+}
+
+// pathUsernameKey is the context key for the username from a request's URL once
+// pathUsername has resolved it.
+type pathUsernameKey struct{}
+
+// withPathUsername returns the request with the username that pathUsername
+// resolved for it, so that later calls return it without repeating the checks.
+func withPathUsername(r *http.Request, username string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathUsernameKey{}, username))
+}
+
+// pathUsername returns the normalized username from the request's URL, after
+// checking that it's valid and that the caller may act for the user. If
+// usernames aren't case-sensitive, it's then replaced by the spelling in the
+// users table, so unauthenticated requests never cost a database query. It
+// writes out an error response and returns false if any of those checks fails.
+func (u *UserPreferencesApp) pathUsername(writer http.ResponseWriter, r *http.Request) (string, bool) {
+	if username, ok := r.Context().Value(pathUsernameKey{}).(string); ok {
+		return username, true
+	}
+
+	username, ok := mux.Vars(r)["username"]
+	if !ok {
+		badRequest(writer, "Missing username in URL")
+		return "", false
+	}
+
+	if u.usernames != nil {
+		normalized, err := u.usernames.normalize(username)
+		if err != nil {
+			badRequest(writer, err.Error())
+			return "", false
+		}
+		username = normalized
+	}
+
+	if !u.authorize(writer, r, username) {
+		return "", false
+	}
+
+	if u.foldUsernames {
+		stored, err := u.prefs.lookupUsername(username)
+		if err != nil && err != sql.ErrNoRows {
+			errored(writer, fmt.Sprintf("Error looking up username %s: %s", username, err))
+			return "", false
+		}
+		if err == nil {
+			username = stored
+		}
+	}
+
+	if u.archiving {
+		if err := u.restoreArchived(username); err != nil {
+			errored(writer, err.Error())
+			return "", false
+		}
+	}
+
+	return username, true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUsernamePolicy(t *testing.T) {
+	policy, err := NewUsernamePolicy(`^[a-z0-9_.-]+$`, 8, true, "@iplantcollaborative.org", suffixAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{
+		"alice":                         "alice@iplantcollaborative.org",
+		"Alice":                         "alice@iplantcollaborative.org",
+		"alice@iplantcollaborative.org": "alice@iplantcollaborative.org",
+		"ALICE@IPLANTCOLLABORATIVE.ORG": "alice@iplantcollaborative.org",
+	}
+	for username, expected := range valid {
+		if normalized, err := policy.normalize(username); err != nil || normalized != expected {
+			t.Errorf("%s was normalized to %q: %v", username, normalized, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"al ice":                   "doesn't match",
+		"bartholomew":              "longer than 8",
+		"bob!":                     "doesn't match",
+		"@iplantcollaborative.org": "empty",
+	}
+	for username, problem := range invalid {
+		if _, err := policy.normalize(username); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("%s returned %v", username, err)
+		}
+	}
+
+	policy, err = NewUsernamePolicy("", 0, false, "@iplantcollaborative.org", suffixStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normalized, err := policy.normalize("alice@iplantcollaborative.org"); err != nil || normalized != "alice" {
+		t.Errorf("the suffix wasn't stripped: %q, %v", normalized, err)
+	}
+	if _, err = policy.normalize("alice@iplantcollaborative.org@iplantcollaborative.org"); err == nil {
+		t.Error("a username with the suffix twice was accepted")
+	}
+
+	if _, err = NewUsernamePolicy("(", 0, false, "", suffixNone); err == nil {
+		t.Error("an invalid pattern was accepted")
+	}
+	if _, err = NewUsernamePolicy("", 0, false, "", suffixAppend); err == nil {
+		t.Error("appending an empty suffix was accepted")
+	}
+	if _, err = NewUsernamePolicy("", 0, false, "@example.org", "replace"); err == nil {
+		t.Error("an unknown suffix mode was accepted")
+	}
+}
+
+func TestUsernameValidation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	cfg := testConfig(t, "user-preferences:\n  usernames:\n    lowercase: true\n    pattern: '^[a-z]+$'\n")
+	n := New(mock)
+	if err := configureApp(n, cfg); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, body := doRequest(t, http.MethodPut, server.URL+"/Alice", []byte(`{"theme":"dark"}`), nil); status != http.StatusCreated {
+		t.Errorf("a write for a normalized username returned %d: %s", status, body)
+	}
+	if has, _ := mock.hasPreferences("alice"); !has {
+		t.Error("the preferences weren't stored for the normalized username")
+	}
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/wp-login.php", nil, nil)
+	if status != http.StatusBadRequest || !strings.Contains(string(body), "doesn't match the pattern") {
+		t.Errorf("an invalid username returned %d: %s", status, body)
+	}
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/wp-login.php/quota", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("an invalid username on a subresource returned %d", status)
+	}
+}
+
+func TestLookupUsername(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT u.username FROM users u WHERE lower\\(u.username\\) = lower\\(\\$1\\)").
+		WithArgs("Alice").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("alice"))
+
+	stored, err := NewPrefsDB(db).lookupUsername("Alice")
+	if err != nil || stored != "alice" {
+		t.Errorf("lookupUsername(Alice) returned %q, %v", stored, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaseInsensitiveUsernames(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	if err := mock.insertPreferences("alice", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/ALICE", nil, nil); status == http.StatusOK {
+		t.Error("a username differing in case was found while usernames were case-sensitive")
+	}
+
+	n.foldUsernames = true
+	status, body := doRequest(t, http.MethodGet, server.URL+"/ALICE", nil, nil)
+	if status != http.StatusOK || !strings.Contains(string(body), "dark") {
+		t.Errorf("GET /ALICE returned %d: %s", status, body)
+	}
+	if status, _ = doRequest(t, http.MethodGet, server.URL+"/bob", nil, nil); status == http.StatusOK {
+		t.Error("an unknown user was found")
+	}
+}
+
+// lookupCountingDB counts the calls to lookupUsername.
+type lookupCountingDB struct {
+	*MockDB
+	lookups int
+}
+
+func (c *lookupCountingDB) lookupUsername(username string) (string, error) {
+	c.lookups++
+	return c.MockDB.lookupUsername(username)
+}
+
+func TestFoldUsernamesAfterAuthorizing(t *testing.T) {
+	mock := &lookupCountingDB{MockDB: NewMockDB()}
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.foldUsernames = true
+	n.auth = fixedAuthenticator{err: ErrNoCredentials}
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	if status, _ := doRequest(t, http.MethodGet, server.URL+"/ALICE", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("a request without credentials returned %d", status)
+	}
+	if mock.lookups != 0 {
+		t.Errorf("an unauthenticated request looked up the username %d times", mock.lookups)
+	}
+
+	n.auth = fixedAuthenticator{username: "alice"}
+	if status, body := doRequest(t, http.MethodGet, server.URL+"/ALICE", nil, nil); status != http.StatusOK {
+		t.Errorf("a request for the authenticated user in another case returned %d: %s", status, body)
+	}
+	if mock.lookups != 1 {
+		t.Errorf("an authenticated request looked up the username %d times", mock.lookups)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The limits on the number of users returned by a single listing request.
+const (
+	defaultUserListLimit = 100
+	maxUserListLimit     = 1000
+)
+
+// userSortColumns maps the sort fields accepted by the listing endpoint to the
+// columns they sort by.
+var userSortColumns = map[string]string{
+	"username":    "u.username",
+	"created_at":  "p.created_at",
+	"modified_at": "p.modified_at",
+	"size":        "COALESCE(octet_length(p.preferences), octet_length(p.compressed))",
+}
+
+// UserFilter selects and orders the users returned by listUsers.
+type UserFilter struct {
+	// HasPreferences limits the listing to users with (true) or without
+	// (false) stored preferences. All users are listed if it's nil.
+	HasPreferences *bool
+
+	// ModifiedSince limits the listing to users whose preferences were
+	// modified at or after the time, if it's set.
+	ModifiedSince *time.Time
+
+	// Sort is one of the keys of userSortColumns. Descending reverses the
+	// order. Ties are broken by username.
+	Sort       string
+	Descending bool
+
+	Limit  int
+	Offset int
+}
+
+// UserSummary describes a user and their stored preferences. The preferences
+// fields are empty if the user doesn't have any.
+type UserSummary struct {
+	Username       string     `json:"username"`
+	HasPreferences bool       `json:"has_preferences"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	ModifiedAt     *time.Time `json:"modified_at,omitempty"`
+	Version        int64      `json:"version,omitempty"`
+	Size           int        `json:"size,omitempty"`
+}
+
+// userListResponse is the JSON body returned by the user listing endpoint.
+// NextOffset is only set if there may be more users to list.
+type userListResponse struct {
+	Users      []UserSummary `json:"users"`
+	Limit      int           `json:"limit"`
+	Offset     int           `json:"offset"`
+	NextOffset *int          `json:"next_offset,omitempty"`
+}
+
+// listUsers returns the users matching the filter.
+func (p *PrefsDB) listUsers(filter UserFilter) ([]UserSummary, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	if filter.HasPreferences != nil {
+		if *filter.HasPreferences {
+			conditions = append(conditions, "p.id IS NOT NULL")
+		} else {
+			conditions = append(conditions, "p.id IS NULL")
+		}
+	}
+
+	if filter.ModifiedSince != nil {
+		args = append(args, *filter.ModifiedSince)
+		conditions = append(conditions, fmt.Sprintf("p.modified_at >= $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	column, ok := userSortColumns[filter.Sort]
+	if !ok {
+		column = userSortColumns["username"]
+	}
+	direction := "ASC"
+	if filter.Descending {
+		direction = "DESC"
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(`SELECT u.username,
+                   p.created_at,
+                   p.modified_at,
+                   COALESCE(p.version, 0),
+                   COALESCE(octet_length(p.preferences), octet_length(p.compressed), 0)
+              FROM %s u
+         LEFT JOIN %s p ON p.user_id = u.id
+              %s
+          ORDER BY %s %s NULLS LAST, u.username
+             LIMIT $%d OFFSET $%d`, p.tables.usersSource(), p.tables.Preferences, where, column, direction, len(args)-1, len(args))
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var (
+			user       UserSummary
+			createdAt  pq.NullTime
+			modifiedAt pq.NullTime
+		)
+		if err := rows.Scan(&user.Username, &createdAt, &modifiedAt, &user.Version, &user.Size); err != nil {
+			return nil, err
+		}
+		if createdAt.Valid {
+			user.HasPreferences = true
+			user.CreatedAt = &createdAt.Time
+			user.ModifiedAt = &modifiedAt.Time
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// parseUserFilter builds a UserFilter from the listing request's query
+// parameters.
+func parseUserFilter(r *http.Request) (UserFilter, error) {
+	var (
+		filter = UserFilter{Sort: "username", Limit: defaultUserListLimit}
+		params = r.URL.Query()
+		err    error
+	)
+
+	if value := params.Get("has-preferences"); value != "" {
+		hasPrefs, parseErr := strconv.ParseBool(value)
+		if parseErr != nil {
+			return filter, fmt.Errorf("Invalid has-preferences value: %s", value)
+		}
+		filter.HasPreferences = &hasPrefs
+	}
+
+	if value := params.Get("modified-since"); value != "" {
+		since, parseErr := time.Parse(time.RFC3339, value)
+		if parseErr != nil {
+			return filter, fmt.Errorf("Invalid modified-since value %s; use an RFC 3339 timestamp", value)
+		}
+		filter.ModifiedSince = &since
+	}
+
+	if value := params.Get("sort"); value != "" {
+		if _, ok := userSortColumns[value]; !ok {
+			return filter, fmt.Errorf("Invalid sort field: %s", value)
+		}
+		filter.Sort = value
+	}
+
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, fmt.Errorf("Invalid order %s; use asc or desc", order)
+	}
+
+	if value := params.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxUserListLimit {
+			return filter, fmt.Errorf("Invalid limit %s; use a number from 1 to %d", value, maxUserListLimit)
+		}
+	}
+
+	if value := params.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("Invalid offset: %s", value)
+		}
+	}
+
+	return filter, nil
+}
+
+// ListUsersRequest handles listing users and metadata about their preferences.
+func (u *UserPreferencesApp) ListUsersRequest(writer http.ResponseWriter, r *http.Request) {
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		badRequest(writer, err.Error())
+		return
+	}
+
+	users, err := u.prefs.listUsers(filter)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error listing users: %s", err))
+		return
+	}
+
+	response := &userListResponse{
+		Users:  users,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	}
+	if len(users) == filter.Limit {
+		next := filter.Offset + filter.Limit
+		response.NextOffset = &next
+	}
+
+	jsoned, err := json.Marshal(response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating user list JSON: %s", err))
+		return
+	}
+
+	writer.Write(jsoned)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseUserFilter(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/admin/users?has-preferences=true&modified-since=2020-01-02T03:04:05Z&sort=modified_at&order=desc&limit=10&offset=20", nil)
+
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.HasPreferences == nil || !*filter.HasPreferences {
+		t.Errorf("has-preferences was %v", filter.HasPreferences)
+	}
+	if filter.ModifiedSince == nil || !filter.ModifiedSince.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("modified-since was %v", filter.ModifiedSince)
+	}
+	if filter.Sort != "modified_at" || !filter.Descending || filter.Limit != 10 || filter.Offset != 20 {
+		t.Errorf("filter was %#v", filter)
+	}
+
+	for _, query := range []string{
+		"has-preferences=maybe",
+		"modified-since=yesterday",
+		"sort=preferences",
+		"order=sideways",
+		"limit=0",
+		"limit=1001",
+		"offset=-1",
+	} {
+		r = httptest.NewRequest(http.MethodGet, "/admin/users?"+query, nil)
+		if _, err = parseUserFilter(r); err == nil {
+			t.Errorf("%s did not return an error", query)
+		}
+	}
+}
+
+func TestListUsersRequest(t *testing.T) {
+	mock := NewMockDB()
+	for _, username := range []string{"alice", "bob", "carol"} {
+		mock.users[username] = true
+	}
+	mock.insertPreferences("alice", `{"theme":"dark"}`)
+	mock.insertPreferences("carol", `{}`)
+
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	headers := map[string]string{adminKeyHeader: "secret"}
+
+	status, _ := doRequest(t, http.MethodGet, server.URL+"/admin/users", nil, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("listing users without the admin key returned %d instead of %d", status, http.StatusForbidden)
+	}
+
+	query := url.Values{"has-preferences": {"true"}, "limit": {"1"}}
+	status, body := doRequest(t, http.MethodGet, server.URL+"/admin/users?"+query.Encode(), nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("listing users returned %d instead of %d", status, http.StatusOK)
+	}
+
+	var parsed userListResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Users) != 1 || parsed.Users[0].Username != "alice" || !parsed.Users[0].HasPreferences {
+		t.Errorf("the first page was %#v", parsed.Users)
+	}
+	if parsed.NextOffset == nil || *parsed.NextOffset != 1 {
+		t.Errorf("the next offset was %v", parsed.NextOffset)
+	}
+
+	query.Set("offset", "1")
+	_, body = doRequest(t, http.MethodGet, server.URL+"/admin/users?"+query.Encode(), nil, headers)
+	parsed = userListResponse{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Users) != 1 || parsed.Users[0].Username != "carol" {
+		t.Errorf("the second page was %#v", parsed.Users)
+	}
+
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/admin/users?sort=bogus", nil, headers)
+	if status != http.StatusBadRequest {
+		t.Errorf("an invalid sort returned %d instead of %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	p := NewPrefsDB(db)
+	hasPrefs := true
+	since := time.Now().Add(-time.Hour)
+	modified := time.Now()
+
+	mock.ExpectQuery(`SELECT u.username, .+ FROM users u LEFT JOIN user_preferences p ON p.user_id = u.id WHERE p.id IS NOT NULL AND p.modified_at >= \$1 ORDER BY p.modified_at DESC NULLS LAST, u.username LIMIT \$2 OFFSET \$3`).
+		WithArgs(since, 10, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "created_at", "modified_at", "version", "size"}).
+			AddRow("alice", modified, modified, 2, 16).
+			AddRow("bob", nil, nil, 0, 0))
+
+	users, err := p.listUsers(UserFilter{
+		HasPreferences: &hasPrefs,
+		ModifiedSince:  &since,
+		Sort:           "modified_at",
+		Descending:     true,
+		Limit:          10,
+	})
+	if err != nil {
+		t.Fatalf("error from listUsers(): %s", err)
+	}
+
+	if len(users) != 2 || !users[0].HasPreferences || users[0].Size != 16 || users[1].HasPreferences {
+		t.Errorf("listUsers() returned %#v", users)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// The build information, set with -ldflags "-X main.appver=... -X
+// main.gitref=... -X main.builddate=...".
+var (
+	gitref    string
+	appver    string
+	builtby   string
+	builddate string
+)
+
+// serviceName is the name the service reports for itself.
+const serviceName = "user-preferences"
+
+// serviceVersionHeader is the response header that names the running version.
+const serviceVersionHeader = "X-Service-Version"
+
+// unknownVersion is reported for build information that wasn't set.
+const unknownVersion = "unknown"
+
+// orUnknown returns the value, or unknownVersion if it's empty.
+func orUnknown(value string) string {
+	if value == "" {
+		return unknownVersion
+	}
+	return value
+}
+
+// serviceVersion returns the version of the running build.
+func serviceVersion() string {
+	return orUnknown(appver)
+}
+
+// versionInfo describes the running build.
+type versionInfo struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	GitRef    string `json:"git_ref"`
+	BuildDate string `json:"build_date"`
+	BuiltBy   string `json:"built_by,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo returns the information about the running build.
+func buildInfo() versionInfo {
+	return versionInfo{
+		Service:   serviceName,
+		Version:   serviceVersion(),
+		GitRef:    orUnknown(gitref),
+		BuildDate: orUnknown(builddate),
+		BuiltBy:   builtby,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// AppVersion prints the version information to stdout
+func AppVersion() {
+	if appver != "" {
+		fmt.Printf("App-Version: %s\n", appver)
+	}
+	if gitref != "" {
+		fmt.Printf("Git-Ref: %s\n", gitref)
+	}
+	if builddate != "" {
+		fmt.Printf("Build-Date: %s\n", builddate)
+	}
+	if builtby != "" {
+		fmt.Printf("Built-By: %s\n", builtby)
+	}
+	fmt.Printf("Go-Version: %s\n", runtime.Version())
+}
+
+// VersionRequest handles describing the running build, so that operators can
+// check which one is deployed.
+func (u *UserPreferencesApp) VersionRequest(writer http.ResponseWriter, r *http.Request) {
+	jsoned, err := json.Marshal(buildInfo())
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating version JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionRequest(t *testing.T) {
+	defer func(version, ref, date string) { appver, gitref, builddate = version, ref, date }(appver, gitref, builddate)
+	appver, gitref, builddate = "2.10.0", "abc123", ""
+
+	n := New(NewMockDB())
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var info versionInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	expected := versionInfo{
+		Service:   "user-preferences",
+		Version:   "2.10.0",
+		GitRef:    "abc123",
+		BuildDate: "unknown",
+		GoVersion: runtime.Version(),
+	}
+	if resp.StatusCode != http.StatusOK || info != expected {
+		t.Errorf("the version request returned %d: %+v", resp.StatusCode, info)
+	}
+	if header := resp.Header.Get(serviceVersionHeader); header != "2.10.0" {
+		t.Errorf("the version header was %q", header)
+	}
+
+	resp, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if header := resp.Header.Get(serviceVersionHeader); header != "2.10.0" {
+		t.Errorf("the version header on other responses was %q", header)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The versions of the API. Unversioned routes get version 1.
+const (
+	apiV1 = 1
+	apiV2 = 2
+)
+
+// apiVersionKey is the context key for the API version a request was made
+// with.
+type apiVersionKey struct{}
+
+// apiVersion returns the API version the request was made with.
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	return apiV1
+}
+
+// splitAPIVersion returns the API version named by the path's /v1 or /v2
+// prefix, along with the rest of the path. False is returned if the path
+// doesn't start with a version.
+func splitAPIVersion(path string) (int, string, bool) {
+	for _, version := range []int{apiV1, apiV2} {
+		prefix := fmt.Sprintf("/v%d", version)
+		switch {
+		case path == prefix:
+			return version, "/", true
+		case strings.HasPrefix(path, prefix+"/"):
+			return version, strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return 0, path, false
+}
+
+// withAPIVersion strips any version prefix from the request's URL and returns
+// the request with its API version recorded. Version 1 responses, including
+// those for unversioned routes, are marked as deprecated, with a link to the
+// same resource in version 2.
+func withAPIVersion(writer http.ResponseWriter, r *http.Request) *http.Request {
+	version, path, ok := splitAPIVersion(r.URL.Path)
+	if !ok {
+		version = apiV1
+	}
+
+	if version == apiV1 {
+		writer.Header().Set("Deprecation", "true")
+		writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, externalPath(r, "/v2"+path)))
+	}
+	if !ok {
+		return r
+	}
+
+	versioned := withPathPrefix(r, fmt.Sprintf("/v%d", version))
+	versioned = versioned.WithContext(context.WithValue(versioned.Context(), apiVersionKey{}, version))
+	u := *r.URL
+	u.Path = path
+	if u.RawPath != "" {
+		if _, u.RawPath, ok = splitAPIVersion(u.RawPath); !ok {
+			u.RawPath = ""
+		}
+	}
+	versioned.URL = &u
+	return versioned
+}
+
+// mergesOnPost returns whether a POST of the request's resource merges the
+// body into the stored document. Version 1 treats POST like PUT for presets,
+// group preferences, and sessions.
+func mergesOnPost(r *http.Request) bool {
+	return r.Method == http.MethodPost && apiVersion(r) >= apiV2
+}
+
+// postedValues returns the document to store for a write of a preset, group,
+// or session. The body of a version 2 POST is merged into the stored document,
+// which is "" if there isn't one yet; the body is returned unchanged for other
+// requests.
+func (u *UserPreferencesApp) postedValues(r *http.Request, stored string, values map[string]interface{}) (map[string]interface{}, error) {
+	if !mergesOnPost(r) {
+		return values, nil
+	}
+
+	existing, err := presetValues(stored)
+	if err != nil {
+		return nil, err
+	}
+	return deepMerge(existing, values, u.merge), nil
+}
+
+// apiError is the body of an error response in version 2 of the API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// structuredErrorWriter turns the plain text error responses written by the
+// handlers into JSON for version 2 of the API. Other responses are passed
+// through unchanged.
+type structuredErrorWriter struct {
+	http.ResponseWriter
+	status  int
+	message bytes.Buffer
+}
+
+func (w *structuredErrorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *structuredErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.message.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes out the structured error response, if there was one.
+func (w *structuredErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+
+	jsoned, err := json.Marshal(&apiError{
+		Status:  w.status,
+		Error:   http.StatusText(w.status),
+		Message: strings.TrimSpace(w.message.String()),
+	})
+	if err != nil {
+		jsoned = []byte(fmt.Sprintf(`{"status":%d}`, w.status))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(jsoned)
+}
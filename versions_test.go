@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitAPIVersion(t *testing.T) {
+	tests := []struct {
+		path     string
+		version  int
+		rest     string
+		versions bool
+	}{
+		{"/v1", apiV1, "/", true},
+		{"/v2/", apiV2, "/", true},
+		{"/v2/test-user/searches", apiV2, "/test-user/searches", true},
+		{"/v3/test-user", 0, "/v3/test-user", false},
+		{"/v2test-user", 0, "/v2test-user", false},
+		{"/test-user", 0, "/test-user", false},
+	}
+	for _, test := range tests {
+		version, rest, ok := splitAPIVersion(test.path)
+		if version != test.version || rest != test.rest || ok != test.versions {
+			t.Errorf("splitAPIVersion(%s) returned %d, %s, %t", test.path, version, rest, ok)
+		}
+	}
+}
+
+func TestAPIVersionRouting(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences("test-user", `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(mock))
+	defer server.Close()
+
+	for _, path := range []string{"/test-user", "/v1/test-user", "/v2/test-user"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s returned %d", path, resp.StatusCode)
+		}
+
+		deprecated := !strings.HasPrefix(path, "/v2")
+		if (resp.Header.Get("Deprecation") == "true") != deprecated {
+			t.Errorf("GET %s returned the Deprecation header %q", path, resp.Header.Get("Deprecation"))
+		}
+		if deprecated && resp.Header.Get("Link") != `</v2/test-user>; rel="successor-version"` {
+			t.Errorf("GET %s returned the Link header %q", path, resp.Header.Get("Link"))
+		}
+	}
+}
+
+func TestAPIVersionErrors(t *testing.T) {
+	server := httptest.NewServer(New(NewMockDB()))
+	defer server.Close()
+
+	status, body := doRequest(t, http.MethodGet, server.URL+"/v1/missing-user", nil, nil)
+	if status != http.StatusBadRequest || string(body) != "{\"user\":\"missing-user\"}\n" {
+		t.Errorf("GET of a missing user in v1 returned %d '%s'", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/v2/missing-user", nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET of a missing user in v2 returned %d '%s'", status, body)
+	}
+	var parsed apiError
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("the v2 error wasn't JSON: %s", body)
+	}
+	expected := apiError{Status: http.StatusNotFound, Error: "Not Found", Message: "User missing-user does not exist"}
+	if parsed != expected {
+		t.Errorf("the v2 error was %+v", parsed)
+	}
+
+	status, body = doRequest(t, http.MethodGet, server.URL+"/v2/sessions/missing", nil, nil)
+	if status != http.StatusNotFound || !strings.Contains(string(body), `"message":"Session does not exist or has expired"`) {
+		t.Errorf("GET of a missing session in v2 returned %d '%s'", status, body)
+	}
+}
+
+func TestAPIVersionPostMerges(t *testing.T) {
+	mock := NewMockDB()
+	n := New(mock)
+	n.adminKey = "secret"
+	server := httptest.NewServer(n)
+	defer server.Close()
+	admin := map[string]string{adminKeyHeader: "secret"}
+
+	mock.presets["dark"] = `{"theme":"dark","font":"large"}`
+	if status, body := doRequest(t, http.MethodPost, server.URL+"/v2/presets/dark", []byte(`{"font":"small","theme":null}`), admin); status != http.StatusOK {
+		t.Fatalf("POST of a preset in v2 returned %d '%s'", status, body)
+	}
+	if mock.presets["dark"] != `{"font":"small"}` {
+		t.Errorf("POST in v2 stored the preset %s", mock.presets["dark"])
+	}
+
+	if status, body := doRequest(t, http.MethodPost, server.URL+"/v1/presets/dark", []byte(`{"theme":"light"}`), admin); status != http.StatusOK {
+		t.Fatalf("POST of a preset in v1 returned %d '%s'", status, body)
+	}
+	if mock.presets["dark"] != `{"theme":"light"}` {
+		t.Errorf("POST in v1 stored the preset %s", mock.presets["dark"])
+	}
+
+	if status, body := doRequest(t, http.MethodPost, server.URL+"/v2/presets/new", []byte(`{"theme":"dark","font":null}`), admin); status != http.StatusOK {
+		t.Fatalf("POST of a new preset in v2 returned %d '%s'", status, body)
+	}
+	if mock.presets["new"] != `{"theme":"dark"}` {
+		t.Errorf("POST of a new preset in v2 stored %s", mock.presets["new"])
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+// The validation modes.
+const (
+	// validationEnforce rejects writes that don't match the model.
+	validationEnforce = "enforce"
+
+	// validationWarn stores writes that don't match the model, and lists the
+	// problems as warnings in the response.
+	validationWarn = "warn"
+)
+
+// The kinds of warnings returned for writes.
+const (
+	warningInvalid      = "invalid"
+	warningUnregistered = "unregistered-key"
+	warningDeprecated   = "deprecated-key"
+	warningNearQuota    = "near-quota"
+)
+
+// warningMetrics counts the warnings returned for writes by kind. It's
+// published at /debug/vars.
+var warningMetrics = expvar.NewMap("validation_warnings")
+
+// WriteWarning describes a problem with a write that didn't stop it from being
+// stored.
+type WriteWarning struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// parseValidationMode returns whether the validation mode only warns about
+// invalid writes.
+func parseValidationMode(mode string) (bool, error) {
+	switch mode {
+	case validationEnforce:
+		return false, nil
+	case validationWarn:
+		return true, nil
+	default:
+		return false, fmt.Errorf("The validation mode must be %s or %s, not %q", validationEnforce, validationWarn, mode)
+	}
+}
+
+// invalidWarnings converts the problems in a validation error into warnings.
+func invalidWarnings(err error) []WriteWarning {
+	invalid, ok := err.(*model.ValidationError)
+	if !ok {
+		return []WriteWarning{{Kind: warningInvalid, Message: err.Error()}}
+	}
+
+	warnings := make([]WriteWarning, len(invalid.Fields))
+	for i, field := range invalid.Fields {
+		warnings[i] = WriteWarning{Kind: warningInvalid, Key: field.Key, Message: field.Message}
+	}
+	return warnings
+}
+
+// quotaWarning returns a warning if a document of the given size uses at least
+// the configured fraction of the quota, or nil otherwise. Documents over the
+// quota are rejected when they're stored, so they aren't warned about.
+func (u *UserPreferencesApp) quotaWarning(size int) *WriteWarning {
+	if u.quota <= 0 || u.quotaWarningAt <= 0 || size > u.quota || float64(size) < u.quotaWarningAt*float64(u.quota) {
+		return nil
+	}
+	return &WriteWarning{
+		Kind:    warningNearQuota,
+		Message: fmt.Sprintf("The preferences use %d of the %d bytes allowed", size, u.quota),
+	}
+}
+
+// countWarnings adds the warnings to the metrics.
+func countWarnings(warnings []WriteWarning) {
+	for _, warning := range warnings {
+		warningMetrics.Add(warning.Kind, 1)
+	}
+}
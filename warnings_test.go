@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseValidationMode(t *testing.T) {
+	if warnOnly, err := parseValidationMode("enforce"); err != nil || warnOnly {
+		t.Errorf("parseValidationMode(enforce) returned %t, %v", warnOnly, err)
+	}
+	if warnOnly, err := parseValidationMode("warn"); err != nil || !warnOnly {
+		t.Errorf("parseValidationMode(warn) returned %t, %v", warnOnly, err)
+	}
+	if _, err := parseValidationMode("lenient"); err == nil {
+		t.Error("an unknown validation mode was accepted")
+	}
+}
+
+func TestQuotaWarning(t *testing.T) {
+	n := New(NewMockDB())
+	n.quota = 100
+	n.quotaWarningAt = 0.9
+
+	if warning := n.quotaWarning(89); warning != nil {
+		t.Errorf("a document well under the quota got a warning: %+v", warning)
+	}
+	if warning := n.quotaWarning(95); warning == nil || warning.Kind != warningNearQuota {
+		t.Errorf("a document near the quota got %+v", warning)
+	}
+	if warning := n.quotaWarning(101); warning != nil {
+		t.Errorf("a document over the quota got a warning: %+v", warning)
+	}
+
+	n.quotaWarningAt = 0
+	if warning := n.quotaWarning(95); warning != nil {
+		t.Errorf("a warning was returned while they were disabled: %+v", warning)
+	}
+}
+
+// writeWarnings returns the warnings in a write's response.
+func writeWarnings(t *testing.T, status int, body []byte) []WriteWarning {
+	if status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("the write returned %d: %s", status, body)
+	}
+	var parsed struct {
+		Warnings []WriteWarning `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Warnings
+}
+
+func TestWarnOnlyValidation(t *testing.T) {
+	username := "test-user"
+	mock := NewMockDB()
+	mock.users[username] = true
+	mock.registry["theme"] = RegisteredKey{Key: "theme", Owner: "ui-team"}
+	mock.registry["old-theme"] = RegisteredKey{Key: "old-theme", Owner: "ui-team", Deprecated: true, Replacement: "theme"}
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+	url := fmt.Sprintf("%s/%s", server.URL, username)
+
+	invalid := []byte(`{"defaultOutputFolder":12}`)
+	if status, body := doRequest(t, http.MethodPut, url, invalid, nil); status != http.StatusBadRequest {
+		t.Fatalf("an invalid write returned %d: %s", status, body)
+	}
+
+	n.warnOnly = true
+	status, body := doRequest(t, http.MethodPut, url, invalid, nil)
+	warnings := writeWarnings(t, status, body)
+	if len(warnings) == 0 || warnings[0].Kind != warningInvalid || warnings[0].Key == "" {
+		t.Errorf("the warnings for an invalid write were %+v", warnings)
+	}
+
+	status, body = doRequest(t, http.MethodPut, url, []byte(`{"theme":"dark"}`), nil)
+	if warnings = writeWarnings(t, status, body); len(warnings) != 0 {
+		t.Errorf("a valid write got warnings %+v", warnings)
+	}
+	if strings.Contains(string(body), `"warnings"`) {
+		t.Errorf("a write without warnings had a warnings array: %s", body)
+	}
+
+	n.warnUnregisteredKeys = true
+	n.warnDeprecatedKeys = true
+	n.quota = 60
+	n.quotaWarningAt = 0.5
+	status, body = doRequest(t, http.MethodPut, url, []byte(`{"theme":"dark","old-theme":"dark","mystery":1}`), nil)
+	kinds := map[string]string{}
+	for _, warning := range writeWarnings(t, status, body) {
+		kinds[warning.Kind] = warning.Key
+	}
+	expected := map[string]string{
+		warningUnregistered: "mystery",
+		warningDeprecated:   "old-theme",
+		warningNearQuota:    "",
+	}
+	for kind, key := range expected {
+		if actual, ok := kinds[kind]; !ok || actual != key {
+			t.Errorf("the %s warning was for %q, present %t", kind, actual, ok)
+		}
+	}
+}
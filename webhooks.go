@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+// testWebhookMessage is the text of the notification sent to test a webhook.
+const testWebhookMessage = "This is a test notification from the Discovery Environment."
+
+// WebhookPolicy restricts the webhooks users may save to the allowed hosts and
+// topics, and sends test notifications to them. A host pattern starting with
+// "*." also allows any subdomain. Empty lists allow anything.
+type WebhookPolicy struct {
+	hosts  []string
+	topics map[string]bool
+	client *http.Client
+}
+
+// NewWebhookPolicy returns a newly created *WebhookPolicy. Test notifications
+// give up after the timeout.
+func NewWebhookPolicy(hosts, topics []string, timeout time.Duration) *WebhookPolicy {
+	p := &WebhookPolicy{
+		hosts:  make([]string, 0, len(hosts)),
+		topics: make(map[string]bool, len(topics)),
+		client: outbound.client("webhooks", timeout),
+	}
+	for _, host := range hosts {
+		p.hosts = append(p.hosts, strings.ToLower(host))
+	}
+	for _, topic := range topics {
+		p.topics[topic] = true
+	}
+	return p
+}
+
+// allowedHost returns whether webhooks may post to the host.
+func (p *WebhookPolicy) allowedHost(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, pattern := range p.hosts {
+		if host == pattern || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the problems with the webhooks. The webhooks are expected to
+// have already been validated by the model, so only the allowlists are
+// checked.
+func (p *WebhookPolicy) check(hooks []model.Webhook) []model.FieldError {
+	var errs []model.FieldError
+
+	for i, hook := range hooks {
+		key := fmt.Sprintf("webhooks.%d", i)
+		if parsed, err := url.Parse(hook.URL); err == nil && !p.allowedHost(parsed.Hostname()) {
+			errs = append(errs, model.FieldError{Key: key + ".url", Message: fmt.Sprintf("webhooks may not post to %s", parsed.Hostname())})
+		}
+		if len(p.topics) == 0 {
+			continue
+		}
+		for _, topic := range hook.Topics {
+			if !p.topics[topic] {
+				errs = append(errs, model.FieldError{Key: key + ".topics", Message: fmt.Sprintf("unknown topic %s", topic)})
+			}
+		}
+	}
+
+	return errs
+}
+
+// webhookTestResult is the outcome of sending a test notification to a
+// webhook.
+type webhookTestResult struct {
+	URL        string `json:"url"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ElapsedMS  int64  `json:"elapsed_ms"`
+}
+
+// fire sends a test notification for the user to the webhook. Webhooks that
+// the allowlists reject aren't contacted.
+func (p *WebhookPolicy) fire(username string, hook model.Webhook) webhookTestResult {
+	result := webhookTestResult{URL: hook.URL}
+
+	if errs := p.check([]model.Webhook{hook}); len(errs) > 0 {
+		result.Error = errs[0].Message
+		return result
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":   testWebhookMessage,
+		"topic":  "test",
+		"user":   username,
+		"topics": hook.Topics,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := p.client.Post(hook.URL, "application/json", bytes.NewReader(payload))
+	result.ElapsedMS = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.OK = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !result.OK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		result.Error = fmt.Sprintf("The webhook returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return result
+}
+
+// webhookTestResponse is the JSON body returned after testing webhooks.
+type webhookTestResponse struct {
+	Results []webhookTestResult `json:"results"`
+}
+
+// WebhookTestRequest handles sending test notifications to webhooks. The body
+// may contain a webhook to test before it's saved; otherwise every webhook
+// in the user's stored preferences is tested. The response reports the
+// outcome for each webhook, so a failed test is still a 200.
+func (u *UserPreferencesApp) WebhookTestRequest(writer http.ResponseWriter, r *http.Request) {
+	username, ok := u.requireUser(writer, r)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := decodeBody(r.Body, &body); err != nil {
+		badRequest(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		return
+	}
+
+	var hooks []model.Webhook
+	if len(body) > 0 {
+		prefs, err := model.Decode(map[string]interface{}{"webhooks": []interface{}{body}})
+		if err != nil {
+			writeTypedRejection(writer, http.StatusBadRequest, "Invalid webhook", err)
+			return
+		}
+		hooks = prefs.Webhooks
+	} else {
+		stored, err := u.loadPreferences(username)
+		if err != nil {
+			errored(writer, err.Error())
+			return
+		}
+
+		prefs, err := model.Decode(stored)
+		if err != nil {
+			writeTypedRejection(writer, http.StatusUnprocessableEntity, fmt.Sprintf("The stored preferences for user %s don't match the model", username), err)
+			return
+		}
+		hooks = prefs.Webhooks
+	}
+
+	response := webhookTestResponse{Results: make([]webhookTestResult, len(hooks))}
+	for i, hook := range hooks {
+		response.Results[i] = u.webhooks.fire(username, hook)
+		if !response.Results[i].OK {
+			log.Infof("Test notification for user %s to %s failed: %s", username, hook.URL, response.Results[i].Error)
+		}
+	}
+
+	jsoned, err := json.Marshal(&response)
+	if err != nil {
+		errored(writer, fmt.Sprintf("Error generating webhook test JSON: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsoned)
+}
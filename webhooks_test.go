@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/user-preferences/model"
+)
+
+func TestWebhookPolicyCheck(t *testing.T) {
+	policy := NewWebhookPolicy([]string{"*.slack.com", "zapier.com"}, []string{"data", "apps"}, time.Second)
+	hooks := []model.Webhook{
+		{URL: "https://hooks.slack.com/services/x", Topics: []string{"data"}},
+		{URL: "https://Zapier.com/hooks/1", Topics: []string{"apps"}},
+		{URL: "https://evil.example.org/", Topics: []string{"data", "bogus"}},
+		{URL: "https://notslack.com/", Topics: []string{"apps"}},
+	}
+
+	expected := []model.FieldError{
+		{Key: "webhooks.2.url", Message: "webhooks may not post to evil.example.org"},
+		{Key: "webhooks.2.topics", Message: "unknown topic bogus"},
+		{Key: "webhooks.3.url", Message: "webhooks may not post to notslack.com"},
+	}
+	if errs := policy.check(hooks); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("check returned %#v", errs)
+	}
+
+	if errs := NewWebhookPolicy(nil, nil, time.Second).check(hooks); len(errs) != 0 {
+		t.Errorf("an empty policy returned %#v", errs)
+	}
+}
+
+func TestWebhookWriteValidation(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["alice"] = true
+
+	n := New(mock)
+	n.webhooks = NewWebhookPolicy([]string{"hooks.example.org"}, nil, time.Second)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	body := []byte(`{"webhooks":[{"url":"https://other.example.org/x","type":{"type":"Custom"},"topics":["data"]}]}`)
+	status, resBody := doRequest(t, http.MethodPut, server.URL+"/alice", body, nil)
+	if status != http.StatusBadRequest || !strings.Contains(string(resBody), "webhooks may not post to other.example.org") {
+		t.Errorf("a disallowed webhook returned %d: %s", status, resBody)
+	}
+
+	body = []byte(`{"webhooks":[{"url":"https://hooks.example.org/x","type":{"type":"Custom"},"topics":["data"]}]}`)
+	if status, resBody = doRequest(t, http.MethodPut, server.URL+"/alice", body, nil); status != http.StatusCreated {
+		t.Errorf("an allowed webhook returned %d: %s", status, resBody)
+	}
+}
+
+func TestWebhookTestRequest(t *testing.T) {
+	var payloads []map[string]interface{}
+	hooks := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+
+		if r.URL.Path == "/broken" {
+			http.Error(writer, "no such hook", http.StatusNotFound)
+		}
+	}))
+	defer hooks.Close()
+
+	mock := NewMockDB()
+	mock.users["alice"] = true
+	mock.insertPreferences("alice", `{"webhooks":[`+
+		`{"url":"`+hooks.URL+`/ok","type":{"type":"Slack"},"topics":["data"]},`+
+		`{"url":"`+hooks.URL+`/broken","type":{"type":"Slack"},"topics":["data"]}]}`)
+
+	n := New(mock)
+	server := httptest.NewServer(n.router)
+	defer server.Close()
+
+	url := server.URL + "/alice/webhooks/test"
+	status, body := doRequest(t, http.MethodPost, url, nil, nil)
+	var response webhookTestResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(response.Results) != 2 {
+		t.Fatalf("testing the stored webhooks returned %d: %s", status, body)
+	}
+	if !response.Results[0].OK || response.Results[0].StatusCode != http.StatusOK {
+		t.Errorf("the working webhook's result was %#v", response.Results[0])
+	}
+	if response.Results[1].OK || response.Results[1].Error != "The webhook returned 404: no such hook" {
+		t.Errorf("the broken webhook's result was %#v", response.Results[1])
+	}
+	if len(payloads) != 2 || payloads[0]["user"] != "alice" || payloads[0]["text"] != testWebhookMessage {
+		t.Errorf("the payloads were %#v", payloads)
+	}
+
+	status, body = doRequest(t, http.MethodPost, url, []byte(`{"url":"`+hooks.URL+`/new","type":{"type":"Zapier"},"topics":["apps"]}`), nil)
+	response = webhookTestResponse{}
+	json.Unmarshal(body, &response)
+	if status != http.StatusOK || len(response.Results) != 1 || !response.Results[0].OK {
+		t.Errorf("testing an unsaved webhook returned %d: %s", status, body)
+	}
+
+	if status, body = doRequest(t, http.MethodPost, url, []byte(`{"url":"not a url","type":{"type":"Zapier"},"topics":["apps"]}`), nil); status != http.StatusBadRequest {
+		t.Errorf("testing an invalid webhook returned %d: %s", status, body)
+	}
+}
+
+func TestWebhookTestDisallowed(t *testing.T) {
+	contacted := false
+	hooks := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		contacted = true
+	}))
+	defer hooks.Close()
+
+	result := NewWebhookPolicy([]string{"hooks.example.org"}, nil, time.Second).fire("alice", model.Webhook{URL: hooks.URL, Topics: []string{"data"}})
+	parsed, _ := url.Parse(hooks.URL)
+	if result.OK || contacted || result.Error != "webhooks may not post to "+parsed.Hostname() {
+		t.Errorf("a disallowed webhook returned %#v", result)
+	}
+}
+
+func TestConfigureWebhooks(t *testing.T) {
+	cfg := testConfig(t, "user-preferences:\n  webhooks:\n    allowed-hosts: [\"*.slack.com\"]\n    allowed-topics: [data]\n    timeout: 3s\n")
+	app := New(NewMockDB())
+	if err := configureApp(app, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(app.webhooks.hosts, []string{"*.slack.com"}) || !app.webhooks.topics["data"] || app.webhooks.client.Timeout != 3*time.Second {
+		t.Errorf("the webhook policy was %#v", app.webhooks)
+	}
+}